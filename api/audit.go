@@ -0,0 +1,302 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"Dowlet_projects/ecommerce/models"
+
+	"github.com/gorilla/mux"
+)
+
+// auditTarget describes which entity a mutating route touches
+type auditTarget struct {
+	entity string
+	// idVar is the mux variable holding the entity ID
+	idVar string
+	// self marks routes acting on the caller's own market or superadmin account
+	self bool
+	// responseKey is the JSON key holding the ID of a newly created entity
+	responseKey string
+}
+
+// auditTargets maps route templates of mutating admin routes to the entity they change
+var auditTargets = map[string]auditTarget{
+	"/api/superadmin/markets":                                  {entity: "markets", responseKey: "market_id"},
+	"/api/superadmin/markets/{id}":                             {entity: "markets", idVar: "id"},
+	"/api/superadmin/markets/{id}/categories":                  {entity: "market_categories", idVar: "id"},
+	"/api/superadmin/translations/{entity}/{id}":               {entity: "translations"},
+	"/api/superadmin/categories":                               {entity: "categories", responseKey: "category_id"},
+	"/api/superadmin/categories/{category_id}":                 {entity: "categories", idVar: "category_id"},
+	"/api/superadmin/banners":                                  {entity: "banners", responseKey: "banner.id"},
+	"/api/superadmin/banners/{id}":                             {entity: "banners", idVar: "id"},
+	"/api/superadmin/user-messages/{id}":                       {entity: "user_messages", idVar: "id"},
+	"/api/superadmin/market-messages/{id}":                     {entity: "market_messages", idVar: "id"},
+	"/api/superadmin/users/{id}":                               {entity: "users", idVar: "id"},
+	"/api/superadmin/conversations/{conversation_id}":          {entity: "conversations", idVar: "conversation_id"},
+	"/api/superadmin/conversations/{conversation_id}/messages": {entity: "conversations", idVar: "conversation_id"},
+	"/api/superadmin/conversations/{conversation_id}/read":     {entity: "conversations", idVar: "conversation_id"},
+	"/api/superadmin/conversations/{conversation_id}/status":   {entity: "conversations", idVar: "conversation_id"},
+	"/api/superadmin/jobs/{job_id}/retry":                      {entity: "jobs", idVar: "job_id"},
+	"/api/superadmin/reports/rollup":                           {entity: "jobs", responseKey: "job_id"},
+	"/api/superadmin/commission-rates":                         {entity: "commission_rates", responseKey: "rate_id"},
+	"/api/superadmin/commission-rates/{rate_id}":               {entity: "commission_rates", idVar: "rate_id"},
+	"/api/superadmin/payouts/statements":                       {entity: "payout_statements"},
+	"/api/superadmin/payouts/{statement_id}/paid":              {entity: "payout_statements", idVar: "statement_id"},
+	"/api/superadmin/superadmin-update":                        {entity: "superadmins", self: true},
+	"/api/market/products":                                     {entity: "products", responseKey: "product_id"},
+	"/api/market/products/import":                              {entity: "product_import_jobs", responseKey: "job_id"},
+	"/api/market/products/{product_id}":                        {entity: "products", idVar: "product_id"},
+	"/api/market/products/{id}/thumbnails":                     {entity: "products", idVar: "id"},
+	"/api/market/thumbnails/{thumbnail_id}/size":               {entity: "thumbnails", idVar: "thumbnail_id"},
+	"/api/market/thumbnails/{thumbnail_id}":                    {entity: "thumbnails", idVar: "thumbnail_id"},
+	"/api/market/sizes/{size_id}":                              {entity: "sizes", idVar: "size_id"},
+	"/api/market/markets/{id}/thumbnail":                       {entity: "markets", idVar: "id"},
+	"/api/market/profile":                                      {entity: "markets", self: true},
+	"/api/market/orders/{order_id}":                            {entity: "orders", idVar: "order_id"},
+	"/api/market/order-items/{item_id}/status":                 {entity: "order_items", idVar: "item_id"},
+	"/api/market/shipments":                                    {entity: "order_shipments", responseKey: "shipment_id"},
+	"/api/market/shipments/{shipment_id}/delivered":            {entity: "order_shipments", idVar: "shipment_id"},
+	"/api/market/returns/{return_id}/status":                   {entity: "return_requests", idVar: "return_id"},
+	"/api/market/messages":                                     {entity: "conversations", responseKey: "conversation_id"},
+	"/api/market/staff":                                        {entity: "market_staff", responseKey: "staff_id"},
+	"/api/market/staff/{staff_id}":                             {entity: "market_staff", idVar: "staff_id"},
+	"/api/market/staff/{staff_id}/password":                    {entity: "market_staff", idVar: "staff_id"},
+	"/api/market/password":                                     {entity: "market_staff", self: true},
+	"/api/market/products/{product_id}/variants":               {entity: "product_variants", responseKey: "variant.id"},
+	"/api/market/variants/{variant_id}":                        {entity: "product_variants", idVar: "variant_id"},
+	"/api/market/variants/{variant_id}/images":                 {entity: "product_variants", idVar: "variant_id"},
+	"/api/market/variant-images/{image_id}":                    {entity: "product_variant_images", idVar: "image_id"},
+	"/api/market/notifications/read-all":                       {entity: "notifications"},
+	"/api/market/notifications/{notification_id}/read":         {entity: "notifications", idVar: "notification_id"},
+	"/api/market/devices":                                      {entity: "device_tokens"},
+	"/api/market/conversations":                                {entity: "conversations", responseKey: "conversation_id"},
+	"/api/market/conversations/{conversation_id}/messages":     {entity: "conversations", idVar: "conversation_id"},
+	"/api/market/conversations/{conversation_id}/read":         {entity: "conversations", idVar: "conversation_id"},
+	"/api/market/conversations/{conversation_id}/status":       {entity: "conversations", idVar: "conversation_id"},
+	"/api/market/translations/{entity}/{id}":                   {entity: "translations"},
+}
+
+// auditActions maps HTTP methods to audit actions
+var auditActions = map[string]string{
+	http.MethodPost:   "create",
+	http.MethodPut:    "update",
+	http.MethodPatch:  "update",
+	http.MethodDelete: "delete",
+}
+
+// maxAuditResponseBody caps how much of a response is kept to resolve created entity IDs
+const maxAuditResponseBody = 64 << 10
+
+// auditResponseWriter records the status code and body of a response
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.body.Len() < maxAuditResponseBody {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// auditMiddleware records successful mutating requests of market admins and superadmins in audit_events.
+// It must run after authMiddleware so that claims are available.
+func (h *Handler) auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action, mutating := auditActions[r.Method]
+		claims, ok := r.Context().Value("claims").(*models.Claims)
+		if !mutating || !ok || (claims.Role != "superadmin" && claims.Role != "market_admin") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		target, known := auditTargets[route]
+		if !known {
+			target = auditTarget{entity: strings.Trim(route, "/")}
+		}
+
+		entityID := auditEntityID(r, claims, target)
+		var before json.RawMessage
+		if entityID != "" && action != "create" {
+			before = h.auditSnapshot(r.Context(), target.entity, entityID)
+		}
+
+		rec := &auditResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if rec.status >= http.StatusBadRequest {
+			return
+		}
+
+		if entityID == "" && target.responseKey != "" {
+			entityID = auditResponseID(rec.body.Bytes(), target.responseKey)
+		}
+
+		// The request context may already be done once the response is written; its values still
+		// tag the log records
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 5*time.Second)
+		defer cancel()
+
+		var after json.RawMessage
+		if entityID != "" {
+			after = h.auditSnapshot(ctx, target.entity, entityID)
+		}
+
+		actorID, actorRole := claims.UserID, claims.Role
+		if claims.StaffID != 0 {
+			actorID, actorRole = claims.StaffID, "market_staff"
+		}
+
+		event := models.AuditEvent{
+			ActorID:    actorID,
+			ActorRole:  actorRole,
+			MarketID:   claims.MarketID,
+			Action:     action,
+			EntityType: target.entity,
+			EntityID:   entityID,
+			Before:     before,
+			After:      after,
+			Route:      route,
+			Path:       r.URL.Path,
+			StatusCode: rec.status,
+			IP:         h.clientIP(r),
+			UserAgent:  truncate(r.UserAgent(), 255),
+		}
+		if err := h.db.CreateAuditEvent(ctx, event); err != nil {
+			slog.ErrorContext(ctx, "Failed to record audit event", "method", r.Method, "path", r.URL.Path, "error", err)
+		}
+	})
+}
+
+// auditEntityID resolves the ID of the entity a request targets
+func auditEntityID(r *http.Request, claims *models.Claims, target auditTarget) string {
+	vars := mux.Vars(r)
+	switch {
+	case target.self && target.entity == "market_staff":
+		return strconv.Itoa(claims.StaffID)
+	case target.self && claims.Role == "market_admin":
+		return strconv.Itoa(claims.MarketID)
+	case target.self:
+		return strconv.Itoa(claims.UserID)
+	case target.idVar != "":
+		return vars[target.idVar]
+	}
+	return ""
+}
+
+// auditSnapshot captures the state of an entity, logging rather than failing the request on errors
+func (h *Handler) auditSnapshot(ctx context.Context, entity, entityID string) json.RawMessage {
+	var snapshot json.RawMessage
+	var err error
+	if entity == "jobs" {
+		// Jobs live in Redis rather than in an SQL table
+		var job models.Job
+		if job, err = h.db.GetJob(ctx, entityID); err == nil {
+			snapshot, err = json.Marshal(job)
+		}
+	} else {
+		snapshot, err = h.db.SnapshotEntity(ctx, entity, entityID)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to snapshot entity for audit", "entity", entity, "entity_id", entityID, "error", err)
+		return nil
+	}
+	return snapshot
+}
+
+// auditResponseID extracts a created entity ID from a JSON response; key may be dotted (e.g. "banner.id")
+func auditResponseID(body []byte, key string) string {
+	var payload interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return ""
+	}
+	for _, part := range strings.Split(key, ".") {
+		obj, ok := payload.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		payload = obj[part]
+	}
+	switch v := payload.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatInt(int64(v), 10)
+	}
+	return ""
+}
+
+// clientIP returns the address of the client that sent a request. X-Forwarded-For and X-Real-IP
+// can be set by anyone, so they are only believed on connections from a trusted proxy; the client
+// is then the rightmost X-Forwarded-For address that is not a trusted proxy itself.
+func (h *Handler) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !containsIP(h.cfg.TrustedProxies, host) {
+		return host
+	}
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			host = strings.TrimSpace(hops[i])
+			if !containsIP(h.cfg.TrustedProxies, host) {
+				break
+			}
+		}
+		return host
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+		return realIP
+	}
+	return host
+}
+
+// containsIP reports whether an address belongs to one of the networks
+func containsIP(networks []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// truncate shortens s to at most n bytes
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
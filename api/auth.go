@@ -1,10 +1,10 @@
 package api
 
 import (
+	"log/slog"
 	"context"
 	"database/sql"
-	"encoding/json"
-	"fmt"
+	"errors"
 	"strings"
 	"net/http"
 	"regexp"
@@ -17,19 +17,19 @@ import (
 
 // RegisterRequest defines the request body for user registration
 type RegisterRequest struct {
-	FullName string `json:"full_name" example:"John Doe" description:"Full name of the user" validate:"required"`
-	Phone    string `json:"phone" example:"+12345678901" description:"Phone number in international format" validate:"required"`
+	FullName string `json:"full_name" example:"John Doe" description:"Full name of the user" validate:"required,max=255"`
+	Phone    string `json:"phone" example:"+12345678901" description:"Phone number in international format" validate:"required,phone"`
 }
 
 // LoginRequest defines the request body for login
 type LoginRequest struct {
-	Phone string `json:"phone" example:"+12345678901" description:"Phone number in international format" validate:"required"`
+	Phone string `json:"phone" example:"+12345678901" description:"Phone number in international format" validate:"required,phone"`
 }
 
 // VerifyCodeRequest defines the request body for verification
 type VerifyCodeRequest struct {
-	Phone string `json:"phone" example:"+12345678901" description:"Phone number in international format" validate:"required"`
-	Code  string `json:"code" example:"1234" description:"4-digit verification code" validate:"required,len=4"`
+	Phone string `json:"phone" example:"+12345678901" description:"Phone number in international format" validate:"required,phone"`
+	Code  string `json:"code" example:"1234" description:"4-digit verification code" validate:"required,len=4,numeric"`
 }
 
 // register handles user registration
@@ -42,29 +42,18 @@ type VerifyCodeRequest struct {
 // @Router /register [post]
 func (h *Handler) register(w http.ResponseWriter, r *http.Request) {
 	var req RegisterRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "Invalid request body")
-		return
-	}
-
-	// Validate input
-	if req.FullName == "" {
-		respondError(w, http.StatusBadRequest, "Full name is required")
-		return
-	}
-	if !validatePhone(req.Phone) {
-		respondError(w, http.StatusBadRequest, "Invalid phone number format")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
 	// Check if phone exists
-	_, err := h.db.GetUserByPhone(req.Phone)
+	_, err := h.db.GetUserByPhone(r.Context(), req.Phone)
 	if err == nil {
-		respondError(w, http.StatusConflict, "Phone number already registered")
+		respondServiceError(w, http.StatusConflict, services.ErrPhoneRegistered)
 		return
 	}
 	if err != sql.ErrNoRows {
-		fmt.Println(err)
+		slog.ErrorContext(r.Context(), "Failed to look up user by phone", "error", err)
 		respondError(w, http.StatusInternalServerError, "Database error")
 		return
 	}
@@ -92,25 +81,18 @@ func (h *Handler) register(w http.ResponseWriter, r *http.Request) {
 // @Router /login [post]
 func (h *Handler) login(w http.ResponseWriter, r *http.Request) {
 	var req LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "Invalid request body")
-		return
-	}
-
-	// Validate input
-	if !validatePhone(req.Phone) {
-		respondError(w, http.StatusBadRequest, "Invalid phone number format")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
 	// Check if phone exists
-	userID, err := h.db.GetUserByPhone(req.Phone)
+	userID, err := h.db.GetUserByPhone(r.Context(), req.Phone)
 	if err == sql.ErrNoRows {
 		respondError(w, http.StatusNotFound, "Phone number not registered")
 		return
 	}
 	if err != nil {
-		fmt.Println(err)
+		slog.ErrorContext(r.Context(), "Failed to look up user by phone", "error", err)
 		respondError(w, http.StatusInternalServerError, "Database error")
 		return
 	}
@@ -139,19 +121,13 @@ func (h *Handler) login(w http.ResponseWriter, r *http.Request) {
 // @Router /superadmin/login [post]
 func (h *Handler) loginSuperadmin(w http.ResponseWriter, r *http.Request) {
 	var req SuperadminRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "Error parsing JSON body")
-		return
-	}
-
-	if req.Username == "" || req.Password == "" {
-		respondError(w, http.StatusBadRequest, "Missing credentials")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
-	userID, err := h.db.AuthenticateSuperadmin(req.Username, req.Password)
+	userID, err := h.db.AuthenticateSuperadmin(r.Context(), req.Username, req.Password)
 	if err != nil {
-		respondError(w, http.StatusUnauthorized, err.Error())
+		respondServiceError(w, http.StatusUnauthorized, err)
 		return
 	}
 
@@ -174,23 +150,26 @@ func (h *Handler) loginSuperadmin(w http.ResponseWriter, r *http.Request) {
 // @Router /market/login [post]
 func (h *Handler) loginMarket(w http.ResponseWriter, r *http.Request) {
 	var req MarketRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "Error parsing JSON body")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
-	if req.Phone == "" || req.Password == "" {
-		respondError(w, http.StatusBadRequest, "Missing credentials")
+	var token string
+	userID, marketID, err := h.db.AuthenticateMarket(r.Context(), req.Phone, req.Password)
+	if err == nil {
+		token, err = h.generateJWT(userID, marketID, "market_admin")
+	} else if errors.Is(err, services.ErrInvalidCredentials) {
+		// Not the market's own login; try staff accounts
+		staff, staffErr := h.db.AuthenticateMarketStaff(r.Context(), req.Phone, req.Password)
+		if staffErr != nil {
+			respondError(w, http.StatusUnauthorized, staffErr.Error())
+			return
+		}
+		token, err = h.generateStaffJWT(staff)
+	} else {
+		respondServiceError(w, http.StatusUnauthorized, err)
 		return
 	}
-
-	userID, marketID, err := h.db.AuthenticateMarket(req.Phone, req.Password)
-	if err != nil {
-		respondError(w, http.StatusUnauthorized, err.Error())
-		return
-	}
-
-	token, err := h.generateJWT(userID, marketID, "market_admin")
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "Failed to generate token")
 		return
@@ -209,23 +188,17 @@ func (h *Handler) loginMarket(w http.ResponseWriter, r *http.Request) {
 // @Router /superadmin/register [post]
 func (h *Handler) registerSuperadmin(w http.ResponseWriter, r *http.Request) {
 	var req models.SuperadminRegisterRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "Error parsing JSON body")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
-	if req.Username == "" || req.FullName == "" || req.Phone == "" || req.Password == "" {
-		respondError(w, http.StatusBadRequest, "Missing required fields")
-		return
-	}
-
-	superadminID, err := h.db.RegisterSuperadmin(req.Username, req.FullName, req.Phone, req.Password)
+	superadminID, err := h.db.RegisterSuperadmin(r.Context(), req.Username, req.FullName, req.Phone, req.Password)
 	if err != nil {
-		if err.Error() == "username or phone already exists" {
-			respondError(w, http.StatusConflict, err.Error())
+		if errors.Is(err, services.ErrUsernameOrPhoneTaken) {
+			respondServiceError(w, http.StatusConflict, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -242,50 +215,39 @@ func (h *Handler) registerSuperadmin(w http.ResponseWriter, r *http.Request) {
 // @Router /verify [post]
 func (h *Handler) verifyCode(w http.ResponseWriter, r *http.Request) {
 	var req VerifyCodeRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "Invalid request body")
-		return
-	}
-
-	// Validate input
-	if !validatePhone(req.Phone) {
-		respondError(w, http.StatusBadRequest, "Invalid phone number format")
-		return
-	}
-	if len(req.Code) != 4 || !regexp.MustCompile(`^\d{4}$`).MatchString(req.Code) {
-		respondError(w, http.StatusBadRequest, "Invalid verification code")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
 	// Validate code
-	storedCode, expiresAt, fullName, err := h.db.GetVerificationCode(req.Phone)
+	storedCode, expiresAt, fullName, err := h.db.GetVerificationCode(r.Context(), req.Phone)
 	if err == sql.ErrNoRows {
-		respondError(w, http.StatusBadRequest, "No verification code found")
+		respondServiceError(w, http.StatusBadRequest, services.ErrNoVerificationCode)
 		return
 	}
 	if err != nil {
-		fmt.Println(err)
+		slog.ErrorContext(r.Context(), "Failed to fetch verification code", "error", err)
 		respondError(w, http.StatusInternalServerError, "Database error")
 		return
 	}
 
 	if time.Now().After(expiresAt) {
-		respondError(w, http.StatusBadRequest, "Verification code expired")
+		respondServiceError(w, http.StatusBadRequest, services.ErrVerificationCodeExpired)
 		return
 	}
 
 	if storedCode != req.Code {
-		respondError(w, http.StatusBadRequest, "Invalid verification code")
+		respondServiceError(w, http.StatusBadRequest, services.ErrInvalidVerificationCode)
 		return
 	}
 
 	// Check if user is already registered
-	userID, err := h.db.GetUserByPhone(req.Phone)
+	userID, err := h.db.GetUserByPhone(r.Context(), req.Phone)
 	var isRegistered bool
 	if err == nil {
 		isRegistered = true
 	} else if err != sql.ErrNoRows {
-		fmt.Println(err)
+		slog.ErrorContext(r.Context(), "Failed to look up user by phone", "error", err)
 		respondError(w, http.StatusInternalServerError, "Database error")
 		return
 	}
@@ -296,9 +258,9 @@ func (h *Handler) verifyCode(w http.ResponseWriter, r *http.Request) {
 			respondError(w, http.StatusBadRequest, "Missing registration data")
 			return
 		}
-		userID64, err := h.db.SaveUser(fullName, req.Phone)
+		userID64, err := h.db.SaveUser(r.Context(), fullName, req.Phone)
 		if err != nil {
-			fmt.Println(err)
+			slog.ErrorContext(r.Context(), "Failed to register user", "error", err)
 			respondError(w, http.StatusInternalServerError, "Failed to register user")
 			return
 		}
@@ -306,8 +268,8 @@ func (h *Handler) verifyCode(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Delete used code
-	if err := h.db.DeleteVerificationCode(req.Phone); err != nil {
-		fmt.Printf("Failed to delete verification code: %v\n", err.Error())
+	if err := h.db.DeleteVerificationCode(r.Context(), req.Phone); err != nil {
+		slog.WarnContext(r.Context(), "Failed to delete verification code", "error", err)
 	}
 
 	// Generate JWT
@@ -327,6 +289,10 @@ func (h *Handler) verifyCode(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		tokenStr := r.Header.Get("Authorization")
+		// EventSource cannot set headers, so event streams may pass the token in the query
+		if tokenStr == "" && r.Header.Get("Accept") == "text/event-stream" {
+			tokenStr = r.URL.Query().Get("access_token")
+		}
 		if tokenStr == "" {
 			respondError(w, http.StatusUnauthorized, "Authorization header missing")
 			return
@@ -388,3 +354,17 @@ func (h *Handler) generateJWT(userID, marketID int, role string) (string, error)
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString([]byte(h.cfg.JWTSecret))
 }
+
+// generateStaffJWT creates a market admin JWT carrying the staff member's identity
+func (h *Handler) generateStaffJWT(staff models.MarketStaff) (string, error) {
+	claims := &models.Claims{
+		UserID:    staff.MarketID,
+		MarketID:  staff.MarketID,
+		Role:      "market_admin",
+		StaffID:   staff.ID,
+		StaffRole: staff.Role,
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(h.cfg.JWTSecret))
+}
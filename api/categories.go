@@ -0,0 +1,195 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"Dowlet_projects/ecommerce/models"
+	"Dowlet_projects/ecommerce/services"
+
+	"github.com/gorilla/mux"
+)
+
+// getCategoryTree returns the active categories as a tree
+// @Summary     Get the category tree
+// @Description Returns the active categories as a tree, siblings in sort order. Inactive categories hide their subcategories. With market_id, only the categories the market sells in are kept, with their parent categories.
+// @Tags        Categories
+// @Produce     json
+// @Param       market_id query integer false "Only categories of this market"
+// @Param       lang      query string  false "Preferred locale; Accept-Language is used otherwise"
+// @Router      /categories/tree [get]
+func (h *Handler) getCategoryTree(w http.ResponseWriter, r *http.Request) {
+	marketID := 0
+	if v := r.URL.Query().Get("market_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id < 1 {
+			respondError(w, http.StatusBadRequest, "Invalid market_id")
+			return
+		}
+		marketID = id
+	}
+
+	tree, err := h.db.GetCategoryTree(r.Context(), marketID, false)
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := h.db.LocalizeCategories(r.Context(), requestLocales(r), tree); err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, tree)
+}
+
+// getSuperadminCategoryTree returns every category as a tree
+// @Summary     Get the full category tree
+// @Description Returns all categories as a tree, including inactive ones. Requires superadmin JWT authentication.
+// @Tags        Categories
+// @Produce     json
+// @Security    BearerAuth
+// @Router      /api/superadmin/categories/tree [get]
+func (h *Handler) getSuperadminCategoryTree(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireSuperadmin(w, r); !ok {
+		return
+	}
+
+	tree, err := h.db.GetCategoryTree(r.Context(), 0, true)
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, tree)
+}
+
+// updateCategory changes a category
+// @Summary     Update a category
+// @Description Changes the name, parent, slug, icon, sort order or active flag of a category. Only the fields sent are changed; parent_id 0 makes the category top-level. A category cannot be moved under itself or its subcategories. Requires superadmin JWT authentication.
+// @Tags        Categories
+// @Accept      json
+// @Produce     json
+// @Param       category_id path integer              true "Category ID"
+// @Param       request     body models.CategoryInput true "Fields to change"
+// @Security    BearerAuth
+// @Router      /api/superadmin/categories/{category_id} [put]
+func (h *Handler) updateCategory(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireSuperadmin(w, r); !ok {
+		return
+	}
+	categoryID, err := strconv.Atoi(mux.Vars(r)["category_id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid category ID")
+		return
+	}
+
+	var input models.CategoryInput
+	if !decodeJSON(w, r, &input) {
+		return
+	}
+
+	if err := h.db.UpdateCategory(r.Context(), categoryID, input); err != nil {
+		switch {
+		case errors.Is(err, services.ErrCategoryNotFound):
+			respondServiceError(w, http.StatusNotFound, err)
+		case errors.Is(err, services.ErrCategoryNameRequired), errors.Is(err, services.ErrInvalidSlug), errors.Is(err, services.ErrNoFieldsToUpdate),
+			errors.Is(err, services.ErrParentCategoryNotFound), errors.Is(err, services.ErrCategoryCycle):
+			respondServiceError(w, http.StatusBadRequest, err)
+		case errors.Is(err, services.ErrSlugTaken), errors.Is(err, services.ErrCategoryNameTaken):
+			respondServiceError(w, http.StatusConflict, err)
+		default:
+			respondServiceError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Category updated successfully"})
+}
+
+// getMarketCategoryAssignments lists the categories assigned to a market
+// @Summary     Get a market's categories
+// @Description Lists the categories a market may sell in; each allows its subcategories too. An empty list means the market is not restricted. Requires superadmin JWT authentication.
+// @Tags        Categories
+// @Produce     json
+// @Param       id path integer true "Market ID"
+// @Security    BearerAuth
+// @Router      /api/superadmin/markets/{id}/categories [get]
+func (h *Handler) getMarketCategoryAssignments(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireSuperadmin(w, r); !ok {
+		return
+	}
+	marketID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid market ID")
+		return
+	}
+
+	categories, err := h.db.GetMarketCategories(r.Context(), marketID)
+	if err != nil {
+		if errors.Is(err, services.ErrMarketNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
+			return
+		}
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, categories)
+}
+
+// setMarketCategoryAssignments replaces the categories assigned to a market
+// @Summary     Set a market's categories
+// @Description Replaces the categories a market may sell in; each allows its subcategories too. An empty list lifts the restriction. Existing products are kept, but new products and category changes must use an assigned category. Requires superadmin JWT authentication.
+// @Tags        Categories
+// @Accept      json
+// @Produce     json
+// @Param       id      path integer                          true "Market ID"
+// @Param       request body models.SetMarketCategoriesRequest true "Category IDs"
+// @Security    BearerAuth
+// @Router      /api/superadmin/markets/{id}/categories [put]
+func (h *Handler) setMarketCategoryAssignments(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireSuperadmin(w, r); !ok {
+		return
+	}
+	marketID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid market ID")
+		return
+	}
+
+	var req models.SetMarketCategoriesRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if err := h.db.SetMarketCategories(r.Context(), marketID, req.CategoryIDs); err != nil {
+		switch {
+		case errors.Is(err, services.ErrMarketNotFound), errors.Is(err, services.ErrCategoryNotFound):
+			respondServiceError(w, http.StatusNotFound, err)
+		default:
+			respondServiceError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Market categories updated successfully"})
+}
+
+// getMarketAdminCategoryTree returns the categories the caller's market may sell in
+// @Summary     Get the market's category tree
+// @Description Returns the active categories the market may sell in as a tree, with their parent categories. Requires market admin JWT authentication.
+// @Tags        Categories
+// @Produce     json
+// @Security    BearerAuth
+// @Router      /api/market/categories [get]
+func (h *Handler) getMarketAdminCategoryTree(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireMarketAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	tree, err := h.db.GetCategoryTree(r.Context(), claims.MarketID, false)
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, tree)
+}
@@ -0,0 +1,616 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"Dowlet_projects/ecommerce/models"
+	"Dowlet_projects/ecommerce/services"
+
+	"github.com/gorilla/mux"
+)
+
+// Limits of conversation messages
+const (
+	maxMessageAttachments = 5
+	maxMessageRequestSize = 25 << 20
+)
+
+// attachmentExtensions lists the accepted attachment content types and the extension they are stored with
+var attachmentExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+}
+
+// conversationParty resolves the side of conversations the caller takes part as.
+// Market staff act for their market; superadmins act as support.
+func conversationParty(claims *models.Claims) (string, int, bool) {
+	switch {
+	case claims.Role == "user" && claims.UserID != 0:
+		return models.RecipientUser, claims.UserID, true
+	case claims.Role == "market_admin" && claims.MarketID != 0:
+		return models.RecipientMarket, claims.MarketID, true
+	case claims.Role == "superadmin":
+		return models.ConversationPartySuperadmin, claims.UserID, true
+	}
+	return "", 0, false
+}
+
+// conversationPermission returns the market staff permission needed for conversations of a kind:
+// order chats follow the order permissions, support conversations need messages:write
+func conversationPermission(kind string, write bool) string {
+	if kind == models.ConversationKindOrder {
+		if write {
+			return permOrdersWrite
+		}
+		return permOrdersRead
+	}
+	return permMessagesWrite
+}
+
+// conversationAllowed reports whether the caller may read or write conversations of a kind.
+// Conversation routes are open to all staff; access is decided per conversation kind here.
+func conversationAllowed(claims *models.Claims, kind string, write bool) bool {
+	if claims.Role != "market_admin" || claims.StaffID == 0 {
+		return true
+	}
+	return staffHasPermission(claims.StaffRole, conversationPermission(kind, write))
+}
+
+// respondConversationError maps conversation service errors to HTTP responses
+func respondConversationError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrConversationNotFound), errors.Is(err, services.ErrOrderNotFound):
+		respondServiceError(w, http.StatusNotFound, err)
+	case errors.Is(err, services.ErrInvalidStatus):
+		respondError(w, http.StatusBadRequest, "Invalid status; must be open or resolved")
+	case errors.Is(err, services.ErrInvalidConversation):
+		respondError(w, http.StatusForbidden, "Forbidden")
+	default:
+		respondServiceError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// parseConversationMessage reads a conversation request sent as JSON or as multipart/form-data with
+// files in "attachments", and stores the attachments under uploads/messages.
+// On failure it responds itself and returns false; on success the caller owns the saved files.
+func parseConversationMessage(w http.ResponseWriter, r *http.Request) (models.CreateConversationRequest, []models.ConversationAttachment, []string, bool) {
+	var req models.CreateConversationRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxMessageRequestSize)
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if !decodeJSON(w, r, &req) {
+			return req, nil, nil, false
+		}
+	} else if !decodeForm(w, r, 10<<20, &req) {
+		return req, nil, nil, false
+	}
+	req.Subject = strings.TrimSpace(req.Subject)
+	req.Message = strings.TrimSpace(req.Message)
+
+	var files []*multipart.FileHeader
+	if r.MultipartForm != nil {
+		files = r.MultipartForm.File["attachments"]
+	}
+	if req.Message == "" && len(files) == 0 {
+		respondError(w, http.StatusBadRequest, "Message or attachment is required")
+		return req, nil, nil, false
+	}
+	if len(files) > maxMessageAttachments {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("At most %d attachments are allowed", maxMessageAttachments))
+		return req, nil, nil, false
+	}
+	if len(files) == 0 {
+		return req, nil, nil, true
+	}
+
+	attachments := make([]models.ConversationAttachment, 0, len(files))
+	var savedPaths []string
+	for _, fileHeader := range files {
+		saved, err := saveUploadedFile(fileHeader, "messages", attachmentExtensions, "JPEG, PNG, GIF, WebP and PDF")
+		if err != nil {
+			removeFiles(savedPaths)
+			respondUploadError(w, err)
+			return req, nil, nil, false
+		}
+		savedPaths = append(savedPaths, saved.path)
+		attachments = append(attachments, models.ConversationAttachment{
+			URL:         saved.url,
+			FileName:    saved.fileName,
+			ContentType: saved.contentType,
+			Size:        saved.size,
+		})
+	}
+
+	return req, attachments, savedPaths, true
+}
+
+// uploadedFile is a file saved under uploads/ from a multipart request
+type uploadedFile struct {
+	url         string
+	path        string
+	fileName    string
+	contentType string
+	size        int64
+}
+
+// uploadError is a failed upload with the response it should produce
+type uploadError struct {
+	status  int
+	message string
+}
+
+func (e *uploadError) Error() string {
+	return e.message
+}
+
+// respondUploadError responds with the status of an uploadError, or 500 for other errors
+func respondUploadError(w http.ResponseWriter, err error) {
+	if ue, ok := err.(*uploadError); ok {
+		respondError(w, ue.status, ue.message)
+		return
+	}
+	respondServiceError(w, http.StatusInternalServerError, err)
+}
+
+// saveUploadedFile stores an uploaded file under uploads/<dir> with a random name. The content type is
+// sniffed from the file and must be one of allowed, which maps it to the stored extension; allowedNames
+// lists the allowed types for the error message.
+func saveUploadedFile(fileHeader *multipart.FileHeader, dir string, allowed map[string]string, allowedNames string) (uploadedFile, error) {
+	if err := os.MkdirAll(filepath.Join("uploads", dir), 0755); err != nil {
+		return uploadedFile{}, &uploadError{http.StatusInternalServerError, "Error creating directory"}
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return uploadedFile{}, &uploadError{http.StatusInternalServerError, "Error opening file"}
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	contentType := http.DetectContentType(head[:n])
+	ext, ok := allowed[contentType]
+	if !ok {
+		return uploadedFile{}, &uploadError{http.StatusBadRequest, fmt.Sprintf("Unsupported file type %s; allowed are %s", contentType, allowedNames)}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return uploadedFile{}, &uploadError{http.StatusInternalServerError, "Error reading file"}
+	}
+
+	// Uploads are served publicly, so their names must not be guessable
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return uploadedFile{}, &uploadError{http.StatusInternalServerError, "Error saving file"}
+	}
+	filename := hex.EncodeToString(random) + ext
+	filePath := filepath.Join("uploads", dir, filename)
+	out, err := os.Create(filePath)
+	if err != nil {
+		return uploadedFile{}, &uploadError{http.StatusInternalServerError, "Error saving file"}
+	}
+	size, err := io.Copy(out, file)
+	out.Close()
+	if err != nil {
+		os.Remove(filePath)
+		return uploadedFile{}, &uploadError{http.StatusInternalServerError, "Error copying file"}
+	}
+
+	name := filepath.Base(fileHeader.Filename)
+	if len(name) > 255 {
+		name = name[len(name)-255:]
+	}
+	return uploadedFile{
+		url:         "/uploads/" + dir + "/" + filename,
+		path:        filePath,
+		fileName:    name,
+		contentType: contentType,
+		size:        size,
+	}, nil
+}
+
+// removeFiles deletes files saved for a request that failed
+func removeFiles(paths []string) {
+	for _, p := range paths {
+		os.Remove(p)
+	}
+}
+
+// conversationIDFromRequest parses the conversation_id path variable
+func conversationIDFromRequest(w http.ResponseWriter, r *http.Request) (int, bool) {
+	conversationID, err := strconv.Atoi(mux.Vars(r)["conversation_id"])
+	if err != nil || conversationID < 1 {
+		respondError(w, http.StatusBadRequest, "Invalid conversation ID")
+		return 0, false
+	}
+	return conversationID, true
+}
+
+// getConversations lists the caller's conversations
+// @Summary Get conversations
+// @Description Lists the conversations of the authenticated user or market, or the support conversations for superadmins, most recently active first. Each entry carries the last message and the number of messages the caller has not read.
+// @Tags Conversations
+// @Produce json
+// @Security BearerAuth
+// @Param kind query string false "Conversation kind (support, order); ignored for superadmins"
+// @Param status query string false "Conversation status (open, resolved)"
+// @Param page query integer false "Page number (default: 1)"
+// @Param limit query integer false "Items per page (default: 20, max: 100)"
+// @Router /api/conversations [get]
+// @Router /api/market/conversations [get]
+// @Router /api/superadmin/conversations [get]
+func (h *Handler) getConversations(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	partyType, partyID, ok := conversationParty(claims)
+	if !ok {
+		respondError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	query := r.URL.Query()
+	status := query.Get("status")
+	if status != "" && status != models.ConversationStatusOpen && status != models.ConversationStatusResolved {
+		respondError(w, http.StatusBadRequest, "Invalid status; must be open or resolved")
+		return
+	}
+
+	kind := query.Get("kind")
+	if kind != "" && kind != models.ConversationKindSupport && kind != models.ConversationKindOrder {
+		respondError(w, http.StatusBadRequest, "Invalid kind; must be support or order")
+		return
+	}
+	var kinds []string
+	if partyType != models.ConversationPartySuperadmin {
+		for _, k := range []string{models.ConversationKindSupport, models.ConversationKindOrder} {
+			if (kind == "" || kind == k) && conversationAllowed(claims, k, false) {
+				kinds = append(kinds, k)
+			}
+		}
+		if len(kinds) == 0 {
+			respondError(w, http.StatusForbidden, "Forbidden")
+			return
+		}
+	}
+
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit < 1 {
+		limit = 20
+	}
+	if limit > 100 {
+		limit = 100
+	}
+
+	conversations, totalCount, err := h.db.GetConversations(r.Context(), partyType, partyID, kinds, status, page, limit)
+	if err != nil {
+		respondConversationError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"items":       conversations,
+		"total_count": totalCount,
+		"page":        page,
+		"limit":       limit,
+	})
+}
+
+// createConversation opens a support conversation or an order conversation
+// @Summary Open a conversation
+// @Description Opens a support conversation (subject required) or, with cart_order_id, the conversation between the buyer and the shop about that order: users pass the market_id and markets the user_id of the order. Opening an existing order conversation again adds the message to it. Accepts JSON or multipart/form-data with up to 5 files in "attachments" (JPEG, PNG, GIF, WebP or PDF).
+// @Tags Conversations
+// @Accept json,mpfd
+// @Produce json
+// @Security BearerAuth
+// @Param body body models.CreateConversationRequest true "Conversation and its first message"
+// @Router /api/conversations [post]
+// @Router /api/market/conversations [post]
+func (h *Handler) createConversation(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	partyType, partyID, ok := conversationParty(claims)
+	if !ok || partyType == models.ConversationPartySuperadmin {
+		respondError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	req, attachments, savedPaths, ok := parseConversationMessage(w, r)
+	if !ok {
+		return
+	}
+
+	kind := models.ConversationKindSupport
+	if req.CartOrderID != 0 {
+		kind = models.ConversationKindOrder
+	}
+	if !conversationAllowed(claims, kind, true) {
+		removeFiles(savedPaths)
+		respondError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+	switch {
+	case kind == models.ConversationKindSupport && req.Subject == "":
+		removeFiles(savedPaths)
+		respondError(w, http.StatusBadRequest, "Subject is required")
+		return
+	case kind == models.ConversationKindOrder && partyType == models.RecipientUser && req.MarketID == 0:
+		removeFiles(savedPaths)
+		respondError(w, http.StatusBadRequest, "Market ID is required for order conversations")
+		return
+	case kind == models.ConversationKindOrder && partyType == models.RecipientMarket && req.UserID == 0:
+		removeFiles(savedPaths)
+		respondError(w, http.StatusBadRequest, "User ID is required for order conversations")
+		return
+	}
+
+	conversationID, message, err := h.db.OpenConversation(r.Context(), partyType, partyID, req, attachments)
+	if err != nil {
+		removeFiles(savedPaths)
+		respondConversationError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"message":              "Conversation started successfully",
+		"conversation_id":      conversationID,
+		"conversation_message": message,
+	})
+}
+
+// getConversation retrieves a conversation with its messages
+// @Summary Get a conversation
+// @Description Retrieves a conversation of the caller with its latest messages in chronological order, each with its attachments and whether the other side has read it. Pass before_id to page back through older messages.
+// @Tags Conversations
+// @Produce json
+// @Security BearerAuth
+// @Param conversation_id path integer true "Conversation ID"
+// @Param before_id query integer false "Only messages older than this message ID"
+// @Param limit query integer false "Number of messages (default: 50, max: 100)"
+// @Router /api/conversations/{conversation_id} [get]
+// @Router /api/market/conversations/{conversation_id} [get]
+// @Router /api/superadmin/conversations/{conversation_id} [get]
+func (h *Handler) getConversation(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	partyType, partyID, ok := conversationParty(claims)
+	if !ok {
+		respondError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+	conversationID, ok := conversationIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	beforeID, err := strconv.Atoi(query.Get("before_id"))
+	if err != nil || beforeID < 0 {
+		beforeID = 0
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit < 1 {
+		limit = 50
+	}
+	if limit > 100 {
+		limit = 100
+	}
+
+	conversation, messages, err := h.db.GetConversation(r.Context(), partyType, partyID, conversationID, beforeID, limit)
+	if err != nil {
+		respondConversationError(w, err)
+		return
+	}
+	if !conversationAllowed(claims, conversation.Kind, false) {
+		respondError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"conversation": conversation,
+		"messages":     messages,
+	})
+}
+
+// createConversationMessage replies to a conversation
+// @Summary Reply to a conversation
+// @Description Adds a message to a conversation of the caller; replying to a resolved conversation reopens it. The other side is notified. Accepts JSON with "message" or multipart/form-data with "message" and up to 5 files in "attachments" (JPEG, PNG, GIF, WebP or PDF).
+// @Tags Conversations
+// @Accept json,mpfd
+// @Produce json
+// @Security BearerAuth
+// @Param conversation_id path integer true "Conversation ID"
+// @Param message formData string false "Message text"
+// @Param attachments formData file false "Attachment"
+// @Router /api/conversations/{conversation_id}/messages [post]
+// @Router /api/market/conversations/{conversation_id}/messages [post]
+// @Router /api/superadmin/conversations/{conversation_id}/messages [post]
+func (h *Handler) createConversationMessage(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	partyType, partyID, ok := conversationParty(claims)
+	if !ok {
+		respondError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+	conversationID, ok := conversationIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	kind, err := h.db.ConversationKind(r.Context(), partyType, partyID, conversationID)
+	if err != nil {
+		respondConversationError(w, err)
+		return
+	}
+	if !conversationAllowed(claims, kind, true) {
+		respondError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	req, attachments, savedPaths, ok := parseConversationMessage(w, r)
+	if !ok {
+		return
+	}
+
+	message, err := h.db.AddConversationMessage(r.Context(), partyType, partyID, conversationID, req.Message, attachments)
+	if err != nil {
+		removeFiles(savedPaths)
+		respondConversationError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"message":              "Message sent successfully",
+		"conversation_message": message,
+	})
+}
+
+// markConversationRead marks a conversation as read by the caller
+// @Summary Mark a conversation as read
+// @Description Marks every message of a conversation as read by the caller's side, which the other side sees as read receipts.
+// @Tags Conversations
+// @Produce json
+// @Security BearerAuth
+// @Param conversation_id path integer true "Conversation ID"
+// @Router /api/conversations/{conversation_id}/read [put]
+// @Router /api/market/conversations/{conversation_id}/read [put]
+// @Router /api/superadmin/conversations/{conversation_id}/read [put]
+func (h *Handler) markConversationRead(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	partyType, partyID, ok := conversationParty(claims)
+	if !ok {
+		respondError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+	conversationID, ok := conversationIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	kind, err := h.db.ConversationKind(r.Context(), partyType, partyID, conversationID)
+	if err != nil {
+		respondConversationError(w, err)
+		return
+	}
+	if !conversationAllowed(claims, kind, false) {
+		respondError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	if err := h.db.MarkConversationRead(r.Context(), partyType, partyID, conversationID); err != nil {
+		respondConversationError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Conversation marked as read"})
+}
+
+// updateConversationStatus resolves or reopens a conversation
+// @Summary Update conversation status
+// @Description Marks a conversation of the caller as resolved or reopens it.
+// @Tags Conversations
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param conversation_id path integer true "Conversation ID"
+// @Param body body models.UpdateConversationStatusRequest true "New status (open, resolved)"
+// @Router /api/conversations/{conversation_id}/status [put]
+// @Router /api/market/conversations/{conversation_id}/status [put]
+// @Router /api/superadmin/conversations/{conversation_id}/status [put]
+func (h *Handler) updateConversationStatus(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	partyType, partyID, ok := conversationParty(claims)
+	if !ok {
+		respondError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+	conversationID, ok := conversationIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.UpdateConversationStatusRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	kind, err := h.db.ConversationKind(r.Context(), partyType, partyID, conversationID)
+	if err != nil {
+		respondConversationError(w, err)
+		return
+	}
+	if !conversationAllowed(claims, kind, true) {
+		respondError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	if err := h.db.SetConversationStatus(r.Context(), partyType, partyID, conversationID, req.Status); err != nil {
+		respondConversationError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Conversation status updated successfully"})
+}
+
+// deleteConversation deletes a support conversation
+// @Summary Delete a conversation
+// @Description Deletes a support conversation with its messages and attachments. Requires superadmin JWT authentication.
+// @Tags Conversations
+// @Produce json
+// @Security BearerAuth
+// @Param conversation_id path integer true "Conversation ID"
+// @Router /api/superadmin/conversations/{conversation_id} [delete]
+func (h *Handler) deleteConversation(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.Role != "superadmin" {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	conversationID, ok := conversationIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.db.DeleteConversation(r.Context(), conversationID); err != nil {
+		respondConversationError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Conversation deleted successfully"})
+}
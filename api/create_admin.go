@@ -2,7 +2,8 @@ package api
 
 
 import (
-	"encoding/json"
+	"errors"
+	"unicode/utf8"
 	"net/http"
 	"fmt"
 	"strconv"
@@ -16,6 +17,11 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// Upload limits of bulk product imports
+const (
+	maxImportFileSize    = 10 << 20
+	maxImportArchiveSize = 100 << 20
+)
 
 // createProduct creates a new product
 // @Summary Create a new product
@@ -42,49 +48,8 @@ func (h *Handler) createProduct(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Parse multipart form (max 10MB)
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		respondError(w, http.StatusBadRequest, "Error parsing form data")
-		return
-	}
-
-	// Get form fields
-	req := ProductRequest{
-		Name:          r.FormValue("name"),
-		NameRu:        r.FormValue("name_ru"),
-		Description:   r.FormValue("description"),
-		DescriptionRu: r.FormValue("description_ru"),
-	}
-	price, err := strconv.ParseFloat(r.FormValue("price"), 64)
-	if err != nil {
-		respondError(w, http.StatusBadRequest, "Invalid price")
-		return
-	}
-	req.Price = price
-
-	discount, err := strconv.ParseFloat(r.FormValue("discount"), 64)
-	if err != nil && r.FormValue("discount") != "" {
-		respondError(w, http.StatusBadRequest, "Invalid discount")
-		return
-	}
-	req.Discount = discount
-
-	categoryID, err := strconv.Atoi(r.FormValue("category_id"))
-	if err != nil {
-		respondError(w, http.StatusBadRequest, "Invalid category ID")
-		return
-	}
-	req.CategoryID = categoryID
-
-	isActive, err := strconv.ParseBool(r.FormValue("is_active"))
-	if err != nil && r.FormValue("is_active") != "" {
-		respondError(w, http.StatusBadRequest, "Invalid is_active value")
-		return
-	}
-	req.IsActive = isActive
-
-	// Validate required fields
-	if req.Name == "" || req.Price == 0 || req.CategoryID == 0 {
-		respondError(w, http.StatusBadRequest, "Missing required fields")
+	var req ProductRequest
+	if !decodeForm(w, r, 10<<20, &req) {
 		return
 	}
 
@@ -136,7 +101,11 @@ func (h *Handler) createProduct(w http.ResponseWriter, r *http.Request) {
 		filePath, filename)
 
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		if errors.Is(err, services.ErrCategoryNotFound) || errors.Is(err, services.ErrCategoryNotAssigned) {
+			respondServiceError(w, http.StatusBadRequest, err)
+			return
+		}
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -161,24 +130,28 @@ func (h *Handler) addProductThumbnails(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	err := r.ParseMultipartForm(10 << 20) // Max 10 MB
-	if err != nil {
-		respondError(w, http.StatusBadRequest, "Error parsing form")
+	var form ThumbnailsForm
+	if !decodeForm(w, r, 10<<20, &form) { // Max 10 MB
 		return
 	}
 
-	colors := r.FormValue("colors")
-	colors_ru := r.FormValue("colors_ru")
-	if colors == "" {
-		respondError(w, http.StatusBadRequest, "Colors are required")
-		return
+	colorList := strings.Split(form.Colors, ",")
+	colorList_ru := strings.Split(form.ColorsRu, ",")
+	var colorErrors []models.FieldError
+	for i, color := range colorList {
+		if utf8.RuneCountInString(color) > 50 {
+			colorErrors = append(colorErrors, fieldError(fmt.Sprintf("colors[%d]", i), "MAX_LENGTH", "50"))
+		}
 	}
-	if colors_ru == "" {
-		respondError(w, http.StatusBadRequest, "Colors_ru are required")
+	for i, color := range colorList_ru {
+		if utf8.RuneCountInString(color) > 50 {
+			colorErrors = append(colorErrors, fieldError(fmt.Sprintf("colors_ru[%d]", i), "MAX_LENGTH", "50"))
+		}
+	}
+	if len(colorErrors) > 0 {
+		respondValidationError(w, colorErrors...)
 		return
 	}
-	colorList := strings.Split(colors, ",")
-	colorList_ru := strings.Split(colors_ru, ",")
 	files := r.MultipartForm.File["thumbnails"]
 	if len(files) == 0 {
 		respondError(w, http.StatusBadRequest, "At least one thumbnail is required")
@@ -241,9 +214,9 @@ func (h *Handler) addProductThumbnails(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Save thumbnails to database
-	thumbnail_id, err := h.db.CreateThumbnails(thumbnails)
+	thumbnail_id, err := h.db.CreateThumbnails(r.Context(), thumbnails)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -279,23 +252,17 @@ func (h *Handler) addSizeByThumbnail(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req SizeRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "Error parsing JSON body")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
-	if req.Size == "" || req.Count <= 0 {
-		respondError(w, http.StatusBadRequest, "Missing or invalid fields")
-		return
-	}
-
-	err := h.db.CreateSizeByThumbnailID(claims.MarketID, thumbnailID, req.Size, req.Count, req.Price)
+	err := h.db.CreateSizeByThumbnailID(r.Context(), claims.MarketID, thumbnailID, req.Size, req.Count, req.Price)
 	if err != nil {
-		if err.Error() == "thumbnail not found or unauthorized" {
-			respondError(w, http.StatusNotFound, err.Error())
+		if errors.Is(err, services.ErrThumbnailNotOwned) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -351,9 +318,9 @@ func (h *Handler) uploadMarketThumbnail(w http.ResponseWriter, r *http.Request)
 	}
 
 	thumbnailURL := "/uploads/markets" + filename
-	err = h.db.UpdateMarketThumbnail(id, thumbnailURL)
+	err = h.db.UpdateMarketThumbnail(r.Context(), id, thumbnailURL)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -365,7 +332,7 @@ func (h *Handler) uploadMarketThumbnail(w http.ResponseWriter, r *http.Request)
 
 // createMarketMessage creates a new market message for superadmin
 // @Summary Create a new market message
-// @Description Creates a new message from a market to superadmin. Requires market admin JWT authentication.
+// @Description Creates a new message from a market to superadmin by opening a support conversation. Deprecated: use POST /api/market/conversations. Requires market admin JWT authentication.
 // @Tags Market Messages
 // @Accept json
 // @Produce json
@@ -385,42 +352,298 @@ func (h *Handler) createMarketMessage(w http.ResponseWriter, r *http.Request) {
 
 	// Parse request body
 	var req models.CreateMarketMessageRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "Error parsing JSON body")
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	// Open a support conversation with the message
+	conversationID, message, err := h.db.OpenConversation(r.Context(), models.RecipientMarket, claims.MarketID, models.CreateConversationRequest{
+		Subject:      "Support request",
+		Message:      req.Message,
+		ContactName:  req.FullName,
+		ContactPhone: req.Phone,
+	}, nil)
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"message":         "Market message sent successfully",
+		"message_id":      message.ID,
+		"conversation_id": conversationID,
+	})
+}
+
+// createMarketStaff invites a staff member to the market admin's market
+// @Summary Invite market staff
+// @Description Creates a staff account with a role (owner, catalog_manager, order_handler, viewer) and returns a temporary password. Requires market owner JWT authentication.
+// @Tags Market Staff
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body models.CreateMarketStaffRequest true "Staff details"
+// @Router /api/market/staff [post]
+func (h *Handler) createMarketStaff(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
+		if !ok {
+			respondError(w, http.StatusUnauthorized, "Unauthorized")
+		} else {
+			respondError(w, http.StatusForbidden, "Forbidden")
+		}
+		return
+	}
+
+	var req models.CreateMarketStaffRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	password, err := services.GenerateTempPassword()
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	staff, err := h.db.CreateMarketStaff(r.Context(), claims.MarketID, req.FullName, req.Phone, req.Role, password)
+	if err != nil {
+		if errors.Is(err, services.ErrPhoneTaken) {
+			respondServiceError(w, http.StatusConflict, err)
+			return
+		}
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"message":  "Staff member created successfully",
+		"staff":    staff,
+		"staff_id": staff.ID,
+		"password": password,
+	})
+}
+
+// respondVariantError maps product variant service errors to HTTP responses
+func respondVariantError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrProductNotOwned), errors.Is(err, services.ErrVariantNotOwned), errors.Is(err, services.ErrImageNotOwned):
+		respondServiceError(w, http.StatusNotFound, err)
+	case errors.Is(err, services.ErrSKUTaken):
+		respondServiceError(w, http.StatusConflict, err)
+	case errors.Is(err, services.ErrNoFieldsToUpdate), errors.Is(err, services.ErrSKURequired), errors.Is(err, services.ErrNegativeStock),
+		errors.Is(err, services.ErrNegativePrice), errors.Is(err, services.ErrAttributeRequired), errors.Is(err, services.ErrDuplicateAttribute):
+		respondServiceError(w, http.StatusBadRequest, err)
+	default:
+		respondServiceError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// createVariant adds a variant to a product
+// @Summary Create a product variant
+// @Description Creates a variant with its own SKU, barcode, price, compare-at price, stock and option values (e.g. color, size, material). Price defaults to the product price and SKU is generated when omitted. Requires market admin JWT authentication.
+// @Tags Product Variants
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param product_id path integer true "Product ID"
+// @Param body body models.CreateVariantRequest true "Variant details"
+// @Router /api/market/products/{product_id}/variants [post]
+func (h *Handler) createVariant(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	productID, err := strconv.Atoi(mux.Vars(r)["product_id"])
+	if err != nil || productID < 1 {
+		respondError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	var req models.CreateVariantRequest
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
-	// Validate input
-	if req.FullName == "" {
-		respondError(w, http.StatusBadRequest, "Full name is required")
+	variant, err := h.db.CreateVariant(r.Context(), claims.MarketID, productID, req)
+	if err != nil {
+		respondVariantError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"message": "Variant created successfully",
+		"variant": variant,
+	})
+}
+
+// addVariantImages uploads images for a variant
+// @Summary Add variant images
+// @Description Uploads one or more images for a product variant. Requires market admin JWT authentication.
+// @Tags Product Variants
+// @Accept multipart/form-data
+// @Produce json
+// @Security BearerAuth
+// @Param variant_id path integer true "Variant ID"
+// @Param images formData file true "Variant images"
+// @Router /api/market/variants/{variant_id}/images [post]
+func (h *Handler) addVariantImages(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
-	if len(req.FullName) > 50 {
-		respondError(w, http.StatusBadRequest, "Full name exceeds 50 characters")
+
+	variantID, err := strconv.Atoi(mux.Vars(r)["variant_id"])
+	if err != nil || variantID < 1 {
+		respondError(w, http.StatusBadRequest, "Invalid variant ID")
 		return
 	}
-	if req.Phone == "" {
-		respondError(w, http.StatusBadRequest, "Phone is required")
+
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		respondError(w, http.StatusBadRequest, "Error parsing form")
 		return
 	}
-	if len(req.Phone) > 20 {
-		respondError(w, http.StatusBadRequest, "Phone exceeds 20 characters")
+	files := r.MultipartForm.File["images"]
+	if len(files) == 0 {
+		respondError(w, http.StatusBadRequest, "At least one image is required")
 		return
 	}
-	if req.Message == "" {
-		respondError(w, http.StatusBadRequest, "Message is required")
+
+	if err := os.MkdirAll("uploads/products", 0755); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error creating directory")
 		return
 	}
 
-	// Create message in database
-	messageID, err := h.db.CreateMarketMessage(claims.MarketID, req)
+	var imageURLs []string
+	var savedPaths []string
+	for _, fileHeader := range files {
+		file, err := fileHeader.Open()
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Error opening file")
+			return
+		}
+
+		filename := fmt.Sprintf("%d-%s", time.Now().UnixNano(), filepath.Base(fileHeader.Filename))
+		filePath := filepath.Join("uploads/products", filename)
+		out, err := os.Create(filePath)
+		if err != nil {
+			file.Close()
+			respondError(w, http.StatusInternalServerError, "Error saving file")
+			return
+		}
+		_, err = io.Copy(out, file)
+		out.Close()
+		file.Close()
+		savedPaths = append(savedPaths, filePath)
+		if err != nil {
+			for _, p := range savedPaths {
+				os.Remove(p)
+			}
+			respondError(w, http.StatusInternalServerError, "Error copying file")
+			return
+		}
+
+		imageURLs = append(imageURLs, "/uploads/products/"+filename)
+	}
+
+	images, err := h.db.AddVariantImages(r.Context(), claims.MarketID, variantID, imageURLs)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		for _, p := range savedPaths {
+			os.Remove(p)
+		}
+		respondVariantError(w, err)
 		return
 	}
 
 	respondJSON(w, http.StatusCreated, map[string]interface{}{
-		"message":   "Market message sent successfully",
-		"message_id": messageID,
+		"message": "Variant images added successfully",
+		"images":  images,
+	})
+}
+
+// importProducts starts a bulk product import from a CSV or XLSX file
+// @Summary Import products
+// @Description Starts an asynchronous import of products, colors and sizes from a CSV or XLSX file using the same columns as the export. Each row is one variant; product columns are read from the first row of each product. Rows with a product_id or a known SKU update the catalog, other rows create products grouped by name. Images are /uploads paths, http(s) URLs or file names inside the optional images zip. Nothing is written if any row is invalid. With dry_run the file is only validated and a preview is produced. Poll the returned job for progress and row errors. Requires market admin JWT authentication.
+// @Tags Products
+// @Accept multipart/form-data
+// @Produce json
+// @Security BearerAuth
+// @Param file formData file true "CSV or XLSX file"
+// @Param images formData file false "Zip archive of images referenced by file name"
+// @Param dry_run formData boolean false "Validate and preview without writing"
+// @Router /api/market/products/import [post]
+func (h *Handler) importProducts(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		respondError(w, http.StatusBadRequest, "Error parsing form data")
+		return
+	}
+
+	file, fileHeader, err := r.FormFile("file")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Import file is required")
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxImportFileSize+1))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading file")
+		return
+	}
+	if len(data) > maxImportFileSize {
+		respondError(w, http.StatusRequestEntityTooLarge, "Import file is too large")
+		return
+	}
+
+	var imagesZip []byte
+	images, _, err := r.FormFile("images")
+	if err == nil {
+		defer images.Close()
+		imagesZip, err = io.ReadAll(io.LimitReader(images, maxImportArchiveSize+1))
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Error reading images archive")
+			return
+		}
+		if len(imagesZip) > maxImportArchiveSize {
+			respondError(w, http.StatusRequestEntityTooLarge, "Images archive is too large")
+			return
+		}
+	} else if err != http.ErrMissingFile {
+		respondError(w, http.StatusBadRequest, "Error accessing images archive")
+		return
+	}
+
+	dryRun, err := strconv.ParseBool(r.FormValue("dry_run"))
+	if err != nil && r.FormValue("dry_run") != "" {
+		respondError(w, http.StatusBadRequest, "Invalid dry_run value")
+		return
+	}
+
+	jobID, err := h.db.StartProductImport(r.Context(), claims.MarketID, claims.StaffID, fileHeader.Filename, data, imagesZip, dryRun)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrUnsupportedFileFormat):
+			respondError(w, http.StatusBadRequest, "Only CSV or XLSX files are supported")
+		case errors.Is(err, services.ErrInvalidImagesArchive):
+			respondServiceError(w, http.StatusBadRequest, err)
+		default:
+			respondServiceError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	respondJSON(w, http.StatusAccepted, map[string]interface{}{
+		"message": "Import started",
+		"job_id":  jobID,
+		"status":  models.ImportStatusQueued,
+		"dry_run": dryRun,
 	})
 }
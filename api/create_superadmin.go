@@ -1,16 +1,18 @@
 package api
 
 import (
+   "errors"
    "net/http"
    "Dowlet_projects/ecommerce/models"
-	//"Dowlet_projects/ecommerce/services"
+	"Dowlet_projects/ecommerce/services"
 	"fmt"
-	"strconv"
 	"io"
 	"os"
 	"path/filepath"
 	"time"
 	"strings"
+
+	"github.com/gorilla/mux"
 )
 
 
@@ -34,36 +36,12 @@ import (
 func (h *Handler) createMarket(w http.ResponseWriter, r *http.Request) {
 	claims, ok := r.Context().Value("claims").(*models.Claims)
 	if !ok || claims.Role != "superadmin" {
-		fmt.Println(claims)
 		respondError(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
-	err := r.ParseMultipartForm(10 << 20) // Max 10 MB
-	if err != nil {
-		respondError(w, http.StatusBadRequest, "Error parsing form")
-		return
-	}
-
-	name := r.FormValue("name")
-	name_ru := r.FormValue("name_ru")
-	phone := r.FormValue("phone")
-	password := r.FormValue("password")
-	location := r.FormValue("location")
-	location_ru := r.FormValue("location_ru")
-	// Get the form value as a string
-	deliveryPriceStr := r.FormValue("delivery_price")
-
-	// Convert the string to float64
-	deliveryPrice, err := strconv.ParseFloat(deliveryPriceStr, 64)
-	if err != nil {
-		// Handle the error (e.g., invalid input)
-		respondError(w, http.StatusInternalServerError, "error converting string to float64")
-		return
-	}
-
-	if name == "" || name_ru == "" || phone == "" || password == "" {
-		respondError(w, http.StatusBadRequest, "Missing required fields")
+	var form MarketCreateForm
+	if !decodeForm(w, r, 10<<20, &form) { // Max 10 MB
 		return
 	}
 
@@ -104,19 +82,19 @@ func (h *Handler) createMarket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	createdUsername, marketID, err := h.db.CreateMarket(r.Context(), name, name_ru, location, location_ru, thumbnailURL, phone, password, deliveryPrice)
+	createdUsername, marketID, err := h.db.CreateMarket(r.Context(), form.Name, form.NameRu, form.Location, form.LocationRu, thumbnailURL, form.Phone, form.Password, *form.DeliveryPrice)
 	if err != nil {
-		if err.Error() == "username or phone already exists" {
-			respondError(w, http.StatusConflict, err.Error())
+		if errors.Is(err, services.ErrPhoneTaken) {
+			respondServiceError(w, http.StatusConflict, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
 	respondJSON(w, http.StatusOK, map[string]string{
 		"username":  createdUsername,
-		"password":  password,
+		"password":  form.Password,
 		"market_id": marketID,
 	})
 }
@@ -131,6 +109,11 @@ func (h *Handler) createMarket(w http.ResponseWriter, r *http.Request) {
 // @Security BearerAuth
 // @Param name formData string true "Category name"
 // @Param name_ru formData string true "Category name_ru"
+// @Param parent_id formData integer false "Parent category ID; top-level when omitted"
+// @Param slug formData string false "URL slug (lower-case letters, digits and hyphens); derived from the name when omitted"
+// @Param icon_url formData string false "Icon URL"
+// @Param sort_order formData integer false "Position among sibling categories (default 0)"
+// @Param is_active formData boolean false "Whether the category is shown (default true)"
 // @Param thumbnail formData file false "Thumbnail image"
 // @Router /api/superadmin/categories [post]
 func (h *Handler) createCategory(w http.ResponseWriter, r *http.Request) {
@@ -140,16 +123,12 @@ func (h *Handler) createCategory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := r.ParseMultipartForm(10 << 20) // Max 10 MB
-	if err != nil {
-		respondError(w, http.StatusBadRequest, "Error parsing form")
+	var input models.CategoryInput
+	if !decodeForm(w, r, 10<<20, &input) { // Max 10 MB
 		return
 	}
-
-	name := r.FormValue("name")
-	name_ru := r.FormValue("name_ru")
-	if name == "" {
-		respondError(w, http.StatusBadRequest, "Category name is required")
+	if input.Name == nil {
+		respondValidationError(w, fieldError("name", "REQUIRED", ""))
 		return
 	}
 
@@ -190,13 +169,21 @@ func (h *Handler) createCategory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	categoryID, err := h.db.CreateCategory(name, name_ru, thumbnailURL)
+	categoryID, err := h.db.CreateCategory(r.Context(), input, thumbnailURL)
 	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidSlug), errors.Is(err, services.ErrParentCategoryNotFound):
+			respondServiceError(w, http.StatusBadRequest, err)
+			return
+		case errors.Is(err, services.ErrSlugTaken):
+			respondServiceError(w, http.StatusConflict, err)
+			return
+		}
 		if strings.Contains(err.Error(), "Duplicate entry") {
-			respondError(w, http.StatusConflict, "Category name already exists")
+			respondServiceError(w, http.StatusConflict, services.ErrCategoryNameTaken)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -225,20 +212,9 @@ func (h *Handler) createBanner(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse multipart form (max 10MB)
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		respondError(w, http.StatusBadRequest, "Failed to parse multipart form")
-		return
-	}
-
-	// Get description
-	req := models.CreateBannerRequest{
-		Description: r.FormValue("description"),
-	}
-
-	// Validate description length
-	if len(req.Description) > 255 {
-		respondError(w, http.StatusBadRequest, "Description exceeds 255 characters")
+	// Parse and validate the multipart form (max 10MB)
+	var req models.CreateBannerRequest
+	if !decodeForm(w, r, 10<<20, &req) {
 		return
 	}
 
@@ -292,11 +268,11 @@ func (h *Handler) createBanner(w http.ResponseWriter, r *http.Request) {
 	thumbnailURL1 := filepath.Join("/uploads/banners", filename)
 	thumbnailURL1 = strings.ReplaceAll(thumbnailURL1, string(filepath.Separator), "/")
 	// Create banner in database
-	banner, err := h.db.CreateBanner(req, thumbnailURL1)
+	banner, err := h.db.CreateBanner(r.Context(), req, thumbnailURL1)
 	if err != nil {
 		// Clean up uploaded file if database insert fails
 		os.Remove(dstPath)
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -304,4 +280,82 @@ func (h *Handler) createBanner(w http.ResponseWriter, r *http.Request) {
 		"message": "Banner created successfully",
 		"banner":  banner,
 	})
-}
\ No newline at end of file
+}
+// retryJob requeues a dead-lettered background job
+// @Summary     Retry a dead background job
+// @Description Moves a job from the dead-letter list back to the queue with a fresh set of attempts. Requires superadmin JWT authentication.
+// @Tags        Superadmin
+// @Produce     json
+// @Param       job_id path string true "Job ID"
+// @Security    BearerAuth
+// @Router      /api/superadmin/jobs/{job_id}/retry [post]
+func (h *Handler) retryJob(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.Role != "superadmin" {
+		if !ok {
+			respondError(w, http.StatusUnauthorized, "Unauthorized")
+		} else {
+			respondError(w, http.StatusForbidden, "Forbidden")
+		}
+		return
+	}
+
+	jobID := mux.Vars(r)["job_id"]
+	if err := h.db.RetryDeadJob(r.Context(), jobID); err != nil {
+		if errors.Is(err, services.ErrJobNotFound) {
+			respondError(w, http.StatusNotFound, "Job not found in dead-letter list")
+			return
+		}
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{
+		"message": "Job requeued successfully",
+		"job_id":  jobID,
+	})
+}
+
+// rollupReports queues a rebuild of the report tables
+// @Summary     Rebuild reports
+// @Description Queues a background job that rebuilds the report rollup tables for a date range, e.g. after correcting old orders. The nightly rollup only rebuilds the last 14 days. Poll the job with GET /api/superadmin/jobs/{job_id}. Requires superadmin JWT authentication.
+// @Tags        Reports
+// @Accept      json
+// @Produce     json
+// @Param       request body models.ReportRollupRequest true "Date range (YYYY-MM-DD, inclusive, at most 366 days)"
+// @Security    BearerAuth
+// @Router      /api/superadmin/reports/rollup [post]
+func (h *Handler) rollupReports(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.Role != "superadmin" {
+		if !ok {
+			respondError(w, http.StatusUnauthorized, "Unauthorized")
+		} else {
+			respondError(w, http.StatusForbidden, "Forbidden")
+		}
+		return
+	}
+
+	var req models.ReportRollupRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	// Both dates passed the date rule
+	from, _ := time.Parse("2006-01-02", req.From)
+	to, _ := time.Parse("2006-01-02", req.To)
+
+	jobID, err := h.db.EnqueueReportRollup(r.Context(), from, to)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidPeriod) || errors.Is(err, services.ErrRollupRangeTooLong) {
+			respondServiceError(w, http.StatusBadRequest, err)
+			return
+		}
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusAccepted, map[string]string{
+		"message": "Report rollup queued",
+		"job_id":  jobID,
+	})
+}
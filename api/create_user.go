@@ -3,8 +3,8 @@ package api
 import (
 	"net/http"
 	"Dowlet_projects/ecommerce/models"
-	"encoding/json"
-	"strings"
+	"Dowlet_projects/ecommerce/services"
+	"errors"
 	"strconv"
 	"github.com/gorilla/mux"
 )
@@ -26,23 +26,17 @@ func (h *Handler) toggleFavorite(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req FavoriteRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "Error parsing JSON body")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
-	if req.ProductID <= 0 {
-		respondError(w, http.StatusBadRequest, "Invalid product ID")
-		return
-	}
-
-	isFavorite, err := h.db.ToggleFavoriteProduct(claims.UserID, req.ProductID)
+	isFavorite, err := h.db.ToggleFavoriteProduct(r.Context(), claims.UserID, req.ProductID)
 	if err != nil {
-		if err.Error() == "product not found" {
-			respondError(w, http.StatusNotFound, err.Error())
+		if errors.Is(err, services.ErrProductNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -67,23 +61,26 @@ func (h *Handler) addToCart(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req models.CartRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "Error parsing JSON body")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
-
-	if req.ProductID <= 0 || req.ThumbnailID <= 0 || req.SizeID <= 0 || req.Count <= 0 {
-		respondError(w, http.StatusBadRequest, "Invalid or missing product_id, thumbnail_id, size_id, or count")
+	// Legacy clients identify the variant by thumbnail and size
+	if req.VariantID == 0 && (req.ThumbnailID == 0 || req.SizeID == 0) {
+		respondValidationError(w, fieldError("variant_id", "REQUIRED", ""))
 		return
 	}
 
-	cartOrderID, err := h.db.AddToCart(claims.UserID, req)
+	cartOrderID, err := h.db.AddToCart(r.Context(), claims.UserID, req)
 	if err != nil {
-		if strings.Contains(err.Error(), "invalid") {
-			respondError(w, http.StatusBadRequest, err.Error())
+		if errors.Is(err, services.ErrCartInvalidProduct) || errors.Is(err, services.ErrCartInvalidVariant) || errors.Is(err, services.ErrCartInvalidCount) {
+			respondServiceError(w, http.StatusBadRequest, err)
+			return
+		}
+		if errors.Is(err, services.ErrInsufficientStock) {
+			respondServiceError(w, http.StatusConflict, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -109,23 +106,17 @@ func (h *Handler) addLocation(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req LocationRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "Error parsing JSON body")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
-	if req.LocationName == "" || req.LocationAddress == "" {
-		respondError(w, http.StatusBadRequest, "Location name and address are required")
-		return
-	}
-
-	locationID, err := h.db.CreateLocation(claims.UserID, req.LocationName, req.LocationNameRu, req.LocationAddress, req.LocationAddressRu)
+	locationID, err := h.db.CreateLocation(r.Context(), claims.UserID, req.LocationName, req.LocationNameRu, req.LocationAddress, req.LocationAddressRu)
 	if err != nil {
-		if err.Error() == "location name already exists for user" {
-			respondError(w, http.StatusConflict, err.Error())
+		if errors.Is(err, services.ErrLocationNameTaken) {
+			respondServiceError(w, http.StatusConflict, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -135,7 +126,7 @@ func (h *Handler) addLocation(w http.ResponseWriter, r *http.Request) {
 
 // createOrder submits an order for a cart
 // @Summary Create order
-// @Description Submits an order for a cart order with location and user details. Requires user JWT authentication.
+// @Description Submits an order for a cart order with location and user details. The cart becomes one order per market; order_ids lists them and order_id is the first. Requires user JWT authentication.
 // @Tags Orders
 // @Accept json
 // @Produce json
@@ -159,37 +150,31 @@ func (h *Handler) createOrder(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req OrderRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "Error parsing JSON body")
-		return
-	}
-
-	if req.LocationID <= 0 || req.Name == "" || req.Phone == "" {
-		respondError(w, http.StatusBadRequest, "Missing required fields")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
-	orderID, err := h.db.CreateOrder(claims.UserID, cartOrderID, req.LocationID, req.Name, req.Phone, req.Notes)
+	orderIDs, err := h.db.CreateOrder(r.Context(), claims.UserID, cartOrderID, req.LocationID, req.Name, req.Phone, req.Notes)
 	if err != nil {
-		if err.Error() == "cart not found or not owned by user" || err.Error() == "location not found or not owned by user" {
-			respondError(w, http.StatusNotFound, err.Error())
+		if errors.Is(err, services.ErrCartNotFound) || errors.Is(err, services.ErrLocationNotOwned) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
-		if err.Error() == "order already exists for this cart" {
-			respondError(w, http.StatusConflict, err.Error())
+		if errors.Is(err, services.ErrOrderExists) || errors.Is(err, services.ErrInsufficientStock) {
+			respondServiceError(w, http.StatusConflict, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	respondJSON(w, http.StatusOK, map[string]int{"order_id": orderID})
+	respondJSON(w, http.StatusOK, map[string]interface{}{"order_id": orderIDs[0], "order_ids": orderIDs})
 }
 
 
 // createMessage creates a new user message for superadmin
 // @Summary Create a new message
-// @Description Creates a new message to superadmin. Requires user JWT authentication.
+// @Description Creates a new message to superadmin by opening a support conversation. Deprecated: use POST /api/conversations. Requires user JWT authentication.
 // @Tags User Messages
 // @Accept json
 // @Produce json
@@ -205,42 +190,25 @@ func (h *Handler) createMessage(w http.ResponseWriter, r *http.Request) {
 
 	// Parse request body
 	var req models.CreateMessageRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "Error parsing JSON body")
-		return
-	}
-
-	// Validate input
-	if req.FullName == "" {
-		respondError(w, http.StatusBadRequest, "Full name is required")
-		return
-	}
-	if len(req.FullName) > 50 {
-		respondError(w, http.StatusBadRequest, "Full name exceeds 50 characters")
-		return
-	}
-	if req.Phone == "" {
-		respondError(w, http.StatusBadRequest, "Phone is required")
-		return
-	}
-	if len(req.Phone) > 20 {
-		respondError(w, http.StatusBadRequest, "Phone exceeds 20 characters")
-		return
-	}
-	if req.Message == "" {
-		respondError(w, http.StatusBadRequest, "Message is required")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
-	// Create message in database
-	messageID, err := h.db.CreateMessage(claims.UserID, req)
+	// Open a support conversation with the message
+	conversationID, message, err := h.db.OpenConversation(r.Context(), models.RecipientUser, claims.UserID, models.CreateConversationRequest{
+		Subject:      "Support request",
+		Message:      req.Message,
+		ContactName:  req.FullName,
+		ContactPhone: req.Phone,
+	}, nil)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
 	respondJSON(w, http.StatusCreated, map[string]interface{}{
-		"message":   "Message sent successfully",
-		"message_id": messageID,
+		"message":         "Message sent successfully",
+		"message_id":      message.ID,
+		"conversation_id": conversationID,
 	})
 }
\ No newline at end of file
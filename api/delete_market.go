@@ -1,8 +1,10 @@
 package api
 
 import (
+	"errors"
 	"net/http"
 	"Dowlet_projects/ecommerce/models"
+	"Dowlet_projects/ecommerce/services"
 	"github.com/gorilla/mux"
 	"strconv"
 )
@@ -32,11 +34,11 @@ func (h *Handler) deleteProduct(w http.ResponseWriter, r *http.Request) {
 
 	err = h.db.DeleteProduct(r.Context(), claims.MarketID, productID)
 	if err != nil {
-		if err.Error() == "product not found or unauthorized" {
-			respondError(w, http.StatusNotFound, err.Error())
+		if errors.Is(err, services.ErrProductNotOwned) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -66,13 +68,13 @@ func (h *Handler) deleteSizeByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := h.db.DeleteSizeByID(claims.MarketID, sizeID)
+	err := h.db.DeleteSizeByID(r.Context(), claims.MarketID, sizeID)
 	if err != nil {
-		if err.Error() == "size not found or unauthorized" {
-			respondError(w, http.StatusNotFound, err.Error())
+		if errors.Is(err, services.ErrSizeNotOwned) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -80,9 +82,9 @@ func (h *Handler) deleteSizeByID(w http.ResponseWriter, r *http.Request) {
 }
 
 
-// deleteOrderByID deletes a order
-// @Summary Delete a order by ID
-// @Description Deletes a order by its ID. Requires JWT authentication.
+// deleteOrderByID cancels an order
+// @Summary Cancel an order by ID
+// @Description Cancels the items of an order that are still being fulfilled and returns their stock; the order is kept as canceled. Delivered items are not affected. Requires JWT authentication.
 // @Tags Orders
 // @Produce json
 // @Security BearerAuth
@@ -102,17 +104,21 @@ func (h *Handler) deleteOrderByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := h.db.DeleteOrderByID(claims.MarketID, orderID)
+	err := h.db.DeleteOrderByID(r.Context(), claims.MarketID, orderID)
 	if err != nil {
-		if err.Error() == "order not found or unauthorized" {
-			respondError(w, http.StatusNotFound, err.Error())
+		if errors.Is(err, services.ErrOrderNotInMarket) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		if errors.Is(err, services.ErrOrderHasNoOpenItems) {
+			respondServiceError(w, http.StatusConflict, err)
+			return
+		}
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	respondJSON(w, http.StatusOK, map[string]string{"message": "Order deleted successfully"})
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Order canceled successfully"})
 }
 
 
@@ -138,15 +144,72 @@ func (h *Handler) deleteThumbnail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := h.db.DeleteThumbnail(claims.MarketID, thumbnailID)
+	err := h.db.DeleteThumbnail(r.Context(), claims.MarketID, thumbnailID)
 	if err != nil {
-		if err.Error() == "thumbnail not found or unauthorized" {
-			respondError(w, http.StatusNotFound, err.Error())
+		if errors.Is(err, services.ErrThumbnailNotOwned) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
 	respondJSON(w, http.StatusOK, map[string]string{"message": "Thumbnail deleted successfully"})
-}
\ No newline at end of file
+}
+// deleteVariant deletes a product variant
+// @Summary Delete a product variant
+// @Description Deletes a variant and its images. Carts holding the variant lose it; past orders keep their snapshot. Requires market admin JWT authentication.
+// @Tags Product Variants
+// @Produce json
+// @Security BearerAuth
+// @Param variant_id path integer true "Variant ID"
+// @Router /api/market/variants/{variant_id} [delete]
+func (h *Handler) deleteVariant(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	variantID, err := strconv.Atoi(mux.Vars(r)["variant_id"])
+	if err != nil || variantID < 1 {
+		respondError(w, http.StatusBadRequest, "Invalid variant ID")
+		return
+	}
+
+	if err := h.db.DeleteVariant(r.Context(), claims.MarketID, variantID); err != nil {
+		respondVariantError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Variant deleted successfully"})
+}
+
+// deleteVariantImage deletes an image of a product variant
+// @Summary Delete a variant image
+// @Description Deletes a single variant image. Requires market admin JWT authentication.
+// @Tags Product Variants
+// @Produce json
+// @Security BearerAuth
+// @Param image_id path integer true "Variant image ID"
+// @Router /api/market/variant-images/{image_id} [delete]
+func (h *Handler) deleteVariantImage(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	imageID, err := strconv.Atoi(mux.Vars(r)["image_id"])
+	if err != nil || imageID < 1 {
+		respondError(w, http.StatusBadRequest, "Invalid image ID")
+		return
+	}
+
+	if err := h.db.DeleteVariantImage(r.Context(), claims.MarketID, imageID); err != nil {
+		respondVariantError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Variant image deleted successfully"})
+}
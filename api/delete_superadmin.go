@@ -2,8 +2,9 @@ package api
 
 import (
 	"Dowlet_projects/ecommerce/models"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -11,7 +12,7 @@ import (
 	"strings"
 
 	"github.com/gorilla/mux"
-	//"Dowlet_projects/ecommerce/services"
+	"Dowlet_projects/ecommerce/services"
 )
 
 // deleteMarket deletes a market
@@ -37,13 +38,13 @@ func (h *Handler) deleteMarket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.db.DeleteMarket(marketID)
+	err = h.db.DeleteMarket(r.Context(), marketID)
 	if err != nil {
-		if err.Error() == "market not found" {
-			respondError(w, http.StatusNotFound, err.Error())
+		if errors.Is(err, services.ErrMarketNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -53,7 +54,7 @@ func (h *Handler) deleteMarket(w http.ResponseWriter, r *http.Request) {
 
 // deleteCategory deletes a category and its thumbnail
 // @Summary Delete a category
-// @Description Deletes a category and its thumbnail image. Requires superadmin JWT authentication.
+// @Description Deletes a category and its thumbnail image. Categories with subcategories or products cannot be deleted. Requires superadmin JWT authentication.
 // @Tags Categories
 // @Produce json
 // @Security BearerAuth
@@ -74,17 +75,21 @@ func (h *Handler) deleteCategory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.db.DeleteCategory(categoryID)
+	err = h.db.DeleteCategory(r.Context(), categoryID)
 	if err != nil {
-		if err.Error() == "category not found" {
-			respondError(w, http.StatusNotFound, err.Error())
+		if errors.Is(err, services.ErrCategoryNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
+			return
+		}
+		if errors.Is(err, services.ErrCategoryHasChildren) {
+			respondError(w, http.StatusConflict, "Category has subcategories; move or delete them first")
 			return
 		}
 		if strings.Contains(err.Error(), "FOREIGN KEY") {
 			respondError(w, http.StatusConflict, "Category has associated products")
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -127,11 +132,11 @@ func (h *Handler) deleteBanner(w http.ResponseWriter, r *http.Request) {
     // Delete banner and get thumbnail URL
     thumbnailURL, err := h.db.DeleteBanner(r.Context(), bannerID)
     if err != nil {
-        if err.Error() == "banner not found" {
-            respondError(w, http.StatusNotFound, err.Error())
+        if errors.Is(err, services.ErrBannerNotFound) {
+            respondServiceError(w, http.StatusNotFound, err)
             return
         }
-        respondError(w, http.StatusInternalServerError, err.Error())
+        respondServiceError(w, http.StatusInternalServerError, err)
         return
     }
 
@@ -143,7 +148,7 @@ func (h *Handler) deleteBanner(w http.ResponseWriter, r *http.Request) {
 
     // Ensure upload directory exists
     if _, err := os.Stat(uploadDir); os.IsNotExist(err) {
-        log.Printf("Upload directory does not exist: %s", uploadDir)
+        slog.WarnContext(r.Context(), "Upload directory does not exist", "dir", uploadDir)
         respondJSON(w, http.StatusOK, map[string]string{
             "message": "Banner deleted successfully, but upload directory not found",
         })
@@ -159,17 +164,17 @@ func (h *Handler) deleteBanner(w http.ResponseWriter, r *http.Request) {
         // Check if file exists
         if _, err := os.Stat(filePath); err == nil {
             if err := os.Remove(filePath); err != nil {
-                log.Printf("Failed to delete thumbnail at %s: %v", filePath, err)
+                slog.ErrorContext(r.Context(), "Failed to delete thumbnail", "path", filePath, "error", err)
                 respondError(w, http.StatusInternalServerError, fmt.Sprintf("failed to delete thumbnail: %v", err))
                 return
             }
-            log.Printf("Deleted thumbnail: %s", filePath)
+            slog.DebugContext(r.Context(), "Deleted thumbnail", "path", filePath)
         } else if !os.IsNotExist(err) {
-            log.Printf("Error checking thumbnail at %s: %v", filePath, err)
+            slog.ErrorContext(r.Context(), "Failed to check thumbnail", "path", filePath, "error", err)
             respondError(w, http.StatusInternalServerError, fmt.Sprintf("failed to check thumbnail: %v", err))
             return
         } else {
-            log.Printf("Thumbnail does not exist: %s", filePath)
+            slog.WarnContext(r.Context(), "Thumbnail does not exist", "path", filePath)
         }
     }
 
@@ -208,12 +213,12 @@ func (h *Handler) deleteUserMessage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Delete message
-	if err := h.db.DeleteUserMessage(id); err != nil {
-		if err.Error() == "message not found" {
-			respondError(w, http.StatusNotFound, err.Error())
+	if err := h.db.DeleteUserMessage(r.Context(), id); err != nil {
+		if errors.Is(err, services.ErrMessageNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -253,12 +258,12 @@ func (h *Handler) deleteMarketMessage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Delete message
-	if err := h.db.DeleteMarketMessage(id); err != nil {
-		if err.Error() == "message not found" {
-			respondError(w, http.StatusNotFound, err.Error())
+	if err := h.db.DeleteMarketMessage(r.Context(), id); err != nil {
+		if errors.Is(err, services.ErrMessageNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -299,11 +304,11 @@ func (h *Handler) deleteUser(w http.ResponseWriter, r *http.Request) {
     // Delete user
     err = h.db.DeleteUser(r.Context(), userID)
     if err != nil {
-        if err.Error() == "user not found" {
-            respondError(w, http.StatusNotFound, "User not found")
+        if errors.Is(err, services.ErrUserNotFound) {
+            respondServiceError(w, http.StatusNotFound, err)
             return
         }
-        respondError(w, http.StatusInternalServerError, err.Error())
+        respondServiceError(w, http.StatusInternalServerError, err)
         return
     }
 
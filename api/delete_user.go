@@ -1,8 +1,10 @@
 package api
 
 import (
+	"errors"
 	"net/http"
 	"Dowlet_projects/ecommerce/models"
+	"Dowlet_projects/ecommerce/services"
 	"strconv"
 	"github.com/gorilla/mux"
 )
@@ -30,13 +32,13 @@ func (h *Handler) deleteCart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.db.DeleteCart(claims.UserID, cartOrderID)
+	err = h.db.DeleteCart(r.Context(), claims.UserID, cartOrderID)
 	if err != nil {
-		if err.Error() == "cart not found or not owned by user" {
-			respondError(w, http.StatusNotFound, err.Error())
+		if errors.Is(err, services.ErrCartNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -67,17 +69,17 @@ func (h *Handler) deleteLocation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.db.DeleteLocation(claims.UserID, locationID)
+	err = h.db.DeleteLocation(r.Context(), claims.UserID, locationID)
 	if err != nil {
-		if err.Error() == "location not found or not owned by user" {
-			respondError(w, http.StatusNotFound, err.Error())
+		if errors.Is(err, services.ErrLocationNotOwned) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
-		if err.Error() == "location is referenced by orders and cannot be deleted" {
-			respondError(w, http.StatusConflict, err.Error())
+		if errors.Is(err, services.ErrLocationInUse) {
+			respondServiceError(w, http.StatusConflict, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -100,9 +102,9 @@ func (h *Handler) clearCart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := h.db.ClearCart(claims.UserID)
+	err := h.db.ClearCart(r.Context(), claims.UserID)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -134,15 +136,49 @@ func (h *Handler) deleteCartBySizeID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.db.DeleteCartBySizeID(claims.UserID, sizeID)
+	err = h.db.DeleteCartBySizeID(r.Context(), claims.UserID, sizeID)
 	if err != nil {
-		if err.Error() == "cart entry not found" {
-			respondError(w, http.StatusNotFound, err.Error())
+		if errors.Is(err, services.ErrCartItemNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
 	respondJSON(w, http.StatusOK, map[string]string{"message": "Cart entry deleted successfully"})
-}
\ No newline at end of file
+}
+
+// deleteCartByVariantID deletes a cart entry for the authenticated user based on variant_id
+// @Summary Delete cart entry by variant_id
+// @Description Deletes a specific cart entry for the authenticated user based on variant_id. Requires user JWT authentication.
+// @Tags Cart
+// @Produce json
+// @Security BearerAuth
+// @Param variant_id path int true "Variant ID"
+// @Router /api/cart/variants/{variant_id} [delete]
+func (h *Handler) deleteCartByVariantID(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.UserID == 0 || claims.Role != "user" {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	variantID, err := strconv.Atoi(mux.Vars(r)["variant_id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid variant_id")
+		return
+	}
+
+	err = h.db.DeleteCartByVariantID(r.Context(), claims.UserID, variantID)
+	if err != nil {
+		if errors.Is(err, services.ErrCartItemNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
+			return
+		}
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Cart entry deleted successfully"})
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"Dowlet_projects/ecommerce/models"
+	"Dowlet_projects/ecommerce/services"
+
+	"github.com/gorilla/mux"
+)
+
+// getOrderInvoice renders the invoice of a market order
+// @Summary     Get an order invoice
+// @Description Renders a printable invoice of the order with its items that were not cancelled, delivery and total, in English or Russian. PDF output needs DOCUMENT_FONT_PATH to be configured. Requires market admin JWT authentication.
+// @Tags        Orders
+// @Produce     html
+// @Produce     application/pdf
+// @Param       order_id path  integer true  "Order ID"
+// @Param       format   query string  false "html (default) or pdf"
+// @Param       lang     query string  false "en (default) or ru"
+// @Security    BearerAuth
+// @Router      /api/market/orders/{order_id}/invoice [get]
+func (h *Handler) getOrderInvoice(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireMarketAdmin(w, r)
+	if !ok {
+		return
+	}
+	h.respondOrderDocument(w, r, models.RecipientMarket, claims.MarketID, models.OrderDocumentInvoice)
+}
+
+// getOrderPackingSlip renders the packing slip of a market order
+// @Summary     Get an order packing slip
+// @Description Renders a printable packing slip to put in the parcel: the shipping address and the items that were not cancelled, without prices, in English or Russian. PDF output needs DOCUMENT_FONT_PATH to be configured. Requires market admin JWT authentication.
+// @Tags        Orders
+// @Produce     html
+// @Produce     application/pdf
+// @Param       order_id path  integer true  "Order ID"
+// @Param       format   query string  false "html (default) or pdf"
+// @Param       lang     query string  false "en (default) or ru"
+// @Security    BearerAuth
+// @Router      /api/market/orders/{order_id}/packing-slip [get]
+func (h *Handler) getOrderPackingSlip(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireMarketAdmin(w, r)
+	if !ok {
+		return
+	}
+	h.respondOrderDocument(w, r, models.RecipientMarket, claims.MarketID, models.OrderDocumentPackingSlip)
+}
+
+// getOrderReceipt renders the receipt of one of the user's orders
+// @Summary     Get an order receipt
+// @Description Renders a printable receipt of one of the user's orders, in English or Russian. PDF output needs DOCUMENT_FONT_PATH to be configured. Requires user JWT authentication.
+// @Tags        Orders
+// @Produce     html
+// @Produce     application/pdf
+// @Param       order_id path  integer true  "Order ID"
+// @Param       format   query string  false "html (default) or pdf"
+// @Param       lang     query string  false "en (default) or ru"
+// @Security    BearerAuth
+// @Router      /api/user-orders/{order_id}/receipt [get]
+func (h *Handler) getOrderReceipt(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.Role != "user" || claims.UserID == 0 {
+		if !ok {
+			respondError(w, http.StatusUnauthorized, "Unauthorized")
+		} else {
+			respondError(w, http.StatusForbidden, "Forbidden")
+		}
+		return
+	}
+	h.respondOrderDocument(w, r, models.RecipientUser, claims.UserID, models.OrderDocumentReceipt)
+}
+
+// respondOrderDocument writes an order document in the format and language asked for
+func (h *Handler) respondOrderDocument(w http.ResponseWriter, r *http.Request, partyType string, partyID int, kind string) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["order_id"])
+	if err != nil || orderID < 1 {
+		respondError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = models.DocumentFormatHTML
+	}
+	lang := r.URL.Query().Get("lang")
+	if lang == "" {
+		lang = models.DocumentLangEn
+	}
+
+	data, contentType, orderNumber, err := h.db.RenderOrderDocument(r.Context(), partyType, partyID, orderID, kind, lang, format)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrOrderNotFound):
+			respondServiceError(w, http.StatusNotFound, err)
+		case errors.Is(err, services.ErrInvalidDocumentKind), errors.Is(err, services.ErrInvalidDocumentLang),
+			errors.Is(err, services.ErrInvalidDocumentFormat):
+			respondServiceError(w, http.StatusBadRequest, err)
+		case errors.Is(err, services.ErrDocumentsUnavailable):
+			respondServiceError(w, http.StatusNotImplemented, err)
+		default:
+			respondServiceError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	filename := strings.ReplaceAll(kind, "_", "-") + "-" + orderNumber + "." + format
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s"`, filename))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"Dowlet_projects/ecommerce/models"
+	"Dowlet_projects/ecommerce/services"
+)
+
+// errorLocales are the languages error messages are translated to; English is the messages themselves
+var errorLocales = map[string]bool{"en": true, "ru": true, "tk": true}
+
+// statusErrorCodes are the codes of errors that are not in the services catalogue
+var statusErrorCodes = map[int]string{
+	http.StatusBadRequest:            "BAD_REQUEST",
+	http.StatusUnauthorized:          "UNAUTHORIZED",
+	http.StatusForbidden:             "FORBIDDEN",
+	http.StatusNotFound:              "NOT_FOUND",
+	http.StatusMethodNotAllowed:      "METHOD_NOT_ALLOWED",
+	http.StatusConflict:              "CONFLICT",
+	http.StatusRequestEntityTooLarge: "PAYLOAD_TOO_LARGE",
+	http.StatusUnprocessableEntity:   "UNPROCESSABLE_ENTITY",
+	http.StatusTooManyRequests:       "TOO_MANY_REQUESTS",
+	http.StatusInternalServerError:   "INTERNAL_ERROR",
+	http.StatusNotImplemented:        "NOT_IMPLEMENTED",
+	http.StatusServiceUnavailable:    "SERVICE_UNAVAILABLE",
+}
+
+// handlerErrorCodes are the codes of messages handlers write themselves, by lower-cased message
+var handlerErrorCodes = map[string]string{
+	"unauthorized":            "UNAUTHORIZED",
+	"forbidden":               "FORBIDDEN",
+	"invalid request body":    "INVALID_REQUEST_BODY",
+	"error parsing json body": "INVALID_REQUEST_BODY",
+	"missing required fields": "MISSING_REQUIRED_FIELDS",
+}
+
+// errorMessages translates error codes. Codes without a translation in a locale are described by
+// the translation of their status code, while Error keeps the exact English text.
+var errorMessages = map[string]map[string]string{
+	// Generic
+	"BAD_REQUEST":             {"ru": "Некорректный запрос", "tk": "Haýyş nädogry"},
+	"UNAUTHORIZED":            {"ru": "Требуется авторизация", "tk": "Ygtyýarlandyrma gerek"},
+	"FORBIDDEN":               {"ru": "Доступ запрещён", "tk": "Rugsat berilmedi"},
+	"NOT_FOUND":               {"ru": "Не найдено", "tk": "Tapylmady"},
+	"METHOD_NOT_ALLOWED":      {"ru": "Метод не поддерживается", "tk": "Usul goldanylmaýar"},
+	"CONFLICT":                {"ru": "Конфликт с текущим состоянием", "tk": "Häzirki ýagdaý bilen gapma-garşylyk"},
+	"PAYLOAD_TOO_LARGE":       {"ru": "Слишком большой запрос", "tk": "Haýyş gaty uly"},
+	"UNPROCESSABLE_ENTITY":    {"ru": "Запрос не может быть обработан", "tk": "Haýyşy işläp bolmaýar"},
+	"TOO_MANY_REQUESTS":       {"ru": "Слишком много запросов", "tk": "Haýyşlar gaty köp"},
+	"INTERNAL_ERROR":          {"ru": "Внутренняя ошибка сервера", "tk": "Serweriň içki ýalňyşlygy"},
+	"NOT_IMPLEMENTED":         {"ru": "Не поддерживается", "tk": "Goldanylmaýar"},
+	"SERVICE_UNAVAILABLE":     {"ru": "Сервис временно недоступен", "tk": "Hyzmat wagtlaýyn elýeterli däl"},
+	"INVALID_REQUEST_BODY":    {"ru": "Некорректное тело запроса", "tk": "Haýyşyň mazmuny nädogry"},
+	"VALIDATION_FAILED":       {"ru": "Проверьте правильность заполнения полей", "tk": "Meýdanlaryň dogry doldurylandygyny barlaň"},
+	"MISSING_REQUIRED_FIELDS": {"ru": "Не заполнены обязательные поля", "tk": "Hökmany meýdanlar doldurylmady"},
+
+	// Accounts and verification
+	"USER_NOT_FOUND":              {"ru": "Пользователь не найден", "tk": "Ulanyjy tapylmady"},
+	"SUPERADMIN_NOT_FOUND":        {"ru": "Суперадминистратор не найден", "tk": "Superadministrator tapylmady"},
+	"STAFF_NOT_FOUND":             {"ru": "Сотрудник не найден", "tk": "Işgär tapylmady"},
+	"INVALID_CREDENTIALS":         {"ru": "Неверные учётные данные", "tk": "Giriş maglumatlary nädogry"},
+	"ACCOUNT_DISABLED":            {"ru": "Учётная запись отключена", "tk": "Hasap öçürildi"},
+	"INVALID_STAFF_ROLE":          {"ru": "Недопустимая роль сотрудника", "tk": "Işgäriň roly nädogry"},
+	"USERNAME_OR_PHONE_TAKEN":     {"ru": "Имя пользователя или телефон уже заняты", "tk": "Ulanyjy ady ýa-da telefon belgisi eýýäm bar"},
+	"USERNAME_TAKEN":              {"ru": "Имя пользователя уже занято", "tk": "Ulanyjy ady eýýäm bar"},
+	"PHONE_TAKEN":                 {"ru": "Этот номер телефона уже зарегистрирован", "tk": "Bu telefon belgisi eýýäm hasaba alnan"},
+	"PHONE_UNCHANGED":             {"ru": "Номер телефона не изменился", "tk": "Telefon belgisi üýtgemedi"},
+	"NO_PHONE_CHANGE_REQUESTED":   {"ru": "Смена номера не запрашивалась", "tk": "Telefon belgisini üýtgetmek soralmady"},
+	"VERIFICATION_CODE_NOT_FOUND": {"ru": "Код подтверждения не найден", "tk": "Tassyklama kody tapylmady"},
+	"VERIFICATION_CODE_EXPIRED":   {"ru": "Срок действия кода подтверждения истёк", "tk": "Tassyklama kodunyň möhleti geçdi"},
+	"INVALID_VERIFICATION_CODE":   {"ru": "Неверный код подтверждения", "tk": "Tassyklama kody nädogry"},
+	"TOO_MANY_ATTEMPTS":           {"ru": "Слишком много попыток", "tk": "Synanyşyklar gaty köp"},
+	"NAME_AND_PHONE_REQUIRED":     {"ru": "Укажите имя и телефон", "tk": "Ady we telefon belgisi hökmany"},
+	"NO_FIELDS_TO_UPDATE":         {"ru": "Нет полей для обновления", "tk": "Üýtgetmek üçin meýdan berilmedi"},
+	"NAME_TAKEN":                  {"ru": "Такое название уже существует", "tk": "Bu at eýýäm bar"},
+
+	// Markets and catalog
+	"MARKET_NOT_FOUND":           {"ru": "Магазин не найден", "tk": "Dükan tapylmady"},
+	"PRODUCT_NOT_FOUND":          {"ru": "Товар не найден", "tk": "Haryt tapylmady"},
+	"THUMBNAIL_NOT_FOUND":        {"ru": "Изображение не найдено", "tk": "Surat tapylmady"},
+	"SIZE_NOT_FOUND":             {"ru": "Размер не найден", "tk": "Ölçeg tapylmady"},
+	"SIZE_REQUIRED":              {"ru": "Укажите размер", "tk": "Ölçeg hökmany"},
+	"VARIANT_NOT_FOUND":          {"ru": "Вариант товара не найден", "tk": "Harydyň görnüşi tapylmady"},
+	"IMAGE_NOT_FOUND":            {"ru": "Изображение не найдено", "tk": "Surat tapylmady"},
+	"SKU_REQUIRED":               {"ru": "Укажите артикул", "tk": "Artikul hökmany"},
+	"SKU_TAKEN":                  {"ru": "Такой артикул уже существует", "tk": "Bu artikul eýýäm bar"},
+	"INVALID_PRICE":              {"ru": "Цена не может быть отрицательной", "tk": "Baha otrisatel bolup bilmez"},
+	"INVALID_STOCK":              {"ru": "Остаток не может быть отрицательным", "tk": "Ammardaky mukdar otrisatel bolup bilmez"},
+	"ATTRIBUTE_REQUIRED":         {"ru": "Укажите название и значение атрибута", "tk": "Aýratynlygyň ady we bahasy hökmany"},
+	"DUPLICATE_ATTRIBUTE":        {"ru": "Атрибут указан несколько раз", "tk": "Aýratynlyk birnäçe gezek görkezildi"},
+	"INVALID_COUNT":              {"ru": "Недопустимое количество", "tk": "Mukdar nädogry"},
+	"UNSUPPORTED_IMAGE_TYPE":     {"ru": "Допускаются только изображения JPEG, PNG и WebP", "tk": "Diňe JPEG, PNG we WebP suratlar kabul edilýär"},
+	"UNSUPPORTED_FILE_FORMAT":    {"ru": "Неподдерживаемый формат файла", "tk": "Faýl formaty goldanylmaýar"},
+	"INVALID_IMAGES_ARCHIVE":     {"ru": "Недопустимый архив изображений", "tk": "Suratlar arhiwi nädogry"},
+	"BANNER_NOT_FOUND":           {"ru": "Баннер не найден", "tk": "Banner tapylmady"},
+	"CATEGORY_NOT_FOUND":         {"ru": "Категория не найдена", "tk": "Kategoriýa tapylmady"},
+	"PARENT_CATEGORY_NOT_FOUND":  {"ru": "Родительская категория не найдена", "tk": "Ýokary kategoriýa tapylmady"},
+	"CATEGORY_NOT_ASSIGNED":      {"ru": "Категория не назначена этому магазину", "tk": "Kategoriýa bu dükana berilmedik"},
+	"CATEGORY_NAME_REQUIRED":     {"ru": "Укажите название категории", "tk": "Kategoriýanyň ady hökmany"},
+	"CATEGORY_NAME_TAKEN":        {"ru": "Категория с таким названием уже существует", "tk": "Bu atly kategoriýa eýýäm bar"},
+	"CATEGORY_HAS_SUBCATEGORIES": {"ru": "У категории есть подкатегории", "tk": "Kategoriýanyň içki kategoriýalary bar"},
+	"CATEGORY_CYCLE":             {"ru": "Категорию нельзя переместить в саму себя или в её подкатегории", "tk": "Kategoriýany özüne ýa-da içki kategoriýalaryna geçirip bolmaýar"},
+	"INVALID_SLUG":               {"ru": "Недопустимый slug", "tk": "Slug nädogry"},
+	"SLUG_TAKEN":                 {"ru": "Такой slug уже занят", "tk": "Bu slug eýýäm bar"},
+	"UNKNOWN_ENTITY_TYPE":        {"ru": "Неизвестный тип объекта", "tk": "Näbelli obýekt görnüşi"},
+	"ENTITY_NOT_FOUND":           {"ru": "Объект не найден", "tk": "Obýekt tapylmady"},
+	"UNKNOWN_TRANSLATION_FIELD":  {"ru": "Неизвестное поле перевода", "tk": "Terjime meýdany näbelli"},
+	"INVALID_LOCALE":             {"ru": "Недопустимый язык", "tk": "Dil nädogry"},
+	"BASE_TEXT_REQUIRED":         {"ru": "Текст на основном языке обязателен", "tk": "Esasy dildäki tekst hökmany"},
+	"NO_TRANSLATIONS":            {"ru": "Переводы не указаны", "tk": "Terjimeler berilmedi"},
+
+	// Carts, orders and returns
+	"CART_ITEM_NOT_FOUND":        {"ru": "Товар в корзине не найден", "tk": "Sebetdäki haryt tapylmady"},
+	"CART_NOT_FOUND":             {"ru": "Корзина не найдена", "tk": "Sebet tapylmady"},
+	"CART_EMPTY":                 {"ru": "Корзина пуста", "tk": "Sebet boş"},
+	"CART_ITEM_OUT_OF_STOCK":     {"ru": "Недостаточно товара на складе", "tk": "Ammarda haryt ýeterlik däl"},
+	"ORDER_NOT_FOUND":            {"ru": "Заказ не найден", "tk": "Sargyt tapylmady"},
+	"ORDER_ALREADY_EXISTS":       {"ru": "Заказ по этой корзине уже оформлен", "tk": "Bu sebet boýunça sargyt eýýäm edildi"},
+	"ORDER_ITEM_NOT_FOUND":       {"ru": "Позиция заказа не найдена", "tk": "Sargydyň haryty tapylmady"},
+	"ORDER_ITEM_CLOSED":          {"ru": "Позиция заказа уже закрыта", "tk": "Sargydyň haryty eýýäm ýapyldy"},
+	"ORDER_HAS_NO_OPEN_ITEMS":    {"ru": "В заказе нет открытых позиций", "tk": "Sargytda açyk haryt ýok"},
+	"ORDER_ITEMS_MIXED":          {"ru": "Позиции должны относиться к одному заказу", "tk": "Harytlar bir sargyda degişli bolmaly"},
+	"ORDER_ITEMS_REQUIRED":       {"ru": "Укажите хотя бы одну позицию заказа", "tk": "Iň bolmanda bir haryt görkeziň"},
+	"DUPLICATE_ORDER_ITEM":       {"ru": "Позиция заказа указана дважды", "tk": "Sargydyň haryty iki gezek görkezildi"},
+	"INVALID_ORDER_ITEM":         {"ru": "Недопустимая позиция заказа", "tk": "Sargydyň haryty nädogry"},
+	"ITEM_NOT_PENDING":           {"ru": "Отправить можно только ожидающие позиции", "tk": "Diňe garaşylýan harytlary ugradyp bolýar"},
+	"SHIPMENT_NOT_FOUND":         {"ru": "Отправление не найдено", "tk": "Ugradylan ýük tapylmady"},
+	"SHIPMENT_ALREADY_DELIVERED": {"ru": "Отправление уже доставлено", "tk": "Ýük eýýäm gowşuryldy"},
+	"INVALID_STATUS":             {"ru": "Недопустимый статус", "tk": "Status nädogry"},
+	"ORDER_PREFIX_TAKEN":         {"ru": "Такой префикс заказов уже занят", "tk": "Bu sargyt prefiksi eýýäm bar"},
+	"LOCATION_NOT_FOUND":         {"ru": "Адрес не найден", "tk": "Salgy tapylmady"},
+	"LOCATION_FIELDS_REQUIRED":   {"ru": "Укажите название и адрес", "tk": "Ady we salgysy hökmany"},
+	"LOCATION_NAME_TAKEN":        {"ru": "Адрес с таким названием уже существует", "tk": "Bu atly salgy eýýäm bar"},
+	"LOCATION_IN_USE":            {"ru": "Адрес используется в заказах и не может быть удалён", "tk": "Salgy sargytlarda ulanylýar, ony pozup bolmaýar"},
+	"RETURN_NOT_FOUND":           {"ru": "Заявка на возврат не найдена", "tk": "Yzyna gaýtarmak arzasy tapylmady"},
+	"RETURN_WINDOW_CLOSED":       {"ru": "Срок возврата истёк", "tk": "Yzyna gaýtarmagyň möhleti geçdi"},
+	"INVALID_RETURN_TRANSITION":  {"ru": "Недопустимое изменение статуса возврата", "tk": "Yzyna gaýtarmagyň statusyny beýle üýtgedip bolmaýar"},
+	"RETURN_COUNT_EXCEEDED":      {"ru": "Количество больше доставленного", "tk": "Mukdar gowşurylandan köp"},
+	"ITEM_NOT_DELIVERED":         {"ru": "Вернуть можно только доставленные позиции", "tk": "Diňe gowşurylan harytlary yzyna gaýtaryp bolýar"},
+	"INVALID_DOCUMENT_KIND":      {"ru": "Недопустимый тип документа", "tk": "Resminamanyň görnüşi nädogry"},
+	"INVALID_LANGUAGE":           {"ru": "Недопустимый язык; допустимы en и ru", "tk": "Dil nädogry; en ýa-da ru bolmaly"},
+	"INVALID_FORMAT":             {"ru": "Недопустимый формат; допустимы html и pdf", "tk": "Format nädogry; html ýa-da pdf bolmaly"},
+	"DOCUMENTS_NOT_CONFIGURED":   {"ru": "PDF-документы не настроены", "tk": "PDF resminamalar sazlanmadyk"},
+
+	// Payouts, messaging and jobs
+	"STATEMENT_NOT_FOUND":        {"ru": "Выписка не найдена", "tk": "Hasabat tapylmady"},
+	"STATEMENT_ALREADY_PAID":     {"ru": "Выписка уже оплачена", "tk": "Hasabat eýýäm tölendi"},
+	"COMMISSION_RATE_NOT_FOUND":  {"ru": "Ставка комиссии не найдена", "tk": "Komissiýa göterimi tapylmady"},
+	"DEFAULT_COMMISSION_RATE":    {"ru": "Ставку комиссии по умолчанию нельзя удалить", "tk": "Esasy komissiýa göterimini pozup bolmaýar"},
+	"INVALID_RATE":               {"ru": "Ставка должна быть от 0 до 100", "tk": "Göterim 0 bilen 100 aralygynda bolmaly"},
+	"INVALID_MARKET_OR_CATEGORY": {"ru": "Недопустимый магазин или категория", "tk": "Dükan ýa-da kategoriýa nädogry"},
+	"INVALID_PERIOD":             {"ru": "Начало периода не может быть позже его конца", "tk": "Döwrüň başy ahyryndan soň bolup bilmez"},
+	"ROLLUP_RANGE_TOO_LONG":      {"ru": "Слишком большой период пересчёта", "tk": "Täzeden hasaplamagyň döwri gaty uly"},
+	"CONVERSATION_NOT_FOUND":     {"ru": "Переписка не найдена", "tk": "Ýazyşma tapylmady"},
+	"MESSAGE_NOT_FOUND":          {"ru": "Сообщение не найдено", "tk": "Hat tapylmady"},
+	"INVALID_CONVERSATION_PARTY": {"ru": "Недопустимый участник переписки", "tk": "Ýazyşmanyň gatnaşyjysy nädogry"},
+	"NOTIFICATION_NOT_FOUND":     {"ru": "Уведомление не найдено", "tk": "Habarnama tapylmady"},
+	"DEVICE_NOT_FOUND":           {"ru": "Устройство не найдено", "tk": "Enjam tapylmady"},
+	"INVALID_PLATFORM":           {"ru": "Недопустимая платформа", "tk": "Platforma nädogry"},
+	"JOB_NOT_FOUND":              {"ru": "Задача не найдена", "tk": "Iş tapylmady"},
+
+	// Idempotency keys
+	"INVALID_IDEMPOTENCY_KEY": {"ru": "Ключ идемпотентности должен содержать от 1 до 255 печатных символов ASCII", "tk": "Idempotentlik açary 1-den 255-e çenli çap edilýän ASCII nyşandan ybarat bolmaly"},
+	"IDEMPOTENCY_KEY_REUSED":  {"ru": "Ключ идемпотентности уже использован для другого запроса", "tk": "Idempotentlik açary başga haýyş üçin eýýäm ulanyldy"},
+	"IDEMPOTENCY_KEY_IN_USE":  {"ru": "Запрос с этим ключом идемпотентности ещё выполняется", "tk": "Bu idempotentlik açary bilen haýyş entek ýerine ýetirilýär"},
+}
+
+// localeMiddleware picks the language of error messages from ?lang= and Accept-Language and
+// announces it in Content-Language, where respondError reads it back
+func (h *Handler) localeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, locale := range requestLocales(r) {
+			if errorLocales[locale] {
+				w.Header().Set("Content-Language", locale)
+				break
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// respondError sends an error response. Common handler messages get their own code, others get
+// the code of the status; errors returned by services go through respondServiceError instead.
+func respondError(w http.ResponseWriter, status int, message string) {
+	body := models.ErrorResponse{Error: message}
+	if code, ok := handlerErrorCodes[strings.ToLower(message)]; ok {
+		body.Code = code
+	} else if code, ok := statusErrorCodes[status]; ok {
+		body.Code = code
+	} else {
+		body.Code = "ERROR"
+	}
+	writeError(w, status, body)
+}
+
+// respondServiceError sends an error returned by services, keeping the field and details of
+// *services.Error values
+func respondServiceError(w http.ResponseWriter, status int, err error) {
+	var e *services.Error
+	if !errors.As(err, &e) {
+		respondError(w, status, err.Error())
+		return
+	}
+	writeError(w, status, models.ErrorResponse{
+		Error:   err.Error(),
+		Code:    e.Code,
+		Field:   e.Field,
+		Details: e.Details,
+	})
+}
+
+// writeError translates the message of an error body to the response language and sends it
+func writeError(w http.ResponseWriter, status int, body models.ErrorResponse) {
+	body.Message = body.Error
+	body.RequestID = w.Header().Get(requestIDHeader)
+	if locale := w.Header().Get("Content-Language"); locale != "" && locale != "en" {
+		if text, ok := errorMessages[body.Code][locale]; ok {
+			body.Message = text
+		} else if text, ok := errorMessages[statusErrorCodes[status]][locale]; ok {
+			body.Message = text
+		}
+	}
+	respondJSON(w, status, body)
+}
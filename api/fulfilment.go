@@ -0,0 +1,148 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"Dowlet_projects/ecommerce/models"
+	"Dowlet_projects/ecommerce/services"
+
+	"github.com/gorilla/mux"
+)
+
+// requireMarketAdmin responds and returns false unless the caller acts for a market
+func requireMarketAdmin(w http.ResponseWriter, r *http.Request) (*models.Claims, bool) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
+		if !ok {
+			respondError(w, http.StatusUnauthorized, "Unauthorized")
+		} else {
+			respondError(w, http.StatusForbidden, "Forbidden")
+		}
+		return nil, false
+	}
+	return claims, true
+}
+
+// updateOrderItemStatus closes a single order item
+// @Summary     Update an order item status
+// @Description Marks a single item of an order as delivered, canceled or out_of_stock while the rest of the order is fulfilled. Cancelled items return their stock; out-of-stock items set the variant's stock to 0. The order total leaves out cancelled and out-of-stock items. Requires market admin JWT authentication.
+// @Tags        Orders
+// @Accept      json
+// @Produce     json
+// @Param       item_id path integer                             true "Order item ID"
+// @Param       request body models.UpdateOrderItemStatusRequest true "New status and optional note to the customer"
+// @Security    BearerAuth
+// @Router      /api/market/order-items/{item_id}/status [put]
+func (h *Handler) updateOrderItemStatus(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireMarketAdmin(w, r)
+	if !ok {
+		return
+	}
+	itemID, err := strconv.Atoi(mux.Vars(r)["item_id"])
+	if err != nil || itemID < 1 {
+		respondError(w, http.StatusBadRequest, "Invalid order item ID")
+		return
+	}
+
+	var req models.UpdateOrderItemStatusRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.Note = strings.TrimSpace(req.Note)
+
+	if err := h.db.UpdateOrderItemStatus(r.Context(), claims.MarketID, itemID, req); err != nil {
+		switch {
+		case errors.Is(err, services.ErrOrderItemNotFound):
+			respondServiceError(w, http.StatusNotFound, err)
+		case errors.Is(err, services.ErrInvalidItemStatus):
+			respondServiceError(w, http.StatusBadRequest, err)
+		case errors.Is(err, services.ErrOrderItemClosed):
+			respondServiceError(w, http.StatusConflict, err)
+		default:
+			respondServiceError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Order item updated successfully"})
+}
+
+// createShipment ships order items together
+// @Summary     Create a shipment
+// @Description Ships pending items of one order together, optionally with a carrier and tracking number. An order may be split over several shipments. Requires market admin JWT authentication.
+// @Tags        Orders
+// @Accept      json
+// @Produce     json
+// @Param       request body models.CreateShipmentRequest true "Order items and tracking details"
+// @Security    BearerAuth
+// @Router      /api/market/shipments [post]
+func (h *Handler) createShipment(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireMarketAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.CreateShipmentRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.Carrier = strings.TrimSpace(req.Carrier)
+	req.TrackingNumber = strings.TrimSpace(req.TrackingNumber)
+
+	shipmentID, err := h.db.CreateShipment(r.Context(), claims.MarketID, req)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrOrderItemNotFound):
+			respondServiceError(w, http.StatusNotFound, err)
+		case errors.Is(err, services.ErrOrderItemsRequired), errors.Is(err, services.ErrDuplicateOrderItem), errors.Is(err, services.ErrOrderItemsMixed):
+			respondServiceError(w, http.StatusBadRequest, err)
+		case errors.Is(err, services.ErrItemNotPending):
+			respondServiceError(w, http.StatusConflict, err)
+		default:
+			respondServiceError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"message":     "Shipment created successfully",
+		"shipment_id": shipmentID,
+	})
+}
+
+// deliverShipment marks a shipment as delivered
+// @Summary     Mark a shipment as delivered
+// @Description Marks the items of a shipment that are still on their way as delivered. Requires market admin JWT authentication.
+// @Tags        Orders
+// @Produce     json
+// @Param       shipment_id path integer true "Shipment ID"
+// @Security    BearerAuth
+// @Router      /api/market/shipments/{shipment_id}/delivered [put]
+func (h *Handler) deliverShipment(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireMarketAdmin(w, r)
+	if !ok {
+		return
+	}
+	shipmentID, err := strconv.Atoi(mux.Vars(r)["shipment_id"])
+	if err != nil || shipmentID < 1 {
+		respondError(w, http.StatusBadRequest, "Invalid shipment ID")
+		return
+	}
+
+	if err := h.db.DeliverShipment(r.Context(), claims.MarketID, shipmentID); err != nil {
+		switch {
+		case errors.Is(err, services.ErrShipmentNotFound):
+			respondServiceError(w, http.StatusNotFound, err)
+		case errors.Is(err, services.ErrShipmentDelivered):
+			respondServiceError(w, http.StatusConflict, err)
+		default:
+			respondServiceError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Shipment marked as delivered"})
+}
@@ -2,12 +2,15 @@ package api
 
 import (
 	"Dowlet_projects/ecommerce/models"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
-	//"Dowlet_projects/ecommerce/services"
+	"Dowlet_projects/ecommerce/services"
 )
 
 // getMarketAdminOrders retrieves orders for a market admin's market
@@ -38,9 +41,9 @@ func (h *Handler) getMarketAdminOrders(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	orders, err := h.db.GetMarketAdminOrders(claims.MarketID, status)
+	orders, err := h.db.GetMarketAdminOrders(r.Context(), claims.MarketID, status)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -51,13 +54,12 @@ func (h *Handler) getMarketAdminOrders(w http.ResponseWriter, r *http.Request) {
 
 // getMarketAdminOrderByID retrieves a specific order by order_id for a market admin
 // @Summary Get market admin order by ID
-// @Description Retrieves detailed order information for a specific order_id. Requires market admin JWT authentication.
+// @Description Retrieves detailed order information for a specific order_id, with its items and shipments. Requires market admin JWT authentication.
 // @Tags Orders
 // @Produce json
 // @Security BearerAuth
-// @Param cart_order_id path string true "Cart Order ID"
-// @Param user_id path string true "User ID"
-// @Router /api/market/orders/{cart_order_id}/{user_id} [get]
+// @Param order_id path string true "Order ID"
+// @Router /api/market/orders/{order_id} [get]
 func (h *Handler) getMarketAdminOrderByID(w http.ResponseWriter, r *http.Request) {
 	claims, ok := r.Context().Value("claims").(*models.Claims)
 	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
@@ -66,33 +68,107 @@ func (h *Handler) getMarketAdminOrderByID(w http.ResponseWriter, r *http.Request
 	}
 
 	vars := mux.Vars(r)
-	cartOrderIDStr := vars["cart_order_id"]
-	cartOrderID, err := strconv.Atoi(cartOrderIDStr)
+	orderIDStr := vars["order_id"]
+	orderID, err := strconv.Atoi(orderIDStr)
 	if err != nil {
-		respondError(w, http.StatusBadRequest, "Invalid cart order ID")
+		respondError(w, http.StatusBadRequest, "Invalid order ID")
 		return
 	}
-	
-	userIDStr := vars["user_id"]
-	userID, err := strconv.Atoi(userIDStr)
+
+	order, err := h.db.GetMarketAdminOrderByID(r.Context(), claims.MarketID, orderID)
 	if err != nil {
-		respondError(w, http.StatusBadRequest, "Invalid User ID")
+		if errors.Is(err, services.ErrOrderNotForMarket) {
+			respondServiceError(w, http.StatusNotFound, err)
+			return
+		}
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	respondJSON(w, http.StatusOK, order)
+}
+
 
+// orderStreamHeartbeat keeps idle order streams from being closed by proxies
+const orderStreamHeartbeat = 25 * time.Second
 
-	order, err := h.db.GetMarketAdminOrderByID(claims.MarketID, cartOrderID, userID)
-	if err != nil {
-		if err.Error() == "order not found or not for this market" {
-			respondError(w, http.StatusNotFound, err.Error())
+// streamMarketOrders streams order events of the market admin's market as server-sent events
+// @Summary Stream market order events
+// @Description Streams new-order, order-cancelled and status-changed events of the market admin's market as server-sent events (text/event-stream). Each event carries an id; reconnecting with the Last-Event-ID header (or last_event_id query parameter) replays missed events, or sends a "resync" event when they are no longer kept and the orders list must be reloaded. Browsers' EventSource cannot set headers, so the JWT may also be passed as the access_token query parameter.
+// @Tags Orders
+// @Produce text/event-stream
+// @Security BearerAuth
+// @Param Last-Event-ID header string false "ID of the last received event"
+// @Param last_event_id query integer false "ID of the last received event, for clients that cannot set headers"
+// @Router /api/market/orders/stream [get]
+func (h *Handler) streamMarketOrders(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	lastEventIDStr := r.Header.Get("Last-Event-ID")
+	if lastEventIDStr == "" {
+		lastEventIDStr = r.URL.Query().Get("last_event_id")
+	}
+	var lastEventID int64
+	if lastEventIDStr != "" {
+		var err error
+		lastEventID, err = strconv.ParseInt(lastEventIDStr, 10, 64)
+		if err != nil || lastEventID < 0 {
+			respondError(w, http.StatusBadRequest, "Invalid last event ID")
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+	}
+
+	// Streams outlive the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		respondError(w, http.StatusInternalServerError, "Streaming unsupported")
 		return
 	}
 
-	respondJSON(w, http.StatusOK, order)
+	events, err := h.db.SubscribeOrderEvents(r.Context(), claims.MarketID, lastEventID)
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(orderStreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-h.streamsDone:
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
 }
 
 
@@ -110,13 +186,13 @@ func (h *Handler) getMarketProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	profile, err := h.db.GetMarketProfile(claims.MarketID)
+	profile, err := h.db.GetMarketProfile(r.Context(), claims.MarketID)
 	if err != nil {
-		if err.Error() == "market not found" {
-			respondError(w, http.StatusNotFound, err.Error())
+		if errors.Is(err, services.ErrMarketNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -133,13 +209,12 @@ func (h *Handler) getMarketProfile(w http.ResponseWriter, r *http.Request) {
 // @Security BearerAuth
 // @Param limit query integer false "Number of products per page (default: 20, min: 1, max: 100)"
 // @Param page query integer false "Page number (default: 1, min: 1)"
-// @Param category_id query string false "Page number"
+// @Param category_id query string false "Category ID; includes its subcategories"
 // @Router /api/market/markets [get]
 func (h *Handler) getMarketByID(w http.ResponseWriter, r *http.Request) {
 	claims, ok := r.Context().Value("claims").(*models.Claims)
 	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
 		if !ok {
-			fmt.Println(claims)
 			respondError(w, http.StatusUnauthorized, "Unauthorized")
 		} else {
 			respondError(w, http.StatusForbidden, "Forbidden")
@@ -191,11 +266,11 @@ func (h *Handler) getMarketByID(w http.ResponseWriter, r *http.Request) {
 
 	market, products, totalCount, err := h.db.GetMarketByID(r.Context(), marketID, categoryID, page, limit)
 	if err != nil {
-		if err.Error() == "market not found" {
-			respondError(w, http.StatusNotFound, err.Error())
+		if errors.Is(err, services.ErrMarketNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -208,4 +283,438 @@ func (h *Handler) getMarketByID(w http.ResponseWriter, r *http.Request) {
 			"limit":       limit,
 		},
 	})
-}
\ No newline at end of file
+}
+// getMarketStaff lists the staff accounts of the market admin's market
+// @Summary Get market staff
+// @Description Lists staff accounts of the market. Requires market owner JWT authentication.
+// @Tags Market Staff
+// @Produce json
+// @Security BearerAuth
+// @Router /api/market/staff [get]
+func (h *Handler) getMarketStaff(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
+		if !ok {
+			respondError(w, http.StatusUnauthorized, "Unauthorized")
+		} else {
+			respondError(w, http.StatusForbidden, "Forbidden")
+		}
+		return
+	}
+
+	staff, err := h.db.GetMarketStaff(r.Context(), claims.MarketID)
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, staff)
+}
+
+// getProductVariants lists the option axes and variants of a market product
+// @Summary Get product variants
+// @Description Lists the options and all variants (including inactive ones) of a product in the market admin's market. Requires market admin JWT authentication.
+// @Tags Product Variants
+// @Produce json
+// @Security BearerAuth
+// @Param product_id path integer true "Product ID"
+// @Router /api/market/products/{product_id}/variants [get]
+func (h *Handler) getProductVariants(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	productID, err := strconv.Atoi(mux.Vars(r)["product_id"])
+	if err != nil || productID < 1 {
+		respondError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	options, variants, err := h.db.GetMarketProductVariants(r.Context(), claims.MarketID, productID)
+	if err != nil {
+		if errors.Is(err, services.ErrProductNotOwned) {
+			respondServiceError(w, http.StatusNotFound, err)
+			return
+		}
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"options":  options,
+		"variants": variants,
+	})
+}
+
+// getProductImportJob reports the progress and outcome of a product import
+// @Summary Get product import job
+// @Description Returns the status, counters, row errors and preview of a product import job of the market. Requires market admin JWT authentication.
+// @Tags Products
+// @Produce json
+// @Security BearerAuth
+// @Param job_id path integer true "Import job ID"
+// @Router /api/market/products/import/{job_id} [get]
+func (h *Handler) getProductImportJob(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	jobID, err := strconv.Atoi(mux.Vars(r)["job_id"])
+	if err != nil || jobID < 1 {
+		respondError(w, http.StatusBadRequest, "Invalid job ID")
+		return
+	}
+
+	job, err := h.db.GetProductImportJob(r.Context(), claims.MarketID, jobID)
+	if err != nil {
+		if errors.Is(err, services.ErrImportJobNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
+			return
+		}
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, job)
+}
+
+// exportProducts downloads the market's catalog in the import format
+// @Summary Export products
+// @Description Exports every product, color and size of the market as CSV or XLSX with the columns accepted by the import. Requires market admin JWT authentication.
+// @Tags Products
+// @Produce octet-stream
+// @Security BearerAuth
+// @Param format query string false "csv (default) or xlsx"
+// @Router /api/market/products/export [get]
+func (h *Handler) exportProducts(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	contentType := "text/csv; charset=utf-8"
+	switch format {
+	case "csv":
+	case "xlsx":
+		contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	default:
+		respondError(w, http.StatusBadRequest, "Invalid format; must be csv or xlsx")
+		return
+	}
+
+	data, err := h.db.ExportMarketProducts(r.Context(), claims.MarketID, format)
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="products-%d.%s"`, claims.MarketID, format))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// getMarketJob retrieves a background job started by the market
+// @Summary Get a background job
+// @Description Returns the status, attempts and last error of a background job belonging to the market admin's market. Requires market admin JWT authentication.
+// @Tags Jobs
+// @Produce json
+// @Security BearerAuth
+// @Param job_id path string true "Job ID"
+// @Router /api/market/jobs/{job_id} [get]
+func (h *Handler) getMarketJob(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	job, err := h.db.GetJob(r.Context(), mux.Vars(r)["job_id"])
+	if err != nil {
+		if errors.Is(err, services.ErrJobNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
+			return
+		}
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if job.MarketID != claims.MarketID {
+		respondServiceError(w, http.StatusNotFound, services.ErrJobNotFound)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, job)
+}
+
+// maxAnalyticsRange caps the date range of analytics queries
+const maxAnalyticsRange = 2 * 366
+
+// parseAnalyticsRange reads the from and to query parameters (YYYY-MM-DD, both inclusive).
+// The range defaults to the last 30 days. On failure it responds itself and returns false.
+func parseAnalyticsRange(w http.ResponseWriter, r *http.Request) (time.Time, time.Time, bool) {
+	query := r.URL.Query()
+	now := time.Now()
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if value := query.Get("to"); value != "" {
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid to date; use YYYY-MM-DD")
+			return time.Time{}, time.Time{}, false
+		}
+		to = parsed
+	}
+	from := to.AddDate(0, 0, -29)
+	if value := query.Get("from"); value != "" {
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid from date; use YYYY-MM-DD")
+			return time.Time{}, time.Time{}, false
+		}
+		from = parsed
+	}
+	if from.After(to) {
+		respondServiceError(w, http.StatusBadRequest, services.ErrInvalidPeriod)
+		return time.Time{}, time.Time{}, false
+	}
+	if to.Sub(from) > maxAnalyticsRange*24*time.Hour {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("Date range must not exceed %d days", maxAnalyticsRange))
+		return time.Time{}, time.Time{}, false
+	}
+	return from, to, true
+}
+
+// analyticsLimit reads the limit query parameter of analytics lists
+func analyticsLimit(r *http.Request, def, max int) int {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 {
+		return def
+	}
+	if limit > max {
+		return max
+	}
+	return limit
+}
+
+// getSalesSummary retrieves sales totals of the market admin's market
+// @Summary Get sales summary
+// @Description Returns revenue, order count, items sold, average basket and cancellation rate of the market admin's market for a date range (default: last 30 days). Revenue uses the discounted prices the items were ordered at and excludes cancelled lines. Requires market admin JWT authentication.
+// @Tags Analytics
+// @Produce json
+// @Security BearerAuth
+// @Param from query string false "Start date (YYYY-MM-DD, inclusive)"
+// @Param to query string false "End date (YYYY-MM-DD, inclusive; default: today)"
+// @Router /api/market/analytics/summary [get]
+func (h *Handler) getSalesSummary(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	from, to, ok := parseAnalyticsRange(w, r)
+	if !ok {
+		return
+	}
+
+	summary, err := h.db.GetSalesSummary(r.Context(), claims.MarketID, from, to)
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, summary)
+}
+
+// getSalesSeries retrieves revenue and order count over time
+// @Summary Get sales over time
+// @Description Returns revenue, order count and items sold of the market admin's market per day, week (starting Monday) or month, including buckets without sales. Requires market admin JWT authentication.
+// @Tags Analytics
+// @Produce json
+// @Security BearerAuth
+// @Param from query string false "Start date (YYYY-MM-DD, inclusive)"
+// @Param to query string false "End date (YYYY-MM-DD, inclusive; default: today)"
+// @Param bucket query string false "Bucket size (day, week, month; default: day)"
+// @Router /api/market/analytics/sales [get]
+func (h *Handler) getSalesSeries(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	from, to, ok := parseAnalyticsRange(w, r)
+	if !ok {
+		return
+	}
+
+	bucket := r.URL.Query().Get("bucket")
+	if bucket == "" {
+		bucket = models.AnalyticsBucketDay
+	}
+	if bucket != models.AnalyticsBucketDay && bucket != models.AnalyticsBucketWeek && bucket != models.AnalyticsBucketMonth {
+		respondError(w, http.StatusBadRequest, "Invalid bucket. Must be one of: day, week, month")
+		return
+	}
+	if bucket == models.AnalyticsBucketDay && to.Sub(from) > 366*24*time.Hour {
+		respondError(w, http.StatusBadRequest, "Daily buckets are limited to 366 days; use week or month")
+		return
+	}
+
+	series, err := h.db.GetSalesSeries(r.Context(), claims.MarketID, from, to, bucket)
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, series)
+}
+
+// getTopProducts retrieves the best-selling products
+// @Summary Get top products
+// @Description Returns the best-selling products of the market admin's market in a date range by quantity or revenue. Requires market admin JWT authentication.
+// @Tags Analytics
+// @Produce json
+// @Security BearerAuth
+// @Param from query string false "Start date (YYYY-MM-DD, inclusive)"
+// @Param to query string false "End date (YYYY-MM-DD, inclusive; default: today)"
+// @Param sort query string false "Sort by quantity or revenue (default: quantity)"
+// @Param limit query integer false "Number of products (default: 10, max: 100)"
+// @Router /api/market/analytics/top-products [get]
+func (h *Handler) getTopProducts(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	from, to, ok := parseAnalyticsRange(w, r)
+	if !ok {
+		return
+	}
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy == "" {
+		sortBy = "quantity"
+	}
+	if sortBy != "quantity" && sortBy != "revenue" {
+		respondError(w, http.StatusBadRequest, "Invalid sort. Must be one of: quantity, revenue")
+		return
+	}
+
+	products, err := h.db.GetTopProducts(r.Context(), claims.MarketID, from, to, sortBy, analyticsLimit(r, 10, 100))
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, products)
+}
+
+// getTopVariants retrieves the best-selling sizes and other variants
+// @Summary Get top variants
+// @Description Returns the best-selling variants (sizes, colors, ...) of the market admin's market in a date range by quantity or revenue, each with its option label such as "Red / XL". Requires market admin JWT authentication.
+// @Tags Analytics
+// @Produce json
+// @Security BearerAuth
+// @Param from query string false "Start date (YYYY-MM-DD, inclusive)"
+// @Param to query string false "End date (YYYY-MM-DD, inclusive; default: today)"
+// @Param sort query string false "Sort by quantity or revenue (default: quantity)"
+// @Param limit query integer false "Number of variants (default: 10, max: 100)"
+// @Router /api/market/analytics/top-variants [get]
+func (h *Handler) getTopVariants(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	from, to, ok := parseAnalyticsRange(w, r)
+	if !ok {
+		return
+	}
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy == "" {
+		sortBy = "quantity"
+	}
+	if sortBy != "quantity" && sortBy != "revenue" {
+		respondError(w, http.StatusBadRequest, "Invalid sort. Must be one of: quantity, revenue")
+		return
+	}
+
+	variants, err := h.db.GetTopVariants(r.Context(), claims.MarketID, from, to, sortBy, analyticsLimit(r, 10, 100))
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, variants)
+}
+
+// getLowStock retrieves variants that are running out of stock
+// @Summary Get low-stock items
+// @Description Returns the active variants of the market admin's market whose stock is at or below the threshold, lowest stock first. Requires market admin JWT authentication.
+// @Tags Analytics
+// @Produce json
+// @Security BearerAuth
+// @Param threshold query integer false "Stock threshold (default: 5)"
+// @Param limit query integer false "Number of items (default: 50, max: 500)"
+// @Router /api/market/analytics/low-stock [get]
+func (h *Handler) getLowStock(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	threshold := 5
+	if value := r.URL.Query().Get("threshold"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			respondError(w, http.StatusBadRequest, "Invalid threshold")
+			return
+		}
+		threshold = n
+	}
+
+	items, err := h.db.GetLowStock(r.Context(), claims.MarketID, threshold, analyticsLimit(r, 50, 500))
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, items)
+}
+
+// getFavoriteConversion retrieves the favorites-to-purchase conversion
+// @Summary Get favorites conversion
+// @Description Returns how many of the users who favorited the market admin's products bought them within the date range, overall and for the most favorited products. Requires market admin JWT authentication.
+// @Tags Analytics
+// @Produce json
+// @Security BearerAuth
+// @Param from query string false "Start date (YYYY-MM-DD, inclusive)"
+// @Param to query string false "End date (YYYY-MM-DD, inclusive; default: today)"
+// @Param limit query integer false "Number of products (default: 20, max: 100)"
+// @Router /api/market/analytics/favorites-conversion [get]
+func (h *Handler) getFavoriteConversion(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	from, to, ok := parseAnalyticsRange(w, r)
+	if !ok {
+		return
+	}
+
+	report, err := h.db.GetFavoriteConversion(r.Context(), claims.MarketID, from, to, analyticsLimit(r, 20, 100))
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, report)
+}
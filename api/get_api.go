@@ -2,9 +2,10 @@ package api
 
 import (
 	"Dowlet_projects/ecommerce/models"
+	"Dowlet_projects/ecommerce/services"
 	"encoding/json"
-	"fmt"
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
 	"strconv"
 
@@ -20,6 +21,7 @@ import (
 // @Param duration query integer false "Duration day for new (default: 7)"
 // @Param is_new query boolean false "Filter new markets (default: false)"
 // @Param is_vip query boolean false "Filter vip markets (default: false)"
+// @Param lang query string false "Preferred locale, e.g. en, ru or tk; Accept-Language is used otherwise"
 // @Router /markets [get]
 func (h *Handler) getMarkets(w http.ResponseWriter, r *http.Request) {
 
@@ -45,9 +47,12 @@ func (h *Handler) getMarkets(w http.ResponseWriter, r *http.Request) {
 	}
 
 	markets, err := h.db.GetMarkets(r.Context(), isNew, isVip, duration)
-	fmt.Println(err)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := h.db.LocalizeMarkets(r.Context(), requestLocales(r), markets); err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -86,7 +91,7 @@ func (h *Handler) getMarkets(w http.ResponseWriter, r *http.Request) {
 
 // 	products, err := h.db.GetMarketProducts(r.Context(), claims.MarketID, 0, page, limit)
 // 	if err != nil {
-// 		respondError(w, http.StatusInternalServerError, err.Error())
+// 		respondServiceError(w, http.StatusInternalServerError, err)
 // 		return
 // 	}
 
@@ -101,7 +106,7 @@ func (h *Handler) getMarkets(w http.ResponseWriter, r *http.Request) {
 // @Tags Products
 // @Produce json
 // @Security BearerAuth
-// @Param category_id query string false "Category ID"
+// @Param category_id query string false "Category ID; includes its subcategories"
 // @Param market_id query string false "Market ID"
 // @Param duration query integer false "Duration day for new (default: 7)"
 // @Param page query integer false "Page number (default: 1, ignored if random=true)"
@@ -113,24 +118,21 @@ func (h *Handler) getMarkets(w http.ResponseWriter, r *http.Request) {
 // @Param sort query string false "Sort order: cheap_to_expensive, expensive_to_cheap (default: by ID)"
 // @Param has_discount query boolean false "Filter products with discount (default: false)"
 // @Param is_new query boolean false "Filter new products (default: false)"
+// @Param lang query string false "Preferred locale, e.g. en, ru or tk; Accept-Language is used otherwise"
 // @Router /api/products [get]
 func (h *Handler)  getAllProducts(w http.ResponseWriter, r *http.Request) {
 	// Parse query parameters
 	var userID int
     claims, ok := r.Context().Value("claims").(*models.Claims)
     if !ok || claims == nil {
-        log.Println("No valid claims found in context; treating as unauthenticated user")
         userID = 0
     } else if claims.Role != "user" {
-        log.Printf("User role %s is not 'user'; treating as unauthenticated user", claims.Role)
         userID = 0
     } else {
         userID = int(claims.UserID)
-        log.Printf("Authenticated user ID: %d", userID)
     }
 
 	marketIDStr := r.URL.Query().Get("market_id")
-	fmt.Println(marketIDStr)
 	var marketID int
 	if marketIDStr != "" {
 		var err error
@@ -237,7 +239,11 @@ func (h *Handler)  getAllProducts(w http.ResponseWriter, r *http.Request) {
 
 	products, err := h.db.GetPaginatedProducts(r.Context(), userID, categoryID, marketID, duration, page, limit, search, random, startPrice, endPrice, sort, hasDiscount, isNew)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := h.db.LocalizeProducts(r.Context(), requestLocales(r), products); err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -250,7 +256,7 @@ func (h *Handler)  getAllProducts(w http.ResponseWriter, r *http.Request) {
 // @Description Retrieves paginated products with optional category, price range, discount, new status, sorting, name search, or random selection for homepage
 // @Tags Products
 // @Produce json
-// @Param category_id query string false "Category ID"
+// @Param category_id query string false "Category ID; includes its subcategories"
 // @Param market_id query string false "Market ID"
 // @Param duration query integer false "Duration day for new (default: 7)"
 // @Param page query integer false "Page number (default: 1, ignored if random=true)"
@@ -262,12 +268,12 @@ func (h *Handler)  getAllProducts(w http.ResponseWriter, r *http.Request) {
 // @Param sort query string false "Sort order: cheap_to_expensive, expensive_to_cheap (default: by ID)"
 // @Param has_discount query boolean false "Filter products with discount (default: false)"
 // @Param is_new query boolean false "Filter new products (default: false)"
+// @Param lang query string false "Preferred locale, e.g. en, ru or tk; Accept-Language is used otherwise"
 // @Router /products [get]
 func (h *Handler)  getAllProductsNonAuthenticated(w http.ResponseWriter, r *http.Request) {
 	// Parse query parameters
 	var userID int
 	marketIDStr := r.URL.Query().Get("market_id")
-	fmt.Println(marketIDStr)
 	var marketID int
 	if marketIDStr != "" {
 		var err error
@@ -374,7 +380,11 @@ func (h *Handler)  getAllProductsNonAuthenticated(w http.ResponseWriter, r *http
 
 	products, err := h.db.GetPaginatedProducts(r.Context(), userID, categoryID, marketID, duration, page, limit, search, random, startPrice, endPrice, sort, hasDiscount, isNew)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := h.db.LocalizeProducts(r.Context(), requestLocales(r), products); err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -389,18 +399,24 @@ func (h *Handler)  getAllProductsNonAuthenticated(w http.ResponseWriter, r *http
 // @Accept json
 // @Produce json
 // @Param id path string true "Product ID"
+// @Param lang query string false "Preferred locale, e.g. en, ru or tk; Accept-Language is used otherwise"
 // @Router /products/{id} [get]
 func (h *Handler) getProduct(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	product, err := h.db.GetProduct(id, 0)
+	product, err := h.db.GetProduct(r.Context(), id, 0)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+	products := []models.Product{product}
+	if err := h.db.LocalizeProducts(r.Context(), requestLocales(r), products); err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	respondJSON(w, http.StatusOK, product)
+	respondJSON(w, http.StatusOK, products[0])
 }
 
 
@@ -412,6 +428,7 @@ func (h *Handler) getProduct(w http.ResponseWriter, r *http.Request) {
 // @Produce json
 // @Security BearerAuth
 // @Param id path string true "Product ID"
+// @Param lang query string false "Preferred locale, e.g. en, ru or tk; Accept-Language is used otherwise"
 // @Router /api/products/{id} [get]
 func (h *Handler) getProductNonAuthenticated(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -420,23 +437,25 @@ func (h *Handler) getProductNonAuthenticated(w http.ResponseWriter, r *http.Requ
 	var userID int
     claims, ok := r.Context().Value("claims").(*models.Claims)
     if !ok || claims == nil {
-        log.Println("No valid claims found in context; treating as unauthenticated user")
         userID = 0
     } else if claims.Role != "user" {
-        log.Printf("User role %s is not 'user'; treating as unauthenticated user", claims.Role)
         userID = 0
     } else {
         userID = int(claims.UserID)
-        log.Printf("Authenticated user ID: %d", userID)
     }
 
-	product, err := h.db.GetProduct(id, userID)
+	product, err := h.db.GetProduct(r.Context(), id, userID)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+	products := []models.Product{product}
+	if err := h.db.LocalizeProducts(r.Context(), requestLocales(r), products); err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	respondJSON(w, http.StatusOK, product)
+	respondJSON(w, http.StatusOK, products[0])
 }
 
 
@@ -449,9 +468,9 @@ func (h *Handler) getProductNonAuthenticated(w http.ResponseWriter, r *http.Requ
 // @Produce json
 // @Router /thumbnails [get]
 func (h *Handler) getAllThumbnails(w http.ResponseWriter, r *http.Request) {
-	thumbnails, err := h.db.GetAllThumbnailsWithProducts()
+	thumbnails, err := h.db.GetAllThumbnailsWithProducts(r.Context())
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -468,6 +487,7 @@ func (h *Handler) getAllThumbnails(w http.ResponseWriter, r *http.Request) {
 // @Param page query integer false "Page number (default: 1)"
 // @Param limit query integer false "Items per page (default: 10)"
 // @Param search query string false "Search by category name"
+// @Param lang query string false "Preferred locale, e.g. en, ru or tk; Accept-Language is used otherwise"
 // @Router /categories [get]
 func (h *Handler) getCategories(w http.ResponseWriter, r *http.Request) {
 	// claims, ok := r.Context().Value("claims").(*models.Claims)
@@ -490,9 +510,13 @@ func (h *Handler) getCategories(w http.ResponseWriter, r *http.Request) {
 		limit = 10
 	}
 
-	categories, err := h.db.GetCategories(page, limit, search)
+	categories, err := h.db.GetCategories(r.Context(), page, limit, search)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := h.db.LocalizeCategories(r.Context(), requestLocales(r), categories); err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -508,9 +532,9 @@ func (h *Handler) getCategories(w http.ResponseWriter, r *http.Request) {
 // @Produce json
 // @Router /banners [get]
 func (h *Handler) getBanners(w http.ResponseWriter, r *http.Request) {
-	banners, err := h.db.GetAllBanners()
+	banners, err := h.db.GetAllBanners(r.Context())
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -527,6 +551,7 @@ func (h *Handler) getBanners(w http.ResponseWriter, r *http.Request) {
 // @Param id path string true "Market ID"
 // @Param limit query integer false "Number of products per page (default: 20, min: 1, max: 100)"
 // @Param page query integer false "Page number (default: 1, min: 1)"
+// @Param lang query string false "Preferred locale, e.g. en, ru or tk; Accept-Language is used otherwise"
 // @Router /markets/{id} [get]
 func (h *Handler) getMarketByIDALL(w http.ResponseWriter, r *http.Request) {
 	// Get market ID from URL
@@ -566,11 +591,22 @@ func (h *Handler) getMarketByIDALL(w http.ResponseWriter, r *http.Request) {
 
 	market, products, totalCount, err := h.db.GetMarketByID(r.Context(), marketID, 0, page, limit)
 	if err != nil {
-		if err.Error() == "market not found" {
-			respondError(w, http.StatusNotFound, err.Error())
+		if errors.Is(err, services.ErrMarketNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+	locales := requestLocales(r)
+	markets := []models.Market{*market}
+	if err := h.db.LocalizeMarkets(r.Context(), locales, markets); err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+	*market = markets[0]
+	if err := h.db.LocalizeProducts(r.Context(), locales, products); err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -590,11 +626,6 @@ func respondJSON(w http.ResponseWriter, status int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	if err := json.NewEncoder(w).Encode(payload); err != nil {
-		fmt.Printf("Failed to encode JSON: %v\n", err)
+		slog.Error("Failed to encode JSON response", "error", err)
 	}
 }
-
-// respondError sends an error response
-func respondError(w http.ResponseWriter, status int, message string) {
-	respondJSON(w, status, map[string]string{"error": message})
-}
\ No newline at end of file
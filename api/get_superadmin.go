@@ -1,15 +1,22 @@
 package api
 
 import (
+	"errors"
+	"log/slog"
 	"Dowlet_projects/ecommerce/models"
+	"encoding/csv"
+	"fmt"
 	"net/http"
 	"strconv"
-	//"Dowlet_projects/ecommerce/services"
+	"time"
+
+	"github.com/gorilla/mux"
+	"Dowlet_projects/ecommerce/services"
 )
 
 // getUserMessages retrieves all user messages
 // @Summary Get all user messages
-// @Description Retrieves all messages sent by users to superadmin. Requires superadmin JWT authentication.
+// @Description Retrieves the one-shot messages users sent before support conversations existed; they were carried over to conversations. Deprecated: use GET /api/superadmin/conversations. Requires superadmin JWT authentication.
 // @Tags User Messages
 // @Produce json
 // @Security BearerAuth
@@ -25,9 +32,9 @@ func (h *Handler) getUserMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	messages, err := h.db.GetAllUserMessages()
+	messages, err := h.db.GetAllUserMessages(r.Context())
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -37,7 +44,7 @@ func (h *Handler) getUserMessages(w http.ResponseWriter, r *http.Request) {
 
 // getMarketMessages retrieves all market messages
 // @Summary Get all market messages
-// @Description Retrieves all messages sent by markets to superadmin. Requires superadmin JWT authentication.
+// @Description Retrieves the one-shot messages markets sent before support conversations existed; they were carried over to conversations. Deprecated: use GET /api/superadmin/conversations. Requires superadmin JWT authentication.
 // @Tags Market Messages
 // @Produce json
 // @Security BearerAuth
@@ -53,9 +60,9 @@ func (h *Handler) getMarketMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	messages, err := h.db.GetAllMarketMessages()
+	messages, err := h.db.GetAllMarketMessages(r.Context())
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -97,9 +104,431 @@ func (h *Handler) getUsers(w http.ResponseWriter, r *http.Request) {
     // Fetch users
     users, err := h.db.GetUsers(r.Context(), page, limit, search)
     if err != nil {
-        respondError(w, http.StatusInternalServerError, err.Error())
+        respondServiceError(w, http.StatusInternalServerError, err)
         return
     }
 
     respondJSON(w, http.StatusOK, users)
-}
\ No newline at end of file
+}
+
+// getAuditEvents retrieves the audit log of administrative actions
+// @Summary     Get audit events
+// @Description Retrieves a paginated, filterable list of audited market admin and superadmin actions. Requires superadmin authentication.
+// @Tags        Superadmin
+// @Produce     json
+// @Param       actor_id    query integer false "Actor ID (user, market or superadmin ID depending on role)"
+// @Param       actor_role  query string  false "Actor role (superadmin, market_admin)"
+// @Param       entity_type query string  false "Entity type (e.g. markets, products, sizes, users, cart_orders)"
+// @Param       entity_id   query string  false "Entity ID"
+// @Param       from        query string  false "Start of time range (RFC3339 or YYYY-MM-DD)"
+// @Param       to          query string  false "End of time range (RFC3339 or YYYY-MM-DD, inclusive)"
+// @Param       page        query integer false "Page number (default: 1)"
+// @Param       limit       query integer false "Items per page (default: 20, max: 100)"
+// @Security    BearerAuth
+// @Router      /api/superadmin/audit-events [get]
+func (h *Handler) getAuditEvents(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.Role != "superadmin" {
+		if !ok {
+			respondError(w, http.StatusUnauthorized, "Unauthorized")
+		} else {
+			respondError(w, http.StatusForbidden, "Forbidden")
+		}
+		return
+	}
+
+	query := r.URL.Query()
+	filter := models.AuditEventFilter{
+		ActorRole:  query.Get("actor_role"),
+		EntityType: query.Get("entity_type"),
+		EntityID:   query.Get("entity_id"),
+	}
+
+	if actorIDStr := query.Get("actor_id"); actorIDStr != "" {
+		actorID, err := strconv.Atoi(actorIDStr)
+		if err != nil || actorID < 1 {
+			respondError(w, http.StatusBadRequest, "Invalid actor_id")
+			return
+		}
+		filter.ActorID = actorID
+	}
+
+	if fromStr := query.Get("from"); fromStr != "" {
+		from, _, err := parseTimeParam(fromStr)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid from; use RFC3339 or YYYY-MM-DD")
+			return
+		}
+		filter.From = &from
+	}
+	if toStr := query.Get("to"); toStr != "" {
+		to, dateOnly, err := parseTimeParam(toStr)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid to; use RFC3339 or YYYY-MM-DD")
+			return
+		}
+		if dateOnly {
+			// Include the whole day
+			to = to.Add(24*time.Hour - time.Second)
+		}
+		filter.To = &to
+	}
+
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit < 1 {
+		limit = 20
+	}
+	if limit > 100 {
+		limit = 100
+	}
+
+	events, totalCount, err := h.db.GetAuditEvents(r.Context(), filter, page, limit)
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"items":       events,
+		"total_count": totalCount,
+		"page":        page,
+		"limit":       limit,
+	})
+}
+
+// parseTimeParam parses an RFC3339 timestamp or a YYYY-MM-DD date, reporting whether it was a date
+func parseTimeParam(s string) (time.Time, bool, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, false, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	return t, true, err
+}
+
+// getJobs reports the background job queue and its dead-letter list
+// @Summary     Get background jobs
+// @Description Returns the length of the job queue lists and the most recent dead-lettered jobs. Requires superadmin JWT authentication.
+// @Tags        Superadmin
+// @Produce     json
+// @Param       page  query integer false "Page number of dead jobs (default: 1)"
+// @Param       limit query integer false "Dead jobs per page (default: 20, max: 100)"
+// @Security    BearerAuth
+// @Router      /api/superadmin/jobs [get]
+func (h *Handler) getJobs(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.Role != "superadmin" {
+		if !ok {
+			respondError(w, http.StatusUnauthorized, "Unauthorized")
+		} else {
+			respondError(w, http.StatusForbidden, "Forbidden")
+		}
+		return
+	}
+
+	query := r.URL.Query()
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit < 1 {
+		limit = 20
+	}
+	if limit > 100 {
+		limit = 100
+	}
+
+	stats, err := h.db.GetJobQueueStats(r.Context())
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+	deadJobs, totalCount, err := h.db.GetDeadJobs(r.Context(), page, limit)
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"stats": stats,
+		"dead": map[string]interface{}{
+			"items":       deadJobs,
+			"total_count": totalCount,
+			"page":        page,
+			"limit":       limit,
+		},
+	})
+}
+
+// getJob retrieves a background job
+// @Summary     Get a background job
+// @Description Returns the status, attempts and last error of a background job. Requires superadmin JWT authentication.
+// @Tags        Superadmin
+// @Produce     json
+// @Param       job_id path string true "Job ID"
+// @Security    BearerAuth
+// @Router      /api/superadmin/jobs/{job_id} [get]
+func (h *Handler) getJob(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.Role != "superadmin" {
+		if !ok {
+			respondError(w, http.StatusUnauthorized, "Unauthorized")
+		} else {
+			respondError(w, http.StatusForbidden, "Forbidden")
+		}
+		return
+	}
+
+	job, err := h.db.GetJob(r.Context(), mux.Vars(r)["job_id"])
+	if err != nil {
+		if errors.Is(err, services.ErrJobNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
+			return
+		}
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, job)
+}
+
+// reportRequest checks for a superadmin and reads the date range and format of a report request.
+// On failure it responds itself and returns false.
+func reportRequest(w http.ResponseWriter, r *http.Request) (from, to time.Time, asCSV bool, ok bool) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.Role != "superadmin" {
+		if !ok {
+			respondError(w, http.StatusUnauthorized, "Unauthorized")
+		} else {
+			respondError(w, http.StatusForbidden, "Forbidden")
+		}
+		return from, to, false, false
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+	case "csv":
+		asCSV = true
+	default:
+		respondError(w, http.StatusBadRequest, "Invalid format; must be json or csv")
+		return from, to, false, false
+	}
+
+	from, to, ok = parseAnalyticsRange(w, r)
+	return from, to, asCSV, ok
+}
+
+// respondCSV sends rows as a CSV file download
+func respondCSV(w http.ResponseWriter, fileName string, rows [][]string) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, fileName))
+	w.WriteHeader(http.StatusOK)
+	writer := csv.NewWriter(w)
+	if err := writer.WriteAll(rows); err != nil {
+		slog.Error("Failed to write CSV", "error", err)
+	}
+}
+
+// reportFileName names the CSV export of a report after its date range
+func reportFileName(name string, from, to time.Time) string {
+	return fmt.Sprintf("%s-%s-%s.csv", name, from.Format("2006-01-02"), to.Format("2006-01-02"))
+}
+
+func formatMoney(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+func formatRatio(v float64) string {
+	return strconv.FormatFloat(v, 'f', 4, 64)
+}
+
+// getReportSummary retrieves the platform totals and order funnel
+// @Summary     Get platform report summary
+// @Description Returns GMV, items sold, new users and markets, active markets (markets with at least one order) and the order funnel (carts started, orders, delivered) for a date range (default: last 30 days). Figures come from the nightly rollup; data_through is the last rolled-up day. Requires superadmin JWT authentication.
+// @Tags        Reports
+// @Produce     json
+// @Produce     text/csv
+// @Param       from   query string false "Start date (YYYY-MM-DD, inclusive)"
+// @Param       to     query string false "End date (YYYY-MM-DD, inclusive; default: today)"
+// @Param       format query string false "Response format (json, csv; default: json)"
+// @Security    BearerAuth
+// @Router      /api/superadmin/reports/summary [get]
+func (h *Handler) getReportSummary(w http.ResponseWriter, r *http.Request) {
+	from, to, asCSV, ok := reportRequest(w, r)
+	if !ok {
+		return
+	}
+
+	summary, err := h.db.GetReportSummary(r.Context(), from, to)
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if asCSV {
+		funnel := summary.Funnel
+		respondCSV(w, reportFileName("report-summary", from, to), [][]string{
+			{"metric", "value"},
+			{"data_through", summary.DataThrough},
+			{"gmv", formatMoney(summary.GMV)},
+			{"items_sold", strconv.Itoa(summary.ItemsSold)},
+			{"new_users", strconv.Itoa(summary.NewUsers)},
+			{"new_markets", strconv.Itoa(summary.NewMarkets)},
+			{"active_markets", strconv.Itoa(summary.ActiveMarkets)},
+			{"carts_started", strconv.Itoa(funnel.CartsStarted)},
+			{"orders", strconv.Itoa(funnel.Orders)},
+			{"delivered_orders", strconv.Itoa(funnel.DeliveredOrders)},
+			{"cancelled_orders", strconv.Itoa(funnel.CancelledOrders)},
+			{"cart_to_order_rate", formatRatio(funnel.CartToOrderRate)},
+			{"order_to_delivered_rate", formatRatio(funnel.OrderToDeliveredRate)},
+		})
+		return
+	}
+	respondJSON(w, http.StatusOK, summary)
+}
+
+// getDailyReport retrieves the platform figures per day
+// @Summary     Get daily platform report
+// @Description Returns new users, new markets, active markets, orders and GMV per day of a date range, including days without activity. Requires superadmin JWT authentication.
+// @Tags        Reports
+// @Produce     json
+// @Produce     text/csv
+// @Param       from   query string false "Start date (YYYY-MM-DD, inclusive)"
+// @Param       to     query string false "End date (YYYY-MM-DD, inclusive; default: today)"
+// @Param       format query string false "Response format (json, csv; default: json)"
+// @Security    BearerAuth
+// @Router      /api/superadmin/reports/daily [get]
+func (h *Handler) getDailyReport(w http.ResponseWriter, r *http.Request) {
+	from, to, asCSV, ok := reportRequest(w, r)
+	if !ok {
+		return
+	}
+
+	days, err := h.db.GetDailyPlatformStats(r.Context(), from, to)
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if asCSV {
+		rows := [][]string{{"day", "new_users", "new_markets", "active_markets", "orders", "gmv"}}
+		for _, d := range days {
+			rows = append(rows, []string{d.Day, strconv.Itoa(d.NewUsers), strconv.Itoa(d.NewMarkets),
+				strconv.Itoa(d.ActiveMarkets), strconv.Itoa(d.Orders), formatMoney(d.GMV)})
+		}
+		respondCSV(w, reportFileName("report-daily", from, to), rows)
+		return
+	}
+	respondJSON(w, http.StatusOK, days)
+}
+
+// getMarketsReport retrieves the GMV of every market
+// @Summary     Get GMV per market
+// @Description Returns orders, delivered and cancelled orders, items sold and GMV of every market for a date range, highest GMV first. Requires superadmin JWT authentication.
+// @Tags        Reports
+// @Produce     json
+// @Produce     text/csv
+// @Param       from   query string false "Start date (YYYY-MM-DD, inclusive)"
+// @Param       to     query string false "End date (YYYY-MM-DD, inclusive; default: today)"
+// @Param       format query string false "Response format (json, csv; default: json)"
+// @Security    BearerAuth
+// @Router      /api/superadmin/reports/markets [get]
+func (h *Handler) getMarketsReport(w http.ResponseWriter, r *http.Request) {
+	from, to, asCSV, ok := reportRequest(w, r)
+	if !ok {
+		return
+	}
+
+	markets, err := h.db.GetMarketGMVReport(r.Context(), from, to)
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if asCSV {
+		rows := [][]string{{"market_id", "name", "name_ru", "is_vip", "orders", "delivered_orders", "cancelled_orders", "items_sold", "gmv"}}
+		for _, m := range markets {
+			rows = append(rows, []string{strconv.Itoa(m.MarketID), m.Name, m.NameRu, strconv.FormatBool(m.IsVIP),
+				strconv.Itoa(m.Orders), strconv.Itoa(m.DeliveredOrders), strconv.Itoa(m.CancelledOrders),
+				strconv.Itoa(m.ItemsSold), formatMoney(m.GMV)})
+		}
+		respondCSV(w, reportFileName("report-markets", from, to), rows)
+		return
+	}
+	respondJSON(w, http.StatusOK, markets)
+}
+
+// getCategoriesReport retrieves the sales per category
+// @Summary     Get category performance
+// @Description Returns orders, items sold, GMV and GMV share per category for a date range, highest GMV first. Category 0 collects uncategorized products. Requires superadmin JWT authentication.
+// @Tags        Reports
+// @Produce     json
+// @Produce     text/csv
+// @Param       from   query string false "Start date (YYYY-MM-DD, inclusive)"
+// @Param       to     query string false "End date (YYYY-MM-DD, inclusive; default: today)"
+// @Param       format query string false "Response format (json, csv; default: json)"
+// @Security    BearerAuth
+// @Router      /api/superadmin/reports/categories [get]
+func (h *Handler) getCategoriesReport(w http.ResponseWriter, r *http.Request) {
+	from, to, asCSV, ok := reportRequest(w, r)
+	if !ok {
+		return
+	}
+
+	categories, err := h.db.GetCategoryReport(r.Context(), from, to)
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if asCSV {
+		rows := [][]string{{"category_id", "name", "name_ru", "orders", "items_sold", "gmv", "gmv_share"}}
+		for _, c := range categories {
+			rows = append(rows, []string{strconv.Itoa(c.CategoryID), c.Name, c.NameRu, strconv.Itoa(c.Orders),
+				strconv.Itoa(c.ItemsSold), formatMoney(c.GMV), formatRatio(c.GMVShare)})
+		}
+		respondCSV(w, reportFileName("report-categories", from, to), rows)
+		return
+	}
+	respondJSON(w, http.StatusOK, categories)
+}
+
+// getVIPReport compares VIP and non-VIP markets
+// @Summary     Get VIP comparison
+// @Description Returns market count, active markets, orders, GMV, GMV per active market, average basket and cancellation rate of the non-VIP and the VIP markets for a date range. Requires superadmin JWT authentication.
+// @Tags        Reports
+// @Produce     json
+// @Produce     text/csv
+// @Param       from   query string false "Start date (YYYY-MM-DD, inclusive)"
+// @Param       to     query string false "End date (YYYY-MM-DD, inclusive; default: today)"
+// @Param       format query string false "Response format (json, csv; default: json)"
+// @Security    BearerAuth
+// @Router      /api/superadmin/reports/vip [get]
+func (h *Handler) getVIPReport(w http.ResponseWriter, r *http.Request) {
+	from, to, asCSV, ok := reportRequest(w, r)
+	if !ok {
+		return
+	}
+
+	segments, err := h.db.GetVIPComparison(r.Context(), from, to)
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if asCSV {
+		rows := [][]string{{"is_vip", "markets", "active_markets", "orders", "gmv", "gmv_per_active_market", "average_basket", "cancellation_rate"}}
+		for _, s := range segments {
+			rows = append(rows, []string{strconv.FormatBool(s.IsVIP), strconv.Itoa(s.Markets), strconv.Itoa(s.ActiveMarkets),
+				strconv.Itoa(s.Orders), formatMoney(s.GMV), formatMoney(s.GMVPerActiveMarket), formatMoney(s.AverageBasket),
+				formatRatio(s.CancellationRate)})
+		}
+		respondCSV(w, reportFileName("report-vip", from, to), rows)
+		return
+	}
+	respondJSON(w, http.StatusOK, segments)
+}
@@ -1,8 +1,10 @@
 package api
 
 import (
+	"errors"
 	"net/http"
 	"Dowlet_projects/ecommerce/models"
+	"Dowlet_projects/ecommerce/services"
 	"strconv"
 )
 
@@ -35,9 +37,9 @@ func (h *Handler) getUserFavorites(w http.ResponseWriter, r *http.Request) {
 		limit = 10
 	}
 
-	products, err := h.db.GetUserFavoriteProducts(claims.UserID, page, limit)
+	products, err := h.db.GetUserFavoriteProducts(r.Context(), claims.UserID, page, limit)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -59,9 +61,9 @@ func (h *Handler) getCart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cart, err := h.db.GetUserCart(claims.UserID)
+	cart, err := h.db.GetUserCart(r.Context(), claims.UserID)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -84,9 +86,9 @@ func (h *Handler) getLocations(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	locations, err := h.db.GetUserLocations(claims.UserID)
+	locations, err := h.db.GetUserLocations(r.Context(), claims.UserID)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -109,13 +111,13 @@ func (h *Handler) getProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	profile, err := h.db.GetUserProfile(claims.UserID)
+	profile, err := h.db.GetUserProfile(r.Context(), claims.UserID)
 	if err != nil {
-		if err.Error() == "user not found" {
-			respondError(w, http.StatusNotFound, err.Error())
+		if errors.Is(err, services.ErrUserNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -152,9 +154,9 @@ func (h *Handler) getUserOrders(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	orders, err := h.db.GetUserOrders(claims.UserID, status)
+	orders, err := h.db.GetUserOrders(r.Context(), claims.UserID, status)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
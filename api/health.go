@@ -0,0 +1,82 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"Dowlet_projects/ecommerce/metrics"
+)
+
+// HTTP metrics, labelled by route template rather than path to keep the number of series bounded
+var (
+	httpRequests = metrics.NewCounter("ecommerce_http_requests_total",
+		"HTTP requests by method, route template and status code", "method", "route", "status")
+	httpRequestDuration = metrics.NewHistogram("ecommerce_http_request_duration_seconds",
+		"HTTP request latency by method and route template", metrics.DefaultBuckets, "method", "route")
+)
+
+// probeRoutes are polled by orchestrators and scrapers; their access log lines are debug level
+var probeRoutes = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// readyTimeout bounds the connection checks of /readyz
+const readyTimeout = 2 * time.Second
+
+// healthz reports that the server is running
+// @Summary     Liveness check
+// @Description Answers 200 while the server process is serving requests. It does not check MySQL or Redis, so that an outage of either does not get the server restarted; use /readyz for that.
+// @Tags        Health
+// @Produce     json
+// @Router      /healthz [get]
+func (h *Handler) healthz(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz reports whether MySQL and Redis are reachable
+// @Summary     Readiness check
+// @Description Pings MySQL and Redis. Answers 200 when both respond, otherwise 503 with the failing checks.
+// @Tags        Health
+// @Produce     json
+// @Router      /readyz [get]
+func (h *Handler) readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	status, code := "ok", http.StatusOK
+	checks := map[string]string{}
+	for name, err := range h.db.Ping(ctx) {
+		if err != nil {
+			checks[name] = err.Error()
+			status, code = "unavailable", http.StatusServiceUnavailable
+			continue
+		}
+		checks[name] = "ok"
+	}
+	respondJSON(w, code, map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	})
+}
+
+// serveMetrics serves the metrics in the Prometheus text format. With METRICS_TOKEN set, scrapers
+// must send it as a bearer token.
+// @Summary     Prometheus metrics
+// @Description HTTP latency and status by route, connection pool statistics, cache hits and misses, and business counters in the Prometheus text format. Requires the METRICS_TOKEN bearer token when one is configured.
+// @Tags        Health
+// @Produce     plain
+// @Router      /metrics [get]
+func (h *Handler) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.MetricsToken != "" {
+		token := []byte("Bearer " + h.cfg.MetricsToken)
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), token) != 1 {
+			respondError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+	}
+	metrics.Handler().ServeHTTP(w, r)
+}
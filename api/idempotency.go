@@ -0,0 +1,178 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"Dowlet_projects/ecommerce/models"
+	"Dowlet_projects/ecommerce/services"
+)
+
+// idempotencyKeyHeader lets clients retry POST and PUT requests without repeating their effect
+const idempotencyKeyHeader = "Idempotency-Key"
+
+const (
+	// maxIdempotentRequestSize bounds the bodies held in memory to fingerprint a request
+	maxIdempotentRequestSize = 32 << 20
+	// maxIdempotentResponseSize bounds the responses stored for replay; larger ones are not kept
+	maxIdempotentResponseSize = 1 << 20
+)
+
+// replayedHeaders are the response headers stored with a response, besides its status and body
+var replayedHeaders = []string{"Content-Type", "Content-Disposition", "Content-Language", "Location"}
+
+// idempotencyResponseWriter keeps a copy of a response to store it for retries
+type idempotencyResponseWriter struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *idempotencyResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *idempotencyResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.overflow {
+		if w.body.Len()+len(b) > maxIdempotentResponseSize {
+			w.overflow = true
+			w.body.Reset()
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *idempotencyResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// idempotencyMiddleware replays the stored response when a POST or PUT request is retried with
+// the Idempotency-Key of an earlier request of the same account, instead of running it again.
+// Reusing a key for a different method, path or body is rejected with 422, and a retry that
+// arrives while the first request is still running gets 409. Server errors are not stored, so
+// such requests may be retried. It runs after authMiddleware, as keys are scoped to the account.
+func (h *Handler) idempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || (r.Method != http.MethodPost && r.Method != http.MethodPut) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		claims, ok := r.Context().Value("claims").(*models.Claims)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !validIdempotencyKey(key) {
+			respondServiceError(w, http.StatusBadRequest, services.ErrInvalidIdempotencyKey)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentRequestSize))
+		if err != nil {
+			respondError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		scope := accountKey(claims)
+		fingerprint := requestFingerprint(r, body)
+		stored, err := h.db.StartIdempotentRequest(r.Context(), scope, key, fingerprint)
+		switch {
+		case errors.Is(err, services.ErrIdempotencyKeyReused):
+			respondServiceError(w, http.StatusUnprocessableEntity, err)
+			return
+		case errors.Is(err, services.ErrIdempotencyKeyInUse):
+			respondServiceError(w, http.StatusConflict, err)
+			return
+		case err != nil:
+			// Without Redis the request runs as if it carried no key
+			slog.WarnContext(r.Context(), "Idempotency key ignored", "error", err)
+			next.ServeHTTP(w, r)
+			return
+		case stored != nil:
+			for name, value := range stored.Header {
+				w.Header().Set(name, value)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+
+		rec := &idempotencyResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		// Responses are kept even if the client has gone away, which is when it will retry
+		ctx := context.WithoutCancel(r.Context())
+		if rec.status >= http.StatusInternalServerError || rec.overflow {
+			if err := h.db.ReleaseIdempotencyKey(ctx, scope, key); err != nil {
+				slog.WarnContext(ctx, "Failed to release idempotency key", "error", err)
+			}
+			return
+		}
+		response := services.IdempotentResponse{
+			Fingerprint: fingerprint,
+			Status:      rec.status,
+			Header:      map[string]string{},
+			Body:        rec.body.Bytes(),
+		}
+		for _, name := range replayedHeaders {
+			if value := w.Header().Get(name); value != "" {
+				response.Header[name] = value
+			}
+		}
+		if err := h.db.CompleteIdempotentRequest(ctx, scope, key, response, h.cfg.IdempotencyTTL); err != nil {
+			slog.WarnContext(ctx, "Failed to store idempotent response", "error", err)
+		}
+	})
+}
+
+// validIdempotencyKey accepts 1 to 255 printable ASCII characters, such as UUIDs
+func validIdempotencyKey(key string) bool {
+	if len(key) > 255 {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x21 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestFingerprint identifies a request by method, path, query and body. Multipart boundaries
+// are left out, as clients pick a new one when they encode a retry.
+func requestFingerprint(r *http.Request, body []byte) string {
+	if mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil &&
+		strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		body = bytes.ReplaceAll(body, []byte(params["boundary"]), nil)
+	}
+	hash := sha256.New()
+	io.WriteString(hash, r.Method+" "+r.URL.RequestURI()+"\n")
+	io.WriteString(hash, strconv.Itoa(len(body))+"\n")
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
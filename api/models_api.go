@@ -10,53 +10,54 @@ type CartRequest struct {
 }
 
 type LocationRequest struct {
-	LocationName      string `json:"location_name"`
-	LocationNameRu    string `json:"location_name_ru"`
-	LocationAddress   string `json:"location_address"`
-	LocationAddressRu string `json:"location_address_ru"`
+	LocationName      string `json:"location_name" validate:"required,max=255"`
+	LocationNameRu    string `json:"location_name_ru" validate:"max=255"`
+	LocationAddress   string `json:"location_address" validate:"required,max=255"`
+	LocationAddressRu string `json:"location_address_ru" validate:"max=255"`
 }
 
 // OrderRequest for submitting an order
 type OrderRequest struct {
-	LocationID int    `json:"location_id"`
-	Name       string `json:"name"`
-	Phone      string `json:"phone"`
+	LocationID int    `json:"location_id" validate:"required,min=1"`
+	Name       string `json:"name" validate:"required,max=255"`
+	Phone      string `json:"phone" validate:"required,max=20"`
 	Notes      string `json:"notes"`
 }
 
+// ProductRequest holds the form fields of a product; discount is a percentage
 type ProductRequest struct {
-	CategoryID    int     `json:"category_id"`
-	Name          string  `json:"name"`
-	NameRu        string  `json:"name_ru"`
-	Price         float64 `json:"price"`
-	Discount      float64 `json:"discount,omitempty"`
-	Description   string  `json:"description,omitempty"`
-	DescriptionRu string  `json:"description_ru,omitempty"`
-	IsActive      bool    `json:"is_active"`
+	CategoryID    int     `json:"category_id" form:"category_id" validate:"required,min=1"`
+	Name          string  `json:"name" form:"name" validate:"required,max=255"`
+	NameRu        string  `json:"name_ru" form:"name_ru" validate:"max=255"`
+	Price         float64 `json:"price" form:"price" validate:"required,gt=0,max=99999999"`
+	Discount      float64 `json:"discount,omitempty" form:"discount" validate:"min=0,max=100"`
+	Description   string  `json:"description,omitempty" form:"description"`
+	DescriptionRu string  `json:"description_ru,omitempty" form:"description_ru"`
+	IsActive      bool    `json:"is_active" form:"is_active"`
 }
 
 // SizeRequest for adding a size
 type SizeRequest struct {
-	Size  string  `json:"size"`
-	Count int     `json:"count"`
-	Price float64 `json:"price"`
+	Size  string  `json:"size" validate:"required,max=50"`
+	Count int     `json:"count" validate:"required,min=1"`
+	Price float64 `json:"price" validate:"min=0,max=99999999"`
 }
 
 // FavoriteRequest for toggling favorite
 type FavoriteRequest struct {
-	ProductID int `json:"product_id"`
+	ProductID int `json:"product_id" validate:"required,min=1"`
 }
 
 // MarketRequest for market login
 type MarketRequest struct {
-	Phone    string `json:"phone"`
-	Password string `json:"password"`
+	Phone    string `json:"phone" validate:"required"`
+	Password string `json:"password" validate:"required"`
 }
 
 // SuperadminRequest for superadmin login
 type SuperadminRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username string `json:"username" validate:"required"`
+	Password string `json:"password" validate:"required"`
 }
 
 // UserRegisterRequest for user registration
@@ -80,3 +81,38 @@ type CreateMarketRequest struct {
 	Phone        string `json:"phone"`
 	Password     string `json:"password"`
 }
+
+// MarketCreateForm holds the form fields of a new market and its admin account
+type MarketCreateForm struct {
+	Name          string   `form:"name" validate:"required,max=255"`
+	NameRu        string   `form:"name_ru" validate:"required,max=255"`
+	Location      string   `form:"location" validate:"max=255"`
+	LocationRu    string   `form:"location_ru" validate:"max=255"`
+	Phone         string   `form:"phone" validate:"required,max=20"`
+	DeliveryPrice *float64 `form:"delivery_price" validate:"required,min=0,max=99999999"`
+	Password      string   `form:"password" validate:"required,max=255"`
+}
+
+// MarketUpdateForm holds the form fields of a superadmin market update; unset fields are left unchanged
+type MarketUpdateForm struct {
+	Password      string   `form:"password" validate:"max=255"`
+	DeliveryPrice *float64 `form:"delivery_price" validate:"omitempty,min=0,max=99999999"`
+	Phone         string   `form:"phone" validate:"omitempty,phone"`
+	Name          string   `form:"name" validate:"max=255"`
+	NameRu        string   `form:"name_ru" validate:"max=255"`
+	Location      string   `form:"location" validate:"max=255"`
+	LocationRu    string   `form:"location_ru" validate:"max=255"`
+	IsVIP         *bool    `form:"isVIP"`
+}
+
+// ThumbnailsForm holds the comma-separated colors of thumbnails uploaded together, one per file
+type ThumbnailsForm struct {
+	Colors   string `form:"colors" validate:"required"`
+	ColorsRu string `form:"colors_ru" validate:"required"`
+}
+
+// ThumbnailForm holds the colors of a replaced thumbnail
+type ThumbnailForm struct {
+	Color   string `form:"color" validate:"required,max=50"`
+	ColorRu string `form:"color_ru" validate:"required,max=50"`
+}
@@ -0,0 +1,242 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"Dowlet_projects/ecommerce/models"
+	"Dowlet_projects/ecommerce/services"
+
+	"github.com/gorilla/mux"
+)
+
+// notificationRecipient resolves the inbox of the caller: users have their own, a market's login and
+// staff share the market inbox
+func notificationRecipient(claims *models.Claims) (string, int, bool) {
+	switch {
+	case claims.Role == "user" && claims.UserID != 0:
+		return models.RecipientUser, claims.UserID, true
+	case claims.Role == "market_admin" && claims.MarketID != 0:
+		return models.RecipientMarket, claims.MarketID, true
+	}
+	return "", 0, false
+}
+
+// deviceOwner resolves who a push token registered by the caller belongs to
+func deviceOwner(claims *models.Claims) (string, int, bool) {
+	switch {
+	case claims.Role == "user" && claims.UserID != 0:
+		return models.RecipientUser, claims.UserID, true
+	case claims.Role == "market_admin" && claims.StaffID != 0:
+		return models.RecipientMarketStaff, claims.StaffID, true
+	case claims.Role == "market_admin" && claims.MarketID != 0:
+		return models.RecipientMarket, claims.MarketID, true
+	}
+	return "", 0, false
+}
+
+// registerDevice registers a push notification token for the caller
+// @Summary Register a push device
+// @Description Registers an FCM device token of the authenticated user, market or market staff member for push notifications. Registering a known token moves it to the caller.
+// @Tags Notifications
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body models.RegisterDeviceRequest true "Device token and platform (android, ios, web)"
+// @Router /api/devices [post]
+// @Router /api/market/devices [post]
+func (h *Handler) registerDevice(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	ownerType, ownerID, ok := deviceOwner(claims)
+	if !ok {
+		respondError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	var req models.RegisterDeviceRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if err := h.db.RegisterDevice(r.Context(), ownerType, ownerID, req.Token, req.Platform); err != nil {
+		if errors.Is(err, services.ErrInvalidPlatform) {
+			respondError(w, http.StatusBadRequest, "Invalid platform; must be one of android, ios, web")
+			return
+		}
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Device registered successfully"})
+}
+
+// unregisterDevice removes a push notification token of the caller
+// @Summary Unregister a push device
+// @Description Removes a device token of the authenticated user, market or market staff member, e.g. on logout.
+// @Tags Notifications
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body models.UnregisterDeviceRequest true "Device token"
+// @Router /api/devices [delete]
+// @Router /api/market/devices [delete]
+func (h *Handler) unregisterDevice(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	ownerType, ownerID, ok := deviceOwner(claims)
+	if !ok {
+		respondError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	var req models.UnregisterDeviceRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if err := h.db.UnregisterDevice(r.Context(), ownerType, ownerID, req.Token); err != nil {
+		if errors.Is(err, services.ErrDeviceNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
+			return
+		}
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Device unregistered successfully"})
+}
+
+// getNotifications lists the caller's in-app notifications
+// @Summary Get notifications
+// @Description Lists the in-app notifications of the authenticated user, or of the market for market admins and staff, newest first.
+// @Tags Notifications
+// @Produce json
+// @Security BearerAuth
+// @Param unread query boolean false "Only unread notifications"
+// @Param page query integer false "Page number (default: 1)"
+// @Param limit query integer false "Items per page (default: 20, max: 100)"
+// @Router /api/notifications [get]
+// @Router /api/market/notifications [get]
+func (h *Handler) getNotifications(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	recipientType, recipientID, ok := notificationRecipient(claims)
+	if !ok {
+		respondError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	query := r.URL.Query()
+	unreadOnly, err := strconv.ParseBool(query.Get("unread"))
+	if err != nil && query.Get("unread") != "" {
+		respondError(w, http.StatusBadRequest, "Invalid unread value")
+		return
+	}
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit < 1 {
+		limit = 20
+	}
+	if limit > 100 {
+		limit = 100
+	}
+
+	notifications, totalCount, unreadCount, err := h.db.GetNotifications(r.Context(), recipientType, recipientID, unreadOnly, page, limit)
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"items":        notifications,
+		"total_count":  totalCount,
+		"unread_count": unreadCount,
+		"page":         page,
+		"limit":        limit,
+	})
+}
+
+// markNotificationRead marks one of the caller's notifications as read
+// @Summary Mark a notification as read
+// @Description Marks an in-app notification of the authenticated user or market as read.
+// @Tags Notifications
+// @Produce json
+// @Security BearerAuth
+// @Param notification_id path integer true "Notification ID"
+// @Router /api/notifications/{notification_id}/read [put]
+// @Router /api/market/notifications/{notification_id}/read [put]
+func (h *Handler) markNotificationRead(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	recipientType, recipientID, ok := notificationRecipient(claims)
+	if !ok {
+		respondError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	notificationID, err := strconv.Atoi(mux.Vars(r)["notification_id"])
+	if err != nil || notificationID < 1 {
+		respondError(w, http.StatusBadRequest, "Invalid notification ID")
+		return
+	}
+
+	if err := h.db.MarkNotificationRead(r.Context(), recipientType, recipientID, notificationID); err != nil {
+		if errors.Is(err, services.ErrNotificationNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
+			return
+		}
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Notification marked as read"})
+}
+
+// markAllNotificationsRead marks all of the caller's notifications as read
+// @Summary Mark all notifications as read
+// @Description Marks every unread in-app notification of the authenticated user or market as read.
+// @Tags Notifications
+// @Produce json
+// @Security BearerAuth
+// @Router /api/notifications/read-all [put]
+// @Router /api/market/notifications/read-all [put]
+func (h *Handler) markAllNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	recipientType, recipientID, ok := notificationRecipient(claims)
+	if !ok {
+		respondError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	updated, err := h.db.MarkAllNotificationsRead(r.Context(), recipientType, recipientID)
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Notifications marked as read",
+		"updated": updated,
+	})
+}
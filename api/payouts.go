@@ -0,0 +1,342 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"Dowlet_projects/ecommerce/models"
+	"Dowlet_projects/ecommerce/services"
+
+	"github.com/gorilla/mux"
+)
+
+// requireSuperadmin responds and returns false unless the caller is a superadmin
+func requireSuperadmin(w http.ResponseWriter, r *http.Request) (*models.Claims, bool) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.Role != "superadmin" {
+		if !ok {
+			respondError(w, http.StatusUnauthorized, "Unauthorized")
+		} else {
+			respondError(w, http.StatusForbidden, "Forbidden")
+		}
+		return nil, false
+	}
+	return claims, true
+}
+
+// payoutScope returns the market whose statements the caller may see: their own market for market
+// admins, or 0 (every market) for superadmins
+func payoutScope(w http.ResponseWriter, r *http.Request) (int, bool) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return 0, false
+	}
+	switch {
+	case claims.Role == "superadmin":
+		return 0, true
+	case claims.Role == "market_admin" && claims.MarketID != 0:
+		return claims.MarketID, true
+	}
+	respondError(w, http.StatusForbidden, "Forbidden")
+	return 0, false
+}
+
+// getCommissionRates lists the commission rates
+// @Summary     Get commission rates
+// @Description Lists the commission rates. market_id and category_id 0 stand for any market or category; the most specific rate of a delivered order item applies (market and category, market, category, platform default). Requires superadmin JWT authentication.
+// @Tags        Payouts
+// @Produce     json
+// @Security    BearerAuth
+// @Router      /api/superadmin/commission-rates [get]
+func (h *Handler) getCommissionRates(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireSuperadmin(w, r); !ok {
+		return
+	}
+
+	rates, err := h.db.GetCommissionRates(r.Context())
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, rates)
+}
+
+// setCommissionRate creates or changes a commission rate
+// @Summary     Set a commission rate
+// @Description Creates or changes the commission percentage of a market, a category, a market's category, or the platform default (both 0). New rates apply to items delivered afterwards. Requires superadmin JWT authentication.
+// @Tags        Payouts
+// @Accept      json
+// @Produce     json
+// @Param       request body models.SetCommissionRateRequest true "Scope and rate (0-100)"
+// @Security    BearerAuth
+// @Router      /api/superadmin/commission-rates [put]
+func (h *Handler) setCommissionRate(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireSuperadmin(w, r); !ok {
+		return
+	}
+
+	var req models.SetCommissionRateRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	rateID, err := h.db.SetCommissionRate(r.Context(), req)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidRate), errors.Is(err, services.ErrInvalidRateScope):
+			respondServiceError(w, http.StatusBadRequest, err)
+		case errors.Is(err, services.ErrMarketNotFound), errors.Is(err, services.ErrCategoryNotFound):
+			respondServiceError(w, http.StatusNotFound, err)
+		default:
+			respondServiceError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Commission rate saved successfully",
+		"rate_id": rateID,
+	})
+}
+
+// deleteCommissionRate removes a commission rate
+// @Summary     Delete a commission rate
+// @Description Removes a market or category commission rate so that the next less specific rate applies. The platform default cannot be removed. Requires superadmin JWT authentication.
+// @Tags        Payouts
+// @Produce     json
+// @Param       rate_id path integer true "Commission rate ID"
+// @Security    BearerAuth
+// @Router      /api/superadmin/commission-rates/{rate_id} [delete]
+func (h *Handler) deleteCommissionRate(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireSuperadmin(w, r); !ok {
+		return
+	}
+	rateID, err := strconv.Atoi(mux.Vars(r)["rate_id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid rate ID")
+		return
+	}
+
+	if err := h.db.DeleteCommissionRate(r.Context(), rateID); err != nil {
+		switch {
+		case errors.Is(err, services.ErrCommissionRateNotFound):
+			respondServiceError(w, http.StatusNotFound, err)
+		case errors.Is(err, services.ErrDefaultCommissionRate):
+			respondServiceError(w, http.StatusBadRequest, err)
+		default:
+			respondServiceError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Commission rate deleted successfully"})
+}
+
+// getPayoutStatements lists payout statements
+// @Summary     Get payout statements
+// @Description Lists payout statements, newest period first. Market admins see their own market's; superadmins see every market's and may filter by market_id. Requires market admin or superadmin JWT authentication.
+// @Tags        Payouts
+// @Produce     json
+// @Param       status    query string  false "Filter by status (pending, paid)"
+// @Param       market_id query integer false "Filter by market (superadmin only)"
+// @Param       page      query integer false "Page number (default: 1)"
+// @Param       limit     query integer false "Items per page (default: 20, max: 100)"
+// @Security    BearerAuth
+// @Router      /api/market/payouts [get]
+// @Router      /api/superadmin/payouts [get]
+func (h *Handler) getPayoutStatements(w http.ResponseWriter, r *http.Request) {
+	marketID, ok := payoutScope(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	status := query.Get("status")
+	if status != "" && status != models.PayoutStatusPending && status != models.PayoutStatusPaid {
+		respondError(w, http.StatusBadRequest, "Invalid status; must be pending or paid")
+		return
+	}
+	if marketID == 0 && query.Get("market_id") != "" {
+		id, err := strconv.Atoi(query.Get("market_id"))
+		if err != nil || id < 1 {
+			respondError(w, http.StatusBadRequest, "Invalid market_id")
+			return
+		}
+		marketID = id
+	}
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit < 1 {
+		limit = 20
+	}
+	if limit > 100 {
+		limit = 100
+	}
+
+	statements, totalCount, err := h.db.GetPayoutStatements(r.Context(), marketID, status, page, limit)
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"items":       statements,
+		"total_count": totalCount,
+		"page":        page,
+		"limit":       limit,
+	})
+}
+
+// getPayoutStatement retrieves a payout statement with its ledger entries
+// @Summary     Get a payout statement
+// @Description Returns a payout statement with its ledger entries, or with format=csv downloads the entries as a CSV file. Market admins can only access their own market's statements. Requires market admin or superadmin JWT authentication.
+// @Tags        Payouts
+// @Produce     json
+// @Produce     text/csv
+// @Param       statement_id path  integer true  "Payout statement ID"
+// @Param       format       query string  false "Response format (json, csv; default: json)"
+// @Security    BearerAuth
+// @Router      /api/market/payouts/{statement_id} [get]
+// @Router      /api/superadmin/payouts/{statement_id} [get]
+func (h *Handler) getPayoutStatement(w http.ResponseWriter, r *http.Request) {
+	marketID, ok := payoutScope(w, r)
+	if !ok {
+		return
+	}
+	statementID, err := strconv.Atoi(mux.Vars(r)["statement_id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid statement ID")
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		respondError(w, http.StatusBadRequest, "Invalid format; must be json or csv")
+		return
+	}
+
+	statement, err := h.db.GetPayoutStatement(r.Context(), statementID, marketID)
+	if err != nil {
+		if errors.Is(err, services.ErrStatementNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
+			return
+		}
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if format == "csv" {
+		rows := [][]string{{"entry_id", "created_at", "entry_type", "item_id", "debit_account", "credit_account", "amount", "commission_rate", "reversal_of"}}
+		for _, e := range statement.Entries {
+			itemID, rate, reversalOf := "", "", ""
+			if e.ItemID != nil {
+				itemID = strconv.Itoa(*e.ItemID)
+			}
+			if e.CommissionRate != nil {
+				rate = formatMoney(*e.CommissionRate)
+			}
+			if e.ReversalOf != nil {
+				reversalOf = strconv.Itoa(*e.ReversalOf)
+			}
+			rows = append(rows, []string{strconv.Itoa(e.ID), e.CreatedAt, e.EntryType, itemID, e.DebitAccount,
+				e.CreditAccount, formatMoney(e.Amount), rate, reversalOf})
+		}
+		rows = append(rows,
+			[]string{},
+			[]string{"gross", formatMoney(statement.Gross)},
+			[]string{"commission", formatMoney(statement.Commission)},
+			[]string{"net", formatMoney(statement.Net)},
+			[]string{"status", statement.Status})
+		respondCSV(w, fmt.Sprintf("payout-%d-%s-%s.csv", statement.MarketID, statement.PeriodStart, statement.PeriodEnd), rows)
+		return
+	}
+	respondJSON(w, http.StatusOK, statement)
+}
+
+// generatePayoutStatements creates the payout statements of a period
+// @Summary     Generate payout statements
+// @Description Assigns every market's unsettled ledger entries posted up to the end of the period (including leftovers of earlier periods) to the market's statement of that period. Statements of the previous month are also generated automatically at the start of each month. Requires superadmin JWT authentication.
+// @Tags        Payouts
+// @Accept      json
+// @Produce     json
+// @Param       request body models.GeneratePayoutStatementsRequest true "Period (YYYY-MM-DD, inclusive)"
+// @Security    BearerAuth
+// @Router      /api/superadmin/payouts/statements [post]
+func (h *Handler) generatePayoutStatements(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireSuperadmin(w, r); !ok {
+		return
+	}
+
+	var req models.GeneratePayoutStatementsRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	// Both dates passed the date rule
+	start, _ := time.Parse("2006-01-02", req.PeriodStart)
+	end, _ := time.Parse("2006-01-02", req.PeriodEnd)
+
+	statementIDs, err := h.db.GeneratePayoutStatements(r.Context(), start, end)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidPayoutPeriod) {
+			respondServiceError(w, http.StatusBadRequest, err)
+			return
+		}
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"message":       "Payout statements generated successfully",
+		"statement_ids": statementIDs,
+	})
+}
+
+// markPayoutPaid marks a payout statement as paid
+// @Summary     Mark a payout statement as paid
+// @Description Marks a pending payout statement as paid and posts the payout entry settling the market's balance. Requires superadmin JWT authentication.
+// @Tags        Payouts
+// @Accept      json
+// @Produce     json
+// @Param       statement_id path integer                      true  "Payout statement ID"
+// @Param       request      body models.MarkPayoutPaidRequest false "Payment reference, e.g. a bank transfer number"
+// @Security    BearerAuth
+// @Router      /api/superadmin/payouts/{statement_id}/paid [put]
+func (h *Handler) markPayoutPaid(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireSuperadmin(w, r)
+	if !ok {
+		return
+	}
+	statementID, err := strconv.Atoi(mux.Vars(r)["statement_id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid statement ID")
+		return
+	}
+
+	var req models.MarkPayoutPaidRequest
+	if r.ContentLength != 0 {
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+	}
+
+	if err := h.db.MarkPayoutStatementPaid(r.Context(), statementID, claims.UserID, req.Reference); err != nil {
+		switch {
+		case errors.Is(err, services.ErrStatementNotFound):
+			respondServiceError(w, http.StatusNotFound, err)
+		case errors.Is(err, services.ErrStatementPaid):
+			respondServiceError(w, http.StatusConflict, err)
+		default:
+			respondServiceError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Payout statement marked as paid"})
+}
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"Dowlet_projects/ecommerce/models"
+	"Dowlet_projects/ecommerce/services"
+
+	"github.com/gorilla/mux"
+)
+
+// Market staff permissions checked on /api/market routes
+const (
+	permCatalogRead   = "catalog:read"
+	permCatalogWrite  = "catalog:write"
+	permOrdersRead    = "orders:read"
+	permOrdersWrite   = "orders:write"
+	permProfileRead   = "profile:read"
+	permProfileWrite  = "profile:write"
+	permMessagesWrite = "messages:write"
+	permStaffManage   = "staff:manage"
+	// permSelf is granted to every active staff member, e.g. for changing their own password
+	permSelf = "self"
+)
+
+// staffRolePermissions lists the permissions granted to each market staff role.
+// The owner is handled separately and is granted every permission.
+var staffRolePermissions = map[string]map[string]bool{
+	models.StaffRoleCatalogManager: {
+		permCatalogRead:  true,
+		permCatalogWrite: true,
+		permProfileRead:  true,
+	},
+	models.StaffRoleOrderHandler: {
+		permCatalogRead: true,
+		permOrdersRead:  true,
+		permOrdersWrite: true,
+		permProfileRead: true,
+	},
+	models.StaffRoleViewer: {
+		permCatalogRead: true,
+		permOrdersRead:  true,
+		permProfileRead: true,
+	},
+}
+
+// marketRoutePermissions maps "METHOD route-template" of market admin routes to the permission they require.
+// Routes missing from the map are restricted to the market owner.
+var marketRoutePermissions = map[string]string{
+	"POST /api/market/products":                            permCatalogWrite,
+	"POST /api/market/products/import":                     permCatalogWrite,
+	"GET /api/market/products/import/{job_id}":             permCatalogWrite,
+	"GET /api/market/jobs/{job_id}":                        permSelf,
+	"GET /api/market/products/export":                      permCatalogRead,
+	"GET /api/market/categories":                           permCatalogRead,
+	"GET /api/market/translations/{entity}/{id}":           permCatalogRead,
+	"PUT /api/market/translations/{entity}/{id}":           permCatalogWrite,
+	"PUT /api/market/products/{product_id}":                permCatalogWrite,
+	"DELETE /api/market/products/{product_id}":             permCatalogWrite,
+	"POST /api/market/products/{id}/thumbnails":            permCatalogWrite,
+	"POST /api/market/thumbnails/{thumbnail_id}/size":      permCatalogWrite,
+	"DELETE /api/market/sizes/{size_id}":                   permCatalogWrite,
+	"PUT /api/market/sizes/{size_id}":                      permCatalogWrite,
+	"DELETE /api/market/thumbnails/{thumbnail_id}":         permCatalogWrite,
+	"PUT /api/market/thumbnails/{thumbnail_id}":            permCatalogWrite,
+	"GET /api/market/orders":                               permOrdersRead,
+	"GET /api/market/orders/stream":                        permOrdersRead,
+	"GET /api/market/analytics/summary":                    permOrdersRead,
+	"GET /api/market/analytics/sales":                      permOrdersRead,
+	"GET /api/market/analytics/top-products":               permOrdersRead,
+	"GET /api/market/analytics/top-variants":               permOrdersRead,
+	"GET /api/market/analytics/low-stock":                  permCatalogRead,
+	"GET /api/market/analytics/favorites-conversion":       permOrdersRead,
+	"GET /api/market/orders/{order_id}":                    permOrdersRead,
+	"PUT /api/market/orders/{order_id}":                    permOrdersWrite,
+	"DELETE /api/market/orders/{order_id}":                 permOrdersWrite,
+	"GET /api/market/orders/{order_id}/invoice":            permOrdersRead,
+	"GET /api/market/orders/{order_id}/packing-slip":       permOrdersRead,
+	"PUT /api/market/order-items/{item_id}/status":         permOrdersWrite,
+	"POST /api/market/shipments":                           permOrdersWrite,
+	"PUT /api/market/shipments/{shipment_id}/delivered":    permOrdersWrite,
+	"GET /api/market/returns":                              permOrdersRead,
+	"GET /api/market/returns/{return_id}":                  permOrdersRead,
+	"PUT /api/market/returns/{return_id}/status":           permOrdersWrite,
+	"GET /api/market/profile":                              permProfileRead,
+	"PUT /api/market/profile":                              permProfileWrite,
+	"GET /api/market/markets":                              permProfileRead,
+	"POST /api/market/markets/{id}/thumbnail":              permProfileWrite,
+	"POST /api/market/messages":                            permMessagesWrite,
+	"GET /api/market/staff":                                permStaffManage,
+	"POST /api/market/staff":                               permStaffManage,
+	"PUT /api/market/staff/{staff_id}":                     permStaffManage,
+	"PUT /api/market/staff/{staff_id}/password":            permStaffManage,
+	"PUT /api/market/password":                             permSelf,
+	"GET /api/market/products/{product_id}/variants":       permCatalogRead,
+	"POST /api/market/products/{product_id}/variants":      permCatalogWrite,
+	"PUT /api/market/variants/{variant_id}":                permCatalogWrite,
+	"DELETE /api/market/variants/{variant_id}":             permCatalogWrite,
+	"POST /api/market/variants/{variant_id}/images":        permCatalogWrite,
+	"DELETE /api/market/variant-images/{image_id}":         permCatalogWrite,
+	"GET /api/market/notifications":                        permOrdersRead,
+	"PUT /api/market/notifications/read-all":               permOrdersRead,
+	"PUT /api/market/notifications/{notification_id}/read": permOrdersRead,
+	"POST /api/market/devices":                             permSelf,
+	"DELETE /api/market/devices":                           permSelf,
+	// Conversations check permissions per conversation kind, see conversationAllowed
+	"GET /api/market/conversations":                             permSelf,
+	"POST /api/market/conversations":                            permSelf,
+	"GET /api/market/conversations/{conversation_id}":           permSelf,
+	"POST /api/market/conversations/{conversation_id}/messages": permSelf,
+	"PUT /api/market/conversations/{conversation_id}/read":      permSelf,
+	"PUT /api/market/conversations/{conversation_id}/status":    permSelf,
+}
+
+// staffHasPermission reports whether a market staff role grants a permission
+func staffHasPermission(role, permission string) bool {
+	if role == models.StaffRoleOwner {
+		return true
+	}
+	if permission == permSelf {
+		return true
+	}
+	return staffRolePermissions[role][permission]
+}
+
+// marketPermissionMiddleware enforces market staff permissions on /api/market routes.
+// It must run after authMiddleware. The market's own login (StaffID == 0) acts as owner.
+// Staff status and role are re-read on every request so that disabling a member or
+// changing their role takes effect without waiting for their token to be replaced.
+func (h *Handler) marketPermissionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value("claims").(*models.Claims)
+		if r.Method == http.MethodOptions || !ok || claims.Role != "market_admin" || claims.StaffID == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		marketID, role, isActive, err := h.db.GetMarketStaffAccess(r.Context(), claims.StaffID)
+		if err != nil {
+			if errors.Is(err, services.ErrStaffNotFound) {
+				respondError(w, http.StatusUnauthorized, "Invalid token")
+				return
+			}
+			slog.ErrorContext(r.Context(), "Failed to load staff access", "staff_id", claims.StaffID, "error", err)
+			respondError(w, http.StatusInternalServerError, "Failed to verify permissions")
+			return
+		}
+		if !isActive || marketID != claims.MarketID {
+			respondServiceError(w, http.StatusUnauthorized, services.ErrAccountDisabled)
+			return
+		}
+
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		permission, known := marketRoutePermissions[r.Method+" "+route]
+		if !known {
+			permission = permStaffManage
+		}
+		if !staffHasPermission(role, permission) {
+			respondError(w, http.StatusForbidden, "Forbidden")
+			return
+		}
+
+		// Handlers see the role currently stored, not the one baked into the token
+		updated := *claims
+		updated.StaffRole = role
+		ctx := context.WithValue(r.Context(), "claims", &updated)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"Dowlet_projects/ecommerce/models"
+	"Dowlet_projects/ecommerce/services"
+)
+
+// requestPhoneChange sends a verification code to a new phone number
+// @Summary     Request a phone number change
+// @Description Sends a verification code by SMS to the new phone number. The number changes once the code is confirmed with /api/profile/phone/confirm; a new request replaces the previous one. Numbers of other users are rejected. Requires user JWT authentication.
+// @Tags        Profile
+// @Accept      json
+// @Produce     json
+// @Param       request body models.RequestPhoneChangeRequest true "New phone number in international format"
+// @Security    BearerAuth
+// @Router      /api/profile/phone [post]
+func (h *Handler) requestPhoneChange(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.UserID == 0 || claims.Role != "user" {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req models.RequestPhoneChangeRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if err := h.db.RequestPhoneChange(r.Context(), claims.UserID, req.Phone); err != nil {
+		switch {
+		case errors.Is(err, services.ErrUserNotFound):
+			respondServiceError(w, http.StatusNotFound, err)
+		case errors.Is(err, services.ErrPhoneUnchanged):
+			respondServiceError(w, http.StatusBadRequest, err)
+		case errors.Is(err, services.ErrPhoneRegistered):
+			respondServiceError(w, http.StatusConflict, err)
+		default:
+			respondServiceError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Verification code sent"})
+}
+
+// confirmPhoneChange switches the user to a new phone number
+// @Summary     Confirm a phone number change
+// @Description Changes the user's phone number with the code sent by /api/profile/phone. After 5 wrong codes the change has to be requested again. The previous number is told about the change by SMS unless PHONE_CHANGE_NOTIFY_OLD is false. Requires user JWT authentication.
+// @Tags        Profile
+// @Accept      json
+// @Produce     json
+// @Param       request body models.ConfirmPhoneChangeRequest true "New phone number and the code sent to it"
+// @Security    BearerAuth
+// @Router      /api/profile/phone/confirm [post]
+func (h *Handler) confirmPhoneChange(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.UserID == 0 || claims.Role != "user" {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req models.ConfirmPhoneChangeRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	profile, err := h.db.ConfirmPhoneChange(r.Context(), claims.UserID, req.Phone, req.Code, h.cfg.PhoneChangeNotifyOld)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrUserNotFound), errors.Is(err, services.ErrNoPhoneChange):
+			respondServiceError(w, http.StatusNotFound, err)
+		case errors.Is(err, services.ErrInvalidVerificationCode), errors.Is(err, services.ErrVerificationCodeExpired):
+			respondServiceError(w, http.StatusBadRequest, err)
+		case errors.Is(err, services.ErrTooManyAttempts):
+			respondServiceError(w, http.StatusTooManyRequests, err)
+		case errors.Is(err, services.ErrPhoneRegistered):
+			respondServiceError(w, http.StatusConflict, err)
+		default:
+			respondServiceError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Phone number changed successfully",
+		"profile": profile,
+	})
+}
@@ -2,15 +2,17 @@ package api
 
 import (
 	"Dowlet_projects/ecommerce/models"
-	"log"
+	"Dowlet_projects/ecommerce/services"
+	"errors"
+	"log/slog"
 	"net/http"
 
 	//"Dowlet_projects/ecommerce/services"
-	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -48,73 +50,21 @@ func (h *Handler) updateProduct(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     productIDStr, ok := vars["product_id"]
     if !ok {
-		fmt.Println(ok)
         respondError(w, http.StatusBadRequest, "Missing product ID")
         return
     }
     productID, err := strconv.Atoi(productIDStr)
     if err != nil || productID < 1 {
-		fmt.Println(err)
         respondError(w, http.StatusBadRequest, "Invalid product ID")
         return
     }
 
     // Parse multipart form (max 10MB)
-    if err := r.ParseMultipartForm(10 << 20); err != nil {
-		fmt.Println(err)
-        respondError(w, http.StatusBadRequest, "Error parsing form")
+    var req ProductRequest
+    if !decodeForm(w, r, 10<<20, &req) {
         return
     }
 
-    // Parse form fields
-    categoryIDStr := r.FormValue("category_id")
-    name := r.FormValue("name")
-    nameRu := r.FormValue("name_ru")
-    priceStr := r.FormValue("price")
-    discountStr := r.FormValue("discount")
-    description := r.FormValue("description")
-    descriptionRu := r.FormValue("description_ru")
-    isActiveStr := r.FormValue("is_active")
-
-    // Validate required fields
-    if name == "" || priceStr == "" {
-		fmt.Println("name priceStr")
-        respondError(w, http.StatusBadRequest, "Missing required fields: name and price")
-        return
-    }
-
-    // Parse numeric fields
-    categoryID, err := strconv.Atoi(categoryIDStr)
-    if err != nil || categoryID < 1 {
-		fmt.Println(err)
-        respondError(w, http.StatusBadRequest, "Invalid category ID")
-        return
-    }
-    price, err := strconv.ParseFloat(priceStr, 64)
-    if err != nil || price <= 0 {
-		fmt.Println(err)
-        respondError(w, http.StatusBadRequest, "Invalid price")
-        return
-    }
-    var discount float64
-    if discountStr != "" {
-        discount, err = strconv.ParseFloat(discountStr, 64)
-        if err != nil || discount < 0 {
-			fmt.Println(err)
-            respondError(w, http.StatusBadRequest, "Invalid discount")
-            return
-        }
-    }
-    isActive := false
-    if isActiveStr != "" {
-        isActive, err = strconv.ParseBool(isActiveStr)
-        if err != nil {
-			fmt.Println(err)
-            respondError(w, http.StatusBadRequest, "Invalid is_active value")
-            return
-        }
-    }
-
     // Get upload directory
     uploadDir := os.Getenv("UPLOAD_DIR")
     if uploadDir == "" {
@@ -123,8 +73,7 @@ func (h *Handler) updateProduct(w http.ResponseWriter, r *http.Request) {
 
     // Ensure upload directory exists
     if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		fmt.Println(err)
-        log.Printf("Failed to create upload directory %s: %v", uploadDir, err)
+        slog.ErrorContext(r.Context(), "Failed to create upload directory", "dir", uploadDir, "error", err)
         respondError(w, http.StatusInternalServerError, "Failed to create upload directory")
         return
     }
@@ -133,7 +82,6 @@ func (h *Handler) updateProduct(w http.ResponseWriter, r *http.Request) {
     var imageURL string
     file, handler, err := r.FormFile("thumbnail")
     if err == nil {
-		fmt.Println(err)
         defer file.Close()
         // Generate unique file name
         //ext := filepath.Ext(handler.Filename)
@@ -144,32 +92,35 @@ func (h *Handler) updateProduct(w http.ResponseWriter, r *http.Request) {
         // Save file
         f, err := os.Create(filePath)
         if err != nil {
-            log.Printf("Failed to create file %s: %v", filePath, err)
+            slog.ErrorContext(r.Context(), "Failed to create file", "path", filePath, "error", err)
             respondError(w, http.StatusInternalServerError, "Failed to save image")
             return
         }
         defer f.Close()
         if _, err := io.Copy(f, file); err != nil {
-            log.Printf("Failed to write file %s: %v", filePath, err)
+            slog.ErrorContext(r.Context(), "Failed to write file", "path", filePath, "error", err)
             respondError(w, http.StatusInternalServerError, "Failed to save image")
             return
         }
-        log.Printf("Saved new image: %s", filePath)
+        slog.DebugContext(r.Context(), "Saved new image", "path", filePath)
     } else if err != http.ErrMissingFile {
         respondError(w, http.StatusBadRequest, "Error processing image")
         return
     }
 
     // Update product and get old image URL
-    oldImageURL, err := h.db.UpdateProduct(r.Context(), claims.MarketID, productID, categoryID, name, nameRu, price, discount, description, descriptionRu, isActive, imageURL)
+    oldImageURL, err := h.db.UpdateProduct(r.Context(), claims.MarketID, productID, req.CategoryID, req.Name, req.NameRu, req.Price, req.Discount, req.Description, req.DescriptionRu, req.IsActive, imageURL)
     if err != nil {
-        if err.Error() == "product not found or unauthorized" || err.Error() == "thumbnail not found" {
-            fmt.Println(err)
-			respondError(w, http.StatusNotFound, err.Error())
+        if errors.Is(err, services.ErrProductNotOwned) || errors.Is(err, services.ErrThumbnailNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
             return
         }
-		fmt.Println(err)
-        respondError(w, http.StatusInternalServerError, err.Error())
+        if errors.Is(err, services.ErrCategoryNotFound) || errors.Is(err, services.ErrCategoryNotAssigned) {
+            respondServiceError(w, http.StatusBadRequest, err)
+            return
+        }
+		slog.ErrorContext(r.Context(), "Failed to update product", "product_id", productID, "error", err)
+        respondServiceError(w, http.StatusInternalServerError, err)
         return
     }
 
@@ -179,13 +130,13 @@ func (h *Handler) updateProduct(w http.ResponseWriter, r *http.Request) {
         filePath := filepath.Join(uploadDir, fileName)
         if _, err := os.Stat(filePath); err == nil {
             if err := os.Remove(filePath); err != nil {
-                log.Printf("Failed to delete old thumbnail at %s: %v", filePath, err)
+                slog.ErrorContext(r.Context(), "Failed to delete old thumbnail", "path", filePath, "error", err)
                 respondError(w, http.StatusInternalServerError, fmt.Sprintf("failed to delete old thumbnail: %v", err))
                 return
             }
-            log.Printf("Deleted old thumbnail: %s", filePath)
+            slog.DebugContext(r.Context(), "Deleted old thumbnail", "path", filePath)
         } else if !os.IsNotExist(err) {
-            log.Printf("Error checking old thumbnail at %s: %v", filePath, err)
+            slog.ErrorContext(r.Context(), "Failed to check old thumbnail", "path", filePath, "error", err)
             respondError(w, http.StatusInternalServerError, fmt.Sprintf("failed to check old thumbnail: %v", err))
             return
         }
@@ -195,6 +146,13 @@ func (h *Handler) updateProduct(w http.ResponseWriter, r *http.Request) {
 }
 
 
+// orderPrefixPattern is the form of a market's order prefix. Prefixes of the form M<digits> are
+// the defaults of markets (M<market id>) and cannot be picked.
+var (
+	orderPrefixPattern        = regexp.MustCompile(`^[A-Z][A-Z0-9]{1,9}$`)
+	defaultOrderPrefixPattern = regexp.MustCompile(`^M[0-9]+$`)
+)
+
 // updateMarketProfile updates the authenticated market admin's market profile
 // @Summary Update market profile
 // @Description Updates the market profile data (except phone) for the authenticated market admin. Supports thumbnail file upload. Requires market admin JWT authentication.
@@ -207,6 +165,7 @@ func (h *Handler) updateProduct(w http.ResponseWriter, r *http.Request) {
 // @Param name_ru formData string false "Market name in Russian"
 // @Param location formData string false "Market location"
 // @Param location_ru formData string false "Market location in Russian"
+// @Param order_prefix formData string false "Prefix of new order numbers: 2-10 letters and digits starting with a letter, e.g. MARKET for MARKET-2026-000123"
 // @Param thumbnail formData file false "Thumbnail image (PNG/JPEG, max 5MB)"
 // @Router /api/market/profile [put]
 func (h *Handler) updateMarketProfile(w http.ResponseWriter, r *http.Request) {
@@ -217,22 +176,18 @@ func (h *Handler) updateMarketProfile(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Parse multipart form (max 10MB)
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		respondError(w, http.StatusBadRequest, "Failed to parse multipart form")
+	var req models.UpdateMarketProfileRequest
+	if !decodeForm(w, r, 10<<20, &req) {
 		return
 	}
-
-	// Get form fields
-	req := models.UpdateMarketProfileRequest{
-		DeliveryPrice: parseFloat(r.FormValue("delivery_price")),
-		Name:          r.FormValue("name"),
-		NameRu:        r.FormValue("name_ru"),
-		Location:      r.FormValue("location"),
-		LocationRu:    r.FormValue("location_ru"),
+	req.OrderPrefix = strings.ToUpper(strings.TrimSpace(req.OrderPrefix))
+	if req.OrderPrefix != "" && (!orderPrefixPattern.MatchString(req.OrderPrefix) || defaultOrderPrefixPattern.MatchString(req.OrderPrefix)) {
+		respondError(w, http.StatusBadRequest, "Invalid order prefix; use 2-10 letters and digits starting with a letter, other than M followed by digits")
+		return
 	}
 
 	// Check if any text fields are provided
-	hasTextFields := req.DeliveryPrice != 0 || req.Name != "" || req.NameRu != "" || req.Location != "" || req.LocationRu != ""
+	hasTextFields := req.DeliveryPrice != 0 || req.Name != "" || req.NameRu != "" || req.Location != "" || req.LocationRu != "" || req.OrderPrefix != ""
 
 	// Handle thumbnail upload
 	var thumbnailURL string
@@ -285,28 +240,32 @@ func (h *Handler) updateMarketProfile(w http.ResponseWriter, r *http.Request) {
 
 	// Check if any fields are provided
 	if !hasTextFields && thumbnailURL == "" {
-		respondError(w, http.StatusBadRequest, "No fields provided to update")
+		respondServiceError(w, http.StatusBadRequest, services.ErrNoFieldsToUpdate)
 		return
 	}
 
 	thumbnailURL1 := filepath.Join("/uploads/markets", filename)
 	thumbnailURL1 = strings.ReplaceAll(thumbnailURL1, string(filepath.Separator), "/")
 
-	updatedProfile, err := h.db.UpdateMarketProfile(claims.MarketID, req, thumbnailURL1)
+	updatedProfile, err := h.db.UpdateMarketProfile(r.Context(), claims.MarketID, req, thumbnailURL1)
 	if err != nil {
 		// Clean up uploaded file if database update fails
 		if thumbnailURL != "" {
 			os.Remove(filepath.Join(".", thumbnailURL))
 		}
-		if err.Error() == "market not found" || err.Error() == "market not found after update" {
-			respondError(w, http.StatusNotFound, err.Error())
+		if errors.Is(err, services.ErrMarketNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
+			return
+		}
+		if errors.Is(err, services.ErrNoFieldsToUpdate) {
+			respondServiceError(w, http.StatusBadRequest, err)
 			return
 		}
-		if err.Error() == "no fields provided to update" {
-			respondError(w, http.StatusBadRequest, err.Error())
+		if errors.Is(err, services.ErrOrderPrefixTaken) {
+			respondServiceError(w, http.StatusConflict, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -320,15 +279,14 @@ func (h *Handler) updateMarketProfile(w http.ResponseWriter, r *http.Request) {
 
 // updateOrderStatus updates the status of an order
 // @Summary Update order status
-// @Description Updates the status of an order to 'canceled' or 'delivered'. Requires market admin JWT authentication.
+// @Description Updates the status of the items of an order that are still being fulfilled to 'canceled' or 'delivered'; delivered and cancelled items keep their status. Requires market admin JWT authentication.
 // @Tags Orders
 // @Accept json
 // @Produce json
 // @Security BearerAuth
-// @Param cart_order_id path integer true "Cart Order ID"
-// @Param user_id path integer true "User ID"
+// @Param order_id path integer true "Order ID"
 // @Param body body models.UpdateOrderStatusRequest true "Order status update"
-// @Router /api/market/orders/{cart_order_id}/{user_id} [put]
+// @Router /api/market/orders/{order_id} [put]
 func (h *Handler) updateOrderStatus(w http.ResponseWriter, r *http.Request) {
 	claims, ok := r.Context().Value("claims").(*models.Claims)
 	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
@@ -342,44 +300,34 @@ func (h *Handler) updateOrderStatus(w http.ResponseWriter, r *http.Request) {
 
 	// Get order_id from URL
 	vars := mux.Vars(r)
-	orderIDStr := vars["cart_order_id"]
-	cartOrderID, err := strconv.Atoi(orderIDStr)
-	if err != nil || cartOrderID < 1 {
-		respondError(w, http.StatusBadRequest, "Invalid order ID")
-		return
-	}
-
-	userIDStr := vars["user_id"]
-	userID, err := strconv.Atoi(userIDStr)
-	if err != nil || userID < 1 {
+	orderIDStr := vars["order_id"]
+	orderID, err := strconv.Atoi(orderIDStr)
+	if err != nil || orderID < 1 {
 		respondError(w, http.StatusBadRequest, "Invalid order ID")
 		return
 	}
 
 	// Parse request body
 	var req models.UpdateOrderStatusRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "Error parsing JSON body")
-		return
-	}
-
-	// Validate status
-	if req.Status == "" {
-		respondError(w, http.StatusBadRequest, "Status is required")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
 	// Update order status
-	if err := h.db.UpdateOrderStatus(cartOrderID, userID, claims.MarketID, req.Status); err != nil {
-		if err.Error() == "order not found" || err.Error() == "order not found or not associated with this market" {
-			respondError(w, http.StatusNotFound, err.Error())
+	if err := h.db.UpdateOrderStatus(r.Context(), orderID, claims.MarketID, req.Status); err != nil {
+		if errors.Is(err, services.ErrOrderNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
-		if err.Error() == "invalid status; must be 'canceled' or 'delivered'" {
-			respondError(w, http.StatusBadRequest, err.Error())
+		if errors.Is(err, services.ErrInvalidOrderStatus) {
+			respondServiceError(w, http.StatusBadRequest, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		if errors.Is(err, services.ErrOrderHasNoOpenItems) {
+			respondServiceError(w, http.StatusConflict, err)
+			return
+		}
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -421,13 +369,13 @@ func (h *Handler) deleteUserHistory(w http.ResponseWriter, r *http.Request) {
 
 
 	// Update order status
-	if err := h.db.DeleteUserHistory(orderID, claims.UserID); err != nil {
-		if err.Error() == "order not found" || err.Error() == "order not found or not associated with this market" {
-			respondError(w, http.StatusNotFound, err.Error())
+	if err := h.db.DeleteUserHistory(r.Context(), orderID, claims.UserID); err != nil {
+		if errors.Is(err, services.ErrOrderNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
 		
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -469,37 +417,18 @@ func (h *Handler) updateSize(w http.ResponseWriter, r *http.Request) {
 
 	// Parse request body
 	var req models.UpdateSizeRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "Error parsing JSON body")
-		return
-	}
-
-	// Validate input
-	if req.Count < 0 {
-		respondError(w, http.StatusBadRequest, "Count must be non-negative")
-		return
-	}
-	if req.Price < 0 {
-		respondError(w, http.StatusBadRequest, "Price must be non-negative")
-		return
-	}
-	if req.Size == "" {
-		respondError(w, http.StatusBadRequest, "Size is required")
-		return
-	}
-	if len(req.Size) > 50 {
-		respondError(w, http.StatusBadRequest, "Size exceeds 50 characters")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
 	// Update size
-	updatedSize, err := h.db.UpdateSize(sizeID, req)
+	updatedSize, err := h.db.UpdateSize(r.Context(), sizeID, req)
 	if err != nil {
-		if err.Error() == "size not found or not associated with this market" || err.Error() == "size not found after update" {
-			respondError(w, http.StatusNotFound, err.Error())
+		if errors.Is(err, services.ErrSizeNotInMarket) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -543,29 +472,8 @@ func (h *Handler) updateThumbnail(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Parse multipart form
-	err = r.ParseMultipartForm(10 << 20) // Max 10 MB
-	if err != nil {
-		respondError(w, http.StatusBadRequest, "Error parsing form")
-		return
-	}
-
-	// Get form values
-	color := r.FormValue("color")
-	colorRu := r.FormValue("color_ru")
-	if color == "" {
-		respondError(w, http.StatusBadRequest, "Color is required")
-		return
-	}
-	if len(color) > 50 {
-		respondError(w, http.StatusBadRequest, "Color exceeds 50 characters")
-		return
-	}
-	if colorRu == "" {
-		respondError(w, http.StatusBadRequest, "Color_ru is required")
-		return
-	}
-	if len(colorRu) > 50 {
-		respondError(w, http.StatusBadRequest, "Color_ru exceeds 50 characters")
+	var form ThumbnailForm
+	if !decodeForm(w, r, 10<<20, &form) { // Max 10 MB
 		return
 	}
 
@@ -577,17 +485,17 @@ func (h *Handler) updateThumbnail(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Fetch product_id to construct file path
-	oldImageURL, filePath, imageCreated, err := h.db.UpdateThumbnail(thumbnailID, color, colorRu, claims.MarketID, files)
+	oldImageURL, filePath, imageCreated, err := h.db.UpdateThumbnail(r.Context(), thumbnailID, form.Color, form.ColorRu, claims.MarketID, files)
 
 	if err != nil {
 		if imageCreated != "" {
 			os.Remove(filePath)
 		}
-		if err.Error() == "thumbnail not found or not associated with this market" || err.Error() == "thumbnail not found" {
-			respondError(w, http.StatusNotFound, err.Error())
+		if errors.Is(err, services.ErrThumbnailNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -605,14 +513,184 @@ func (h *Handler) updateThumbnail(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// parseFloat parses a string to float64, returning 0 if empty or invalid
-func parseFloat(s string) float64 {
-	if s == "" {
-		return 0
+// updateMarketStaff changes the role or active flag of a staff member
+// @Summary Update market staff
+// @Description Changes a staff member's role or disables/enables the account. Requires market owner JWT authentication.
+// @Tags Market Staff
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param staff_id path integer true "Staff ID"
+// @Param body body models.UpdateMarketStaffRequest true "Staff changes"
+// @Router /api/market/staff/{staff_id} [put]
+func (h *Handler) updateMarketStaff(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
+		if !ok {
+			respondError(w, http.StatusUnauthorized, "Unauthorized")
+		} else {
+			respondError(w, http.StatusForbidden, "Forbidden")
+		}
+		return
+	}
+
+	staffID, err := strconv.Atoi(mux.Vars(r)["staff_id"])
+	if err != nil || staffID < 1 {
+		respondError(w, http.StatusBadRequest, "Invalid staff ID")
+		return
+	}
+	if staffID == claims.StaffID {
+		respondError(w, http.StatusBadRequest, "Cannot change your own role or status")
+		return
 	}
-	f, err := strconv.ParseFloat(s, 64)
+
+	var req models.UpdateMarketStaffRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	staff, err := h.db.UpdateMarketStaff(r.Context(), claims.MarketID, staffID, req)
 	if err != nil {
-		return 0
+		switch {
+		case errors.Is(err, services.ErrStaffNotFound):
+			respondServiceError(w, http.StatusNotFound, err)
+		case errors.Is(err, services.ErrInvalidStaffRole), errors.Is(err, services.ErrNoFieldsToUpdate):
+			respondServiceError(w, http.StatusBadRequest, err)
+		default:
+			respondServiceError(w, http.StatusInternalServerError, err)
+		}
+		return
 	}
-	return f
+
+	respondJSON(w, http.StatusOK, staff)
+}
+
+// resetMarketStaffPassword resets a staff member's password
+// @Summary Reset market staff password
+// @Description Replaces a staff member's password with a new temporary one and returns it. Requires market owner JWT authentication.
+// @Tags Market Staff
+// @Produce json
+// @Security BearerAuth
+// @Param staff_id path integer true "Staff ID"
+// @Router /api/market/staff/{staff_id}/password [put]
+func (h *Handler) resetMarketStaffPassword(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
+		if !ok {
+			respondError(w, http.StatusUnauthorized, "Unauthorized")
+		} else {
+			respondError(w, http.StatusForbidden, "Forbidden")
+		}
+		return
+	}
+
+	staffID, err := strconv.Atoi(mux.Vars(r)["staff_id"])
+	if err != nil || staffID < 1 {
+		respondError(w, http.StatusBadRequest, "Invalid staff ID")
+		return
+	}
+
+	password, err := services.GenerateTempPassword()
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := h.db.ResetMarketStaffPassword(r.Context(), claims.MarketID, staffID, password); err != nil {
+		if errors.Is(err, services.ErrStaffNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
+			return
+		}
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{
+		"message":  "Password reset successfully",
+		"password": password,
+	})
+}
+
+// changeMarketStaffPassword lets a logged-in staff member change their own password
+// @Summary Change own staff password
+// @Description Changes the password of the authenticated staff member. Requires market staff JWT authentication.
+// @Tags Market Staff
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body models.ChangePasswordRequest true "Old and new password"
+// @Router /api/market/password [put]
+func (h *Handler) changeMarketStaffPassword(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
+		if !ok {
+			respondError(w, http.StatusUnauthorized, "Unauthorized")
+		} else {
+			respondError(w, http.StatusForbidden, "Forbidden")
+		}
+		return
+	}
+	if claims.StaffID == 0 {
+		respondError(w, http.StatusForbidden, "Only staff accounts can change their password here")
+		return
+	}
+
+	var req models.ChangePasswordRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if err := h.db.ChangeMarketStaffPassword(r.Context(), claims.StaffID, req.OldPassword, req.NewPassword); err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidCredentials):
+			respondServiceError(w, http.StatusUnauthorized, err)
+		case errors.Is(err, services.ErrStaffNotFound):
+			respondServiceError(w, http.StatusNotFound, err)
+		default:
+			respondServiceError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Password changed successfully"})
+}
+
+// updateVariant updates a product variant
+// @Summary Update a product variant
+// @Description Updates the SKU, barcode, price, compare-at price, stock, active flag, position or option values of a variant. A compare_at_price of 0 clears it. Requires market admin JWT authentication.
+// @Tags Product Variants
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param variant_id path integer true "Variant ID"
+// @Param body body models.UpdateVariantRequest true "Variant changes"
+// @Router /api/market/variants/{variant_id} [put]
+func (h *Handler) updateVariant(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.MarketID == 0 || claims.Role != "market_admin" {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	variantID, err := strconv.Atoi(mux.Vars(r)["variant_id"])
+	if err != nil || variantID < 1 {
+		respondError(w, http.StatusBadRequest, "Invalid variant ID")
+		return
+	}
+
+	var req models.UpdateVariantRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	variant, err := h.db.UpdateVariant(r.Context(), claims.MarketID, variantID, req)
+	if err != nil {
+		respondVariantError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Variant updated successfully",
+		"variant": variant,
+	})
 }
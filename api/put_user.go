@@ -2,10 +2,11 @@ package api
 
 import (
 	"Dowlet_projects/ecommerce/models"
-	"encoding/json"
+	"Dowlet_projects/ecommerce/services"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -42,27 +43,70 @@ func (h *Handler) updateCartCountBySizeID(w http.ResponseWriter, r *http.Request
 	}
 
 	var req models.UpdateCartRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "Error parsing JSON body")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
-	if req.CountChange == 0 {
-		respondError(w, http.StatusBadRequest, "Count change cannot be zero")
+	newCount, err := h.db.UpdateCartCountBySizeID(r.Context(), claims.UserID, sizeID, req.CountChange)
+	if err != nil {
+		if errors.Is(err, services.ErrCartItemNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
+			return
+		}
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"message":   "Cart entry count updated successfully",
+		"new_count": newCount,
+	})
+}
+
+// updateCartCountByVariantID sets the count of a cart entry for the authenticated user based on variant_id
+// @Summary Update cart entry count by variant
+// @Description Sets the count of a cart entry identified by variant_id for the authenticated user. Requires user JWT authentication.
+// @Tags Cart
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param variant_id path int true "Variant ID"
+// @Param body body models.UpdateCartRequest true "New count"
+// @Router /api/cart/variants/{variant_id} [put]
+func (h *Handler) updateCartCountByVariantID(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok || claims.UserID == 0 || claims.Role != "user" {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	variantID, err := strconv.Atoi(mux.Vars(r)["variant_id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid variant_id")
+		return
+	}
+
+	var req models.UpdateCartRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	// Here count_change is the new count rather than a change
+	if req.CountChange < 1 {
+		respondValidationError(w, fieldError("count_change", "MIN", "1"))
 		return
 	}
 
-	newCount, err := h.db.UpdateCartCountBySizeID(claims.UserID, sizeID, req.CountChange)
+	newCount, err := h.db.UpdateCartCountByVariantID(r.Context(), claims.UserID, variantID, req.CountChange)
 	if err != nil {
-		if err.Error() == "cart entry not found" {
-			respondError(w, http.StatusNotFound, err.Error())
+		if errors.Is(err, services.ErrCartItemNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
-		if err.Error() == "count cannot be less than 1" {
-			respondError(w, http.StatusBadRequest, err.Error())
+		if errors.Is(err, services.ErrInsufficientStock) {
+			respondServiceError(w, http.StatusConflict, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -99,27 +143,26 @@ func (h *Handler) updateLocationByID(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req models.UpdateLocationRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "Error parsing JSON body")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
 	if req.LocationName == "" && req.LocationAddress == "" {
-		respondError(w, http.StatusBadRequest, "No fields provided to update")
+		respondServiceError(w, http.StatusBadRequest, services.ErrNoFieldsToUpdate)
 		return
 	}
 
-	updatedLocation, err := h.db.UpdateLocationByID(claims.UserID, locationID, req)
+	updatedLocation, err := h.db.UpdateLocationByID(r.Context(), claims.UserID, locationID, req)
 	if err != nil {
-		if err.Error() == "location not found or unauthorized" || err.Error() == "location not found after update" {
-			respondError(w, http.StatusNotFound, err.Error())
+		if errors.Is(err, services.ErrLocationNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
-		if err.Error() == "no fields provided to update" {
-			respondError(w, http.StatusBadRequest, err.Error())
+		if errors.Is(err, services.ErrNoFieldsToUpdate) {
+			respondServiceError(w, http.StatusBadRequest, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -132,7 +175,7 @@ func (h *Handler) updateLocationByID(w http.ResponseWriter, r *http.Request) {
 
 // updateProfile updates the authenticated user's profile
 // @Summary Update user profile
-// @Description Updates the full_name and/or phone of the authenticated user. Requires user JWT authentication.
+// @Description Updates the full_name of the authenticated user. The phone number cannot be changed here; use /api/profile/phone to confirm a new number with a code. Requires user JWT authentication.
 // @Tags Profile
 // @Accept json
 // @Produce json
@@ -147,27 +190,30 @@ func (h *Handler) updateProfile(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req models.UpdateProfileRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "Error parsing JSON body")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
-	if req.FullName == "" && req.Phone == "" {
-		respondError(w, http.StatusBadRequest, "No fields provided to update")
+	if req.Phone != "" {
+		respondError(w, http.StatusBadRequest, "Phone number changes must be confirmed; use /api/profile/phone")
+		return
+	}
+	if req.FullName == "" {
+		respondServiceError(w, http.StatusBadRequest, services.ErrNoFieldsToUpdate)
 		return
 	}
 
-	updatedProfile, err := h.db.UpdateUserProfile(claims.UserID, req)
+	updatedProfile, err := h.db.UpdateUserProfile(r.Context(), claims.UserID, req)
 	if err != nil {
-		if err.Error() == "user not found" || err.Error() == "user not found after update" {
-			respondError(w, http.StatusNotFound, err.Error())
+		if errors.Is(err, services.ErrUserNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
 			return
 		}
-		if err.Error() == "no fields provided to update" {
-			respondError(w, http.StatusBadRequest, err.Error())
+		if errors.Is(err, services.ErrNoFieldsToUpdate) {
+			respondServiceError(w, http.StatusBadRequest, err)
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondServiceError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -212,19 +258,18 @@ func (h *Handler) updateUserVerified(w http.ResponseWriter, r *http.Request) {
 
     // Parse request body
     var req models.UpdateUserVerifiedRequest
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        respondError(w, http.StatusBadRequest, "Invalid request body")
+    if !decodeJSON(w, r, &req) {
         return
     }
 
     // Update verified status
     err = h.db.UpdateUserVerified(r.Context(), userID, req.Verified)
     if err != nil {
-        if err.Error() == "user not found" {
-            respondError(w, http.StatusNotFound, "User not found")
+        if errors.Is(err, services.ErrUserNotFound) {
+            respondServiceError(w, http.StatusNotFound, err)
             return
         }
-        respondError(w, http.StatusInternalServerError, err.Error())
+        respondServiceError(w, http.StatusInternalServerError, err)
         return
     }
 
@@ -283,49 +328,11 @@ func (h *Handler) updateMarket(w http.ResponseWriter, r *http.Request) {
     }
 
     // Parse multipart form (max 10MB)
-    if err := r.ParseMultipartForm(10 << 20); err != nil {
-        respondError(w, http.StatusBadRequest, "Error parsing form")
+    var form MarketUpdateForm
+    if !decodeForm(w, r, 10<<20, &form) {
         return
     }
 
-    // Parse form fields
-    password := r.FormValue("password")
-    deliveryPriceStr := r.FormValue("delivery_price")
-    phone := r.FormValue("phone")
-    name := r.FormValue("name")
-    nameRu := r.FormValue("name_ru")
-    location := r.FormValue("location")
-    locationRu := r.FormValue("location_ru")
-    isVIPStr := r.FormValue("isVIP")
-
-    // Validate and parse numeric/boolean fields
-    var deliveryPrice *float64
-    if deliveryPriceStr != "" {
-        dp, err := strconv.ParseFloat(deliveryPriceStr, 64)
-        if err != nil || dp < 0 {
-            respondError(w, http.StatusBadRequest, "Invalid delivery price")
-            return
-        }
-        deliveryPrice = &dp
-    }
-    var isVIP *bool
-    if isVIPStr != "" {
-        vip, err := strconv.ParseBool(isVIPStr)
-        if err != nil {
-            respondError(w, http.StatusBadRequest, "Invalid isVIP value")
-            return
-        }
-        isVIP = &vip
-    }
-
-    // Validate phone if provided
-    if phone != "" {
-        if len(phone) > 20 || !strings.HasPrefix(phone, "+") {
-            respondError(w, http.StatusBadRequest, "Invalid phone format")
-            return
-        }
-    }
-
     // Get upload directory
     uploadDir := os.Getenv("UPLOAD_DIR")
     if uploadDir == "" {
@@ -334,7 +341,7 @@ func (h *Handler) updateMarket(w http.ResponseWriter, r *http.Request) {
 
     // Ensure upload directory exists
     if err := os.MkdirAll(uploadDir, 0755); err != nil {
-        log.Printf("Failed to create upload directory %s: %v", uploadDir, err)
+        slog.ErrorContext(r.Context(), "Failed to create upload directory", "dir", uploadDir, "error", err)
         respondError(w, http.StatusInternalServerError, "Failed to create upload directory")
         return
     }
@@ -357,30 +364,34 @@ func (h *Handler) updateMarket(w http.ResponseWriter, r *http.Request) {
         // Save file
         f, err := os.Create(filePath)
         if err != nil {
-            log.Printf("Failed to create file %s: %v", filePath, err)
+            slog.ErrorContext(r.Context(), "Failed to create file", "path", filePath, "error", err)
             respondError(w, http.StatusInternalServerError, "Failed to save image")
             return
         }
         defer f.Close()
         if _, err := io.Copy(f, file); err != nil {
-            log.Printf("Failed to write file %s: %v", filePath, err)
+            slog.ErrorContext(r.Context(), "Failed to write file", "path", filePath, "error", err)
             respondError(w, http.StatusInternalServerError, "Failed to save image")
             return
         }
-        log.Printf("Saved new image: %s", filePath)
+        slog.DebugContext(r.Context(), "Saved new image", "path", filePath)
     } else if err != http.ErrMissingFile {
         respondError(w, http.StatusBadRequest, "Error processing image")
         return
     }
 
     // Update market and get old thumbnail URL
-    oldThumbnailURL, newThumbnailURL, err := h.db.UpdateMarket(r.Context(), marketID, password, deliveryPrice, phone, name, nameRu, location, locationRu, isVIP, imageURL)
+    oldThumbnailURL, newThumbnailURL, err := h.db.UpdateMarket(r.Context(), marketID, form.Password, form.DeliveryPrice, form.Phone, form.Name, form.NameRu, form.Location, form.LocationRu, form.IsVIP, imageURL)
     if err != nil {
-        if err.Error() == "market not found" {
-            respondError(w, http.StatusNotFound, err.Error())
+        if errors.Is(err, services.ErrMarketNotFound) {
+            respondServiceError(w, http.StatusNotFound, err)
             return
         }
-        respondError(w, http.StatusInternalServerError, err.Error())
+        if errors.Is(err, services.ErrPhoneTaken) {
+            respondServiceError(w, http.StatusConflict, err)
+            return
+        }
+        respondServiceError(w, http.StatusInternalServerError, err)
         return
     }
 
@@ -390,13 +401,13 @@ func (h *Handler) updateMarket(w http.ResponseWriter, r *http.Request) {
         filePath := filepath.Join(uploadDir, fileName)
         if _, err := os.Stat(filePath); err == nil {
             if err := os.Remove(filePath); err != nil {
-                log.Printf("Failed to delete old thumbnail at %s: %v", filePath, err)
+                slog.ErrorContext(r.Context(), "Failed to delete old thumbnail", "path", filePath, "error", err)
                 respondError(w, http.StatusInternalServerError, fmt.Sprintf("failed to delete old thumbnail: %v", err))
                 return
             }
-            log.Printf("Deleted old thumbnail: %s", filePath)
+            slog.DebugContext(r.Context(), "Deleted old thumbnail", "path", filePath)
         } else if !os.IsNotExist(err) {
-            log.Printf("Error checking old thumbnail at %s: %v", filePath, err)
+            slog.ErrorContext(r.Context(), "Failed to check old thumbnail", "path", filePath, "error", err)
             respondError(w, http.StatusInternalServerError, fmt.Sprintf("failed to check old thumbnail: %v", err))
             return
         }
@@ -431,51 +442,22 @@ func (h *Handler) updateSuperadmin(w http.ResponseWriter, r *http.Request) {
 
     // Parse JSON body
     var req models.SuperadminRequest
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        respondError(w, http.StatusBadRequest, "Error parsing JSON body")
-        return
-    }
-
-    // Validate inputs
-    if req.Phone != nil {
-        phone := strings.TrimSpace(*req.Phone)
-        if len(phone) > 20 || (phone != "" && !strings.HasPrefix(phone, "+")) {
-            respondError(w, http.StatusBadRequest, "Invalid phone format")
-            return
-        }
-        req.Phone = &phone
-    }
-    if req.FullName != "" {
-        fullName := strings.TrimSpace(req.FullName)
-        if len(fullName) > 255 {
-            respondError(w, http.StatusBadRequest, "Full name too long")
-            return
-        }
-        req.FullName = fullName
-    }
-    if req.Username != "" {
-        username := strings.TrimSpace(req.Username)
-        if len(username) > 50 || len(username) < 3 {
-            respondError(w, http.StatusBadRequest, "Username must be 3-50 characters")
-            return
-        }
-        req.Username = username
-    }
-    if req.Password != "" && len(req.Password) < 6 {
-        respondError(w, http.StatusBadRequest, "Password must be at least 6 characters")
+    if !decodeJSON(w, r, &req) {
         return
     }
+    req.FullName = strings.TrimSpace(req.FullName)
+    req.Username = strings.TrimSpace(req.Username)
 
     // Update superadmin
     err := h.db.UpdateSuperadmin(r.Context(), int(claims.UserID), req.Phone, req.FullName, req.Username, req.Password)
     if err != nil {
-        switch err.Error() {
-        case "superadmin not found":
-            respondError(w, http.StatusNotFound, err.Error())
-        case "username already exists":
-            respondError(w, http.StatusConflict, err.Error())
+        switch {
+        case errors.Is(err, services.ErrSuperadminNotFound):
+            respondServiceError(w, http.StatusNotFound, err)
+        case errors.Is(err, services.ErrUsernameTaken):
+            respondServiceError(w, http.StatusConflict, err)
         default:
-            respondError(w, http.StatusInternalServerError, err.Error())
+            respondServiceError(w, http.StatusInternalServerError, err)
         }
         return
     }
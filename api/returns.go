@@ -0,0 +1,285 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"Dowlet_projects/ecommerce/models"
+	"Dowlet_projects/ecommerce/services"
+
+	"github.com/gorilla/mux"
+)
+
+// Limits of return requests
+const (
+	maxReturnPhotos      = 5
+	maxReturnRequestSize = 25 << 20
+)
+
+// returnPhotoExtensions lists the accepted return photo content types and the extension they are stored with
+var returnPhotoExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+// returnParty resolves whose return requests the caller sees: their own as a user, or their
+// market's as market staff
+func returnParty(w http.ResponseWriter, r *http.Request) (string, int, bool) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return "", 0, false
+	}
+	switch {
+	case claims.Role == "user" && claims.UserID != 0:
+		return models.RecipientUser, claims.UserID, true
+	case claims.Role == "market_admin" && claims.MarketID != 0:
+		return models.RecipientMarket, claims.MarketID, true
+	}
+	respondError(w, http.StatusForbidden, "Forbidden")
+	return "", 0, false
+}
+
+// returnIDFromRequest parses the return_id path variable
+func returnIDFromRequest(w http.ResponseWriter, r *http.Request) (int, bool) {
+	returnID, err := strconv.Atoi(mux.Vars(r)["return_id"])
+	if err != nil || returnID < 1 {
+		respondError(w, http.StatusBadRequest, "Invalid return ID")
+		return 0, false
+	}
+	return returnID, true
+}
+
+// parseReturnRequest reads a return request sent as JSON or as multipart/form-data with the items as
+// JSON in "items" and photos in "photos", and stores the photos under uploads/returns.
+// On failure it responds itself and returns false; on success the caller owns the saved files.
+func parseReturnRequest(w http.ResponseWriter, r *http.Request) (models.CreateReturnRequest, []string, []string, bool) {
+	var req models.CreateReturnRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxReturnRequestSize)
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if !decodeJSON(w, r, &req) {
+			return req, nil, nil, false
+		}
+	} else {
+		if err := r.ParseMultipartForm(10 << 20); err != nil {
+			respondError(w, http.StatusBadRequest, "Error parsing form")
+			return req, nil, nil, false
+		}
+		if err := json.Unmarshal([]byte(r.FormValue("items")), &req.Items); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid items; must be a JSON array")
+			return req, nil, nil, false
+		}
+		req.Reason = r.FormValue("reason")
+		if !validateRequest(w, req) {
+			return req, nil, nil, false
+		}
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+
+	if r.MultipartForm == nil {
+		return req, nil, nil, true
+	}
+	files := r.MultipartForm.File["photos"]
+	if len(files) > maxReturnPhotos {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("At most %d photos are allowed", maxReturnPhotos))
+		return req, nil, nil, false
+	}
+
+	var urls, savedPaths []string
+	for _, fileHeader := range files {
+		saved, err := saveUploadedFile(fileHeader, "returns", returnPhotoExtensions, "JPEG, PNG and WebP")
+		if err != nil {
+			removeFiles(savedPaths)
+			respondUploadError(w, err)
+			return req, nil, nil, false
+		}
+		savedPaths = append(savedPaths, saved.path)
+		urls = append(urls, saved.url)
+	}
+
+	return req, urls, savedPaths, true
+}
+
+// createReturnRequest opens a return request
+// @Summary Request a return
+// @Description Requests the return of delivered items of one order, within the return window after delivery. Send JSON, or multipart/form-data with the items as a JSON array in "items", "reason" and up to 5 photos (JPEG, PNG, WebP) in "photos". An item count of 0 returns the whole item. Requires user JWT authentication.
+// @Tags Returns
+// @Accept json
+// @Accept multipart/form-data
+// @Produce json
+// @Param request body models.CreateReturnRequest true "Order items and reason"
+// @Security BearerAuth
+// @Router /api/returns [post]
+func (h *Handler) createReturnRequest(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if claims.Role != "user" || claims.UserID == 0 {
+		respondError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	req, photoURLs, savedPaths, ok := parseReturnRequest(w, r)
+	if !ok {
+		return
+	}
+
+	returnID, err := h.db.CreateReturnRequest(r.Context(), claims.UserID, req, photoURLs, h.cfg.ReturnWindowDays)
+	if err != nil {
+		removeFiles(savedPaths)
+		switch {
+		case errors.Is(err, services.ErrOrderItemNotFound):
+			respondServiceError(w, http.StatusNotFound, err)
+		case errors.Is(err, services.ErrOrderItemsRequired), errors.Is(err, services.ErrInvalidOrderItem), errors.Is(err, services.ErrDuplicateOrderItem),
+			errors.Is(err, services.ErrOrderItemsMixed), errors.Is(err, services.ErrItemNotDelivered),
+			errors.Is(err, services.ErrReturnWindowClosed), errors.Is(err, services.ErrReturnCountExceeded):
+			respondServiceError(w, http.StatusBadRequest, err)
+		default:
+			respondServiceError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"message":   "Return requested successfully",
+		"return_id": returnID,
+	})
+}
+
+// getReturnRequests lists return requests
+// @Summary Get return requests
+// @Description Lists the return requests of the authenticated user, or of the market for market staff, newest first. Requires user or market admin JWT authentication.
+// @Tags Returns
+// @Produce json
+// @Security BearerAuth
+// @Param status query string false "Filter by status (requested, approved, rejected, received, refunded)"
+// @Param page query integer false "Page number (default: 1)"
+// @Param limit query integer false "Items per page (default: 20, max: 100)"
+// @Router /api/returns [get]
+// @Router /api/market/returns [get]
+func (h *Handler) getReturnRequests(w http.ResponseWriter, r *http.Request) {
+	partyType, partyID, ok := returnParty(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	status := query.Get("status")
+	switch status {
+	case "", models.ReturnStatusRequested, models.ReturnStatusApproved, models.ReturnStatusRejected,
+		models.ReturnStatusReceived, models.ReturnStatusRefunded:
+	default:
+		respondServiceError(w, http.StatusBadRequest, services.ErrInvalidStatus)
+		return
+	}
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit < 1 {
+		limit = 20
+	}
+	if limit > 100 {
+		limit = 100
+	}
+
+	returns, totalCount, err := h.db.GetReturnRequests(r.Context(), partyType, partyID, status, page, limit)
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"items":       returns,
+		"total_count": totalCount,
+		"page":        page,
+		"limit":       limit,
+	})
+}
+
+// getReturnRequest retrieves a return request
+// @Summary Get a return request
+// @Description Returns a return request with its order items and photos. Users can only access their own returns and market staff their market's. Requires user or market admin JWT authentication.
+// @Tags Returns
+// @Produce json
+// @Security BearerAuth
+// @Param return_id path integer true "Return request ID"
+// @Router /api/returns/{return_id} [get]
+// @Router /api/market/returns/{return_id} [get]
+func (h *Handler) getReturnRequest(w http.ResponseWriter, r *http.Request) {
+	partyType, partyID, ok := returnParty(w, r)
+	if !ok {
+		return
+	}
+	returnID, ok := returnIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	rr, err := h.db.GetReturnRequest(r.Context(), partyType, partyID, returnID)
+	if err != nil {
+		if errors.Is(err, services.ErrReturnNotFound) {
+			respondServiceError(w, http.StatusNotFound, err)
+			return
+		}
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, rr)
+}
+
+// updateReturnStatus moves a return request on
+// @Summary Update a return request
+// @Description Approves or rejects a requested return (with an optional note to the customer), marks approved returns as received, which puts the items back in stock, and marks received returns as refunded, which reverses the returned share of the sale in the ledger. Requires market admin JWT authentication.
+// @Tags Returns
+// @Accept json
+// @Produce json
+// @Param return_id path integer true "Return request ID"
+// @Param request body models.UpdateReturnStatusRequest true "New status, note and refund reference"
+// @Security BearerAuth
+// @Router /api/market/returns/{return_id}/status [put]
+func (h *Handler) updateReturnStatus(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*models.Claims)
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if claims.Role != "market_admin" || claims.MarketID == 0 {
+		respondError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+	returnID, ok := returnIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.UpdateReturnStatusRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.Note = strings.TrimSpace(req.Note)
+
+	if err := h.db.UpdateReturnStatus(r.Context(), claims.MarketID, returnID, req); err != nil {
+		switch {
+		case errors.Is(err, services.ErrReturnNotFound):
+			respondServiceError(w, http.StatusNotFound, err)
+		case errors.Is(err, services.ErrReturnTransition):
+			respondServiceError(w, http.StatusConflict, err)
+		default:
+			respondServiceError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Return request updated successfully"})
+}
@@ -4,17 +4,24 @@ import (
 	//"Dowlet_projects/ecommerce/models"
 	"Dowlet_projects/ecommerce/config"
 	"Dowlet_projects/ecommerce/services"
+	"Dowlet_projects/ecommerce/tracing"
 	"fmt"
+	"net/http"
+	"sync"
 	//"os"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
 )
 
 
 type Handler struct {
 	db  *services.DBService
 	cfg *config.Config
+	// streamsDone is closed by CloseStreams to end open event streams
+	streamsDone chan struct{}
+	closeOnce   sync.Once
 }
 
 // NewHandler creates a new Handler with the given DBService and Config
@@ -26,28 +33,41 @@ func NewHandler(db *services.DBService, cfg *config.Config) (*Handler, error) {
 		return nil, fmt.Errorf("config cannot be nil")
 	}
 	return &Handler{
-		db:  db,
-		cfg: cfg,
+		db:          db,
+		cfg:         cfg,
+		streamsDone: make(chan struct{}),
 	}, nil
 }
 
+// CloseStreams ends all open event streams, e.g. when the server shuts down
+func (h *Handler) CloseStreams() {
+	h.closeOnce.Do(func() { close(h.streamsDone) })
+}
+
 // SetupRoutes configures API routes
 func (h *Handler) SetupRoutes(router *mux.Router) {
 	// CORS setup
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", "Last-Event-ID", "X-Request-ID", "Idempotency-Key", "traceparent", "tracestate"},
+		ExposedHeaders:   []string{"X-Request-ID", "Retry-After", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "Idempotent-Replayed"},
 		AllowCredentials: true,
 	})
 
 	// Superadmin-only routes
 	superadmin := router.PathPrefix("/api/superadmin").Subrouter()
-	superadmin.Use(h.authMiddleware)
+	superadmin.Use(h.authMiddleware, h.rateLimitMiddleware(rateLimitSuperadmin, h.cfg.RateLimitSuperadmin), h.idempotencyMiddleware, h.auditMiddleware)
 	superadmin.HandleFunc("/markets", h.createMarket).Methods("POST", "OPTIONS")
 	superadmin.HandleFunc("/markets/{id}", h.deleteMarket).Methods("DELETE", "OPTIONS")
 	superadmin.HandleFunc("/categories", h.createCategory).Methods("POST", "OPTIONS")
+	superadmin.HandleFunc("/categories/tree", h.getSuperadminCategoryTree).Methods("GET", "OPTIONS")
+	superadmin.HandleFunc("/categories/{category_id}", h.updateCategory).Methods("PUT", "OPTIONS")
 	superadmin.HandleFunc("/categories/{category_id}", h.deleteCategory).Methods("DELETE", "OPTIONS")
+	superadmin.HandleFunc("/markets/{id}/categories", h.getMarketCategoryAssignments).Methods("GET", "OPTIONS")
+	superadmin.HandleFunc("/markets/{id}/categories", h.setMarketCategoryAssignments).Methods("PUT", "OPTIONS")
+	superadmin.HandleFunc("/translations/{entity}/{id}", h.getTranslations).Methods("GET", "OPTIONS")
+	superadmin.HandleFunc("/translations/{entity}/{id}", h.setTranslations).Methods("PUT", "OPTIONS")
 	superadmin.HandleFunc("/banners", h.createBanner).Methods("POST", "OPTIONS")
 	superadmin.HandleFunc("/banners/{id}", h.deleteBanner).Methods("DELETE", "OPTIONS")
 	superadmin.HandleFunc("/user-messages", h.getUserMessages).Methods("GET", "OPTIONS")
@@ -59,11 +79,41 @@ func (h *Handler) SetupRoutes(router *mux.Router) {
 	superadmin.HandleFunc("/users/{id}", h.updateUserVerified).Methods("PUT")
 	superadmin.HandleFunc("/markets/{id}", h.updateMarket).Methods("PUT", "OPTIONS")
 	superadmin.HandleFunc("/superadmin-update", h.updateSuperadmin).Methods("PUT", "OPTIONS")
+	superadmin.HandleFunc("/audit-events", h.getAuditEvents).Methods("GET", "OPTIONS")
+	superadmin.HandleFunc("/jobs", h.getJobs).Methods("GET", "OPTIONS")
+	superadmin.HandleFunc("/jobs/{job_id}", h.getJob).Methods("GET", "OPTIONS")
+	superadmin.HandleFunc("/jobs/{job_id}/retry", h.retryJob).Methods("POST", "OPTIONS")
+	superadmin.HandleFunc("/reports/summary", h.getReportSummary).Methods("GET", "OPTIONS")
+	superadmin.HandleFunc("/reports/daily", h.getDailyReport).Methods("GET", "OPTIONS")
+	superadmin.HandleFunc("/reports/markets", h.getMarketsReport).Methods("GET", "OPTIONS")
+	superadmin.HandleFunc("/reports/categories", h.getCategoriesReport).Methods("GET", "OPTIONS")
+	superadmin.HandleFunc("/reports/vip", h.getVIPReport).Methods("GET", "OPTIONS")
+	superadmin.HandleFunc("/reports/rollup", h.rollupReports).Methods("POST", "OPTIONS")
+	superadmin.HandleFunc("/commission-rates", h.getCommissionRates).Methods("GET", "OPTIONS")
+	superadmin.HandleFunc("/commission-rates", h.setCommissionRate).Methods("PUT", "OPTIONS")
+	superadmin.HandleFunc("/commission-rates/{rate_id}", h.deleteCommissionRate).Methods("DELETE", "OPTIONS")
+	superadmin.HandleFunc("/payouts", h.getPayoutStatements).Methods("GET", "OPTIONS")
+	superadmin.HandleFunc("/payouts/statements", h.generatePayoutStatements).Methods("POST", "OPTIONS")
+	superadmin.HandleFunc("/payouts/{statement_id}", h.getPayoutStatement).Methods("GET", "OPTIONS")
+	superadmin.HandleFunc("/payouts/{statement_id}/paid", h.markPayoutPaid).Methods("PUT", "OPTIONS")
+	superadmin.HandleFunc("/conversations", h.getConversations).Methods("GET", "OPTIONS")
+	superadmin.HandleFunc("/conversations/{conversation_id}", h.getConversation).Methods("GET", "OPTIONS")
+	superadmin.HandleFunc("/conversations/{conversation_id}", h.deleteConversation).Methods("DELETE", "OPTIONS")
+	superadmin.HandleFunc("/conversations/{conversation_id}/messages", h.createConversationMessage).Methods("POST", "OPTIONS")
+	superadmin.HandleFunc("/conversations/{conversation_id}/read", h.markConversationRead).Methods("PUT", "OPTIONS")
+	superadmin.HandleFunc("/conversations/{conversation_id}/status", h.updateConversationStatus).Methods("PUT", "OPTIONS")
 
 	// Market admin routes
 	marketAdmin := router.PathPrefix("/api/market").Subrouter()
-	marketAdmin.Use(h.authMiddleware)
+	marketAdmin.Use(h.authMiddleware, h.rateLimitMiddleware(rateLimitMarket, h.cfg.RateLimitMarket), h.marketPermissionMiddleware, h.idempotencyMiddleware, h.auditMiddleware)
 	marketAdmin.HandleFunc("/products", h.createProduct).Methods("POST", "OPTIONS")
+	marketAdmin.HandleFunc("/products/import", h.importProducts).Methods("POST", "OPTIONS")
+	marketAdmin.HandleFunc("/products/import/{job_id}", h.getProductImportJob).Methods("GET", "OPTIONS")
+	marketAdmin.HandleFunc("/products/export", h.exportProducts).Methods("GET", "OPTIONS")
+	marketAdmin.HandleFunc("/categories", h.getMarketAdminCategoryTree).Methods("GET", "OPTIONS")
+	marketAdmin.HandleFunc("/translations/{entity}/{id}", h.getMarketTranslations).Methods("GET", "OPTIONS")
+	marketAdmin.HandleFunc("/translations/{entity}/{id}", h.setMarketTranslations).Methods("PUT", "OPTIONS")
+	marketAdmin.HandleFunc("/jobs/{job_id}", h.getMarketJob).Methods("GET", "OPTIONS")
 	marketAdmin.HandleFunc("/products/{product_id}", h.updateProduct).Methods("PUT", "OPTIONS")
 	marketAdmin.HandleFunc("/products/{product_id}", h.deleteProduct).Methods("DELETE", "OPTIONS")
 	marketAdmin.HandleFunc("/products/{id}/thumbnails", h.addProductThumbnails).Methods("POST", "OPTIONS")
@@ -72,18 +122,57 @@ func (h *Handler) SetupRoutes(router *mux.Router) {
 	marketAdmin.HandleFunc("/thumbnails/{thumbnail_id}", h.deleteThumbnail).Methods("DELETE", "OPTIONS")
 	marketAdmin.HandleFunc("/markets/{id}/thumbnail", h.uploadMarketThumbnail).Methods("POST", "OPTIONS")
 	marketAdmin.HandleFunc("/orders", h.getMarketAdminOrders).Methods("GET", "OPTIONS")
-	marketAdmin.HandleFunc("/orders/{cart_order_id}/{user_id}", h.getMarketAdminOrderByID).Methods("GET", "OPTIONS")
+	marketAdmin.HandleFunc("/orders/stream", h.streamMarketOrders).Methods("GET", "OPTIONS")
+	marketAdmin.HandleFunc("/analytics/summary", h.getSalesSummary).Methods("GET", "OPTIONS")
+	marketAdmin.HandleFunc("/analytics/sales", h.getSalesSeries).Methods("GET", "OPTIONS")
+	marketAdmin.HandleFunc("/analytics/top-products", h.getTopProducts).Methods("GET", "OPTIONS")
+	marketAdmin.HandleFunc("/analytics/top-variants", h.getTopVariants).Methods("GET", "OPTIONS")
+	marketAdmin.HandleFunc("/analytics/low-stock", h.getLowStock).Methods("GET", "OPTIONS")
+	marketAdmin.HandleFunc("/analytics/favorites-conversion", h.getFavoriteConversion).Methods("GET", "OPTIONS")
+	marketAdmin.HandleFunc("/payouts", h.getPayoutStatements).Methods("GET", "OPTIONS")
+	marketAdmin.HandleFunc("/payouts/{statement_id}", h.getPayoutStatement).Methods("GET", "OPTIONS")
+	marketAdmin.HandleFunc("/returns", h.getReturnRequests).Methods("GET", "OPTIONS")
+	marketAdmin.HandleFunc("/returns/{return_id}", h.getReturnRequest).Methods("GET", "OPTIONS")
+	marketAdmin.HandleFunc("/returns/{return_id}/status", h.updateReturnStatus).Methods("PUT", "OPTIONS")
+	marketAdmin.HandleFunc("/orders/{order_id}", h.getMarketAdminOrderByID).Methods("GET", "OPTIONS")
 	marketAdmin.HandleFunc("/profile", h.getMarketProfile).Methods("GET", "OPTIONS")
 	marketAdmin.HandleFunc("/profile", h.updateMarketProfile).Methods("PUT", "OPTIONS")
-	marketAdmin.HandleFunc("/orders/{cart_order_id}/{user_id}", h.updateOrderStatus).Methods("PUT", "OPTIONS")
+	marketAdmin.HandleFunc("/orders/{order_id}", h.updateOrderStatus).Methods("PUT", "OPTIONS")
 	marketAdmin.HandleFunc("/sizes/{size_id}", h.updateSize).Methods("PUT", "OPTIONS")
 	marketAdmin.HandleFunc("/thumbnails/{thumbnail_id}", h.updateThumbnail).Methods("PUT", "OPITONS")
 	marketAdmin.HandleFunc("/markets", h.getMarketByID).Methods("GET", "OPTIONS")
 	marketAdmin.HandleFunc("/messages", h.createMarketMessage).Methods("POST", "OPTIONS")
 	marketAdmin.HandleFunc("/orders/{order_id}", h.deleteOrderByID).Methods("DELETE", "OPTIONS")
+	marketAdmin.HandleFunc("/orders/{order_id}/invoice", h.getOrderInvoice).Methods("GET", "OPTIONS")
+	marketAdmin.HandleFunc("/orders/{order_id}/packing-slip", h.getOrderPackingSlip).Methods("GET", "OPTIONS")
+	marketAdmin.HandleFunc("/order-items/{item_id}/status", h.updateOrderItemStatus).Methods("PUT", "OPTIONS")
+	marketAdmin.HandleFunc("/shipments", h.createShipment).Methods("POST", "OPTIONS")
+	marketAdmin.HandleFunc("/shipments/{shipment_id}/delivered", h.deliverShipment).Methods("PUT", "OPTIONS")
+	marketAdmin.HandleFunc("/staff", h.getMarketStaff).Methods("GET", "OPTIONS")
+	marketAdmin.HandleFunc("/staff", h.createMarketStaff).Methods("POST", "OPTIONS")
+	marketAdmin.HandleFunc("/staff/{staff_id}", h.updateMarketStaff).Methods("PUT", "OPTIONS")
+	marketAdmin.HandleFunc("/staff/{staff_id}/password", h.resetMarketStaffPassword).Methods("PUT", "OPTIONS")
+	marketAdmin.HandleFunc("/password", h.changeMarketStaffPassword).Methods("PUT", "OPTIONS")
+	marketAdmin.HandleFunc("/products/{product_id}/variants", h.getProductVariants).Methods("GET", "OPTIONS")
+	marketAdmin.HandleFunc("/products/{product_id}/variants", h.createVariant).Methods("POST", "OPTIONS")
+	marketAdmin.HandleFunc("/variants/{variant_id}", h.updateVariant).Methods("PUT", "OPTIONS")
+	marketAdmin.HandleFunc("/variants/{variant_id}", h.deleteVariant).Methods("DELETE", "OPTIONS")
+	marketAdmin.HandleFunc("/variants/{variant_id}/images", h.addVariantImages).Methods("POST", "OPTIONS")
+	marketAdmin.HandleFunc("/variant-images/{image_id}", h.deleteVariantImage).Methods("DELETE", "OPTIONS")
+	marketAdmin.HandleFunc("/notifications", h.getNotifications).Methods("GET", "OPTIONS")
+	marketAdmin.HandleFunc("/notifications/read-all", h.markAllNotificationsRead).Methods("PUT", "OPTIONS")
+	marketAdmin.HandleFunc("/notifications/{notification_id}/read", h.markNotificationRead).Methods("PUT", "OPTIONS")
+	marketAdmin.HandleFunc("/devices", h.registerDevice).Methods("POST", "OPTIONS")
+	marketAdmin.HandleFunc("/devices", h.unregisterDevice).Methods("DELETE", "OPTIONS")
+	marketAdmin.HandleFunc("/conversations", h.getConversations).Methods("GET", "OPTIONS")
+	marketAdmin.HandleFunc("/conversations", h.createConversation).Methods("POST", "OPTIONS")
+	marketAdmin.HandleFunc("/conversations/{conversation_id}", h.getConversation).Methods("GET", "OPTIONS")
+	marketAdmin.HandleFunc("/conversations/{conversation_id}/messages", h.createConversationMessage).Methods("POST", "OPTIONS")
+	marketAdmin.HandleFunc("/conversations/{conversation_id}/read", h.markConversationRead).Methods("PUT", "OPTIONS")
+	marketAdmin.HandleFunc("/conversations/{conversation_id}/status", h.updateConversationStatus).Methods("PUT", "OPTIONS")
 	// User protected routes
 	userProtected := router.PathPrefix("/api").Subrouter()
-	userProtected.Use(h.authMiddleware)
+	userProtected.Use(h.authMiddleware, h.rateLimitMiddleware(rateLimitUser, h.cfg.RateLimitUser), h.idempotencyMiddleware)
 	userProtected.HandleFunc("/favorites", h.getUserFavorites).Methods("GET", "OPTIONS")
 	userProtected.HandleFunc("/favorites", h.toggleFavorite).Methods("POST", "OPTIONS")
 	userProtected.HandleFunc("/cart", h.addToCart).Methods("POST", "OPTIONS")
@@ -96,30 +185,67 @@ func (h *Handler) SetupRoutes(router *mux.Router) {
 	userProtected.HandleFunc("/cart", h.clearCart).Methods("DELETE", "OPTIONS")
 	userProtected.HandleFunc("/cart-product/{size_id}", h.deleteCartBySizeID).Methods("DELETE", "OPTIONS")
 	userProtected.HandleFunc("/cart/{size_id}", h.updateCartCountBySizeID).Methods("PUT", "OPTIONS")
+	userProtected.HandleFunc("/cart/variants/{variant_id}", h.updateCartCountByVariantID).Methods("PUT", "OPTIONS")
+	userProtected.HandleFunc("/cart/variants/{variant_id}", h.deleteCartByVariantID).Methods("DELETE", "OPTIONS")
 	userProtected.HandleFunc("/locations/{location_id}", h.updateLocationByID).Methods("PUT", "OPTIONS")
 	userProtected.HandleFunc("/profile", h.getProfile).Methods("GET", "OPTIONS")
 	userProtected.HandleFunc("/profile", h.updateProfile).Methods("PUT", "OPTIONS")
+	userProtected.HandleFunc("/profile/phone", h.requestPhoneChange).Methods("POST", "OPTIONS")
+	userProtected.HandleFunc("/profile/phone/confirm", h.confirmPhoneChange).Methods("POST", "OPTIONS")
 	userProtected.HandleFunc("/user-orders", h.getUserOrders).Methods("GET", "OPTIONS")
 	userProtected.HandleFunc("/user-orders/{order_id}", h.deleteUserHistory).Methods("PUT", "OPTIONS")
+	userProtected.HandleFunc("/user-orders/{order_id}/receipt", h.getOrderReceipt).Methods("GET", "OPTIONS")
+	userProtected.HandleFunc("/returns", h.createReturnRequest).Methods("POST", "OPTIONS")
+	userProtected.HandleFunc("/returns", h.getReturnRequests).Methods("GET", "OPTIONS")
+	userProtected.HandleFunc("/returns/{return_id}", h.getReturnRequest).Methods("GET", "OPTIONS")
 	userProtected.HandleFunc("/messages", h.createMessage).Methods("POST", "OPTIONS")
+	userProtected.HandleFunc("/notifications", h.getNotifications).Methods("GET", "OPTIONS")
+	userProtected.HandleFunc("/notifications/read-all", h.markAllNotificationsRead).Methods("PUT", "OPTIONS")
+	userProtected.HandleFunc("/notifications/{notification_id}/read", h.markNotificationRead).Methods("PUT", "OPTIONS")
+	userProtected.HandleFunc("/devices", h.registerDevice).Methods("POST", "OPTIONS")
+	userProtected.HandleFunc("/devices", h.unregisterDevice).Methods("DELETE", "OPTIONS")
+	userProtected.HandleFunc("/conversations", h.getConversations).Methods("GET", "OPTIONS")
+	userProtected.HandleFunc("/conversations", h.createConversation).Methods("POST", "OPTIONS")
+	userProtected.HandleFunc("/conversations/{conversation_id}", h.getConversation).Methods("GET", "OPTIONS")
+	userProtected.HandleFunc("/conversations/{conversation_id}/messages", h.createConversationMessage).Methods("POST", "OPTIONS")
+	userProtected.HandleFunc("/conversations/{conversation_id}/read", h.markConversationRead).Methods("PUT", "OPTIONS")
+	userProtected.HandleFunc("/conversations/{conversation_id}/status", h.updateConversationStatus).Methods("PUT", "OPTIONS")
 
-	// Public routes
-	router.HandleFunc("/superadmin/register", h.registerSuperadmin).Methods("POST", "OPTIONS")
-	router.HandleFunc("/register", h.register).Methods("POST", "OPTIONS")
-	router.HandleFunc("/login", h.login).Methods("POST", "OPTIONS")
-	router.HandleFunc("/verify", h.verifyCode).Methods("POST", "OPTIONS")
-	router.HandleFunc("/market/login", h.loginMarket).Methods("POST", "OPTIONS")
-	router.HandleFunc("/superadmin/login", h.loginSuperadmin).Methods("POST", "OPTIONS")
-	router.HandleFunc("/markets", h.getMarkets).Methods("GET", "OPTIONS")
+	// Public routes, limited per client IP
+	public := router.NewRoute().Subrouter()
+	public.Use(h.rateLimitMiddleware(rateLimitPublic, h.cfg.RateLimitPublic))
+	public.HandleFunc("/superadmin/register", h.registerSuperadmin).Methods("POST", "OPTIONS")
+	public.HandleFunc("/register", h.register).Methods("POST", "OPTIONS")
+	public.HandleFunc("/login", h.login).Methods("POST", "OPTIONS")
+	public.HandleFunc("/verify", h.verifyCode).Methods("POST", "OPTIONS")
+	public.HandleFunc("/market/login", h.loginMarket).Methods("POST", "OPTIONS")
+	public.HandleFunc("/superadmin/login", h.loginSuperadmin).Methods("POST", "OPTIONS")
+	public.HandleFunc("/markets", h.getMarkets).Methods("GET", "OPTIONS")
 	//router.HandleFunc("/markets/{id}/products", h.getMarketProducts).Methods("GET", "OPTIONS")
 	userProtected.HandleFunc("/products", h.getAllProducts).Methods("GET", "OPTIONS")
-	router.HandleFunc("/products", h.getAllProductsNonAuthenticated).Methods("GET", "OPTIONS")
-	router.HandleFunc("/products/{id}", h.getProduct).Methods("GET", "OPTIONS")
+	public.HandleFunc("/products", h.getAllProductsNonAuthenticated).Methods("GET", "OPTIONS")
+	public.HandleFunc("/products/{id}", h.getProduct).Methods("GET", "OPTIONS")
 	userProtected.HandleFunc("/products/{id}", h.getProductNonAuthenticated).Methods("GET", "OPTIONS")
-	router.HandleFunc("/thumbnails", h.getAllThumbnails).Methods("GET", "OPTIONS")
-	router.HandleFunc("/categories", h.getCategories).Methods("GET", "OPTIONS")
-	router.HandleFunc("/banners", h.getBanners).Methods("GET", "OPTIONS")
-	router.HandleFunc("/markets/{id}", h.getMarketByIDALL).Methods("GET", "OPTIONS")
+	public.HandleFunc("/thumbnails", h.getAllThumbnails).Methods("GET", "OPTIONS")
+	public.HandleFunc("/categories", h.getCategories).Methods("GET", "OPTIONS")
+	public.HandleFunc("/categories/tree", h.getCategoryTree).Methods("GET", "OPTIONS")
+	public.HandleFunc("/locales", h.getLocales).Methods("GET", "OPTIONS")
+	public.HandleFunc("/banners", h.getBanners).Methods("GET", "OPTIONS")
+	public.HandleFunc("/markets/{id}", h.getMarketByIDALL).Methods("GET", "OPTIONS")
+
+	// Health checks and metrics
+	router.HandleFunc("/healthz", h.healthz).Methods("GET")
+	router.HandleFunc("/readyz", h.readyz).Methods("GET")
+	router.HandleFunc("/metrics", h.serveMetrics).Methods("GET")
+
+	// Start a server span per request, continuing the caller's trace; probes are not traced
+	router.Use(otelmux.Middleware(tracing.ServiceName, otelmux.WithFilter(func(r *http.Request) bool {
+		return !probeRoutes[r.URL.Path]
+	})))
+	// Tag requests with an ID, write the access log and record the HTTP metrics
+	router.Use(h.requestLogMiddleware)
+	// Pick the language of error messages
+	router.Use(h.localeMiddleware)
 	// Wrap router with CORS
 	router.Use(c.Handler)
 }
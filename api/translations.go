@@ -0,0 +1,218 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"Dowlet_projects/ecommerce/models"
+	"Dowlet_projects/ecommerce/services"
+
+	"github.com/gorilla/mux"
+)
+
+// maxRequestLocales caps how many Accept-Language entries are considered
+const maxRequestLocales = 8
+
+// requestLocales returns the locales a request asks for in order of preference: ?lang= first, then
+// Accept-Language by quality. A regional locale such as pt-BR is followed by its language. No locales
+// means the base locale, as before translations existed.
+func requestLocales(r *http.Request) []string {
+	var locales []string
+	seen := make(map[string]bool)
+	add := func(tag string) {
+		locale, ok := services.NormalizeLocale(tag)
+		if !ok {
+			return
+		}
+		for _, l := range []string{locale, strings.SplitN(locale, "-", 2)[0]} {
+			if !seen[l] {
+				seen[l] = true
+				locales = append(locales, l)
+			}
+		}
+	}
+
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		add(lang)
+	}
+
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var accepted []weighted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q > 0 {
+			accepted = append(accepted, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool { return accepted[i].q > accepted[j].q })
+	for i, a := range accepted {
+		if i == maxRequestLocales {
+			break
+		}
+		add(a.tag)
+	}
+	return locales
+}
+
+// getLocales lists the locales texts are available in
+// @Summary     Get available locales
+// @Description Lists the locales texts can be requested in with ?lang= or Accept-Language. en is the language of the plain fields and ru of the *_ru fields; other locales fall back to en where a text is not translated.
+// @Tags        Translations
+// @Produce     json
+// @Router      /locales [get]
+func (h *Handler) getLocales(w http.ResponseWriter, r *http.Request) {
+	locales, err := h.db.GetLocales(r.Context())
+	if err != nil {
+		respondServiceError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, locales)
+}
+
+// translationTarget parses the entity a translations route points at
+func translationTarget(w http.ResponseWriter, r *http.Request) (string, int, bool) {
+	vars := mux.Vars(r)
+	entityID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid entity ID")
+		return "", 0, false
+	}
+	return vars["entity"], entityID, true
+}
+
+// getTranslations returns the texts of an entity in every locale
+// @Summary     Get translations
+// @Description Returns the texts of a product, category, market, thumbnail or product option by field and locale, including the en (plain) and ru (*_ru) texts. Requires superadmin JWT authentication.
+// @Tags        Translations
+// @Produce     json
+// @Param       entity path string  true "products, categories, markets, thumbnails or product_options"
+// @Param       id     path integer true "Entity ID"
+// @Security    BearerAuth
+// @Router      /api/superadmin/translations/{entity}/{id} [get]
+func (h *Handler) getTranslations(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireSuperadmin(w, r); !ok {
+		return
+	}
+	h.respondTranslations(w, r, 0)
+}
+
+// setTranslations sets texts of an entity
+// @Summary     Set translations
+// @Description Sets texts of a product, category, market, thumbnail or product option by field and locale. en texts change the plain fields and ru texts the *_ru fields; an empty text in another locale removes the translation. Requires superadmin JWT authentication.
+// @Tags        Translations
+// @Accept      json
+// @Produce     json
+// @Param       entity  path string                        true "products, categories, markets, thumbnails or product_options"
+// @Param       id      path integer                       true "Entity ID"
+// @Param       request body models.SetTranslationsRequest true "Texts by field and locale"
+// @Security    BearerAuth
+// @Router      /api/superadmin/translations/{entity}/{id} [put]
+func (h *Handler) setTranslations(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireSuperadmin(w, r); !ok {
+		return
+	}
+	h.saveTranslations(w, r, 0)
+}
+
+// getMarketTranslations returns the texts of one of the market's catalog entities in every locale
+// @Summary     Get catalog translations
+// @Description Returns the texts of one of the market's products, thumbnails or product options by field and locale, including the en (plain) and ru (*_ru) texts. Requires market admin JWT authentication.
+// @Tags        Translations
+// @Produce     json
+// @Param       entity path string  true "products, thumbnails or product_options"
+// @Param       id     path integer true "Entity ID"
+// @Security    BearerAuth
+// @Router      /api/market/translations/{entity}/{id} [get]
+func (h *Handler) getMarketTranslations(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireMarketAdmin(w, r)
+	if !ok {
+		return
+	}
+	h.respondTranslations(w, r, claims.MarketID)
+}
+
+// setMarketTranslations sets texts of one of the market's catalog entities
+// @Summary     Set catalog translations
+// @Description Sets texts of one of the market's products, thumbnails or product options by field and locale. en texts change the plain fields and ru texts the *_ru fields; an empty text in another locale removes the translation. Requires market admin JWT authentication.
+// @Tags        Translations
+// @Accept      json
+// @Produce     json
+// @Param       entity  path string                        true "products, thumbnails or product_options"
+// @Param       id      path integer                       true "Entity ID"
+// @Param       request body models.SetTranslationsRequest true "Texts by field and locale"
+// @Security    BearerAuth
+// @Router      /api/market/translations/{entity}/{id} [put]
+func (h *Handler) setMarketTranslations(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireMarketAdmin(w, r)
+	if !ok {
+		return
+	}
+	h.saveTranslations(w, r, claims.MarketID)
+}
+
+func (h *Handler) respondTranslations(w http.ResponseWriter, r *http.Request, marketID int) {
+	entityType, entityID, ok := translationTarget(w, r)
+	if !ok {
+		return
+	}
+
+	translations, err := h.db.GetTranslations(r.Context(), entityType, entityID, marketID)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrUnknownEntityType):
+			respondServiceError(w, http.StatusBadRequest, err)
+		case errors.Is(err, services.ErrEntityNotFound):
+			respondServiceError(w, http.StatusNotFound, err)
+		default:
+			respondServiceError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	respondJSON(w, http.StatusOK, translations)
+}
+
+func (h *Handler) saveTranslations(w http.ResponseWriter, r *http.Request, marketID int) {
+	entityType, entityID, ok := translationTarget(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.SetTranslationsRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if err := h.db.SetTranslations(r.Context(), entityType, entityID, marketID, req.Translations); err != nil {
+		switch {
+		case errors.Is(err, services.ErrUnknownEntityType), errors.Is(err, services.ErrNoTranslations), errors.Is(err, services.ErrUnknownTranslationField), errors.Is(err, services.ErrInvalidLocale),
+			errors.Is(err, services.ErrBaseTextRequired):
+			respondServiceError(w, http.StatusBadRequest, err)
+		case errors.Is(err, services.ErrEntityNotFound):
+			respondServiceError(w, http.StatusNotFound, err)
+		case errors.Is(err, services.ErrNameTaken):
+			respondServiceError(w, http.StatusConflict, err)
+		default:
+			respondServiceError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Translations updated successfully"})
+}
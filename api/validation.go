@@ -0,0 +1,447 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"Dowlet_projects/ecommerce/models"
+)
+
+// Request structs declare their rules in validate tags, e.g. `validate:"required,max=255"`:
+//
+//	required   the value is set: non-blank text, non-zero number, non-nil pointer, non-empty list
+//	omitempty  the other rules are skipped when the value, or the value a pointer points at, is not set
+//	len=N      exact length of text (in characters) or of a list
+//	min=N      at least N: the value of a number, the length of text or a list
+//	max=N      at most N, as min
+//	gt=N, lt=N a number strictly above or below N
+//	oneof=a b  one of the space-separated values
+//	numeric    text of digits only
+//	phone      a phone number in international format, e.g. +99361234567
+//	date       a date in the form YYYY-MM-DD
+//
+// Pointers are checked through; nil pointers only fail required. Nested structs and lists of structs
+// are checked too, with paths such as items[0].count.
+
+// fieldRule is one rule of a validate tag
+type fieldRule struct {
+	name  string
+	param string
+	num   float64 // param as a number, for len, min, max, gt and lt
+}
+
+// fieldSpec is a struct field with its rules
+type fieldSpec struct {
+	index     int
+	name      string
+	rules     []fieldRule
+	omitEmpty bool
+}
+
+// fieldSpecs caches the parsed rules of each struct type
+var fieldSpecs sync.Map // reflect.Type -> []fieldSpec
+
+// validationMessages describes each field error code, with %s standing for the rule parameter
+var validationMessages = map[string]map[string]string{
+	"REQUIRED":     {"en": "is required", "ru": "обязательное поле", "tk": "hökmany meýdan"},
+	"LENGTH":       {"en": "must be exactly %s characters long", "ru": "должно содержать ровно %s символов", "tk": "takyk %s nyşandan ybarat bolmaly"},
+	"MIN_LENGTH":   {"en": "must be at least %s characters long", "ru": "должно содержать не менее %s символов", "tk": "azyndan %s nyşandan ybarat bolmaly"},
+	"MAX_LENGTH":   {"en": "must be at most %s characters long", "ru": "должно содержать не более %s символов", "tk": "iň köp %s nyşandan ybarat bolmaly"},
+	"ITEMS_LENGTH": {"en": "must have exactly %s items", "ru": "должно содержать ровно %s элементов", "tk": "takyk %s elementden ybarat bolmaly"},
+	"MIN_ITEMS":    {"en": "must have at least %s items", "ru": "должно содержать не менее %s элементов", "tk": "azyndan %s elementden ybarat bolmaly"},
+	"MAX_ITEMS":    {"en": "must have at most %s items", "ru": "должно содержать не более %s элементов", "tk": "iň köp %s elementden ybarat bolmaly"},
+	"EQUAL":        {"en": "must be %s", "ru": "должно быть равно %s", "tk": "%s bolmaly"},
+	"MIN":          {"en": "must be at least %s", "ru": "должно быть не меньше %s", "tk": "%s-den kiçi bolmaly däl"},
+	"MAX":          {"en": "must be at most %s", "ru": "должно быть не больше %s", "tk": "%s-den uly bolmaly däl"},
+	"GREATER_THAN": {"en": "must be greater than %s", "ru": "должно быть больше %s", "tk": "%s-den uly bolmaly"},
+	"LESS_THAN":    {"en": "must be less than %s", "ru": "должно быть меньше %s", "tk": "%s-den kiçi bolmaly"},
+	"ONE_OF":       {"en": "must be one of: %s", "ru": "должно быть одним из: %s", "tk": "şulardan biri bolmaly: %s"},
+	"NUMERIC":      {"en": "must contain only digits", "ru": "должно содержать только цифры", "tk": "diňe sanlardan ybarat bolmaly"},
+	"PHONE":        {"en": "must be a phone number in international format", "ru": "должно быть номером телефона в международном формате", "tk": "halkara formatdaky telefon belgisi bolmaly"},
+	"DATE":         {"en": "must be a date in the form YYYY-MM-DD", "ru": "должно быть датой в формате ГГГГ-ММ-ДД", "tk": "ÝÝÝÝ-AA-GG görnüşindäki sene bolmaly"},
+	"INVALID":      {"en": "is not valid", "ru": "недопустимое значение", "tk": "nädogry baha"},
+}
+
+// decodeJSON decodes a JSON request body into dst and validates it. It responds with an error and
+// returns false when the body is malformed or breaks the rules of dst.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(dst); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return false
+	}
+	return validateRequest(w, dst)
+}
+
+// decodeForm parses a multipart form into dst, a pointer to a struct whose fields name their form
+// values in form tags, and validates it. Text, number and boolean fields are supported, also as
+// pointers; a missing or empty value leaves the field unset. It responds with an error and returns
+// false when the form is malformed, a value cannot be parsed or a rule is broken.
+func decodeForm(w http.ResponseWriter, r *http.Request, maxMemory int64, dst interface{}) bool {
+	if err := r.ParseMultipartForm(maxMemory); err != nil {
+		respondError(w, http.StatusBadRequest, "Error parsing form")
+		return false
+	}
+
+	var fields []models.FieldError
+	v := reflect.ValueOf(dst).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("form"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		value := r.FormValue(name)
+		if value == "" {
+			continue
+		}
+		if err := setFormValue(v.Field(i), value); err != nil {
+			fields = append(fields, fieldError(name, "INVALID", ""))
+		}
+	}
+
+	for _, field := range validateStruct(dst) {
+		if !hasFieldError(fields, field.Field) {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) > 0 {
+		respondValidationError(w, fields...)
+		return false
+	}
+	return true
+}
+
+// setFormValue parses a form value into a field, allocating pointer fields
+func setFormValue(field reflect.Value, value string) error {
+	if field.Kind() == reflect.Ptr {
+		target := reflect.New(field.Type().Elem())
+		if err := setFormValue(target.Elem(), value); err != nil {
+			return err
+		}
+		field.Set(target)
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported form field type %s", field.Type())
+	}
+	return nil
+}
+
+func hasFieldError(fields []models.FieldError, name string) bool {
+	for _, f := range fields {
+		if f.Field == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRequest checks a request built from JSON or form values against its validate tags and
+// responds with every field error at once. It returns false when a response was sent.
+func validateRequest(w http.ResponseWriter, req interface{}) bool {
+	fields := validateStruct(req)
+	if len(fields) == 0 {
+		return true
+	}
+	respondValidationError(w, fields...)
+	return false
+}
+
+// respondValidationError responds 400 VALIDATION_FAILED with field errors. Handlers use it for
+// rules that tags cannot express, such as fields that depend on each other.
+func respondValidationError(w http.ResponseWriter, fields ...models.FieldError) {
+	locale := w.Header().Get("Content-Language")
+	problems := make([]string, len(fields))
+	for i := range fields {
+		problems[i] = fields[i].Field + " " + fields[i].Message
+		if text, ok := validationMessages[fields[i].Code][locale]; ok {
+			fields[i].Message = formatRuleMessage(text, fields[i].Param)
+		}
+	}
+	writeError(w, http.StatusBadRequest, models.ErrorResponse{
+		Error:  "validation failed: " + strings.Join(problems, "; "),
+		Code:   "VALIDATION_FAILED",
+		Field:  fields[0].Field,
+		Fields: fields,
+	})
+}
+
+// fieldError builds the field error of a code in English; respondValidationError translates it
+func fieldError(field, code, param string) models.FieldError {
+	return models.FieldError{
+		Field:   field,
+		Code:    code,
+		Message: formatRuleMessage(validationMessages[code]["en"], param),
+		Param:   param,
+	}
+}
+
+func formatRuleMessage(text, param string) string {
+	if strings.Contains(text, "%s") {
+		return fmt.Sprintf(text, param)
+	}
+	return text
+}
+
+// validateStruct returns the field errors of a struct or pointer to a struct, in field order
+func validateStruct(v interface{}) []models.FieldError {
+	var fields []models.FieldError
+	validateValue(reflect.ValueOf(v), "", &fields)
+	return fields
+}
+
+func validateValue(v reflect.Value, path string, fields *[]models.FieldError) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		for _, spec := range specsOf(v.Type()) {
+			field := v.Field(spec.index)
+			name := spec.name
+			if path != "" {
+				name = path + "." + name
+			}
+			if spec.omitEmpty && isOmitted(field) {
+				continue
+			}
+			if checkRules(field, name, spec.rules, fields) {
+				validateValue(field, name, fields)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			validateValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), fields)
+		}
+	}
+}
+
+// specsOf returns the fields of a struct type that have rules or may contain structs with rules
+func specsOf(t reflect.Type) []fieldSpec {
+	if cached, ok := fieldSpecs.Load(t); ok {
+		return cached.([]fieldSpec)
+	}
+
+	var specs []fieldSpec
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := f.Tag.Get("validate")
+		if tag == "-" || (tag == "" && !mayHoldRules(f.Type)) {
+			continue
+		}
+
+		spec := fieldSpec{index: i, name: fieldName(f)}
+		for _, part := range strings.Split(tag, ",") {
+			if part == "" {
+				continue
+			}
+			name, param, _ := strings.Cut(part, "=")
+			rule := fieldRule{name: name, param: param}
+			switch name {
+			case "omitempty":
+				spec.omitEmpty = true
+				continue
+			case "len", "min", "max", "gt", "lt":
+				num, err := strconv.ParseFloat(param, 64)
+				if err != nil {
+					panic(fmt.Sprintf("validate: bad %s parameter %q on %s.%s", name, param, t.Name(), f.Name))
+				}
+				rule.num = num
+			case "required", "oneof", "numeric", "phone", "date":
+			default:
+				panic(fmt.Sprintf("validate: unknown rule %q on %s.%s", name, t.Name(), f.Name))
+			}
+			spec.rules = append(spec.rules, rule)
+		}
+		specs = append(specs, spec)
+	}
+
+	fieldSpecs.Store(t, specs)
+	return specs
+}
+
+// mayHoldRules reports whether values of a type can contain structs to validate
+func mayHoldRules(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct && t.PkgPath() != "time"
+}
+
+// fieldName is the name clients send a field under: its json or form name, else the Go name
+func fieldName(f reflect.StructField) string {
+	for _, key := range []string{"json", "form"} {
+		if name, _, _ := strings.Cut(f.Tag.Get(key), ","); name != "" && name != "-" {
+			return name
+		}
+	}
+	return f.Name
+}
+
+// isEmptyValue reports whether a value is unset: nil, zero, or blank text
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.String:
+		return strings.TrimSpace(v.String()) == ""
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	default:
+		return v.IsZero()
+	}
+}
+
+// isOmitted reports whether omitempty skips a value: it is unset, or points at an unset value
+func isOmitted(v reflect.Value) bool {
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	return isEmptyValue(v)
+}
+
+// checkRules adds the errors of one field and reports whether its contents should be checked too.
+// A field stops at its first broken rule.
+func checkRules(v reflect.Value, name string, rules []fieldRule, fields *[]models.FieldError) bool {
+	for _, rule := range rules {
+		if rule.name == "required" {
+			if isEmptyValue(v) {
+				*fields = append(*fields, fieldError(name, "REQUIRED", ""))
+				return false
+			}
+			continue
+		}
+
+		value := v
+		for value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				return false
+			}
+			value = value.Elem()
+		}
+		if code, ok := checkRule(value, rule); !ok {
+			*fields = append(*fields, fieldError(name, code, ruleParam(rule)))
+			return false
+		}
+	}
+	return true
+}
+
+// checkRule checks a non-pointer value against a rule, returning the error code when it fails
+func checkRule(v reflect.Value, rule fieldRule) (string, bool) {
+	switch v.Kind() {
+	case reflect.String:
+		s := v.String()
+		n := float64(utf8.RuneCountInString(s))
+		switch rule.name {
+		case "len":
+			return "LENGTH", n == rule.num
+		case "min":
+			return "MIN_LENGTH", n >= rule.num
+		case "max":
+			return "MAX_LENGTH", n <= rule.num
+		case "oneof":
+			for _, option := range strings.Fields(rule.param) {
+				if s == option {
+					return "", true
+				}
+			}
+			return "ONE_OF", false
+		case "numeric":
+			return "NUMERIC", s != "" && strings.Trim(s, "0123456789") == ""
+		case "phone":
+			return "PHONE", validatePhone(s)
+		case "date":
+			_, err := time.Parse("2006-01-02", s)
+			return "DATE", err == nil
+		}
+
+	case reflect.Slice, reflect.Array, reflect.Map:
+		n := float64(v.Len())
+		switch rule.name {
+		case "len":
+			return "ITEMS_LENGTH", n == rule.num
+		case "min":
+			return "MIN_ITEMS", n >= rule.num
+		case "max":
+			return "MAX_ITEMS", n <= rule.num
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		var n float64
+		switch v.Kind() {
+		case reflect.Float32, reflect.Float64:
+			n = v.Float()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n = float64(v.Int())
+		default:
+			n = float64(v.Uint())
+		}
+		switch rule.name {
+		case "len":
+			return "EQUAL", n == rule.num
+		case "min":
+			return "MIN", n >= rule.num
+		case "max":
+			return "MAX", n <= rule.num
+		case "gt":
+			return "GREATER_THAN", n > rule.num
+		case "lt":
+			return "LESS_THAN", n < rule.num
+		case "oneof":
+			for _, option := range strings.Fields(rule.param) {
+				if strconv.FormatFloat(n, 'f', -1, 64) == option {
+					return "", true
+				}
+			}
+			return "ONE_OF", false
+		}
+	}
+	return "INVALID", false
+}
+
+// ruleParam is the rule parameter as shown in messages
+func ruleParam(rule fieldRule) string {
+	if rule.name == "oneof" {
+		return strings.Join(strings.Fields(rule.param), ", ")
+	}
+	return rule.param
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"Dowlet_projects/ecommerce/models"
+)
+
+type testItem struct {
+	Count int `json:"count" validate:"min=1"`
+}
+
+type testRequest struct {
+	Name     string     `json:"name" validate:"required,max=5"`
+	Code     string     `json:"code,omitempty" validate:"omitempty,len=3,numeric"`
+	Phone    *string    `json:"phone,omitempty" validate:"omitempty,phone"`
+	Status   string     `json:"status,omitempty" validate:"omitempty,oneof=open closed"`
+	Day      string     `json:"day,omitempty" validate:"omitempty,date"`
+	Price    float64    `json:"price" validate:"gt=0,lt=100"`
+	Level    int        `json:"level,omitempty" validate:"omitempty,oneof=1 2"`
+	Tags     []string   `json:"tags,omitempty" validate:"max=2"`
+	Items    []testItem `json:"items,omitempty"`
+	Untagged string     `json:"untagged"`
+}
+
+func strPtr(s string) *string { return &s }
+
+func TestValidateStruct(t *testing.T) {
+	valid := func() testRequest {
+		return testRequest{Name: "shop", Price: 10}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*testRequest)
+		field  string
+		code   string
+		param  string
+	}{
+		{"valid", func(r *testRequest) {}, "", "", ""},
+		{"required missing", func(r *testRequest) { r.Name = "" }, "name", "REQUIRED", ""},
+		{"required blank", func(r *testRequest) { r.Name = "   " }, "name", "REQUIRED", ""},
+		{"max length counts characters", func(r *testRequest) { r.Name = "dükan" }, "", "", ""},
+		{"max length", func(r *testRequest) { r.Name = "market" }, "name", "MAX_LENGTH", "5"},
+		{"omitempty skips rules", func(r *testRequest) { r.Code = "" }, "", "", ""},
+		{"len", func(r *testRequest) { r.Code = "12" }, "code", "LENGTH", "3"},
+		{"numeric", func(r *testRequest) { r.Code = "1a3" }, "code", "NUMERIC", ""},
+		{"phone", func(r *testRequest) { r.Phone = strPtr("+99361234567") }, "", "", ""},
+		{"phone without plus", func(r *testRequest) { r.Phone = strPtr("99361234567") }, "phone", "PHONE", ""},
+		{"omitempty through pointer", func(r *testRequest) { r.Phone = strPtr("") }, "", "", ""},
+		{"oneof text", func(r *testRequest) { r.Status = "pending" }, "status", "ONE_OF", "open, closed"},
+		{"oneof number", func(r *testRequest) { r.Level = 3 }, "level", "ONE_OF", "1, 2"},
+		{"date", func(r *testRequest) { r.Day = "2024-13-01" }, "day", "DATE", ""},
+		{"gt", func(r *testRequest) { r.Price = 0 }, "price", "GREATER_THAN", "0"},
+		{"lt", func(r *testRequest) { r.Price = 100 }, "price", "LESS_THAN", "100"},
+		{"max items", func(r *testRequest) { r.Tags = []string{"a", "b", "c"} }, "tags", "MAX_ITEMS", "2"},
+		{"nested list", func(r *testRequest) { r.Items = []testItem{{Count: 1}, {Count: 0}} }, "items[1].count", "MIN", "1"},
+		{"untagged field", func(r *testRequest) { r.Untagged = "" }, "", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := valid()
+			tt.modify(&req)
+			fields := validateStruct(&req)
+			if tt.code == "" {
+				if len(fields) != 0 {
+					t.Fatalf("expected no errors, got %+v", fields)
+				}
+				return
+			}
+			if len(fields) != 1 {
+				t.Fatalf("expected one error, got %+v", fields)
+			}
+			if fields[0].Field != tt.field || fields[0].Code != tt.code || fields[0].Param != tt.param {
+				t.Errorf("got %s %s %q, want %s %s %q", fields[0].Field, fields[0].Code, fields[0].Param, tt.field, tt.code, tt.param)
+			}
+		})
+	}
+}
+
+func TestValidateStructStopsAtFirstBrokenRule(t *testing.T) {
+	req := testRequest{Name: "shop", Code: "1234a", Price: 10}
+	fields := validateStruct(req)
+	if len(fields) != 1 || fields[0].Code != "LENGTH" {
+		t.Fatalf("expected a single LENGTH error, got %+v", fields)
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		ok     bool
+		code   string
+		fields int
+	}{
+		{"valid", `{"name":"shop","price":5}`, true, "", 0},
+		{"malformed", `{"name":`, false, "INVALID_REQUEST_BODY", 0},
+		{"broken rules", `{"name":"","price":500}`, false, "VALIDATION_FAILED", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			var req testRequest
+			if ok := decodeJSON(w, r, &req); ok != tt.ok {
+				t.Fatalf("decodeJSON returned %v, want %v", ok, tt.ok)
+			}
+			if tt.ok {
+				return
+			}
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status %d, want %d", w.Code, http.StatusBadRequest)
+			}
+			var body models.ErrorResponse
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if body.Code != tt.code || len(body.Fields) != tt.fields {
+				t.Errorf("got code %s with %d fields, want %s with %d", body.Code, len(body.Fields), tt.code, tt.fields)
+			}
+		})
+	}
+}
@@ -2,28 +2,91 @@ package config
 
 import (
     "fmt"
+    "log/slog"
+    "net"
     "os"
+    "strconv"
+    "strings"
+    "time"
 )
 
+// RateLimit lets a client make Requests requests at once and refills them evenly over Period.
+// A zero RateLimit turns limiting off.
+type RateLimit struct {
+    Requests int
+    Period   time.Duration
+}
+
 // Config holds application configuration
 type Config struct {
-    DBUser     string
-    DBPassword string
-    DBName     string
-    Redis      string
-    JWTSecret  string
-    ServerAddr string
+    DBUser               string
+    DBPassword           string
+    DBName               string
+    Redis                string
+    JWTSecret            string
+    ServerAddr           string
+    JobWorkers           int
+    // FCMServerKey enables push notifications; without it pushes are only logged
+    FCMServerKey         string
+    FCMEndpoint          string
+    // SMSGatewayURL enables SMS delivery of phone change codes; without it texts are only logged
+    SMSGatewayURL        string
+    SMSGatewayToken      string
+    // NightlyJobsHour is the local hour at which the nightly report rollup and monthly payout
+    // statements are queued
+    NightlyJobsHour      int
+    // ReturnWindowDays is how long after delivery a customer may request a return
+    ReturnWindowDays     int
+    // DocumentFontPath is a TrueType font embedded into PDF invoices and receipts; without it order
+    // documents are only available as HTML
+    DocumentFontPath     string
+    // PhoneChangeNotifyOld sends an SMS to a user's previous number after a phone change
+    PhoneChangeNotifyOld bool
+    // LogLevel is the lowest level written to the log: debug, info, warn or error
+    LogLevel             slog.Level
+    // LogFormat is "json" for log collectors or "text" for reading in a terminal
+    LogFormat            string
+    // MetricsToken, when set, must be sent as a bearer token to read /metrics
+    MetricsToken         string
+    // TraceExporter sends spans to an OTLP collector ("otlp"), writes them to stdout ("stdout") or
+    // turns tracing off ("none")
+    TraceExporter        string
+    // OTLPEndpoint is the collector URL, e.g. http://localhost:4318; empty uses the OTLP default
+    OTLPEndpoint         string
+    // TraceSampleRatio is the share of new traces that are recorded, between 0 and 1
+    TraceSampleRatio     float64
+    // TrustedProxies holds the networks of reverse proxies whose X-Forwarded-For and X-Real-IP
+    // headers name the client; without it clients are known by the address of their connection
+    TrustedProxies       []*net.IPNet
+    // Rate limits by route group. Public routes are limited per client IP, the others per account.
+    RateLimitPublic      RateLimit
+    RateLimitUser        RateLimit
+    RateLimitMarket      RateLimit
+    RateLimitSuperadmin  RateLimit
+    // RateLimitAllowlist holds the networks of internal clients that are not rate limited
+    RateLimitAllowlist   []*net.IPNet
+    // IdempotencyTTL is how long responses to requests with an Idempotency-Key are replayed
+    IdempotencyTTL       time.Duration
 }
 
 // Load loads configuration from environment variables
 func Load() (*Config, error) {
     cfg := &Config{
-        DBUser:     os.Getenv("DB_USER"),
-        DBPassword: os.Getenv("DB_PASSWORD"),
-        DBName:     os.Getenv("DB_NAME"),
-        Redis:      os.Getenv("REDIS_ADDR"),
-        JWTSecret:  os.Getenv("JWT_SECRET"),
-        ServerAddr: os.Getenv("SERVER_ADDR"),
+        DBUser:           os.Getenv("DB_USER"),
+        DBPassword:       os.Getenv("DB_PASSWORD"),
+        DBName:           os.Getenv("DB_NAME"),
+        Redis:            os.Getenv("REDIS_ADDR"),
+        JWTSecret:        os.Getenv("JWT_SECRET"),
+        ServerAddr:       os.Getenv("SERVER_ADDR"),
+        FCMServerKey:     os.Getenv("FCM_SERVER_KEY"),
+        FCMEndpoint:      os.Getenv("FCM_ENDPOINT"),
+        SMSGatewayURL:    os.Getenv("SMS_GATEWAY_URL"),
+        SMSGatewayToken:  os.Getenv("SMS_GATEWAY_TOKEN"),
+        DocumentFontPath: os.Getenv("DOCUMENT_FONT_PATH"),
+        LogFormat:        os.Getenv("LOG_FORMAT"),
+        MetricsToken:     os.Getenv("METRICS_TOKEN"),
+        TraceExporter:    os.Getenv("TRACE_EXPORTER"),
+        OTLPEndpoint:     os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
     }
 
     // Validate required fields
@@ -40,5 +103,158 @@ func Load() (*Config, error) {
         cfg.ServerAddr = ":8080" // Default port
     }
 
+    cfg.JobWorkers = 4 // Default background job workers
+    if workers := os.Getenv("JOB_WORKERS"); workers != "" {
+        n, err := strconv.Atoi(workers)
+        if err != nil || n < 0 {
+            return nil, fmt.Errorf("JOB_WORKERS must be a non-negative integer")
+        }
+        cfg.JobWorkers = n
+    }
+
+    cfg.NightlyJobsHour = 2 // Default nightly jobs at 02:00
+    if hour := os.Getenv("NIGHTLY_JOBS_HOUR"); hour != "" {
+        n, err := strconv.Atoi(hour)
+        if err != nil || n < 0 || n > 23 {
+            return nil, fmt.Errorf("NIGHTLY_JOBS_HOUR must be an hour between 0 and 23")
+        }
+        cfg.NightlyJobsHour = n
+    }
+
+    cfg.ReturnWindowDays = 14 // Default two-week return window
+    if days := os.Getenv("RETURN_WINDOW_DAYS"); days != "" {
+        n, err := strconv.Atoi(days)
+        if err != nil || n < 1 {
+            return nil, fmt.Errorf("RETURN_WINDOW_DAYS must be a positive integer")
+        }
+        cfg.ReturnWindowDays = n
+    }
+
+    cfg.PhoneChangeNotifyOld = true // Warn the previous number by default
+    if notify := os.Getenv("PHONE_CHANGE_NOTIFY_OLD"); notify != "" {
+        b, err := strconv.ParseBool(notify)
+        if err != nil {
+            return nil, fmt.Errorf("PHONE_CHANGE_NOTIFY_OLD must be true or false")
+        }
+        cfg.PhoneChangeNotifyOld = b
+    }
+
+    cfg.LogLevel = slog.LevelInfo // Default info level
+    if level := os.Getenv("LOG_LEVEL"); level != "" {
+        if err := cfg.LogLevel.UnmarshalText([]byte(level)); err != nil {
+            return nil, fmt.Errorf("LOG_LEVEL must be debug, info, warn or error")
+        }
+    }
+
+    if cfg.LogFormat == "" {
+        cfg.LogFormat = "json" // Default format for log collectors
+    }
+    if cfg.LogFormat != "json" && cfg.LogFormat != "text" {
+        return nil, fmt.Errorf("LOG_FORMAT must be json or text")
+    }
+
+    if cfg.TraceExporter == "" {
+        cfg.TraceExporter = "none" // Tracing is opt-in
+    }
+    if cfg.TraceExporter != "otlp" && cfg.TraceExporter != "stdout" && cfg.TraceExporter != "none" {
+        return nil, fmt.Errorf("TRACE_EXPORTER must be otlp, stdout or none")
+    }
+
+    cfg.TraceSampleRatio = 1 // Default to recording every trace
+    if ratio := os.Getenv("TRACE_SAMPLE_RATIO"); ratio != "" {
+        f, err := strconv.ParseFloat(ratio, 64)
+        if err != nil || f < 0 || f > 1 {
+            return nil, fmt.Errorf("TRACE_SAMPLE_RATIO must be a number between 0 and 1")
+        }
+        cfg.TraceSampleRatio = f
+    }
+
+    // Default limits per minute; RATE_LIMIT_<GROUP> takes e.g. 100/1m, or off
+    rateLimits := []struct {
+        env   string
+        field *RateLimit
+        def   RateLimit
+    }{
+        {"RATE_LIMIT_PUBLIC", &cfg.RateLimitPublic, RateLimit{Requests: 120, Period: time.Minute}},
+        {"RATE_LIMIT_USER", &cfg.RateLimitUser, RateLimit{Requests: 300, Period: time.Minute}},
+        {"RATE_LIMIT_MARKET", &cfg.RateLimitMarket, RateLimit{Requests: 600, Period: time.Minute}},
+        {"RATE_LIMIT_SUPERADMIN", &cfg.RateLimitSuperadmin, RateLimit{Requests: 600, Period: time.Minute}},
+    }
+    for _, limit := range rateLimits {
+        *limit.field = limit.def
+        if value := os.Getenv(limit.env); value != "" {
+            l, err := parseRateLimit(value)
+            if err != nil {
+                return nil, fmt.Errorf("%s must be requests per period such as 100/1m, or off", limit.env)
+            }
+            *limit.field = l
+        }
+    }
+
+    networks := []struct {
+        env   string
+        field *[]*net.IPNet
+    }{
+        {"TRUSTED_PROXIES", &cfg.TrustedProxies},
+        {"RATE_LIMIT_ALLOWLIST", &cfg.RateLimitAllowlist},
+    }
+    for _, list := range networks {
+        if value := os.Getenv(list.env); value != "" {
+            for _, entry := range strings.Split(value, ",") {
+                network, err := parseNetwork(strings.TrimSpace(entry))
+                if err != nil {
+                    return nil, fmt.Errorf("%s must be a comma-separated list of IP addresses or CIDR networks", list.env)
+                }
+                *list.field = append(*list.field, network)
+            }
+        }
+    }
+
+    cfg.IdempotencyTTL = 24 * time.Hour // Default to a day of retries
+    if ttl := os.Getenv("IDEMPOTENCY_TTL"); ttl != "" {
+        d, err := time.ParseDuration(ttl)
+        if err != nil || d < time.Minute {
+            return nil, fmt.Errorf("IDEMPOTENCY_TTL must be a duration of at least 1m, such as 24h")
+        }
+        cfg.IdempotencyTTL = d
+    }
+
     return cfg, nil
+}
+
+// parseRateLimit parses "<requests>/<period>", e.g. 100/1m, or "off"
+func parseRateLimit(value string) (RateLimit, error) {
+    if value == "off" {
+        return RateLimit{}, nil
+    }
+    requests, period, ok := strings.Cut(value, "/")
+    if !ok {
+        return RateLimit{}, fmt.Errorf("missing period")
+    }
+    n, err := strconv.Atoi(requests)
+    if err != nil || n < 1 {
+        return RateLimit{}, fmt.Errorf("invalid number of requests")
+    }
+    d, err := time.ParseDuration(period)
+    if err != nil || d < time.Millisecond {
+        return RateLimit{}, fmt.Errorf("invalid period")
+    }
+    return RateLimit{Requests: n, Period: d}, nil
+}
+
+// parseNetwork parses a CIDR network or a single IP address
+func parseNetwork(value string) (*net.IPNet, error) {
+    if strings.Contains(value, "/") {
+        _, network, err := net.ParseCIDR(value)
+        return network, err
+    }
+    ip := net.ParseIP(value)
+    if ip == nil {
+        return nil, fmt.Errorf("invalid IP address %q", value)
+    }
+    bits := 8 * net.IPv6len
+    if ip.To4() != nil {
+        ip, bits = ip.To4(), 8*net.IPv4len
+    }
+    return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
 }
\ No newline at end of file
@@ -0,0 +1,116 @@
+// Package logging configures the structured application log. Records carry the ID of the request
+// they were written for and its trace ID, and personal data in well-known attributes is masked.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context whose log records carry the request ID
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	if requestID == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestID returns the request ID of a context, or "" outside of requests
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Setup makes a logger writing to w the default of both log/slog and the standard log package.
+// format is "json" or "text".
+func Setup(w io.Writer, level slog.Level, format string) *slog.Logger {
+	logger := New(w, level, format)
+	slog.SetDefault(logger)
+	return logger
+}
+
+// New creates a logger writing records of at least level to w as JSON or text
+func New(w io.Writer, level slog.Level, format string) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+	var handler slog.Handler
+	if format == "text" {
+		handler = slog.NewTextHandler(w, opts)
+	} else {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(contextHandler{handler})
+}
+
+// contextHandler adds the request ID and trace ID of the record's context
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// redactedAttrs maps attribute keys holding personal data or secrets to how they are masked
+var redactedAttrs = map[string]func(string) string{
+	"phone":         MaskPhone,
+	"contact_phone": MaskPhone,
+	"full_name":     MaskName,
+	"contact_name":  MaskName,
+	"token":         MaskSecret,
+	"password":      MaskSecret,
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if mask, ok := redactedAttrs[a.Key]; ok && a.Value.Kind() == slog.KindString {
+		return slog.String(a.Key, mask(a.Value.String()))
+	}
+	return a
+}
+
+// MaskPhone keeps the country code and the last two digits of a phone number: +993******12
+func MaskPhone(phone string) string {
+	if len(phone) <= 6 {
+		return strings.Repeat("*", len(phone))
+	}
+	return phone[:4] + strings.Repeat("*", len(phone)-6) + phone[len(phone)-2:]
+}
+
+// MaskName keeps the first letter of a name: A***
+func MaskName(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return ""
+	}
+	r, _ := utf8.DecodeRuneInString(name)
+	return string(r) + "***"
+}
+
+// MaskSecret keeps the first four characters of long secrets such as device tokens and hides
+// short ones entirely
+func MaskSecret(secret string) string {
+	if len(secret) < 16 {
+		return "***"
+	}
+	return secret[:4] + "***"
+}
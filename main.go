@@ -3,6 +3,7 @@ package main
 import (
     "context"
     "log"
+    "log/slog"
     "net/http"
     "os"
     "os/signal"
@@ -11,7 +12,9 @@ import (
     "Dowlet_projects/ecommerce/api"
     "Dowlet_projects/ecommerce/config"
     _ "Dowlet_projects/ecommerce/docs"
+    "Dowlet_projects/ecommerce/logging"
     "Dowlet_projects/ecommerce/services"
+    "Dowlet_projects/ecommerce/tracing"
 
     "github.com/gorilla/mux"
     "github.com/subosito/gotenv"
@@ -41,12 +44,57 @@ func main() {
         log.Fatalf("Failed to load config: %v", err)
     }
 
+    // Log structured records from here on; the standard log package writes through the same logger
+    logging.Setup(os.Stdout, cfg.LogLevel, cfg.LogFormat)
+
+    // Export traces of requests, queries, Redis commands and jobs
+    shutdownTracing, err := tracing.Setup(context.Background(), cfg.TraceExporter, cfg.OTLPEndpoint, cfg.TraceSampleRatio)
+    if err != nil {
+        fatal("Failed to set up tracing", err)
+    }
+
     // Initialize database and Redis service
     dbService, err := services.NewDBService(cfg.DBUser, cfg.DBPassword, cfg.DBName, cfg.Redis)
     if err != nil {
-        log.Fatalf("Failed to connect to database or Redis: %v", err)
+        fatal("Failed to connect to database or Redis", err)
     }
     defer dbService.Close()
+    // Expose the connection pool statistics on /metrics
+    dbService.RegisterMetrics()
+
+    // Deliver push notifications through FCM when configured
+    if cfg.FCMServerKey != "" {
+        dbService.SetNotifier(services.NewFCMNotifier(cfg.FCMEndpoint, cfg.FCMServerKey))
+    } else {
+        slog.Warn("FCM_SERVER_KEY is not set; push notifications will only be logged")
+    }
+
+    // Send phone change codes through the SMS gateway when configured
+    if cfg.SMSGatewayURL != "" {
+        dbService.SetSMSSender(services.NewHTTPSMSSender(cfg.SMSGatewayURL, cfg.SMSGatewayToken))
+    } else {
+        slog.Warn("SMS_GATEWAY_URL is not set; phone change codes will only be logged and cannot be confirmed")
+    }
+
+    // PDF order documents need a font with Cyrillic glyphs
+    if cfg.DocumentFontPath != "" {
+        if err := dbService.SetDocumentFont(cfg.DocumentFontPath); err != nil {
+            fatal("Failed to load DOCUMENT_FONT_PATH", err)
+        }
+    } else {
+        slog.Warn("DOCUMENT_FONT_PATH is not set; order documents are only available as HTML")
+    }
+
+    // Start background job workers
+    workerCtx, stopWorkers := context.WithCancel(context.Background())
+    waitWorkers := func() {}
+    if cfg.JobWorkers > 0 {
+        waitWorkers = dbService.StartJobWorkers(workerCtx, cfg.JobWorkers)
+        slog.Info("Started background job workers", "workers", cfg.JobWorkers)
+    }
+
+    // Queue the nightly report rollup and monthly payout statements; any instance's workers may run them
+    dbService.StartNightlyJobs(workerCtx, cfg.NightlyJobsHour)
 
     // Initialize router
     router := mux.NewRouter()
@@ -61,7 +109,7 @@ func main() {
     // Initialize handler with configuration and database service
     handler, err := api.NewHandler(dbService, cfg)
     if err != nil {
-        log.Fatalf("Failed to create handler: %v", err)
+        fatal("Failed to create handler", err)
     }
     handler.SetupRoutes(router)
 
@@ -76,12 +124,14 @@ func main() {
         WriteTimeout: 10 * time.Second,
         IdleTimeout:  30 * time.Second,
     }
+    // Long-lived order streams would otherwise hold the shutdown up
+    srv.RegisterOnShutdown(handler.CloseStreams)
 
     // Start server with graceful shutdown
     go func() {
-        log.Printf("Starting server on %s", srv.Addr)
+        slog.Info("Starting server", "addr", srv.Addr)
         if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-            log.Fatalf("Server failed: %v", err)
+            fatal("Server failed", err)
         }
     }()
 
@@ -90,11 +140,28 @@ func main() {
     signal.Notify(stop, os.Interrupt, os.Kill)
     <-stop
 
-    log.Println("Shutting down server...")
+    slog.Info("Shutting down server...")
     ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
     defer cancel()
     if err := srv.Shutdown(ctx); err != nil {
-        log.Fatalf("Server shutdown failed: %v", err)
+        fatal("Server shutdown failed", err)
     }
-    log.Println("Server stopped gracefully")
+
+    // Let running jobs finish; queued jobs stay in Redis for the next start
+    stopWorkers()
+    waitWorkers()
+
+    // Flush the spans of the last requests and jobs
+    traceCtx, cancelTrace := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancelTrace()
+    if err := shutdownTracing(traceCtx); err != nil {
+        slog.Error("Failed to flush traces", "error", err)
+    }
+    slog.Info("Server stopped gracefully")
+}
+
+// fatal logs an error that keeps the server from running and exits
+func fatal(msg string, err error) {
+    slog.Error(msg, "error", err)
+    os.Exit(1)
 }
\ No newline at end of file
@@ -0,0 +1,23 @@
+-- Audit log of administrative actions taken through /api/superadmin and /api/market routes
+
+CREATE TABLE `audit_events` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `actor_id` int(11) NOT NULL,
+  `actor_role` varchar(20) NOT NULL,
+  `market_id` int(11) DEFAULT NULL,
+  `action` varchar(10) NOT NULL,
+  `entity_type` varchar(50) NOT NULL,
+  `entity_id` varchar(64) DEFAULT NULL,
+  `before_json` longtext DEFAULT NULL,
+  `after_json` longtext DEFAULT NULL,
+  `route` varchar(255) NOT NULL,
+  `path` varchar(255) NOT NULL,
+  `status_code` smallint(6) NOT NULL,
+  `ip` varchar(64) DEFAULT NULL,
+  `user_agent` varchar(255) DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`id`),
+  KEY `idx_audit_actor` (`actor_role`,`actor_id`),
+  KEY `idx_audit_entity` (`entity_type`,`entity_id`),
+  KEY `idx_audit_created_at` (`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
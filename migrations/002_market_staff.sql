@@ -0,0 +1,16 @@
+-- Staff accounts of a market; the markets.phone/password pair remains the owner login
+
+CREATE TABLE `market_staff` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `market_id` int(11) NOT NULL,
+  `full_name` varchar(255) NOT NULL,
+  `phone` varchar(20) NOT NULL,
+  `password` varchar(255) NOT NULL,
+  `role` enum('owner','catalog_manager','order_handler','viewer') NOT NULL DEFAULT 'viewer',
+  `is_active` tinyint(1) NOT NULL DEFAULT 1,
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `phone` (`phone`),
+  KEY `market_id` (`market_id`),
+  CONSTRAINT `market_staff_ibfk_1` FOREIGN KEY (`market_id`) REFERENCES `markets` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
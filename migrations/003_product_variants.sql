@@ -0,0 +1,141 @@
+-- Generic product variants replacing the Product -> Thumbnail (color) -> Size hierarchy.
+--
+-- A product declares any number of option axes (color, size, material, volume, ...) and each
+-- variant takes one value per axis, carrying its own SKU, barcode, price, compare-at price, stock
+-- and images. The variant price is what the customer is charged; products.price remains the
+-- default price for new variants and the "from" price shown in listings.
+--
+-- Every existing size becomes a variant with the same id, so carts and orders that referenced a
+-- size keep pointing at the same item. The legacy thumbnails/sizes tables and endpoints are kept
+-- and mirrored into variants through product_variants.legacy_size_id.
+
+CREATE TABLE `product_options` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `product_id` int(11) NOT NULL,
+  `name` varchar(50) NOT NULL,
+  `name_ru` varchar(50) NOT NULL DEFAULT '',
+  `position` int(11) NOT NULL DEFAULT 0,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uniq_product_option` (`product_id`,`name`),
+  CONSTRAINT `product_options_ibfk_1` FOREIGN KEY (`product_id`) REFERENCES `products` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+CREATE TABLE `product_variants` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `product_id` int(11) NOT NULL,
+  `sku` varchar(64) NOT NULL,
+  `barcode` varchar(64) DEFAULT NULL,
+  `price` decimal(10,2) NOT NULL,
+  `compare_at_price` decimal(10,2) DEFAULT NULL,
+  `stock` int(11) NOT NULL DEFAULT 0,
+  `is_active` tinyint(1) NOT NULL DEFAULT 1,
+  `position` int(11) NOT NULL DEFAULT 0,
+  `legacy_size_id` int(11) DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uniq_legacy_size_id` (`legacy_size_id`),
+  KEY `idx_variants_product_id` (`product_id`),
+  KEY `idx_variants_sku` (`sku`),
+  KEY `idx_variants_barcode` (`barcode`),
+  CONSTRAINT `product_variants_ibfk_1` FOREIGN KEY (`product_id`) REFERENCES `products` (`id`) ON DELETE CASCADE,
+  CONSTRAINT `product_variants_chk_stock` CHECK (`stock` >= 0)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+CREATE TABLE `product_variant_values` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `variant_id` int(11) NOT NULL,
+  `option_id` int(11) NOT NULL,
+  `value` varchar(100) NOT NULL,
+  `value_ru` varchar(100) NOT NULL DEFAULT '',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uniq_variant_option` (`variant_id`,`option_id`),
+  KEY `option_id` (`option_id`),
+  CONSTRAINT `product_variant_values_ibfk_1` FOREIGN KEY (`variant_id`) REFERENCES `product_variants` (`id`) ON DELETE CASCADE,
+  CONSTRAINT `product_variant_values_ibfk_2` FOREIGN KEY (`option_id`) REFERENCES `product_options` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+CREATE TABLE `product_variant_images` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `variant_id` int(11) NOT NULL,
+  `image_url` varchar(255) NOT NULL,
+  `position` int(11) NOT NULL DEFAULT 0,
+  `legacy_thumbnail_id` int(11) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `variant_id` (`variant_id`),
+  KEY `legacy_thumbnail_id` (`legacy_thumbnail_id`),
+  CONSTRAINT `product_variant_images_ibfk_1` FOREIGN KEY (`variant_id`) REFERENCES `product_variants` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+--
+-- Migrate thumbnails and sizes
+--
+
+INSERT INTO `product_options` (`product_id`, `name`, `name_ru`, `position`)
+SELECT DISTINCT t.product_id, 'color', 'Цвет', 0
+FROM `thumbnails` t
+JOIN `sizes` s ON s.thumbnail_id = t.id
+WHERE t.product_id IS NOT NULL;
+
+INSERT INTO `product_options` (`product_id`, `name`, `name_ru`, `position`)
+SELECT DISTINCT t.product_id, 'size', 'Размер', 1
+FROM `thumbnails` t
+JOIN `sizes` s ON s.thumbnail_id = t.id
+WHERE t.product_id IS NOT NULL;
+
+INSERT INTO `product_variants` (`id`, `product_id`, `sku`, `price`, `stock`, `position`, `legacy_size_id`)
+SELECT s.id, t.product_id, CONCAT('P', t.product_id, '-S', s.id), COALESCE(s.price, p.price),
+       GREATEST(COALESCE(s.count, 0), 0), s.id, s.id
+FROM `sizes` s
+JOIN `thumbnails` t ON s.thumbnail_id = t.id
+JOIN `products` p ON t.product_id = p.id;
+
+INSERT INTO `product_variant_values` (`variant_id`, `option_id`, `value`, `value_ru`)
+SELECT v.id, o.id, COALESCE(t.color, ''), COALESCE(t.color_ru, '')
+FROM `product_variants` v
+JOIN `sizes` s ON v.legacy_size_id = s.id
+JOIN `thumbnails` t ON s.thumbnail_id = t.id
+JOIN `product_options` o ON o.product_id = v.product_id AND o.name = 'color';
+
+INSERT INTO `product_variant_values` (`variant_id`, `option_id`, `value`, `value_ru`)
+SELECT v.id, o.id, COALESCE(s.size, ''), COALESCE(s.size, '')
+FROM `product_variants` v
+JOIN `sizes` s ON v.legacy_size_id = s.id
+JOIN `product_options` o ON o.product_id = v.product_id AND o.name = 'size';
+
+INSERT INTO `product_variant_images` (`variant_id`, `image_url`, `position`, `legacy_thumbnail_id`)
+SELECT v.id, t.image_url, 0, t.id
+FROM `product_variants` v
+JOIN `sizes` s ON v.legacy_size_id = s.id
+JOIN `thumbnails` t ON s.thumbnail_id = t.id
+WHERE t.image_url IS NOT NULL AND t.image_url <> '';
+
+--
+-- Carts and orders reference variants
+--
+
+ALTER TABLE `carts`
+  ADD `variant_id` int(11) DEFAULT NULL AFTER `size_id`,
+  MODIFY `thumbnail_id` int(11) DEFAULT NULL,
+  MODIFY `size_id` int(11) DEFAULT NULL;
+
+UPDATE `carts` SET `variant_id` = `size_id`;
+UPDATE `carts` SET `thumbnail_id` = NULL WHERE `thumbnail_id` = 0;
+UPDATE `carts` SET `size_id` = NULL WHERE `size_id` = 0;
+DELETE FROM `carts` WHERE `variant_id` IS NULL OR `variant_id` NOT IN (SELECT `id` FROM `product_variants`);
+
+ALTER TABLE `carts`
+  ADD UNIQUE KEY `uniq_cart_user_variant` (`user_id`,`variant_id`),
+  DROP INDEX `user_id`,
+  ADD KEY `variant_id` (`variant_id`),
+  ADD CONSTRAINT `carts_ibfk_6` FOREIGN KEY (`variant_id`) REFERENCES `product_variants` (`id`) ON DELETE CASCADE;
+
+ALTER TABLE `orders`
+  ADD `variant_id` int(11) DEFAULT NULL AFTER `size_id`,
+  ADD KEY `variant_id` (`variant_id`);
+
+UPDATE `orders` o
+JOIN `product_variants` v ON v.id = o.size_id
+SET o.variant_id = v.id;
+
+ALTER TABLE `orders`
+  ADD CONSTRAINT `orders_ibfk_7` FOREIGN KEY (`variant_id`) REFERENCES `product_variants` (`id`) ON DELETE SET NULL;
@@ -0,0 +1,22 @@
+-- Bulk product imports run asynchronously; the job row carries progress, row errors and the dry-run preview
+
+CREATE TABLE `product_import_jobs` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `market_id` int(11) NOT NULL,
+  `staff_id` int(11) DEFAULT NULL,
+  `file_name` varchar(255) NOT NULL,
+  `dry_run` tinyint(1) NOT NULL DEFAULT 0,
+  `status` enum('queued','running','completed','failed') NOT NULL DEFAULT 'queued',
+  `total_rows` int(11) NOT NULL DEFAULT 0,
+  `products_created` int(11) NOT NULL DEFAULT 0,
+  `products_updated` int(11) NOT NULL DEFAULT 0,
+  `variants_created` int(11) NOT NULL DEFAULT 0,
+  `variants_updated` int(11) NOT NULL DEFAULT 0,
+  `errors` longtext DEFAULT NULL,
+  `preview` longtext DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  `finished_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_import_jobs_market` (`market_id`, `created_at`),
+  CONSTRAINT `product_import_jobs_ibfk_1` FOREIGN KEY (`market_id`) REFERENCES `markets` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
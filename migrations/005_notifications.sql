@@ -0,0 +1,35 @@
+-- Push device tokens and the in-app notification inbox.
+--
+-- Owners and recipients are identified by (type, id): 'user' is users.id, 'market' is markets.id
+-- (the market's own login) and 'market_staff' is market_staff.id. The market inbox is shared by the
+-- market login and its staff.
+
+CREATE TABLE `device_tokens` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `owner_type` enum('user','market','market_staff') NOT NULL,
+  `owner_id` int(11) NOT NULL,
+  `token` varchar(512) NOT NULL,
+  `platform` enum('android','ios','web') NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  `last_seen_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uniq_device_token` (`token`),
+  KEY `idx_device_tokens_owner` (`owner_type`, `owner_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+CREATE TABLE `notifications` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `recipient_type` enum('user','market') NOT NULL,
+  `recipient_id` int(11) NOT NULL,
+  `type` varchar(50) NOT NULL,
+  `title` varchar(255) NOT NULL,
+  `title_ru` varchar(255) NOT NULL DEFAULT '',
+  `body` text NOT NULL,
+  `body_ru` text NOT NULL,
+  `data` text DEFAULT NULL,
+  `read_at` timestamp NULL DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`id`),
+  KEY `idx_notifications_recipient` (`recipient_type`, `recipient_id`, `read_at`),
+  KEY `idx_notifications_created` (`recipient_type`, `recipient_id`, `created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
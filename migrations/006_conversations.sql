@@ -0,0 +1,80 @@
+-- Threaded conversations replacing the one-shot user_messages and market_messages.
+--
+-- 'support' conversations are opened by a user (user_id) or a market (market_id) and answered by
+-- superadmin support. 'order' conversations are between a buyer and a shop about their part of a
+-- cart order and have user_id, market_id and cart_order_id set; there is at most one per order and
+-- market. Message senders and read receipts use the party types 'user', 'market' and 'superadmin';
+-- the superadmin side of a support conversation is shared by all superadmins.
+
+CREATE TABLE `conversations` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `kind` enum('support','order') NOT NULL,
+  `user_id` int(11) DEFAULT NULL,
+  `market_id` int(11) DEFAULT NULL,
+  `cart_order_id` int(11) DEFAULT NULL,
+  `subject` varchar(255) NOT NULL DEFAULT '',
+  `contact_name` varchar(50) DEFAULT NULL,
+  `contact_phone` varchar(20) DEFAULT NULL,
+  `status` enum('open','resolved') NOT NULL DEFAULT 'open',
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  `last_message_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  `resolved_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uniq_order_conversation` (`kind`, `cart_order_id`, `user_id`, `market_id`),
+  KEY `idx_conversations_user` (`user_id`, `last_message_at`),
+  KEY `idx_conversations_market` (`market_id`, `last_message_at`),
+  KEY `idx_conversations_kind_status` (`kind`, `status`, `last_message_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+CREATE TABLE `conversation_messages` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `conversation_id` int(11) NOT NULL,
+  `sender_type` enum('user','market','superadmin') NOT NULL,
+  `sender_id` int(11) NOT NULL,
+  `body` text NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`id`),
+  KEY `idx_conversation_messages_conversation` (`conversation_id`, `id`),
+  CONSTRAINT `conversation_messages_ibfk_1` FOREIGN KEY (`conversation_id`) REFERENCES `conversations` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+CREATE TABLE `conversation_attachments` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `message_id` int(11) NOT NULL,
+  `url` varchar(255) NOT NULL,
+  `file_name` varchar(255) NOT NULL,
+  `content_type` varchar(100) NOT NULL,
+  `size` int(11) NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `message_id` (`message_id`),
+  CONSTRAINT `conversation_attachments_ibfk_1` FOREIGN KEY (`message_id`) REFERENCES `conversation_messages` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+-- Read receipts: the last message each side of a conversation has seen
+CREATE TABLE `conversation_reads` (
+  `conversation_id` int(11) NOT NULL,
+  `party_type` enum('user','market','superadmin') NOT NULL,
+  `last_read_message_id` int(11) NOT NULL,
+  `read_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`conversation_id`, `party_type`),
+  CONSTRAINT `conversation_reads_ibfk_1` FOREIGN KEY (`conversation_id`) REFERENCES `conversations` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+-- Carry the existing one-shot messages over as open support conversations
+ALTER TABLE `conversations` ADD COLUMN `legacy_message_id` int(11) DEFAULT NULL;
+
+INSERT INTO `conversations` (`kind`, `user_id`, `contact_name`, `contact_phone`, `legacy_message_id`)
+SELECT 'support', `user_id`, `full_name`, `phone`, `id` FROM `user_messages` WHERE `user_id` IS NOT NULL;
+INSERT INTO `conversation_messages` (`conversation_id`, `sender_type`, `sender_id`, `body`)
+SELECT c.`id`, 'user', m.`user_id`, COALESCE(m.`message`, '')
+FROM `user_messages` m JOIN `conversations` c ON c.`legacy_message_id` = m.`id` AND c.`user_id` = m.`user_id`;
+
+UPDATE `conversations` SET `legacy_message_id` = NULL;
+
+INSERT INTO `conversations` (`kind`, `market_id`, `contact_name`, `contact_phone`, `legacy_message_id`)
+SELECT 'support', `market_id`, `full_name`, `phone`, `id` FROM `market_messages` WHERE `market_id` IS NOT NULL;
+INSERT INTO `conversation_messages` (`conversation_id`, `sender_type`, `sender_id`, `body`)
+SELECT c.`id`, 'market', m.`market_id`, COALESCE(m.`message`, '')
+FROM `market_messages` m JOIN `conversations` c ON c.`legacy_message_id` = m.`id` AND c.`market_id` = m.`market_id`;
+
+ALTER TABLE `conversations` DROP COLUMN `legacy_message_id`;
@@ -0,0 +1,49 @@
+-- Platform reports for superadmins, served from nightly rollup tables instead of scanning orders.
+--
+-- cart_starts records every new cart (one per user, market and cart_order_id) because cart rows
+-- are deleted whenever the user deletes or clears a cart, ordered or not; it feeds the cart stage
+-- of the order funnel. The report_* tables
+-- hold one row per day and are rebuilt by the report_rollup job. An order is one user's cart order
+-- at one market; gmv is the value of its non-cancelled lines at the discounted variant price.
+
+CREATE TABLE `cart_starts` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user_id` int(11) NOT NULL,
+  `market_id` int(11) NOT NULL,
+  `cart_order_id` int(11) NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`id`),
+  KEY `idx_cart_starts_created` (`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+CREATE TABLE `report_market_daily` (
+  `day` date NOT NULL,
+  `market_id` int(11) NOT NULL,
+  `carts_started` int(11) NOT NULL DEFAULT 0,
+  `orders` int(11) NOT NULL DEFAULT 0,
+  `delivered_orders` int(11) NOT NULL DEFAULT 0,
+  `cancelled_orders` int(11) NOT NULL DEFAULT 0,
+  `items_sold` int(11) NOT NULL DEFAULT 0,
+  `gmv` decimal(14,2) NOT NULL DEFAULT 0.00,
+  PRIMARY KEY (`day`, `market_id`),
+  KEY `idx_report_market_daily_market` (`market_id`, `day`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+-- category_id 0 collects products without a category
+CREATE TABLE `report_category_daily` (
+  `day` date NOT NULL,
+  `category_id` int(11) NOT NULL,
+  `orders` int(11) NOT NULL DEFAULT 0,
+  `items_sold` int(11) NOT NULL DEFAULT 0,
+  `gmv` decimal(14,2) NOT NULL DEFAULT 0.00,
+  PRIMARY KEY (`day`, `category_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+-- One row per rolled-up day; its presence marks the day as rolled up
+CREATE TABLE `report_platform_daily` (
+  `day` date NOT NULL,
+  `new_users` int(11) NOT NULL DEFAULT 0,
+  `new_markets` int(11) NOT NULL DEFAULT 0,
+  `rolled_up_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`day`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
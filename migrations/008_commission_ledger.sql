@@ -0,0 +1,68 @@
+-- Commission rates, the double-entry ledger and payout statements.
+--
+-- A commission rate applies to a market (market_id), a category (category_id), both, or neither
+-- (the platform default); 0 stands for "any". The most specific rate wins: market and category,
+-- then market, then category, then the default.
+--
+-- Every ledger entry moves amount from its credit account to its debit account, so each entry is
+-- balanced on its own. A delivered order line posts three entries:
+--   sale        debit platform_cash,  credit market_sales        (gross line amount)
+--   commission  debit market_sales,   credit commission_revenue  (gross * rate)
+--   payout_due  debit market_sales,   credit market_payable      (gross - commission)
+-- and paying a statement posts
+--   payout      debit market_payable, credit platform_cash
+-- An entry is undone by a reversal entry (reversal_of) with the accounts swapped. market_sales and
+-- market_payable are kept per market (market_id).
+
+CREATE TABLE `commission_rates` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `market_id` int(11) NOT NULL DEFAULT 0,
+  `category_id` int(11) NOT NULL DEFAULT 0,
+  `rate` decimal(5,2) NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  `updated_at` timestamp NOT NULL DEFAULT current_timestamp() ON UPDATE current_timestamp(),
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uniq_commission_scope` (`market_id`, `category_id`),
+  CONSTRAINT `commission_rates_rate` CHECK (`rate` >= 0 AND `rate` <= 100)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+INSERT INTO `commission_rates` (`market_id`, `category_id`, `rate`) VALUES (0, 0, 0.00);
+
+CREATE TABLE `payout_statements` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `market_id` int(11) NOT NULL,
+  `period_start` date NOT NULL,
+  `period_end` date NOT NULL,
+  `gross` decimal(14,2) NOT NULL DEFAULT 0.00,
+  `commission` decimal(14,2) NOT NULL DEFAULT 0.00,
+  `net` decimal(14,2) NOT NULL DEFAULT 0.00,
+  `status` enum('pending','paid') NOT NULL DEFAULT 'pending',
+  `reference` varchar(255) DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  `paid_at` timestamp NULL DEFAULT NULL,
+  `paid_by` int(11) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uniq_payout_period` (`market_id`, `period_start`, `period_end`),
+  KEY `idx_payout_statements_status` (`status`, `created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+CREATE TABLE `ledger_entries` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `market_id` int(11) NOT NULL,
+  `order_id` int(11) DEFAULT NULL,
+  `statement_id` int(11) DEFAULT NULL,
+  `entry_type` enum('sale','commission','payout_due','payout') NOT NULL,
+  `debit_account` varchar(50) NOT NULL,
+  `credit_account` varchar(50) NOT NULL,
+  `amount` decimal(14,2) NOT NULL,
+  `commission_rate` decimal(5,2) DEFAULT NULL,
+  `reversal_of` int(11) DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uniq_ledger_reversal` (`reversal_of`),
+  KEY `idx_ledger_market` (`market_id`, `created_at`),
+  KEY `idx_ledger_order` (`order_id`),
+  KEY `idx_ledger_statement` (`statement_id`),
+  CONSTRAINT `ledger_entries_ibfk_1` FOREIGN KEY (`statement_id`) REFERENCES `payout_statements` (`id`),
+  CONSTRAINT `ledger_entries_ibfk_2` FOREIGN KEY (`reversal_of`) REFERENCES `ledger_entries` (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
@@ -0,0 +1,55 @@
+-- Return requests for delivered order lines.
+--
+-- A user opens a return for some delivered lines of one cart order at one market, optionally for
+-- part of a line's quantity. The market approves or rejects it, records receipt of the goods (which
+-- restocks the variants) and refunds it. Status: requested -> approved | rejected,
+-- approved -> received -> refunded.
+--
+-- There is no payment record to refund against, so a refund is recorded on the return (amount and
+-- reference) and reverses the returned share of the lines' ledger entries.
+
+ALTER TABLE `orders` ADD `delivered_at` timestamp NULL DEFAULT NULL;
+UPDATE `orders` SET `delivered_at` = `created_at` WHERE `status` = 'delivered';
+
+CREATE TABLE `return_requests` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user_id` int(11) NOT NULL,
+  `market_id` int(11) NOT NULL,
+  `cart_order_id` int(11) NOT NULL,
+  `reason` text NOT NULL,
+  `status` enum('requested','approved','rejected','received','refunded') NOT NULL DEFAULT 'requested',
+  `market_note` text DEFAULT NULL,
+  `refund_amount` decimal(14,2) DEFAULT NULL,
+  `refund_reference` varchar(255) DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  `decided_at` timestamp NULL DEFAULT NULL,
+  `received_at` timestamp NULL DEFAULT NULL,
+  `refunded_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_return_requests_user` (`user_id`, `created_at`),
+  KEY `idx_return_requests_market` (`market_id`, `status`, `created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+CREATE TABLE `return_request_items` (
+  `return_id` int(11) NOT NULL,
+  `order_id` int(11) NOT NULL,
+  `count` int(11) NOT NULL CHECK (`count` > 0),
+  PRIMARY KEY (`return_id`, `order_id`),
+  KEY `order_id` (`order_id`),
+  CONSTRAINT `return_request_items_ibfk_1` FOREIGN KEY (`return_id`) REFERENCES `return_requests` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+CREATE TABLE `return_request_photos` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `return_id` int(11) NOT NULL,
+  `url` varchar(255) NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `return_id` (`return_id`),
+  CONSTRAINT `return_request_photos_ibfk_1` FOREIGN KEY (`return_id`) REFERENCES `return_requests` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+-- Refunds reverse part of a ledger entry, so an entry may now have several reversals
+ALTER TABLE `ledger_entries`
+  DROP INDEX `uniq_ledger_reversal`,
+  ADD KEY `idx_ledger_reversal` (`reversal_of`),
+  ADD `return_id` int(11) DEFAULT NULL AFTER `statement_id`;
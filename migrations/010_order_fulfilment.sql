@@ -0,0 +1,29 @@
+-- Per-line fulfilment of orders.
+--
+-- The lines of a cart order at a market are now fulfilled one by one: a market may cancel a line or
+-- mark it out of stock while fulfilling the rest, and may ship the lines in several shipments.
+-- Line status: pending -> shipped -> delivered, or pending | shipped -> canceled | out_of_stock.
+-- Delivered, canceled and out_of_stock lines are final; returns handle delivered lines.
+
+ALTER TABLE `orders`
+  MODIFY `status` enum('pending','processing','shipped','delivered','canceled','cancelled','out_of_stock') DEFAULT 'pending',
+  ADD `status_note` varchar(255) DEFAULT NULL AFTER `status`,
+  ADD `shipment_id` int(11) DEFAULT NULL AFTER `status_note`,
+  ADD KEY `idx_orders_shipment` (`shipment_id`);
+
+CREATE TABLE `order_shipments` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `market_id` int(11) NOT NULL,
+  `user_id` int(11) NOT NULL,
+  `cart_order_id` int(11) NOT NULL,
+  `carrier` varchar(100) DEFAULT NULL,
+  `tracking_number` varchar(100) DEFAULT NULL,
+  `status` enum('shipped','delivered') NOT NULL DEFAULT 'shipped',
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  `delivered_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_order_shipments_order` (`market_id`, `user_id`, `cart_order_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+ALTER TABLE `orders`
+  ADD CONSTRAINT `orders_ibfk_8` FOREIGN KEY (`shipment_id`) REFERENCES `order_shipments` (`id`) ON DELETE SET NULL;
@@ -0,0 +1,121 @@
+-- Orders become a header row per user, market and cart order, with their lines in order_items.
+--
+-- Until now every line was an `orders` row repeating the customer's name, phone, notes and location,
+-- and an order was only identified by (user_id, market_id, cart_order_id). The old table becomes
+-- order_items; it keeps market_id and created_at so that the sales queries can filter lines without
+-- joining the header. Line statuses stay on the items and the order status is derived from them.
+-- Tables that referenced order lines by `order_id` now call the column `item_id`, and the tables
+-- that identified an order by (user_id, market_id, cart_order_id) reference the header instead.
+
+RENAME TABLE `orders` TO `order_items`;
+
+CREATE TABLE `orders` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `order_number` varchar(32) DEFAULT NULL,
+  `user_id` int(11) NOT NULL,
+  `market_id` int(11) DEFAULT NULL,
+  `cart_order_id` int(11) NOT NULL,
+  `location_id` int(11) DEFAULT NULL,
+  `name` varchar(255) NOT NULL,
+  `phone` varchar(20) NOT NULL,
+  `notes` text DEFAULT NULL,
+  `is_active` tinyint(1) NOT NULL DEFAULT 1,
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uniq_order_number` (`order_number`),
+  UNIQUE KEY `uniq_order_cart` (`user_id`, `market_id`, `cart_order_id`),
+  KEY `idx_orders_market` (`market_id`, `created_at`),
+  KEY `location_id` (`location_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+-- Grouping by the columns of uniq_order_cart gives one header per key, so old rows cannot collide.
+-- Lines of separate checkouts that reused a cart_order_id, after the ordered cart was deleted, end
+-- up under one header, which keeps the earliest date.
+INSERT INTO `orders` (`user_id`, `market_id`, `cart_order_id`, `location_id`, `name`, `phone`, `notes`, `is_active`, `created_at`)
+SELECT `user_id`, `market_id`, `cart_order_id`, MIN(`location_id`), MIN(`name`), MIN(`phone`), MIN(`notes`),
+  MAX(`is_active`), MIN(`created_at`)
+FROM `order_items`
+GROUP BY `user_id`, `market_id`, `cart_order_id`;
+
+UPDATE `orders` SET `order_number` = LPAD(`id`, 8, '0');
+
+-- Constraint names are unique per database, so the items' constraints are renamed before the
+-- header takes the orders_ibfk names
+ALTER TABLE `order_items`
+  DROP FOREIGN KEY `orders_ibfk_1`,
+  DROP FOREIGN KEY `orders_ibfk_2`,
+  DROP FOREIGN KEY `orders_ibfk_3`,
+  DROP FOREIGN KEY `orders_ibfk_4`,
+  DROP FOREIGN KEY `orders_ibfk_5`,
+  DROP FOREIGN KEY `orders_ibfk_6`,
+  DROP FOREIGN KEY `orders_ibfk_7`,
+  DROP FOREIGN KEY `orders_ibfk_8`;
+
+ALTER TABLE `order_items` ADD `order_id` int(11) DEFAULT NULL AFTER `id`;
+
+UPDATE `order_items` i
+JOIN `orders` o ON o.user_id = i.user_id AND o.market_id <=> i.market_id AND o.cart_order_id = i.cart_order_id
+SET i.order_id = o.id;
+
+-- Returns and shipments reference the header
+ALTER TABLE `return_requests` ADD `order_id` int(11) DEFAULT NULL AFTER `market_id`;
+UPDATE `return_requests` r
+JOIN `orders` o ON o.user_id = r.user_id AND o.market_id = r.market_id AND o.cart_order_id = r.cart_order_id
+SET r.order_id = o.id;
+ALTER TABLE `return_requests`
+  MODIFY `order_id` int(11) NOT NULL,
+  DROP `cart_order_id`,
+  ADD KEY `order_id` (`order_id`);
+
+ALTER TABLE `order_shipments` ADD `order_id` int(11) DEFAULT NULL AFTER `id`;
+UPDATE `order_shipments` s
+JOIN `orders` o ON o.user_id = s.user_id AND o.market_id = s.market_id AND o.cart_order_id = s.cart_order_id
+SET s.order_id = o.id;
+ALTER TABLE `order_shipments`
+  MODIFY `order_id` int(11) NOT NULL,
+  DROP INDEX `idx_order_shipments_order`,
+  DROP `user_id`,
+  DROP `cart_order_id`,
+  ADD KEY `idx_order_shipments_order` (`market_id`, `order_id`);
+
+ALTER TABLE `order_items`
+  MODIFY `order_id` int(11) NOT NULL,
+  DROP INDEX `user_id`,
+  DROP INDEX `orders_ibfk_3`,
+  DROP INDEX `orders_ibfk_2`,
+  DROP `user_id`,
+  DROP `cart_order_id`,
+  DROP `location_id`,
+  DROP `name`,
+  DROP `phone`,
+  DROP `notes`,
+  DROP `is_active`,
+  ADD KEY `order_id` (`order_id`),
+  ADD CONSTRAINT `order_items_ibfk_1` FOREIGN KEY (`order_id`) REFERENCES `orders` (`id`) ON DELETE CASCADE,
+  ADD CONSTRAINT `order_items_ibfk_2` FOREIGN KEY (`market_id`) REFERENCES `markets` (`id`) ON DELETE SET NULL,
+  ADD CONSTRAINT `order_items_ibfk_3` FOREIGN KEY (`product_id`) REFERENCES `products` (`id`) ON DELETE SET NULL,
+  ADD CONSTRAINT `order_items_ibfk_4` FOREIGN KEY (`thumbnail_id`) REFERENCES `thumbnails` (`id`) ON DELETE SET NULL,
+  ADD CONSTRAINT `order_items_ibfk_5` FOREIGN KEY (`size_id`) REFERENCES `sizes` (`id`) ON DELETE SET NULL,
+  ADD CONSTRAINT `order_items_ibfk_6` FOREIGN KEY (`variant_id`) REFERENCES `product_variants` (`id`) ON DELETE SET NULL,
+  ADD CONSTRAINT `order_items_ibfk_7` FOREIGN KEY (`shipment_id`) REFERENCES `order_shipments` (`id`) ON DELETE SET NULL;
+
+ALTER TABLE `orders`
+  ADD CONSTRAINT `orders_ibfk_1` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE,
+  ADD CONSTRAINT `orders_ibfk_2` FOREIGN KEY (`location_id`) REFERENCES `locations` (`id`) ON DELETE SET NULL,
+  ADD CONSTRAINT `orders_ibfk_3` FOREIGN KEY (`market_id`) REFERENCES `markets` (`id`) ON DELETE SET NULL;
+
+ALTER TABLE `order_shipments`
+  ADD CONSTRAINT `order_shipments_ibfk_1` FOREIGN KEY (`order_id`) REFERENCES `orders` (`id`) ON DELETE CASCADE;
+
+-- Order lines are items now
+ALTER TABLE `return_request_items`
+  DROP PRIMARY KEY,
+  DROP INDEX `order_id`,
+  CHANGE `order_id` `item_id` int(11) NOT NULL,
+  ADD PRIMARY KEY (`return_id`, `item_id`),
+  ADD KEY `item_id` (`item_id`);
+
+ALTER TABLE `ledger_entries`
+  DROP INDEX `idx_ledger_order`,
+  CHANGE `order_id` `item_id` int(11) DEFAULT NULL,
+  ADD KEY `idx_ledger_item` (`item_id`);
@@ -0,0 +1,35 @@
+-- Readable order numbers: <market prefix>-<year>-<sequence>, e.g. MARKET-2026-000123.
+--
+-- Every market has an order prefix, M<id> until the market picks its own. Sequences are kept per
+-- prefix and year rather than per market, so a prefix given up by one market and taken by another
+-- continues where it left off and numbers never repeat.
+
+ALTER TABLE `markets`
+  ADD `order_prefix` varchar(10) DEFAULT NULL AFTER `name_ru`,
+  ADD UNIQUE KEY `uniq_market_order_prefix` (`order_prefix`);
+
+UPDATE `markets` SET `order_prefix` = CONCAT('M', `id`);
+
+CREATE TABLE `order_number_sequences` (
+  `prefix` varchar(10) NOT NULL,
+  `year` smallint(6) NOT NULL,
+  `last_value` int(11) NOT NULL DEFAULT 0,
+  PRIMARY KEY (`prefix`, `year`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+-- Renumber the existing orders of each market and year in the order they were placed. Orders of
+-- deleted markets keep their numeric number.
+UPDATE `orders` o
+JOIN (
+  SELECT `id`, ROW_NUMBER() OVER (PARTITION BY `market_id`, YEAR(`created_at`) ORDER BY `id`) AS `seq`
+  FROM `orders`
+  WHERE `market_id` IS NOT NULL
+) t ON t.id = o.id
+JOIN `markets` m ON m.id = o.market_id
+SET o.order_number = CONCAT(m.order_prefix, '-', YEAR(o.created_at), '-', LPAD(t.seq, 6, '0'));
+
+INSERT INTO `order_number_sequences` (`prefix`, `year`, `last_value`)
+SELECT m.order_prefix, YEAR(o.created_at), COUNT(*)
+FROM `orders` o
+JOIN `markets` m ON m.id = o.market_id
+GROUP BY m.order_prefix, YEAR(o.created_at);
@@ -0,0 +1,17 @@
+-- Phone number changes are confirmed with a code sent to the new number.
+--
+-- verification_codes held one login/registration code per phone. Codes now have a purpose, and
+-- phone change codes belong to the user who asked for them, so a login code and several users'
+-- pending changes to the same number do not overwrite each other. Login codes keep user_id 0.
+-- Wrong guesses are counted so that a 4-digit code cannot be brute-forced with a stolen token.
+--
+-- expires_at lost its ON UPDATE clause: counting an attempt must not extend the code.
+
+ALTER TABLE `verification_codes`
+  MODIFY `expires_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  ADD `purpose` varchar(20) NOT NULL DEFAULT 'login' AFTER `phone`,
+  ADD `user_id` int(11) NOT NULL DEFAULT 0 AFTER `purpose`,
+  ADD `attempts` int(11) NOT NULL DEFAULT 0 AFTER `expires_at`,
+  DROP INDEX `phone`,
+  ADD UNIQUE KEY `phone` (`phone`, `purpose`, `user_id`),
+  ADD KEY `idx_verification_codes_user` (`user_id`, `purpose`);
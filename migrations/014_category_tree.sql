@@ -0,0 +1,33 @@
+-- Categories form a tree: parent_id points at the parent category, NULL for top-level ones.
+--
+-- sort_order orders siblings, is_active hides a category (and its subtree) from the public tree,
+-- slug is a URL-friendly unique name and icon_url a small image next to the thumbnail. Existing
+-- categories stay top-level; their slugs are derived from the name and id.
+--
+-- market_categories lists the categories a market may sell in; a market without rows is not
+-- restricted. An assigned category allows its whole subtree.
+
+ALTER TABLE `categories`
+  ADD `parent_id` int(11) DEFAULT NULL AFTER `id`,
+  ADD `slug` varchar(120) DEFAULT NULL AFTER `name_ru`,
+  ADD `icon_url` varchar(255) DEFAULT NULL AFTER `thumbnail_url`,
+  ADD `sort_order` int(11) NOT NULL DEFAULT 0,
+  ADD `is_active` tinyint(1) NOT NULL DEFAULT 1,
+  ADD KEY `idx_categories_parent` (`parent_id`, `sort_order`),
+  ADD CONSTRAINT `fk_categories_parent` FOREIGN KEY (`parent_id`) REFERENCES `categories` (`id`);
+
+UPDATE `categories`
+SET `slug` = CONCAT(TRIM(BOTH '-' FROM LOWER(REGEXP_REPLACE(`name`, '[^A-Za-z0-9]+', '-'))), '-', `id`);
+
+ALTER TABLE `categories`
+  MODIFY `slug` varchar(120) NOT NULL,
+  ADD UNIQUE KEY `uniq_category_slug` (`slug`);
+
+CREATE TABLE `market_categories` (
+  `market_id` int(11) NOT NULL,
+  `category_id` int(11) NOT NULL,
+  PRIMARY KEY (`market_id`, `category_id`),
+  KEY `category_id` (`category_id`),
+  CONSTRAINT `market_categories_ibfk_1` FOREIGN KEY (`market_id`) REFERENCES `markets` (`id`) ON DELETE CASCADE,
+  CONSTRAINT `market_categories_ibfk_2` FOREIGN KEY (`category_id`) REFERENCES `categories` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
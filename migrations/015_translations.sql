@@ -0,0 +1,16 @@
+-- Texts of products, categories, markets, thumbnails and product options in any language.
+--
+-- The plain columns (products.name, markets.location, ...) keep the base language, English, and
+-- the *_ru columns keep Russian for existing clients. Every other language is a row here, so adding
+-- one needs no schema change. entity_type is the table name and field the plain column name.
+
+CREATE TABLE `translations` (
+  `entity_type` varchar(40) NOT NULL,
+  `entity_id` int(11) NOT NULL,
+  `field` varchar(40) NOT NULL,
+  `locale` varchar(16) NOT NULL,
+  `value` text NOT NULL,
+  `updated_at` timestamp NOT NULL DEFAULT current_timestamp() ON UPDATE current_timestamp(),
+  PRIMARY KEY (`entity_type`, `entity_id`, `field`, `locale`),
+  KEY `idx_translations_locale` (`locale`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
@@ -0,0 +1,7 @@
+-- A variant may be in several carts of a user: the open cart and carts that were already ordered,
+-- whose rows stay until the user deletes or clears them. The unique key on carts now includes the
+-- cart order, so adding an ordered variant again starts a row in the open cart.
+
+ALTER TABLE `carts`
+  ADD UNIQUE KEY `uniq_cart_user_order_variant` (`user_id`,`cart_order_id`,`variant_id`),
+  DROP INDEX `uniq_cart_user_variant`;
@@ -0,0 +1,16 @@
+-- Order items keep the variant price and product discount they were ordered at.
+--
+-- Sales amounts in the ledger, analytics, reports, refunds and order documents were computed from
+-- the current variant price and product discount, so editing a product changed the amounts of
+-- orders that were already placed. Existing items take today's prices, which is what they were
+-- valued at until now; items whose variant is gone fall back to the product price.
+
+ALTER TABLE `order_items`
+  ADD `unit_price` decimal(10,2) NOT NULL DEFAULT 0.00 AFTER `count`,
+  ADD `discount` decimal(5,2) NOT NULL DEFAULT 0.00 AFTER `unit_price`;
+
+UPDATE `order_items` o
+LEFT JOIN `product_variants` v ON v.id = o.variant_id
+LEFT JOIN `products` p ON p.id = o.product_id
+SET o.unit_price = COALESCE(v.price, p.price, 0),
+  o.discount = COALESCE(p.discount, 0);
@@ -1,15 +1,18 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 )
 
 type Claims struct {
-	UserID   int    `json:"user_id"`
-	MarketID int    `json:"market_id,omitempty"` // For market admins
-	Role     string `json:"role"`                // superadmin, market_admin, user
+	UserID    int    `json:"user_id"`
+	MarketID  int    `json:"market_id,omitempty"`  // For market admins
+	Role      string `json:"role"`                 // superadmin, market_admin, user
+	StaffID   int    `json:"staff_id,omitempty"`   // For market staff; 0 for the market owner login
+	StaffRole string `json:"staff_role,omitempty"` // owner, catalog_manager, order_handler, viewer
 	jwt.StandardClaims
 }
 
@@ -49,25 +52,103 @@ type VerificationCode struct {
 }
 
 type Product struct {
-	ID             int         `json:"id"`
-	MarketID       int         `json:"market_id"`
-	MarketName     string      `json:"market_name"`
-	MarketNameRu   string      `json:"market_name_ru"`
-	CategoryID     int         `json:"category_id"`
-	CategoryName   string      `json:"category_name"`
-	CategoryNameRu string      `json:"category_name_ru"`
-	ThumbnailURL   string      `json:"thumbnail_url"`
-	Name           string      `json:"name"`
-	NameRu         string      `json:"name_ru"`
-	Price          float64     `json:"price"`
-	Discount       float64     `json:"discount"`
-	Description    string      `json:"description"`
-	DescriptionRu  string      `json:"description_ru"`
-	IsNew          bool        `json:"is_new"`
-	FinalPrice     float64     `json:"final_price"`
-	CreatedAt      string      `json:"created_at"`
-	IsFavorite     bool        `json:"is_favorite"`
-	Thumbnails     []Thumbnail `json:"thumbnails"`
+	ID             int              `json:"id"`
+	MarketID       int              `json:"market_id"`
+	MarketName     string           `json:"market_name"`
+	MarketNameRu   string           `json:"market_name_ru"`
+	CategoryID     int              `json:"category_id"`
+	CategoryName   string           `json:"category_name"`
+	CategoryNameRu string           `json:"category_name_ru"`
+	ThumbnailURL   string           `json:"thumbnail_url"`
+	Name           string           `json:"name"`
+	NameRu         string           `json:"name_ru"`
+	Price          float64          `json:"price"`
+	Discount       float64          `json:"discount"`
+	Description    string           `json:"description"`
+	DescriptionRu  string           `json:"description_ru"`
+	IsNew          bool             `json:"is_new"`
+	FinalPrice     float64          `json:"final_price"`
+	CreatedAt      string           `json:"created_at"`
+	IsFavorite     bool             `json:"is_favorite"`
+	Thumbnails     []Thumbnail      `json:"thumbnails"` // Legacy color/size view; superseded by Options and Variants
+	Options        []ProductOption  `json:"options,omitempty"`
+	Variants       []ProductVariant `json:"variants,omitempty"`
+	Breadcrumbs    []CategoryCrumb  `json:"breadcrumbs,omitempty"` // From the top-level category down to CategoryID
+}
+
+// ProductOption is an attribute axis of a product, e.g. color, size, material or volume
+type ProductOption struct {
+	ID        int    `json:"id"`
+	ProductID int    `json:"product_id"`
+	Name      string `json:"name"`
+	NameRu    string `json:"name_ru"`
+	Position  int    `json:"position"`
+}
+
+// VariantAttribute is the value a variant takes on one product option
+type VariantAttribute struct {
+	OptionID int    `json:"option_id"`
+	Name     string `json:"name"`
+	NameRu   string `json:"name_ru"`
+	Value    string `json:"value"`
+	ValueRu  string `json:"value_ru"`
+}
+
+// VariantImage is an image of a product variant
+type VariantImage struct {
+	ID        int    `json:"id"`
+	VariantID int    `json:"variant_id"`
+	ImageURL  string `json:"image_url"`
+	Position  int    `json:"position"`
+}
+
+// ProductVariant is a purchasable combination of option values. Its price, not the
+// product's, is what the customer is charged; the product discount applies on top.
+type ProductVariant struct {
+	ID             int                `json:"id"`
+	ProductID      int                `json:"product_id"`
+	SKU            string             `json:"sku"`
+	Barcode        string             `json:"barcode"`
+	Price          float64            `json:"price"`
+	CompareAtPrice *float64           `json:"compare_at_price"`
+	FinalPrice     float64            `json:"final_price"`
+	Stock          int                `json:"stock"`
+	IsActive       bool               `json:"is_active"`
+	Position       int                `json:"position"`
+	Attributes     []VariantAttribute `json:"attributes"`
+	Images         []VariantImage     `json:"images"`
+}
+
+// VariantAttributeInput sets a variant's value for an option, creating the option if needed
+type VariantAttributeInput struct {
+	Name    string `json:"name" validate:"required,max=50"`
+	NameRu  string `json:"name_ru" validate:"max=50"`
+	Value   string `json:"value" validate:"required,max=100"`
+	ValueRu string `json:"value_ru" validate:"max=100"`
+}
+
+// CreateVariantRequest for creating a product variant
+type CreateVariantRequest struct {
+	SKU            string                  `json:"sku" validate:"max=64"`
+	Barcode        string                  `json:"barcode" validate:"max=64"`
+	Price          *float64                `json:"price" validate:"omitempty,min=0,max=99999999"` // Defaults to the product price
+	CompareAtPrice *float64                `json:"compare_at_price" validate:"omitempty,min=0,max=99999999"`
+	Stock          int                     `json:"stock" validate:"min=0"`
+	IsActive       *bool                   `json:"is_active"`
+	Position       int                     `json:"position" validate:"min=0"`
+	Attributes     []VariantAttributeInput `json:"attributes" validate:"required"`
+}
+
+// UpdateVariantRequest for updating a product variant; nil fields are left unchanged
+type UpdateVariantRequest struct {
+	SKU            *string                 `json:"sku" validate:"min=1,max=64"`
+	Barcode        *string                 `json:"barcode" validate:"max=64"`
+	Price          *float64                `json:"price" validate:"min=0,max=99999999"`
+	CompareAtPrice *float64                `json:"compare_at_price" validate:"min=0,max=99999999"`
+	Stock          *int                    `json:"stock" validate:"min=0"`
+	IsActive       *bool                   `json:"is_active"`
+	Position       *int                    `json:"position" validate:"min=0"`
+	Attributes     []VariantAttributeInput `json:"attributes"` // Replaces the given option values
 }
 
 type Thumbnail struct {
@@ -100,17 +181,86 @@ type AuthClaims struct {
 
 // SuperadminRegisterRequest for superadmin registration
 type SuperadminRegisterRequest struct {
-	Username string `json:"username"`
-	FullName string `json:"full_name"`
-	Phone    string `json:"phone"`
-	Password string `json:"password"`
+	Username string `json:"username" validate:"required,max=50"`
+	FullName string `json:"full_name" validate:"required,max=255"`
+	Phone    string `json:"phone" validate:"required,max=20"`
+	Password string `json:"password" validate:"required"`
 }
 
+// Category is a node of the category tree; ParentID is nil for top-level categories
 type Category struct {
-	ID           int    `json:"id"`
-	Name         string `json:"name"`
-	NameRu       string `json:"name_ru"`
-	ThumbnailURL string `json:"thumbnail_url"`
+	ID           int        `json:"id"`
+	ParentID     *int       `json:"parent_id"`
+	Name         string     `json:"name"`
+	NameRu       string     `json:"name_ru"`
+	Slug         string     `json:"slug"`
+	ThumbnailURL string     `json:"thumbnail_url"`
+	IconURL      string     `json:"icon_url"`
+	SortOrder    int        `json:"sort_order"`
+	IsActive     bool       `json:"is_active"`
+	Children     []Category `json:"children,omitempty"` // Only filled in the category tree
+}
+
+// CategoryCrumb is a step of the path from a top-level category down to a product's category
+type CategoryCrumb struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	NameRu string `json:"name_ru"`
+	Slug   string `json:"slug"`
+}
+
+// CategoryInput holds the category fields set on creation or update; nil fields are left unchanged
+// on update. ParentID 0 makes the category top-level.
+type CategoryInput struct {
+	ParentID  *int    `json:"parent_id" form:"parent_id" validate:"min=0"`
+	Name      *string `json:"name" form:"name" validate:"max=100"`
+	NameRu    *string `json:"name_ru" form:"name_ru" validate:"max=100"`
+	Slug      *string `json:"slug" form:"slug" validate:"max=120"`
+	IconURL   *string `json:"icon_url" form:"icon_url" validate:"max=255"`
+	SortOrder *int    `json:"sort_order" form:"sort_order"`
+	IsActive  *bool   `json:"is_active" form:"is_active"`
+}
+
+// SetMarketCategoriesRequest replaces the categories a market may sell in; an empty list lifts the
+// restriction
+type SetMarketCategoriesRequest struct {
+	CategoryIDs []int `json:"category_ids"`
+}
+
+// ErrorResponse is the body of error responses. Error keeps the English text older clients read;
+// Message is the same error in the request's language.
+type ErrorResponse struct {
+	Error   string                 `json:"error"`
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Field   string                 `json:"field,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+	Fields  []FieldError           `json:"fields,omitempty"` // Every broken rule of a VALIDATION_FAILED error
+	// RequestID identifies the request in the server log, for support requests
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// FieldError is a request field that breaks a validation rule. Code names the rule, e.g. REQUIRED or
+// MAX_LENGTH, and Param is the rule's limit or options.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Param   string `json:"param,omitempty"`
+}
+
+// EntityTranslations are the texts of a product, category, market, thumbnail or product option by
+// field and locale. The en texts are the plain fields and the ru texts the *_ru fields.
+type EntityTranslations struct {
+	EntityType   string                       `json:"entity_type"`
+	EntityID     int                          `json:"entity_id"`
+	Translations map[string]map[string]string `json:"translations"` // field -> locale -> text
+}
+
+// SetTranslationsRequest sets texts by field and locale, e.g. {"name": {"tk": "...", "ru": "..."}}.
+// An empty text removes a translation; en texts cannot be removed from required fields.
+type SetTranslationsRequest struct {
+	Translations map[string]map[string]string `json:"translations" validate:"required"`
 }
 
 // CartMarket represents a market in a user's cart
@@ -126,6 +276,8 @@ type CartMarket struct {
 
 // CartProduct represents a product in a cart
 type CartProduct struct {
+	VariantID    int     `json:"variant_id"`
+	SKU          string  `json:"sku"`
 	SizeID       int     `json:"size_id"`
 	ProductID    int     `json:"product_id"`
 	ThumbnailURL string  `json:"thumbnail_url"`
@@ -139,6 +291,9 @@ type CartProduct struct {
 	SizePrice    float64 `json:"size_price"`
 	Sum          float64 `json:"sum"`
 	Count        int     `json:"count"`
+	Stock        int     `json:"stock"`
+
+	Attributes []VariantAttribute `json:"attributes"`
 }
 
 // CartProductReq represents a product to add to the cart
@@ -174,6 +329,7 @@ type Order struct {
 
 type MarketAdminOrder struct {
 	ID                int     `json:"id"`
+	OrderNumber       string  `json:"order_number"`
 	UserID            int     `json:"user_id"`
 	CartOrderID       int     `json:"cart_order_id"`
 	LocationAddress   string  `json:"location_address"`
@@ -186,6 +342,8 @@ type MarketAdminOrder struct {
 
 // MarketAdminOrderDetail represents a detailed order view for market admins
 type MarketAdminOrderDetail struct {
+	OrderID           int                       `json:"id"`
+	OrderNumber       string                    `json:"order_number"`
 	ID                int                       `json:"user_id"`
 	CartOrderID       int                       `json:"cart_order_id"`
 	MarketID          int                       `json:"market_id"`
@@ -197,11 +355,14 @@ type MarketAdminOrderDetail struct {
 	CreatedAt         string                    `json:"created_at"`
 	Sum               float64                   `json:"sum"`
 	Products          []MarketAdminOrderProduct `json:"products"`
+	Shipments         []OrderShipment           `json:"shipments"`
 }
 
 // MarketAdminOrderProduct represents a product in an order for market admins
 type MarketAdminOrderProduct struct {
 	ID        int     `json:"id"`
+	VariantID int     `json:"variant_id"`
+	SKU       string  `json:"sku"`
 	Name      string  `json:"name"`
 	NameRu    string  `json:"name_ru"`
 	Price     float64 `json:"price"`
@@ -212,26 +373,36 @@ type MarketAdminOrderProduct struct {
 	SizePrice float64 `json:"size_price"`
 	Count     int64   `json:"count"`
 	Sum       float64 `json:"sum"`
+	// ItemID identifies the order item for per-item status changes and shipments
+	ItemID     int    `json:"item_id"`
+	Status     string `json:"status"`
+	StatusNote string `json:"status_note,omitempty"`
+	ShipmentID *int   `json:"shipment_id,omitempty"`
+
+	Attributes []VariantAttribute `json:"attributes"`
 }
 
+// CartRequest adds a variant to the cart. Legacy clients may send thumbnail_id and
+// size_id instead of variant_id.
 type CartRequest struct {
-	ProductID   int `json:"product_id"`
-	ThumbnailID int `json:"thumbnail_id"`
-	SizeID      int `json:"size_id"`
-	Count       int `json:"count"`
+	ProductID   int `json:"product_id" validate:"required,min=1"`
+	VariantID   int `json:"variant_id" validate:"min=0"`
+	ThumbnailID int `json:"thumbnail_id" validate:"min=0"`
+	SizeID      int `json:"size_id" validate:"min=0"`
+	Count       int `json:"count" validate:"required,min=1"`
 }
 
 // UpdateCartRequest for updating cart entry count
 type UpdateCartRequest struct {
-	CountChange int `json:"count_change"`
+	CountChange int `json:"count_change" validate:"required"`
 }
 
 // UpdateLocationRequest for updating a location entry
 type UpdateLocationRequest struct {
-	LocationName      string `json:"location_name,omitempty"`
-	LocationNameRu    string `json:"location_name_ru,omitempty"`
-	LocationAddress   string `json:"location_address,omitempty"`
-	LocationAddressRu string `json:"location_address_ru,omitempty"`
+	LocationName      string `json:"location_name,omitempty" validate:"max=255"`
+	LocationNameRu    string `json:"location_name_ru,omitempty" validate:"max=255"`
+	LocationAddress   string `json:"location_address,omitempty" validate:"max=255"`
+	LocationAddressRu string `json:"location_address_ru,omitempty" validate:"max=255"`
 }
 
 type UserProfile struct {
@@ -240,11 +411,24 @@ type UserProfile struct {
 	Phone    string `json:"phone"`
 }
 
+// UpdateProfileRequest changes the user's name. Phone is rejected: phone changes are confirmed with
+// a code sent to the new number, see RequestPhoneChangeRequest.
 type UpdateProfileRequest struct {
-	FullName string `json:"full_name,omitempty"`
+	FullName string `json:"full_name,omitempty" validate:"max=255"`
 	Phone    string `json:"phone,omitempty"`
 }
 
+// RequestPhoneChangeRequest asks for a verification code to be sent to a new phone number
+type RequestPhoneChangeRequest struct {
+	Phone string `json:"phone" validate:"required,phone"`
+}
+
+// ConfirmPhoneChangeRequest completes a phone change with the code sent to the new number
+type ConfirmPhoneChangeRequest struct {
+	Phone string `json:"phone" validate:"required,phone"`
+	Code  string `json:"code" validate:"required,len=4,numeric"`
+}
+
 type MarketProfile struct {
 	ID            int     `json:"id"`
 	Phone         string  `json:"phone"`
@@ -254,14 +438,17 @@ type MarketProfile struct {
 	Location      string  `json:"location"`
 	LocationRu    string  `json:"location_ru"`
 	ThumbnailURL  string  `json:"thumbnail_url"`
+	// OrderPrefix starts the market's order numbers, e.g. MARKET in MARKET-2026-000123
+	OrderPrefix string `json:"order_prefix"`
 }
 
 type UpdateMarketProfileRequest struct {
-	DeliveryPrice float64 `json:"delivery_price,omitempty"`
-	Name          string  `json:"name,omitempty"`
-	NameRu        string  `json:"name_ru,omitempty"`
-	Location      string  `json:"location,omitempty"`
-	LocationRu    string  `json:"location_ru,omitempty"`
+	DeliveryPrice float64 `json:"delivery_price,omitempty" form:"delivery_price" validate:"min=0,max=99999999"`
+	Name          string  `json:"name,omitempty" form:"name" validate:"max=255"`
+	NameRu        string  `json:"name_ru,omitempty" form:"name_ru" validate:"max=255"`
+	Location      string  `json:"location,omitempty" form:"location" validate:"max=255"`
+	LocationRu    string  `json:"location_ru,omitempty" form:"location_ru" validate:"max=255"`
+	OrderPrefix   string  `json:"order_prefix,omitempty" form:"order_prefix"`
 }
 
 type Banner struct {
@@ -272,11 +459,47 @@ type Banner struct {
 
 // CreateBannerRequest for creating a new banner
 type CreateBannerRequest struct {
-	Description string `json:"description,omitempty"`
+	Description string `json:"description,omitempty" form:"description" validate:"max=255"`
 }
 
 type UpdateOrderStatusRequest struct {
-	Status string `json:"status"`
+	Status string `json:"status" validate:"required,oneof=canceled delivered"`
+}
+
+// Order item statuses. Delivered, canceled and out_of_stock items are final; legacy items may also
+// be "cancelled".
+const (
+	OrderItemStatusPending    = "pending"
+	OrderItemStatusShipped    = "shipped"
+	OrderItemStatusDelivered  = "delivered"
+	OrderItemStatusCanceled   = "canceled"
+	OrderItemStatusOutOfStock = "out_of_stock"
+)
+
+// UpdateOrderItemStatusRequest closes a single order item: delivered, canceled or out_of_stock,
+// with an optional note shown to the customer
+type UpdateOrderItemStatusRequest struct {
+	Status string `json:"status" validate:"required,oneof=delivered canceled out_of_stock"`
+	Note   string `json:"note,omitempty" validate:"max=255"`
+}
+
+// CreateShipmentRequest ships open items of one order together
+type CreateShipmentRequest struct {
+	ItemIDs        []int  `json:"item_ids" validate:"required"`
+	Carrier        string `json:"carrier,omitempty" validate:"max=100"`
+	TrackingNumber string `json:"tracking_number,omitempty" validate:"max=100"`
+}
+
+// OrderShipment is a set of order items a market shipped together
+type OrderShipment struct {
+	ID             int     `json:"id"`
+	OrderID        int     `json:"order_id"`
+	Carrier        string  `json:"carrier"`
+	TrackingNumber string  `json:"tracking_number"`
+	Status         string  `json:"status"`
+	CreatedAt      string  `json:"created_at"`
+	DeliveredAt    *string `json:"delivered_at"`
+	ItemIDs        []int   `json:"item_ids"`
 }
 
 type OrderUpdate struct {
@@ -286,6 +509,8 @@ type OrderUpdate struct {
 }
 
 type ProductsUserOrder struct {
+	VariantID     int    `json:"variant_id"`
+	SKU           string `json:"sku"`
 	ProductName   string `json:"product_name"`
 	ProductNameRu string `json:"product_name_ru"`
 	Size          string `json:"size"`
@@ -293,9 +518,22 @@ type ProductsUserOrder struct {
 	ColorRu       string `json:"color_ru"`
 	ImageURL      string `json:"image_url"`
 	CreatedAt     string `json:"created_at"`
+	ItemID        int    `json:"item_id"`
+	Count         int    `json:"count"`
+	Status        string `json:"status"`
+	StatusNote    string `json:"status_note,omitempty"`
+	// TrackingNumber is set once the item has been shipped
+	TrackingNumber string `json:"tracking_number,omitempty"`
+	// ReturnID and ReturnStatus describe the item's latest return request, if any
+	ReturnID     *int   `json:"return_id,omitempty"`
+	ReturnStatus string `json:"return_status,omitempty"`
+
+	Attributes []VariantAttribute `json:"attributes"`
 }
 
 type UserOrder struct {
+	ID           int                 `json:"id"`
+	OrderNumber  string              `json:"order_number"`
 	CartOrderID  int                 `json:"cart_order_id"`
 	MarketName   string              `json:"market_name"`
 	MarketNameRu string              `json:"market_name_ru"`
@@ -304,11 +542,26 @@ type UserOrder struct {
 	Products     []ProductsUserOrder `json:"products"`
 }
 
+// Printable order documents: invoices and packing slips for the market, receipts for the customer
+const (
+	OrderDocumentInvoice     = "invoice"
+	OrderDocumentPackingSlip = "packing_slip"
+	OrderDocumentReceipt     = "receipt"
+)
+
+// Order document formats and languages
+const (
+	DocumentFormatHTML = "html"
+	DocumentFormatPDF  = "pdf"
+	DocumentLangEn     = "en"
+	DocumentLangRu     = "ru"
+)
+
 // CreateMessageRequest for creating a new message
 type CreateMessageRequest struct {
-	FullName string `json:"full_name"`
-	Phone    string `json:"phone"`
-	Message  string `json:"message"`
+	FullName string `json:"full_name" validate:"required,max=50"`
+	Phone    string `json:"phone" validate:"required,max=20"`
+	Message  string `json:"message" validate:"required"`
 }
 
 // UserMessage represents a user message
@@ -321,16 +574,16 @@ type UserMessage struct {
 }
 
 type UpdateSizeRequest struct {
-	Count int     `json:"count"`
-	Price float64 `json:"price"`
-	Size  string  `json:"size"`
+	Count int     `json:"count" validate:"min=0"`
+	Price float64 `json:"price" validate:"min=0,max=99999999"`
+	Size  string  `json:"size" validate:"required,max=50"`
 }
 
 // CreateMarketMessageRequest for creating a new market message
 type CreateMarketMessageRequest struct {
-	FullName string `json:"full_name"`
-	Phone    string `json:"phone"`
-	Message  string `json:"message"`
+	FullName string `json:"full_name" validate:"required,max=50"`
+	Phone    string `json:"phone" validate:"required,max=20"`
+	Message  string `json:"message" validate:"required"`
 }
 
 // MarketMessage represents a market message
@@ -356,8 +609,600 @@ type ForPostOrders struct {
 }
 
 type SuperadminRequest struct {
-	Phone    *string `json:"phone,omitempty"`
-	FullName string  `json:"full_name,omitempty"`
-	Username string  `json:"username,omitempty"`
-	Password string  `json:"password,omitempty"`
+	Phone    *string `json:"phone,omitempty" validate:"omitempty,phone"`
+	FullName string  `json:"full_name,omitempty" validate:"max=255"`
+	Username string  `json:"username,omitempty" validate:"omitempty,min=3,max=50"`
+	Password string  `json:"password,omitempty" validate:"omitempty,min=6"`
+}
+
+// AuditEvent represents a recorded administrative action
+type AuditEvent struct {
+	ID         int64           `json:"id"`
+	ActorID    int             `json:"actor_id"`
+	ActorRole  string          `json:"actor_role"`
+	MarketID   int             `json:"market_id,omitempty"`
+	Action     string          `json:"action"`
+	EntityType string          `json:"entity_type"`
+	EntityID   string          `json:"entity_id,omitempty"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	Route      string          `json:"route"`
+	Path       string          `json:"path"`
+	StatusCode int             `json:"status_code"`
+	IP         string          `json:"ip"`
+	UserAgent  string          `json:"user_agent"`
+	CreatedAt  string          `json:"created_at"`
+}
+
+// AuditEventFilter narrows down audit events returned to superadmins
+type AuditEventFilter struct {
+	ActorID    int
+	ActorRole  string
+	EntityType string
+	EntityID   string
+	From       *time.Time
+	To         *time.Time
+}
+
+// Market staff roles
+const (
+	StaffRoleOwner          = "owner"
+	StaffRoleCatalogManager = "catalog_manager"
+	StaffRoleOrderHandler   = "order_handler"
+	StaffRoleViewer         = "viewer"
+)
+
+// MarketStaff represents a staff account of a market
+type MarketStaff struct {
+	ID        int    `json:"id"`
+	MarketID  int    `json:"market_id"`
+	FullName  string `json:"full_name"`
+	Phone     string `json:"phone"`
+	Role      string `json:"role"`
+	IsActive  bool   `json:"is_active"`
+	CreatedAt string `json:"created_at"`
+}
+
+// CreateMarketStaffRequest for inviting a staff member to a market
+type CreateMarketStaffRequest struct {
+	FullName string `json:"full_name" validate:"required,max=255"`
+	Phone    string `json:"phone" validate:"required,phone"`
+	Role     string `json:"role" validate:"required,oneof=owner catalog_manager order_handler viewer"`
+}
+
+// UpdateMarketStaffRequest for changing a staff member's role or disabling them
+type UpdateMarketStaffRequest struct {
+	Role     *string `json:"role,omitempty" validate:"oneof=owner catalog_manager order_handler viewer"`
+	IsActive *bool   `json:"is_active,omitempty"`
+}
+
+// ChangePasswordRequest for changing one's own password
+type ChangePasswordRequest struct {
+	OldPassword string `json:"old_password" validate:"required"`
+	NewPassword string `json:"new_password" validate:"required,min=6"`
+}
+
+// Product import job statuses
+const (
+	ImportStatusQueued    = "queued"
+	ImportStatusRunning   = "running"
+	ImportStatusCompleted = "completed"
+	ImportStatusFailed    = "failed"
+)
+
+// ProductImportJob represents an asynchronous bulk product import
+type ProductImportJob struct {
+	ID              int                 `json:"id"`
+	MarketID        int                 `json:"market_id"`
+	FileName        string              `json:"file_name"`
+	DryRun          bool                `json:"dry_run"`
+	Status          string              `json:"status"`
+	TotalRows       int                 `json:"total_rows"`
+	ProductsCreated int                 `json:"products_created"`
+	ProductsUpdated int                 `json:"products_updated"`
+	VariantsCreated int                 `json:"variants_created"`
+	VariantsUpdated int                 `json:"variants_updated"`
+	Errors          []ImportRowError    `json:"errors"`
+	Preview         []ImportPreviewItem `json:"preview,omitempty"`
+	CreatedAt       string              `json:"created_at"`
+	FinishedAt      *string             `json:"finished_at"`
+}
+
+// ImportRowError describes a problem with one row of an import file.
+// Row numbers are 1-based and count the header row, matching spreadsheet row numbers.
+type ImportRowError struct {
+	Row     int    `json:"row"`
+	Column  string `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+// ImportPreviewItem describes what an import does to one product
+type ImportPreviewItem struct {
+	Row             int    `json:"row"`
+	ProductID       int    `json:"product_id,omitempty"`
+	Name            string `json:"name"`
+	Action          string `json:"action"`
+	VariantsCreated int    `json:"variants_created"`
+	VariantsUpdated int    `json:"variants_updated"`
+}
+
+// Background job statuses
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusRetrying  = "retrying"
+	JobStatusCompleted = "completed"
+	JobStatusDead      = "dead"
+)
+
+// Job represents a background job processed by the Redis job queue
+type Job struct {
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	Status      string          `json:"status"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	MarketID    int             `json:"market_id,omitempty"`
+	RequestID   string          `json:"request_id,omitempty"` // Request that queued the job
+	TraceParent string          `json:"-"`                    // Trace of the request that queued the job
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	LastError   string          `json:"last_error,omitempty"`
+	RunAt       *time.Time      `json:"run_at,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// JobQueueStats reports the size of each job queue list
+type JobQueueStats struct {
+	Queued     int64 `json:"queued"`
+	Processing int64 `json:"processing"`
+	Delayed    int64 `json:"delayed"`
+	Dead       int64 `json:"dead"`
+}
+
+// Notification recipient and device owner types
+const (
+	RecipientUser        = "user"
+	RecipientMarket      = "market"
+	RecipientMarketStaff = "market_staff"
+)
+
+// Notification types
+const (
+	NotificationNewOrder           = "new_order"
+	NotificationOrderStatusChanged = "order_status_changed"
+	NotificationNewMessage         = "new_message"
+)
+
+// Notification represents an entry of a user or market in-app inbox
+type Notification struct {
+	ID        int               `json:"id"`
+	Type      string            `json:"type"`
+	Title     string            `json:"title"`
+	TitleRu   string            `json:"title_ru"`
+	Body      string            `json:"body"`
+	BodyRu    string            `json:"body_ru"`
+	Data      map[string]string `json:"data,omitempty"`
+	IsRead    bool              `json:"is_read"`
+	ReadAt    *string           `json:"read_at"`
+	CreatedAt string            `json:"created_at"`
+}
+
+// RegisterDeviceRequest for registering a push device token
+type RegisterDeviceRequest struct {
+	Token    string `json:"token" validate:"required,max=512"`
+	Platform string `json:"platform" validate:"required,oneof=android ios web"`
+}
+
+// UnregisterDeviceRequest for removing a push device token, e.g. on logout
+type UnregisterDeviceRequest struct {
+	Token string `json:"token" validate:"required,max=512"`
+}
+
+// Order event types pushed to market order streams
+const (
+	OrderEventCreated       = "order_created"
+	OrderEventCancelled     = "order_cancelled"
+	OrderEventStatusChanged = "order_status_changed"
+	// OrderEventItemsChanged reports a status change of some items of an order, listed in ItemIDs
+	OrderEventItemsChanged = "order_items_changed"
+	// OrderEventResync tells a reconnecting client that events were missed and the orders list must be reloaded
+	OrderEventResync = "resync"
+)
+
+// OrderEvent is a change of a market's orders delivered over the order stream
+type OrderEvent struct {
+	ID          int64  `json:"id"`
+	Type        string `json:"type"`
+	MarketID    int    `json:"market_id"`
+	OrderID     int    `json:"order_id,omitempty"`
+	CartOrderID int    `json:"cart_order_id,omitempty"`
+	UserID      int    `json:"user_id,omitempty"`
+	Status      string `json:"status,omitempty"`
+	ItemIDs     []int  `json:"item_ids,omitempty"`
+	CreatedAt   string `json:"created_at"`
+}
+
+// Conversation kinds, statuses and party types
+const (
+	ConversationKindSupport    = "support"
+	ConversationKindOrder      = "order"
+	ConversationStatusOpen     = "open"
+	ConversationStatusResolved = "resolved"
+	// ConversationPartySuperadmin is the support side of support conversations; users and markets
+	// take part as RecipientUser and RecipientMarket
+	ConversationPartySuperadmin = "superadmin"
+)
+
+// Conversation is a support thread or a buyer-shop chat about an order
+type Conversation struct {
+	ID            int     `json:"id"`
+	Kind          string  `json:"kind"`
+	Subject       string  `json:"subject"`
+	Status        string  `json:"status"`
+	UserID        *int    `json:"user_id,omitempty"`
+	UserName      string  `json:"user_name,omitempty"`
+	MarketID      *int    `json:"market_id,omitempty"`
+	MarketName    string  `json:"market_name,omitempty"`
+	CartOrderID   *int    `json:"cart_order_id,omitempty"`
+	ContactName   string  `json:"contact_name,omitempty"`
+	ContactPhone  string  `json:"contact_phone,omitempty"`
+	LastMessage   string  `json:"last_message"`
+	UnreadCount   int     `json:"unread_count"`
+	CreatedAt     string  `json:"created_at"`
+	LastMessageAt string  `json:"last_message_at"`
+	ResolvedAt    *string `json:"resolved_at"`
+}
+
+// ConversationMessage is a message of a conversation.
+// IsRead tells whether the other side of the conversation has seen it.
+type ConversationMessage struct {
+	ID             int                      `json:"id"`
+	ConversationID int                      `json:"conversation_id"`
+	SenderType     string                   `json:"sender_type"`
+	SenderID       int                      `json:"sender_id"`
+	Body           string                   `json:"body"`
+	Attachments    []ConversationAttachment `json:"attachments"`
+	IsRead         bool                     `json:"is_read"`
+	CreatedAt      string                   `json:"created_at"`
+}
+
+// ConversationAttachment is a file attached to a conversation message
+type ConversationAttachment struct {
+	ID          int    `json:"id"`
+	URL         string `json:"url"`
+	FileName    string `json:"file_name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+// CreateConversationRequest for opening a conversation.
+// Support conversations need a subject; order conversations need cart_order_id and, for users,
+// market_id or, for markets, user_id.
+type CreateConversationRequest struct {
+	Subject      string `json:"subject" form:"subject" validate:"max=255"`
+	Message      string `json:"message" form:"message" validate:"max=5000"`
+	CartOrderID  int    `json:"cart_order_id,omitempty" form:"cart_order_id" validate:"omitempty,min=1"`
+	MarketID     int    `json:"market_id,omitempty" form:"market_id" validate:"omitempty,min=1"`
+	UserID       int    `json:"user_id,omitempty" form:"user_id" validate:"omitempty,min=1"`
+	ContactName  string `json:"contact_name,omitempty" form:"contact_name" validate:"max=50"`
+	ContactPhone string `json:"contact_phone,omitempty" form:"contact_phone" validate:"max=20"`
+}
+
+// UpdateConversationStatusRequest for resolving or reopening a conversation
+type UpdateConversationStatusRequest struct {
+	Status string `json:"status" validate:"required,oneof=open resolved"`
+}
+
+// Sales analytics bucket sizes
+const (
+	AnalyticsBucketDay   = "day"
+	AnalyticsBucketWeek  = "week"
+	AnalyticsBucketMonth = "month"
+)
+
+// SalesSummary holds the sales totals of a market over a date range.
+// Revenue and items exclude cancelled items; an order counts as cancelled when all its items are.
+type SalesSummary struct {
+	From             string  `json:"from"`
+	To               string  `json:"to"`
+	Revenue          float64 `json:"revenue"`
+	OrderCount       int     `json:"order_count"`
+	ItemsSold        int     `json:"items_sold"`
+	AverageBasket    float64 `json:"average_basket"`
+	CancelledOrders  int     `json:"cancelled_orders"`
+	CancellationRate float64 `json:"cancellation_rate"`
+}
+
+// SalesBucket holds the sales of one day, week (starting Monday) or month
+type SalesBucket struct {
+	Period     string  `json:"period"`
+	Revenue    float64 `json:"revenue"`
+	OrderCount int     `json:"order_count"`
+	ItemsSold  int     `json:"items_sold"`
+}
+
+// SalesSeries holds sales over time, with empty buckets included
+type SalesSeries struct {
+	From    string        `json:"from"`
+	To      string        `json:"to"`
+	Bucket  string        `json:"bucket"`
+	Buckets []SalesBucket `json:"buckets"`
+}
+
+// TopProduct is a best-selling product
+type TopProduct struct {
+	ProductID  int     `json:"product_id"`
+	Name       string  `json:"name"`
+	NameRu     string  `json:"name_ru"`
+	Quantity   int     `json:"quantity"`
+	Revenue    float64 `json:"revenue"`
+	OrderCount int     `json:"order_count"`
+}
+
+// TopVariant is a best-selling variant (size, color, ...) of a product
+type TopVariant struct {
+	VariantID     int     `json:"variant_id"`
+	ProductID     int     `json:"product_id"`
+	ProductName   string  `json:"product_name"`
+	ProductNameRu string  `json:"product_name_ru"`
+	SKU           string  `json:"sku"`
+	Label         string  `json:"label"`
+	Quantity      int     `json:"quantity"`
+	Revenue       float64 `json:"revenue"`
+}
+
+// LowStockItem is an active variant whose stock is at or below the threshold
+type LowStockItem struct {
+	VariantID     int    `json:"variant_id"`
+	ProductID     int    `json:"product_id"`
+	ProductName   string `json:"product_name"`
+	ProductNameRu string `json:"product_name_ru"`
+	SKU           string `json:"sku"`
+	Label         string `json:"label"`
+	Stock         int    `json:"stock"`
+}
+
+// FavoriteConversion relates how many users favorited a product to how many of them bought it
+type FavoriteConversion struct {
+	ProductID      int     `json:"product_id"`
+	Name           string  `json:"name"`
+	NameRu         string  `json:"name_ru"`
+	Favorites      int     `json:"favorites"`
+	Purchasers     int     `json:"purchasers"`
+	ConversionRate float64 `json:"conversion_rate"`
+}
+
+// FavoriteConversionReport holds the favorites-to-purchase conversion of a market; purchases are
+// counted within the date range, favorites regardless of when they were added
+type FavoriteConversionReport struct {
+	From           string               `json:"from"`
+	To             string               `json:"to"`
+	Favorites      int                  `json:"favorites"`
+	Purchasers     int                  `json:"purchasers"`
+	ConversionRate float64              `json:"conversion_rate"`
+	Products       []FavoriteConversion `json:"products"`
+}
+
+// ReportFunnel follows carts through to delivered orders
+type ReportFunnel struct {
+	CartsStarted         int     `json:"carts_started"`
+	Orders               int     `json:"orders"`
+	DeliveredOrders      int     `json:"delivered_orders"`
+	CancelledOrders      int     `json:"cancelled_orders"`
+	CartToOrderRate      float64 `json:"cart_to_order_rate"`
+	OrderToDeliveredRate float64 `json:"order_to_delivered_rate"`
+}
+
+// ReportSummary holds the platform totals of a date range. DataThrough is the last rolled-up day;
+// later days are not included yet.
+type ReportSummary struct {
+	From          string       `json:"from"`
+	To            string       `json:"to"`
+	DataThrough   string       `json:"data_through"`
+	GMV           float64      `json:"gmv"`
+	ItemsSold     int          `json:"items_sold"`
+	NewUsers      int          `json:"new_users"`
+	NewMarkets    int          `json:"new_markets"`
+	ActiveMarkets int          `json:"active_markets"`
+	Funnel        ReportFunnel `json:"funnel"`
+}
+
+// DailyPlatformStats holds the platform figures of one day
+type DailyPlatformStats struct {
+	Day           string  `json:"day"`
+	NewUsers      int     `json:"new_users"`
+	NewMarkets    int     `json:"new_markets"`
+	ActiveMarkets int     `json:"active_markets"`
+	Orders        int     `json:"orders"`
+	GMV           float64 `json:"gmv"`
+}
+
+// MarketGMV holds the sales of one market over a date range
+type MarketGMV struct {
+	MarketID        int     `json:"market_id"`
+	Name            string  `json:"name"`
+	NameRu          string  `json:"name_ru"`
+	IsVIP           bool    `json:"is_vip"`
+	Orders          int     `json:"orders"`
+	DeliveredOrders int     `json:"delivered_orders"`
+	CancelledOrders int     `json:"cancelled_orders"`
+	ItemsSold       int     `json:"items_sold"`
+	GMV             float64 `json:"gmv"`
+}
+
+// CategoryPerformance holds the sales of one category over a date range; CategoryID 0 is uncategorized
+type CategoryPerformance struct {
+	CategoryID int     `json:"category_id"`
+	Name       string  `json:"name"`
+	NameRu     string  `json:"name_ru"`
+	Orders     int     `json:"orders"`
+	ItemsSold  int     `json:"items_sold"`
+	GMV        float64 `json:"gmv"`
+	GMVShare   float64 `json:"gmv_share"`
+}
+
+// VIPSegment holds the combined figures of the VIP or the non-VIP markets over a date range
+type VIPSegment struct {
+	IsVIP              bool    `json:"is_vip"`
+	Markets            int     `json:"markets"`
+	ActiveMarkets      int     `json:"active_markets"`
+	Orders             int     `json:"orders"`
+	GMV                float64 `json:"gmv"`
+	GMVPerActiveMarket float64 `json:"gmv_per_active_market"`
+	AverageBasket      float64 `json:"average_basket"`
+	CancellationRate   float64 `json:"cancellation_rate"`
+}
+
+// ReportRollupRequest requests a rebuild of the report tables for a date range
+type ReportRollupRequest struct {
+	From string `json:"from" validate:"required,date"`
+	To   string `json:"to" validate:"required,date"`
+}
+
+// Ledger entry types
+const (
+	LedgerEntrySale       = "sale"
+	LedgerEntryCommission = "commission"
+	LedgerEntryPayoutDue  = "payout_due"
+	LedgerEntryPayout     = "payout"
+)
+
+// Payout statement statuses
+const (
+	PayoutStatusPending = "pending"
+	PayoutStatusPaid    = "paid"
+)
+
+// CommissionRate is the commission percentage of a market, a category, both, or neither (the platform
+// default); 0 stands for any market or category
+type CommissionRate struct {
+	ID           int     `json:"id"`
+	MarketID     int     `json:"market_id"`
+	MarketName   string  `json:"market_name,omitempty"`
+	CategoryID   int     `json:"category_id"`
+	CategoryName string  `json:"category_name,omitempty"`
+	Rate         float64 `json:"rate"`
+	UpdatedAt    string  `json:"updated_at"`
+}
+
+// SetCommissionRateRequest creates or changes the commission rate of a scope
+type SetCommissionRateRequest struct {
+	MarketID   int      `json:"market_id" validate:"min=0"`
+	CategoryID int      `json:"category_id" validate:"min=0"`
+	Rate       *float64 `json:"rate" validate:"required,min=0,max=100"`
+}
+
+// LedgerEntry moves Amount from CreditAccount to DebitAccount. Reversal entries point at the entry
+// they undo through ReversalOf.
+type LedgerEntry struct {
+	ID             int      `json:"id"`
+	MarketID       int      `json:"market_id"`
+	ItemID         *int     `json:"item_id"`
+	StatementID    *int     `json:"statement_id"`
+	ReturnID       *int     `json:"return_id,omitempty"`
+	EntryType      string   `json:"entry_type"`
+	DebitAccount   string   `json:"debit_account"`
+	CreditAccount  string   `json:"credit_account"`
+	Amount         float64  `json:"amount"`
+	CommissionRate *float64 `json:"commission_rate,omitempty"`
+	ReversalOf     *int     `json:"reversal_of,omitempty"`
+	CreatedAt      string   `json:"created_at"`
+}
+
+// PayoutStatement settles a market's ledger entries of a period. Net is what the platform owes the
+// market: gross sales minus commission, less any reversals.
+type PayoutStatement struct {
+	ID          int           `json:"id"`
+	MarketID    int           `json:"market_id"`
+	MarketName  string        `json:"market_name"`
+	PeriodStart string        `json:"period_start"`
+	PeriodEnd   string        `json:"period_end"`
+	Gross       float64       `json:"gross"`
+	Commission  float64       `json:"commission"`
+	Net         float64       `json:"net"`
+	Status      string        `json:"status"`
+	Reference   string        `json:"reference,omitempty"`
+	CreatedAt   string        `json:"created_at"`
+	PaidAt      *string       `json:"paid_at"`
+	Entries     []LedgerEntry `json:"entries,omitempty"`
+}
+
+// GeneratePayoutStatementsRequest requests payout statements for a period (YYYY-MM-DD, inclusive)
+type GeneratePayoutStatementsRequest struct {
+	PeriodStart string `json:"period_start" validate:"required,date"`
+	PeriodEnd   string `json:"period_end" validate:"required,date"`
+}
+
+// MarkPayoutPaidRequest records how a payout statement was paid
+type MarkPayoutPaidRequest struct {
+	Reference string `json:"reference" validate:"max=255"`
+}
+
+// Return request statuses
+const (
+	ReturnStatusRequested = "requested"
+	ReturnStatusApproved  = "approved"
+	ReturnStatusRejected  = "rejected"
+	ReturnStatusReceived  = "received"
+	ReturnStatusRefunded  = "refunded"
+)
+
+// Notification types of return requests
+const (
+	NotificationReturnRequested = "return_requested"
+	NotificationReturnUpdated   = "return_updated"
+)
+
+// ReturnItem is an order item, or part of its quantity, included in a return request
+type ReturnItem struct {
+	ItemID        int    `json:"item_id"`
+	VariantID     int    `json:"variant_id"`
+	SKU           string `json:"sku"`
+	ProductName   string `json:"product_name"`
+	ProductNameRu string `json:"product_name_ru"`
+	Count         int    `json:"count"`
+	OrderedCount  int    `json:"ordered_count"`
+}
+
+// ReturnRequest is a user's request to return delivered items of one order
+type ReturnRequest struct {
+	ID              int          `json:"id"`
+	UserID          int          `json:"user_id"`
+	UserName        string       `json:"user_name,omitempty"`
+	MarketID        int          `json:"market_id"`
+	MarketName      string       `json:"market_name"`
+	OrderID         int          `json:"order_id"`
+	OrderNumber     string       `json:"order_number"`
+	Reason          string       `json:"reason"`
+	Status          string       `json:"status"`
+	MarketNote      string       `json:"market_note,omitempty"`
+	RefundAmount    *float64     `json:"refund_amount"`
+	RefundReference string       `json:"refund_reference,omitempty"`
+	CreatedAt       string       `json:"created_at"`
+	DecidedAt       *string      `json:"decided_at"`
+	ReceivedAt      *string      `json:"received_at"`
+	RefundedAt      *string      `json:"refunded_at"`
+	Items           []ReturnItem `json:"items"`
+	Photos          []string     `json:"photos"`
+}
+
+// ReturnItemRequest selects an order item and how many of it to return (0 returns all)
+type ReturnItemRequest struct {
+	ItemID int `json:"item_id" validate:"required,min=1"`
+	Count  int `json:"count" validate:"min=0"`
+}
+
+// CreateReturnRequest opens a return for delivered items of one order
+type CreateReturnRequest struct {
+	Items  []ReturnItemRequest `json:"items" validate:"required"`
+	Reason string              `json:"reason" validate:"required,max=2000"`
+}
+
+// UpdateReturnStatusRequest moves a return request on: approved or rejected (with an optional note),
+// received, or refunded (with an optional payment reference)
+type UpdateReturnStatusRequest struct {
+	Status    string `json:"status" validate:"required,oneof=approved rejected received refunded"`
+	Note      string `json:"note" validate:"max=1000"`
+	Reference string `json:"reference" validate:"max=255"`
 }
@@ -0,0 +1,395 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"time"
+
+	"Dowlet_projects/ecommerce/models"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// analyticsCacheTTL bounds how stale cached aggregates get; order changes also drop them
+const analyticsCacheTTL = 10 * time.Minute
+
+// Shared SQL fragments of the sales queries: a line counts when it is not cancelled and is valued at
+// the discounted price it was ordered at, as in the market order list. Open lines are still being
+// fulfilled.
+const (
+	cancelledLine   = "o.status IN ('canceled', 'cancelled', 'out_of_stock')"
+	openLine        = "o.status IN ('pending', 'processing', 'shipped')"
+	lineAmount      = "o.unit_price * (1 - o.discount/100) * o.count"
+	lineRevenue     = "CASE WHEN " + cancelledLine + " THEN 0 ELSE " + lineAmount + " END"
+	lineItems       = "CASE WHEN " + cancelledLine + " THEN 0 ELSE o.count END"
+	variantLabelSQL = `COALESCE((
+		SELECT GROUP_CONCAT(pvv.value ORDER BY po.position SEPARATOR ' / ')
+		FROM product_variant_values pvv
+		JOIN product_options po ON po.id = pvv.option_id
+		WHERE pvv.variant_id = v.id), '')`
+	// marketOrdersSQL groups the items of a market's orders in a date range into one row per order
+	marketOrdersSQL = `
+		SELECT MIN(o.created_at) AS created_at,
+			MIN(` + cancelledLine + `) AS cancelled,
+			SUM(` + lineRevenue + `) AS revenue,
+			SUM(` + lineItems + `) AS items
+		FROM order_items o
+		JOIN product_variants v ON o.variant_id = v.id
+		JOIN products p ON o.product_id = p.id
+		WHERE o.market_id = ? AND o.created_at >= ? AND o.created_at < ?
+		GROUP BY o.order_id`
+)
+
+// analyticsDate formats the bounds of a date range; the end date is inclusive
+func analyticsDate(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+// analyticsBounds returns the SQL timestamp bounds [from, to + 1 day) of an inclusive date range
+func analyticsBounds(from, to time.Time) (string, string) {
+	return from.Format("2006-01-02 00:00:00"), to.AddDate(0, 0, 1).Format("2006-01-02 00:00:00")
+}
+
+func roundMoney(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+func ratio(part, whole int) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return math.Round(float64(part)/float64(whole)*10000) / 10000
+}
+
+// cachedAnalytics fills dest from the cached aggregate under key, or runs compute to fill it and caches the result
+func (s *DBService) cachedAnalytics(ctx context.Context, marketID int, key string, dest interface{}, compute func() error) error {
+	cacheKey := fmt.Sprintf("market:%d:analytics:%s", marketID, key)
+	cached, err := s.redis.Get(ctx, cacheKey).Bytes()
+	if err == nil && json.Unmarshal(cached, dest) == nil {
+		return nil
+	}
+	if err != nil && err != redis.Nil {
+		slog.WarnContext(ctx, "Failed to read analytics cache", "key", cacheKey, "error", err)
+	}
+
+	if err := compute(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(dest)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to marshal analytics for caching", "error", err)
+		return nil
+	}
+	keysKey := fmt.Sprintf("market:%d:analytics_cache_keys", marketID)
+	pipe := s.redis.Pipeline()
+	pipe.Set(ctx, cacheKey, data, analyticsCacheTTL)
+	pipe.SAdd(ctx, keysKey, cacheKey)
+	pipe.Expire(ctx, keysKey, analyticsCacheTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.WarnContext(ctx, "Failed to cache analytics", "error", err)
+	}
+	return nil
+}
+
+// invalidateMarketAnalytics drops the cached aggregates of markets whose orders changed
+func (s *DBService) invalidateMarketAnalytics(ctx context.Context, marketIDs ...int) {
+	for _, marketID := range marketIDs {
+		keysKey := fmt.Sprintf("market:%d:analytics_cache_keys", marketID)
+		keys, err := s.redis.SMembers(ctx, keysKey).Result()
+		if err != nil && err != redis.Nil {
+			slog.WarnContext(ctx, "Failed to fetch analytics cache keys", "error", err)
+			continue
+		}
+		if _, err := s.redis.Del(ctx, append(keys, keysKey)...).Result(); err != nil {
+			slog.WarnContext(ctx, "Failed to invalidate analytics caches", "error", err)
+		}
+	}
+}
+
+// GetSalesSummary returns revenue, order count, average basket and cancellation rate of a market
+func (s *DBService) GetSalesSummary(ctx context.Context, marketID int, from, to time.Time) (models.SalesSummary, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetSalesSummary")
+	defer span.End()
+	summary := models.SalesSummary{From: analyticsDate(from), To: analyticsDate(to)}
+	key := fmt.Sprintf("summary:%s:%s", summary.From, summary.To)
+	err := s.cachedAnalytics(ctx, marketID, key, &summary, func() error {
+		start, end := analyticsBounds(from, to)
+		var orders, cancelled, items int
+		var revenue float64
+		err := s.db.QueryRowContext(ctx, `
+			SELECT COUNT(*), COALESCE(SUM(cancelled), 0), COALESCE(SUM(revenue), 0), COALESCE(SUM(items), 0)
+			FROM (`+marketOrdersSQL+`) t`, marketID, start, end).Scan(&orders, &cancelled, &revenue, &items)
+		if err != nil {
+			return fmt.Errorf("failed to query sales summary: %v", err)
+		}
+
+		summary.Revenue = roundMoney(revenue)
+		summary.OrderCount = orders - cancelled
+		summary.ItemsSold = items
+		summary.CancelledOrders = cancelled
+		summary.CancellationRate = ratio(cancelled, orders)
+		if summary.OrderCount > 0 {
+			summary.AverageBasket = roundMoney(revenue / float64(summary.OrderCount))
+		}
+		return nil
+	})
+	return summary, err
+}
+
+// bucketStart returns the first day of the bucket containing t
+func bucketStart(t time.Time, bucket string) time.Time {
+	t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch bucket {
+	case models.AnalyticsBucketWeek:
+		return t.AddDate(0, 0, -((int(t.Weekday()) + 6) % 7))
+	case models.AnalyticsBucketMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return t
+}
+
+// nextBucket returns the first day of the bucket after the one starting at t
+func nextBucket(t time.Time, bucket string) time.Time {
+	switch bucket {
+	case models.AnalyticsBucketWeek:
+		return t.AddDate(0, 0, 7)
+	case models.AnalyticsBucketMonth:
+		return t.AddDate(0, 1, 0)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+// GetSalesSeries returns revenue and order counts of a market per day, week or month
+func (s *DBService) GetSalesSeries(ctx context.Context, marketID int, from, to time.Time, bucket string) (models.SalesSeries, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetSalesSeries")
+	defer span.End()
+	var periodSQL string
+	switch bucket {
+	case models.AnalyticsBucketDay:
+		periodSQL = "DATE_FORMAT(t.created_at, '%Y-%m-%d')"
+	case models.AnalyticsBucketWeek:
+		periodSQL = "DATE_FORMAT(DATE_SUB(DATE(t.created_at), INTERVAL WEEKDAY(t.created_at) DAY), '%Y-%m-%d')"
+	case models.AnalyticsBucketMonth:
+		periodSQL = "DATE_FORMAT(t.created_at, '%Y-%m-01')"
+	default:
+		return models.SalesSeries{}, fmt.Errorf("invalid bucket")
+	}
+
+	series := models.SalesSeries{From: analyticsDate(from), To: analyticsDate(to), Bucket: bucket}
+	key := fmt.Sprintf("sales:%s:%s:%s", series.From, series.To, bucket)
+	err := s.cachedAnalytics(ctx, marketID, key, &series, func() error {
+		start, end := analyticsBounds(from, to)
+		rows, err := s.db.QueryContext(ctx, `
+			SELECT `+periodSQL+` AS period,
+				SUM(CASE WHEN t.cancelled THEN 0 ELSE 1 END), COALESCE(SUM(t.revenue), 0), COALESCE(SUM(t.items), 0)
+			FROM (`+marketOrdersSQL+`) t
+			GROUP BY period`, marketID, start, end)
+		if err != nil {
+			return fmt.Errorf("failed to query sales: %v", err)
+		}
+		defer rows.Close()
+
+		byPeriod := make(map[string]models.SalesBucket)
+		for rows.Next() {
+			var b models.SalesBucket
+			if err := rows.Scan(&b.Period, &b.OrderCount, &b.Revenue, &b.ItemsSold); err != nil {
+				return fmt.Errorf("failed to scan sales: %v", err)
+			}
+			b.Revenue = roundMoney(b.Revenue)
+			byPeriod[b.Period] = b
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating sales: %v", err)
+		}
+
+		// Charts want every bucket of the range, including those without sales
+		series.Buckets = []models.SalesBucket{}
+		for t := bucketStart(from, bucket); !t.After(to); t = nextBucket(t, bucket) {
+			period := t.Format("2006-01-02")
+			b, ok := byPeriod[period]
+			if !ok {
+				b = models.SalesBucket{Period: period}
+			}
+			series.Buckets = append(series.Buckets, b)
+		}
+		return nil
+	})
+	return series, err
+}
+
+// GetTopProducts returns the best-selling products of a market by quantity or revenue
+func (s *DBService) GetTopProducts(ctx context.Context, marketID int, from, to time.Time, sortBy string, limit int) ([]models.TopProduct, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetTopProducts")
+	defer span.End()
+	order := "quantity DESC, revenue DESC"
+	if sortBy == "revenue" {
+		order = "revenue DESC, quantity DESC"
+	}
+
+	var products []models.TopProduct
+	key := fmt.Sprintf("top_products:%s:%s:%s:%d", analyticsDate(from), analyticsDate(to), sortBy, limit)
+	err := s.cachedAnalytics(ctx, marketID, key, &products, func() error {
+		start, end := analyticsBounds(from, to)
+		rows, err := s.db.QueryContext(ctx, `
+			SELECT p.id, p.name, p.name_ru, SUM(o.count) AS quantity,
+				SUM(`+lineAmount+`) AS revenue,
+				COUNT(DISTINCT o.order_id)
+			FROM order_items o
+			JOIN product_variants v ON o.variant_id = v.id
+			JOIN products p ON o.product_id = p.id
+			WHERE o.market_id = ? AND o.created_at >= ? AND o.created_at < ? AND NOT `+cancelledLine+`
+			GROUP BY p.id, p.name, p.name_ru
+			ORDER BY `+order+`
+			LIMIT ?`, marketID, start, end, limit)
+		if err != nil {
+			return fmt.Errorf("failed to query top products: %v", err)
+		}
+		defer rows.Close()
+
+		products = []models.TopProduct{}
+		for rows.Next() {
+			var p models.TopProduct
+			if err := rows.Scan(&p.ProductID, &p.Name, &p.NameRu, &p.Quantity, &p.Revenue, &p.OrderCount); err != nil {
+				return fmt.Errorf("failed to scan top product: %v", err)
+			}
+			p.Revenue = roundMoney(p.Revenue)
+			products = append(products, p)
+		}
+		return rows.Err()
+	})
+	return products, err
+}
+
+// GetTopVariants returns the best-selling variants (sizes, colors, ...) of a market by quantity or revenue
+func (s *DBService) GetTopVariants(ctx context.Context, marketID int, from, to time.Time, sortBy string, limit int) ([]models.TopVariant, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetTopVariants")
+	defer span.End()
+	order := "quantity DESC, revenue DESC"
+	if sortBy == "revenue" {
+		order = "revenue DESC, quantity DESC"
+	}
+
+	var variants []models.TopVariant
+	key := fmt.Sprintf("top_variants:%s:%s:%s:%d", analyticsDate(from), analyticsDate(to), sortBy, limit)
+	err := s.cachedAnalytics(ctx, marketID, key, &variants, func() error {
+		start, end := analyticsBounds(from, to)
+		rows, err := s.db.QueryContext(ctx, `
+			SELECT v.id, p.id, p.name, p.name_ru, v.sku, `+variantLabelSQL+`, SUM(o.count) AS quantity,
+				SUM(`+lineAmount+`) AS revenue
+			FROM order_items o
+			JOIN product_variants v ON o.variant_id = v.id
+			JOIN products p ON o.product_id = p.id
+			WHERE o.market_id = ? AND o.created_at >= ? AND o.created_at < ? AND NOT `+cancelledLine+`
+			GROUP BY v.id, p.id, p.name, p.name_ru, v.sku
+			ORDER BY `+order+`
+			LIMIT ?`, marketID, start, end, limit)
+		if err != nil {
+			return fmt.Errorf("failed to query top variants: %v", err)
+		}
+		defer rows.Close()
+
+		variants = []models.TopVariant{}
+		for rows.Next() {
+			var v models.TopVariant
+			if err := rows.Scan(&v.VariantID, &v.ProductID, &v.ProductName, &v.ProductNameRu, &v.SKU, &v.Label, &v.Quantity, &v.Revenue); err != nil {
+				return fmt.Errorf("failed to scan top variant: %v", err)
+			}
+			v.Revenue = roundMoney(v.Revenue)
+			variants = append(variants, v)
+		}
+		return rows.Err()
+	})
+	return variants, err
+}
+
+// GetLowStock returns the active variants of a market with stock at or below threshold, lowest first.
+// Stock changes with every order, so it is not cached.
+func (s *DBService) GetLowStock(ctx context.Context, marketID, threshold, limit int) ([]models.LowStockItem, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetLowStock")
+	defer span.End()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT v.id, p.id, p.name, p.name_ru, v.sku, `+variantLabelSQL+`, v.stock
+		FROM product_variants v
+		JOIN products p ON v.product_id = p.id
+		WHERE p.market_id = ? AND v.is_active = 1 AND v.stock <= ?
+		ORDER BY v.stock, p.name, v.position
+		LIMIT ?`, marketID, threshold, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query low stock: %v", err)
+	}
+	defer rows.Close()
+
+	items := []models.LowStockItem{}
+	for rows.Next() {
+		var item models.LowStockItem
+		if err := rows.Scan(&item.VariantID, &item.ProductID, &item.ProductName, &item.ProductNameRu, &item.SKU, &item.Label, &item.Stock); err != nil {
+			return nil, fmt.Errorf("failed to scan low stock item: %v", err)
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating low stock: %v", err)
+	}
+	return items, nil
+}
+
+// GetFavoriteConversion returns how many users who favorited the market's products bought them
+func (s *DBService) GetFavoriteConversion(ctx context.Context, marketID int, from, to time.Time, limit int) (models.FavoriteConversionReport, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetFavoriteConversion")
+	defer span.End()
+	report := models.FavoriteConversionReport{From: analyticsDate(from), To: analyticsDate(to)}
+	key := fmt.Sprintf("favorites:%s:%s:%d", report.From, report.To, limit)
+	err := s.cachedAnalytics(ctx, marketID, key, &report, func() error {
+		start, end := analyticsBounds(from, to)
+		rows, err := s.db.QueryContext(ctx, `
+			SELECT p.id, p.name, p.name_ru, COUNT(DISTINCT f.user_id),
+				COUNT(DISTINCT CASE WHEN EXISTS (
+					SELECT 1 FROM order_items o
+					JOIN orders oh ON oh.id = o.order_id
+					WHERE oh.user_id = f.user_id AND o.product_id = p.id AND o.market_id = p.market_id
+						AND o.created_at >= ? AND o.created_at < ? AND NOT `+cancelledLine+`
+				) THEN f.user_id END)
+			FROM favorites f
+			JOIN products p ON p.id = f.product_id
+			WHERE p.market_id = ?
+			GROUP BY p.id, p.name, p.name_ru`, start, end, marketID)
+		if err != nil {
+			return fmt.Errorf("failed to query favorites conversion: %v", err)
+		}
+		defer rows.Close()
+
+		products := []models.FavoriteConversion{}
+		for rows.Next() {
+			var c models.FavoriteConversion
+			if err := rows.Scan(&c.ProductID, &c.Name, &c.NameRu, &c.Favorites, &c.Purchasers); err != nil {
+				return fmt.Errorf("failed to scan favorites conversion: %v", err)
+			}
+			c.ConversionRate = ratio(c.Purchasers, c.Favorites)
+			report.Favorites += c.Favorites
+			report.Purchasers += c.Purchasers
+			products = append(products, c)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating favorites conversion: %v", err)
+		}
+
+		sort.SliceStable(products, func(i, j int) bool {
+			if products[i].Favorites != products[j].Favorites {
+				return products[i].Favorites > products[j].Favorites
+			}
+			return products[i].Purchasers > products[j].Purchasers
+		})
+		if len(products) > limit {
+			products = products[:limit]
+		}
+		report.Products = products
+		report.ConversionRate = ratio(report.Purchasers, report.Favorites)
+		return nil
+	})
+	return report, err
+}
@@ -0,0 +1,216 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"Dowlet_projects/ecommerce/models"
+)
+
+// auditSnapshotQueries lists the entities that can be snapshotted for the audit log.
+// Columns are spelled out so secrets such as password hashes never end up in audit_events.
+var auditSnapshotQueries = map[string]string{
+	"markets":                "SELECT id, phone, name, name_ru, location, location_ru, thumbnail_url, delivery_price, isVIP, created_at FROM markets WHERE id = ?",
+	"market_categories":      "SELECT market_id, category_id FROM market_categories WHERE market_id = ? ORDER BY category_id",
+	"products":               "SELECT id, market_id, category_id, name, name_ru, price, discount, description, description_ru, is_active, thumbnail_id FROM products WHERE id = ?",
+	"thumbnails":             "SELECT id, product_id, color, color_ru, image_url FROM thumbnails WHERE id = ?",
+	"sizes":                  "SELECT id, thumbnail_id, size, count, price FROM sizes WHERE id = ?",
+	"categories":             "SELECT id, parent_id, name, name_ru, slug, thumbnail_url, icon_url, sort_order, is_active FROM categories WHERE id = ?",
+	"banners":                "SELECT id, description, thumbnail_url FROM banners WHERE id = ?",
+	"users":                  "SELECT id, full_name, phone, verified, created_at FROM users WHERE id = ?",
+	"superadmins":            "SELECT id, username, full_name, phone FROM superadmins WHERE id = ?",
+	"orders":                 "SELECT oh.id, oh.order_number, oh.user_id, oh.market_id, oh.cart_order_id, oh.is_active, o.id AS item_id, o.variant_id, o.count, o.status, o.status_note, o.shipment_id FROM orders oh LEFT JOIN order_items o ON o.order_id = oh.id WHERE oh.id = ? ORDER BY o.id",
+	"order_items":            "SELECT id, order_id, market_id, product_id, size_id, variant_id, count, status, status_note, shipment_id FROM order_items WHERE id = ?",
+	"order_shipments":        "SELECT id, order_id, market_id, carrier, tracking_number, status, delivered_at FROM order_shipments WHERE id = ?",
+	"user_messages":          "SELECT id, user_id, full_name, phone, message FROM user_messages WHERE id = ?",
+	"market_messages":        "SELECT id, market_id, full_name, phone, message FROM market_messages WHERE id = ?",
+	"market_staff":           "SELECT id, market_id, full_name, phone, role, is_active, created_at FROM market_staff WHERE id = ?",
+	"product_variants":       "SELECT id, product_id, sku, barcode, price, compare_at_price, stock, is_active, position FROM product_variants WHERE id = ?",
+	"product_import_jobs":    "SELECT id, market_id, staff_id, file_name, dry_run, status FROM product_import_jobs WHERE id = ?",
+	"product_variant_images": "SELECT id, variant_id, image_url, position FROM product_variant_images WHERE id = ?",
+	"conversations":          "SELECT id, kind, user_id, market_id, cart_order_id, subject, status, resolved_at FROM conversations WHERE id = ?",
+	"commission_rates":       "SELECT id, market_id, category_id, rate FROM commission_rates WHERE id = ?",
+	"payout_statements":      "SELECT id, market_id, period_start, period_end, gross, commission, net, status, reference, paid_at, paid_by FROM payout_statements WHERE id = ?",
+	"return_requests":        "SELECT id, user_id, market_id, order_id, status, market_note, refund_amount, refund_reference, decided_at, received_at, refunded_at FROM return_requests WHERE id = ?",
+}
+
+// SnapshotEntity returns the current state of an entity as JSON, or nil if it does not exist
+func (s *DBService) SnapshotEntity(ctx context.Context, entityType, entityID string) (json.RawMessage, error) {
+	ctx, span := tracer.Start(ctx, "DBService.SnapshotEntity")
+	defer span.End()
+	query, ok := auditSnapshotQueries[entityType]
+	if !ok {
+		return nil, fmt.Errorf("unknown audit entity %q", entityType)
+	}
+	return s.snapshotRows(ctx, query, entityID)
+}
+
+// snapshotRows encodes the rows of a query as a JSON object (one row) or array (several rows)
+func (s *DBService) snapshotRows(ctx context.Context, query string, args ...interface{}) (json.RawMessage, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query snapshot: %v", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot columns: %v", err)
+	}
+
+	var records []map[string]interface{}
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("failed to scan snapshot: %v", err)
+		}
+		record := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			if values[i].Valid {
+				record[column] = values[i].String
+			} else {
+				record[column] = nil
+			}
+		}
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating snapshot rows: %v", err)
+	}
+
+	switch len(records) {
+	case 0:
+		return nil, nil
+	case 1:
+		return json.Marshal(records[0])
+	default:
+		return json.Marshal(records)
+	}
+}
+
+// CreateAuditEvent stores an audit event
+func (s *DBService) CreateAuditEvent(ctx context.Context, event models.AuditEvent) error {
+	ctx, span := tracer.Start(ctx, "DBService.CreateAuditEvent")
+	defer span.End()
+	var marketID interface{}
+	if event.MarketID != 0 {
+		marketID = event.MarketID
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO audit_events (actor_id, actor_role, market_id, action, entity_type, entity_id,
+			before_json, after_json, route, path, status_code, ip, user_agent)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		event.ActorID, event.ActorRole, marketID, event.Action, event.EntityType, nullIfEmpty(event.EntityID),
+		nullIfEmptyJSON(event.Before), nullIfEmptyJSON(event.After), event.Route, event.Path, event.StatusCode,
+		event.IP, event.UserAgent)
+	if err != nil {
+		return fmt.Errorf("failed to insert audit event: %v", err)
+	}
+	return nil
+}
+
+// GetAuditEvents retrieves paginated audit events matching the filter, newest first
+func (s *DBService) GetAuditEvents(ctx context.Context, filter models.AuditEventFilter, page, limit int) ([]models.AuditEvent, int, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetAuditEvents")
+	defer span.End()
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 {
+		limit = 20
+	}
+	offset := (page - 1) * limit
+
+	var conditions []string
+	var args []interface{}
+	if filter.ActorID != 0 {
+		conditions = append(conditions, "actor_id = ?")
+		args = append(args, filter.ActorID)
+	}
+	if filter.ActorRole != "" {
+		conditions = append(conditions, "actor_role = ?")
+		args = append(args, filter.ActorRole)
+	}
+	if filter.EntityType != "" {
+		conditions = append(conditions, "entity_type = ?")
+		args = append(args, filter.EntityType)
+	}
+	if filter.EntityID != "" {
+		conditions = append(conditions, "entity_id = ?")
+		args = append(args, filter.EntityID)
+	}
+	if filter.From != nil {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, filter.From.UTC().Format("2006-01-02 15:04:05"))
+	}
+	if filter.To != nil {
+		conditions = append(conditions, "created_at <= ?")
+		args = append(args, filter.To.UTC().Format("2006-01-02 15:04:05"))
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var totalCount int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM audit_events"+where, args...).Scan(&totalCount); err != nil {
+		return nil, 0, fmt.Errorf("failed to count audit events: %v", err)
+	}
+
+	query := `
+		SELECT id, actor_id, actor_role, COALESCE(market_id, 0), action, entity_type, COALESCE(entity_id, ''),
+			before_json, after_json, route, path, status_code, COALESCE(ip, ''), COALESCE(user_agent, ''), created_at
+		FROM audit_events` + where + `
+		ORDER BY id DESC LIMIT ? OFFSET ?`
+	rows, err := s.db.QueryContext(ctx, query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query audit events: %v", err)
+	}
+	defer rows.Close()
+
+	events := []models.AuditEvent{}
+	for rows.Next() {
+		var e models.AuditEvent
+		var before, after sql.NullString
+		if err := rows.Scan(&e.ID, &e.ActorID, &e.ActorRole, &e.MarketID, &e.Action, &e.EntityType, &e.EntityID,
+			&before, &after, &e.Route, &e.Path, &e.StatusCode, &e.IP, &e.UserAgent, &e.CreatedAt); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan audit event: %v", err)
+		}
+		if before.Valid {
+			e.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			e.After = json.RawMessage(after.String)
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating audit events: %v", err)
+	}
+
+	return events, totalCount, nil
+}
+
+// nullIfEmpty maps an empty string to SQL NULL
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// nullIfEmptyJSON maps empty JSON to SQL NULL
+func nullIfEmptyJSON(raw json.RawMessage) interface{} {
+	if len(raw) == 0 {
+		return nil
+	}
+	return string(raw)
+}
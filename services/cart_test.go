@@ -0,0 +1,152 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"Dowlet_projects/ecommerce/models"
+)
+
+// openTestDB connects to the database named by TEST_MYSQL_DSN, e.g.
+// user:password@tcp(127.0.0.1:3306)/ecommerce_test, which must hold ecommerce_db.sql with all
+// migrations applied. Tests that need it are skipped when the variable is not set.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("TEST_MYSQL_DSN is not set")
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	if err := db.Ping(); err != nil {
+		t.Fatalf("failed to connect to database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// insertTestRow runs an INSERT and returns the new row ID
+func insertTestRow(t *testing.T, db *sql.DB, query string, args ...interface{}) int {
+	t.Helper()
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		t.Fatalf("failed to insert fixture: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatalf("failed to retrieve fixture ID: %v", err)
+	}
+	return int(id)
+}
+
+// cartCounts returns the counts of a variant's cart rows by cart_order_id
+func cartCounts(t *testing.T, db *sql.DB, userID, variantID int) map[int]int {
+	t.Helper()
+	rows, err := db.Query("SELECT cart_order_id, count FROM carts WHERE user_id = ? AND variant_id = ?", userID, variantID)
+	if err != nil {
+		t.Fatalf("failed to query carts: %v", err)
+	}
+	defer rows.Close()
+	counts := make(map[int]int)
+	for rows.Next() {
+		var cartOrderID, count int
+		if err := rows.Scan(&cartOrderID, &count); err != nil {
+			t.Fatalf("failed to scan cart: %v", err)
+		}
+		counts[cartOrderID] = count
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("error iterating carts: %v", err)
+	}
+	return counts
+}
+
+func TestCartAfterOrder(t *testing.T) {
+	db := openTestDB(t)
+	s := &DBService{db: db}
+	ctx := context.Background()
+
+	suffix := time.Now().UnixNano() % 1e9
+	userID := insertTestRow(t, db, "INSERT INTO users (full_name, phone) VALUES (?, ?)",
+		"Cart Test", fmt.Sprintf("+1%d", suffix))
+	marketID := insertTestRow(t, db, `
+		INSERT INTO markets (password, phone, name, name_ru, location, location_ru)
+		VALUES ('', ?, 'Cart Test', 'Cart Test', '', '')`, fmt.Sprintf("+2%d", suffix))
+	productID := insertTestRow(t, db, `
+		INSERT INTO products (market_id, name, name_ru, price, description_ru, is_active)
+		VALUES (?, 'Cart Test', 'Cart Test', 10, '', 1)`, marketID)
+	variantID := insertTestRow(t, db, "INSERT INTO product_variants (product_id, sku, price, stock) VALUES (?, 'CART-TEST', 10, 10)", productID)
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM orders WHERE user_id = ?", userID)
+		db.Exec("DELETE FROM cart_starts WHERE user_id = ?", userID)
+		db.Exec("DELETE FROM carts WHERE user_id = ?", userID)
+		db.Exec("DELETE FROM products WHERE id = ?", productID)
+		db.Exec("DELETE FROM markets WHERE id = ?", marketID)
+		db.Exec("DELETE FROM users WHERE id = ?", userID)
+	})
+
+	firstCart, err := s.AddToCart(ctx, userID, models.CartRequest{ProductID: productID, VariantID: variantID, Count: 1})
+	if err != nil {
+		t.Fatalf("AddToCart: %v", err)
+	}
+	// Order the cart; its rows stay until the user deletes or clears them
+	insertTestRow(t, db, "INSERT INTO orders (user_id, market_id, cart_order_id, name, phone) VALUES (?, ?, ?, 'Cart Test', '')",
+		userID, marketID, firstCart)
+
+	var openCart int
+	steps := []struct {
+		name string
+		run  func() error
+		want map[string]int // counts of the ordered and the open cart
+	}{
+		{"add the ordered variant again", func() error {
+			var err error
+			openCart, err = s.AddToCart(ctx, userID, models.CartRequest{ProductID: productID, VariantID: variantID, Count: 2})
+			if err == nil && openCart == firstCart {
+				err = errors.New("the variant went into the ordered cart")
+			}
+			return err
+		}, map[string]int{"ordered": 1, "open": 2}},
+		{"add to the open cart", func() error {
+			cart, err := s.AddToCart(ctx, userID, models.CartRequest{ProductID: productID, VariantID: variantID, Count: 1})
+			if err == nil && cart != openCart {
+				err = fmt.Errorf("got cart %d, want the open cart %d", cart, openCart)
+			}
+			return err
+		}, map[string]int{"ordered": 1, "open": 3}},
+		{"update the count", func() error {
+			_, err := s.UpdateCartCountByVariantID(ctx, userID, variantID, 5)
+			return err
+		}, map[string]int{"ordered": 1, "open": 5}},
+		{"delete the entry", func() error {
+			return s.DeleteCartByVariantID(ctx, userID, variantID)
+		}, map[string]int{"ordered": 1}},
+		{"delete again", func() error {
+			if err := s.DeleteCartByVariantID(ctx, userID, variantID); !errors.Is(err, ErrCartItemNotFound) {
+				return fmt.Errorf("got %v, want %v", err, ErrCartItemNotFound)
+			}
+			return nil
+		}, map[string]int{"ordered": 1}},
+	}
+
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		counts := cartCounts(t, db, userID, variantID)
+		got := map[string]int{"ordered": counts[firstCart]}
+		if count, ok := counts[openCart]; ok && openCart != 0 {
+			got["open"] = count
+		}
+		if len(got) != len(step.want) || got["ordered"] != step.want["ordered"] || got["open"] != step.want["open"] {
+			t.Fatalf("%s: got carts %v, want %v", step.name, got, step.want)
+		}
+	}
+}
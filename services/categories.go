@@ -0,0 +1,505 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"Dowlet_projects/ecommerce/models"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// allCategoriesCacheKey caches the flat category list the tree, filters and breadcrumbs are built from.
+// It is tracked in categories_cache_keys so that every category change drops it.
+const allCategoriesCacheKey = "categories:all"
+
+// slugPattern matches category slugs: lower-case letters and digits separated by single hyphens
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// slugTransliteration spells Turkmen and Russian letters in ASCII for generated slugs
+var slugTransliteration = map[rune]string{
+	'ä': "a", 'ç': "ch", 'ö': "o", 'ş': "sh", 'ü': "u", 'ý': "y", 'ž': "zh", 'ň': "n",
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e", 'ж': "zh", 'з': "z",
+	'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o", 'п': "p", 'р': "r",
+	'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "h", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "sch",
+	'ы': "y", 'э': "e", 'ю': "yu", 'я': "ya",
+}
+
+// categoryIndex gives tree access to the flat category list
+type categoryIndex struct {
+	byID map[int]*models.Category
+	// children lists the child IDs of each category in sibling order; key 0 holds the top level
+	children map[int][]int
+}
+
+func newCategoryIndex(categories []models.Category) categoryIndex {
+	ix := categoryIndex{byID: make(map[int]*models.Category), children: make(map[int][]int)}
+	for i := range categories {
+		c := &categories[i]
+		ix.byID[c.ID] = c
+	}
+	for _, c := range categories {
+		parent := 0
+		if c.ParentID != nil {
+			if _, ok := ix.byID[*c.ParentID]; ok {
+				parent = *c.ParentID
+			}
+		}
+		ix.children[parent] = append(ix.children[parent], c.ID)
+	}
+	for _, ids := range ix.children {
+		sort.SliceStable(ids, func(i, j int) bool {
+			a, b := ix.byID[ids[i]], ix.byID[ids[j]]
+			if a.SortOrder != b.SortOrder {
+				return a.SortOrder < b.SortOrder
+			}
+			return a.ID < b.ID
+		})
+	}
+	return ix
+}
+
+// subtree returns a category and all of its descendants
+func (ix categoryIndex) subtree(id int) []int {
+	ids := []int{id}
+	for i := 0; i < len(ids); i++ {
+		ids = append(ids, ix.children[ids[i]]...)
+	}
+	return ids
+}
+
+// path returns the breadcrumbs from the top level down to a category
+func (ix categoryIndex) path(id int) []models.CategoryCrumb {
+	var crumbs []models.CategoryCrumb
+	seen := make(map[int]bool)
+	for c, ok := ix.byID[id]; ok && !seen[c.ID]; {
+		seen[c.ID] = true
+		crumbs = append(crumbs, models.CategoryCrumb{ID: c.ID, Name: c.Name, NameRu: c.NameRu, Slug: c.Slug})
+		if c.ParentID == nil {
+			break
+		}
+		c, ok = ix.byID[*c.ParentID]
+	}
+	for i, j := 0, len(crumbs)-1; i < j; i, j = i+1, j-1 {
+		crumbs[i], crumbs[j] = crumbs[j], crumbs[i]
+	}
+	return crumbs
+}
+
+// getAllCategories loads every category, active or not
+func (s *DBService) getAllCategories(ctx context.Context) ([]models.Category, error) {
+	cached, err := s.redis.Get(ctx, allCategoriesCacheKey).Result()
+	if err == nil {
+		var categories []models.Category
+		if err := json.Unmarshal([]byte(cached), &categories); err == nil {
+			return categories, nil
+		}
+		slog.WarnContext(ctx, "Failed to unmarshal cached categories", "error", err)
+	} else if err != redis.Nil {
+		slog.WarnContext(ctx, "Failed to read cached categories", "error", err)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, parent_id, name, COALESCE(name_ru, ''), slug, COALESCE(thumbnail_url, ''),
+			COALESCE(icon_url, ''), sort_order, is_active
+		FROM categories`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query categories: %v", err)
+	}
+	defer rows.Close()
+
+	categories := []models.Category{}
+	for rows.Next() {
+		var c models.Category
+		var parentID sql.NullInt64
+		if err := rows.Scan(&c.ID, &parentID, &c.Name, &c.NameRu, &c.Slug, &c.ThumbnailURL, &c.IconURL, &c.SortOrder, &c.IsActive); err != nil {
+			return nil, fmt.Errorf("failed to scan category: %v", err)
+		}
+		if parentID.Valid {
+			id := int(parentID.Int64)
+			c.ParentID = &id
+		}
+		categories = append(categories, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating categories: %v", err)
+	}
+
+	if data, err := json.Marshal(categories); err == nil {
+		pipe := s.redis.Pipeline()
+		pipe.Set(ctx, allCategoriesCacheKey, data, time.Hour)
+		pipe.SAdd(ctx, "categories_cache_keys", allCategoriesCacheKey)
+		if _, err := pipe.Exec(ctx); err != nil {
+			slog.WarnContext(ctx, "Failed to cache categories", "error", err)
+		}
+	}
+	return categories, nil
+}
+
+func (s *DBService) getCategoryIndex(ctx context.Context) (categoryIndex, error) {
+	categories, err := s.getAllCategories(ctx)
+	if err != nil {
+		return categoryIndex{}, err
+	}
+	return newCategoryIndex(categories), nil
+}
+
+// invalidateCategoryCaches drops the cached category lists and the product listings embedding
+// category names
+func (s *DBService) invalidateCategoryCaches(ctx context.Context) {
+	s.invalidateCacheSets(ctx, "categories_cache_keys", "global_products_cache_keys")
+}
+
+// invalidateCacheSets drops the cache entries tracked in the given Redis sets, and the sets
+func (s *DBService) invalidateCacheSets(ctx context.Context, sets ...string) {
+	pipe := s.redis.Pipeline()
+	for _, set := range sets {
+		keys, err := s.redis.SMembers(ctx, set).Result()
+		if err != nil && err != redis.Nil {
+			slog.WarnContext(ctx, "Failed to fetch cache keys", "set", set, "error", err)
+			continue
+		}
+		if len(keys) > 0 {
+			pipe.Del(ctx, keys...)
+		}
+		pipe.Del(ctx, set)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.WarnContext(ctx, "Failed to invalidate caches", "sets", sets, "error", err)
+	}
+}
+
+// GetCategoryTree returns the categories as a tree, siblings in sort order. Inactive categories and
+// their subtrees are left out unless includeInactive. With a marketID, only the categories the market
+// may sell in are kept, with their ancestors for context.
+func (s *DBService) GetCategoryTree(ctx context.Context, marketID int, includeInactive bool) ([]models.Category, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetCategoryTree")
+	defer span.End()
+	ix, err := s.getCategoryIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var allowed map[int]bool
+	if marketID != 0 {
+		if allowed, err = s.marketAllowedCategories(ctx, s.db, ix, marketID); err != nil {
+			return nil, err
+		}
+	}
+
+	var build func(parent int) []models.Category
+	build = func(parent int) []models.Category {
+		nodes := []models.Category{}
+		for _, id := range ix.children[parent] {
+			c := *ix.byID[id]
+			if !c.IsActive && !includeInactive {
+				continue
+			}
+			c.Children = build(id)
+			if allowed != nil && !allowed[id] && len(c.Children) == 0 {
+				continue
+			}
+			nodes = append(nodes, c)
+		}
+		return nodes
+	}
+	return build(0), nil
+}
+
+// marketAllowedCategories returns the categories a market may sell in: the subtrees of its assigned
+// categories, or nil when the market is not restricted
+func (s *DBService) marketAllowedCategories(ctx context.Context, q execer, ix categoryIndex, marketID int) (map[int]bool, error) {
+	assigned := make(map[int]bool)
+	if err := collectIDs(ctx, q, assigned, "SELECT category_id FROM market_categories WHERE market_id = ?", marketID); err != nil {
+		return nil, err
+	}
+	if len(assigned) == 0 {
+		return nil, nil
+	}
+	allowed := make(map[int]bool)
+	for id := range assigned {
+		for _, sub := range ix.subtree(id) {
+			allowed[sub] = true
+		}
+	}
+	return allowed, nil
+}
+
+// marketCategoryIDs returns the categories a market may put products in
+func (s *DBService) marketCategoryIDs(ctx context.Context, marketID int) (map[int]bool, error) {
+	ix, err := s.getCategoryIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	allowed, err := s.marketAllowedCategories(ctx, s.db, ix, marketID)
+	if err != nil {
+		return nil, err
+	}
+	if allowed == nil {
+		allowed = make(map[int]bool, len(ix.byID))
+		for id := range ix.byID {
+			allowed[id] = true
+		}
+	}
+	return allowed, nil
+}
+
+// checkProductCategory fails unless a market may put products in the category
+func (s *DBService) checkProductCategory(ctx context.Context, marketID, categoryID int) error {
+	ix, err := s.getCategoryIndex(ctx)
+	if err != nil {
+		return err
+	}
+	if _, ok := ix.byID[categoryID]; !ok {
+		return ErrCategoryNotFound
+	}
+	allowed, err := s.marketAllowedCategories(ctx, s.db, ix, marketID)
+	if err != nil {
+		return err
+	}
+	if allowed != nil && !allowed[categoryID] {
+		return ErrCategoryNotAssigned
+	}
+	return nil
+}
+
+// categoryFilterIDs returns the categories a category_id filter matches: the category and its
+// descendants
+func (s *DBService) categoryFilterIDs(ctx context.Context, categoryID int) ([]interface{}, error) {
+	ix, err := s.getCategoryIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ids := ix.subtree(categoryID)
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return args, nil
+}
+
+// attachBreadcrumbs sets the category breadcrumbs of products. Breadcrumbs are not cached with
+// product listings, so they follow category changes immediately.
+func (s *DBService) attachBreadcrumbs(ctx context.Context, products []models.Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+	ix, err := s.getCategoryIndex(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range products {
+		products[i].Breadcrumbs = ix.path(products[i].CategoryID)
+	}
+	return nil
+}
+
+// UpdateCategory changes the fields of a category set in input. Moving a category under itself or one
+// of its descendants is rejected.
+func (s *DBService) UpdateCategory(ctx context.Context, categoryID int, input models.CategoryInput) error {
+	ctx, span := tracer.Start(ctx, "DBService.UpdateCategory")
+	defer span.End()
+	ix, err := s.getCategoryIndex(ctx)
+	if err != nil {
+		return err
+	}
+	if _, ok := ix.byID[categoryID]; !ok {
+		return ErrCategoryNotFound
+	}
+
+	var updates []string
+	var args []interface{}
+	if input.Name != nil {
+		name := strings.TrimSpace(*input.Name)
+		if name == "" {
+			return ErrCategoryNameRequired
+		}
+		updates = append(updates, "name = ?")
+		args = append(args, name)
+	}
+	if input.NameRu != nil {
+		updates = append(updates, "name_ru = ?")
+		args = append(args, strings.TrimSpace(*input.NameRu))
+	}
+	if input.ParentID != nil {
+		parentID, err := validCategoryParent(ix, categoryID, *input.ParentID)
+		if err != nil {
+			return err
+		}
+		updates = append(updates, "parent_id = ?")
+		args = append(args, parentID)
+	}
+	if input.Slug != nil {
+		if !slugPattern.MatchString(*input.Slug) {
+			return ErrInvalidSlug
+		}
+		updates = append(updates, "slug = ?")
+		args = append(args, *input.Slug)
+	}
+	if input.IconURL != nil {
+		updates = append(updates, "icon_url = ?")
+		args = append(args, nullIfEmpty(*input.IconURL))
+	}
+	if input.SortOrder != nil {
+		updates = append(updates, "sort_order = ?")
+		args = append(args, *input.SortOrder)
+	}
+	if input.IsActive != nil {
+		updates = append(updates, "is_active = ?")
+		args = append(args, *input.IsActive)
+	}
+	if len(updates) == 0 {
+		return ErrNoFieldsToUpdate
+	}
+
+	args = append(args, categoryID)
+	if _, err := s.db.ExecContext(ctx, "UPDATE categories SET "+strings.Join(updates, ", ")+" WHERE id = ?", args...); err != nil {
+		if strings.Contains(err.Error(), "Duplicate entry") {
+			if strings.Contains(err.Error(), "uniq_category_slug") {
+				return ErrSlugTaken
+			}
+			return ErrCategoryNameTaken
+		}
+		return fmt.Errorf("failed to update category: %v", err)
+	}
+
+	s.invalidateCategoryCaches(ctx)
+	return nil
+}
+
+// validCategoryParent checks a new parent of a category (0 for none, or a new category when
+// categoryID is 0) and returns it as a column value
+func validCategoryParent(ix categoryIndex, categoryID, parentID int) (interface{}, error) {
+	if parentID == 0 {
+		return nil, nil
+	}
+	if _, ok := ix.byID[parentID]; !ok {
+		return nil, ErrParentCategoryNotFound
+	}
+	if categoryID != 0 {
+		for _, id := range ix.subtree(categoryID) {
+			if id == parentID {
+				return nil, ErrCategoryCycle
+			}
+		}
+	}
+	return parentID, nil
+}
+
+// uniqueCategorySlug derives a slug from a category name, adding a number when it is taken
+func (s *DBService) uniqueCategorySlug(ctx context.Context, name string) (string, error) {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(name) {
+		switch t, ok := slugTransliteration[r]; {
+		case ok:
+			b.WriteString(t)
+			hyphen = false
+		case r >= 'a' && r <= 'z' || r >= '0' && r <= '9':
+			b.WriteRune(r)
+			hyphen = false
+		case !hyphen && b.Len() > 0:
+			b.WriteByte('-')
+			hyphen = true
+		}
+	}
+	base := strings.TrimSuffix(b.String(), "-")
+	if len(base) > 100 {
+		base = strings.TrimSuffix(base[:100], "-")
+	}
+	if base == "" {
+		base = "category"
+	}
+
+	slug := base
+	for n := 2; ; n++ {
+		var taken bool
+		if err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM categories WHERE slug = ?)", slug).Scan(&taken); err != nil {
+			return "", fmt.Errorf("failed to check slug: %v", err)
+		}
+		if !taken {
+			return slug, nil
+		}
+		slug = fmt.Sprintf("%s-%d", base, n)
+	}
+}
+
+// GetMarketCategories returns the categories assigned to a market; an empty list means the market
+// may sell in every category
+func (s *DBService) GetMarketCategories(ctx context.Context, marketID int) ([]models.Category, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetMarketCategories")
+	defer span.End()
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM markets WHERE id = ?)", marketID).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to validate market: %v", err)
+	}
+	if !exists {
+		return nil, ErrMarketNotFound
+	}
+
+	ix, err := s.getCategoryIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	assigned := make(map[int]bool)
+	if err := collectIDs(ctx, s.db, assigned, "SELECT category_id FROM market_categories WHERE market_id = ?", marketID); err != nil {
+		return nil, err
+	}
+	categories := []models.Category{}
+	for id := range assigned {
+		if c, ok := ix.byID[id]; ok {
+			categories = append(categories, *c)
+		}
+	}
+	sort.Slice(categories, func(i, j int) bool { return categories[i].ID < categories[j].ID })
+	return categories, nil
+}
+
+// SetMarketCategories replaces the categories assigned to a market. Existing products outside the
+// new categories are kept; only new products and category changes are checked.
+func (s *DBService) SetMarketCategories(ctx context.Context, marketID int, categoryIDs []int) error {
+	ctx, span := tracer.Start(ctx, "DBService.SetMarketCategories")
+	defer span.End()
+	ix, err := s.getCategoryIndex(ctx)
+	if err != nil {
+		return err
+	}
+	for _, id := range categoryIDs {
+		if _, ok := ix.byID[id]; !ok {
+			return ErrCategoryNotFound
+		}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM markets WHERE id = ? FOR UPDATE", marketID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return ErrMarketNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to validate market: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM market_categories WHERE market_id = ?", marketID); err != nil {
+		return fmt.Errorf("failed to clear market categories: %v", err)
+	}
+	for _, id := range categoryIDs {
+		if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO market_categories (market_id, category_id) VALUES (?, ?)", marketID, id); err != nil {
+			return fmt.Errorf("failed to assign category: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,606 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"Dowlet_projects/ecommerce/models"
+)
+
+// conversationPreviewLength caps the message excerpt used in notifications
+const conversationPreviewLength = 100
+
+// conversationColumns are the columns scanned by scanConversation; the unread count is taken for
+// the party type passed as the first two query arguments
+const conversationColumns = `
+	c.id, c.kind, c.subject, c.status, c.user_id, COALESCE(u.full_name, ''), c.market_id, COALESCE(m.name, ''),
+	c.cart_order_id, COALESCE(c.contact_name, ''), COALESCE(c.contact_phone, ''),
+	COALESCE((SELECT body FROM conversation_messages WHERE conversation_id = c.id ORDER BY id DESC LIMIT 1), ''),
+	(SELECT COUNT(*) FROM conversation_messages cm
+		WHERE cm.conversation_id = c.id AND cm.sender_type <> ? AND cm.id > COALESCE(r.last_read_message_id, 0)),
+	c.created_at, c.last_message_at, c.resolved_at
+	FROM conversations c
+	LEFT JOIN users u ON u.id = c.user_id
+	LEFT JOIN markets m ON m.id = c.market_id
+	LEFT JOIN conversation_reads r ON r.conversation_id = c.id AND r.party_type = ?`
+
+// conversationRef holds what is needed to check access to a conversation and route its messages
+type conversationRef struct {
+	kind     string
+	userID   int
+	marketID int
+}
+
+// recipient returns the party a message of senderType is addressed to
+func (c conversationRef) recipient(senderType string) (string, int) {
+	if c.kind == models.ConversationKindOrder {
+		if senderType == models.RecipientUser {
+			return models.RecipientMarket, c.marketID
+		}
+		return models.RecipientUser, c.userID
+	}
+	if senderType != models.ConversationPartySuperadmin {
+		return models.ConversationPartySuperadmin, 0
+	}
+	if c.userID != 0 {
+		return models.RecipientUser, c.userID
+	}
+	return models.RecipientMarket, c.marketID
+}
+
+// conversationScope returns the condition limiting conversations to those a party takes part in.
+// Superadmins handle support conversations only.
+func conversationScope(partyType string, partyID int) (string, []interface{}, error) {
+	switch partyType {
+	case models.RecipientUser:
+		return "c.user_id = ?", []interface{}{partyID}, nil
+	case models.RecipientMarket:
+		return "c.market_id = ?", []interface{}{partyID}, nil
+	case models.ConversationPartySuperadmin:
+		return "c.kind = 'support'", nil, nil
+	}
+	return "", nil, ErrInvalidConversation
+}
+
+// conversationForParty loads a conversation the party takes part in
+func conversationForParty(ctx context.Context, q execer, partyType string, partyID, conversationID int) (conversationRef, error) {
+	scope, args, err := conversationScope(partyType, partyID)
+	if err != nil {
+		return conversationRef{}, err
+	}
+	var ref conversationRef
+	var userID, marketID sql.NullInt64
+	err = q.QueryRowContext(ctx, "SELECT c.kind, c.user_id, c.market_id FROM conversations c WHERE c.id = ? AND "+scope,
+		append([]interface{}{conversationID}, args...)...).Scan(&ref.kind, &userID, &marketID)
+	if err == sql.ErrNoRows {
+		return conversationRef{}, ErrConversationNotFound
+	}
+	if err != nil {
+		return conversationRef{}, fmt.Errorf("failed to fetch conversation: %v", err)
+	}
+	ref.userID = int(userID.Int64)
+	ref.marketID = int(marketID.Int64)
+	return ref, nil
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanConversation scans a row selected with conversationColumns
+func scanConversation(row rowScanner) (models.Conversation, error) {
+	var c models.Conversation
+	var userID, marketID, cartOrderID sql.NullInt64
+	var resolvedAt sql.NullString
+	err := row.Scan(&c.ID, &c.Kind, &c.Subject, &c.Status, &userID, &c.UserName, &marketID, &c.MarketName,
+		&cartOrderID, &c.ContactName, &c.ContactPhone, &c.LastMessage, &c.UnreadCount,
+		&c.CreatedAt, &c.LastMessageAt, &resolvedAt)
+	if err != nil {
+		return c, err
+	}
+	if userID.Valid {
+		id := int(userID.Int64)
+		c.UserID = &id
+	}
+	if marketID.Valid {
+		id := int(marketID.Int64)
+		c.MarketID = &id
+	}
+	if cartOrderID.Valid {
+		id := int(cartOrderID.Int64)
+		c.CartOrderID = &id
+	}
+	if resolvedAt.Valid {
+		c.ResolvedAt = &resolvedAt.String
+	}
+	return c, nil
+}
+
+// ConversationKind returns the kind of a conversation the party takes part in
+func (s *DBService) ConversationKind(ctx context.Context, partyType string, partyID, conversationID int) (string, error) {
+	ctx, span := tracer.Start(ctx, "DBService.ConversationKind")
+	defer span.End()
+	ref, err := conversationForParty(ctx, s.db, partyType, partyID, conversationID)
+	if err != nil {
+		return "", err
+	}
+	return ref.kind, nil
+}
+
+// OpenConversation starts a conversation with its first message and returns the conversation ID.
+// Users and markets open support conversations; with a cart order they open (or continue) the
+// conversation between the buyer and the shop about that order.
+func (s *DBService) OpenConversation(ctx context.Context, partyType string, partyID int, req models.CreateConversationRequest, attachments []models.ConversationAttachment) (int, models.ConversationMessage, error) {
+	ctx, span := tracer.Start(ctx, "DBService.OpenConversation")
+	defer span.End()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, models.ConversationMessage{}, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var ref conversationRef
+	var result sql.Result
+	switch {
+	case partyType != models.RecipientUser && partyType != models.RecipientMarket:
+		return 0, models.ConversationMessage{}, ErrInvalidConversation
+	case req.CartOrderID != 0:
+		ref = conversationRef{kind: models.ConversationKindOrder, userID: req.UserID, marketID: req.MarketID}
+		if partyType == models.RecipientUser {
+			ref.userID = partyID
+		} else {
+			ref.marketID = partyID
+		}
+
+		var exists bool
+		err = tx.QueryRowContext(ctx, `
+			SELECT EXISTS(SELECT 1 FROM orders WHERE cart_order_id = ? AND user_id = ? AND market_id = ?)`,
+			req.CartOrderID, ref.userID, ref.marketID).Scan(&exists)
+		if err != nil {
+			return 0, models.ConversationMessage{}, fmt.Errorf("failed to verify order: %v", err)
+		}
+		if !exists {
+			return 0, models.ConversationMessage{}, ErrOrderNotFound
+		}
+
+		subject := req.Subject
+		if subject == "" {
+			subject = fmt.Sprintf("Order #%d", req.CartOrderID)
+		}
+		// An order has a single conversation per market; opening it again continues it
+		result, err = tx.ExecContext(ctx, `
+			INSERT INTO conversations (kind, user_id, market_id, cart_order_id, subject)
+			VALUES ('order', ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id)`,
+			ref.userID, ref.marketID, req.CartOrderID, subject)
+	default:
+		ref = conversationRef{kind: models.ConversationKindSupport}
+		if partyType == models.RecipientUser {
+			ref.userID = partyID
+		} else {
+			ref.marketID = partyID
+		}
+		result, err = tx.ExecContext(ctx, `
+			INSERT INTO conversations (kind, user_id, market_id, subject, contact_name, contact_phone)
+			VALUES ('support', ?, ?, ?, ?, ?)`,
+			nullIfZero(ref.userID), nullIfZero(ref.marketID), req.Subject,
+			nullIfEmpty(req.ContactName), nullIfEmpty(req.ContactPhone))
+	}
+	if err != nil {
+		return 0, models.ConversationMessage{}, fmt.Errorf("failed to create conversation: %v", err)
+	}
+	conversationID, err := result.LastInsertId()
+	if err != nil {
+		return 0, models.ConversationMessage{}, fmt.Errorf("failed to retrieve conversation ID: %v", err)
+	}
+
+	message, err := insertConversationMessage(ctx, tx, int(conversationID), partyType, partyID, req.Message, attachments)
+	if err != nil {
+		return 0, models.ConversationMessage{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, models.ConversationMessage{}, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	s.notifyConversationMessage(ctx, ref, message)
+
+	return int(conversationID), message, nil
+}
+
+// AddConversationMessage posts a reply to a conversation; replying to a resolved conversation reopens it
+func (s *DBService) AddConversationMessage(ctx context.Context, partyType string, partyID, conversationID int, body string, attachments []models.ConversationAttachment) (models.ConversationMessage, error) {
+	ctx, span := tracer.Start(ctx, "DBService.AddConversationMessage")
+	defer span.End()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return models.ConversationMessage{}, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	ref, err := conversationForParty(ctx, tx, partyType, partyID, conversationID)
+	if err != nil {
+		return models.ConversationMessage{}, err
+	}
+
+	message, err := insertConversationMessage(ctx, tx, conversationID, partyType, partyID, body, attachments)
+	if err != nil {
+		return models.ConversationMessage{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.ConversationMessage{}, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	s.notifyConversationMessage(ctx, ref, message)
+
+	return message, nil
+}
+
+// insertConversationMessage stores a message with its attachments, reopens the conversation and
+// marks it read up to the new message for the sender
+func insertConversationMessage(ctx context.Context, tx *sql.Tx, conversationID int, senderType string, senderID int, body string, attachments []models.ConversationAttachment) (models.ConversationMessage, error) {
+	result, err := tx.ExecContext(ctx, "INSERT INTO conversation_messages (conversation_id, sender_type, sender_id, body) VALUES (?, ?, ?, ?)",
+		conversationID, senderType, senderID, body)
+	if err != nil {
+		return models.ConversationMessage{}, fmt.Errorf("failed to insert message: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return models.ConversationMessage{}, fmt.Errorf("failed to retrieve message ID: %v", err)
+	}
+
+	message := models.ConversationMessage{
+		ID:             int(id),
+		ConversationID: conversationID,
+		SenderType:     senderType,
+		SenderID:       senderID,
+		Body:           body,
+		Attachments:    []models.ConversationAttachment{},
+	}
+	if err := tx.QueryRowContext(ctx, "SELECT created_at FROM conversation_messages WHERE id = ?", id).Scan(&message.CreatedAt); err != nil {
+		return models.ConversationMessage{}, fmt.Errorf("failed to fetch message: %v", err)
+	}
+
+	for _, attachment := range attachments {
+		result, err := tx.ExecContext(ctx, `
+			INSERT INTO conversation_attachments (message_id, url, file_name, content_type, size)
+			VALUES (?, ?, ?, ?, ?)`,
+			id, attachment.URL, attachment.FileName, attachment.ContentType, attachment.Size)
+		if err != nil {
+			return models.ConversationMessage{}, fmt.Errorf("failed to insert attachment: %v", err)
+		}
+		attachmentID, err := result.LastInsertId()
+		if err != nil {
+			return models.ConversationMessage{}, fmt.Errorf("failed to retrieve attachment ID: %v", err)
+		}
+		attachment.ID = int(attachmentID)
+		message.Attachments = append(message.Attachments, attachment)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE conversations SET last_message_at = CURRENT_TIMESTAMP, status = 'open', resolved_at = NULL
+		WHERE id = ?`, conversationID)
+	if err != nil {
+		return models.ConversationMessage{}, fmt.Errorf("failed to update conversation: %v", err)
+	}
+
+	if err := markConversationRead(ctx, tx, conversationID, senderType, int(id)); err != nil {
+		return models.ConversationMessage{}, err
+	}
+
+	return message, nil
+}
+
+// markConversationRead moves the read receipt of a party forward to messageID
+func markConversationRead(ctx context.Context, q execer, conversationID int, partyType string, messageID int) error {
+	_, err := q.ExecContext(ctx, `
+		INSERT INTO conversation_reads (conversation_id, party_type, last_read_message_id)
+		VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			last_read_message_id = GREATEST(last_read_message_id, VALUES(last_read_message_id)),
+			read_at = CURRENT_TIMESTAMP`,
+		conversationID, partyType, messageID)
+	if err != nil {
+		return fmt.Errorf("failed to update read receipt: %v", err)
+	}
+	return nil
+}
+
+// GetConversations lists the conversations of a party, most recently active first.
+// kinds and status are optional filters.
+func (s *DBService) GetConversations(ctx context.Context, partyType string, partyID int, kinds []string, status string, page, limit int) ([]models.Conversation, int, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetConversations")
+	defer span.End()
+	scope, scopeArgs, err := conversationScope(partyType, partyID)
+	if err != nil {
+		return nil, 0, err
+	}
+	where := []string{scope}
+	args := scopeArgs
+	if len(kinds) > 0 {
+		where = append(where, "c.kind IN ("+placeholders(len(kinds))+")")
+		for _, kind := range kinds {
+			args = append(args, kind)
+		}
+	}
+	if status != "" {
+		where = append(where, "c.status = ?")
+		args = append(args, status)
+	}
+	whereClause := strings.Join(where, " AND ")
+
+	var total int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM conversations c WHERE "+whereClause, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count conversations: %v", err)
+	}
+
+	queryArgs := append([]interface{}{partyType, partyType}, args...)
+	queryArgs = append(queryArgs, limit, (page-1)*limit)
+	rows, err := s.db.QueryContext(ctx, "SELECT "+conversationColumns+" WHERE "+whereClause+`
+		ORDER BY c.last_message_at DESC, c.id DESC
+		LIMIT ? OFFSET ?`, queryArgs...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query conversations: %v", err)
+	}
+	defer rows.Close()
+
+	conversations := []models.Conversation{}
+	for rows.Next() {
+		c, err := scanConversation(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to scan conversation: %v", err)
+		}
+		conversations = append(conversations, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating conversations: %v", err)
+	}
+
+	return conversations, total, nil
+}
+
+// GetConversation returns a conversation with up to limit of its messages in chronological order.
+// With beforeID only messages older than that message are returned, for paging back in history.
+func (s *DBService) GetConversation(ctx context.Context, partyType string, partyID, conversationID, beforeID, limit int) (models.Conversation, []models.ConversationMessage, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetConversation")
+	defer span.End()
+	scope, scopeArgs, err := conversationScope(partyType, partyID)
+	if err != nil {
+		return models.Conversation{}, nil, err
+	}
+	args := append([]interface{}{partyType, partyType, conversationID}, scopeArgs...)
+	conversation, err := scanConversation(s.db.QueryRowContext(ctx, "SELECT "+conversationColumns+" WHERE c.id = ? AND "+scope, args...))
+	if err == sql.ErrNoRows {
+		return models.Conversation{}, nil, ErrConversationNotFound
+	}
+	if err != nil {
+		return models.Conversation{}, nil, fmt.Errorf("failed to fetch conversation: %v", err)
+	}
+
+	ref := conversationRef{kind: conversation.Kind}
+	if conversation.UserID != nil {
+		ref.userID = *conversation.UserID
+	}
+	if conversation.MarketID != nil {
+		ref.marketID = *conversation.MarketID
+	}
+
+	query := "SELECT id, sender_type, sender_id, body, created_at FROM conversation_messages WHERE conversation_id = ?"
+	queryArgs := []interface{}{conversationID}
+	if beforeID > 0 {
+		query += " AND id < ?"
+		queryArgs = append(queryArgs, beforeID)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	queryArgs = append(queryArgs, limit)
+
+	rows, err := s.db.QueryContext(ctx, query, queryArgs...)
+	if err != nil {
+		return models.Conversation{}, nil, fmt.Errorf("failed to query messages: %v", err)
+	}
+	defer rows.Close()
+
+	var messages []models.ConversationMessage
+	index := make(map[int]int)
+	for rows.Next() {
+		m := models.ConversationMessage{ConversationID: conversationID, Attachments: []models.ConversationAttachment{}}
+		if err := rows.Scan(&m.ID, &m.SenderType, &m.SenderID, &m.Body, &m.CreatedAt); err != nil {
+			return models.Conversation{}, nil, fmt.Errorf("failed to scan message: %v", err)
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return models.Conversation{}, nil, fmt.Errorf("error iterating messages: %v", err)
+	}
+	rows.Close()
+
+	// Oldest first
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	if len(messages) == 0 {
+		return conversation, []models.ConversationMessage{}, nil
+	}
+
+	messageIDs := make([]interface{}, len(messages))
+	for i, m := range messages {
+		index[m.ID] = i
+		messageIDs[i] = m.ID
+	}
+	attachmentRows, err := s.db.QueryContext(ctx, `
+		SELECT message_id, id, url, file_name, content_type, size
+		FROM conversation_attachments
+		WHERE message_id IN (`+placeholders(len(messageIDs))+`)
+		ORDER BY id`, messageIDs...)
+	if err != nil {
+		return models.Conversation{}, nil, fmt.Errorf("failed to query attachments: %v", err)
+	}
+	defer attachmentRows.Close()
+	for attachmentRows.Next() {
+		var messageID int
+		var a models.ConversationAttachment
+		if err := attachmentRows.Scan(&messageID, &a.ID, &a.URL, &a.FileName, &a.ContentType, &a.Size); err != nil {
+			return models.Conversation{}, nil, fmt.Errorf("failed to scan attachment: %v", err)
+		}
+		i := index[messageID]
+		messages[i].Attachments = append(messages[i].Attachments, a)
+	}
+	if err := attachmentRows.Err(); err != nil {
+		return models.Conversation{}, nil, fmt.Errorf("error iterating attachments: %v", err)
+	}
+
+	reads := make(map[string]int)
+	readRows, err := s.db.QueryContext(ctx, "SELECT party_type, last_read_message_id FROM conversation_reads WHERE conversation_id = ?", conversationID)
+	if err != nil {
+		return models.Conversation{}, nil, fmt.Errorf("failed to query read receipts: %v", err)
+	}
+	defer readRows.Close()
+	for readRows.Next() {
+		var party string
+		var lastRead int
+		if err := readRows.Scan(&party, &lastRead); err != nil {
+			return models.Conversation{}, nil, fmt.Errorf("failed to scan read receipt: %v", err)
+		}
+		reads[party] = lastRead
+	}
+	if err := readRows.Err(); err != nil {
+		return models.Conversation{}, nil, fmt.Errorf("error iterating read receipts: %v", err)
+	}
+
+	for i, m := range messages {
+		recipientType, _ := ref.recipient(m.SenderType)
+		messages[i].IsRead = reads[recipientType] >= m.ID
+	}
+
+	return conversation, messages, nil
+}
+
+// MarkConversationRead marks every message of a conversation as read for the party
+func (s *DBService) MarkConversationRead(ctx context.Context, partyType string, partyID, conversationID int) error {
+	ctx, span := tracer.Start(ctx, "DBService.MarkConversationRead")
+	defer span.End()
+	if _, err := conversationForParty(ctx, s.db, partyType, partyID, conversationID); err != nil {
+		return err
+	}
+	var lastMessageID int
+	err := s.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) FROM conversation_messages WHERE conversation_id = ?", conversationID).
+		Scan(&lastMessageID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch last message: %v", err)
+	}
+	if lastMessageID == 0 {
+		return nil
+	}
+	return markConversationRead(ctx, s.db, conversationID, partyType, lastMessageID)
+}
+
+// SetConversationStatus resolves or reopens a conversation
+func (s *DBService) SetConversationStatus(ctx context.Context, partyType string, partyID, conversationID int, status string) error {
+	ctx, span := tracer.Start(ctx, "DBService.SetConversationStatus")
+	defer span.End()
+	if status != models.ConversationStatusOpen && status != models.ConversationStatusResolved {
+		return ErrInvalidStatus
+	}
+	if _, err := conversationForParty(ctx, s.db, partyType, partyID, conversationID); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE conversations
+		SET status = ?, resolved_at = IF(? = 'resolved', COALESCE(resolved_at, CURRENT_TIMESTAMP), NULL)
+		WHERE id = ?`, status, status, conversationID)
+	if err != nil {
+		return fmt.Errorf("failed to update conversation status: %v", err)
+	}
+	return nil
+}
+
+// DeleteConversation removes a support conversation with its messages and attachment files
+func (s *DBService) DeleteConversation(ctx context.Context, conversationID int) error {
+	ctx, span := tracer.Start(ctx, "DBService.DeleteConversation")
+	defer span.End()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT a.url
+		FROM conversation_attachments a
+		JOIN conversation_messages m ON a.message_id = m.id
+		WHERE m.conversation_id = ?`, conversationID)
+	if err != nil {
+		return fmt.Errorf("failed to query attachments: %v", err)
+	}
+	var urls []string
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan attachment: %v", err)
+		}
+		urls = append(urls, url)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating attachments: %v", err)
+	}
+
+	result, err := s.db.ExecContext(ctx, "DELETE FROM conversations WHERE id = ? AND kind = 'support'", conversationID)
+	if err != nil {
+		return fmt.Errorf("failed to delete conversation: %v", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to check rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		return ErrConversationNotFound
+	}
+
+	s.scheduleUploadRemoval(ctx, urls)
+	return nil
+}
+
+// notifyConversationMessage tells the other side of a conversation about a new message.
+// Superadmin support has no inbox and is not notified.
+func (s *DBService) notifyConversationMessage(ctx context.Context, ref conversationRef, message models.ConversationMessage) {
+	recipientType, recipientID := ref.recipient(message.SenderType)
+	if recipientType == models.ConversationPartySuperadmin || recipientID == 0 {
+		return
+	}
+
+	body, bodyRu := message.Body, message.Body
+	if runes := []rune(body); len(runes) > conversationPreviewLength {
+		body = string(runes[:conversationPreviewLength]) + "…"
+		bodyRu = body
+	}
+	if body == "" {
+		body, bodyRu = "Sent an attachment", "Отправлено вложение"
+	}
+
+	title, titleRu := "New message", "Новое сообщение"
+	if message.SenderType == models.ConversationPartySuperadmin {
+		title, titleRu = "Reply from support", "Ответ поддержки"
+	}
+
+	s.notify(ctx, notification{
+		recipientType: recipientType,
+		recipientID:   recipientID,
+		kind:          models.NotificationNewMessage,
+		title:         title,
+		titleRu:       titleRu,
+		body:          body,
+		bodyRu:        bodyRu,
+		data: map[string]string{
+			"conversation_id": fmt.Sprint(message.ConversationID),
+			"kind":            ref.kind,
+		},
+	})
+}
+
+// nullIfZero maps a zero ID to SQL NULL
+func nullIfZero(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
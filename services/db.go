@@ -1,7 +1,7 @@
 package services
 
 import (
-	"log"
+	"log/slog"
 	"crypto/rand"
 	"database/sql"
 	"fmt"
@@ -18,7 +18,9 @@ import (
 	"Dowlet_projects/ecommerce/models"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/XSAM/otelsql"
 	"github.com/go-redis/redis/v8"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 	"golang.org/x/crypto/bcrypt"
 	"context"
 	"encoding/json"
@@ -26,8 +28,13 @@ import (
 
 // DBService handles database operations
 type DBService struct {
-	db    *sql.DB
-	redis *redis.Client
+	db           *sql.DB
+	redis        *redis.Client
+	jobTypes     map[string]jobType
+	notifier     Notifier
+	sms          SMSSender
+	// documentFont is embedded into PDF order documents; nil disables PDFs
+	documentFont *pdfFont
 }
 
 // ThumbnailData represents data for a thumbnail to be inserted
@@ -54,17 +61,23 @@ type ThumbnailWithProduct struct {
 // NewDBService creates a new database service with Redis
 func NewDBService(user, password, dbname, redisAddr string) (*DBService, error) {
 	connectionString := fmt.Sprintf("%s:%s@tcp(127.0.0.1:3306)/%s", user, password, dbname)
-	db, err := sql.Open("mysql", connectionString)
+	// Queries get client spans; their statements are recorded as they only hold placeholders
+	db, err := otelsql.Open("mysql", connectionString,
+		otelsql.WithAttributes(semconv.DBSystemMySQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{DisableErrSkip: true, OmitConnResetSession: true, OmitRows: true}))
 	if err != nil {
 		return nil, err
 	}
 	redisClient := redis.NewClient(&redis.Options{
 		Addr: redisAddr,
 	})
+	redisClient.AddHook(redisTracingHook{})
 	if _, err := redisClient.Ping(context.Background()).Result(); err != nil {
 		return nil, fmt.Errorf("failed to connect to Redis: %v", err)
 	}
-	return &DBService{db: db, redis: redisClient}, nil
+	s := &DBService{db: db, redis: redisClient, jobTypes: make(map[string]jobType), notifier: NewFakeNotifier(), sms: LogSMSSender{}}
+	s.registerJobHandlers()
+	return s, nil
 }
 
 // Close closes the database and Redis connections
@@ -74,9 +87,11 @@ func (s *DBService) Close() {
 }
 
 // SaveVerificationCode stores a verification code with registration data
-func (s *DBService) SaveVerificationCode(phone, code, fullName string) error {
+func (s *DBService) SaveVerificationCode(ctx context.Context, phone, code, fullName string) error {
+	ctx, span := tracer.Start(ctx, "DBService.SaveVerificationCode")
+	defer span.End()
 	expiresAt := time.Now().Add(5 * time.Minute)
-	_, err := s.db.Exec(
+	_, err := s.db.ExecContext(ctx, 
 		`INSERT INTO verification_codes (phone, code, expires_at, full_name)
 		 VALUES (?, ?, ?, ?)
 		 ON DUPLICATE KEY UPDATE code = ?, expires_at = ?, full_name = ?`,
@@ -88,11 +103,13 @@ func (s *DBService) SaveVerificationCode(phone, code, fullName string) error {
 	return nil
 }
 
-func (s *DBService) GetVerificationCode(phone string) (string, time.Time, string, error) {
+func (s *DBService) GetVerificationCode(ctx context.Context, phone string) (string, time.Time, string, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetVerificationCode")
+	defer span.End()
 	var code, fullName string
 	var expiresAtStr string // Temporary string to hold the expires_at value
-	err := s.db.QueryRow(
-		"SELECT code, expires_at, full_name FROM verification_codes WHERE phone = ?",
+	err := s.db.QueryRowContext(ctx, 
+		"SELECT code, expires_at, full_name FROM verification_codes WHERE phone = ? AND purpose = 'login'",
 		phone).Scan(&code, &expiresAtStr, &fullName)
 	if err != nil {
 		return "", time.Time{}, "", err
@@ -108,14 +125,18 @@ func (s *DBService) GetVerificationCode(phone string) (string, time.Time, string
 }
 
 // DeleteVerificationCode deletes a verification code
-func (s *DBService) DeleteVerificationCode(phone string) error {
-	_, err := s.db.Exec("DELETE FROM verification_codes WHERE phone = ?", phone)
+func (s *DBService) DeleteVerificationCode(ctx context.Context, phone string) error {
+	ctx, span := tracer.Start(ctx, "DBService.DeleteVerificationCode")
+	defer span.End()
+	_, err := s.db.ExecContext(ctx, "DELETE FROM verification_codes WHERE phone = ? AND purpose = 'login'", phone)
 	return err
 }
 
 // SaveUser saves a new user
-func (s *DBService) SaveUser(fullName, phone string) (int64, error) {
-	result, err := s.db.Exec(
+func (s *DBService) SaveUser(ctx context.Context, fullName, phone string) (int64, error) {
+	ctx, span := tracer.Start(ctx, "DBService.SaveUser")
+	defer span.End()
+	result, err := s.db.ExecContext(ctx, 
 		"INSERT INTO users (full_name, phone, verified) VALUES (?, ?, ?)",
 		fullName, phone, true)
 	if err != nil {
@@ -125,26 +146,31 @@ func (s *DBService) SaveUser(fullName, phone string) (int64, error) {
 }
 
 // GetUserByPhone retrieves a user by phone number
-func (s *DBService) GetUserByPhone(phone string) (int, error) {
+func (s *DBService) GetUserByPhone(ctx context.Context, phone string) (int, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetUserByPhone")
+	defer span.End()
 	var userID int
-	err := s.db.QueryRow("SELECT id FROM users WHERE phone = ?", phone).Scan(&userID)
-	fmt.Println(userID)
+	err := s.db.QueryRowContext(ctx, "SELECT id FROM users WHERE phone = ?", phone).Scan(&userID)
 	return userID, err
 }
 
 // GetMarkets retrieves all markets with caching
 func (s *DBService) GetMarkets(ctx context.Context, isNew, isVip bool, duration int) ([]models.Market, error) {
+    ctx, span := tracer.Start(ctx, "DBService.GetMarkets")
+    defer span.End()
     cacheKey := fmt.Sprintf("markets:new:%t:vip:%t:duration:%d", isNew, isVip, duration)
     cached, err := s.redis.Get(ctx, cacheKey).Result()
     if err == nil {
         var markets []models.Market
         if err := json.Unmarshal([]byte(cached), &markets); err == nil {
+            cacheLookups.Inc("markets", "hit")
             return markets, nil
         }
-        log.Printf("Failed to unmarshal cached markets: %v", err)
+        slog.WarnContext(ctx, "Failed to unmarshal cached markets", "error", err)
     } else if err != redis.Nil {
-        log.Printf("Redis get error: %v", err)
+        slog.WarnContext(ctx, "Failed to read cache", "key", cacheKey, "error", err)
     }
+    cacheLookups.Inc("markets", "miss")
 
     query := `SELECT id, name, name_ru, location, location_ru, thumbnail_url, delivery_price, phone, created_at,
               CASE WHEN DATEDIFF(CURDATE(), STR_TO_DATE(created_at, '%Y-%m-%d %H:%i:%s')) <= ? THEN true ELSE false END as isNew,
@@ -179,13 +205,13 @@ func (s *DBService) GetMarkets(ctx context.Context, isNew, isVip bool, duration
     if len(markets) > 0 {
         marketsJSON, err := json.Marshal(markets)
         if err != nil {
-            log.Printf("Failed to marshal markets: %v", err)
+            slog.WarnContext(ctx, "Failed to marshal markets for caching", "error", err)
         } else {
             pipe := s.redis.Pipeline()
             pipe.Set(ctx, cacheKey, marketsJSON, 1*time.Hour)
             pipe.SAdd(ctx, "markets_cache_keys", cacheKey)
             if _, err := pipe.Exec(ctx); err != nil {
-                log.Printf("Failed to set cache: %v", err)
+                slog.WarnContext(ctx, "Failed to set cache", "key", cacheKey, "error", err)
             }
         }
     }
@@ -195,6 +221,8 @@ func (s *DBService) GetMarkets(ctx context.Context, isNew, isVip bool, duration
 
 // GetMarketProducts retrieves paginated products for a market with caching
 func (s *DBService) GetMarketProducts(ctx context.Context, marketID, categoryID, page, limit int) ([]models.Product, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetMarketProducts")
+	defer span.End()
 	cacheKey := fmt.Sprintf("market:%d:products:page:%d:limit:%d", marketID, page, limit)
 
 	shouldCache := categoryID == 0
@@ -203,11 +231,11 @@ func (s *DBService) GetMarketProducts(ctx context.Context, marketID, categoryID,
 		if err == nil {
 			var products []models.Product
 			if err := json.Unmarshal([]byte(cached), &products); err == nil {
-				return products, nil
+				return products, s.attachBreadcrumbs(ctx, products)
 			}
-			log.Printf("Failed to unmarshal cached products: %v", err)
+			slog.WarnContext(ctx, "Failed to unmarshal cached products", "error", err)
 		} else if err != redis.Nil {
-			log.Printf("Redis get error: %v", err)
+			slog.WarnContext(ctx, "Failed to read cache", "key", cacheKey, "error", err)
 		}
 	}
 	
@@ -256,8 +284,13 @@ func (s *DBService) GetMarketProducts(ctx context.Context, marketID, categoryID,
 		args := []interface{}{marketID}
 
 		if categoryID != 0 {
-		query += " AND p.category_id = ?"
-		args = append(args, categoryID)
+		// A category matches its subcategories' products too
+		categoryIDs, err := s.categoryFilterIDs(ctx, categoryID)
+		if err != nil {
+			return nil, err
+		}
+		query += " AND p.category_id IN (" + placeholders(len(categoryIDs)) + ")"
+		args = append(args, categoryIDs...)
 	}
 
 	query += " ORDER BY p.id LIMIT ? OFFSET ?"
@@ -285,24 +318,24 @@ func (s *DBService) GetMarketProducts(ctx context.Context, marketID, categoryID,
 	if shouldCache && len(products) > 0 {
 		productsJSON, err := json.Marshal(products)
 		if err != nil {
-			log.Printf("Failed to marshal products: %v", err)
+			slog.WarnContext(ctx, "Failed to marshal products for caching", "error", err)
 		} else {
 			pipe := s.redis.Pipeline()
 			pipe.Set(ctx, cacheKey, productsJSON, 5*time.Minute)
 			pipe.SAdd(ctx, fmt.Sprintf("market:%d:products_cache_keys", marketID), cacheKey)
 			if _, err := pipe.Exec(ctx); err != nil {
-				log.Printf("Failed to set cache: %v", err)
+				slog.WarnContext(ctx, "Failed to set cache", "key", cacheKey, "error", err)
 			}
 		}
 	}
 
-	
-
-	return products, nil
+	return products, s.attachBreadcrumbs(ctx, products)
 }
 
 // GetMarketByID retrieves a market and its products by market ID with pagination
 func (s *DBService) GetMarketByID(ctx context.Context, marketID, categoryID, page, limit int) (*models.Market, []models.Product, int, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetMarketByID")
+	defer span.End()
 	var market models.Market
 	err := s.db.QueryRow(`
         SELECT id, phone, name, name_ru, location, location_ru, delivery_price, thumbnail_url
@@ -310,7 +343,7 @@ func (s *DBService) GetMarketByID(ctx context.Context, marketID, categoryID, pag
 		Scan(&market.ID, &market.Phone, &market.Name, &market.NameRu, &market.Location, &market.LocationRu, &market.DeliveryPrice, &market.ThumbnailURL)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, nil, 0, fmt.Errorf("market not found")
+			return nil, nil, 0, ErrMarketNotFound
 		}
 		return nil, nil, 0, fmt.Errorf("failed to query market: %v", err)
 	}
@@ -332,24 +365,27 @@ func (s *DBService) GetMarketByID(ctx context.Context, marketID, categoryID, pag
 
 // UpdateProduct updates a product, its thumbnail, and invalidates cache
 func (s *DBService) UpdateProduct(ctx context.Context, marketID, productID, categoryID int, name, nameRu string, price, discount float64, description, descriptionRu string, isActive bool, imageURL string) (oldImageURL string, err error) {
+    ctx, span := tracer.Start(ctx, "DBService.UpdateProduct")
+    defer span.End()
+    // Verify the market may sell in the category
+    if err := s.checkProductCategory(ctx, marketID, categoryID); err != nil {
+        return "", err
+    }
+
     // Begin transaction
     tx, err := s.db.BeginTx(ctx, nil)
     if err != nil {
-		fmt.Println(err)
         return "", fmt.Errorf("failed to start transaction: %v", err)
     }
     defer tx.Rollback()
-	fmt.Println(productID, marketID)
     // Verify product exists and belongs to market
     var thumbnailID *int
     err = tx.QueryRowContext(ctx, "SELECT thumbnail_id FROM products WHERE id = ? AND market_id = ?", productID, marketID).Scan(&thumbnailID)
     if err != nil {
-		fmt.Println(err)
         return "", fmt.Errorf("failed to validate product: %v", err)
     }
     if thumbnailID == nil {
-		fmt.Println("error thumbnail")
-        return "", fmt.Errorf("product not found or unauthorized")
+        return "", ErrProductNotOwned
     }
 
     // Fetch old image_url if thumbnail_id exists
@@ -357,7 +393,6 @@ func (s *DBService) UpdateProduct(ctx context.Context, marketID, productID, cate
     if *thumbnailID != 0 {
         err = tx.QueryRowContext(ctx, "SELECT COALESCE(image_url, '') FROM thumbnails WHERE id = ?", *thumbnailID).Scan(&oldImageURL)
         if err != nil {
-			fmt.Println(err)
             return "", fmt.Errorf("failed to fetch old image_url: %v", err)
         }
     }
@@ -367,19 +402,16 @@ func (s *DBService) UpdateProduct(ctx context.Context, marketID, productID, cate
 	
     // Update thumbnail if new image_url is provided
     if imageURL != "" && *thumbnailID != 0 {
-		fmt.Println(*thumbnailID)
         result, err := tx.ExecContext(ctx, "UPDATE thumbnails SET image_url = ? WHERE id = ?", thumbnailURL, *thumbnailID)
         if err != nil {
-			fmt.Println(err)
             return "", fmt.Errorf("failed to update thumbnail: %v", err)
         }
         rowsAffected, err := result.RowsAffected()
         if err != nil {
-			fmt.Println(err)
             return "", fmt.Errorf("failed to check thumbnail update: %v", err)
         }
         if rowsAffected == 0 {
-            return "", fmt.Errorf("thumbnail not found")
+            return "", ErrThumbnailNotFound
         }
     }
 
@@ -398,12 +430,11 @@ func (s *DBService) UpdateProduct(ctx context.Context, marketID, productID, cate
     //     return "", fmt.Errorf("failed to check product update: %v", err)
     // }
     // if rowsAffected == 0 {
-    //     return "", fmt.Errorf("product not found or unauthorized")
+    //     return "", ErrProductNotOwned
     // }
 
     // Commit transaction
     if err := tx.Commit(); err != nil {
-		fmt.Println(err)
         return "", fmt.Errorf("failed to commit transaction: %v", err)
     }
 
@@ -411,22 +442,20 @@ func (s *DBService) UpdateProduct(ctx context.Context, marketID, productID, cate
     pipe := s.redis.Pipeline()
     marketKeys, err := s.redis.SMembers(ctx, fmt.Sprintf("market:%d:products_cache_keys", marketID)).Result()
     if err == nil && len(marketKeys) > 0 {
-		fmt.Println(err)
         pipe.Del(ctx, marketKeys...)
     } else if err != nil && err != redis.Nil {
-        log.Printf("Failed to fetch market cache keys: %v", err)
+        slog.WarnContext(ctx, "Failed to fetch market cache keys", "error", err)
     }
 
     globalKeys, err := s.redis.SMembers(ctx, "global_products_cache_keys").Result()
     if err == nil && len(globalKeys) > 0 {
-		fmt.Println(err)
         pipe.Del(ctx, globalKeys...)
     } else if err != nil && err != redis.Nil {
-        log.Printf("Failed to fetch global cache keys: %v", err)
+        slog.WarnContext(ctx, "Failed to fetch global cache keys", "error", err)
     }
 
     if _, err := pipe.Exec(ctx); err != nil {
-        log.Printf("Failed to invalidate caches: %v", err)
+        slog.WarnContext(ctx, "Failed to invalidate caches", "error", err)
     }
 
     return oldImageURL, nil
@@ -434,6 +463,8 @@ func (s *DBService) UpdateProduct(ctx context.Context, marketID, productID, cate
 
 // GetPaginatedProducts retrieves products with pagination, optional filters, and sorting with caching
 func (s *DBService) GetPaginatedProducts(ctx context.Context, userID, categoryID, marketID, duration, page, limit int, search string, random bool, startPrice, endPrice float64, sort string, hasDiscount, isNew bool) ([]models.Product, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetPaginatedProducts")
+	defer span.End()
 	// Generate cache key (exclude duration, search, startPrice, endPrice)
 	cacheKey := fmt.Sprintf("products:cat:%d:page:%d:limit:%d:random:%t:sort:%s:discount:%t:new:%t",
 		categoryID, page, limit, random, sort, hasDiscount, isNew)
@@ -446,12 +477,14 @@ func (s *DBService) GetPaginatedProducts(ctx context.Context, userID, categoryID
 		if err == nil {
 			var products []models.Product
 			if err := json.Unmarshal([]byte(cached), &products); err == nil {
-				return products, nil
+				cacheLookups.Inc("products", "hit")
+				return products, s.attachBreadcrumbs(ctx, products)
 			}
-			log.Printf("Failed to unmarshal cached products: %v", err)
+			slog.WarnContext(ctx, "Failed to unmarshal cached products", "error", err)
 		} else if err != redis.Nil {
-			log.Printf("Redis get error: %v", err)
+			slog.WarnContext(ctx, "Failed to read cache", "key", cacheKey, "error", err)
 		}
+		cacheLookups.Inc("products", "miss")
 	}
 
 	// Pagination setup
@@ -506,10 +539,14 @@ func (s *DBService) GetPaginatedProducts(ctx context.Context, userID, categoryID
 	args := []interface{}{queryDuration, userID}
 
 	if categoryID != 0 {
-		query += " AND p.category_id = ?"
-		args = append(args, categoryID)
+		// A category matches its subcategories' products too
+		categoryIDs, err := s.categoryFilterIDs(ctx, categoryID)
+		if err != nil {
+			return nil, err
+		}
+		query += " AND p.category_id IN (" + placeholders(len(categoryIDs)) + ")"
+		args = append(args, categoryIDs...)
 	}
-	fmt.Println(marketID)
 	if marketID != 0 {
 		query += " AND p.market_id = ?"
 		args = append(args, marketID)
@@ -571,24 +608,26 @@ func (s *DBService) GetPaginatedProducts(ctx context.Context, userID, categoryID
 	if shouldCache && len(products) > 0 {
 		productsJSON, err := json.Marshal(products)
 		if err != nil {
-			log.Printf("Failed to marshal products: %v", err)
+			slog.WarnContext(ctx, "Failed to marshal products for caching", "error", err)
 		} else {
 			pipe := s.redis.Pipeline()
 			pipe.Set(ctx, cacheKey, productsJSON, 3*time.Minute)
 			pipe.SAdd(ctx, "global_products_cache_keys", cacheKey)
 			if _, err := pipe.Exec(ctx); err != nil {
-				log.Printf("Failed to set cache: %v", err)
+				slog.WarnContext(ctx, "Failed to set cache", "key", cacheKey, "error", err)
 			}
 		}
 	}
 
-	return products, nil
+	return products, s.attachBreadcrumbs(ctx, products)
 }
 
 // GetProduct retrieves a single product by ID
-func (s *DBService) GetProduct(id string, userID int) (models.Product, error) {
+func (s *DBService) GetProduct(ctx context.Context, id string, userID int) (models.Product, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetProduct")
+	defer span.End()
 	var p models.Product
-	err := s.db.QueryRow(`
+	err := s.db.QueryRowContext(ctx, `
 		SELECT 
 			p.id, 
 			p.market_id, 
@@ -625,13 +664,28 @@ func (s *DBService) GetProduct(id string, userID int) (models.Product, error) {
 		return p, err
 	}
 
-	p.Thumbnails, err = s.getProductDetails(p.ID)
+	ix, err := s.getCategoryIndex(ctx)
+	if err != nil {
+		return p, err
+	}
+	p.Breadcrumbs = ix.path(p.CategoryID)
+
+	p.Thumbnails, err = s.getProductDetails(ctx, p.ID)
+	if err != nil {
+		return p, err
+	}
+
+	p.Options, err = s.GetProductOptions(ctx, p.ID)
+	if err != nil {
+		return p, err
+	}
+	p.Variants, err = s.GetProductVariants(ctx, p.ID, true)
 	return p, err
 }
 
 // getProductDetails retrieves thumbnails and sizes for a product
-func (s *DBService) getProductDetails(productID int) ([]models.Thumbnail, error) {
-	thumbRows, err := s.db.Query("SELECT id, product_id, color, color_ru, image_url FROM thumbnails WHERE product_id = ?", productID)
+func (s *DBService) getProductDetails(ctx context.Context, productID int) ([]models.Thumbnail, error) {
+	thumbRows, err := s.db.QueryContext(ctx, "SELECT id, product_id, color, color_ru, image_url FROM thumbnails WHERE product_id = ?", productID)
 	if err != nil {
 		return nil, err
 	}
@@ -644,7 +698,12 @@ func (s *DBService) getProductDetails(productID int) ([]models.Thumbnail, error)
 		if err := thumbRows.Scan(&t.ID, &t.ProductID, &t.Color, &t.ColorRu, &t.ImageURL); err != nil {
 			return nil, err
 		}
-		sizeRows, err := s.db.Query("SELECT id, thumbnail_id, size, count, price FROM sizes WHERE thumbnail_id = ?", t.ID)
+		// Variants own price and stock since the variant migration; sizes mirror them
+		sizeRows, err := s.db.QueryContext(ctx, `
+			SELECT s.id, s.thumbnail_id, s.size, COALESCE(v.stock, s.count), COALESCE(v.price, s.price)
+			FROM sizes s
+			LEFT JOIN product_variants v ON v.legacy_size_id = s.id
+			WHERE s.thumbnail_id = ?`, t.ID)
 		if err != nil {
 			return nil, err
 		}
@@ -665,6 +724,8 @@ func (s *DBService) getProductDetails(productID int) ([]models.Thumbnail, error)
 
 // CreateProduct creates a new product and invalidates cache
 func (s *DBService) CreateProduct(ctx context.Context, marketID, categoryID int, name, name_ru string, price, discount float64, description, description_ru string, is_active bool, urlPath, filePath, filename string) (int, error) {
+    ctx, span := tracer.Start(ctx, "DBService.CreateProduct")
+    defer span.End()
     // Verify market exists
     var exists bool
     err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM markets WHERE id = ?)", marketID).Scan(&exists)
@@ -672,16 +733,12 @@ func (s *DBService) CreateProduct(ctx context.Context, marketID, categoryID int,
         return 0, fmt.Errorf("failed to validate market: %v", err)
     }
     if !exists {
-        return 0, fmt.Errorf("market not found")
+        return 0, ErrMarketNotFound
     }
 
-    // Verify category exists
-    err = s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM categories WHERE id = ?)", categoryID).Scan(&exists)
-    if err != nil {
-        return 0, fmt.Errorf("failed to validate category: %v", err)
-    }
-    if !exists {
-        return 0, fmt.Errorf("category not found")
+    // Verify the market may sell in the category
+    if err := s.checkProductCategory(ctx, marketID, categoryID); err != nil {
+        return 0, err
     }
 
     // Begin transaction
@@ -713,7 +770,7 @@ func (s *DBService) CreateProduct(ctx context.Context, marketID, categoryID int,
         }
         if !exists {
             os.Remove(filePath)
-            return 0, fmt.Errorf("thumbnail not found")
+            return 0, ErrThumbnailNotFound
         }
     }
 
@@ -746,32 +803,36 @@ func (s *DBService) CreateProduct(ctx context.Context, marketID, categoryID int,
     if err == nil && len(marketKeys) > 0 {
         pipe.Del(ctx, marketKeys...)
     } else if err != nil && err != redis.Nil {
-        log.Printf("Failed to fetch market cache keys: %v", err)
+        slog.WarnContext(ctx, "Failed to fetch market cache keys", "error", err)
     }
 
     globalKeys, err := s.redis.SMembers(ctx, "global_products_cache_keys").Result()
     if err == nil && len(globalKeys) > 0 {
         pipe.Del(ctx, globalKeys...)
     } else if err != nil && err != redis.Nil {
-        log.Printf("Failed to fetch global cache keys: %v", err)
+        slog.WarnContext(ctx, "Failed to fetch global cache keys", "error", err)
     }
 
     if _, err := pipe.Exec(ctx); err != nil {
-        log.Printf("Failed to invalidate caches: %v", err)
+        slog.WarnContext(ctx, "Failed to invalidate caches", "error", err)
     }
 
     return int(productID), nil
 }
 
 // UpdateMarketThumbnail updates the thumbnail for a market
-func (s *DBService) UpdateMarketThumbnail(marketID, thumbnailURL string) error {
-	_, err := s.db.Exec("UPDATE markets SET thumbnail_url = ? WHERE id = ?", thumbnailURL, marketID)
+func (s *DBService) UpdateMarketThumbnail(ctx context.Context, marketID, thumbnailURL string) error {
+	ctx, span := tracer.Start(ctx, "DBService.UpdateMarketThumbnail")
+	defer span.End()
+	_, err := s.db.ExecContext(ctx, "UPDATE markets SET thumbnail_url = ? WHERE id = ?", thumbnailURL, marketID)
 	return err
 }
 
 // GetProductThumbnails retrieves thumbnails for a product
-func (s *DBService) GetProductThumbnails(productID string) ([]models.Thumbnail, error) {
-	rows, err := s.db.Query("SELECT id, product_id, color, image_url FROM thumbnails WHERE product_id = ?", productID)
+func (s *DBService) GetProductThumbnails(ctx context.Context, productID string) ([]models.Thumbnail, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetProductThumbnails")
+	defer span.End()
+	rows, err := s.db.QueryContext(ctx, "SELECT id, product_id, color, image_url FROM thumbnails WHERE product_id = ?", productID)
 	if err != nil {
 		return nil, err
 	}
@@ -789,6 +850,8 @@ func (s *DBService) GetProductThumbnails(productID string) ([]models.Thumbnail,
 }
 // DeleteProduct deletes a product and its thumbnails and invalidates cache
 func (s *DBService) DeleteProduct(ctx context.Context, marketID, productID int) error {
+    ctx, span := tracer.Start(ctx, "DBService.DeleteProduct")
+    defer span.End()
     // Begin transaction
     tx, err := s.db.BeginTx(ctx, nil)
     if err != nil {
@@ -805,7 +868,7 @@ func (s *DBService) DeleteProduct(ctx context.Context, marketID, productID int)
         return fmt.Errorf("failed to validate product: %v", err)
     }
     if !exists {
-        return fmt.Errorf("product not found or unauthorized")
+        return ErrProductNotOwned
     }
 
     // Fetch legacy thumbnails (linked via product_id)
@@ -826,6 +889,10 @@ func (s *DBService) DeleteProduct(ctx context.Context, marketID, productID int)
         }
     }
 
+    if err := deleteProductTranslations(ctx, tx, "id = ?", productID); err != nil {
+        return err
+    }
+
     // Delete legacy thumbnails (sizes are deleted via CASCADE)
     _, err = tx.ExecContext(ctx, "DELETE FROM thumbnails WHERE product_id = ?", productID)
     if err != nil {
@@ -859,7 +926,7 @@ func (s *DBService) DeleteProduct(ctx context.Context, marketID, productID int)
         return fmt.Errorf("failed to check rows affected: %v", err)
     }
     if rowsAffected == 0 {
-        return fmt.Errorf("product not found or unauthorized")
+        return ErrProductNotOwned
     }
 
     // Commit transaction
@@ -875,7 +942,7 @@ func (s *DBService) DeleteProduct(ctx context.Context, marketID, productID int)
     for _, imageURL := range imageURLs {
         filePath := filepath.Join(uploadDir, filepath.Base(imageURL))
         if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
-            log.Printf("Warning: failed to delete file %s: %v", filePath, err)
+            slog.Warn("Failed to delete file", "path", filePath, "error", err)
         }
     }
 
@@ -885,32 +952,34 @@ func (s *DBService) DeleteProduct(ctx context.Context, marketID, productID int)
     if err == nil && len(marketKeys) > 0 {
         pipe.Del(ctx, marketKeys...)
     } else if err != nil && err != redis.Nil {
-        log.Printf("Failed to fetch market cache keys: %v", err)
+        slog.WarnContext(ctx, "Failed to fetch market cache keys", "error", err)
     }
 
     globalKeys, err := s.redis.SMembers(ctx, "global_products_cache_keys").Result()
     if err == nil && len(globalKeys) > 0 {
         pipe.Del(ctx, globalKeys...)
     } else if err != nil && err != redis.Nil {
-        log.Printf("Failed to fetch global cache keys: %v", err)
+        slog.WarnContext(ctx, "Failed to fetch global cache keys", "error", err)
     }
 
     if _, err := pipe.Exec(ctx); err != nil {
-        log.Printf("Failed to invalidate caches: %v", err)
+        slog.WarnContext(ctx, "Failed to invalidate caches", "error", err)
     }
 
     return nil
 }
 // CreateMarket creates a market and invalidates related caches
 func (s *DBService) CreateMarket(ctx context.Context, name, name_ru, location, location_ru, thumbnailURL, phone, password string, deliveryPrice float64) (string, string, error) {
-    // Verify phone doesn't exist
+    ctx, span := tracer.Start(ctx, "DBService.CreateMarket")
+    defer span.End()
+    // Verify phone doesn't exist; staff phones share the market login namespace with owner phones
     var exists bool
-    err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM markets WHERE phone = ?)", phone).Scan(&exists)
+    err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM markets WHERE phone = ?) OR EXISTS(SELECT 1 FROM market_staff WHERE phone = ?)", phone, phone).Scan(&exists)
     if err != nil {
         return "", "", fmt.Errorf("failed to check phone: %v", err)
     }
     if exists {
-        return "", "", fmt.Errorf("phone already exists")
+        return "", "", ErrPhoneTaken
     }
 
     // Hash password
@@ -933,6 +1002,11 @@ func (s *DBService) CreateMarket(ctx context.Context, name, name_ru, location, l
         return "", "", fmt.Errorf("failed to retrieve market ID: %v", err)
     }
 
+    // Orders are numbered under M<id> until the market picks its own prefix
+    if _, err := s.db.ExecContext(ctx, "UPDATE markets SET order_prefix = CONCAT('M', id) WHERE id = ?", marketID); err != nil {
+        return "", "", fmt.Errorf("failed to set order prefix: %v", err)
+    }
+
     // Invalidate caches using pipeline
     pipe := s.redis.Pipeline()
 
@@ -943,7 +1017,7 @@ func (s *DBService) CreateMarket(ctx context.Context, name, name_ru, location, l
         pipe.Del(ctx, marketKeys...)
         pipe.Del(ctx, marketCacheKey)
     } else if err != nil && err != redis.Nil {
-        log.Printf("Failed to fetch market cache keys: %v", err)
+        slog.WarnContext(ctx, "Failed to fetch market cache keys", "error", err)
     }
 
     // Invalidate global markets caches
@@ -952,63 +1026,69 @@ func (s *DBService) CreateMarket(ctx context.Context, name, name_ru, location, l
         pipe.Del(ctx, globalMarketKeys...)
         pipe.Del(ctx, "markets_cache_keys")
     } else if err != nil && err != redis.Nil {
-        log.Printf("Failed to fetch global markets cache keys: %v", err)
+        slog.WarnContext(ctx, "Failed to fetch global markets cache keys", "error", err)
     }
 
     if _, err := pipe.Exec(ctx); err != nil {
-        log.Printf("Failed to invalidate caches: %v", err)
+        slog.WarnContext(ctx, "Failed to invalidate caches", "error", err)
     }
 
     return phone, strconv.Itoa(int(marketID)), nil
 }
 
 // AuthenticateMarket authenticates a market admin
-func (s *DBService) AuthenticateMarket(phone, password string) (int, int, error) {
+func (s *DBService) AuthenticateMarket(ctx context.Context, phone, password string) (int, int, error) {
+	ctx, span := tracer.Start(ctx, "DBService.AuthenticateMarket")
+	defer span.End()
 	var userID, marketID int
 	var passwordHash string
-	err := s.db.QueryRow("SELECT id, id, password FROM markets WHERE phone = ?", phone).Scan(&userID, &marketID, &passwordHash)
+	err := s.db.QueryRowContext(ctx, "SELECT id, id, password FROM markets WHERE phone = ?", phone).Scan(&userID, &marketID, &passwordHash)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return 0, 0, fmt.Errorf("invalid credentials")
+			return 0, 0, ErrInvalidCredentials
 		}
 		return 0, 0, fmt.Errorf("failed to query market: %v", err)
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)); err != nil {
-		return 0, 0, fmt.Errorf("invalid credentials")
+		return 0, 0, ErrInvalidCredentials
 	}
 
 	return userID, marketID, nil
 }
 
 // AuthenticateSuperadmin authenticates a superadmin
-func (s *DBService) AuthenticateSuperadmin(username, password string) (int, error) {
+func (s *DBService) AuthenticateSuperadmin(ctx context.Context, username, password string) (int, error) {
+	ctx, span := tracer.Start(ctx, "DBService.AuthenticateSuperadmin")
+	defer span.End()
 	var userID int
 	var passwordHash string
-	err := s.db.QueryRow("SELECT id, password FROM superadmins WHERE username = ?", username).Scan(&userID, &passwordHash)
+	err := s.db.QueryRowContext(ctx, "SELECT id, password FROM superadmins WHERE username = ?", username).Scan(&userID, &passwordHash)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return 0, fmt.Errorf("invalid credentials")
+			return 0, ErrInvalidCredentials
 		}
 		return 0, fmt.Errorf("failed to query superadmin: %v", err)
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)); err != nil {
-		return 0, fmt.Errorf("invalid credentials")
+		return 0, ErrInvalidCredentials
 	}
 
 	return userID, nil
 }
 
 // RegisterSuperadmin registers a new superadmin
-func (s *DBService) RegisterSuperadmin(username, fullName, phone, password string) (int, error) {
+func (s *DBService) RegisterSuperadmin(ctx context.Context, username, fullName, phone, password string) (int, error) {
+	ctx, span := tracer.Start(ctx, "DBService.RegisterSuperadmin")
+	defer span.End()
 	var exists bool
-	err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM superadmins WHERE username = ? OR phone = ?)", username, phone).Scan(&exists)
+	err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM superadmins WHERE username = ? OR phone = ?)", username, phone).Scan(&exists)
 	if err != nil {
 		return 0, fmt.Errorf("failed to check username/phone: %v", err)
 	}
 	if exists {
-		return 0, fmt.Errorf("username or phone already exists")
+		return 0, ErrUsernameOrPhoneTaken
 	}
 
 	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -1016,7 +1096,7 @@ func (s *DBService) RegisterSuperadmin(username, fullName, phone, password strin
 		return 0, fmt.Errorf("failed to hash password: %v", err)
 	}
 
-	result, err := s.db.Exec(`
+	result, err := s.db.ExecContext(ctx, `
 		INSERT INTO superadmins (username, full_name, phone, password)
 		VALUES (?, ?, ?, ?)`,
 		username, fullName, phone, passwordHash)
@@ -1033,20 +1113,22 @@ func (s *DBService) RegisterSuperadmin(username, fullName, phone, password strin
 }
 
 // RegisterUser registers a user
-func (s *DBService) RegisterUser(fullName, phone string) (int, string, error) {
+func (s *DBService) RegisterUser(ctx context.Context, fullName, phone string) (int, string, error) {
+	ctx, span := tracer.Start(ctx, "DBService.RegisterUser")
+	defer span.End()
 	var exists bool
-	err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE phone = ?)", phone).Scan(&exists)
+	err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE phone = ?)", phone).Scan(&exists)
 	if err != nil {
 		return 0, "", fmt.Errorf("failed to check phone: %v", err)
 	}
 	if exists {
-		return 0, "", fmt.Errorf("phone number already registered")
+		return 0, "", ErrPhoneRegistered
 	}
 
 	otp := generateOTP(4)
 	expiresAt := time.Now().Add(5 * time.Minute)
 
-	result, err := s.db.Exec("INSERT INTO verification_codes (phone, code, expires_at, full_name) VALUES (?, ?, ?, ?)",
+	result, err := s.db.ExecContext(ctx, "INSERT INTO verification_codes (phone, code, expires_at, full_name) VALUES (?, ?, ?, ?)",
 		phone, otp, expiresAt, fullName)
 	if err != nil {
 		return 0, "", fmt.Errorf("failed to store verification: %v", err)
@@ -1061,30 +1143,32 @@ func (s *DBService) RegisterUser(fullName, phone string) (int, string, error) {
 }
 
 // VerifyUserOTP verifies OTP and creates/updates a user
-func (s *DBService) VerifyUserOTP(phone, otp string) (int, error) {
+func (s *DBService) VerifyUserOTP(ctx context.Context, phone, otp string) (int, error) {
+	ctx, span := tracer.Start(ctx, "DBService.VerifyUserOTP")
+	defer span.End()
 	var code string
 	var expiresAt time.Time
 	var fullName string
-	err := s.db.QueryRow("SELECT code, expires_at, full_name FROM verification_codes WHERE phone = ?", phone).Scan(&code, &expiresAt, &fullName)
+	err := s.db.QueryRowContext(ctx, "SELECT code, expires_at, full_name FROM verification_codes WHERE phone = ? AND purpose = 'login'", phone).Scan(&code, &expiresAt, &fullName)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return 0, fmt.Errorf("no verification code found")
+			return 0, ErrNoVerificationCode
 		}
 		return 0, fmt.Errorf("failed to query verification code: %v", err)
 	}
 
 	if code != otp || time.Now().After(expiresAt) {
-		return 0, fmt.Errorf("invalid or expired OTP")
+		return 0, ErrInvalidOTP
 	}
 
 	var userID int
-	err = s.db.QueryRow("SELECT id FROM users WHERE phone = ?", phone).Scan(&userID)
+	err = s.db.QueryRowContext(ctx, "SELECT id FROM users WHERE phone = ?", phone).Scan(&userID)
 	if err != nil && err != sql.ErrNoRows {
 		return 0, fmt.Errorf("failed to check user: %v", err)
 	}
 
 	if err == sql.ErrNoRows {
-		result, err := s.db.Exec("INSERT INTO users (full_name, phone, verified) VALUES (?, ?, 1)", fullName, phone)
+		result, err := s.db.ExecContext(ctx, "INSERT INTO users (full_name, phone, verified) VALUES (?, ?, 1)", fullName, phone)
 		if err != nil {
 			return 0, fmt.Errorf("failed to create user: %v", err)
 		}
@@ -1094,13 +1178,13 @@ func (s *DBService) VerifyUserOTP(phone, otp string) (int, error) {
 		}
 		userID = int(userID64)
 	} else {
-		_, err = s.db.Exec("UPDATE users SET verified = 1 WHERE id = ?", userID)
+		_, err = s.db.ExecContext(ctx, "UPDATE users SET verified = 1 WHERE id = ?", userID)
 		if err != nil {
 			return 0, fmt.Errorf("failed to update user: %v", err)
 		}
 	}
 
-	_, err = s.db.Exec("DELETE FROM verification_codes WHERE phone = ?", phone)
+	_, err = s.db.ExecContext(ctx, "DELETE FROM verification_codes WHERE phone = ? AND purpose = 'login'", phone)
 	if err != nil {
 		return 0, fmt.Errorf("failed to clear verification code: %v", err)
 	}
@@ -1108,8 +1192,10 @@ func (s *DBService) VerifyUserOTP(phone, otp string) (int, error) {
 	return userID, nil
 }
 // DeleteMarket deletes a market, its products, and thumbnails
-func (s *DBService) DeleteMarket(marketID int) error {
-	tx, err := s.db.Begin()
+func (s *DBService) DeleteMarket(ctx context.Context, marketID int) error {
+	ctx, span := tracer.Start(ctx, "DBService.DeleteMarket")
+	defer span.End()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("failed to start transaction: %v", err)
 	}
@@ -1117,16 +1203,16 @@ func (s *DBService) DeleteMarket(marketID int) error {
 
 	// Verify market exists
 	var marketThumbnailURL string
-	err = tx.QueryRow("SELECT thumbnail_url FROM markets WHERE id = ?", marketID).Scan(&marketThumbnailURL)
+	err = tx.QueryRowContext(ctx, "SELECT thumbnail_url FROM markets WHERE id = ?", marketID).Scan(&marketThumbnailURL)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return fmt.Errorf("market not found")
+			return ErrMarketNotFound
 		}
 		return fmt.Errorf("failed to validate market: %v", err)
 	}
 
 	// Fetch all products and their thumbnails
-	rows, err := tx.Query(`
+	rows, err := tx.QueryContext(ctx, `
 		SELECT t.image_url
 		FROM thumbnails t
 		JOIN products p ON t.product_id = p.id
@@ -1147,9 +1233,15 @@ func (s *DBService) DeleteMarket(marketID int) error {
 		}
 	}
 
+	if err := deleteProductTranslations(ctx, tx, "market_id = ?", marketID); err != nil {
+		return err
+	}
+	if err := deleteTranslations(ctx, tx, "markets", marketID); err != nil {
+		return err
+	}
 
 	// Delete thumbnails (sizes are deleted via CASCADE)
-	_, err = tx.Exec(`
+	_, err = tx.ExecContext(ctx, `
 		DELETE t FROM thumbnails t
 		JOIN products p ON t.product_id = p.id
 		WHERE p.market_id = ?`, marketID)
@@ -1158,13 +1250,13 @@ func (s *DBService) DeleteMarket(marketID int) error {
 	}
 
 	// Delete products
-	_, err = tx.Exec("DELETE FROM products WHERE market_id = ?", marketID)
+	_, err = tx.ExecContext(ctx, "DELETE FROM products WHERE market_id = ?", marketID)
 	if err != nil {
 		return fmt.Errorf("failed to delete products: %v", err)
 	}
 
 	// Delete market
-	result, err := tx.Exec("DELETE FROM markets WHERE id = ?", marketID)
+	result, err := tx.ExecContext(ctx, "DELETE FROM markets WHERE id = ?", marketID)
 	if err != nil {
 		return fmt.Errorf("failed to delete market: %v", err)
 	}
@@ -1174,7 +1266,7 @@ func (s *DBService) DeleteMarket(marketID int) error {
 		return fmt.Errorf("failed to check rows affected: %v", err)
 	}
 	if rowsAffected == 0 {
-		return fmt.Errorf("market not found")
+		return ErrMarketNotFound
 	}
 
 	// Commit transaction
@@ -1190,7 +1282,7 @@ func (s *DBService) DeleteMarket(marketID int) error {
 	for _, imageURL := range imageURLs {
 		filePath := filepath.Join(uploadDir+"/products", filepath.Base(imageURL))
 		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
-			log.Printf("Warning: failed to delete file %s: %v", filePath, err)
+			slog.Warn("Failed to delete file", "path", filePath, "error", err)
 		}
 	}
 
@@ -1198,31 +1290,33 @@ func (s *DBService) DeleteMarket(marketID int) error {
 	if marketThumbnailURL != "" {
 		filePath := filepath.Join(uploadDir+"/markets", filepath.Base(marketThumbnailURL))
 		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
-			log.Printf("Warning: failed to delete market thumbnail %s: %v", filePath, err)
+			slog.Warn("Failed to delete market thumbnail", "path", filePath, "error", err)
 		}
 	}
 
 	// Invalidate cache
-	marketKeys, err := s.redis.SMembers(context.Background(), "markets_cache_keys").Result()
+	marketKeys, err := s.redis.SMembers(ctx, "markets_cache_keys").Result()
 	if err == nil && len(marketKeys) > 0 {
-		s.redis.Del(context.Background(), marketKeys...)
+		s.redis.Del(ctx, marketKeys...)
 	} else if err != nil && err != redis.Nil {
-		log.Printf("Failed to invalidate markets cache: %v", err)
+		slog.Warn("Failed to invalidate markets cache", "error", err)
 	}
 
 	// Also invalidate market-specific product caches
-	marketProductKeys, err := s.redis.SMembers(context.Background(), fmt.Sprintf("market:%d:products_cache_keys", marketID)).Result()
+	marketProductKeys, err := s.redis.SMembers(ctx, fmt.Sprintf("market:%d:products_cache_keys", marketID)).Result()
 	if err == nil && len(marketProductKeys) > 0 {
-		s.redis.Del(context.Background(), marketProductKeys...)
+		s.redis.Del(ctx, marketProductKeys...)
 	} else if err != nil && err != redis.Nil {
-		log.Printf("Failed to invalidate market product cache: %v", err)
+		slog.Warn("Failed to invalidate market product cache", "market_id", marketID, "error", err)
 	}
 
 	return nil
 }
 
-func (s *DBService) CreateThumbnails(thumbnails []ThumbnailData) (int64, error) {
-	tx, err := s.db.Begin()
+func (s *DBService) CreateThumbnails(ctx context.Context, thumbnails []ThumbnailData) (int64, error) {
+	ctx, span := tracer.Start(ctx, "DBService.CreateThumbnails")
+	defer span.End()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return 0, fmt.Errorf("failed to start transaction: %v", err)
 	}
@@ -1230,7 +1324,7 @@ func (s *DBService) CreateThumbnails(thumbnails []ThumbnailData) (int64, error)
 
 	var lastInsertID int64
 	for _, thumb := range thumbnails {
-		result, err := tx.Exec("INSERT INTO thumbnails (product_id, color, color_ru, image_url) VALUES (?, ?, ?, ?)",
+		result, err := tx.ExecContext(ctx, "INSERT INTO thumbnails (product_id, color, color_ru, image_url) VALUES (?, ?, ?, ?)",
 			thumb.ProductID, thumb.Color, thumb.ColorRu, thumb.ImageURL)
 		if err != nil {
 			return 0, fmt.Errorf("failed to insert thumbnail: %v", err)
@@ -1251,22 +1345,43 @@ func (s *DBService) CreateThumbnails(thumbnails []ThumbnailData) (int64, error)
 }
 
 // DeleteThumbnail deletes a thumbnail by its ID
-func (s *DBService) DeleteThumbnail(marketID int, thumbnailID string) error {
+func (s *DBService) DeleteThumbnail(ctx context.Context, marketID int, thumbnailID string) error {
+	ctx, span := tracer.Start(ctx, "DBService.DeleteThumbnail")
+	defer span.End()
 	// Verify thumbnail exists and belongs to market's product
 	var imageURL string
-	err := s.db.QueryRow(`
+	err := s.db.QueryRowContext(ctx, `
 		SELECT t.image_url 
 		FROM thumbnails t 
 		JOIN products p ON t.product_id = p.id 
 		WHERE t.id = ? AND p.market_id = ?`, thumbnailID, marketID).Scan(&imageURL)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return fmt.Errorf("thumbnail not found or unauthorized")
+			return ErrThumbnailNotOwned
 		}
 		return fmt.Errorf("failed to retrieve thumbnail: %v", err)
 	}
 
-	result, err := s.db.Exec("DELETE FROM thumbnails WHERE id = ?", thumbnailID)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// Sizes go with the thumbnail via CASCADE; their variants have to be removed explicitly
+	_, err = tx.ExecContext(ctx, `
+		DELETE v FROM product_variants v
+		JOIN sizes s ON v.legacy_size_id = s.id
+		WHERE s.thumbnail_id = ?`, thumbnailID)
+	if err != nil {
+		return fmt.Errorf("failed to delete variants: %v", err)
+	}
+
+	if err := deleteTranslations(ctx, tx, "thumbnails", thumbnailID); err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM thumbnails WHERE id = ?", thumbnailID)
 	if err != nil {
 		return fmt.Errorf("failed to delete thumbnail: %v", err)
 	}
@@ -1276,7 +1391,11 @@ func (s *DBService) DeleteThumbnail(marketID int, thumbnailID string) error {
 		return fmt.Errorf("failed to check rows affected: %v", err)
 	}
 	if rowsAffected == 0 {
-		return fmt.Errorf("thumbnail not found")
+		return ErrThumbnailNotFound
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
 	}
 
 	uploadDir := os.Getenv("UPLOAD_DIR")
@@ -1288,19 +1407,21 @@ func (s *DBService) DeleteThumbnail(marketID int, thumbnailID string) error {
 	if imageURL != "" {
 		filePath := filepath.Join(uploadDir, filepath.Base(imageURL))
 			if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
-				log.Printf("Warning: failed to delete file %s: %v", filePath, err)
+				slog.Warn("Failed to delete file", "path", filePath, "error", err)
 			}
 	}
 
 	// Invalidate cache
-	s.redis.Del(context.Background(), fmt.Sprintf("market:%d:products:*", marketID))
+	s.redis.Del(ctx, fmt.Sprintf("market:%d:products:*", marketID))
 
 	return nil
 }
 
 // GetAllThumbnailsWithProducts retrieves all thumbnails with associated product information
-func (s *DBService) GetAllThumbnailsWithProducts() ([]ThumbnailWithProduct, error) {
-	rows, err := s.db.Query(`
+func (s *DBService) GetAllThumbnailsWithProducts(ctx context.Context) ([]ThumbnailWithProduct, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetAllThumbnailsWithProducts")
+	defer span.End()
+	rows, err := s.db.QueryContext(ctx, `
 		SELECT t.id, t.product_id, t.color, t.image_url, 
 		       p.name, p.price, p.discount, p.description, p.created_at
 		FROM thumbnails t
@@ -1324,17 +1445,19 @@ func (s *DBService) GetAllThumbnailsWithProducts() ([]ThumbnailWithProduct, erro
 }
 
 // CreateSizeByThumbnailID creates a size linked to a thumbnail
-func (s *DBService) CreateSizeByThumbnailID(marketID int, thumbnailID string, size string, count int, price float64) error {
+func (s *DBService) CreateSizeByThumbnailID(ctx context.Context, marketID int, thumbnailID string, size string, count int, price float64) error {
+	ctx, span := tracer.Start(ctx, "DBService.CreateSizeByThumbnailID")
+	defer span.End()
 	if size == "" {
-		return fmt.Errorf("size cannot be empty")
+		return ErrSizeRequired
 	}
 	if count < 0 {
-		return fmt.Errorf("count cannot be negative")
+		return ErrNegativeCount
 	}
 
 	// Verify thumbnail exists and belongs to market's product
 	var exists bool
-	err := s.db.QueryRow(`
+	err := s.db.QueryRowContext(ctx, `
 		SELECT EXISTS(
 			SELECT 1 
 			FROM thumbnails t 
@@ -1345,7 +1468,7 @@ func (s *DBService) CreateSizeByThumbnailID(marketID int, thumbnailID string, si
 		return fmt.Errorf("failed to validate thumbnail: %v", err)
 	}
 	if !exists {
-		return fmt.Errorf("thumbnail not found or unauthorized")
+		return ErrThumbnailNotOwned
 	}
 
 	thumbnailIDInt, err := strconv.Atoi(thumbnailID)
@@ -1353,23 +1476,44 @@ func (s *DBService) CreateSizeByThumbnailID(marketID int, thumbnailID string, si
 		return fmt.Errorf("invalid thumbnail ID: %v", err)
 	}
 
-	_, err = s.db.Exec("INSERT INTO sizes (thumbnail_id, size, count, price) VALUES (?, ?, ?, ?)",
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "INSERT INTO sizes (thumbnail_id, size, count, price) VALUES (?, ?, ?, ?)",
 		thumbnailIDInt, size, count, price)
 	if err != nil {
 		return fmt.Errorf("failed to insert size: %v", err)
 	}
+	sizeID, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve size ID: %v", err)
+	}
+
+	// Mirror the size into the variant model
+	if err := syncSizeVariant(ctx, tx, int(sizeID)); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
 
 	// Invalidate cache
-	s.redis.Del(context.Background(), fmt.Sprintf("market:%d:products:*", marketID))
+	s.redis.Del(ctx, fmt.Sprintf("market:%d:products:*", marketID))
 
 	return nil
 }
 
 // DeleteSizeByID deletes a size by its ID
-func (s *DBService) DeleteSizeByID(marketID int, sizeID string) error {
+func (s *DBService) DeleteSizeByID(ctx context.Context, marketID int, sizeID string) error {
+	ctx, span := tracer.Start(ctx, "DBService.DeleteSizeByID")
+	defer span.End()
 	// Verify size exists and belongs to market's product
 	var exists bool
-	err := s.db.QueryRow(`
+	err := s.db.QueryRowContext(ctx, `
 		SELECT EXISTS(
 			SELECT 1 
 			FROM sizes s 
@@ -1381,10 +1525,20 @@ func (s *DBService) DeleteSizeByID(marketID int, sizeID string) error {
 		return fmt.Errorf("failed to validate size: %v", err)
 	}
 	if !exists {
-		return fmt.Errorf("size not found or unauthorized")
+		return ErrSizeNotOwned
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
 	}
+	defer tx.Rollback()
 
-	result, err := s.db.Exec("DELETE FROM sizes WHERE id = ?", sizeID)
+	if _, err := tx.ExecContext(ctx, "DELETE FROM product_variants WHERE legacy_size_id = ?", sizeID); err != nil {
+		return fmt.Errorf("failed to delete variant: %v", err)
+	}
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM sizes WHERE id = ?", sizeID)
 	if err != nil {
 		return fmt.Errorf("failed to delete size: %v", err)
 	}
@@ -1394,54 +1548,36 @@ func (s *DBService) DeleteSizeByID(marketID int, sizeID string) error {
 		return fmt.Errorf("failed to check rows affected: %v", err)
 	}
 	if rowsAffected == 0 {
-		return fmt.Errorf("size not found")
+		return ErrSizeNotFound
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
 	}
 
 	// Invalidate cache
-	s.redis.Del(context.Background(), fmt.Sprintf("market:%d:products:*", marketID))
+	s.redis.Del(ctx, fmt.Sprintf("market:%d:products:*", marketID))
 
 	return nil
 }
 
 
 
-// DeleteOrderByID deletes a size by its ID
-func (s *DBService) DeleteOrderByID(marketID int, orderID string) error {
-	// Verify size exists and belongs to market's product
-	var exists bool
-	err := s.db.QueryRow(`
-		SELECT EXISTS(
-			SELECT 1 
-			FROM orders 
-			WHERE id = ? AND market_id = ?
-		)`, orderID, marketID).Scan(&exists)
-	if err != nil {
-		return fmt.Errorf("failed to validate order: %v", err)
-	}
-	if !exists {
-		return fmt.Errorf("order not found or unauthorized")
-	}
-
-	result, err := s.db.Exec("DELETE FROM orders WHERE id = ?", orderID)
-	if err != nil {
-		return fmt.Errorf("failed to delete order: %v", err)
-	}
-
-	rowsAffected, err := result.RowsAffected()
+// DeleteOrderByID cancels the items of an order that are still being fulfilled. The order is kept
+// so that it keeps its history.
+func (s *DBService) DeleteOrderByID(ctx context.Context, marketID int, orderID string) error {
+	ctx, span := tracer.Start(ctx, "DBService.DeleteOrderByID")
+	defer span.End()
+	id, err := strconv.Atoi(orderID)
 	if err != nil {
-		return fmt.Errorf("failed to check rows affected: %v", err)
-	}
-	if rowsAffected == 0 {
-		return fmt.Errorf("order not found")
+		return ErrOrderNotInMarket
 	}
-
-	// Invalidate cache
-	s.redis.Del(context.Background(), fmt.Sprintf("market:%d:products:*", marketID))
-
-	return nil
+	return s.UpdateOrderStatus(ctx, id, marketID, models.OrderItemStatusCanceled)
 }
 
-func (s *DBService) GetUserFavoriteProducts(userID, page, limit int) ([]models.Product, error) {
+func (s *DBService) GetUserFavoriteProducts(ctx context.Context, userID, page, limit int) ([]models.Product, error) {
+    ctx, span := tracer.Start(ctx, "DBService.GetUserFavoriteProducts")
+    defer span.End()
     if page < 1 {
         page = 1
     }
@@ -1482,7 +1618,7 @@ func (s *DBService) GetUserFavoriteProducts(userID, page, limit int) ([]models.P
         WHERE f.user_id = ?
         ORDER BY p.id DESC LIMIT ? OFFSET ?`
 
-    rows, err := s.db.Query(query, userID, limit, offset)
+    rows, err := s.db.QueryContext(ctx, query, userID, limit, offset)
     if err != nil {
         return nil, fmt.Errorf("failed to query favorite products: %v", err)
     }
@@ -1501,7 +1637,7 @@ func (s *DBService) GetUserFavoriteProducts(userID, page, limit int) ([]models.P
             return nil, fmt.Errorf("failed to parse created_at: %v", err)
         }
         p.CreatedAt = createdAt.Format(time.RFC3339)
-        // p.Thumbnails, err = s.getProductDetails(p.ID)
+        // p.Thumbnails, err = s.getProductDetails(ctx, p.ID)
         // if err != nil {
         //     return nil, fmt.Errorf("failed to get product details: %v", err)
         // }
@@ -1512,30 +1648,32 @@ func (s *DBService) GetUserFavoriteProducts(userID, page, limit int) ([]models.P
 }
 
 // ToggleFavoriteProduct adds or removes a favorite
-func (s *DBService) ToggleFavoriteProduct(userID, productID int) (bool, error) {
+func (s *DBService) ToggleFavoriteProduct(ctx context.Context, userID, productID int) (bool, error) {
+	ctx, span := tracer.Start(ctx, "DBService.ToggleFavoriteProduct")
+	defer span.End()
 	var exists bool
-	err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM products WHERE id = ?)", productID).Scan(&exists)
+	err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM products WHERE id = ?)", productID).Scan(&exists)
 	if err != nil {
 		return false, fmt.Errorf("failed to validate product: %v", err)
 	}
 	if !exists {
-		return false, fmt.Errorf("product not found")
+		return false, ErrProductNotFound
 	}
 
-	err = s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM favorites WHERE user_id = ? AND product_id = ?)", userID, productID).Scan(&exists)
+	err = s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM favorites WHERE user_id = ? AND product_id = ?)", userID, productID).Scan(&exists)
 	if err != nil {
 		return false, fmt.Errorf("failed to check favorite status: %v", err)
 	}
 
 	if exists {
-		_, err = s.db.Exec("DELETE FROM favorites WHERE user_id = ? AND product_id = ?", userID, productID)
+		_, err = s.db.ExecContext(ctx, "DELETE FROM favorites WHERE user_id = ? AND product_id = ?", userID, productID)
 		if err != nil {
 			return false, fmt.Errorf("failed to remove favorite: %v", err)
 		}
 		return false, nil
 	}
 
-	_, err = s.db.Exec("INSERT INTO favorites (user_id, product_id) VALUES (?, ?)", userID, productID)
+	_, err = s.db.ExecContext(ctx, "INSERT INTO favorites (user_id, product_id) VALUES (?, ?)", userID, productID)
 	if err != nil {
 		return false, fmt.Errorf("failed to add favorite: %v", err)
 	}
@@ -1555,14 +1693,59 @@ func generateOTP(length int) string {
 	return string(b)
 }
 
-// CreateCategory creates a new category
-func (s *DBService) CreateCategory(name, name_ru, thumbnailURL string) (int, error) {
-    if name == "" {
-        return 0, fmt.Errorf("category name is required")
+// CreateCategory creates a new category, top-level unless input.ParentID is set. Without a slug one
+// is derived from the name.
+func (s *DBService) CreateCategory(ctx context.Context, input models.CategoryInput, thumbnailURL string) (int, error) {
+    ctx, span := tracer.Start(ctx, "DBService.CreateCategory")
+    defer span.End()
+    if input.Name == nil || strings.TrimSpace(*input.Name) == "" {
+        return 0, ErrCategoryNameRequired
+    }
+    name := strings.TrimSpace(*input.Name)
+    var nameRu, iconURL string
+    if input.NameRu != nil {
+        nameRu = strings.TrimSpace(*input.NameRu)
+    }
+    if input.IconURL != nil {
+        iconURL = *input.IconURL
+    }
+    sortOrder, isActive := 0, true
+    if input.SortOrder != nil {
+        sortOrder = *input.SortOrder
+    }
+    if input.IsActive != nil {
+        isActive = *input.IsActive
     }
 
-    result, err := s.db.Exec("INSERT INTO categories (name, name_ru, thumbnail_url) VALUES (?, ?, ?)", name, name_ru, thumbnailURL)
+    ix, err := s.getCategoryIndex(ctx)
     if err != nil {
+        return 0, err
+    }
+    var parentID interface{}
+    if input.ParentID != nil {
+        if parentID, err = validCategoryParent(ix, 0, *input.ParentID); err != nil {
+            return 0, err
+        }
+    }
+
+    var slug string
+    if input.Slug != nil && *input.Slug != "" {
+        if !slugPattern.MatchString(*input.Slug) {
+            return 0, ErrInvalidSlug
+        }
+        slug = *input.Slug
+    } else if slug, err = s.uniqueCategorySlug(ctx, name); err != nil {
+        return 0, err
+    }
+
+    result, err := s.db.ExecContext(ctx, `
+        INSERT INTO categories (parent_id, name, name_ru, slug, thumbnail_url, icon_url, sort_order, is_active)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+        parentID, name, nameRu, slug, thumbnailURL, nullIfEmpty(iconURL), sortOrder, isActive)
+    if err != nil {
+        if strings.Contains(err.Error(), "uniq_category_slug") {
+            return 0, ErrSlugTaken
+        }
         return 0, fmt.Errorf("failed to create category: %v", err)
     }
 
@@ -1572,14 +1755,12 @@ func (s *DBService) CreateCategory(name, name_ru, thumbnailURL string) (int, err
     }
 
     // Invalidate caches
-    ctx := context.Background()
-
     // Invalidate global product caches
     globalKeys, err := s.redis.SMembers(ctx, "global_products_cache_keys").Result()
     if err == nil && len(globalKeys) > 0 {
         s.redis.Del(ctx, globalKeys...)
     } else if err != nil && err != redis.Nil {
-        log.Printf("Failed to invalidate global product cache: %v", err)
+        slog.WarnContext(ctx, "Failed to invalidate global product cache", "error", err)
     }
 
     // Invalidate category caches
@@ -1588,15 +1769,17 @@ func (s *DBService) CreateCategory(name, name_ru, thumbnailURL string) (int, err
         s.redis.Del(ctx, categoryKeys...)
         s.redis.Del(ctx, "categories_cache_keys") // Clear the tracking set
     } else if err != nil && err != redis.Nil {
-        log.Printf("Failed to invalidate category cache: %v", err)
+        slog.WarnContext(ctx, "Failed to invalidate category cache", "error", err)
     }
 
     return int(categoryID), nil
 }
 
 // DeleteCategory deletes a category and its thumbnail
-func (s *DBService) DeleteCategory(categoryID int) error {
-    tx, err := s.db.Begin()
+func (s *DBService) DeleteCategory(ctx context.Context, categoryID int) error {
+    ctx, span := tracer.Start(ctx, "DBService.DeleteCategory")
+    defer span.End()
+    tx, err := s.db.BeginTx(ctx, nil)
     if err != nil {
         return fmt.Errorf("failed to start transaction: %v", err)
     }
@@ -1604,16 +1787,29 @@ func (s *DBService) DeleteCategory(categoryID int) error {
 
     // Fetch thumbnail URL
     var thumbnailURL string
-    err = tx.QueryRow("SELECT thumbnail_url FROM categories WHERE id = ?", categoryID).Scan(&thumbnailURL)
+    err = tx.QueryRowContext(ctx, "SELECT thumbnail_url FROM categories WHERE id = ?", categoryID).Scan(&thumbnailURL)
     if err != nil {
         if err == sql.ErrNoRows {
-            return fmt.Errorf("category not found")
+            return ErrCategoryNotFound
         }
         return fmt.Errorf("failed to retrieve category: %v", err)
     }
 
+    // Subcategories have to be moved or deleted first
+    var hasChildren bool
+    if err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM categories WHERE parent_id = ?)", categoryID).Scan(&hasChildren); err != nil {
+        return fmt.Errorf("failed to check subcategories: %v", err)
+    }
+    if hasChildren {
+        return ErrCategoryHasChildren
+    }
+
+    if err := deleteTranslations(ctx, tx, "categories", categoryID); err != nil {
+        return err
+    }
+
     // Delete category
-    result, err := tx.Exec("DELETE FROM categories WHERE id = ?", categoryID)
+    result, err := tx.ExecContext(ctx, "DELETE FROM categories WHERE id = ?", categoryID)
     if err != nil {
         return fmt.Errorf("failed to delete category: %v", err)
     }
@@ -1623,7 +1819,7 @@ func (s *DBService) DeleteCategory(categoryID int) error {
         return fmt.Errorf("failed to check rows affected: %v", err)
     }
     if rowsAffected == 0 {
-        return fmt.Errorf("category not found")
+        return ErrCategoryNotFound
     }
 
     // Commit transaction
@@ -1639,19 +1835,18 @@ func (s *DBService) DeleteCategory(categoryID int) error {
         }
         filePath := filepath.Join(uploadDir, filepath.Base(thumbnailURL))
         if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
-            log.Printf("Warning: failed to delete category thumbnail %s: %v", filePath, err)
+            slog.Warn("Failed to delete category thumbnail", "path", filePath, "error", err)
         }
     }
 
     // Invalidate caches
-    ctx := context.Background()
 
     // Invalidate global product caches
     globalKeys, err := s.redis.SMembers(ctx, "global_products_cache_keys").Result()
     if err == nil && len(globalKeys) > 0 {
         s.redis.Del(ctx, globalKeys...)
     } else if err != nil && err != redis.Nil {
-        log.Printf("Failed to invalidate global product cache: %v", err)
+        slog.WarnContext(ctx, "Failed to invalidate global product cache", "error", err)
     }
 
     // Invalidate category caches
@@ -1660,14 +1855,16 @@ func (s *DBService) DeleteCategory(categoryID int) error {
         s.redis.Del(ctx, categoryKeys...)
         s.redis.Del(ctx, "categories_cache_keys") // Clear the tracking set
     } else if err != nil && err != redis.Nil {
-        log.Printf("Failed to invalidate category cache: %v", err)
+        slog.WarnContext(ctx, "Failed to invalidate category cache", "error", err)
     }
 
     return nil
 }
 
 // GetCategories retrieves paginated categories with optional name search
-func (s *DBService) GetCategories(page, limit int, search string) ([]models.Category, error) {
+func (s *DBService) GetCategories(ctx context.Context, page, limit int, search string) ([]models.Category, error) {
+    ctx, span := tracer.Start(ctx, "DBService.GetCategories")
+    defer span.End()
     if page < 1 {
         page = 1
     }
@@ -1678,7 +1875,6 @@ func (s *DBService) GetCategories(page, limit int, search string) ([]models.Cate
 
     // Generate cache key (exclude search)
     cacheKey := fmt.Sprintf("categories:page:%d:limit:%d", page, limit)
-    ctx := context.Background()
 
     // Check Redis cache only if search is empty
     var categories []models.Category
@@ -1686,18 +1882,20 @@ func (s *DBService) GetCategories(page, limit int, search string) ([]models.Cate
         cached, err := s.redis.Get(ctx, cacheKey).Result()
         if err == nil {
             if err := json.Unmarshal([]byte(cached), &categories); err != nil {
-                log.Printf("Failed to unmarshal cached categories: %v", err)
+                slog.WarnContext(ctx, "Failed to unmarshal cached categories", "error", err)
             } else {
+                cacheLookups.Inc("categories", "hit")
                 return categories, nil
             }
         } else if err != redis.Nil {
-            log.Printf("Redis error: %v", err)
+            slog.WarnContext(ctx, "Failed to read cached categories", "error", err)
         }
+        cacheLookups.Inc("categories", "miss")
     }
 
     // Query the database
     query := `
-        SELECT id, name, name_ru, thumbnail_url
+        SELECT id, parent_id, name, name_ru, slug, COALESCE(thumbnail_url, ''), COALESCE(icon_url, ''), sort_order, is_active
         FROM categories
         WHERE 1=1`
     args := []interface{}{}
@@ -1708,7 +1906,7 @@ func (s *DBService) GetCategories(page, limit int, search string) ([]models.Cate
     query += " ORDER BY id DESC LIMIT ? OFFSET ?"
     args = append(args, limit, offset)
 
-    rows, err := s.db.Query(query, args...)
+    rows, err := s.db.QueryContext(ctx, query, args...)
     if err != nil {
         return nil, fmt.Errorf("failed to query categories: %v", err)
     }
@@ -1717,9 +1915,14 @@ func (s *DBService) GetCategories(page, limit int, search string) ([]models.Cate
     categories = []models.Category{}
     for rows.Next() {
         var c models.Category
-        if err := rows.Scan(&c.ID, &c.Name, &c.NameRu, &c.ThumbnailURL); err != nil {
+        var parentID sql.NullInt64
+        if err := rows.Scan(&c.ID, &parentID, &c.Name, &c.NameRu, &c.Slug, &c.ThumbnailURL, &c.IconURL, &c.SortOrder, &c.IsActive); err != nil {
             return nil, fmt.Errorf("failed to scan category: %v", err)
         }
+        if parentID.Valid {
+            id := int(parentID.Int64)
+            c.ParentID = &id
+        }
         categories = append(categories, c)
     }
 
@@ -1727,14 +1930,14 @@ func (s *DBService) GetCategories(page, limit int, search string) ([]models.Cate
     if search == "" && len(categories) > 0 {
         jsonData, err := json.Marshal(categories)
         if err != nil {
-            log.Printf("Failed to marshal categories for caching: %v", err)
+            slog.WarnContext(ctx, "Failed to marshal categories for caching", "error", err)
         } else {
             ttl := 3600 * time.Second // 1 hour TTL
             pipe := s.redis.Pipeline()
             pipe.Set(ctx, cacheKey, jsonData, ttl)
             pipe.SAdd(ctx, "categories_cache_keys", cacheKey)
             if _, err := pipe.Exec(ctx); err != nil {
-                log.Printf("Failed to cache categories: %v", err)
+                slog.WarnContext(ctx, "Failed to cache categories", "error", err)
             }
         }
     }
@@ -1742,13 +1945,21 @@ func (s *DBService) GetCategories(page, limit int, search string) ([]models.Cate
     return categories, nil
 }
 
+// openCartRow limits a statement on carts to rows of open carts; rows of ordered carts are kept
+// until the user deletes or clears them, but are no longer changed by the item endpoints
+const openCartRow = `NOT EXISTS (
+        SELECT 1 FROM orders o
+        WHERE o.user_id = carts.user_id AND o.market_id = carts.market_id AND o.cart_order_id = carts.cart_order_id)`
+
 // AddToCart adds or updates a product in the user's cart under a single cart order
-func (s *DBService) AddToCart(userID int, req models.CartRequest) (int, error) {
+func (s *DBService) AddToCart(ctx context.Context, userID int, req models.CartRequest) (int, error) {
+	ctx, span := tracer.Start(ctx, "DBService.AddToCart")
+	defer span.End()
 	if req.Count <= 0 {
-		return 0, fmt.Errorf("count must be positive for product_id %d", req.ProductID)
+		return 0, ErrCartInvalidCount.WithDetails(map[string]interface{}{"product_id": req.ProductID}, req.ProductID)
 	}
 
-	tx, err := s.db.Begin()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return 0, fmt.Errorf("failed to start transaction: %v", err)
 	}
@@ -1756,35 +1967,42 @@ func (s *DBService) AddToCart(userID int, req models.CartRequest) (int, error) {
 
 	// Derive market_id from product_id
 	var marketID int
-	err = tx.QueryRow("SELECT market_id FROM products WHERE id = ?", req.ProductID).Scan(&marketID)
+	err = tx.QueryRowContext(ctx, "SELECT market_id FROM products WHERE id = ?", req.ProductID).Scan(&marketID)
 	if err == sql.ErrNoRows {
-		return 0, fmt.Errorf("invalid product_id %d", req.ProductID)
+		return 0, ErrCartInvalidProduct.WithDetails(map[string]interface{}{"product_id": req.ProductID}, req.ProductID)
 	}
 	if err != nil {
 		return 0, fmt.Errorf("failed to get market_id for product_id %d: %v", req.ProductID, err)
 	}
 
-	// Validate relationships
-	var exists bool
-	err = tx.QueryRow(`
-        SELECT EXISTS(
-            SELECT 1 
-            FROM products p
-            JOIN markets m ON p.market_id = m.id
-            JOIN thumbnails t ON t.id = ?
-            JOIN sizes s ON s.id = ? AND s.thumbnail_id = t.id
-            WHERE p.id = ? AND m.id = ?
-        )`, req.ThumbnailID, req.SizeID, req.ProductID, marketID).Scan(&exists)
+	// Resolve the variant; legacy clients address it by thumbnail and size
+	var variantID, stock int
+	var thumbnailID, sizeID sql.NullInt64
+	if req.VariantID != 0 {
+		err = tx.QueryRowContext(ctx, `
+            SELECT v.id, v.stock, s.thumbnail_id, v.legacy_size_id
+            FROM product_variants v
+            LEFT JOIN sizes s ON v.legacy_size_id = s.id
+            WHERE v.id = ? AND v.product_id = ? AND v.is_active = 1`,
+			req.VariantID, req.ProductID).Scan(&variantID, &stock, &thumbnailID, &sizeID)
+	} else {
+		err = tx.QueryRowContext(ctx, `
+            SELECT v.id, v.stock, s.thumbnail_id, v.legacy_size_id
+            FROM product_variants v
+            JOIN sizes s ON v.legacy_size_id = s.id
+            WHERE s.id = ? AND s.thumbnail_id = ? AND v.product_id = ? AND v.is_active = 1`,
+			req.SizeID, req.ThumbnailID, req.ProductID).Scan(&variantID, &stock, &thumbnailID, &sizeID)
+	}
+	if err == sql.ErrNoRows {
+		return 0, ErrCartInvalidVariant.WithDetails(map[string]interface{}{"product_id": req.ProductID}, req.ProductID)
+	}
 	if err != nil {
 		return 0, fmt.Errorf("failed to validate product_id %d: %v", req.ProductID, err)
 	}
-	if !exists {
-		return 0, fmt.Errorf("invalid market, product_id %d, thumbnail, or size", req.ProductID)
-	}
 
 	// Find existing cart_order_id for user and market
 	var cartOrderID int
-	err = tx.QueryRow(`
+	err = tx.QueryRowContext(ctx, `
         SELECT DISTINCT c.cart_order_id 
         FROM carts c
         WHERE c.user_id = ? AND c.market_id = ? AND c.cart_order_id NOT IN (
@@ -1795,29 +2013,46 @@ func (s *DBService) AddToCart(userID int, req models.CartRequest) (int, error) {
 		) 
         LIMIT 1`, userID, marketID).Scan(&cartOrderID)
 	if err == sql.ErrNoRows {
-		// Generate new cart_order_id (using max + 1 for simplicity)
-		err = tx.QueryRow(`
-            SELECT COALESCE(MAX(cart_order_id), 0) + 1 
-            FROM carts WHERE user_id = ? AND market_id = ? `, userID, marketID).Scan(&cartOrderID)
+		// Generate new cart_order_id past those of both carts and orders, as ordered carts may have
+		// been deleted and orders are unique per user, market and cart_order_id
+		err = tx.QueryRowContext(ctx, `
+            SELECT GREATEST(
+                COALESCE((SELECT MAX(cart_order_id) FROM carts WHERE user_id = ? AND market_id = ?), 0),
+                COALESCE((SELECT MAX(cart_order_id) FROM orders WHERE user_id = ? AND market_id = ?), 0)
+            ) + 1`, userID, marketID, userID, marketID).Scan(&cartOrderID)
 		if err != nil {
 			return 0, fmt.Errorf("failed to generate cart_order_id: %v", err)
 		}
+		// Ordered carts keep their rows until the user deletes or clears them, which may also happen
+		// before ordering, so the funnel report counts the carts started here rather than cart rows
+		if _, err := tx.ExecContext(ctx, `
+            INSERT INTO cart_starts (user_id, market_id, cart_order_id) VALUES (?, ?, ?)`,
+			userID, marketID, cartOrderID); err != nil {
+			return 0, fmt.Errorf("failed to record cart start: %v", err)
+		}
 	} else if err != nil {
 		return 0, fmt.Errorf("failed to check existing cart: %v", err)
 	}
 
-	// Check if cart entry exists
-	var cartID int
-	err = tx.QueryRow(`
-        SELECT id FROM carts 
-        WHERE user_id = ? AND market_id = ? AND product_id = ? AND thumbnail_id = ? AND size_id = ?`,
-		userID, marketID, req.ProductID, req.ThumbnailID, req.SizeID).Scan(&cartID)
+	// Check if the open cart has the variant; rows of ordered carts are left alone, so that the
+	// item goes into the cart started above
+	var cartID, currentCount int
+	err = tx.QueryRowContext(ctx, `
+        SELECT id, count FROM carts 
+        WHERE user_id = ? AND variant_id = ? AND cart_order_id = ?`,
+		userID, variantID, cartOrderID).Scan(&cartID, &currentCount)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to check cart entry for product_id %d: %v", req.ProductID, err)
+	}
+	if currentCount+req.Count > stock {
+		return 0, ErrInsufficientStock.WithDetails(map[string]interface{}{"variant_id": variantID}, variantID)
+	}
 	if err == sql.ErrNoRows {
 		// Insert new cart entry
-		result, err := tx.Exec(`
-            INSERT INTO carts (user_id, market_id, product_id, thumbnail_id, size_id, count, cart_order_id)
-            VALUES (?, ?, ?, ?, ?, ?, ?)`,
-			userID, marketID, req.ProductID, req.ThumbnailID, req.SizeID, req.Count, cartOrderID)
+		result, err := tx.ExecContext(ctx, `
+            INSERT INTO carts (user_id, market_id, product_id, thumbnail_id, size_id, variant_id, count, cart_order_id)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			userID, marketID, req.ProductID, thumbnailID, sizeID, variantID, req.Count, cartOrderID)
 		if err != nil {
 			return 0, fmt.Errorf("failed to insert product_id %d: %v", req.ProductID, err)
 		}
@@ -1826,11 +2061,9 @@ func (s *DBService) AddToCart(userID int, req models.CartRequest) (int, error) {
 			return 0, fmt.Errorf("failed to retrieve cart ID for product_id %d: %v", req.ProductID, err)
 		}
 		cartID = int(cartID64)
-	} else if err != nil {
-		return 0, fmt.Errorf("failed to check cart entry for product_id %d: %v", req.ProductID, err)
 	} else {
 		// Update existing cart entry
-		_, err := tx.Exec(`
+		_, err := tx.ExecContext(ctx, `
             UPDATE carts 
             SET count = count + ?
             WHERE id = ?`,
@@ -1848,7 +2081,9 @@ func (s *DBService) AddToCart(userID int, req models.CartRequest) (int, error) {
 }
 
 // GetUserCart retrieves a user's cart grouped by cart order and markets
-func (s *DBService) GetUserCart(userID int) ([]models.CartMarket, error) {
+func (s *DBService) GetUserCart(ctx context.Context, userID int) ([]models.CartMarket, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetUserCart")
+	defer span.End()
 	query := `
 		SELECT 
 			c.cart_order_id, 
@@ -1862,24 +2097,23 @@ func (s *DBService) GetUserCart(userID int) ([]models.CartMarket, error) {
 			p.name_ru, 
 			p.price, 
 			p.discount, 
-			t.id, 
-			t.image_url, 
-			t.color, 
-			t.color_ru, 
-			s.id, 
-			s.size, 
-			s.price, 
+			v.id,
+			v.sku,
+			COALESCE(c.size_id, 0),
+			COALESCE((SELECT vi.image_url FROM product_variant_images vi WHERE vi.variant_id = v.id ORDER BY vi.position, vi.id LIMIT 1), pt.image_url, ''),
+			v.price, 
+			v.stock,
 			c.count, 
-			s.price*(1-COALESCE(p.discount,0)/100)*c.count AS sum
+			v.price*(1-COALESCE(p.discount,0)/100)*c.count AS sum
 		FROM carts c
 		JOIN markets m ON c.market_id = m.id
 		JOIN products p ON c.product_id = p.id
-		JOIN thumbnails t ON c.thumbnail_id = t.id
-		JOIN sizes s ON c.size_id = s.id
+		JOIN product_variants v ON c.variant_id = v.id
+		LEFT JOIN thumbnails pt ON p.thumbnail_id = pt.id
 		WHERE c.user_id = ?
 		ORDER BY c.cart_order_id, m.id, p.id DESC`
 
-	rows, err := s.db.Query(query, userID)
+	rows, err := s.db.QueryContext(ctx, query, userID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query cart: %v", err)
 	}
@@ -1891,18 +2125,20 @@ func (s *DBService) GetUserCart(userID int) ([]models.CartMarket, error) {
 		Markets     map[int]*models.CartMarket
 	}
 	cartOrders := make(map[int]*cartOrder)
+	var variantIDs []int
 	for rows.Next() {
-		var cartOrderID, userID, marketID, productID, thumbnailID, sizeID int
-		var marketName, productName, thumbnailURL, color, size, marketNameRu, productNameRu, colorRu string
+		var cartOrderID, userID, marketID, productID, variantID, sizeID, stock int
+		var marketName, productName, thumbnailURL, sku, marketNameRu, productNameRu string
 		var price, discount, deliveryPrice, sizePrice, sum float64
 		var count int
 
 		if err := rows.Scan(&cartOrderID, &userID, &marketID, &marketName, &marketNameRu, &deliveryPrice,
 			&productID, &productName, &productNameRu, &price, &discount,
-			&thumbnailID, &thumbnailURL, &color, &colorRu,
-			&sizeID, &size, &sizePrice, &count, &sum); err != nil {
+			&variantID, &sku, &sizeID, &thumbnailURL,
+			&sizePrice, &stock, &count, &sum); err != nil {
 			return nil, fmt.Errorf("failed to scan cart item: %v", err)
 		}
+		variantIDs = append(variantIDs, variantID)
 
 		// Create or update cart order
 		order, exists := cartOrders[cartOrderID]
@@ -1931,6 +2167,8 @@ func (s *DBService) GetUserCart(userID int) ([]models.CartMarket, error) {
 
 		// Add product to market
 		market.Products = append(market.Products, models.CartProduct{
+			VariantID:    variantID,
+			SKU:          sku,
 			SizeID:       sizeID,
 			ProductID:    productID,
 			ThumbnailURL: thumbnailURL,
@@ -1938,14 +2176,34 @@ func (s *DBService) GetUserCart(userID int) ([]models.CartMarket, error) {
 			NameRu:       productNameRu,
 			Price:        price,
 			Discount:     discount,
-			Color:        color,
-			ColorRu:      colorRu,
-			Size:         size,
 			SizePrice:    sizePrice,
 			Count:        count,
+			Stock:        stock,
 			Sum:          sum,
 		})
 	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating cart items: %v", err)
+	}
+
+	// Attach variant attributes and fill the legacy color/size fields from them
+	attributes, err := s.getVariantAttributes(ctx, variantIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, order := range cartOrders {
+		for _, market := range order.Markets {
+			for i := range market.Products {
+				product := &market.Products[i]
+				product.Attributes = attributes[product.VariantID]
+				if product.Attributes == nil {
+					product.Attributes = []models.VariantAttribute{}
+				}
+				product.Color, product.ColorRu = attributeValue(product.Attributes, "color")
+				product.Size, _ = attributeValue(product.Attributes, "size")
+			}
+		}
+	}
 
 	// Convert to final output
 	var cart []models.CartMarket = []models.CartMarket{}
@@ -1959,8 +2217,10 @@ func (s *DBService) GetUserCart(userID int) ([]models.CartMarket, error) {
 }
 
 // DeleteCart deletes all entries for a user's cart order
-func (s *DBService) DeleteCart(userID, cartOrderID int) error {
-	result, err := s.db.Exec(`
+func (s *DBService) DeleteCart(ctx context.Context, userID, cartOrderID int) error {
+	ctx, span := tracer.Start(ctx, "DBService.DeleteCart")
+	defer span.End()
+	result, err := s.db.ExecContext(ctx, `
 		DELETE FROM carts 
 		WHERE cart_order_id = ? AND user_id = ?`, cartOrderID, userID)
 	if err != nil {
@@ -1972,24 +2232,26 @@ func (s *DBService) DeleteCart(userID, cartOrderID int) error {
 		return fmt.Errorf("failed to check rows affected: %v", err)
 	}
 	if rowsAffected == 0 {
-		return fmt.Errorf("cart not found or not owned by user")
+		return ErrCartNotFound
 	}
 
 	return nil
 }
 
 // CreateLocation adds a new location for a user
-func (s *DBService) CreateLocation(userID int, locationName, locationNameRu, locationAddress, locationAddressRu string) (int, error) {
+func (s *DBService) CreateLocation(ctx context.Context, userID int, locationName, locationNameRu, locationAddress, locationAddressRu string) (int, error) {
+	ctx, span := tracer.Start(ctx, "DBService.CreateLocation")
+	defer span.End()
 	if locationName == "" || locationAddress == "" || locationNameRu == "" || locationAddressRu == "" {
-		return 0, fmt.Errorf("location name and address are required")
+		return 0, ErrLocationFields
 	}
 
-	result, err := s.db.Exec(`
+	result, err := s.db.ExecContext(ctx, `
         INSERT INTO locations (user_id, location_name, location_name_ru, location_address, location_address_ru)
         VALUES (?, ?, ?, ?, ?)`, userID, locationName, locationNameRu, locationAddress, locationAddressRu)
 	if err != nil {
 		if strings.Contains(err.Error(), "Duplicate entry") {
-			return 0, fmt.Errorf("location name already exists")
+			return 0, ErrLocationNameTaken
 		}
 		return 0, fmt.Errorf("failed to create location: %v", err.Error())
 	}
@@ -2003,8 +2265,10 @@ func (s *DBService) CreateLocation(userID int, locationName, locationNameRu, loc
 }
 
 // GetUserLocations retrieves all locations for a user
-func (s *DBService) GetUserLocations(userID int) ([]models.Location, error) {
-	rows, err := s.db.Query(`
+func (s *DBService) GetUserLocations(ctx context.Context, userID int) ([]models.Location, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetUserLocations")
+	defer span.End()
+	rows, err := s.db.QueryContext(ctx, `
         SELECT id, user_id, location_name, location_name_ru, location_address, location_address_ru
         FROM locations
         WHERE user_id = ?
@@ -2030,130 +2294,223 @@ func (s *DBService) GetUserLocations(userID int) ([]models.Location, error) {
 type ForPostOrders struct {
 	MarketID    int
 	ProductID   int
-	ThumbnailID int
-	SizeID      int
+	ThumbnailID sql.NullInt64
+	SizeID      sql.NullInt64
+	VariantID   int
 	Count       int
 }
 
-// CreateOrder creates a new order for a user's cart
-func (s *DBService) CreateOrder(userID, cartOrderID, locationID int, name, phone, notes string) (int, error) {
+// orderNumberFormat renders an order number from the market's order prefix, the year and the
+// prefix's sequence number of that year, e.g. MARKET-2026-000123
+const orderNumberFormat = "%s-%d-%06d"
+
+// nextOrderNumber draws the next order number of a market. The sequence row stays locked until q's
+// transaction ends, so concurrent orders of the market wait for each other rather than share a number.
+func nextOrderNumber(ctx context.Context, q execer, marketID int) (string, error) {
+	var prefix string
+	err := q.QueryRowContext(ctx, "SELECT COALESCE(order_prefix, CONCAT('M', id)) FROM markets WHERE id = ?", marketID).Scan(&prefix)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch order prefix: %v", err)
+	}
+
+	year := time.Now().Year()
+	if _, err := q.ExecContext(ctx, `
+		INSERT INTO order_number_sequences (prefix, year, last_value) VALUES (?, ?, 1)
+		ON DUPLICATE KEY UPDATE last_value = last_value + 1`, prefix, year); err != nil {
+		return "", fmt.Errorf("failed to advance order number sequence: %v", err)
+	}
+	var seq int
+	if err := q.QueryRowContext(ctx, `
+		SELECT last_value FROM order_number_sequences WHERE prefix = ? AND year = ?`, prefix, year).Scan(&seq); err != nil {
+		return "", fmt.Errorf("failed to read order number sequence: %v", err)
+	}
+	return fmt.Sprintf(orderNumberFormat, prefix, year, seq), nil
+}
+
+// placedOrder is an order created from a user's cart
+type placedOrder struct {
+	id, marketID int
+	number       string
+}
+
+// CreateOrder creates the orders for a user's cart, one per market, and returns their IDs
+func (s *DBService) CreateOrder(ctx context.Context, userID, cartOrderID, locationID int, name, phone, notes string) ([]int, error) {
+	ctx, span := tracer.Start(ctx, "DBService.CreateOrder")
+	defer span.End()
 	if name == "" || phone == "" {
-		return 0, fmt.Errorf("name and phone are required")
+		return nil, ErrNameAndPhoneRequired
 	}
 
 	// Start a transaction
-	tx, err := s.db.Begin()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return 0, fmt.Errorf("failed to start transaction: %v", err)
+		return nil, fmt.Errorf("failed to start transaction: %v", err)
 	}
 	defer tx.Rollback() // Rollback if not committed
 
 	// Validate cart_order_id and user ownership
 	var exists bool
-	err = tx.QueryRow(`
+	err = tx.QueryRowContext(ctx, `
         SELECT EXISTS(
             SELECT 1 
             FROM carts 
             WHERE cart_order_id = ? AND user_id = ?
         )`, cartOrderID, userID).Scan(&exists)
 	if err != nil {
-		return 0, fmt.Errorf("failed to validate cart: %v", err)
+		return nil, fmt.Errorf("failed to validate cart: %v", err)
 	}
 	if !exists {
-		return 0, fmt.Errorf("cart not found or not owned by user")
+		return nil, ErrCartNotFound
 	}
 
-	// Fetch all cart items for the cart_order_id
-	rows, err := tx.Query(`
-		SELECT market_id, product_id, thumbnail_id, size_id, count 
-		FROM carts 
-		WHERE cart_order_id = ? AND user_id = ?`,
+	// Fetch all cart items for the cart_order_id. Carts are numbered per market, so rows of a cart
+	// with the same number that was already ordered at another market are left out.
+	rows, err := tx.QueryContext(ctx, `
+		SELECT c.market_id, c.product_id, c.thumbnail_id, c.size_id, c.variant_id, c.count,
+			EXISTS(SELECT 1 FROM orders o WHERE o.user_id = c.user_id AND o.market_id = c.market_id AND o.cart_order_id = c.cart_order_id)
+		FROM carts c
+		WHERE c.cart_order_id = ? AND c.user_id = ?`,
 		cartOrderID, userID)
 	if err != nil {
-		return 0, fmt.Errorf("failed to fetch cart items: %v", err)
+		return nil, fmt.Errorf("failed to fetch cart items: %v", err)
 	}
 	defer rows.Close()
 
 	var forPostOrders []ForPostOrders
+	alreadyOrdered := false
 	for rows.Next() {
 		var item ForPostOrders
-		err := rows.Scan(&item.MarketID, &item.ProductID, &item.ThumbnailID, &item.SizeID, &item.Count)
+		var ordered bool
+		err := rows.Scan(&item.MarketID, &item.ProductID, &item.ThumbnailID, &item.SizeID, &item.VariantID, &item.Count, &ordered)
 		if err != nil {
-			return 0, fmt.Errorf("failed to scan cart item: %v", err)
+			return nil, fmt.Errorf("failed to scan cart item: %v", err)
+		}
+		if ordered {
+			alreadyOrdered = true
+			continue
 		}
 		forPostOrders = append(forPostOrders, item)
 	}
 	if err = rows.Err(); err != nil {
-		return 0, fmt.Errorf("error iterating cart items: %v", err)
+		return nil, fmt.Errorf("error iterating cart items: %v", err)
 	}
 	if len(forPostOrders) == 0 {
-		return 0, fmt.Errorf("no items found in cart")
+		if alreadyOrdered {
+			return nil, ErrOrderExists
+		}
+		return nil, ErrCartEmpty
 	}
 
 	// Validate location_id and user ownership
-	err = tx.QueryRow(`
+	err = tx.QueryRowContext(ctx, `
         SELECT EXISTS(
             SELECT 1 
             FROM locations 
             WHERE id = ? AND user_id = ?
         )`, locationID, userID).Scan(&exists)
 	if err != nil {
-		return 0, fmt.Errorf("failed to validate location: %v", err)
+		return nil, fmt.Errorf("failed to validate location: %v", err)
 	}
 	if !exists {
-		return 0, fmt.Errorf("location not found or not owned by user")
+		return nil, ErrLocationNotOwned
 	}
 
-	// Insert each cart item as an order
-	var orderID int64
+	// Each market's part of the cart becomes an order; insert its items and reserve their stock
+	var orders []placedOrder
+	marketOrders := make(map[int]int)
 	for _, item := range forPostOrders {
-		result, err := tx.Exec(`
-			INSERT INTO orders (user_id, cart_order_id, location_id, name, phone, notes, 
-				market_id, product_id, thumbnail_id, size_id, count)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-			userID, cartOrderID, locationID, name, phone, notes, item.MarketID,
-			item.ProductID, item.ThumbnailID, item.SizeID, item.Count)
+		result, err := tx.ExecContext(ctx, `
+			UPDATE product_variants SET stock = stock - ?
+			WHERE id = ? AND is_active = 1 AND stock >= ?`,
+			item.Count, item.VariantID, item.Count)
 		if err != nil {
-			if strings.Contains(err.Error(), "Duplicate entry") {
-				return 0, fmt.Errorf("order already exists for cart item")
-			}
-			return 0, fmt.Errorf("failed to create order: %v", err)
+			return nil, fmt.Errorf("failed to reserve stock: %v", err)
+		}
+		if reserved, err := result.RowsAffected(); err != nil {
+			return nil, fmt.Errorf("failed to check rows affected: %v", err)
+		} else if reserved == 0 {
+			return nil, ErrInsufficientStock.WithDetails(map[string]interface{}{"variant_id": item.VariantID}, item.VariantID)
 		}
-		// Get the last inserted ID (assuming you want the ID of the first inserted order)
-		if orderID == 0 {
-			orderID, err = result.LastInsertId()
+
+		orderID, ok := marketOrders[item.MarketID]
+		if !ok {
+			number, err := nextOrderNumber(ctx, tx, item.MarketID)
+			if err != nil {
+				return nil, err
+			}
+			result, err = tx.ExecContext(ctx, `
+				INSERT INTO orders (order_number, user_id, market_id, cart_order_id, location_id, name, phone, notes)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				number, userID, item.MarketID, cartOrderID, locationID, name, phone, notes)
 			if err != nil {
-				return 0, fmt.Errorf("failed to retrieve order ID: %v", err)
+				if strings.Contains(err.Error(), "Duplicate entry") {
+					return nil, ErrOrderExists
+				}
+				return nil, fmt.Errorf("failed to create order: %v", err)
 			}
+			id, err := result.LastInsertId()
+			if err != nil {
+				return nil, fmt.Errorf("failed to retrieve order ID: %v", err)
+			}
+			orderID = int(id)
+			marketOrders[item.MarketID] = orderID
+			orders = append(orders, placedOrder{id: orderID, marketID: item.MarketID, number: number})
+		}
+
+		// The item keeps the price and discount it is sold at, whatever later edits of the product
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO order_items (order_id, market_id, product_id, thumbnail_id, size_id, variant_id, count, unit_price, discount)
+			SELECT ?, ?, ?, ?, ?, v.id, ?, v.price, COALESCE(p.discount, 0)
+			FROM product_variants v
+			JOIN products p ON p.id = v.product_id
+			WHERE v.id = ?`,
+			orderID, item.MarketID, item.ProductID, item.ThumbnailID, item.SizeID, item.Count, item.VariantID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create order item: %v", err)
 		}
 	}
 
 	// Commit the transaction
 	if err := tx.Commit(); err != nil {
-		return 0, fmt.Errorf("failed to commit transaction: %v", err)
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
 	}
 
-	return int(orderID), nil
+	ordersCreated.Add(float64(len(orders)))
+	orderIDs := make([]int, len(orders))
+	marketIDs := make([]int, len(orders))
+	for i, o := range orders {
+		orderIDs[i] = o.id
+		marketIDs[i] = o.marketID
+		s.notifyNewOrder(ctx, userID, o.id, o.number, name, o.marketID)
+		s.publishNewOrderEvent(ctx, userID, o.id, cartOrderID, o.marketID)
+	}
+	s.invalidateMarketAnalytics(ctx, marketIDs...)
+
+	return orderIDs, nil
 }
 
 // GetMarketAdminOrders retrieves orders for a market admin's market, optionally filtered by status
-func (s *DBService) GetMarketAdminOrders(marketID int, status string) ([]models.MarketAdminOrder, error) {
+func (s *DBService) GetMarketAdminOrders(ctx context.Context, marketID int, status string) ([]models.MarketAdminOrder, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetMarketAdminOrders")
+	defer span.End()
 	query := `
 		SELECT 
-			o.id,
-			o.cart_order_id, 
-			o.user_id,
+			oh.id,
+			oh.order_number,
+			oh.cart_order_id, 
+			oh.user_id,
 			l.location_address, 
 			l.location_address_ru, 
-			o.status,
-			o.name, 
-			o.created_at,
-			SUM(s.price * (1 - COALESCE(p.discount, 0)/100) * o.count) as sum
-		FROM orders o
-		JOIN locations l ON o.location_id = l.id
-		JOIN sizes s ON o.size_id = s.id
+			` + orderStatusSQL + `,
+			oh.name, 
+			oh.created_at,
+			SUM(` + lineRevenue + `) as sum
+		FROM orders oh
+		JOIN order_items o ON o.order_id = oh.id
+		JOIN locations l ON oh.location_id = l.id
+		JOIN product_variants v ON o.variant_id = v.id
 		JOIN products p ON o.product_id = p.id
-		WHERE o.market_id = ?`
+		WHERE oh.market_id = ?`
 	args := []interface{}{marketID}
 
 	if status != "" {
@@ -2162,10 +2519,10 @@ func (s *DBService) GetMarketAdminOrders(marketID int, status string) ([]models.
 	}
 
 	query += `
-		GROUP BY o.user_id, o.cart_order_id 
-		ORDER BY o.created_at DESC`
+		GROUP BY oh.id 
+		ORDER BY oh.created_at DESC`
 
-	rows, err := s.db.Query(query, args...)
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query orders: %v", err)
 	}
@@ -2174,7 +2531,7 @@ func (s *DBService) GetMarketAdminOrders(marketID int, status string) ([]models.
 	var orders []models.MarketAdminOrder = []models.MarketAdminOrder{}
 	for rows.Next() {
 		var o models.MarketAdminOrder
-		if err := rows.Scan(&o.ID, &o.CartOrderID, &o.UserID, &o.LocationAddress, &o.LocationAddressRu, &o.Status, &o.Name, &o.CreatedAt, &o.Sum); err != nil {
+		if err := rows.Scan(&o.ID, &o.OrderNumber, &o.CartOrderID, &o.UserID, &o.LocationAddress, &o.LocationAddressRu, &o.Status, &o.Name, &o.CreatedAt, &o.Sum); err != nil {
 			return nil, fmt.Errorf("failed to scan order: %v", err)
 		}
 		o.Sum = math.Round(o.Sum*100) / 100 // Round to 2 decimal places
@@ -2184,38 +2541,37 @@ func (s *DBService) GetMarketAdminOrders(marketID int, status string) ([]models.
 	return orders, nil
 }
 
-// GetMarketAdminOrderByID retrieves a specific order by cart_order_id for a market admin
-func (s *DBService) GetMarketAdminOrderByID(marketID, cartOrderID, userID int) (*models.MarketAdminOrderDetail, error) {
+// GetMarketAdminOrderByID retrieves one of the market's orders for a market admin
+func (s *DBService) GetMarketAdminOrderByID(ctx context.Context, marketID, orderID int) (*models.MarketAdminOrderDetail, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetMarketAdminOrderByID")
+	defer span.End()
 	// Fetch order details
 	var order models.MarketAdminOrderDetail = models.MarketAdminOrderDetail{}
-	err := s.db.QueryRow(`
+	err := s.db.QueryRowContext(ctx, `
 		SELECT 
-			o.user_id,
-			o.cart_order_id, 
-			o.market_id,
-			o.name, 
-			o.phone,
-			o.status, 
-			l.location_address, 
-			l.location_address_ru,
-			o.created_at,
-			(SELECT 
-			SUM(s.price * (1 - COALESCE(p.discount, 0)/100) * o.count) 
-			FROM orders o
-			JOIN locations l ON o.location_id = l.id
-			JOIN sizes s ON o.size_id = s.id
-			JOIN products p ON o.product_id = p.id
-			WHERE o.market_id = ? AND o.cart_order_id = ? AND o.user_id = ?) as sum
-		FROM orders o
-		JOIN locations l ON o.location_id = l.id
-		JOIN sizes s ON o.size_id = s.id
+			oh.id,
+			oh.order_number,
+			oh.user_id,
+			oh.cart_order_id, 
+			oh.market_id,
+			oh.name, 
+			oh.phone,
+			` + orderStatusSQL + `, 
+			MIN(l.location_address), 
+			MIN(l.location_address_ru),
+			oh.created_at,
+			SUM(` + lineRevenue + `) as sum
+		FROM orders oh
+		JOIN order_items o ON o.order_id = oh.id
+		JOIN locations l ON oh.location_id = l.id
+		JOIN product_variants v ON o.variant_id = v.id
 		JOIN products p ON o.product_id = p.id
-		WHERE o.market_id = ? AND o.cart_order_id = ? AND o.user_id = ?
-		GROUP BY o.id`,
-		marketID, cartOrderID, userID, marketID, cartOrderID, userID,
-	).Scan(&order.ID, &order.CartOrderID, &order.MarketID, &order.Name, &order.Phone, &order.Status, &order.LocationAddress, &order.LocationAddressRu, &order.CreatedAt, &order.Sum)
+		WHERE oh.id = ? AND oh.market_id = ?
+		GROUP BY oh.id`,
+		orderID, marketID,
+	).Scan(&order.OrderID, &order.OrderNumber, &order.ID, &order.CartOrderID, &order.MarketID, &order.Name, &order.Phone, &order.Status, &order.LocationAddress, &order.LocationAddressRu, &order.CreatedAt, &order.Sum)
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("order not found or not for this market")
+		return nil, ErrOrderNotForMarket
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to query order: %v", err)
@@ -2223,23 +2579,29 @@ func (s *DBService) GetMarketAdminOrderByID(marketID, cartOrderID, userID int) (
 	order.Sum = math.Round(order.Sum*100) / 100 // Round to 2 decimal places
 
 	// Fetch products
-	rows, err := s.db.Query(`
+	rows, err := s.db.QueryContext(ctx, `
 		SELECT 
 			p.id, 
+			v.id,
+			v.sku,
 			p.name, 
 			p.name_ru,
 			p.price, 
-			t.image_url, 
-			COALESCE(p.discount, 0), 
+			COALESCE((SELECT vi.image_url FROM product_variant_images vi WHERE vi.variant_id = v.id ORDER BY vi.position, vi.id LIMIT 1), t.image_url, ''), 
+			o.discount, 
 			p.created_at,
-			s.size, s.price, o.count,
-			(s.price * (1 - COALESCE(p.discount, 0)/100) * o.count) as product_sum
-		FROM orders o
-		LEFT JOIN products p ON o.product_id = p.id
+			o.unit_price, o.count,
+			` + lineRevenue + ` as product_sum,
+			o.id,
+			o.status,
+			COALESCE(o.status_note, ''),
+			o.shipment_id
+		FROM order_items o
+		JOIN products p ON o.product_id = p.id
+		JOIN product_variants v ON o.variant_id = v.id
 		LEFT JOIN thumbnails t ON o.thumbnail_id = t.id
-		LEFT JOIN sizes s ON o.size_id = s.id
-		WHERE o.cart_order_id = ? AND o.market_id = ? AND o.user_id = ?`,
-		cartOrderID, marketID, userID,
+		WHERE o.order_id = ?`,
+		orderID,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query products: %v", err)
@@ -2247,25 +2609,51 @@ func (s *DBService) GetMarketAdminOrderByID(marketID, cartOrderID, userID int) (
 	defer rows.Close()
 
 	var products []models.MarketAdminOrderProduct
+	var variantIDs []int
 	for rows.Next() {
 		var prod models.MarketAdminOrderProduct
-		if err := rows.Scan(&prod.ID, &prod.Name, &prod.NameRu, &prod.Price, &prod.ImageURL, &prod.Discount, &prod.CreatedAt,
-			&prod.Size, &prod.SizePrice, &prod.Count, &prod.Sum); err != nil {
+		var shipmentID sql.NullInt64
+		if err := rows.Scan(&prod.ID, &prod.VariantID, &prod.SKU, &prod.Name, &prod.NameRu, &prod.Price, &prod.ImageURL, &prod.Discount, &prod.CreatedAt,
+			&prod.SizePrice, &prod.Count, &prod.Sum, &prod.ItemID, &prod.Status, &prod.StatusNote, &shipmentID); err != nil {
 			return nil, fmt.Errorf("failed to scan product: %v", err)
 		}
+		if shipmentID.Valid {
+			id := int(shipmentID.Int64)
+			prod.ShipmentID = &id
+		}
 		prod.Sum = math.Round(prod.Sum*100) / 100 // Round to 2 decimal places
 		products = append(products, prod)
+		variantIDs = append(variantIDs, prod.VariantID)
+	}
+
+	attributes, err := s.getVariantAttributes(ctx, variantIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range products {
+		products[i].Attributes = attributes[products[i].VariantID]
+		if products[i].Attributes == nil {
+			products[i].Attributes = []models.VariantAttribute{}
+		}
+		products[i].Size, _ = attributeValue(products[i].Attributes, "size")
 	}
 	order.Products = products
 
+	order.Shipments, err = s.getOrderShipments(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+
 	return &order, nil
 }
 
 // DeleteLocation deletes a user's location if no orders reference it
-func (s *DBService) DeleteLocation(userID, locationID int) error {
+func (s *DBService) DeleteLocation(ctx context.Context, userID, locationID int) error {
+	ctx, span := tracer.Start(ctx, "DBService.DeleteLocation")
+	defer span.End()
 	// Verify location exists and belongs to user
 	var exists bool
-	err := s.db.QueryRow(`
+	err := s.db.QueryRowContext(ctx, `
 		SELECT EXISTS(
 			SELECT 1 
 			FROM locations 
@@ -2275,11 +2663,11 @@ func (s *DBService) DeleteLocation(userID, locationID int) error {
 		return fmt.Errorf("failed to verify location: %v", err)
 	}
 	if !exists {
-		return fmt.Errorf("location not found or not owned by user")
+		return ErrLocationNotOwned
 	}
 
 	// Check for orders referencing the location
-	err = s.db.QueryRow(`
+	err = s.db.QueryRowContext(ctx, `
 		SELECT EXISTS(
 			SELECT 1 
 			FROM orders 
@@ -2289,11 +2677,11 @@ func (s *DBService) DeleteLocation(userID, locationID int) error {
 		return fmt.Errorf("failed to check orders: %v", err)
 	}
 	if exists {
-		return fmt.Errorf("location is referenced by orders and cannot be deleted")
+		return ErrLocationInUse
 	}
 
 	// Delete the location
-	_, err = s.db.Exec(`
+	_, err = s.db.ExecContext(ctx, `
 		DELETE FROM locations 
 		WHERE id = ? AND user_id = ?`, locationID, userID)
 	if err != nil {
@@ -2304,15 +2692,17 @@ func (s *DBService) DeleteLocation(userID, locationID int) error {
 }
 
 // ClearCart deletes all cart entries for a user
-func (s *DBService) ClearCart(userID int) error {
-	tx, err := s.db.Begin()
+func (s *DBService) ClearCart(ctx context.Context, userID int) error {
+	ctx, span := tracer.Start(ctx, "DBService.ClearCart")
+	defer span.End()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("failed to start transaction: %v", err)
 	}
 	defer tx.Rollback()
 
 	// Delete all cart entries for the user
-	_, err = tx.Exec("DELETE FROM carts WHERE user_id = ?", userID)
+	_, err = tx.ExecContext(ctx, "DELETE FROM carts WHERE user_id = ?", userID)
 	if err != nil {
 		return fmt.Errorf("failed to clear cart: %v", err)
 	}
@@ -2324,16 +2714,18 @@ func (s *DBService) ClearCart(userID int) error {
 	return nil
 }
 
-// DeleteCartBySizeID deletes a cart entry for a user based on size_id
-func (s *DBService) DeleteCartBySizeID(userID, sizeID int) error {
-	tx, err := s.db.Begin()
+// DeleteCartBySizeID deletes an open cart entry for a user based on size_id
+func (s *DBService) DeleteCartBySizeID(ctx context.Context, userID, sizeID int) error {
+	ctx, span := tracer.Start(ctx, "DBService.DeleteCartBySizeID")
+	defer span.End()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("failed to start transaction: %v", err)
 	}
 	defer tx.Rollback()
 
 	// Delete cart entry
-	result, err := tx.Exec("DELETE FROM carts WHERE user_id = ? AND size_id = ?", userID, sizeID)
+	result, err := tx.ExecContext(ctx, "DELETE FROM carts WHERE user_id = ? AND size_id = ? AND "+openCartRow, userID, sizeID)
 	if err != nil {
 		return fmt.Errorf("failed to delete cart entry: %v", err)
 	}
@@ -2343,7 +2735,7 @@ func (s *DBService) DeleteCartBySizeID(userID, sizeID int) error {
 		return fmt.Errorf("failed to check rows affected: %v", err)
 	}
 	if rowsAffected == 0 {
-		return fmt.Errorf("cart entry not found")
+		return ErrCartItemNotFound
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -2353,9 +2745,11 @@ func (s *DBService) DeleteCartBySizeID(userID, sizeID int) error {
 	return nil
 }
 
-// UpdateCartCountBySizeID updates the count of a cart entry for a user based on size_id
-func (s *DBService) UpdateCartCountBySizeID(userID, sizeID, countChange int) (int, error) {
-	tx, err := s.db.Begin()
+// UpdateCartCountBySizeID updates the count of an open cart entry for a user based on size_id
+func (s *DBService) UpdateCartCountBySizeID(ctx context.Context, userID, sizeID, countChange int) (int, error) {
+	ctx, span := tracer.Start(ctx, "DBService.UpdateCartCountBySizeID")
+	defer span.End()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return 0, fmt.Errorf("failed to start transaction: %v", err)
 	}
@@ -2364,7 +2758,7 @@ func (s *DBService) UpdateCartCountBySizeID(userID, sizeID, countChange int) (in
 	
 
 	// Update count
-	result, err := tx.Exec("UPDATE carts SET count = ? WHERE user_id = ? AND size_id = ?", countChange, userID, sizeID)
+	result, err := tx.ExecContext(ctx, "UPDATE carts SET count = ? WHERE user_id = ? AND size_id = ? AND "+openCartRow, countChange, userID, sizeID)
 	if err != nil {
 		return 0, fmt.Errorf("failed to update cart entry: %v", err)
 	}
@@ -2374,7 +2768,7 @@ func (s *DBService) UpdateCartCountBySizeID(userID, sizeID, countChange int) (in
 		return 0, fmt.Errorf("failed to check rows affected: %v", err)
 	}
 	if rowsAffected == 0 {
-		return 0, fmt.Errorf("cart entry not found")
+		return 0, ErrCartItemNotFound
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -2384,9 +2778,71 @@ func (s *DBService) UpdateCartCountBySizeID(userID, sizeID, countChange int) (in
 	return countChange, nil
 }
 
+// DeleteCartByVariantID deletes an open cart entry for a user based on variant_id
+func (s *DBService) DeleteCartByVariantID(ctx context.Context, userID, variantID int) error {
+	ctx, span := tracer.Start(ctx, "DBService.DeleteCartByVariantID")
+	defer span.End()
+	result, err := s.db.ExecContext(ctx, "DELETE FROM carts WHERE user_id = ? AND variant_id = ? AND "+openCartRow, userID, variantID)
+	if err != nil {
+		return fmt.Errorf("failed to delete cart entry: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to check rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		return ErrCartItemNotFound
+	}
+
+	return nil
+}
+
+// UpdateCartCountByVariantID sets the count of an open cart entry for a user based on variant_id
+func (s *DBService) UpdateCartCountByVariantID(ctx context.Context, userID, variantID, count int) (int, error) {
+	ctx, span := tracer.Start(ctx, "DBService.UpdateCartCountByVariantID")
+	defer span.End()
+	if count <= 0 {
+		return 0, ErrInvalidCount
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var stock int
+	err = tx.QueryRowContext(ctx, `
+		SELECT v.stock FROM carts
+		JOIN product_variants v ON carts.variant_id = v.id
+		WHERE carts.user_id = ? AND carts.variant_id = ? AND `+openCartRow, userID, variantID).Scan(&stock)
+	if err == sql.ErrNoRows {
+		return 0, ErrCartItemNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch cart entry: %v", err)
+	}
+	if count > stock {
+		return 0, ErrInsufficientStock.WithDetails(map[string]interface{}{"variant_id": variantID}, variantID)
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE carts SET count = ? WHERE user_id = ? AND variant_id = ? AND "+openCartRow, count, userID, variantID); err != nil {
+		return 0, fmt.Errorf("failed to update cart entry: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return count, nil
+}
+
 // UpdateLocationByID updates a location entry for a user based on location_id
-func (s *DBService) UpdateLocationByID(userID, locationID int, req models.UpdateLocationRequest) (models.Location, error) {
-	tx, err := s.db.Begin()
+func (s *DBService) UpdateLocationByID(ctx context.Context, userID, locationID int, req models.UpdateLocationRequest) (models.Location, error) {
+	ctx, span := tracer.Start(ctx, "DBService.UpdateLocationByID")
+	defer span.End()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return models.Location{}, fmt.Errorf("failed to start transaction: %v", err)
 	}
@@ -2407,14 +2863,14 @@ func (s *DBService) UpdateLocationByID(userID, locationID int, req models.Update
 	}
 
 	if len(updates) == 0 {
-		return models.Location{}, fmt.Errorf("no fields provided to update")
+		return models.Location{}, ErrNoFieldsToUpdate
 	}
 
 	query += strings.Join(updates, ", ") + " WHERE id = ? AND user_id = ?"
 	args = append(args, locationID, userID)
 
 	// Execute update
-	result, err := tx.Exec(query, args...)
+	result, err := tx.ExecContext(ctx, query, args...)
 	if err != nil {
 		return models.Location{}, fmt.Errorf("failed to update location: %v", err)
 	}
@@ -2424,15 +2880,15 @@ func (s *DBService) UpdateLocationByID(userID, locationID int, req models.Update
 		return models.Location{}, fmt.Errorf("failed to check rows affected: %v", err)
 	}
 	if rowsAffected == 0 {
-		return models.Location{}, fmt.Errorf("location not found or unauthorized")
+		return models.Location{}, ErrLocationNotFound
 	}
 
 	// Fetch updated location
 	var loc models.Location
-	err = tx.QueryRow("SELECT id, user_id, location_name, location_address FROM locations WHERE id = ? AND user_id = ?",
+	err = tx.QueryRowContext(ctx, "SELECT id, user_id, location_name, location_address FROM locations WHERE id = ? AND user_id = ?",
 		locationID, userID).Scan(&loc.ID, &loc.UserID, &loc.LocationName, &loc.LocationAddress)
 	if err == sql.ErrNoRows {
-		return models.Location{}, fmt.Errorf("location not found after update")
+		return models.Location{}, ErrLocationNotFound
 	}
 	if err != nil {
 		return models.Location{}, fmt.Errorf("failed to fetch updated location: %v", err)
@@ -2446,12 +2902,14 @@ func (s *DBService) UpdateLocationByID(userID, locationID int, req models.Update
 }
 
 // GetUserProfile retrieves the profile data for a user
-func (s *DBService) GetUserProfile(userID int) (models.UserProfile, error) {
+func (s *DBService) GetUserProfile(ctx context.Context, userID int) (models.UserProfile, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetUserProfile")
+	defer span.End()
 	var profile models.UserProfile
-	err := s.db.QueryRow("SELECT id, COALESCE(full_name, ''), COALESCE(phone, '') FROM users WHERE id = ?", userID).
+	err := s.db.QueryRowContext(ctx, "SELECT id, COALESCE(full_name, ''), COALESCE(phone, '') FROM users WHERE id = ?", userID).
 		Scan(&profile.ID, &profile.FullName, &profile.Phone)
 	if err == sql.ErrNoRows {
-		return models.UserProfile{}, fmt.Errorf("user not found")
+		return models.UserProfile{}, ErrUserNotFound
 	}
 	if err != nil {
 		return models.UserProfile{}, fmt.Errorf("failed to fetch user profile: %v", err)
@@ -2460,8 +2918,10 @@ func (s *DBService) GetUserProfile(userID int) (models.UserProfile, error) {
 }
 
 // UpdateUserProfile updates the profile data for a user
-func (s *DBService) UpdateUserProfile(userID int, req models.UpdateProfileRequest) (models.UserProfile, error) {
-	tx, err := s.db.Begin()
+func (s *DBService) UpdateUserProfile(ctx context.Context, userID int, req models.UpdateProfileRequest) (models.UserProfile, error) {
+	ctx, span := tracer.Start(ctx, "DBService.UpdateUserProfile")
+	defer span.End()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return models.UserProfile{}, fmt.Errorf("failed to start transaction: %v", err)
 	}
@@ -2476,20 +2936,17 @@ func (s *DBService) UpdateUserProfile(userID int, req models.UpdateProfileReques
 		updates = append(updates, "full_name = ?")
 		args = append(args, req.FullName)
 	}
-	if req.Phone != "" {
-		updates = append(updates, "phone = ?")
-		args = append(args, req.Phone)
-	}
+	// The phone is the login identity and only changes through RequestPhoneChange/ConfirmPhoneChange
 
 	if len(updates) == 0 {
-		return models.UserProfile{}, fmt.Errorf("no fields provided to update")
+		return models.UserProfile{}, ErrNoFieldsToUpdate
 	}
 
 	query += strings.Join(updates, ", ") + " WHERE id = ?"
 	args = append(args, userID)
 
 	// Execute update
-	result, err := tx.Exec(query, args...)
+	result, err := tx.ExecContext(ctx, query, args...)
 	if err != nil {
 		return models.UserProfile{}, fmt.Errorf("failed to update profile: %v", err)
 	}
@@ -2499,15 +2956,15 @@ func (s *DBService) UpdateUserProfile(userID int, req models.UpdateProfileReques
 		return models.UserProfile{}, fmt.Errorf("failed to check rows affected: %v", err)
 	}
 	if rowsAffected == 0 {
-		return models.UserProfile{}, fmt.Errorf("user not found")
+		return models.UserProfile{}, ErrUserNotFound
 	}
 
 	// Fetch updated profile
 	var profile models.UserProfile
-	err = tx.QueryRow("SELECT id, COALESCE(full_name, ''), COALESCE(phone, '') FROM users WHERE id = ?", userID).
+	err = tx.QueryRowContext(ctx, "SELECT id, COALESCE(full_name, ''), COALESCE(phone, '') FROM users WHERE id = ?", userID).
 		Scan(&profile.ID, &profile.FullName, &profile.Phone)
 	if err == sql.ErrNoRows {
-		return models.UserProfile{}, fmt.Errorf("user not found after update")
+		return models.UserProfile{}, ErrUserNotFound
 	}
 	if err != nil {
 		return models.UserProfile{}, fmt.Errorf("failed to fetch updated profile: %v", err)
@@ -2520,16 +2977,18 @@ func (s *DBService) UpdateUserProfile(userID int, req models.UpdateProfileReques
 	return profile, nil
 }
 
-func (s *DBService) GetMarketProfile(marketID int) (models.MarketProfile, error) {
+func (s *DBService) GetMarketProfile(ctx context.Context, marketID int) (models.MarketProfile, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetMarketProfile")
+	defer span.End()
 	var profile models.MarketProfile
-	err := s.db.QueryRow(`
+	err := s.db.QueryRowContext(ctx, `
 		SELECT id, COALESCE(phone, ''), delivery_price, COALESCE(name, ''), COALESCE(name_ru, ''),
-			COALESCE(location, ''), COALESCE(location_ru, ''), COALESCE(thumbnail_url, '')
+			COALESCE(location, ''), COALESCE(location_ru, ''), COALESCE(thumbnail_url, ''), COALESCE(order_prefix, '')
 		FROM markets WHERE id = ?`, marketID).
 		Scan(&profile.ID, &profile.Phone, &profile.DeliveryPrice, &profile.Name, &profile.NameRu,
-			&profile.Location, &profile.LocationRu, &profile.ThumbnailURL)
+			&profile.Location, &profile.LocationRu, &profile.ThumbnailURL, &profile.OrderPrefix)
 	if err == sql.ErrNoRows {
-		return models.MarketProfile{}, fmt.Errorf("market not found")
+		return models.MarketProfile{}, ErrMarketNotFound
 	}
 	if err != nil {
 		return models.MarketProfile{}, fmt.Errorf("failed to fetch market profile: %v", err)
@@ -2538,8 +2997,10 @@ func (s *DBService) GetMarketProfile(marketID int) (models.MarketProfile, error)
 }
 
 // UpdateMarketProfile updates the profile data for a market
-func (s *DBService) UpdateMarketProfile(marketID int, req models.UpdateMarketProfileRequest, thumbnailURL string) (models.MarketProfile, error) {
-	tx, err := s.db.Begin()
+func (s *DBService) UpdateMarketProfile(ctx context.Context, marketID int, req models.UpdateMarketProfileRequest, thumbnailURL string) (models.MarketProfile, error) {
+	ctx, span := tracer.Start(ctx, "DBService.UpdateMarketProfile")
+	defer span.End()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return models.MarketProfile{}, fmt.Errorf("failed to start transaction: %v", err)
 	}
@@ -2547,9 +3008,9 @@ func (s *DBService) UpdateMarketProfile(marketID int, req models.UpdateMarketPro
 
 	// Fetch current thumbnail_url
 	var oldThumbnailURL string
-	err = tx.QueryRow("SELECT COALESCE(thumbnail_url, '') FROM markets WHERE id = ?", marketID).Scan(&oldThumbnailURL)
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(thumbnail_url, '') FROM markets WHERE id = ?", marketID).Scan(&oldThumbnailURL)
 	if err == sql.ErrNoRows {
-		return models.MarketProfile{}, fmt.Errorf("market not found")
+		return models.MarketProfile{}, ErrMarketNotFound
 	}
 	if err != nil {
 		return models.MarketProfile{}, fmt.Errorf("failed to fetch current thumbnail: %v", err)
@@ -2584,17 +3045,24 @@ func (s *DBService) UpdateMarketProfile(marketID int, req models.UpdateMarketPro
 		updates = append(updates, "thumbnail_url = ?")
 		args = append(args, thumbnailURL)
 	}
+	if req.OrderPrefix != "" {
+		updates = append(updates, "order_prefix = ?")
+		args = append(args, req.OrderPrefix)
+	}
 
 	if len(updates) == 0 {
-		return models.MarketProfile{}, fmt.Errorf("no fields provided to update")
+		return models.MarketProfile{}, ErrNoFieldsToUpdate
 	}
 
 	query += strings.Join(updates, ", ") + " WHERE id = ?"
 	args = append(args, marketID)
 
 	// Execute update
-	result, err := tx.Exec(query, args...)
+	result, err := tx.ExecContext(ctx, query, args...)
 	if err != nil {
+		if strings.Contains(err.Error(), "Duplicate entry") {
+			return models.MarketProfile{}, ErrOrderPrefixTaken
+		}
 		return models.MarketProfile{}, fmt.Errorf("failed to update market profile: %v", err)
 	}
 
@@ -2603,7 +3071,7 @@ func (s *DBService) UpdateMarketProfile(marketID int, req models.UpdateMarketPro
 		return models.MarketProfile{}, fmt.Errorf("failed to check rows affected: %v", err)
 	}
 	if rowsAffected == 0 {
-		return models.MarketProfile{}, fmt.Errorf("market not found")
+		return models.MarketProfile{}, ErrMarketNotFound
 	}
 
 	// Delete old thumbnail if new one is provided and old one exists
@@ -2616,14 +3084,14 @@ func (s *DBService) UpdateMarketProfile(marketID int, req models.UpdateMarketPro
 
 	// Fetch updated profile
 	var profile models.MarketProfile
-	err = tx.QueryRow(`
+	err = tx.QueryRowContext(ctx, `
 		SELECT id, COALESCE(phone, ''), delivery_price, COALESCE(name, ''), COALESCE(name_ru, ''),
-			COALESCE(location, ''), COALESCE(location_ru, ''), COALESCE(thumbnail_url, '')
+			COALESCE(location, ''), COALESCE(location_ru, ''), COALESCE(thumbnail_url, ''), COALESCE(order_prefix, '')
 		FROM markets WHERE id = ?`, marketID).
 		Scan(&profile.ID, &profile.Phone, &profile.DeliveryPrice, &profile.Name, &profile.NameRu,
-			&profile.Location, &profile.LocationRu, &profile.ThumbnailURL)
+			&profile.Location, &profile.LocationRu, &profile.ThumbnailURL, &profile.OrderPrefix)
 	if err == sql.ErrNoRows {
-		return models.MarketProfile{}, fmt.Errorf("market not found after update")
+		return models.MarketProfile{}, ErrMarketNotFound
 	}
 	if err != nil {
 		return models.MarketProfile{}, fmt.Errorf("failed to fetch updated market profile: %v", err)
@@ -2634,21 +3102,23 @@ func (s *DBService) UpdateMarketProfile(marketID int, req models.UpdateMarketPro
 	}
 
 	// Invalidate cache
-	s.redis.Del(context.Background(), "markets:*")
+	s.redis.Del(ctx, "markets:*")
 
 	return profile, nil
 }
 
 // CreateBanner inserts a new banner into the banners table
-func (s *DBService) CreateBanner(req models.CreateBannerRequest, thumbnailURL string) (models.Banner, error) {
-	tx, err := s.db.Begin()
+func (s *DBService) CreateBanner(ctx context.Context, req models.CreateBannerRequest, thumbnailURL string) (models.Banner, error) {
+	ctx, span := tracer.Start(ctx, "DBService.CreateBanner")
+	defer span.End()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return models.Banner{}, fmt.Errorf("failed to start transaction: %v", err)
 	}
 	defer tx.Rollback()
 
 	// Insert banner
-	result, err := tx.Exec("INSERT INTO banners (description, thumbnail_url) VALUES (?, ?)", req.Description, thumbnailURL)
+	result, err := tx.ExecContext(ctx, "INSERT INTO banners (description, thumbnail_url) VALUES (?, ?)", req.Description, thumbnailURL)
 	if err != nil {
 		return models.Banner{}, fmt.Errorf("failed to insert banner: %v", err)
 	}
@@ -2661,7 +3131,7 @@ func (s *DBService) CreateBanner(req models.CreateBannerRequest, thumbnailURL st
 
 	// Fetch created banner
 	var banner models.Banner
-	err = tx.QueryRow("SELECT id, COALESCE(description, ''), COALESCE(thumbnail_url, '') FROM banners WHERE id = ?", id).
+	err = tx.QueryRowContext(ctx, "SELECT id, COALESCE(description, ''), COALESCE(thumbnail_url, '') FROM banners WHERE id = ?", id).
 		Scan(&banner.ID, &banner.Description, &banner.ThumbnailURL)
 	if err != nil {
 		return models.Banner{}, fmt.Errorf("failed to fetch created banner: %v", err)
@@ -2676,6 +3146,8 @@ func (s *DBService) CreateBanner(req models.CreateBannerRequest, thumbnailURL st
 
 // DeleteBanner deletes a banner by ID and returns its thumbnail URL
 func (s *DBService) DeleteBanner(ctx context.Context, bannerID int) (string, error) {
+    ctx, span := tracer.Start(ctx, "DBService.DeleteBanner")
+    defer span.End()
     tx, err := s.db.BeginTx(ctx, nil)
     if err != nil {
         return "", fmt.Errorf("failed to start transaction: %v", err)
@@ -2686,7 +3158,7 @@ func (s *DBService) DeleteBanner(ctx context.Context, bannerID int) (string, err
     var thumbnailURL string
     err = tx.QueryRowContext(ctx, "SELECT COALESCE(thumbnail_url, '') FROM banners WHERE id = ?", bannerID).Scan(&thumbnailURL)
     if err == sql.ErrNoRows {
-        return "", fmt.Errorf("banner not found")
+        return "", ErrBannerNotFound
     }
     if err != nil {
         return "", fmt.Errorf("failed to fetch banner: %v", err)
@@ -2703,7 +3175,7 @@ func (s *DBService) DeleteBanner(ctx context.Context, bannerID int) (string, err
         return "", fmt.Errorf("failed to check rows affected: %v", err)
     }
     if rowsAffected == 0 {
-        return "", fmt.Errorf("banner not found")
+        return "", ErrBannerNotFound
     }
 
     if err := tx.Commit(); err != nil {
@@ -2714,9 +3186,11 @@ func (s *DBService) DeleteBanner(ctx context.Context, bannerID int) (string, err
 }
 
 // GetAllBanners retrieves all banners from the banners table
-func (s *DBService) GetAllBanners() ([]models.Banner, error) {
+func (s *DBService) GetAllBanners(ctx context.Context) ([]models.Banner, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetAllBanners")
+	defer span.End()
 	query := "SELECT id, COALESCE(description, ''), COALESCE(thumbnail_url, '') FROM banners ORDER BY id DESC"
-	rows, err := s.db.Query(query)
+	rows, err := s.db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query banners: %v", err)
 	}
@@ -2738,9 +3212,11 @@ func (s *DBService) GetAllBanners() ([]models.Banner, error) {
 	return banners, nil
 }
 
-// UpdateOrderStatus updates the status of an order
-func (s *DBService) UpdateOrderStatus(cartOrderID, userID, marketID int, status string) error {
-	tx, err := s.db.Begin()
+// UpdateOrderStatus updates the status of the items of one of the market's orders that are still being fulfilled
+func (s *DBService) UpdateOrderStatus(ctx context.Context, orderID, marketID int, status string) error {
+	ctx, span := tracer.Start(ctx, "DBService.UpdateOrderStatus")
+	defer span.End()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("failed to start transaction: %v", err)
 	}
@@ -2748,50 +3224,65 @@ func (s *DBService) UpdateOrderStatus(cartOrderID, userID, marketID int, status
 
 	// Validate status
 	if status != "canceled" && status != "delivered" {
-		return fmt.Errorf("invalid status; must be 'canceled' or 'delivered'")
+		return ErrInvalidOrderStatus
 	}
 
 	// Verify order exists and is associated with the market
 	var exists bool
-	err = tx.QueryRow(`
+	err = tx.QueryRowContext(ctx, `
 		SELECT EXISTS (
 			SELECT 1 
-			FROM orders o 
-			WHERE o.cart_order_id = ? AND o.market_id = ? AND o.user_id = ?
-		)`, cartOrderID, marketID, userID).Scan(&exists)
+			FROM orders oh 
+			WHERE oh.id = ? AND oh.market_id = ?
+		)`, orderID, marketID).Scan(&exists)
 	if err != nil {
 		return fmt.Errorf("failed to verify order: %v", err)
 	}
 	if !exists {
-		return fmt.Errorf("order not found or not associated with this market")
+		return ErrOrderNotInMarket
 	}
 
-	// Update order status
-	result, err := tx.Exec("UPDATE orders SET status = ? WHERE cart_order_id = ? AND user_id = ? AND market_id = ?", status, cartOrderID, userID, marketID)
+	// Only items still being fulfilled change; delivered and cancelled items keep their status
+	items, err := lockOrderItems(ctx, tx, "o.order_id = ? AND "+openLine, orderID)
 	if err != nil {
-		return fmt.Errorf("failed to update order status: %v", err)
+		return err
 	}
-
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return fmt.Errorf("failed to check rows affected: %v", err)
+	if len(items) == 0 {
+		return ErrOrderHasNoOpenItems
 	}
-	if rowsAffected == 0 {
-		return fmt.Errorf("order not found")
+	itemIDs := make([]int, len(items))
+	for i, it := range items {
+		itemIDs[i] = it.id
+	}
+
+	// Update order status
+	if err := closeOrderItems(ctx, tx, itemIDs, status, ""); err != nil {
+		return err
 	}
 
 	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("failed to commit transaction: %v", err)
 	}
 
+	// Cancelled items were restocked
+	if status == models.OrderItemStatusCanceled {
+		s.invalidateMarketProductCaches(ctx, marketID)
+	}
+	order := items[0]
+	s.notifyOrderStatusChanged(ctx, order.userID, orderID, order.orderNumber, marketID, status)
+	s.publishOrderStatusEvent(ctx, order.userID, orderID, order.cartOrderID, marketID, status)
+	s.invalidateMarketAnalytics(ctx, marketID)
+
 	return nil
 }
 
 
 
 // DeleteUserHistory updates the status of an order
-func (s *DBService) DeleteUserHistory(orderID, userID int) error {
-	tx, err := s.db.Begin()
+func (s *DBService) DeleteUserHistory(ctx context.Context, orderID, userID int) error {
+	ctx, span := tracer.Start(ctx, "DBService.DeleteUserHistory")
+	defer span.End()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("failed to start transaction: %v", err)
 	}
@@ -2799,21 +3290,21 @@ func (s *DBService) DeleteUserHistory(orderID, userID int) error {
 
 
 	var exists bool
-	err = tx.QueryRow(`
+	err = tx.QueryRowContext(ctx, `
 		SELECT EXISTS (
 			SELECT 1 
-			FROM orders o 
-			WHERE o.id = ? AND o.user_id = ?
+			FROM orders oh 
+			WHERE oh.id = ? AND oh.user_id = ?
 		)`, orderID, userID).Scan(&exists)
 	if err != nil {
 		return fmt.Errorf("failed to verify order: %v", err)
 	}
 	if !exists {
-		return fmt.Errorf("order not found or not associated with this user")
+		return ErrOrderNotOwned
 	}
 
 	// Update order status
-	result, err := tx.Exec("UPDATE orders SET is_active = ? WHERE id = ?", false, orderID)
+	result, err := tx.ExecContext(ctx, "UPDATE orders SET is_active = ? WHERE id = ?", false, orderID)
 	if err != nil {
 		return fmt.Errorf("failed to update order is_active: %v", err)
 	}
@@ -2823,7 +3314,7 @@ func (s *DBService) DeleteUserHistory(orderID, userID int) error {
 		return fmt.Errorf("failed to check rows affected: %v", err)
 	}
 	if rowsAffected == 0 {
-		return fmt.Errorf("order not found")
+		return ErrOrderNotFound
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -2834,19 +3325,24 @@ func (s *DBService) DeleteUserHistory(orderID, userID int) error {
 }
 
 // GetUserOrders retrieves orders for a user, optionally filtered by status
-func (s *DBService) GetUserOrders(UserID int, status string) ([]models.UserOrder, error) {
+func (s *DBService) GetUserOrders(ctx context.Context, UserID int, status string) ([]models.UserOrder, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetUserOrders")
+	defer span.End()
 	query := `
 		SELECT 
-			o.cart_order_id,
-			o.status,
+			oh.id,
+			oh.order_number,
+			oh.cart_order_id,
+			` + orderStatusSQL + `,
 			m.name as market_name,
 			m.name_ru as market_name_ru,
-			SUM(s.price * (1 - COALESCE(p.discount, 0)/100) * o.count) + m.delivery_price as sum
-		FROM orders o 
-		JOIN markets m ON o.market_id = m.id
-		JOIN sizes s ON o.size_id = s.id
+			SUM(` + lineRevenue + `) + IF(MIN(` + cancelledLine + `), 0, m.delivery_price) as sum
+		FROM orders oh 
+		JOIN order_items o ON o.order_id = oh.id
+		JOIN markets m ON oh.market_id = m.id
+		JOIN product_variants v ON o.variant_id = v.id
 		JOIN products p ON o.product_id = p.id
-		WHERE o.is_active = true AND o.user_id = ?`
+		WHERE oh.is_active = true AND oh.user_id = ?`
 	args := []interface{}{UserID}
 
 	if status != "" {
@@ -2855,10 +3351,10 @@ func (s *DBService) GetUserOrders(UserID int, status string) ([]models.UserOrder
 	}
 
 	query += `
-		GROUP BY o.cart_order_id
-		ORDER BY o.created_at DESC`
+		GROUP BY oh.id
+		ORDER BY oh.created_at DESC`
 
-	rows, err := s.db.Query(query, args...)
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query orders: %v", err)
 	}
@@ -2867,7 +3363,7 @@ func (s *DBService) GetUserOrders(UserID int, status string) ([]models.UserOrder
 	var orders []models.UserOrder
 	for rows.Next() {
 		var o models.UserOrder
-		if err := rows.Scan(&o.CartOrderID, &o.Status, &o.MarketName, &o.MarketNameRu, &o.Sum); err != nil {
+		if err := rows.Scan(&o.ID, &o.OrderNumber, &o.CartOrderID, &o.Status, &o.MarketName, &o.MarketNameRu, &o.Sum); err != nil {
 			return nil, fmt.Errorf("failed to scan order: %v", err)
 		}
 		o.Sum = math.Round(o.Sum*100) / 100 // Round to 2 decimal places
@@ -2877,53 +3373,85 @@ func (s *DBService) GetUserOrders(UserID int, status string) ([]models.UserOrder
 		return nil, fmt.Errorf("error iterating order rows: %v", err)
 	}
 
-	// Fetch all products for all cart_order_ids
+	// Fetch the items of all orders
 	if len(orders) == 0 {
 		return orders, nil
 	}
-	cartOrderIDs := make([]interface{}, len(orders))
+	orderIDs := make([]interface{}, len(orders))
 	for i, o := range orders {
-		cartOrderIDs[i] = o.CartOrderID
+		orderIDs[i] = o.ID
 	}
 	query = `
 		SELECT 
-			o.cart_order_id,
+			o.order_id,
+			o.id,
+			o.count,
+			o.status,
+			COALESCE(o.status_note, ''),
+			COALESCE(sh.tracking_number, ''),
+			v.id,
+			v.sku,
 			p.name,
 			p.name_ru,
-			s.size,
-			t.color,
-			t.color_ru,
-			t.image_url,
-			o.created_at
-		FROM orders o
-		JOIN sizes s ON o.size_id = s.id
+			COALESCE((SELECT vi.image_url FROM product_variant_images vi WHERE vi.variant_id = v.id ORDER BY vi.position, vi.id LIMIT 1), t.image_url, ''),
+			o.created_at,
+			(SELECT r.id FROM return_request_items ri JOIN return_requests r ON r.id = ri.return_id
+				WHERE ri.item_id = o.id ORDER BY r.id DESC LIMIT 1),
+			COALESCE((SELECT r.status FROM return_request_items ri JOIN return_requests r ON r.id = ri.return_id
+				WHERE ri.item_id = o.id ORDER BY r.id DESC LIMIT 1), '')
+		FROM order_items o
+		JOIN product_variants v ON o.variant_id = v.id
 		JOIN products p ON o.product_id = p.id
-		JOIN thumbnails t ON t.id = o.thumbnail_id
-		WHERE o.is_active = true AND o.user_id = ? AND o.cart_order_id IN (` + placeholders(len(cartOrderIDs)) + `)`
-	args = append([]interface{}{UserID}, cartOrderIDs...)
-	rows2, err := s.db.Query(query, args...)
+		LEFT JOIN thumbnails t ON t.id = o.thumbnail_id
+		LEFT JOIN order_shipments sh ON sh.id = o.shipment_id
+		WHERE o.order_id IN (` + placeholders(len(orderIDs)) + `)`
+	rows2, err := s.db.QueryContext(ctx, query, orderIDs...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query products: %v", err)
 	}
 	defer rows2.Close()
 
 	productMap := make(map[int][]models.ProductsUserOrder)
+	var variantIDs []int
 	for rows2.Next() {
-		var cartOrderID int
+		var orderID int
 		var product models.ProductsUserOrder
-		if err := rows2.Scan(&cartOrderID, &product.ProductName, &product.ProductNameRu, &product.Size,
-			&product.Color, &product.ColorRu, &product.ImageURL, &product.CreatedAt); err != nil {
+		var returnID sql.NullInt64
+		if err := rows2.Scan(&orderID, &product.ItemID, &product.Count, &product.Status, &product.StatusNote,
+			&product.TrackingNumber, &product.VariantID, &product.SKU,
+			&product.ProductName, &product.ProductNameRu, &product.ImageURL, &product.CreatedAt, &returnID, &product.ReturnStatus); err != nil {
 			return nil, fmt.Errorf("failed to scan product: %v", err)
 		}
-		productMap[cartOrderID] = append(productMap[cartOrderID], product)
+		if returnID.Valid {
+			id := int(returnID.Int64)
+			product.ReturnID = &id
+		}
+		productMap[orderID] = append(productMap[orderID], product)
+		variantIDs = append(variantIDs, product.VariantID)
 	}
 	if err := rows2.Err(); err != nil {
 		return nil, fmt.Errorf("error iterating product rows: %v", err)
 	}
 
+	// Attach variant attributes and fill the legacy color/size fields from them
+	attributes, err := s.getVariantAttributes(ctx, variantIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, products := range productMap {
+		for i := range products {
+			products[i].Attributes = attributes[products[i].VariantID]
+			if products[i].Attributes == nil {
+				products[i].Attributes = []models.VariantAttribute{}
+			}
+			products[i].Color, products[i].ColorRu = attributeValue(products[i].Attributes, "color")
+			products[i].Size, _ = attributeValue(products[i].Attributes, "size")
+		}
+	}
+
 	// Assign products to orders
 	for i := range orders {
-		orders[i].Products = productMap[orders[i].CartOrderID]
+		orders[i].Products = productMap[orders[i].ID]
 	}
 
 	return orders, nil
@@ -2937,46 +3465,18 @@ func placeholders(n int) string {
 	return strings.Repeat("?,", n-1) + "?"
 }
 
-// CreateMessage inserts a new message into the user_messages table
-func (s *DBService) CreateMessage(userID int, req models.CreateMessageRequest) (int, error) {
-	tx, err := s.db.Begin()
-	if err != nil {
-		return 0, fmt.Errorf("failed to start transaction: %v", err)
-	}
-	defer tx.Rollback()
-
-	// Insert message
-	result, err := tx.Exec(
-		"INSERT INTO user_messages (user_id, full_name, phone, message) VALUES (?, ?, ?, ?)",
-		userID, req.FullName, req.Phone, req.Message,
-	)
-	if err != nil {
-		return 0, fmt.Errorf("failed to insert message: %v", err)
-	}
-
-	// Get inserted ID
-	id, err := result.LastInsertId()
-	if err != nil {
-		return 0, fmt.Errorf("failed to get inserted message ID: %v", err)
-	}
-
-	if err := tx.Commit(); err != nil {
-		return 0, fmt.Errorf("failed to commit transaction: %v", err)
-	}
-
-	return int(id), nil
-}
-
 // UpdateSize updates a size entry
-func (s *DBService) UpdateSize(sizeID int, req models.UpdateSizeRequest) (models.SizeUpdate, error) {
-	tx, err := s.db.Begin()
+func (s *DBService) UpdateSize(ctx context.Context, sizeID int, req models.UpdateSizeRequest) (models.SizeUpdate, error) {
+	ctx, span := tracer.Start(ctx, "DBService.UpdateSize")
+	defer span.End()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return models.SizeUpdate{}, fmt.Errorf("failed to start transaction: %v", err)
 	}
 	defer tx.Rollback()
 
 	// Update size
-	result, err := tx.Exec(
+	result, err := tx.ExecContext(ctx, 
 		"UPDATE sizes SET count = ?, price = ?, size = ? WHERE id = ?",
 		req.Count, req.Price, req.Size, sizeID,
 	)
@@ -2989,27 +3489,32 @@ func (s *DBService) UpdateSize(sizeID int, req models.UpdateSizeRequest) (models
 		return models.SizeUpdate{}, fmt.Errorf("failed to check rows affected: %v", err)
 	}
 	if rowsAffected == 0 {
-		return models.SizeUpdate{}, fmt.Errorf("size not found or not associated with this market")
+		return models.SizeUpdate{}, ErrSizeNotInMarket
 	}
 
 	// Fetch updated size
 	var size models.SizeUpdate
-	err = tx.QueryRow("SELECT id, count, price, COALESCE(size, '') FROM sizes WHERE id = ?", sizeID).
+	err = tx.QueryRowContext(ctx, "SELECT id, count, price, COALESCE(size, '') FROM sizes WHERE id = ?", sizeID).
 		Scan(&size.ID, &size.Count, &size.Price, &size.Size)
 	if err == sql.ErrNoRows {
-		return models.SizeUpdate{}, fmt.Errorf("size not found after update")
+		return models.SizeUpdate{}, ErrSizeNotInMarket
 	}
 	if err != nil {
 		return models.SizeUpdate{}, fmt.Errorf("failed to fetch updated size: %v", err)
 	}
 
+	// Mirror the size into the variant model
+	if err := syncSizeVariant(ctx, tx, sizeID); err != nil {
+		return models.SizeUpdate{}, err
+	}
+
 	if err := tx.Commit(); err != nil {
 		return models.SizeUpdate{}, fmt.Errorf("failed to commit transaction: %v", err)
 	}
 
 	// Fetch marketID to invalidate market-specific caches
 	var marketID int
-	err = s.db.QueryRow(`
+	err = s.db.QueryRowContext(ctx, `
         SELECT p.market_id
         FROM sizes s
         JOIN thumbnails t ON s.thumbnail_id = t.id
@@ -3017,14 +3522,14 @@ func (s *DBService) UpdateSize(sizeID int, req models.UpdateSizeRequest) (models
         WHERE s.id = ?
     `, sizeID).Scan(&marketID)
 	if err != nil {
-		log.Printf("Failed to fetch marketID for size %d: %v", sizeID, err)
+		slog.Warn("Failed to fetch market of size for cache invalidation", "size_id", sizeID, "error", err)
 	} else {
 		// Invalidate market-specific product caches
-		marketKeys, err := s.redis.SMembers(context.Background(), fmt.Sprintf("market:%d:products_cache_keys", marketID)).Result()
+		marketKeys, err := s.redis.SMembers(ctx, fmt.Sprintf("market:%d:products_cache_keys", marketID)).Result()
 		if err == nil && len(marketKeys) > 0 {
-			s.redis.Del(context.Background(), marketKeys...)
+			s.redis.Del(ctx, marketKeys...)
 		} else if err != nil && err != redis.Nil {
-			log.Printf("Failed to invalidate market cache: %v", err)
+			slog.Warn("Failed to invalidate market cache", "market_id", marketID, "error", err)
 		}
 	}
 
@@ -3032,11 +3537,13 @@ func (s *DBService) UpdateSize(sizeID int, req models.UpdateSizeRequest) (models
 }
 
 // UpdateThumbnail updates a thumbnail entry and returns the old image URL
-func (s *DBService) UpdateThumbnail(thumbnailID int, color, color_ru string, marketID int, files []*multipart.FileHeader) (string, string, string, error) {
+func (s *DBService) UpdateThumbnail(ctx context.Context, thumbnailID int, color, color_ru string, marketID int, files []*multipart.FileHeader) (string, string, string, error) {
+	ctx, span := tracer.Start(ctx, "DBService.UpdateThumbnail")
+	defer span.End()
 	var productID int
 	var filePath string
 	var imageCreated string
-	err := s.db.QueryRow("SELECT product_id FROM thumbnails WHERE id = ?", thumbnailID).Scan(&productID)
+	err := s.db.QueryRowContext(ctx, "SELECT product_id FROM thumbnails WHERE id = ?", thumbnailID).Scan(&productID)
 	if err == sql.ErrNoRows {
 		return "", "", "", fmt.Errorf("thumbnail not found: %v", err)
 	}
@@ -3083,7 +3590,7 @@ func (s *DBService) UpdateThumbnail(thumbnailID int, color, color_ru string, mar
 		ColorRu:   color_ru,
 		ImageURL:  imageURL,
 	}
-	tx, err := s.db.Begin()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return "", "", "", fmt.Errorf("failed to start transaction: %v", err)
 	}
@@ -3091,21 +3598,21 @@ func (s *DBService) UpdateThumbnail(thumbnailID int, color, color_ru string, mar
 
 	// Fetch old image URL and verify market ownership
 	var oldImageURL string
-	err = tx.QueryRow(`
+	err = tx.QueryRowContext(ctx, `
 		SELECT t.image_url 
 		FROM thumbnails t
 		JOIN products p ON t.product_id = p.id
 		WHERE t.id = ? AND p.market_id = ?
 	`, thumbnailID, marketID).Scan(&oldImageURL)
 	if err == sql.ErrNoRows {
-		return "", "", "", fmt.Errorf("thumbnail not found or not associated with this market")
+		return "", "", "", ErrThumbnailNotInMarket
 	}
 	if err != nil {
 		return "", "", "", fmt.Errorf("failed to fetch thumbnail: %v", err)
 	}
 
 	// Update thumbnail
-	result, err := tx.Exec(
+	result, err := tx.ExecContext(ctx, 
 		"UPDATE thumbnails SET color = ?, color_ru = ?, image_url = ? WHERE id = ?",
 		thumb.Color, thumb.ColorRu, thumb.ImageURL, thumbnailID,
 	)
@@ -3118,7 +3625,12 @@ func (s *DBService) UpdateThumbnail(thumbnailID int, color, color_ru string, mar
 		return "", "", "", fmt.Errorf("failed to check rows affected: %v", err)
 	}
 	if rowsAffected == 0 {
-		return "", "", "", fmt.Errorf("thumbnail not found")
+		return "", "", "", ErrThumbnailNotFound
+	}
+
+	// Mirror the new color and image into the variants of this thumbnail's sizes
+	if err := syncThumbnailVariants(ctx, tx, thumbnailID); err != nil {
+		return "", "", "", err
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -3126,13 +3638,15 @@ func (s *DBService) UpdateThumbnail(thumbnailID int, color, color_ru string, mar
 	}
 
 	// Invalidate cache
-	s.redis.Del(context.Background(), fmt.Sprintf("market:%d:products:*", marketID))
+	s.redis.Del(ctx, fmt.Sprintf("market:%d:products:*", marketID))
 
 	return oldImageURL, filePath, imageCreated, nil
 }
 
 // GetAllUserMessages retrieves all user messages
-func (s *DBService) GetAllUserMessages() ([]models.UserMessage, error) {
+func (s *DBService) GetAllUserMessages(ctx context.Context) ([]models.UserMessage, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetAllUserMessages")
+	defer span.End()
 	query := `
 		SELECT 
 			id, 
@@ -3142,7 +3656,7 @@ func (s *DBService) GetAllUserMessages() ([]models.UserMessage, error) {
 			COALESCE(message, '')
 		FROM user_messages
 	`
-	rows, err := s.db.Query(query)
+	rows, err := s.db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query user messages: %v", err)
 	}
@@ -3165,14 +3679,16 @@ func (s *DBService) GetAllUserMessages() ([]models.UserMessage, error) {
 }
 
 // DeleteUserMessage deletes a user message by ID
-func (s *DBService) DeleteUserMessage(id int) error {
-	tx, err := s.db.Begin()
+func (s *DBService) DeleteUserMessage(ctx context.Context, id int) error {
+	ctx, span := tracer.Start(ctx, "DBService.DeleteUserMessage")
+	defer span.End()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("failed to start transaction: %v", err)
 	}
 	defer tx.Rollback()
 
-	result, err := tx.Exec("DELETE FROM user_messages WHERE id = ?", id)
+	result, err := tx.ExecContext(ctx, "DELETE FROM user_messages WHERE id = ?", id)
 	if err != nil {
 		return fmt.Errorf("failed to delete user message: %v", err)
 	}
@@ -3182,7 +3698,7 @@ func (s *DBService) DeleteUserMessage(id int) error {
 		return fmt.Errorf("failed to check rows affected: %v", err)
 	}
 	if rowsAffected == 0 {
-		return fmt.Errorf("message not found")
+		return ErrMessageNotFound
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -3192,41 +3708,15 @@ func (s *DBService) DeleteUserMessage(id int) error {
 	return nil
 }
 
-// CreateMarketMessage inserts a new message into the market_messages table
-func (s *DBService) CreateMarketMessage(marketID int, req models.CreateMarketMessageRequest) (int, error) {
-	tx, err := s.db.Begin()
-	if err != nil {
-		return 0, fmt.Errorf("failed to start transaction: %v", err)
-	}
-	defer tx.Rollback()
-
-	result, err := tx.Exec(
-		"INSERT INTO market_messages (market_id, full_name, phone, message) VALUES (?, ?, ?, ?)",
-		marketID, req.FullName, req.Phone, req.Message,
-	)
-	if err != nil {
-		return 0, fmt.Errorf("failed to insert market message: %v", err)
-	}
-
-	id, err := result.LastInsertId()
-	if err != nil {
-		return 0, fmt.Errorf("failed to get inserted message ID: %v", err)
-	}
-
-	if err := tx.Commit(); err != nil {
-		return 0, fmt.Errorf("failed to commit transaction: %v", err)
-	}
-
-	return int(id), nil
-}
-
 // GetAllMarketMessages retrieves all market messages
-func (s *DBService) GetAllMarketMessages() ([]models.MarketMessage, error) {
+func (s *DBService) GetAllMarketMessages(ctx context.Context) ([]models.MarketMessage, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetAllMarketMessages")
+	defer span.End()
 	query := `
 		SELECT id, market_id, COALESCE(full_name, ''), COALESCE(phone, ''), COALESCE(message, '')
 		FROM market_messages
 	`
-	rows, err := s.db.Query(query)
+	rows, err := s.db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query market messages: %v", err)
 	}
@@ -3249,14 +3739,16 @@ func (s *DBService) GetAllMarketMessages() ([]models.MarketMessage, error) {
 }
 
 // DeleteMarketMessage deletes a market message by ID
-func (s *DBService) DeleteMarketMessage(id int) error {
-	tx, err := s.db.Begin()
+func (s *DBService) DeleteMarketMessage(ctx context.Context, id int) error {
+	ctx, span := tracer.Start(ctx, "DBService.DeleteMarketMessage")
+	defer span.End()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("failed to start transaction: %v", err)
 	}
 	defer tx.Rollback()
 
-	result, err := tx.Exec("DELETE FROM market_messages WHERE id = ?", id)
+	result, err := tx.ExecContext(ctx, "DELETE FROM market_messages WHERE id = ?", id)
 	if err != nil {
 		return fmt.Errorf("failed to delete market message: %v", err)
 	}
@@ -3266,7 +3758,7 @@ func (s *DBService) DeleteMarketMessage(id int) error {
 		return fmt.Errorf("failed to check rows affected: %v", err)
 	}
 	if rowsAffected == 0 {
-		return fmt.Errorf("message not found")
+		return ErrMessageNotFound
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -3277,6 +3769,8 @@ func (s *DBService) DeleteMarketMessage(id int) error {
 }
 // GetUsers retrieves paginated users from the database with optional search
 func (s *DBService) GetUsers(ctx context.Context, page, limit int, search string) ([]models.User, error) {
+    ctx, span := tracer.Start(ctx, "DBService.GetUsers")
+    defer span.End()
     if page < 1 {
         page = 1
     }
@@ -3330,6 +3824,8 @@ func (s *DBService) GetUsers(ctx context.Context, page, limit int, search string
 
 // DeleteUser deletes a user by ID
 func (s *DBService) DeleteUser(ctx context.Context, userID int) error {
+    ctx, span := tracer.Start(ctx, "DBService.DeleteUser")
+    defer span.End()
     // Begin transaction
     tx, err := s.db.BeginTx(ctx, nil)
     if err != nil {
@@ -3344,7 +3840,7 @@ func (s *DBService) DeleteUser(ctx context.Context, userID int) error {
         return fmt.Errorf("failed to validate user: %v", err)
     }
     if !exists {
-        return fmt.Errorf("user not found")
+        return ErrUserNotFound
     }
 
     // Delete user
@@ -3358,7 +3854,7 @@ func (s *DBService) DeleteUser(ctx context.Context, userID int) error {
         return fmt.Errorf("failed to check rows affected: %v", err)
     }
     if rowsAffected == 0 {
-        return fmt.Errorf("user not found")
+        return ErrUserNotFound
     }
 
     // Commit transaction
@@ -3371,6 +3867,8 @@ func (s *DBService) DeleteUser(ctx context.Context, userID int) error {
 
 // UpdateUserVerified updates a user's verified status
 func (s *DBService) UpdateUserVerified(ctx context.Context, userID int, verified bool) error {
+    ctx, span := tracer.Start(ctx, "DBService.UpdateUserVerified")
+    defer span.End()
     // Begin transaction
     tx, err := s.db.BeginTx(ctx, nil)
     if err != nil {
@@ -3385,7 +3883,7 @@ func (s *DBService) UpdateUserVerified(ctx context.Context, userID int, verified
         return fmt.Errorf("failed to validate user: %v", err)
     }
     if !exists {
-        return fmt.Errorf("user not found")
+        return ErrUserNotFound
     }
 
     // Update verified status
@@ -3399,7 +3897,7 @@ func (s *DBService) UpdateUserVerified(ctx context.Context, userID int, verified
         return fmt.Errorf("failed to check rows affected: %v", err)
     }
     if rowsAffected == 0 {
-        return fmt.Errorf("user not found")
+        return ErrUserNotFound
     }
 
     // Commit transaction
@@ -3412,6 +3910,8 @@ func (s *DBService) UpdateUserVerified(ctx context.Context, userID int, verified
 
 // UpdateMarket updates a market and invalidates cache
 func (s *DBService) UpdateMarket(ctx context.Context, marketID int, password string, deliveryPrice *float64, phone, name, nameRu, location, locationRu string, isVIP *bool, thumbnailURL string) (oldThumbnailURL string, newThumbnailURL string, err error) {
+    ctx, span := tracer.Start(ctx, "DBService.UpdateMarket")
+    defer span.End()
     thumbnailURL = filepath.Join("/uploads/markets", thumbnailURL)
     thumbnailURL = strings.ReplaceAll(thumbnailURL, string(filepath.Separator), "/")
 	// Begin transaction
@@ -3425,7 +3925,7 @@ func (s *DBService) UpdateMarket(ctx context.Context, marketID int, password str
     err = tx.QueryRowContext(ctx, "SELECT COALESCE(thumbnail_url, '') FROM markets WHERE id = ?", marketID).Scan(&oldThumbnailURL)
     if err != nil {
         if err == sql.ErrNoRows {
-            return "", "", fmt.Errorf("market not found")
+            return "", "", ErrMarketNotFound
         }
         return "", "", fmt.Errorf("failed to validate market: %v", err)
     }
@@ -3447,6 +3947,15 @@ func (s *DBService) UpdateMarket(ctx context.Context, marketID int, password str
         args = append(args, *deliveryPrice)
     }
     if phone != "" {
+        // Staff phones share the market login namespace with owner phones
+        var exists bool
+        err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM markets WHERE phone = ? AND id <> ?) OR EXISTS(SELECT 1 FROM market_staff WHERE phone = ?)", phone, marketID, phone).Scan(&exists)
+        if err != nil {
+            return "", "", fmt.Errorf("failed to check phone: %v", err)
+        }
+        if exists {
+            return "", "", ErrPhoneTaken
+        }
         setClauses = append(setClauses, "phone = ?")
         args = append(args, phone)
     }
@@ -3503,10 +4012,10 @@ func (s *DBService) UpdateMarket(ctx context.Context, marketID int, password str
         pipe.Del(ctx, cacheKeys...)
         pipe.Del(ctx, "markets_cache_keys")
     } else if err != nil && err != redis.Nil {
-        log.Printf("Failed to fetch markets cache keys: %v", err)
+        slog.WarnContext(ctx, "Failed to fetch markets cache keys", "error", err)
     }
     if _, err := pipe.Exec(ctx); err != nil {
-        log.Printf("Failed to invalidate caches: %v", err)
+        slog.WarnContext(ctx, "Failed to invalidate caches", "error", err)
     }
 
     return oldThumbnailURL, thumbnailURL, nil
@@ -3515,6 +4024,8 @@ func (s *DBService) UpdateMarket(ctx context.Context, marketID int, password str
 
 // UpdateSuperadmin updates a superadmin's details
 func (s *DBService) UpdateSuperadmin(ctx context.Context, superadminID int, phone *string, fullName, username, password string) error {
+    ctx, span := tracer.Start(ctx, "DBService.UpdateSuperadmin")
+    defer span.End()
     // Begin transaction
     tx, err := s.db.BeginTx(ctx, nil)
     if err != nil {
@@ -3529,7 +4040,7 @@ func (s *DBService) UpdateSuperadmin(ctx context.Context, superadminID int, phon
         return fmt.Errorf("failed to validate superadmin: %v", err)
     }
     if !exists {
-        return fmt.Errorf("superadmin not found")
+        return ErrSuperadminNotFound
     }
 
     // Check username uniqueness if provided
@@ -3540,7 +4051,7 @@ func (s *DBService) UpdateSuperadmin(ctx context.Context, superadminID int, phon
             return fmt.Errorf("failed to check username: %v", err)
         }
         if count > 0 {
-            return fmt.Errorf("username already exists")
+            return ErrUsernameTaken
         }
     }
 
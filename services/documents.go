@@ -0,0 +1,424 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"strconv"
+	"strings"
+
+	"Dowlet_projects/ecommerce/models"
+)
+
+// orderDocument is an order laid out for printing in a single language
+type orderDocument struct {
+	Kind           string
+	Lang           string
+	OrderNumber    string
+	CreatedAt      string
+	MarketName     string
+	MarketLocation string
+	MarketPhone    string
+	CustomerName   string
+	CustomerPhone  string
+	Address        string
+	Notes          string
+	Items          []orderDocumentItem
+	Subtotal       float64
+	Delivery       float64
+	Total          float64
+}
+
+type orderDocumentItem struct {
+	Name      string
+	SKU       string
+	Options   string
+	Count     int
+	UnitPrice float64
+	Sum       float64
+}
+
+// ShowPrices reports whether the document lists prices; packing slips travel with the parcel and
+// leave them out
+func (d orderDocument) ShowPrices() bool {
+	return d.Kind != models.OrderDocumentPackingSlip
+}
+
+// Label returns a document caption in the document's language
+func (d orderDocument) Label(key string) string {
+	l, ok := documentLabels[key]
+	if !ok {
+		return key
+	}
+	if d.Lang == models.DocumentLangRu {
+		return l.ru
+	}
+	return l.en
+}
+
+// Money formats an amount with two decimals
+func (d orderDocument) Money(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+var documentLabels = map[string]struct{ en, ru string }{
+	models.OrderDocumentInvoice:     {"Invoice", "Счёт"},
+	models.OrderDocumentPackingSlip: {"Packing slip", "Упаковочный лист"},
+	models.OrderDocumentReceipt:     {"Receipt", "Чек"},
+	"order":                         {"Order", "Заказ"},
+	"date":                          {"Date", "Дата"},
+	"seller":                        {"Seller", "Продавец"},
+	"customer":                      {"Customer", "Покупатель"},
+	"ship_to":                       {"Ship to", "Адрес доставки"},
+	"phone":                         {"Phone", "Телефон"},
+	"notes":                         {"Notes", "Примечания"},
+	"item":                          {"Item", "Товар"},
+	"sku":                           {"SKU", "Артикул"},
+	"qty":                           {"Qty", "Кол-во"},
+	"price":                         {"Price", "Цена"},
+	"sum":                           {"Amount", "Сумма"},
+	"packed":                        {"Packed", "Упаковано"},
+	"subtotal":                      {"Subtotal", "Подытог"},
+	"delivery":                      {"Delivery", "Доставка"},
+	"total":                         {"Total", "Итого"},
+	"thanks":                        {"Thank you for your order!", "Спасибо за заказ!"},
+}
+
+// SetDocumentFont loads the TrueType font embedded into PDF order documents. Without it documents are
+// only available as HTML.
+func (s *DBService) SetDocumentFont(path string) error {
+	font, err := loadPDFFont(path)
+	if err != nil {
+		return err
+	}
+	s.documentFont = font
+	return nil
+}
+
+// RenderOrderDocument renders a printable document of an order for its customer (partyType user) or
+// its market, in English or Russian, as HTML or PDF. It returns the document, its content type and
+// the order number.
+func (s *DBService) RenderOrderDocument(ctx context.Context, partyType string, partyID, orderID int, kind, lang, format string) ([]byte, string, string, error) {
+	ctx, span := tracer.Start(ctx, "DBService.RenderOrderDocument")
+	defer span.End()
+	switch kind {
+	case models.OrderDocumentInvoice, models.OrderDocumentPackingSlip, models.OrderDocumentReceipt:
+	default:
+		return nil, "", "", ErrInvalidDocumentKind
+	}
+	if lang != models.DocumentLangEn && lang != models.DocumentLangRu {
+		return nil, "", "", ErrInvalidDocumentLang
+	}
+	if format != models.DocumentFormatHTML && format != models.DocumentFormatPDF {
+		return nil, "", "", ErrInvalidDocumentFormat
+	}
+	if format == models.DocumentFormatPDF && s.documentFont == nil {
+		return nil, "", "", ErrDocumentsUnavailable
+	}
+
+	doc, err := s.getOrderDocument(ctx, partyType, partyID, orderID, lang)
+	if err != nil {
+		return nil, "", "", err
+	}
+	doc.Kind = kind
+
+	if format == models.DocumentFormatPDF {
+		data, err := renderOrderDocumentPDF(s.documentFont, doc)
+		if err != nil {
+			return nil, "", "", err
+		}
+		return data, "application/pdf", doc.OrderNumber, nil
+	}
+	var buf bytes.Buffer
+	if err := orderDocumentTemplate.Execute(&buf, doc); err != nil {
+		return nil, "", "", fmt.Errorf("failed to render document: %v", err)
+	}
+	return buf.Bytes(), "text/html; charset=utf-8", doc.OrderNumber, nil
+}
+
+// getOrderDocument loads an order with its items that were not cancelled, picking the Russian
+// texts where they exist when lang is ru
+func (s *DBService) getOrderDocument(ctx context.Context, partyType string, partyID, orderID int, lang string) (orderDocument, error) {
+	var scope string
+	switch partyType {
+	case models.RecipientUser:
+		scope = "oh.user_id = ?"
+	case models.RecipientMarket:
+		scope = "oh.market_id = ?"
+	default:
+		return orderDocument{}, fmt.Errorf("invalid party type")
+	}
+
+	doc := orderDocument{Lang: lang}
+	var marketName, marketNameRu, location, locationRu, address, addressRu string
+	var deliveryPrice float64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT oh.order_number, oh.created_at, oh.name, oh.phone, COALESCE(oh.notes, ''),
+			COALESCE(l.location_address, ''), COALESCE(l.location_address_ru, ''),
+			COALESCE(m.name, ''), COALESCE(m.name_ru, ''), COALESCE(m.location, ''), COALESCE(m.location_ru, ''),
+			COALESCE(m.phone, ''), m.delivery_price
+		FROM orders oh
+		JOIN markets m ON m.id = oh.market_id
+		LEFT JOIN locations l ON l.id = oh.location_id
+		WHERE oh.id = ? AND `+scope,
+		orderID, partyID,
+	).Scan(&doc.OrderNumber, &doc.CreatedAt, &doc.CustomerName, &doc.CustomerPhone, &doc.Notes,
+		&address, &addressRu, &marketName, &marketNameRu, &location, &locationRu, &doc.MarketPhone, &deliveryPrice)
+	if err == sql.ErrNoRows {
+		return orderDocument{}, ErrOrderNotFound
+	}
+	if err != nil {
+		return orderDocument{}, fmt.Errorf("failed to query order: %v", err)
+	}
+	doc.MarketName = localized(marketName, marketNameRu, lang)
+	doc.MarketLocation = localized(location, locationRu, lang)
+	doc.Address = localized(address, addressRu, lang)
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT v.id, v.sku, p.name, COALESCE(p.name_ru, ''), o.count,
+			o.unit_price * (1 - o.discount/100)
+		FROM order_items o
+		JOIN products p ON p.id = o.product_id
+		JOIN product_variants v ON v.id = o.variant_id
+		WHERE o.order_id = ? AND NOT `+cancelledLine+`
+		ORDER BY o.id`,
+		orderID,
+	)
+	if err != nil {
+		return orderDocument{}, fmt.Errorf("failed to query order items: %v", err)
+	}
+	defer rows.Close()
+
+	var variantIDs []int
+	for rows.Next() {
+		var item orderDocumentItem
+		var variantID int
+		var name, nameRu string
+		if err := rows.Scan(&variantID, &item.SKU, &name, &nameRu, &item.Count, &item.UnitPrice); err != nil {
+			return orderDocument{}, fmt.Errorf("failed to scan order item: %v", err)
+		}
+		item.Name = localized(name, nameRu, lang)
+		item.UnitPrice = roundMoney(item.UnitPrice)
+		item.Sum = roundMoney(item.UnitPrice * float64(item.Count))
+		doc.Subtotal += item.Sum
+		doc.Items = append(doc.Items, item)
+		variantIDs = append(variantIDs, variantID)
+	}
+	if err := rows.Err(); err != nil {
+		return orderDocument{}, fmt.Errorf("error iterating order items: %v", err)
+	}
+
+	attributes, err := s.getVariantAttributes(ctx, variantIDs)
+	if err != nil {
+		return orderDocument{}, err
+	}
+	for i := range doc.Items {
+		var options []string
+		for _, a := range attributes[variantIDs[i]] {
+			options = append(options, a.Name+": "+localized(a.Value, a.ValueRu, lang))
+		}
+		doc.Items[i].Options = strings.Join(options, ", ")
+	}
+
+	// Delivery is charged unless every item was cancelled, as in the order totals
+	if len(doc.Items) > 0 {
+		doc.Delivery = deliveryPrice
+	}
+	doc.Subtotal = roundMoney(doc.Subtotal)
+	doc.Total = roundMoney(doc.Subtotal + doc.Delivery)
+	return doc, nil
+}
+
+// localized picks the Russian text for ru documents, falling back to the English one
+func localized(en, ru, lang string) string {
+	if lang == models.DocumentLangRu && ru != "" {
+		return ru
+	}
+	return en
+}
+
+var orderDocumentTemplate = template.Must(template.New("order_document").Funcs(template.FuncMap{
+	"inc": func(i int) int { return i + 1 },
+}).Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<title>{{.Label .Kind}} {{.OrderNumber}}</title>
+<style>
+body { font-family: "DejaVu Sans", Arial, sans-serif; font-size: 13px; color: #222; margin: 32px; }
+h1 { font-size: 22px; margin: 0 0 4px; }
+.meta { color: #555; margin-bottom: 24px; }
+.parties { display: flex; gap: 48px; margin-bottom: 24px; }
+.parties h2 { font-size: 13px; text-transform: uppercase; color: #555; margin: 0 0 4px; }
+table { width: 100%; border-collapse: collapse; }
+th, td { text-align: left; padding: 6px 4px; border-bottom: 1px solid #ddd; vertical-align: top; }
+th.num, td.num { text-align: right; }
+.options { color: #666; font-size: 11px; }
+.totals { margin-top: 12px; margin-left: auto; width: 280px; }
+.totals td { border: none; }
+.totals tr.total td { font-weight: bold; border-top: 1px solid #222; }
+@media print { body { margin: 0; } }
+</style>
+</head>
+<body>
+<h1>{{.Label .Kind}}</h1>
+<div class="meta">{{.Label "order"}} {{.OrderNumber}} &middot; {{.Label "date"}}: {{.CreatedAt}}</div>
+<div class="parties">
+<div>
+<h2>{{.Label "seller"}}</h2>
+<div>{{.MarketName}}</div>
+{{if .MarketLocation}}<div>{{.MarketLocation}}</div>{{end}}
+{{if .MarketPhone}}<div>{{.Label "phone"}}: {{.MarketPhone}}</div>{{end}}
+</div>
+<div>
+<h2>{{if .ShowPrices}}{{.Label "customer"}}{{else}}{{.Label "ship_to"}}{{end}}</h2>
+<div>{{.CustomerName}}</div>
+{{if .Address}}<div>{{.Address}}</div>{{end}}
+<div>{{.Label "phone"}}: {{.CustomerPhone}}</div>
+{{if .Notes}}<div>{{.Label "notes"}}: {{.Notes}}</div>{{end}}
+</div>
+</div>
+<table>
+<tr><th>#</th><th>{{.Label "item"}}</th><th>{{.Label "sku"}}</th><th class="num">{{.Label "qty"}}</th>
+{{- if .ShowPrices}}<th class="num">{{.Label "price"}}</th><th class="num">{{.Label "sum"}}</th>{{else}}<th>{{.Label "packed"}}</th>{{end}}</tr>
+{{- range $i, $item := .Items}}
+<tr><td>{{inc $i}}</td><td>{{$item.Name}}{{if $item.Options}}<div class="options">{{$item.Options}}</div>{{end}}</td><td>{{$item.SKU}}</td><td class="num">{{$item.Count}}</td>
+{{- if $.ShowPrices}}<td class="num">{{$.Money $item.UnitPrice}}</td><td class="num">{{$.Money $item.Sum}}</td>{{else}}<td>&#9744;</td>{{end}}</tr>
+{{- end}}
+</table>
+{{- if .ShowPrices}}
+<table class="totals">
+<tr><td>{{.Label "subtotal"}}</td><td class="num">{{.Money .Subtotal}}</td></tr>
+<tr><td>{{.Label "delivery"}}</td><td class="num">{{.Money .Delivery}}</td></tr>
+<tr class="total"><td>{{.Label "total"}}</td><td class="num">{{.Money .Total}}</td></tr>
+</table>
+{{- end}}
+{{if eq .Kind "receipt"}}<p>{{.Label "thanks"}}</p>{{end}}
+</body>
+</html>
+`))
+
+// renderOrderDocumentPDF lays out the same document as the HTML template on A4 pages
+func renderOrderDocumentPDF(font *pdfFont, doc orderDocument) ([]byte, error) {
+	const (
+		left, right = 40.0, pdfPageWidth - 40
+		bottom      = pdfPageHeight - 50
+		size        = 10.0
+		lineHeight  = 14.0
+	)
+	w := newPDFWriter(font)
+
+	y := 60.0
+	w.text(left, y, 20, doc.Label(doc.Kind))
+	y += 20
+	w.text(left, y, size, doc.Label("order")+" "+doc.OrderNumber+" · "+doc.Label("date")+": "+doc.CreatedAt)
+	y += 30
+
+	// Seller and customer side by side
+	half := (right - left) / 2
+	seller := []string{doc.MarketName}
+	if doc.MarketLocation != "" {
+		seller = append(seller, w.wrap(doc.MarketLocation, size, half-20)...)
+	}
+	if doc.MarketPhone != "" {
+		seller = append(seller, doc.Label("phone")+": "+doc.MarketPhone)
+	}
+	customer := []string{doc.CustomerName}
+	if doc.Address != "" {
+		customer = append(customer, w.wrap(doc.Address, size, half-20)...)
+	}
+	customer = append(customer, doc.Label("phone")+": "+doc.CustomerPhone)
+	if doc.Notes != "" {
+		customer = append(customer, w.wrap(doc.Label("notes")+": "+doc.Notes, size, half-20)...)
+	}
+	customerTitle := doc.Label("customer")
+	if !doc.ShowPrices() {
+		customerTitle = doc.Label("ship_to")
+	}
+	w.text(left, y, 9, strings.ToUpper(doc.Label("seller")))
+	w.text(left+half, y, 9, strings.ToUpper(customerTitle))
+	y += lineHeight
+	for i := 0; i < len(seller) || i < len(customer); i++ {
+		if i < len(seller) {
+			w.text(left, y, size, seller[i])
+		}
+		if i < len(customer) {
+			w.text(left+half, y, size, customer[i])
+		}
+		y += lineHeight
+	}
+	y += 16
+
+	// Items; numeric columns are right-aligned at these x positions
+	colSKU, colQty, colPrice, colSum := 300.0, 410.0, 480.0, right
+	nameWidth := colSKU - left - 30
+	header := func() {
+		w.text(left, y, size, "#")
+		w.text(left+20, y, size, doc.Label("item"))
+		w.text(colSKU, y, size, doc.Label("sku"))
+		w.textRight(colQty, y, size, doc.Label("qty"))
+		if doc.ShowPrices() {
+			w.textRight(colPrice, y, size, doc.Label("price"))
+			w.textRight(colSum, y, size, doc.Label("sum"))
+		} else {
+			w.text(colPrice, y, size, doc.Label("packed"))
+		}
+		w.rule(left, right, y+5)
+		y += lineHeight + 4
+	}
+	header()
+	for i, item := range doc.Items {
+		lines := w.wrap(item.Name, size, nameWidth)
+		var options []string
+		if item.Options != "" {
+			options = w.wrap(item.Options, 8, nameWidth)
+		}
+		height := float64(len(lines))*lineHeight + float64(len(options))*11
+		if y+height > bottom {
+			w.addPage()
+			y = 60
+			header()
+		}
+		w.text(left, y, size, strconv.Itoa(i+1))
+		w.text(colSKU, y, size, item.SKU)
+		w.textRight(colQty, y, size, strconv.Itoa(item.Count))
+		if doc.ShowPrices() {
+			w.textRight(colPrice, y, size, doc.Money(item.UnitPrice))
+			w.textRight(colSum, y, size, doc.Money(item.Sum))
+		} else {
+			w.text(colPrice, y, size, "[   ]")
+		}
+		for _, line := range lines {
+			w.text(left+20, y, size, line)
+			y += lineHeight
+		}
+		for _, line := range options {
+			w.text(left+20, y-3, 8, line)
+			y += 11
+		}
+		w.rule(left, right, y-lineHeight+5)
+		y += 4
+	}
+
+	if doc.ShowPrices() {
+		if y+4*lineHeight > bottom {
+			w.addPage()
+			y = 60
+		}
+		y += 8
+		for _, row := range []struct {
+			label  string
+			amount float64
+		}{{"subtotal", doc.Subtotal}, {"delivery", doc.Delivery}, {"total", doc.Total}} {
+			w.text(colPrice-80, y, size, doc.Label(row.label))
+			w.textRight(colSum, y, size, doc.Money(row.amount))
+			y += lineHeight
+		}
+	}
+	if doc.Kind == models.OrderDocumentReceipt {
+		w.text(left, y+20, size, doc.Label("thanks"))
+	}
+	return w.bytes()
+}
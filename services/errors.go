@@ -0,0 +1,177 @@
+package services
+
+import "fmt"
+
+// Error is a service error with a stable code clients can branch on. Error() returns the English
+// message, which handlers used to compare against before codes existed.
+type Error struct {
+	Code    string
+	Message string
+	// Field names the request field at fault, if any
+	Field string
+	// Details carry values such as the ID of the offending item
+	Details map[string]interface{}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is matches errors with the same code, so that copies carrying details match their sentinel
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// WithDetails returns a copy of e with its message formatted from args and the given details
+func (e *Error) WithDetails(details map[string]interface{}, args ...interface{}) *Error {
+	c := *e
+	if len(args) > 0 {
+		c.Message = fmt.Sprintf(e.Message, args...)
+	}
+	c.Details = details
+	return &c
+}
+
+func newError(code, message, field string) *Error {
+	return &Error{Code: code, Message: message, Field: field}
+}
+
+// Accounts and verification
+var (
+	ErrUserNotFound            = newError("USER_NOT_FOUND", "user not found", "")
+	ErrSuperadminNotFound      = newError("SUPERADMIN_NOT_FOUND", "superadmin not found", "")
+	ErrStaffNotFound           = newError("STAFF_NOT_FOUND", "staff not found", "")
+	ErrInvalidCredentials      = newError("INVALID_CREDENTIALS", "invalid credentials", "")
+	ErrAccountDisabled         = newError("ACCOUNT_DISABLED", "account disabled", "")
+	ErrInvalidStaffRole        = newError("INVALID_STAFF_ROLE", "invalid staff role", "role")
+	ErrUsernameOrPhoneTaken    = newError("USERNAME_OR_PHONE_TAKEN", "username or phone already exists", "")
+	ErrUsernameTaken           = newError("USERNAME_TAKEN", "username already exists", "username")
+	ErrPhoneTaken              = newError("PHONE_TAKEN", "phone already exists", "phone")
+	ErrPhoneRegistered         = newError("PHONE_TAKEN", "phone number already registered", "phone")
+	ErrPhoneUnchanged          = newError("PHONE_UNCHANGED", "phone number unchanged", "phone")
+	ErrNoPhoneChange           = newError("NO_PHONE_CHANGE_REQUESTED", "no phone change requested", "phone")
+	ErrNoVerificationCode      = newError("VERIFICATION_CODE_NOT_FOUND", "no verification code found", "")
+	ErrVerificationCodeExpired = newError("VERIFICATION_CODE_EXPIRED", "verification code expired", "code")
+	ErrInvalidVerificationCode = newError("INVALID_VERIFICATION_CODE", "invalid verification code", "code")
+	ErrInvalidOTP              = newError("INVALID_VERIFICATION_CODE", "invalid or expired OTP", "code")
+	ErrTooManyAttempts         = newError("TOO_MANY_ATTEMPTS", "too many attempts", "")
+	ErrNameAndPhoneRequired    = newError("NAME_AND_PHONE_REQUIRED", "name and phone are required", "")
+	ErrNoFieldsToUpdate        = newError("NO_FIELDS_TO_UPDATE", "no fields provided to update", "")
+	ErrNameTaken               = newError("NAME_TAKEN", "name already exists", "name")
+)
+
+// Markets and catalog
+var (
+	ErrMarketNotFound          = newError("MARKET_NOT_FOUND", "market not found", "")
+	ErrProductNotFound         = newError("PRODUCT_NOT_FOUND", "product not found", "")
+	ErrProductNotOwned         = newError("PRODUCT_NOT_FOUND", "product not found or unauthorized", "")
+	ErrThumbnailNotFound       = newError("THUMBNAIL_NOT_FOUND", "thumbnail not found", "")
+	ErrThumbnailNotOwned       = newError("THUMBNAIL_NOT_FOUND", "thumbnail not found or unauthorized", "")
+	ErrThumbnailNotInMarket    = newError("THUMBNAIL_NOT_FOUND", "thumbnail not found or not associated with this market", "")
+	ErrSizeNotFound            = newError("SIZE_NOT_FOUND", "size not found", "")
+	ErrSizeNotOwned            = newError("SIZE_NOT_FOUND", "size not found or unauthorized", "")
+	ErrSizeNotInMarket         = newError("SIZE_NOT_FOUND", "size not found or not associated with this market", "")
+	ErrSizeRequired            = newError("SIZE_REQUIRED", "size cannot be empty", "size")
+	ErrVariantNotOwned         = newError("VARIANT_NOT_FOUND", "variant not found or unauthorized", "")
+	ErrImageNotOwned           = newError("IMAGE_NOT_FOUND", "image not found or unauthorized", "")
+	ErrSKURequired             = newError("SKU_REQUIRED", "sku cannot be empty", "sku")
+	ErrSKUTaken                = newError("SKU_TAKEN", "sku already exists", "sku")
+	ErrNegativePrice           = newError("INVALID_PRICE", "price cannot be negative", "price")
+	ErrNegativeStock           = newError("INVALID_STOCK", "stock cannot be negative", "stock")
+	ErrAttributeRequired       = newError("ATTRIBUTE_REQUIRED", "attribute name and value are required", "attributes")
+	ErrDuplicateAttribute      = newError("DUPLICATE_ATTRIBUTE", "duplicate attribute %s", "attributes")
+	ErrInvalidCount            = newError("INVALID_COUNT", "count must be positive", "count")
+	ErrNegativeCount           = newError("INVALID_COUNT", "count cannot be negative", "count")
+	ErrUnsupportedImage        = newError("UNSUPPORTED_IMAGE_TYPE", "only JPEG, PNG or WebP images are allowed", "")
+	ErrUnsupportedFileFormat   = newError("UNSUPPORTED_FILE_FORMAT", "unsupported file format", "file")
+	ErrInvalidImagesArchive    = newError("INVALID_IMAGES_ARCHIVE", "invalid images archive", "images")
+	ErrBannerNotFound          = newError("BANNER_NOT_FOUND", "banner not found", "")
+	ErrCategoryNotFound        = newError("CATEGORY_NOT_FOUND", "category not found", "")
+	ErrParentCategoryNotFound  = newError("PARENT_CATEGORY_NOT_FOUND", "parent category not found", "parent_id")
+	ErrCategoryNotAssigned     = newError("CATEGORY_NOT_ASSIGNED", "category not assigned to this market", "category_id")
+	ErrCategoryNameRequired    = newError("CATEGORY_NAME_REQUIRED", "category name is required", "name")
+	ErrCategoryNameTaken       = newError("CATEGORY_NAME_TAKEN", "category name already exists", "name")
+	ErrCategoryHasChildren     = newError("CATEGORY_HAS_SUBCATEGORIES", "category has subcategories", "")
+	ErrCategoryCycle           = newError("CATEGORY_CYCLE", "category cannot be moved under itself or its subcategories", "parent_id")
+	ErrInvalidSlug             = newError("INVALID_SLUG", "invalid slug", "slug")
+	ErrSlugTaken               = newError("SLUG_TAKEN", "slug already taken", "slug")
+	ErrUnknownEntityType       = newError("UNKNOWN_ENTITY_TYPE", "unknown entity type", "")
+	ErrEntityNotFound          = newError("ENTITY_NOT_FOUND", "entity not found", "")
+	ErrUnknownTranslationField = newError("UNKNOWN_TRANSLATION_FIELD", "unknown translation field", "translations")
+	ErrInvalidLocale           = newError("INVALID_LOCALE", "invalid locale", "translations")
+	ErrBaseTextRequired        = newError("BASE_TEXT_REQUIRED", "text in the base locale is required", "translations")
+	ErrNoTranslations          = newError("NO_TRANSLATIONS", "no translations provided", "translations")
+)
+
+// Carts, orders and returns
+var (
+	ErrCartItemNotFound      = newError("CART_ITEM_NOT_FOUND", "cart entry not found", "")
+	ErrCartNotFound          = newError("CART_NOT_FOUND", "cart not found or not owned by user", "")
+	ErrCartEmpty             = newError("CART_EMPTY", "no items found in cart", "")
+	ErrInsufficientStock     = newError("CART_ITEM_OUT_OF_STOCK", "insufficient stock for variant %d", "count")
+	ErrCartInvalidCount      = newError("INVALID_COUNT", "count must be positive for product_id %d", "count")
+	ErrCartInvalidProduct    = newError("PRODUCT_NOT_FOUND", "invalid product_id %d", "product_id")
+	ErrCartInvalidVariant    = newError("VARIANT_NOT_FOUND", "invalid market, product_id %d, or variant", "variant_id")
+	ErrOrderNotFound         = newError("ORDER_NOT_FOUND", "order not found", "")
+	ErrOrderNotInMarket      = newError("ORDER_NOT_FOUND", "order not found or not associated with this market", "")
+	ErrOrderNotForMarket     = newError("ORDER_NOT_FOUND", "order not found or not for this market", "")
+	ErrOrderNotOwned         = newError("ORDER_NOT_FOUND", "order not found or not associated with this user", "")
+	ErrOrderExists           = newError("ORDER_ALREADY_EXISTS", "order already exists for this cart", "")
+	ErrOrderItemNotFound     = newError("ORDER_ITEM_NOT_FOUND", "order item not found", "")
+	ErrOrderItemClosed       = newError("ORDER_ITEM_CLOSED", "order item is already %s", "")
+	ErrOrderHasNoOpenItems   = newError("ORDER_HAS_NO_OPEN_ITEMS", "order has no open items", "")
+	ErrOrderItemsMixed       = newError("ORDER_ITEMS_MIXED", "order items must belong to one order", "item_ids")
+	ErrOrderItemsRequired    = newError("ORDER_ITEMS_REQUIRED", "at least one order item is required", "item_ids")
+	ErrDuplicateOrderItem    = newError("DUPLICATE_ORDER_ITEM", "duplicate order item", "items")
+	ErrInvalidOrderItem      = newError("INVALID_ORDER_ITEM", "invalid order item", "items")
+	ErrItemNotPending        = newError("ITEM_NOT_PENDING", "only pending items can be shipped", "item_ids")
+	ErrShipmentNotFound      = newError("SHIPMENT_NOT_FOUND", "shipment not found", "")
+	ErrShipmentDelivered     = newError("SHIPMENT_ALREADY_DELIVERED", "shipment already delivered", "")
+	ErrInvalidStatus         = newError("INVALID_STATUS", "invalid status", "status")
+	ErrInvalidItemStatus     = newError("INVALID_STATUS", "invalid status; must be delivered, canceled or out_of_stock", "status")
+	ErrInvalidOrderStatus    = newError("INVALID_STATUS", "invalid status; must be 'canceled' or 'delivered'", "status")
+	ErrOrderPrefixTaken      = newError("ORDER_PREFIX_TAKEN", "order prefix already taken", "order_prefix")
+	ErrLocationNotOwned      = newError("LOCATION_NOT_FOUND", "location not found or not owned by user", "")
+	ErrLocationNotFound      = newError("LOCATION_NOT_FOUND", "location not found or unauthorized", "")
+	ErrLocationFields        = newError("LOCATION_FIELDS_REQUIRED", "location name and address are required", "")
+	ErrLocationNameTaken     = newError("LOCATION_NAME_TAKEN", "location name already exists", "location_name")
+	ErrLocationInUse         = newError("LOCATION_IN_USE", "location is referenced by orders and cannot be deleted", "")
+	ErrReturnNotFound        = newError("RETURN_NOT_FOUND", "return request not found", "")
+	ErrReturnWindowClosed    = newError("RETURN_WINDOW_CLOSED", "return window has closed", "")
+	ErrReturnCountExceeded   = newError("RETURN_COUNT_EXCEEDED", "return count exceeds the delivered quantity", "count")
+	ErrItemNotDelivered      = newError("ITEM_NOT_DELIVERED", "only delivered items can be returned", "items")
+	ErrReturnTransition      = newError("INVALID_RETURN_TRANSITION", "cannot change return from %s to %s", "status")
+	ErrInvalidDocumentKind   = newError("INVALID_DOCUMENT_KIND", "invalid document kind", "")
+	ErrInvalidDocumentLang   = newError("INVALID_LANGUAGE", "invalid language; must be en or ru", "lang")
+	ErrInvalidDocumentFormat = newError("INVALID_FORMAT", "invalid format; must be html or pdf", "format")
+	ErrDocumentsUnavailable  = newError("DOCUMENTS_NOT_CONFIGURED", "pdf documents are not configured", "format")
+)
+
+// Payouts, messaging and jobs
+var (
+	ErrStatementNotFound      = newError("STATEMENT_NOT_FOUND", "statement not found", "")
+	ErrStatementPaid          = newError("STATEMENT_ALREADY_PAID", "statement already paid", "")
+	ErrCommissionRateNotFound = newError("COMMISSION_RATE_NOT_FOUND", "commission rate not found", "")
+	ErrDefaultCommissionRate  = newError("DEFAULT_COMMISSION_RATE", "cannot delete the default commission rate", "")
+	ErrInvalidRate            = newError("INVALID_RATE", "rate must be between 0 and 100", "rate")
+	ErrInvalidRateScope       = newError("INVALID_MARKET_OR_CATEGORY", "invalid market or category", "")
+	ErrInvalidPayoutPeriod    = newError("INVALID_PERIOD", "period_start must not be after period_end", "period_start")
+	ErrInvalidPeriod          = newError("INVALID_PERIOD", "from must not be after to", "from")
+	ErrRollupRangeTooLong     = newError("ROLLUP_RANGE_TOO_LONG", "rollup range must not exceed %d days", "to")
+	ErrConversationNotFound   = newError("CONVERSATION_NOT_FOUND", "conversation not found", "")
+	ErrMessageNotFound        = newError("MESSAGE_NOT_FOUND", "message not found", "")
+	ErrInvalidConversation    = newError("INVALID_CONVERSATION_PARTY", "invalid conversation party", "")
+	ErrNotificationNotFound   = newError("NOTIFICATION_NOT_FOUND", "notification not found", "")
+	ErrDeviceNotFound         = newError("DEVICE_NOT_FOUND", "device not found", "")
+	ErrInvalidPlatform        = newError("INVALID_PLATFORM", "invalid platform", "platform")
+	ErrJobNotFound            = newError("JOB_NOT_FOUND", "job not found", "")
+	ErrImportJobNotFound      = newError("JOB_NOT_FOUND", "import job not found", "")
+)
+
+// Idempotency keys
+var (
+	ErrInvalidIdempotencyKey = newError("INVALID_IDEMPOTENCY_KEY", "idempotency key must be 1 to 255 printable ASCII characters", "")
+	ErrIdempotencyKeyReused  = newError("IDEMPOTENCY_KEY_REUSED", "idempotency key was already used for a different request", "")
+	ErrIdempotencyKeyInUse   = newError("IDEMPOTENCY_KEY_IN_USE", "a request with this idempotency key is still in progress", "")
+)
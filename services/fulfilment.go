@@ -0,0 +1,352 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"Dowlet_projects/ecommerce/models"
+)
+
+// orderStatusSQL derives the status of an order from its items: pending while any item awaits
+// shipping, shipped while any item is on its way, delivered once the rest were delivered or
+// cancelled, and canceled when no item is left
+const orderStatusSQL = `CASE
+		WHEN MAX(o.status IN ('pending', 'processing')) THEN 'pending'
+		WHEN MAX(o.status = 'shipped') THEN 'shipped'
+		WHEN MAX(o.status = 'delivered') THEN 'delivered'
+		ELSE 'canceled' END`
+
+// orderItem is an order item locked for a status change, with the order it belongs to
+type orderItem struct {
+	id, orderID, userID, marketID, cartOrderID int
+	orderNumber, status                        string
+}
+
+// lockOrderItems locks the order items matching condition, an expression over order_items aliased o
+// and their orders aliased oh
+func lockOrderItems(ctx context.Context, q execer, condition string, args ...interface{}) ([]orderItem, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT o.id, o.order_id, oh.user_id, COALESCE(oh.market_id, 0), oh.cart_order_id, oh.order_number, o.status
+		FROM order_items o
+		JOIN orders oh ON oh.id = o.order_id
+		WHERE `+condition+`
+		FOR UPDATE`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch order items: %v", err)
+	}
+	defer rows.Close()
+
+	var items []orderItem
+	for rows.Next() {
+		var it orderItem
+		if err := rows.Scan(&it.id, &it.orderID, &it.userID, &it.marketID, &it.cartOrderID, &it.orderNumber, &it.status); err != nil {
+			return nil, fmt.Errorf("failed to scan order item: %v", err)
+		}
+		items = append(items, it)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating order items: %v", err)
+	}
+	return items, nil
+}
+
+// isOpenItem reports whether an order item is still being fulfilled
+func isOpenItem(status string) bool {
+	return status == "pending" || status == "processing" || status == models.OrderItemStatusShipped
+}
+
+// closeOrderItems moves open order items to a final status. Cancelled items return their stock;
+// out-of-stock items leave the variant without stock, as the market has none left. Delivered items
+// are posted to the ledger and complete their shipments once no item of those is still on its way.
+func closeOrderItems(ctx context.Context, q execer, itemIDs []int, status, note string) error {
+	if len(itemIDs) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(itemIDs))
+	for i, id := range itemIDs {
+		args[i] = id
+	}
+
+	var stockSQL string
+	switch status {
+	case models.OrderItemStatusCanceled:
+		stockSQL = "v.stock + o.count"
+	case models.OrderItemStatusOutOfStock:
+		stockSQL = "0"
+	}
+	if stockSQL != "" {
+		if _, err := q.ExecContext(ctx, `
+			UPDATE product_variants v
+			JOIN order_items o ON o.variant_id = v.id
+			SET v.stock = `+stockSQL+`
+			WHERE o.id IN (`+placeholders(len(itemIDs))+`)`, args...); err != nil {
+			return fmt.Errorf("failed to update variant stock: %v", err)
+		}
+	}
+
+	if _, err := q.ExecContext(ctx, `
+		UPDATE order_items
+		SET status = ?, status_note = ?, delivered_at = IF(? = 'delivered', CURRENT_TIMESTAMP, delivered_at)
+		WHERE id IN (`+placeholders(len(itemIDs))+`)`,
+		append([]interface{}{status, nullIfEmpty(note), status}, args...)...); err != nil {
+		return fmt.Errorf("failed to update order items: %v", err)
+	}
+
+	if status != models.OrderItemStatusDelivered {
+		return nil
+	}
+	if err := postOrderLedger(ctx, q, itemIDs); err != nil {
+		return err
+	}
+	if _, err := q.ExecContext(ctx, `
+		UPDATE order_shipments sh
+		SET sh.status = 'delivered', sh.delivered_at = CURRENT_TIMESTAMP
+		WHERE sh.status = 'shipped'
+		AND sh.id IN (SELECT o.shipment_id FROM order_items o WHERE o.id IN (`+placeholders(len(itemIDs))+`))
+		AND NOT EXISTS (SELECT 1 FROM order_items o WHERE o.shipment_id = sh.id AND o.status = 'shipped')`, args...); err != nil {
+		return fmt.Errorf("failed to complete shipments: %v", err)
+	}
+	return nil
+}
+
+// UpdateOrderItemStatus closes a single item of one of the market's orders while the rest of the
+// order is fulfilled: delivered, canceled or out_of_stock
+func (s *DBService) UpdateOrderItemStatus(ctx context.Context, marketID, itemID int, req models.UpdateOrderItemStatusRequest) error {
+	ctx, span := tracer.Start(ctx, "DBService.UpdateOrderItemStatus")
+	defer span.End()
+	switch req.Status {
+	case models.OrderItemStatusDelivered, models.OrderItemStatusCanceled, models.OrderItemStatusOutOfStock:
+	default:
+		return ErrInvalidItemStatus
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	items, err := lockOrderItems(ctx, tx, "o.id = ? AND oh.market_id = ?", itemID, marketID)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return ErrOrderItemNotFound
+	}
+	if !isOpenItem(items[0].status) {
+		return ErrOrderItemClosed.WithDetails(map[string]interface{}{"status": items[0].status}, items[0].status)
+	}
+
+	if err := closeOrderItems(ctx, tx, []int{itemID}, req.Status, req.Note); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	s.orderItemsChanged(ctx, items[0], []int{itemID}, req.Status)
+	return nil
+}
+
+// CreateShipment ships pending items of one of the market's orders together and returns the shipment ID
+func (s *DBService) CreateShipment(ctx context.Context, marketID int, req models.CreateShipmentRequest) (int, error) {
+	ctx, span := tracer.Start(ctx, "DBService.CreateShipment")
+	defer span.End()
+	if len(req.ItemIDs) == 0 {
+		return 0, ErrOrderItemsRequired
+	}
+	seen := make(map[int]bool, len(req.ItemIDs))
+	args := make([]interface{}, 0, len(req.ItemIDs)+1)
+	for _, id := range req.ItemIDs {
+		if seen[id] {
+			return 0, ErrDuplicateOrderItem
+		}
+		seen[id] = true
+		args = append(args, id)
+	}
+	args = append(args, marketID)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	items, err := lockOrderItems(ctx, tx, "o.id IN ("+placeholders(len(req.ItemIDs))+") AND oh.market_id = ?", args...)
+	if err != nil {
+		return 0, err
+	}
+	if len(items) != len(req.ItemIDs) {
+		return 0, ErrOrderItemNotFound
+	}
+	for _, it := range items {
+		if it.orderID != items[0].orderID {
+			return 0, ErrOrderItemsMixed
+		}
+		if it.status != "pending" && it.status != "processing" {
+			return 0, ErrItemNotPending
+		}
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO order_shipments (order_id, market_id, carrier, tracking_number)
+		VALUES (?, ?, ?, ?)`,
+		items[0].orderID, marketID, nullIfEmpty(req.Carrier), nullIfEmpty(req.TrackingNumber))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create shipment: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve shipment ID: %v", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE order_items SET status = 'shipped', shipment_id = ?
+		WHERE id IN (`+placeholders(len(req.ItemIDs))+`)`,
+		append([]interface{}{id}, args[:len(req.ItemIDs)]...)...); err != nil {
+		return 0, fmt.Errorf("failed to ship order items: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	s.orderItemsChanged(ctx, items[0], req.ItemIDs, models.OrderItemStatusShipped)
+	return int(id), nil
+}
+
+// DeliverShipment marks the items of a market's shipment that are still on their way as delivered
+func (s *DBService) DeliverShipment(ctx context.Context, marketID, shipmentID int) error {
+	ctx, span := tracer.Start(ctx, "DBService.DeliverShipment")
+	defer span.End()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRowContext(ctx, `
+		SELECT status FROM order_shipments WHERE id = ? AND market_id = ? FOR UPDATE`,
+		shipmentID, marketID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return ErrShipmentNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch shipment: %v", err)
+	}
+	if status == "delivered" {
+		return ErrShipmentDelivered
+	}
+
+	items, err := lockOrderItems(ctx, tx, "o.shipment_id = ? AND o.status = 'shipped'", shipmentID)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		// Every item of the shipment was cancelled on the way
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE order_shipments SET status = 'delivered', delivered_at = CURRENT_TIMESTAMP WHERE id = ?`,
+			shipmentID); err != nil {
+			return fmt.Errorf("failed to update shipment: %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit transaction: %v", err)
+		}
+		return nil
+	}
+	itemIDs := make([]int, len(items))
+	for i, it := range items {
+		itemIDs[i] = it.id
+	}
+
+	if err := closeOrderItems(ctx, tx, itemIDs, models.OrderItemStatusDelivered, ""); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	s.orderItemsChanged(ctx, items[0], itemIDs, models.OrderItemStatusDelivered)
+	return nil
+}
+
+// getOrderShipments lists the shipments of an order with the items they carry
+func (s *DBService) getOrderShipments(ctx context.Context, orderID int) ([]models.OrderShipment, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT sh.id, sh.order_id, COALESCE(sh.carrier, ''), COALESCE(sh.tracking_number, ''),
+			sh.status, sh.created_at, sh.delivered_at
+		FROM order_shipments sh
+		WHERE sh.order_id = ?
+		ORDER BY sh.id`, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query shipments: %v", err)
+	}
+	defer rows.Close()
+
+	shipments := []models.OrderShipment{}
+	index := make(map[int]int)
+	for rows.Next() {
+		var sh models.OrderShipment
+		var deliveredAt sql.NullString
+		if err := rows.Scan(&sh.ID, &sh.OrderID, &sh.Carrier, &sh.TrackingNumber, &sh.Status,
+			&sh.CreatedAt, &deliveredAt); err != nil {
+			return nil, fmt.Errorf("failed to scan shipment: %v", err)
+		}
+		if deliveredAt.Valid {
+			sh.DeliveredAt = &deliveredAt.String
+		}
+		sh.ItemIDs = []int{}
+		index[sh.ID] = len(shipments)
+		shipments = append(shipments, sh)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating shipments: %v", err)
+	}
+	if len(shipments) == 0 {
+		return shipments, nil
+	}
+
+	itemRows, err := s.db.QueryContext(ctx, `
+		SELECT o.shipment_id, o.id FROM order_items o
+		WHERE o.order_id = ? AND o.shipment_id IS NOT NULL
+		ORDER BY o.id`, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query shipment items: %v", err)
+	}
+	defer itemRows.Close()
+	for itemRows.Next() {
+		var shipmentID, itemID int
+		if err := itemRows.Scan(&shipmentID, &itemID); err != nil {
+			return nil, fmt.Errorf("failed to scan shipment item: %v", err)
+		}
+		if i, ok := index[shipmentID]; ok {
+			shipments[i].ItemIDs = append(shipments[i].ItemIDs, itemID)
+		}
+	}
+	if err := itemRows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating shipment items: %v", err)
+	}
+	return shipments, nil
+}
+
+// orderItemsChanged runs the follow-ups of a committed status change of items of one order
+func (s *DBService) orderItemsChanged(ctx context.Context, item orderItem, itemIDs []int, status string) {
+	if status == models.OrderItemStatusCanceled || status == models.OrderItemStatusOutOfStock {
+		s.invalidateMarketProductCaches(ctx, item.marketID)
+	}
+	s.notifyOrderItemsChanged(ctx, item.userID, item.orderID, item.orderNumber, item.marketID, status, len(itemIDs))
+	s.publishOrderEvent(ctx, models.OrderEvent{
+		Type:        models.OrderEventItemsChanged,
+		MarketID:    item.marketID,
+		OrderID:     item.orderID,
+		CartOrderID: item.cartOrderID,
+		UserID:      item.userID,
+		Status:      status,
+		ItemIDs:     itemIDs,
+	})
+	s.invalidateMarketAnalytics(ctx, item.marketID)
+}
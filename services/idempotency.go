@@ -0,0 +1,96 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// idempotencyKeyFormat is the Redis key of a stored response, by account and client-chosen key
+const idempotencyKeyFormat = "idempotency:%s:%s"
+
+// idempotencyLockTTL bounds how long a key stays in progress if the server stops before the
+// response is stored; requests cannot run longer than the server's write timeout anyway
+const idempotencyLockTTL = time.Minute
+
+// IdempotentResponse is the response to a request with an idempotency key, replayed when the
+// request is retried. Fingerprint identifies the request the key was first used for.
+type IdempotentResponse struct {
+	Fingerprint string            `json:"fingerprint"`
+	Completed   bool              `json:"completed"`
+	Status      int               `json:"status,omitempty"`
+	Header      map[string]string `json:"header,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+}
+
+// StartIdempotentRequest claims an idempotency key of an account for the request with the given
+// fingerprint. It returns nil when the request should run, or the stored response of an earlier
+// run to replay. A key claimed by a different request gives ErrIdempotencyKeyReused, and a key
+// whose request is still running gives ErrIdempotencyKeyInUse.
+func (s *DBService) StartIdempotentRequest(ctx context.Context, scope, key, fingerprint string) (*IdempotentResponse, error) {
+	ctx, span := tracer.Start(ctx, "DBService.StartIdempotentRequest")
+	defer span.End()
+	redisKey := fmt.Sprintf(idempotencyKeyFormat, scope, key)
+	pending, err := json.Marshal(IdempotentResponse{Fingerprint: fingerprint})
+	if err != nil {
+		return nil, err
+	}
+
+	// The stored response may expire between both calls, so claim the key again once
+	for attempt := 0; attempt < 2; attempt++ {
+		claimed, err := s.redis.SetNX(ctx, redisKey, pending, idempotencyLockTTL).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to claim idempotency key: %v", err)
+		}
+		if claimed {
+			return nil, nil
+		}
+
+		data, err := s.redis.Get(ctx, redisKey).Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read idempotency key: %v", err)
+		}
+		var stored IdempotentResponse
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, fmt.Errorf("failed to decode idempotent response: %v", err)
+		}
+		switch {
+		case stored.Fingerprint != fingerprint:
+			return nil, ErrIdempotencyKeyReused
+		case !stored.Completed:
+			return nil, ErrIdempotencyKeyInUse
+		}
+		return &stored, nil
+	}
+	return nil, ErrIdempotencyKeyInUse
+}
+
+// CompleteIdempotentRequest stores the response of a request started with StartIdempotentRequest
+// for replay during ttl
+func (s *DBService) CompleteIdempotentRequest(ctx context.Context, scope, key string, response IdempotentResponse, ttl time.Duration) error {
+	ctx, span := tracer.Start(ctx, "DBService.CompleteIdempotentRequest")
+	defer span.End()
+	response.Completed = true
+	data, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	if err := s.redis.Set(ctx, fmt.Sprintf(idempotencyKeyFormat, scope, key), data, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to store idempotent response: %v", err)
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey frees a key claimed by StartIdempotentRequest without storing a response,
+// so that a retry runs the request again
+func (s *DBService) ReleaseIdempotencyKey(ctx context.Context, scope, key string) error {
+	ctx, span := tracer.Start(ctx, "DBService.ReleaseIdempotencyKey")
+	defer span.End()
+	return s.redis.Del(ctx, fmt.Sprintf(idempotencyKeyFormat, scope, key)).Err()
+}
@@ -0,0 +1,53 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"Dowlet_projects/ecommerce/models"
+)
+
+// Background job types
+const (
+	JobTypeProductImport    = "product_import"
+	JobTypeRemoveUploads    = "remove_uploads"
+	JobTypeReportRollup     = "report_rollup"
+	JobTypePayoutStatements = "payout_statements"
+)
+
+// registerJobHandlers registers the handlers of every background job type
+func (s *DBService) registerJobHandlers() {
+	s.RegisterJobHandler(JobTypeProductImport, 3, productImportTimeout, s.handleProductImportJob)
+	s.RegisterJobHandler(JobTypeRemoveUploads, 5, 0, handleRemoveUploadsJob)
+	s.RegisterJobHandler(JobTypeSendPush, 5, time.Minute, s.handleSendPushJob)
+	s.RegisterJobHandler(JobTypeReportRollup, 3, 30*time.Minute, s.handleReportRollupJob)
+	s.RegisterJobHandler(JobTypePayoutStatements, 3, 10*time.Minute, s.handlePayoutStatementsJob)
+}
+
+// removeUploadsPayload is the job payload of an uploaded file cleanup
+type removeUploadsPayload struct {
+	URLs []string `json:"urls"`
+}
+
+func handleRemoveUploadsJob(ctx context.Context, job models.Job) error {
+	var payload removeUploadsPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid remove uploads payload: %v", err)
+	}
+	removeUploadedFiles(payload.URLs)
+	return nil
+}
+
+// scheduleUploadRemoval deletes uploaded files in the background, or right away if the job cannot be queued
+func (s *DBService) scheduleUploadRemoval(ctx context.Context, imageURLs []string) {
+	if len(imageURLs) == 0 {
+		return
+	}
+	if _, err := s.EnqueueJob(ctx, JobTypeRemoveUploads, removeUploadsPayload{URLs: imageURLs}, 0); err != nil {
+		slog.WarnContext(ctx, "Failed to queue upload removal, deleting inline", "error", err)
+		removeUploadedFiles(imageURLs)
+	}
+}
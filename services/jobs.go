@@ -0,0 +1,456 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"Dowlet_projects/ecommerce/logging"
+	"Dowlet_projects/ecommerce/models"
+
+	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Redis keys of the job queue. Job IDs move between the lists; job state lives in the job hash.
+const (
+	jobsQueueKey      = "jobs:queue"
+	jobsProcessingKey = "jobs:processing"
+	jobsDelayedKey    = "jobs:delayed"
+	jobsDeadKey       = "jobs:dead"
+	jobsNextIDKey     = "jobs:next_id"
+	jobKeyFormat      = "job:%s"
+)
+
+const (
+	// defaultJobMaxAttempts is used for job types registered without their own limit
+	defaultJobMaxAttempts = 5
+	// defaultJobTimeout is used for job types registered without their own timeout
+	defaultJobTimeout = 5 * time.Minute
+	// jobRetention is how long finished jobs stay queryable
+	jobRetention = 7 * 24 * time.Hour
+	// jobBackoffBase and jobBackoffMax bound the exponential retry delay
+	jobBackoffBase = 5 * time.Second
+	jobBackoffMax  = 10 * time.Minute
+	// jobStaleGrace is added to a job's timeout before a running job is considered abandoned
+	jobStaleGrace = time.Minute
+)
+
+// JobHandler processes a job; returning an error schedules a retry until the job runs out of attempts
+type JobHandler func(ctx context.Context, job models.Job) error
+
+// jobType describes how jobs of one type are processed
+type jobType struct {
+	handler     JobHandler
+	maxAttempts int
+	timeout     time.Duration
+}
+
+// RegisterJobHandler registers the handler of a job type. Zero maxAttempts or timeout use the defaults.
+// Handlers must be registered before the workers are started.
+func (s *DBService) RegisterJobHandler(name string, maxAttempts int, timeout time.Duration, handler JobHandler) {
+	if maxAttempts <= 0 {
+		maxAttempts = defaultJobMaxAttempts
+	}
+	if timeout <= 0 {
+		timeout = defaultJobTimeout
+	}
+	s.jobTypes[name] = jobType{handler: handler, maxAttempts: maxAttempts, timeout: timeout}
+}
+
+// EnqueueJob queues a job for the background workers. marketID scopes who may read the job status (0 for none).
+func (s *DBService) EnqueueJob(ctx context.Context, name string, payload interface{}, marketID int) (string, error) {
+	ctx, span := tracer.Start(ctx, "DBService.EnqueueJob")
+	defer span.End()
+	jt, ok := s.jobTypes[name]
+	if !ok {
+		return "", fmt.Errorf("unknown job type %s", name)
+	}
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode job payload: %v", err)
+	}
+
+	id, err := s.redis.Incr(ctx, jobsNextIDKey).Result()
+	if err != nil {
+		return "", fmt.Errorf("failed to allocate job ID: %v", err)
+	}
+	jobID := strconv.FormatInt(id, 10)
+	now := time.Now().Unix()
+
+	pipe := s.redis.TxPipeline()
+	pipe.HSet(ctx, fmt.Sprintf(jobKeyFormat, jobID), map[string]interface{}{
+		"type":         name,
+		"status":       models.JobStatusQueued,
+		"payload":      string(encoded),
+		"market_id":    marketID,
+		"request_id":   logging.RequestID(ctx),
+		"traceparent":  traceParent(ctx),
+		"attempts":     0,
+		"max_attempts": jt.maxAttempts,
+		"last_error":   "",
+		"created_at":   now,
+		"updated_at":   now,
+	})
+	pipe.LPush(ctx, jobsQueueKey, jobID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", fmt.Errorf("failed to enqueue job: %v", err)
+	}
+	return jobID, nil
+}
+
+// GetJob retrieves a job by ID
+func (s *DBService) GetJob(ctx context.Context, jobID string) (models.Job, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetJob")
+	defer span.End()
+	fields, err := s.redis.HGetAll(ctx, fmt.Sprintf(jobKeyFormat, jobID)).Result()
+	if err != nil {
+		return models.Job{}, fmt.Errorf("failed to fetch job: %v", err)
+	}
+	if len(fields) == 0 {
+		return models.Job{}, ErrJobNotFound
+	}
+
+	job := models.Job{
+		ID:        jobID,
+		Type:      fields["type"],
+		Status:    fields["status"],
+		LastError: fields["last_error"],
+	}
+	if fields["payload"] != "" {
+		job.Payload = json.RawMessage(fields["payload"])
+	}
+	job.MarketID, _ = strconv.Atoi(fields["market_id"])
+	job.RequestID = fields["request_id"]
+	job.TraceParent = fields["traceparent"]
+	job.Attempts, _ = strconv.Atoi(fields["attempts"])
+	job.MaxAttempts, _ = strconv.Atoi(fields["max_attempts"])
+	job.CreatedAt = unixField(fields["created_at"])
+	job.UpdatedAt = unixField(fields["updated_at"])
+	if fields["run_at"] != "" {
+		runAt := unixField(fields["run_at"])
+		job.RunAt = &runAt
+	}
+	return job, nil
+}
+
+// GetJobQueueStats reports the length of the queue lists
+func (s *DBService) GetJobQueueStats(ctx context.Context) (models.JobQueueStats, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetJobQueueStats")
+	defer span.End()
+	pipe := s.redis.Pipeline()
+	queued := pipe.LLen(ctx, jobsQueueKey)
+	processing := pipe.LLen(ctx, jobsProcessingKey)
+	delayed := pipe.ZCard(ctx, jobsDelayedKey)
+	dead := pipe.LLen(ctx, jobsDeadKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return models.JobQueueStats{}, fmt.Errorf("failed to fetch queue stats: %v", err)
+	}
+	return models.JobQueueStats{
+		Queued:     queued.Val(),
+		Processing: processing.Val(),
+		Delayed:    delayed.Val(),
+		Dead:       dead.Val(),
+	}, nil
+}
+
+// GetDeadJobs retrieves the most recently dead-lettered jobs
+func (s *DBService) GetDeadJobs(ctx context.Context, page, limit int) ([]models.Job, int64, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetDeadJobs")
+	defer span.End()
+	start := int64((page - 1) * limit)
+	ids, err := s.redis.LRange(ctx, jobsDeadKey, start, start+int64(limit)-1).Result()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to fetch dead jobs: %v", err)
+	}
+	total, err := s.redis.LLen(ctx, jobsDeadKey).Result()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to count dead jobs: %v", err)
+	}
+
+	jobs := []models.Job{}
+	for _, id := range ids {
+		job, err := s.GetJob(ctx, id)
+		if err != nil {
+			if errors.Is(err, ErrJobNotFound) {
+				continue
+			}
+			return nil, 0, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, total, nil
+}
+
+// RetryDeadJob moves a dead-lettered job back to the queue with a fresh set of attempts
+func (s *DBService) RetryDeadJob(ctx context.Context, jobID string) error {
+	ctx, span := tracer.Start(ctx, "DBService.RetryDeadJob")
+	defer span.End()
+	removed, err := s.redis.LRem(ctx, jobsDeadKey, 0, jobID).Result()
+	if err != nil {
+		return fmt.Errorf("failed to remove dead job: %v", err)
+	}
+	if removed == 0 {
+		return ErrJobNotFound
+	}
+
+	key := fmt.Sprintf(jobKeyFormat, jobID)
+	pipe := s.redis.TxPipeline()
+	pipe.HSet(ctx, key, "status", models.JobStatusQueued, "attempts", 0, "updated_at", time.Now().Unix())
+	pipe.HDel(ctx, key, "run_at")
+	pipe.Persist(ctx, key)
+	pipe.LPush(ctx, jobsQueueKey, jobID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to requeue job: %v", err)
+	}
+	return nil
+}
+
+// StartJobWorkers starts the background workers and the scheduler that promotes delayed jobs.
+// They stop taking new jobs once ctx is canceled; the returned function waits for running jobs to finish.
+func (s *DBService) StartJobWorkers(ctx context.Context, workers int) func() {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.jobWorker(ctx)
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.jobScheduler(ctx)
+	}()
+	return wg.Wait
+}
+
+// jobWorker takes jobs off the queue until ctx is canceled
+func (s *DBService) jobWorker(ctx context.Context) {
+	for ctx.Err() == nil {
+		jobID, err := s.redis.BRPopLPush(ctx, jobsQueueKey, jobsProcessingKey, 5*time.Second).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.ErrorContext(ctx, "Job worker failed to poll queue", "error", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		s.processJob(jobID)
+	}
+}
+
+// processJob runs a job taken off the queue and records the outcome.
+// It deliberately does not inherit the worker context so that shutdown lets running jobs finish.
+func (s *DBService) processJob(jobID string) {
+	// Each run is a trace of its own, linked to the trace of the request that queued the job
+	ctx, span := tracer.Start(context.Background(), "job", trace.WithAttributes(attribute.String("job.id", jobID)))
+	defer span.End()
+	key := fmt.Sprintf(jobKeyFormat, jobID)
+
+	job, err := s.GetJob(ctx, jobID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Dropping job", "job_id", jobID, "error", err)
+		s.redis.LRem(ctx, jobsProcessingKey, 0, jobID)
+		return
+	}
+	span.SetName("job " + job.Type)
+	span.AddLink(trace.Link{SpanContext: traceParentContext(job.TraceParent)})
+	// Log records of the job carry the ID of the request that queued it
+	ctx = logging.WithRequestID(ctx, job.RequestID)
+	jt, ok := s.jobTypes[job.Type]
+	if !ok {
+		s.finishJob(ctx, job, fmt.Errorf("no handler registered for job type %s", job.Type), true)
+		return
+	}
+
+	job.Attempts++
+	now := time.Now()
+	if err := s.redis.HSet(ctx, key,
+		"status", models.JobStatusRunning,
+		"attempts", job.Attempts,
+		"updated_at", now.Unix(),
+		"deadline", now.Add(jt.timeout).Unix(),
+	).Err(); err != nil {
+		slog.ErrorContext(ctx, "Failed to mark job as running", "job_id", jobID, "error", err)
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, jt.timeout)
+	err = runJobHandler(runCtx, jt.handler, job)
+	cancel()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	s.finishJob(ctx, job, err, job.Attempts >= job.MaxAttempts)
+}
+
+// runJobHandler calls a handler, turning a panic into an error
+func runJobHandler(ctx context.Context, handler JobHandler, job models.Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.ErrorContext(ctx, "Job panicked", "job_id", job.ID, "job_type", job.Type, "panic", r, "stack", string(debug.Stack()))
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return handler(ctx, job)
+}
+
+// finishJob records the outcome of a job run: completed, retried with backoff, or dead-lettered
+func (s *DBService) finishJob(ctx context.Context, job models.Job, jobErr error, final bool) {
+	key := fmt.Sprintf(jobKeyFormat, job.ID)
+	now := time.Now()
+	pipe := s.redis.TxPipeline()
+	pipe.LRem(ctx, jobsProcessingKey, 0, job.ID)
+	pipe.HDel(ctx, key, "deadline")
+
+	switch {
+	case jobErr == nil:
+		jobRuns.Inc(job.Type, models.JobStatusCompleted)
+		pipe.HSet(ctx, key, "status", models.JobStatusCompleted, "last_error", "", "updated_at", now.Unix())
+		pipe.HDel(ctx, key, "run_at")
+		pipe.Expire(ctx, key, jobRetention)
+	case final:
+		jobRuns.Inc(job.Type, models.JobStatusDead)
+		slog.ErrorContext(ctx, "Job moved to dead-letter list", "job_id", job.ID, "job_type", job.Type, "attempts", job.Attempts, "error", jobErr)
+		pipe.HSet(ctx, key, "status", models.JobStatusDead, "last_error", jobErr.Error(), "updated_at", now.Unix())
+		pipe.HDel(ctx, key, "run_at")
+		pipe.LPush(ctx, jobsDeadKey, job.ID)
+	default:
+		runAt := now.Add(jobBackoff(job.Attempts))
+		jobRuns.Inc(job.Type, models.JobStatusRetrying)
+		slog.WarnContext(ctx, "Job attempt failed, retrying", "job_id", job.ID, "job_type", job.Type, "attempts", job.Attempts, "run_at", runAt, "error", jobErr)
+		pipe.HSet(ctx, key, "status", models.JobStatusRetrying, "last_error", jobErr.Error(), "run_at", runAt.Unix(), "updated_at", now.Unix())
+		pipe.ZAdd(ctx, jobsDelayedKey, &redis.Z{Score: float64(runAt.Unix()), Member: job.ID})
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.ErrorContext(ctx, "Failed to record job outcome", "job_id", job.ID, "error", err)
+	}
+}
+
+// jobBackoff returns the delay before the next attempt: exponential with jitter, capped at jobBackoffMax
+func jobBackoff(attempts int) time.Duration {
+	delay := jobBackoffBase
+	for i := 1; i < attempts && delay < jobBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > jobBackoffMax {
+		delay = jobBackoffMax
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// jobScheduler promotes due delayed jobs and requeues jobs abandoned by crashed workers
+func (s *DBService) jobScheduler(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastStaleCheck := time.Time{}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.promoteDelayedJobs(ctx, now)
+			if now.Sub(lastStaleCheck) >= time.Minute {
+				s.requeueStaleJobs(ctx, now)
+				lastStaleCheck = now
+			}
+		}
+	}
+}
+
+// promoteDelayedJobs moves delayed jobs whose retry time has come back to the queue
+func (s *DBService) promoteDelayedJobs(ctx context.Context, now time.Time) {
+	ids, err := s.redis.ZRangeByScore(ctx, jobsDelayedKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.Unix(), 10),
+		Count: 100,
+	}).Result()
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.ErrorContext(ctx, "Failed to fetch delayed jobs", "error", err)
+		}
+		return
+	}
+	for _, id := range ids {
+		// Only the scheduler that removes the entry requeues it, so several instances can run side by side
+		removed, err := s.redis.ZRem(ctx, jobsDelayedKey, id).Result()
+		if err != nil || removed == 0 {
+			continue
+		}
+		pipe := s.redis.TxPipeline()
+		pipe.HSet(ctx, fmt.Sprintf(jobKeyFormat, id), "status", models.JobStatusQueued, "updated_at", now.Unix())
+		pipe.LPush(ctx, jobsQueueKey, id)
+		if _, err := pipe.Exec(ctx); err != nil {
+			slog.ErrorContext(ctx, "Failed to requeue delayed job", "job_id", id, "error", err)
+		}
+	}
+}
+
+// requeueStaleJobs treats running jobs past their deadline as failed attempts, e.g. after a worker crash
+func (s *DBService) requeueStaleJobs(ctx context.Context, now time.Time) {
+	ids, err := s.redis.LRange(ctx, jobsProcessingKey, 0, -1).Result()
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.ErrorContext(ctx, "Failed to fetch processing jobs", "error", err)
+		}
+		return
+	}
+	for _, id := range ids {
+		key := fmt.Sprintf(jobKeyFormat, id)
+		fields, err := s.redis.HMGet(ctx, key, "type", "deadline").Result()
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to read running job", "job_id", id, "error", err)
+			continue
+		}
+		if fields[0] == nil {
+			slog.ErrorContext(ctx, "Dropping running job", "job_id", id, "error", ErrJobNotFound)
+			s.redis.LRem(ctx, jobsProcessingKey, 0, id)
+			continue
+		}
+		if fields[1] == nil {
+			// Workers set the deadline just after taking a job off the queue. A job without one was
+			// taken by a worker that stopped in between; it gets the default deadline from the first
+			// sweep that sees it, so that it is requeued like any other abandoned job.
+			if err := s.redis.HSetNX(ctx, key, "deadline", now.Add(defaultJobTimeout).Unix()).Err(); err != nil {
+				slog.ErrorContext(ctx, "Failed to set deadline of running job", "job_id", id, "error", err)
+			}
+			continue
+		}
+		deadline, err := strconv.ParseInt(fmt.Sprint(fields[1]), 10, 64)
+		if err != nil {
+			slog.ErrorContext(ctx, "Invalid deadline of running job", "job_id", id, "deadline", fields[1])
+			deadline = 0
+		}
+		if now.Before(time.Unix(deadline, 0).Add(jobStaleGrace)) {
+			continue
+		}
+		job, err := s.GetJob(ctx, id)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to read stale job", "job_id", id, "error", err)
+			continue
+		}
+		s.finishJob(ctx, job, fmt.Errorf("job did not finish before its deadline"), job.Attempts >= job.MaxAttempts)
+	}
+}
+
+func unixField(value string) time.Time {
+	sec, _ := strconv.ParseInt(value, 10, 64)
+	return time.Unix(sec, 0)
+}
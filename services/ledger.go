@@ -0,0 +1,587 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"time"
+
+	"Dowlet_projects/ecommerce/models"
+)
+
+// Ledger accounts; market_sales and market_payable are kept per market
+const (
+	ledgerAccountCash          = "platform_cash"
+	ledgerAccountMarketSales   = "market_sales"
+	ledgerAccountCommission    = "commission_revenue"
+	ledgerAccountMarketPayable = "market_payable"
+)
+
+// payoutScheduleKeyFormat marks the statements of a month as queued, so that only one instance queues them
+const payoutScheduleKeyFormat = "payouts:statements_scheduled:%s"
+
+// commissionRateSQL picks the most specific commission rate of an order item: market and category,
+// then market, then category, then the platform default
+const commissionRateSQL = `COALESCE((
+	SELECT cr.rate FROM commission_rates cr
+	WHERE cr.market_id IN (0, o.market_id) AND cr.category_id IN (0, COALESCE(p.category_id, 0))
+	ORDER BY cr.market_id = 0, cr.category_id = 0
+	LIMIT 1), 0)`
+
+// reversedAmountSQL is how much of ledger entry e has been reversed so far; refunds reverse part of an entry
+const reversedAmountSQL = "COALESCE((SELECT SUM(r.amount) FROM ledger_entries r WHERE r.reversal_of = e.id), 0)"
+
+// signedLedgerAmount counts reversal entries negatively
+const signedLedgerAmount = "CASE WHEN e.reversal_of IS NULL THEN e.amount ELSE -e.amount END"
+
+// payoutStatementsPayload is the job payload of a payout statement run; both dates are inclusive
+type payoutStatementsPayload struct {
+	PeriodStart string `json:"period_start"`
+	PeriodEnd   string `json:"period_end"`
+}
+
+// postOrderLedger posts the sale, commission and payout-due entries of the delivered items among
+// itemIDs. Items that already have a sale entry which was not fully reversed are skipped.
+func postOrderLedger(ctx context.Context, q execer, itemIDs []int) error {
+	if len(itemIDs) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(itemIDs))
+	for i, id := range itemIDs {
+		args[i] = id
+	}
+
+	rows, err := q.QueryContext(ctx, `
+		SELECT o.id, o.market_id, ROUND(`+lineAmount+`, 2), `+commissionRateSQL+`
+		FROM order_items o
+		LEFT JOIN products p ON o.product_id = p.id
+		WHERE o.id IN (`+placeholders(len(itemIDs))+`) AND o.status = 'delivered' AND o.market_id IS NOT NULL
+		AND NOT EXISTS (
+			SELECT 1 FROM ledger_entries e
+			WHERE e.item_id = o.id AND e.entry_type = 'sale' AND e.reversal_of IS NULL
+			AND e.amount > `+reversedAmountSQL+`)`, args...)
+	if err != nil {
+		return fmt.Errorf("failed to fetch delivered order items: %v", err)
+	}
+	type item struct {
+		itemID, marketID int
+		gross, rate      float64
+	}
+	var items []item
+	for rows.Next() {
+		var it item
+		if err := rows.Scan(&it.itemID, &it.marketID, &it.gross, &it.rate); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan order item: %v", err)
+		}
+		items = append(items, it)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating order items: %v", err)
+	}
+	if len(items) == 0 {
+		return nil
+	}
+
+	var values []string
+	var entryArgs []interface{}
+	for _, it := range items {
+		for _, e := range saleLedgerEntries(it.gross, it.rate) {
+			values = append(values, "(?, ?, ?, ?, ?, ?, ?)")
+			entryArgs = append(entryArgs, it.marketID, it.itemID, e.entryType, e.debit, e.credit, e.amount, it.rate)
+		}
+	}
+	if _, err := q.ExecContext(ctx, `
+		INSERT INTO ledger_entries (market_id, item_id, entry_type, debit_account, credit_account, amount, commission_rate)
+		VALUES `+strings.Join(values, ", "), entryArgs...); err != nil {
+		return fmt.Errorf("failed to post ledger entries: %v", err)
+	}
+	return nil
+}
+
+// saleLedgerEntry is one entry posted for a delivered order item
+type saleLedgerEntry struct {
+	entryType, debit, credit string
+	amount                   float64
+}
+
+// saleLedgerEntries splits the gross amount of a delivered order item into its sale, commission and
+// payout-due entries; rate is the commission rate in percent
+func saleLedgerEntries(gross, rate float64) []saleLedgerEntry {
+	commission := math.Round(gross*rate) / 100
+	return []saleLedgerEntry{
+		{models.LedgerEntrySale, ledgerAccountCash, ledgerAccountMarketSales, gross},
+		{models.LedgerEntryCommission, ledgerAccountMarketSales, ledgerAccountCommission, commission},
+		{models.LedgerEntryPayoutDue, ledgerAccountMarketSales, ledgerAccountMarketPayable, roundMoney(gross - commission)},
+	}
+}
+
+// refundReturnLedger reverses the returned share of the entries of a return's order items and
+// returns the refunded sale amount. found is false when none of the items were posted to the ledger.
+func refundReturnLedger(ctx context.Context, q execer, returnID int) (refunded float64, found bool, err error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT e.id, e.market_id, e.item_id, e.entry_type, e.debit_account, e.credit_account, e.commission_rate,
+			e.amount, e.amount - `+reversedAmountSQL+`, i.count, o.count
+		FROM return_request_items i
+		JOIN order_items o ON o.id = i.item_id
+		JOIN ledger_entries e ON e.item_id = i.item_id AND e.reversal_of IS NULL AND e.entry_type <> 'payout'
+		WHERE i.return_id = ?`, returnID)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to fetch ledger entries of return: %v", err)
+	}
+	type reversal struct {
+		entryID, marketID, itemID int
+		entryType, debit, credit  string
+		rate                      sql.NullFloat64
+		amount                    float64
+	}
+	var reversals []reversal
+	for rows.Next() {
+		var rv reversal
+		var original, remaining float64
+		var returned, ordered int
+		if err := rows.Scan(&rv.entryID, &rv.marketID, &rv.itemID, &rv.entryType, &rv.debit, &rv.credit, &rv.rate,
+			&original, &remaining, &returned, &ordered); err != nil {
+			rows.Close()
+			return 0, false, fmt.Errorf("failed to scan ledger entry: %v", err)
+		}
+		found = true
+		if ordered <= 0 || remaining <= 0 {
+			continue
+		}
+		rv.amount = math.Min(roundMoney(original*float64(returned)/float64(ordered)), remaining)
+		reversals = append(reversals, rv)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, false, fmt.Errorf("error iterating ledger entries: %v", err)
+	}
+
+	for _, rv := range reversals {
+		if _, err := q.ExecContext(ctx, `
+			INSERT INTO ledger_entries (market_id, item_id, return_id, entry_type, debit_account, credit_account, amount, commission_rate, reversal_of)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			rv.marketID, rv.itemID, returnID, rv.entryType, rv.credit, rv.debit, rv.amount, rv.rate, rv.entryID); err != nil {
+			return 0, false, fmt.Errorf("failed to post refund entry: %v", err)
+		}
+		if rv.entryType == models.LedgerEntrySale {
+			refunded += rv.amount
+		}
+	}
+	return roundMoney(refunded), found, nil
+}
+
+// GetCommissionRates lists the configured commission rates, the platform default first
+func (s *DBService) GetCommissionRates(ctx context.Context) ([]models.CommissionRate, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetCommissionRates")
+	defer span.End()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT cr.id, cr.market_id, COALESCE(m.name, ''), cr.category_id, COALESCE(c.name, ''), cr.rate, cr.updated_at
+		FROM commission_rates cr
+		LEFT JOIN markets m ON m.id = cr.market_id
+		LEFT JOIN categories c ON c.id = cr.category_id
+		ORDER BY cr.market_id, cr.category_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query commission rates: %v", err)
+	}
+	defer rows.Close()
+
+	rates := []models.CommissionRate{}
+	for rows.Next() {
+		var rate models.CommissionRate
+		if err := rows.Scan(&rate.ID, &rate.MarketID, &rate.MarketName, &rate.CategoryID, &rate.CategoryName,
+			&rate.Rate, &rate.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan commission rate: %v", err)
+		}
+		rates = append(rates, rate)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating commission rates: %v", err)
+	}
+	return rates, nil
+}
+
+// SetCommissionRate creates or changes the commission rate of a market, a category, both, or neither.
+// The new rate applies to items delivered from now on.
+func (s *DBService) SetCommissionRate(ctx context.Context, req models.SetCommissionRateRequest) (int, error) {
+	ctx, span := tracer.Start(ctx, "DBService.SetCommissionRate")
+	defer span.End()
+	if req.Rate == nil || *req.Rate < 0 || *req.Rate > 100 {
+		return 0, ErrInvalidRate
+	}
+	if req.MarketID < 0 || req.CategoryID < 0 {
+		return 0, ErrInvalidRateScope
+	}
+	if req.MarketID != 0 {
+		var exists bool
+		if err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM markets WHERE id = ?)", req.MarketID).Scan(&exists); err != nil {
+			return 0, fmt.Errorf("failed to validate market: %v", err)
+		}
+		if !exists {
+			return 0, ErrMarketNotFound
+		}
+	}
+	if req.CategoryID != 0 {
+		var exists bool
+		if err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM categories WHERE id = ?)", req.CategoryID).Scan(&exists); err != nil {
+			return 0, fmt.Errorf("failed to validate category: %v", err)
+		}
+		if !exists {
+			return 0, ErrCategoryNotFound
+		}
+	}
+
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO commission_rates (market_id, category_id, rate) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id), rate = VALUES(rate)`,
+		req.MarketID, req.CategoryID, *req.Rate)
+	if err != nil {
+		return 0, fmt.Errorf("failed to save commission rate: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve commission rate ID: %v", err)
+	}
+	return int(id), nil
+}
+
+// DeleteCommissionRate removes a commission rate; the platform default cannot be removed
+func (s *DBService) DeleteCommissionRate(ctx context.Context, rateID int) error {
+	ctx, span := tracer.Start(ctx, "DBService.DeleteCommissionRate")
+	defer span.End()
+	var marketID, categoryID int
+	err := s.db.QueryRowContext(ctx, "SELECT market_id, category_id FROM commission_rates WHERE id = ?", rateID).Scan(&marketID, &categoryID)
+	if err == sql.ErrNoRows {
+		return ErrCommissionRateNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch commission rate: %v", err)
+	}
+	if marketID == 0 && categoryID == 0 {
+		return ErrDefaultCommissionRate
+	}
+
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM commission_rates WHERE id = ?", rateID); err != nil {
+		return fmt.Errorf("failed to delete commission rate: %v", err)
+	}
+	return nil
+}
+
+// GeneratePayoutStatements assigns every market's unsettled entries posted up to the end of the period
+// to the market's statement of that period, creating it if needed. Entries left over from earlier
+// periods are included. Markets whose statement of the period is already paid keep their entries for
+// the next period. It returns the IDs of the created or updated statements.
+func (s *DBService) GeneratePayoutStatements(ctx context.Context, periodStart, periodEnd time.Time) ([]int, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GeneratePayoutStatements")
+	defer span.End()
+	if periodStart.After(periodEnd) {
+		return nil, ErrInvalidPayoutPeriod
+	}
+	start, end := analyticsDate(periodStart), analyticsDate(periodEnd)
+	_, endBound := analyticsBounds(periodEnd, periodEnd)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT DISTINCT market_id FROM ledger_entries
+		WHERE statement_id IS NULL AND entry_type <> 'payout' AND created_at < ?`, endBound)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query unsettled markets: %v", err)
+	}
+	var marketIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan market: %v", err)
+		}
+		marketIDs = append(marketIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating unsettled markets: %v", err)
+	}
+
+	statementIDs := []int{}
+	for _, marketID := range marketIDs {
+		var statementID int
+		var status string
+		err := tx.QueryRowContext(ctx, `
+			SELECT id, status FROM payout_statements
+			WHERE market_id = ? AND period_start = ? AND period_end = ?
+			FOR UPDATE`, marketID, start, end).Scan(&statementID, &status)
+		if err == sql.ErrNoRows {
+			result, err := tx.ExecContext(ctx, `
+				INSERT INTO payout_statements (market_id, period_start, period_end) VALUES (?, ?, ?)`,
+				marketID, start, end)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create payout statement: %v", err)
+			}
+			id, err := result.LastInsertId()
+			if err != nil {
+				return nil, fmt.Errorf("failed to retrieve payout statement ID: %v", err)
+			}
+			statementID, status = int(id), models.PayoutStatusPending
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to fetch payout statement: %v", err)
+		}
+		if status == models.PayoutStatusPaid {
+			continue
+		}
+
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE ledger_entries SET statement_id = ?
+			WHERE market_id = ? AND statement_id IS NULL AND entry_type <> 'payout' AND created_at < ?`,
+			statementID, marketID, endBound); err != nil {
+			return nil, fmt.Errorf("failed to assign ledger entries: %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE payout_statements ps
+			JOIN (
+				SELECT e.statement_id,
+					COALESCE(SUM(CASE WHEN e.entry_type = 'sale' THEN `+signedLedgerAmount+` END), 0) AS gross,
+					COALESCE(SUM(CASE WHEN e.entry_type = 'commission' THEN `+signedLedgerAmount+` END), 0) AS commission,
+					COALESCE(SUM(CASE WHEN e.entry_type = 'payout_due' THEN `+signedLedgerAmount+` END), 0) AS net
+				FROM ledger_entries e
+				WHERE e.statement_id = ?
+				GROUP BY e.statement_id
+			) t ON t.statement_id = ps.id
+			SET ps.gross = t.gross, ps.commission = t.commission, ps.net = t.net`, statementID); err != nil {
+			return nil, fmt.Errorf("failed to total payout statement: %v", err)
+		}
+		statementIDs = append(statementIDs, statementID)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return statementIDs, nil
+}
+
+func (s *DBService) handlePayoutStatementsJob(ctx context.Context, job models.Job) error {
+	var payload payoutStatementsPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid payout statements payload: %v", err)
+	}
+	start, err := time.Parse("2006-01-02", payload.PeriodStart)
+	if err != nil {
+		return fmt.Errorf("invalid payout period start %q", payload.PeriodStart)
+	}
+	end, err := time.Parse("2006-01-02", payload.PeriodEnd)
+	if err != nil {
+		return fmt.Errorf("invalid payout period end %q", payload.PeriodEnd)
+	}
+	_, err = s.GeneratePayoutStatements(ctx, start, end)
+	return err
+}
+
+// scheduleMonthlyPayoutStatements queues the statements of the previous month unless another run or
+// instance already queued them
+func (s *DBService) scheduleMonthlyPayoutStatements(ctx context.Context, now time.Time) {
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	periodStart := monthStart.AddDate(0, -1, 0)
+	key := fmt.Sprintf(payoutScheduleKeyFormat, periodStart.Format("2006-01"))
+	queued, err := s.redis.SetNX(ctx, key, 1, 40*24*time.Hour).Result()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to claim monthly payout statements", "error", err)
+		return
+	}
+	if !queued {
+		return
+	}
+
+	payload := payoutStatementsPayload{
+		PeriodStart: analyticsDate(periodStart),
+		PeriodEnd:   analyticsDate(monthStart.AddDate(0, 0, -1)),
+	}
+	if _, err := s.EnqueueJob(ctx, JobTypePayoutStatements, payload, 0); err != nil {
+		slog.ErrorContext(ctx, "Failed to queue monthly payout statements", "error", err)
+		// Let the next start or night try again
+		s.redis.Del(ctx, key)
+	}
+}
+
+// payoutStatementColumns selects a payout statement aliased ps joined with its market m
+const payoutStatementColumns = `ps.id, ps.market_id, COALESCE(m.name, ''), ps.period_start, ps.period_end,
+	ps.gross, ps.commission, ps.net, ps.status, COALESCE(ps.reference, ''), ps.created_at, ps.paid_at`
+
+func scanPayoutStatement(row rowScanner) (models.PayoutStatement, error) {
+	var st models.PayoutStatement
+	var paidAt sql.NullString
+	err := row.Scan(&st.ID, &st.MarketID, &st.MarketName, &st.PeriodStart, &st.PeriodEnd, &st.Gross,
+		&st.Commission, &st.Net, &st.Status, &st.Reference, &st.CreatedAt, &paidAt)
+	if paidAt.Valid {
+		st.PaidAt = &paidAt.String
+	}
+	return st, err
+}
+
+// GetPayoutStatements lists payout statements, newest period first. marketID 0 lists every market's.
+func (s *DBService) GetPayoutStatements(ctx context.Context, marketID int, status string, page, limit int) ([]models.PayoutStatement, int, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetPayoutStatements")
+	defer span.End()
+	where := "WHERE 1=1"
+	var args []interface{}
+	if marketID != 0 {
+		where += " AND ps.market_id = ?"
+		args = append(args, marketID)
+	}
+	if status != "" {
+		where += " AND ps.status = ?"
+		args = append(args, status)
+	}
+
+	var total int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM payout_statements ps "+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count payout statements: %v", err)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+payoutStatementColumns+`
+		FROM payout_statements ps
+		LEFT JOIN markets m ON m.id = ps.market_id
+		`+where+`
+		ORDER BY ps.period_end DESC, ps.id DESC
+		LIMIT ? OFFSET ?`, append(args, limit, (page-1)*limit)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query payout statements: %v", err)
+	}
+	defer rows.Close()
+
+	statements := []models.PayoutStatement{}
+	for rows.Next() {
+		st, err := scanPayoutStatement(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to scan payout statement: %v", err)
+		}
+		statements = append(statements, st)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating payout statements: %v", err)
+	}
+	return statements, total, nil
+}
+
+// GetPayoutStatement retrieves a payout statement with its ledger entries. A non-zero marketID
+// restricts it to that market's statements.
+func (s *DBService) GetPayoutStatement(ctx context.Context, statementID, marketID int) (models.PayoutStatement, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetPayoutStatement")
+	defer span.End()
+	st, err := scanPayoutStatement(s.db.QueryRowContext(ctx, `
+		SELECT `+payoutStatementColumns+`
+		FROM payout_statements ps
+		LEFT JOIN markets m ON m.id = ps.market_id
+		WHERE ps.id = ? AND (? = 0 OR ps.market_id = ?)`, statementID, marketID, marketID))
+	if err == sql.ErrNoRows {
+		return st, ErrStatementNotFound
+	}
+	if err != nil {
+		return st, fmt.Errorf("failed to fetch payout statement: %v", err)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, market_id, item_id, statement_id, return_id, entry_type, debit_account, credit_account, amount,
+			commission_rate, reversal_of, created_at
+		FROM ledger_entries
+		WHERE statement_id = ?
+		ORDER BY id`, statementID)
+	if err != nil {
+		return st, fmt.Errorf("failed to query ledger entries: %v", err)
+	}
+	defer rows.Close()
+
+	st.Entries = []models.LedgerEntry{}
+	for rows.Next() {
+		var e models.LedgerEntry
+		var itemID, stmtID, returnID, reversalOf sql.NullInt64
+		var rate sql.NullFloat64
+		if err := rows.Scan(&e.ID, &e.MarketID, &itemID, &stmtID, &returnID, &e.EntryType, &e.DebitAccount, &e.CreditAccount,
+			&e.Amount, &rate, &reversalOf, &e.CreatedAt); err != nil {
+			return st, fmt.Errorf("failed to scan ledger entry: %v", err)
+		}
+		if itemID.Valid {
+			id := int(itemID.Int64)
+			e.ItemID = &id
+		}
+		if stmtID.Valid {
+			id := int(stmtID.Int64)
+			e.StatementID = &id
+		}
+		if returnID.Valid {
+			id := int(returnID.Int64)
+			e.ReturnID = &id
+		}
+		if reversalOf.Valid {
+			id := int(reversalOf.Int64)
+			e.ReversalOf = &id
+		}
+		if rate.Valid {
+			e.CommissionRate = &rate.Float64
+		}
+		st.Entries = append(st.Entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return st, fmt.Errorf("error iterating ledger entries: %v", err)
+	}
+	return st, nil
+}
+
+// MarkPayoutStatementPaid marks a pending statement as paid and posts the payout entry settling it
+func (s *DBService) MarkPayoutStatementPaid(ctx context.Context, statementID, superadminID int, reference string) error {
+	ctx, span := tracer.Start(ctx, "DBService.MarkPayoutStatementPaid")
+	defer span.End()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var marketID int
+	var net float64
+	var status string
+	err = tx.QueryRowContext(ctx, `
+		SELECT market_id, net, status FROM payout_statements WHERE id = ? FOR UPDATE`, statementID).Scan(&marketID, &net, &status)
+	if err == sql.ErrNoRows {
+		return ErrStatementNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch payout statement: %v", err)
+	}
+	if status == models.PayoutStatusPaid {
+		return ErrStatementPaid
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE payout_statements SET status = ?, reference = ?, paid_at = CURRENT_TIMESTAMP, paid_by = ?
+		WHERE id = ?`, models.PayoutStatusPaid, nullIfEmpty(reference), superadminID, statementID); err != nil {
+		return fmt.Errorf("failed to update payout statement: %v", err)
+	}
+
+	// A negative balance is settled by the market paying the platform
+	debit, credit := ledgerAccountMarketPayable, ledgerAccountCash
+	if net < 0 {
+		debit, credit, net = credit, debit, -net
+	}
+	if net > 0 {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO ledger_entries (market_id, statement_id, entry_type, debit_account, credit_account, amount)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			marketID, statementID, models.LedgerEntryPayout, debit, credit, net); err != nil {
+			return fmt.Errorf("failed to post payout entry: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package services
+
+import (
+	"testing"
+
+	"Dowlet_projects/ecommerce/models"
+)
+
+func TestSaleLedgerEntries(t *testing.T) {
+	tests := []struct {
+		name       string
+		gross      float64
+		rate       float64
+		commission float64
+		payout     float64
+	}{
+		{"no commission", 100, 0, 0, 100},
+		{"whole percent", 250, 10, 25, 225},
+		{"fractional rate", 99.99, 7.5, 7.5, 92.49},
+		{"commission rounds half up", 0.5, 1, 0.01, 0.49},
+		{"commission rounds down", 10.01, 12, 1.2, 8.81},
+		{"discounted line", 3 * 19.99 * 0.85, 5, 2.55, 48.42},
+		{"full commission", 42.42, 100, 42.42, 0},
+		{"zero amount", 0, 15, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := saleLedgerEntries(roundMoney(tt.gross), tt.rate)
+			if len(entries) != 3 {
+				t.Fatalf("expected 3 entries, got %d", len(entries))
+			}
+			want := []struct {
+				entryType, debit, credit string
+				amount                   float64
+			}{
+				{models.LedgerEntrySale, ledgerAccountCash, ledgerAccountMarketSales, roundMoney(tt.gross)},
+				{models.LedgerEntryCommission, ledgerAccountMarketSales, ledgerAccountCommission, tt.commission},
+				{models.LedgerEntryPayoutDue, ledgerAccountMarketSales, ledgerAccountMarketPayable, tt.payout},
+			}
+			for i, w := range want {
+				e := entries[i]
+				if e.entryType != w.entryType || e.debit != w.debit || e.credit != w.credit || e.amount != w.amount {
+					t.Errorf("entry %d: got %s %s->%s %.2f, want %s %s->%s %.2f",
+						i, e.entryType, e.debit, e.credit, e.amount, w.entryType, w.debit, w.credit, w.amount)
+				}
+			}
+			if got := roundMoney(entries[1].amount + entries[2].amount); got != entries[0].amount {
+				t.Errorf("commission and payout add up to %.2f, want the sale amount %.2f", got, entries[0].amount)
+			}
+		})
+	}
+}
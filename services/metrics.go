@@ -0,0 +1,52 @@
+package services
+
+import (
+	"context"
+
+	"Dowlet_projects/ecommerce/metrics"
+)
+
+// Cache and business metrics; HTTP metrics are kept by the api package
+var (
+	cacheLookups = metrics.NewCounter("ecommerce_cache_lookups_total",
+		"Redis lookups of the cached market, product and category lists by result (hit or miss)", "cache", "result")
+	ordersCreated = metrics.NewCounter("ecommerce_orders_created_total",
+		"Market orders created at checkout; one checkout creates an order per market")
+	otpSent = metrics.NewCounter("ecommerce_otp_sent_total",
+		"Verification codes issued by purpose (sign_in or phone_change)", "purpose")
+	jobRuns = metrics.NewCounter("ecommerce_job_runs_total",
+		"Background job runs by type and outcome (completed, retrying or dead)", "type", "outcome")
+)
+
+// RegisterMetrics exposes the MySQL and Redis connection pool statistics of the service. Call it
+// once, for the service the server uses.
+func (s *DBService) RegisterMetrics() {
+	metrics.NewGaugeFunc("ecommerce_db_open_connections", "Open MySQL connections, in use or idle",
+		func() float64 { return float64(s.db.Stats().OpenConnections) })
+	metrics.NewGaugeFunc("ecommerce_db_in_use_connections", "MySQL connections in use",
+		func() float64 { return float64(s.db.Stats().InUse) })
+	metrics.NewGaugeFunc("ecommerce_db_idle_connections", "Idle MySQL connections",
+		func() float64 { return float64(s.db.Stats().Idle) })
+	metrics.NewGaugeFunc("ecommerce_db_max_open_connections", "Limit of open MySQL connections (0 for none)",
+		func() float64 { return float64(s.db.Stats().MaxOpenConnections) })
+	metrics.NewCounterFunc("ecommerce_db_wait_count_total", "MySQL connections waited for",
+		func() float64 { return float64(s.db.Stats().WaitCount) })
+	metrics.NewCounterFunc("ecommerce_db_wait_duration_seconds_total", "Time spent waiting for MySQL connections",
+		func() float64 { return s.db.Stats().WaitDuration.Seconds() })
+
+	metrics.NewGaugeFunc("ecommerce_redis_total_connections", "Redis connections in the pool",
+		func() float64 { return float64(s.redis.PoolStats().TotalConns) })
+	metrics.NewGaugeFunc("ecommerce_redis_idle_connections", "Idle Redis connections",
+		func() float64 { return float64(s.redis.PoolStats().IdleConns) })
+	metrics.NewCounterFunc("ecommerce_redis_pool_timeouts_total", "Waits for a Redis connection that timed out",
+		func() float64 { return float64(s.redis.PoolStats().Timeouts) })
+}
+
+// Ping checks the MySQL and Redis connections, returning the error of each by name ("mysql",
+// "redis"); nil means reachable
+func (s *DBService) Ping(ctx context.Context) map[string]error {
+	return map[string]error{
+		"mysql": s.db.PingContext(ctx),
+		"redis": s.redis.Ping(ctx).Err(),
+	}
+}
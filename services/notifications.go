@@ -0,0 +1,398 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"Dowlet_projects/ecommerce/models"
+)
+
+// JobTypeSendPush delivers the push notification of an inbox entry
+const JobTypeSendPush = "send_push"
+
+// orderNotificationStaffRoles are the staff roles that may read orders and therefore get order pushes
+var orderNotificationStaffRoles = []string{models.StaffRoleOwner, models.StaffRoleOrderHandler, models.StaffRoleViewer}
+
+// validDevicePlatforms lists the accepted device platforms
+var validDevicePlatforms = map[string]bool{"android": true, "ios": true, "web": true}
+
+// SetNotifier replaces the push notifier; the default only records messages
+func (s *DBService) SetNotifier(n Notifier) {
+	s.notifier = n
+}
+
+// RegisterDevice registers a push token for a user, market or market staff member.
+// A token already registered to someone else moves to the new owner, e.g. after a re-login on a shared device.
+func (s *DBService) RegisterDevice(ctx context.Context, ownerType string, ownerID int, token, platform string) error {
+	ctx, span := tracer.Start(ctx, "DBService.RegisterDevice")
+	defer span.End()
+	if !validDevicePlatforms[platform] {
+		return ErrInvalidPlatform
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO device_tokens (owner_type, owner_id, token, platform)
+		VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE owner_type = VALUES(owner_type), owner_id = VALUES(owner_id),
+			platform = VALUES(platform), last_seen_at = CURRENT_TIMESTAMP`,
+		ownerType, ownerID, token, platform)
+	if err != nil {
+		return fmt.Errorf("failed to register device: %v", err)
+	}
+	return nil
+}
+
+// UnregisterDevice removes a push token of its owner
+func (s *DBService) UnregisterDevice(ctx context.Context, ownerType string, ownerID int, token string) error {
+	ctx, span := tracer.Start(ctx, "DBService.UnregisterDevice")
+	defer span.End()
+	result, err := s.db.ExecContext(ctx, "DELETE FROM device_tokens WHERE owner_type = ? AND owner_id = ? AND token = ?",
+		ownerType, ownerID, token)
+	if err != nil {
+		return fmt.Errorf("failed to unregister device: %v", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to check rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		return ErrDeviceNotFound
+	}
+	return nil
+}
+
+// GetNotifications retrieves a page of an inbox, newest first, with the total and unread counts
+func (s *DBService) GetNotifications(ctx context.Context, recipientType string, recipientID int, unreadOnly bool, page, limit int) ([]models.Notification, int, int, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetNotifications")
+	defer span.End()
+	where := "recipient_type = ? AND recipient_id = ?"
+	args := []interface{}{recipientType, recipientID}
+	if unreadOnly {
+		where += " AND read_at IS NULL"
+	}
+
+	var totalCount, unreadCount int
+	err := s.db.QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT COUNT(*), COALESCE(SUM(read_at IS NULL), 0)
+		FROM notifications WHERE %s`, where), args...).Scan(&totalCount, &unreadCount)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to count notifications: %v", err)
+	}
+
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT id, type, title, title_ru, body, body_ru, data, read_at, created_at
+		FROM notifications WHERE %s
+		ORDER BY id DESC
+		LIMIT ? OFFSET ?`, where), append(args, limit, (page-1)*limit)...)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to query notifications: %v", err)
+	}
+	defer rows.Close()
+
+	notifications := []models.Notification{}
+	for rows.Next() {
+		var n models.Notification
+		var data, readAt sql.NullString
+		if err := rows.Scan(&n.ID, &n.Type, &n.Title, &n.TitleRu, &n.Body, &n.BodyRu, &data, &readAt, &n.CreatedAt); err != nil {
+			return nil, 0, 0, fmt.Errorf("failed to scan notification: %v", err)
+		}
+		if data.Valid && data.String != "" {
+			if err := json.Unmarshal([]byte(data.String), &n.Data); err != nil {
+				slog.ErrorContext(ctx, "Failed to decode notification data", "notification_id", n.ID, "error", err)
+			}
+		}
+		if readAt.Valid {
+			n.IsRead = true
+			n.ReadAt = &readAt.String
+		}
+		notifications = append(notifications, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, 0, fmt.Errorf("error iterating notifications: %v", err)
+	}
+
+	return notifications, totalCount, unreadCount, nil
+}
+
+// MarkNotificationRead marks an inbox entry as read
+func (s *DBService) MarkNotificationRead(ctx context.Context, recipientType string, recipientID, notificationID int) error {
+	ctx, span := tracer.Start(ctx, "DBService.MarkNotificationRead")
+	defer span.End()
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE notifications SET read_at = COALESCE(read_at, CURRENT_TIMESTAMP)
+		WHERE id = ? AND recipient_type = ? AND recipient_id = ?`,
+		notificationID, recipientType, recipientID)
+	if err != nil {
+		return fmt.Errorf("failed to mark notification as read: %v", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to check rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		// Nothing changes for an entry that was already read, so confirm that it exists
+		var exists bool
+		err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM notifications WHERE id = ? AND recipient_type = ? AND recipient_id = ?)",
+			notificationID, recipientType, recipientID).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("failed to check notification: %v", err)
+		}
+		if !exists {
+			return ErrNotificationNotFound
+		}
+	}
+	return nil
+}
+
+// MarkAllNotificationsRead marks every unread entry of an inbox as read and returns how many changed
+func (s *DBService) MarkAllNotificationsRead(ctx context.Context, recipientType string, recipientID int) (int64, error) {
+	ctx, span := tracer.Start(ctx, "DBService.MarkAllNotificationsRead")
+	defer span.End()
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE notifications SET read_at = CURRENT_TIMESTAMP
+		WHERE recipient_type = ? AND recipient_id = ? AND read_at IS NULL`,
+		recipientType, recipientID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark notifications as read: %v", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to check rows affected: %v", err)
+	}
+	return updated, nil
+}
+
+// notification is an inbox entry about to be created
+type notification struct {
+	recipientType string
+	recipientID   int
+	kind          string
+	title         string
+	titleRu       string
+	body          string
+	bodyRu        string
+	data          map[string]string
+}
+
+// notify stores an inbox entry and queues its push delivery.
+// Failures are logged only: notifications never fail the action that triggered them.
+func (s *DBService) notify(ctx context.Context, n notification) {
+	var data interface{}
+	if len(n.data) > 0 {
+		encoded, err := json.Marshal(n.data)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to encode notification data", "error", err)
+		} else {
+			data = string(encoded)
+		}
+	}
+
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO notifications (recipient_type, recipient_id, type, title, title_ru, body, body_ru, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		n.recipientType, n.recipientID, n.kind, n.title, n.titleRu, n.body, n.bodyRu, data)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to store notification", "kind", n.kind, "recipient_type", n.recipientType, "recipient_id", n.recipientID, "error", err)
+		return
+	}
+	notificationID, err := result.LastInsertId()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to retrieve notification ID", "error", err)
+		return
+	}
+
+	if _, err := s.EnqueueJob(ctx, JobTypeSendPush, sendPushPayload{NotificationID: int(notificationID)}, 0); err != nil {
+		slog.ErrorContext(ctx, "Failed to queue push", "notification_id", notificationID, "error", err)
+	}
+}
+
+// sendPushPayload is the job payload of a push delivery
+type sendPushPayload struct {
+	NotificationID int `json:"notification_id"`
+}
+
+// handleSendPushJob pushes an inbox entry to every device of its recipient
+func (s *DBService) handleSendPushJob(ctx context.Context, job models.Job) error {
+	var payload sendPushPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid send push payload: %v", err)
+	}
+
+	var recipientType, title, body string
+	var recipientID int
+	var data sql.NullString
+	err := s.db.QueryRowContext(ctx, `
+		SELECT recipient_type, recipient_id, title, body, data
+		FROM notifications WHERE id = ?`, payload.NotificationID).
+		Scan(&recipientType, &recipientID, &title, &body, &data)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch notification: %v", err)
+	}
+
+	tokens, err := s.recipientDeviceTokens(ctx, recipientType, recipientID)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	msg := PushMessage{Tokens: tokens, Title: title, Body: body, Data: map[string]string{}}
+	if data.Valid && data.String != "" {
+		if err := json.Unmarshal([]byte(data.String), &msg.Data); err != nil {
+			slog.ErrorContext(ctx, "Failed to decode notification data", "notification_id", payload.NotificationID, "error", err)
+		}
+	}
+	msg.Data["notification_id"] = fmt.Sprint(payload.NotificationID)
+
+	invalid, err := s.notifier.Send(ctx, msg)
+	if len(invalid) > 0 {
+		if _, delErr := s.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM device_tokens WHERE token IN (%s)", placeholders(len(invalid))),
+			stringArgs(invalid)...); delErr != nil {
+			slog.ErrorContext(ctx, "Failed to delete invalid device tokens", "error", delErr)
+		}
+	}
+	return err
+}
+
+// recipientDeviceTokens lists the push tokens of a recipient. A market's tokens are those of its own
+// login plus those of active staff members allowed to see orders.
+func (s *DBService) recipientDeviceTokens(ctx context.Context, recipientType string, recipientID int) ([]string, error) {
+	var rows *sql.Rows
+	var err error
+	switch recipientType {
+	case models.RecipientUser:
+		rows, err = s.db.QueryContext(ctx, "SELECT token FROM device_tokens WHERE owner_type = 'user' AND owner_id = ?", recipientID)
+	case models.RecipientMarket:
+		args := []interface{}{recipientID, recipientID}
+		args = append(args, stringArgs(orderNotificationStaffRoles)...)
+		rows, err = s.db.QueryContext(ctx, fmt.Sprintf(`
+			SELECT token FROM device_tokens WHERE owner_type = 'market' AND owner_id = ?
+			UNION
+			SELECT d.token FROM device_tokens d
+			JOIN market_staff ms ON d.owner_type = 'market_staff' AND d.owner_id = ms.id
+			WHERE ms.market_id = ? AND ms.is_active = 1 AND ms.role IN (%s)`, placeholders(len(orderNotificationStaffRoles))), args...)
+	default:
+		return nil, fmt.Errorf("unknown recipient type %s", recipientType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query device tokens: %v", err)
+	}
+	defer rows.Close()
+
+	var tokens []string
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			return nil, fmt.Errorf("failed to scan device token: %v", err)
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// notifyNewOrder tells a market about an order freshly placed with it
+func (s *DBService) notifyNewOrder(ctx context.Context, userID, orderID int, orderNumber, customerName string, marketID int) {
+	s.notify(ctx, notification{
+		recipientType: models.RecipientMarket,
+		recipientID:   marketID,
+		kind:          models.NotificationNewOrder,
+		title:         "New order",
+		titleRu:       "Новый заказ",
+		body:          fmt.Sprintf("%s placed order #%s", customerName, orderNumber),
+		bodyRu:        fmt.Sprintf("%s оформил(а) заказ №%s", customerName, orderNumber),
+		data: map[string]string{
+			"order_id":     fmt.Sprint(orderID),
+			"order_number": orderNumber,
+			"user_id":      fmt.Sprint(userID),
+		},
+	})
+}
+
+// orderStatusTexts holds the notification title and body templates per order status
+var orderStatusTexts = map[string]struct{ title, titleRu, body, bodyRu string }{
+	"delivered": {"Order delivered", "Заказ доставлен", "Your order #%s from %s has been delivered", "Ваш заказ №%s из %s доставлен"},
+	"canceled":  {"Order canceled", "Заказ отменён", "Your order #%s from %s has been canceled", "Ваш заказ №%s из %s отменён"},
+}
+
+// orderItemStatusTexts holds the notification title and body templates per order item status
+var orderItemStatusTexts = map[string]struct{ title, titleRu, body, bodyRu string }{
+	"shipped":      {"Order shipped", "Заказ отправлен", "%d item(s) of your order #%s from %s have been shipped", "Товаров отправлено из заказа №%[2]s из %[3]s: %[1]d"},
+	"delivered":    {"Order delivered", "Заказ доставлен", "%d item(s) of your order #%s from %s have been delivered", "Товаров доставлено из заказа №%[2]s из %[3]s: %[1]d"},
+	"canceled":     {"Item canceled", "Товар отменён", "%d item(s) of your order #%s from %s have been canceled", "Товаров отменено в заказе №%[2]s из %[3]s: %[1]d"},
+	"out_of_stock": {"Item out of stock", "Товара нет в наличии", "%d item(s) of your order #%s from %s are out of stock and were removed", "Товаров нет в наличии и они удалены из заказа №%[2]s из %[3]s: %[1]d"},
+}
+
+// marketNotificationNames returns the English and Russian names of a market for notification texts
+func (s *DBService) marketNotificationNames(ctx context.Context, marketID int) (string, string) {
+	var marketName, marketNameRu string
+	err := s.db.QueryRowContext(ctx, "SELECT name, COALESCE(NULLIF(name_ru, ''), name) FROM markets WHERE id = ?", marketID).
+		Scan(&marketName, &marketNameRu)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to fetch market for notification", "market_id", marketID, "error", err)
+	}
+	return marketName, marketNameRu
+}
+
+// notifyOrderStatusChanged tells a user that a market changed the status of their order
+func (s *DBService) notifyOrderStatusChanged(ctx context.Context, userID, orderID int, orderNumber string, marketID int, status string) {
+	texts, ok := orderStatusTexts[status]
+	if !ok {
+		return
+	}
+	marketName, marketNameRu := s.marketNotificationNames(ctx, marketID)
+
+	s.notify(ctx, notification{
+		recipientType: models.RecipientUser,
+		recipientID:   userID,
+		kind:          models.NotificationOrderStatusChanged,
+		title:         texts.title,
+		titleRu:       texts.titleRu,
+		body:          fmt.Sprintf(texts.body, orderNumber, marketName),
+		bodyRu:        fmt.Sprintf(texts.bodyRu, orderNumber, marketNameRu),
+		data: map[string]string{
+			"order_id":     fmt.Sprint(orderID),
+			"order_number": orderNumber,
+			"market_id":    fmt.Sprint(marketID),
+			"status":       status,
+		},
+	})
+}
+
+// notifyOrderItemsChanged tells a user that a market changed the status of some items of their order
+func (s *DBService) notifyOrderItemsChanged(ctx context.Context, userID, orderID int, orderNumber string, marketID int, status string, items int) {
+	texts, ok := orderItemStatusTexts[status]
+	if !ok {
+		return
+	}
+	marketName, marketNameRu := s.marketNotificationNames(ctx, marketID)
+
+	s.notify(ctx, notification{
+		recipientType: models.RecipientUser,
+		recipientID:   userID,
+		kind:          models.NotificationOrderStatusChanged,
+		title:         texts.title,
+		titleRu:       texts.titleRu,
+		body:          fmt.Sprintf(texts.body, items, orderNumber, marketName),
+		bodyRu:        fmt.Sprintf(texts.bodyRu, items, orderNumber, marketNameRu),
+		data: map[string]string{
+			"order_id":     fmt.Sprint(orderID),
+			"order_number": orderNumber,
+			"market_id":    fmt.Sprint(marketID),
+			"status":       status,
+		},
+	})
+}
+
+func stringArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return args
+}
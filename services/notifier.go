@@ -0,0 +1,239 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// PushMessage is a push notification addressed to a set of device tokens
+type PushMessage struct {
+	Tokens []string
+	Title  string
+	Body   string
+	Data   map[string]string
+}
+
+// Notifier delivers push notifications to devices.
+// Send returns the tokens the provider reported as no longer valid so that they can be forgotten.
+type Notifier interface {
+	Send(ctx context.Context, msg PushMessage) (invalidTokens []string, err error)
+}
+
+// defaultFCMEndpoint is the FCM legacy HTTP endpoint; compatible gateways accept the same request
+const defaultFCMEndpoint = "https://fcm.googleapis.com/fcm/send"
+
+// fcmMaxTokens is the maximum number of registration IDs per FCM request
+const fcmMaxTokens = 1000
+
+// FCMNotifier sends push notifications through an FCM-compatible HTTP API
+type FCMNotifier struct {
+	endpoint  string
+	serverKey string
+	client    *http.Client
+}
+
+// NewFCMNotifier creates an FCM notifier; an empty endpoint uses the FCM legacy HTTP endpoint
+func NewFCMNotifier(endpoint, serverKey string) *FCMNotifier {
+	if endpoint == "" {
+		endpoint = defaultFCMEndpoint
+	}
+	return &FCMNotifier{
+		endpoint:  endpoint,
+		serverKey: serverKey,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type fcmRequest struct {
+	RegistrationIDs []string          `json:"registration_ids"`
+	Notification    fcmNotification   `json:"notification"`
+	Data            map[string]string `json:"data,omitempty"`
+	Priority        string            `json:"priority"`
+}
+
+type fcmNotification struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+type fcmResponse struct {
+	Failure int `json:"failure"`
+	Results []struct {
+		MessageID string `json:"message_id"`
+		Error     string `json:"error"`
+	} `json:"results"`
+}
+
+// Send delivers msg in batches of fcmMaxTokens tokens
+func (n *FCMNotifier) Send(ctx context.Context, msg PushMessage) ([]string, error) {
+	var invalid []string
+	for start := 0; start < len(msg.Tokens); start += fcmMaxTokens {
+		end := start + fcmMaxTokens
+		if end > len(msg.Tokens) {
+			end = len(msg.Tokens)
+		}
+		batchInvalid, err := n.send(ctx, msg, msg.Tokens[start:end])
+		invalid = append(invalid, batchInvalid...)
+		if err != nil {
+			return invalid, err
+		}
+	}
+	return invalid, nil
+}
+
+func (n *FCMNotifier) send(ctx context.Context, msg PushMessage, tokens []string) ([]string, error) {
+	body, err := json.Marshal(fcmRequest{
+		RegistrationIDs: tokens,
+		Notification:    fcmNotification{Title: msg.Title, Body: msg.Body},
+		Data:            msg.Data,
+		Priority:        "high",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode push message: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create push request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "key="+n.serverKey)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send push message: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("push provider returned status %d: %s", resp.StatusCode, bytes.TrimSpace(snippet))
+	}
+
+	var result fcmResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode push response: %v", err)
+	}
+
+	var invalid []string
+	for i, r := range result.Results {
+		if i >= len(tokens) {
+			break
+		}
+		switch r.Error {
+		case "":
+		case "NotRegistered", "InvalidRegistration", "MismatchSenderId":
+			invalid = append(invalid, tokens[i])
+		default:
+			// Retrying the whole message would duplicate it on devices that already received it
+			slog.WarnContext(ctx, "Push to token failed", "token", tokens[i], "error", r.Error)
+		}
+	}
+	return invalid, nil
+}
+
+// fakeNotifierHistory caps how many messages a FakeNotifier keeps
+const fakeNotifierHistory = 100
+
+// FakeNotifier records push messages instead of sending them; it is used when no provider is configured
+type FakeNotifier struct {
+	mu   sync.Mutex
+	sent []PushMessage
+}
+
+// NewFakeNotifier creates a notifier that only logs and records messages
+func NewFakeNotifier() *FakeNotifier {
+	return &FakeNotifier{}
+}
+
+// Send records msg and logs it
+func (n *FakeNotifier) Send(ctx context.Context, msg PushMessage) ([]string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sent = append(n.sent, msg)
+	if len(n.sent) > fakeNotifierHistory {
+		n.sent = n.sent[len(n.sent)-fakeNotifierHistory:]
+	}
+	slog.InfoContext(ctx, "Push not sent, no provider configured", "devices", len(msg.Tokens), "title", msg.Title)
+	return nil, nil
+}
+
+// Sent returns the most recently recorded messages
+func (n *FakeNotifier) Sent() []PushMessage {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]PushMessage(nil), n.sent...)
+}
+
+// SMSSender delivers text messages to phone numbers
+type SMSSender interface {
+	SendSMS(ctx context.Context, phone, text string) error
+}
+
+// LogSMSSender logs text messages instead of sending them; it is used when no SMS gateway is configured
+type LogSMSSender struct{}
+
+// SendSMS logs the message
+func (LogSMSSender) SendSMS(ctx context.Context, phone, text string) error {
+	slog.WarnContext(ctx, "SMS not sent, no gateway configured", "phone", phone)
+	// The text may hold a verification code, so it is only logged at debug level
+	slog.DebugContext(ctx, "SMS text", "phone", phone, "text", text)
+	return nil
+}
+
+// HTTPSMSSender sends text messages through an SMS gateway that accepts a JSON POST of the phone
+// number and text, authenticated with a bearer token
+type HTTPSMSSender struct {
+	endpoint string
+	token    string
+	client   *http.Client
+}
+
+// NewHTTPSMSSender creates a sender for the gateway at endpoint; an empty token sends no
+// Authorization header
+func NewHTTPSMSSender(endpoint, token string) *HTTPSMSSender {
+	return &HTTPSMSSender{
+		endpoint: endpoint,
+		token:    token,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type smsRequest struct {
+	Phone string `json:"phone"`
+	Text  string `json:"text"`
+}
+
+// SendSMS posts the message to the gateway; any 2xx status counts as sent
+func (s *HTTPSMSSender) SendSMS(ctx context.Context, phone, text string) error {
+	body, err := json.Marshal(smsRequest{Phone: phone, Text: text})
+	if err != nil {
+		return fmt.Errorf("failed to encode SMS: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create SMS request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send SMS: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("SMS gateway returned status %d: %s", resp.StatusCode, bytes.TrimSpace(snippet))
+	}
+	return nil
+}
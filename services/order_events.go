@@ -0,0 +1,203 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"Dowlet_projects/ecommerce/models"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Order events of a market are numbered by order_events:<market>:next_id, kept in the
+// order_events:<market> sorted set (scored by ID) for replay on reconnect and published on
+// order_events:<market>:live so that every server instance can fan them out to its streams.
+// The ID counter never expires, so IDs keep growing after a quiet day and clients resuming with
+// since=N never miss new events; only the history expires.
+const (
+	orderEventsNextIDKeyFormat  = "order_events:%d:next_id"
+	orderEventsKeyFormat        = "order_events:%d"
+	orderEventsChannelKeyFormat = "order_events:%d:live"
+	// orderEventsHistory is how many recent events per market are kept for replay
+	orderEventsHistory = 500
+	// orderEventsTTL expires the history of markets without recent order activity
+	orderEventsTTL = 24 * time.Hour
+)
+
+// publishOrderEvent records an order event of a market and publishes it to live streams.
+// Failures are only logged: streams are a convenience and must never fail the order action.
+func (s *DBService) publishOrderEvent(ctx context.Context, event models.OrderEvent) {
+	id, err := s.redis.Incr(ctx, fmt.Sprintf(orderEventsNextIDKeyFormat, event.MarketID)).Result()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to allocate order event ID", "market_id", event.MarketID, "error", err)
+		return
+	}
+	event.ID = id
+	event.CreatedAt = time.Now().UTC().Format("2006-01-02 15:04:05")
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to encode order event", "market_id", event.MarketID, "error", err)
+		return
+	}
+
+	key := fmt.Sprintf(orderEventsKeyFormat, event.MarketID)
+	pipe := s.redis.TxPipeline()
+	pipe.ZAdd(ctx, key, &redis.Z{Score: float64(id), Member: payload})
+	pipe.ZRemRangeByRank(ctx, key, 0, -orderEventsHistory-1)
+	pipe.Expire(ctx, key, orderEventsTTL)
+	// Counters used to expire with the history; drop the TTL such counters still carry
+	pipe.Persist(ctx, fmt.Sprintf(orderEventsNextIDKeyFormat, event.MarketID))
+	pipe.Publish(ctx, fmt.Sprintf(orderEventsChannelKeyFormat, event.MarketID), payload)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.ErrorContext(ctx, "Failed to publish order event", "event_id", id, "market_id", event.MarketID, "error", err)
+	}
+}
+
+// publishNewOrderEvent publishes an order-created event to the market of a new order
+func (s *DBService) publishNewOrderEvent(ctx context.Context, userID, orderID, cartOrderID, marketID int) {
+	s.publishOrderEvent(ctx, models.OrderEvent{
+		Type:        models.OrderEventCreated,
+		MarketID:    marketID,
+		OrderID:     orderID,
+		CartOrderID: cartOrderID,
+		UserID:      userID,
+	})
+}
+
+// publishOrderStatusEvent publishes a status change of a market's order
+func (s *DBService) publishOrderStatusEvent(ctx context.Context, userID, orderID, cartOrderID, marketID int, status string) {
+	eventType := models.OrderEventStatusChanged
+	if status == "canceled" || status == "cancelled" {
+		eventType = models.OrderEventCancelled
+	}
+	s.publishOrderEvent(ctx, models.OrderEvent{
+		Type:        eventType,
+		MarketID:    marketID,
+		OrderID:     orderID,
+		CartOrderID: cartOrderID,
+		UserID:      userID,
+		Status:      status,
+	})
+}
+
+// SubscribeOrderEvents streams the order events of a market until ctx is done, then closes the channel.
+// Events after lastEventID are replayed first; if some of them are no longer kept a single resync
+// event is sent instead, telling the client to reload its orders list.
+func (s *DBService) SubscribeOrderEvents(ctx context.Context, marketID int, lastEventID int64) (<-chan models.OrderEvent, error) {
+	// Subscribe before reading the history so that no event falls between the two
+	pubsub := s.redis.Subscribe(ctx, fmt.Sprintf(orderEventsChannelKeyFormat, marketID))
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, fmt.Errorf("failed to subscribe to order events: %v", err)
+	}
+
+	var backlog []models.OrderEvent
+	if lastEventID > 0 {
+		var err error
+		backlog, err = s.orderEventBacklog(ctx, marketID, lastEventID)
+		if err != nil {
+			pubsub.Close()
+			return nil, err
+		}
+	}
+
+	events := make(chan models.OrderEvent, 16)
+	go func() {
+		defer close(events)
+		defer pubsub.Close()
+
+		send := func(event models.OrderEvent) bool {
+			select {
+			case events <- event:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		// After a resync the client starts over from the current sequence
+		since := lastEventID
+		replayed := make(map[int64]bool, len(backlog))
+		for _, event := range backlog {
+			if event.Type == models.OrderEventResync {
+				since = event.ID
+			}
+			replayed[event.ID] = true
+			if !send(event) {
+				return
+			}
+		}
+
+		live := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-live:
+				if !ok {
+					return
+				}
+				var event models.OrderEvent
+				if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+					slog.ErrorContext(ctx, "Failed to decode order event", "market_id", marketID, "error", err)
+					continue
+				}
+				// Events already replayed from the history arrive here too
+				if event.ID <= since || replayed[event.ID] {
+					continue
+				}
+				if !send(event) {
+					return
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// orderEventBacklog returns the kept events of a market after lastEventID, or a resync event when
+// events after lastEventID were already dropped from the history
+func (s *DBService) orderEventBacklog(ctx context.Context, marketID int, lastEventID int64) ([]models.OrderEvent, error) {
+	currentID, err := s.redis.Get(ctx, fmt.Sprintf(orderEventsNextIDKeyFormat, marketID)).Int64()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to fetch order event sequence: %v", err)
+	}
+	if currentID == lastEventID {
+		return nil, nil
+	}
+
+	payloads, err := s.redis.ZRangeByScore(ctx, fmt.Sprintf(orderEventsKeyFormat, marketID), &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(lastEventID, 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch order event history: %v", err)
+	}
+
+	events := make([]models.OrderEvent, 0, len(payloads))
+	for _, payload := range payloads {
+		var event models.OrderEvent
+		if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			return nil, fmt.Errorf("failed to decode order event: %v", err)
+		}
+		events = append(events, event)
+	}
+
+	// The sequence was reset (the counter was lost from Redis) or the oldest missed event was
+	// trimmed or expired
+	if currentID < lastEventID || len(events) == 0 || events[0].ID != lastEventID+1 {
+		return []models.OrderEvent{{
+			ID:        currentID,
+			Type:      models.OrderEventResync,
+			MarketID:  marketID,
+			CreatedAt: time.Now().UTC().Format("2006-01-02 15:04:05"),
+		}}, nil
+	}
+	return events, nil
+}
@@ -20,6 +20,7 @@ func GenerateVerificationCode(db *DBService, phone, fullName string) (string, er
 	if err != nil {
 		return "", err
 	}
+	otpSent.Inc("sign_in")
 
 	return code, nil
 }
@@ -0,0 +1,382 @@
+package services
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// A4 page size in PDF points
+const (
+	pdfPageWidth  = 595.0
+	pdfPageHeight = 842.0
+)
+
+// pdfFont is a TrueType font embedded into generated PDFs. The PDF standard fonts have no Cyrillic
+// glyphs, so documents carry their own font.
+type pdfFont struct {
+	data                       []byte
+	unitsPerEm                 int
+	ascent, descent, capHeight int
+	bbox                       [4]int
+	glyphs                     map[rune]uint16
+	advances                   []uint16
+}
+
+// fontReader reads big-endian font data, remembering the first out-of-range read
+type fontReader struct {
+	data []byte
+	err  error
+}
+
+func (r *fontReader) u16(off int) uint16 {
+	if off < 0 || off+2 > len(r.data) {
+		r.err = fmt.Errorf("font data truncated")
+		return 0
+	}
+	return uint16(r.data[off])<<8 | uint16(r.data[off+1])
+}
+
+func (r *fontReader) i16(off int) int {
+	return int(int16(r.u16(off)))
+}
+
+func (r *fontReader) u32(off int) uint32 {
+	return uint32(r.u16(off))<<16 | uint32(r.u16(off+2))
+}
+
+// loadPDFFont reads a TrueType (.ttf) font file
+func loadPDFFont(path string) (*pdfFont, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read font: %v", err)
+	}
+	return parsePDFFont(data)
+}
+
+// parsePDFFont reads the metrics and character map of a TrueType font
+func parsePDFFont(data []byte) (*pdfFont, error) {
+	r := &fontReader{data: data}
+	if version := r.u32(0); version != 0x00010000 && version != 0x74727565 {
+		return nil, fmt.Errorf("unsupported font; only TrueType outlines can be embedded")
+	}
+
+	tables := make(map[string]int)
+	numTables := int(r.u16(4))
+	for i := 0; i < numTables; i++ {
+		rec := 12 + 16*i
+		if rec+16 > len(data) {
+			return nil, fmt.Errorf("font data truncated")
+		}
+		tables[string(data[rec:rec+4])] = int(r.u32(rec + 8))
+	}
+	for _, tag := range []string{"head", "hhea", "maxp", "hmtx", "cmap"} {
+		if _, ok := tables[tag]; !ok {
+			return nil, fmt.Errorf("font has no %s table", tag)
+		}
+	}
+
+	f := &pdfFont{data: data}
+	head, hhea := tables["head"], tables["hhea"]
+	f.unitsPerEm = int(r.u16(head + 18))
+	f.bbox = [4]int{r.i16(head + 36), r.i16(head + 38), r.i16(head + 40), r.i16(head + 42)}
+	f.ascent, f.descent = r.i16(hhea+4), r.i16(hhea+6)
+	f.capHeight = f.ascent
+	if os2, ok := tables["OS/2"]; ok && r.u16(os2) >= 2 {
+		f.capHeight = r.i16(os2 + 88)
+	}
+	if f.unitsPerEm == 0 {
+		return nil, fmt.Errorf("font has no units per em")
+	}
+
+	numGlyphs := int(r.u16(tables["maxp"] + 4))
+	numMetrics := int(r.u16(hhea + 34))
+	f.advances = make([]uint16, numGlyphs)
+	for g := 0; g < numGlyphs; g++ {
+		if g < numMetrics {
+			f.advances[g] = r.u16(tables["hmtx"] + 4*g)
+		} else if g > 0 {
+			f.advances[g] = f.advances[g-1]
+		}
+	}
+
+	glyphs, err := parseCmap(r, tables["cmap"], numGlyphs)
+	if err != nil {
+		return nil, err
+	}
+	f.glyphs = glyphs
+	if r.err != nil {
+		return nil, r.err
+	}
+	return f, nil
+}
+
+// parseCmap reads the Unicode character map of a font from its format 12 or format 4 subtable
+func parseCmap(r *fontReader, cmap, numGlyphs int) (map[rune]uint16, error) {
+	var format4, format12 int
+	numTables := int(r.u16(cmap + 2))
+	for i := 0; i < numTables; i++ {
+		rec := cmap + 4 + 8*i
+		platform, encoding := r.u16(rec), r.u16(rec+2)
+		sub := cmap + int(r.u32(rec+4))
+		switch {
+		case r.u16(sub) == 12 && (platform == 0 || platform == 3 && encoding == 10):
+			format12 = sub
+		case r.u16(sub) == 4 && (platform == 0 || platform == 3 && encoding == 1):
+			format4 = sub
+		}
+	}
+
+	glyphs := make(map[rune]uint16)
+	switch {
+	case format12 != 0:
+		groups := int(r.u32(format12 + 12))
+		for i := 0; i < groups && r.err == nil; i++ {
+			group := format12 + 16 + 12*i
+			start, end, glyph := r.u32(group), r.u32(group+4), r.u32(group+8)
+			if end > 0x10FFFF || end < start {
+				continue
+			}
+			for c := start; c <= end; c++ {
+				if g := glyph + c - start; g < uint32(numGlyphs) {
+					glyphs[rune(c)] = uint16(g)
+				}
+			}
+		}
+	case format4 != 0:
+		segCount := int(r.u16(format4+6)) / 2
+		ends := format4 + 14
+		starts := ends + 2*segCount + 2
+		deltas := starts + 2*segCount
+		rangeOffsets := deltas + 2*segCount
+		for i := 0; i < segCount && r.err == nil; i++ {
+			start, end := int(r.u16(starts+2*i)), int(r.u16(ends+2*i))
+			delta := int(r.u16(deltas + 2*i))
+			rangeOffset := int(r.u16(rangeOffsets + 2*i))
+			for c := start; c <= end && c != 0xFFFF; c++ {
+				g := 0
+				if rangeOffset == 0 {
+					g = (c + delta) & 0xFFFF
+				} else if g = int(r.u16(rangeOffsets + 2*i + rangeOffset + 2*(c-start))); g != 0 {
+					g = (g + delta) & 0xFFFF
+				}
+				if g != 0 && g < numGlyphs {
+					glyphs[rune(c)] = uint16(g)
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("font has no Unicode character map")
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return glyphs, nil
+}
+
+// scaled converts font units to the 1000-unit glyph space of PDF
+func (f *pdfFont) scaled(v int) int {
+	return v * 1000 / f.unitsPerEm
+}
+
+// pdfWriter lays out text and rules on A4 pages; coordinates are in points from the top left corner
+type pdfWriter struct {
+	font  *pdfFont
+	pages []*bytes.Buffer
+	used  map[uint16]rune
+}
+
+func newPDFWriter(font *pdfFont) *pdfWriter {
+	w := &pdfWriter{font: font, used: make(map[uint16]rune)}
+	w.addPage()
+	return w
+}
+
+// addPage starts a new page; further drawing goes to it
+func (w *pdfWriter) addPage() {
+	w.pages = append(w.pages, &bytes.Buffer{})
+}
+
+func (w *pdfWriter) page() *bytes.Buffer {
+	return w.pages[len(w.pages)-1]
+}
+
+// textWidth returns the width of s set at size points
+func (w *pdfWriter) textWidth(s string, size float64) float64 {
+	var units int
+	for _, c := range s {
+		g := w.font.glyphs[c]
+		if int(g) < len(w.font.advances) {
+			units += int(w.font.advances[g])
+		}
+	}
+	return float64(units) * size / float64(w.font.unitsPerEm)
+}
+
+// text draws s with its baseline at y
+func (w *pdfWriter) text(x, y, size float64, s string) {
+	var hex strings.Builder
+	for _, c := range s {
+		g := w.font.glyphs[c]
+		if _, ok := w.used[g]; !ok && g != 0 {
+			w.used[g] = c
+		}
+		fmt.Fprintf(&hex, "%04X", g)
+	}
+	fmt.Fprintf(w.page(), "BT /F1 %s Tf %s %s Td <%s> Tj ET\n",
+		pdfNumber(size), pdfNumber(x), pdfNumber(pdfPageHeight-y), hex.String())
+}
+
+// textRight draws s ending at x
+func (w *pdfWriter) textRight(x, y, size float64, s string) {
+	w.text(x-w.textWidth(s, size), y, size, s)
+}
+
+// wrap splits s into lines no wider than width at size points, breaking between words
+func (w *pdfWriter) wrap(s string, size, width float64) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(s) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if line != "" && w.textWidth(candidate, size) > width {
+			lines = append(lines, line)
+			candidate = word
+		}
+		line = candidate
+	}
+	if line != "" || len(lines) == 0 {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// rule draws a horizontal line at y
+func (w *pdfWriter) rule(x1, x2, y float64) {
+	fmt.Fprintf(w.page(), "0.5 w %s %s m %s %s l S\n",
+		pdfNumber(x1), pdfNumber(pdfPageHeight-y), pdfNumber(x2), pdfNumber(pdfPageHeight-y))
+}
+
+// bytes assembles the PDF file
+func (w *pdfWriter) bytes() ([]byte, error) {
+	var objects [][]byte
+	add := func(obj string) int {
+		objects = append(objects, []byte(obj))
+		return len(objects)
+	}
+	addStream := func(dict string, data []byte) (int, error) {
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		if _, err := zw.Write(data); err != nil {
+			return 0, fmt.Errorf("failed to compress pdf stream: %v", err)
+		}
+		if err := zw.Close(); err != nil {
+			return 0, fmt.Errorf("failed to compress pdf stream: %v", err)
+		}
+		obj := fmt.Sprintf("<< %s /Filter /FlateDecode /Length %d >>\nstream\n", dict, compressed.Len())
+		objects = append(objects, append(append([]byte(obj), compressed.Bytes()...), "\nendstream"...))
+		return len(objects), nil
+	}
+
+	f := w.font
+	catalog := add("") // filled in once the page tree is known
+	pagesID := add("")
+	fontFile, err := addStream(fmt.Sprintf("/Length1 %d", len(f.data)), f.data)
+	if err != nil {
+		return nil, err
+	}
+	descriptor := add(fmt.Sprintf("<< /Type /FontDescriptor /FontName /DocumentFont /Flags 32 /FontBBox [%d %d %d %d] "+
+		"/ItalicAngle 0 /Ascent %d /Descent %d /CapHeight %d /StemV 80 /FontFile2 %d 0 R >>",
+		f.scaled(f.bbox[0]), f.scaled(f.bbox[1]), f.scaled(f.bbox[2]), f.scaled(f.bbox[3]),
+		f.scaled(f.ascent), f.scaled(f.descent), f.scaled(f.capHeight), fontFile))
+
+	glyphs := make([]int, 0, len(w.used))
+	for g := range w.used {
+		glyphs = append(glyphs, int(g))
+	}
+	sort.Ints(glyphs)
+	var widths strings.Builder
+	for _, g := range glyphs {
+		fmt.Fprintf(&widths, "%d [%d] ", g, f.scaled(int(f.advances[g])))
+	}
+	cidFont := add(fmt.Sprintf("<< /Type /Font /Subtype /CIDFontType2 /BaseFont /DocumentFont "+
+		"/CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >> "+
+		"/FontDescriptor %d 0 R /W [%s] /CIDToGIDMap /Identity >>", descriptor, widths.String()))
+	toUnicode, err := addStream("", toUnicodeCMap(glyphs, w.used))
+	if err != nil {
+		return nil, err
+	}
+	font := add(fmt.Sprintf("<< /Type /Font /Subtype /Type0 /BaseFont /DocumentFont /Encoding /Identity-H "+
+		"/DescendantFonts [%d 0 R] /ToUnicode %d 0 R >>", cidFont, toUnicode))
+
+	var kids []string
+	for _, page := range w.pages {
+		content, err := addStream("", page.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		pageID := add(fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %s %s] "+
+			"/Resources << /Font << /F1 %d 0 R >> >> /Contents %d 0 R >>",
+			pagesID, pdfNumber(pdfPageWidth), pdfNumber(pdfPageHeight), font, content))
+		kids = append(kids, fmt.Sprintf("%d 0 R", pageID))
+	}
+	objects[catalog-1] = []byte(fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pagesID))
+	objects[pagesID-1] = []byte(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids)))
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n", i+1)
+		out.Write(obj)
+		out.WriteString("\nendobj\n")
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, catalog, xref)
+	return out.Bytes(), nil
+}
+
+// toUnicodeCMap maps the glyphs used in a document back to their characters, so that text can be
+// searched and copied
+func toUnicodeCMap(glyphs []int, used map[uint16]rune) []byte {
+	var b bytes.Buffer
+	b.WriteString("/CIDInit /ProcSet findresource begin\n12 dict begin\nbegincmap\n" +
+		"/CIDSystemInfo << /Registry (Adobe) /Ordering (UCS) /Supplement 0 >> def\n" +
+		"/CMapName /Adobe-Identity-UCS def\n/CMapType 2 def\n" +
+		"1 begincodespacerange\n<0000> <FFFF>\nendcodespacerange\n")
+	// A bfchar block holds at most 100 mappings
+	for start := 0; start < len(glyphs); start += 100 {
+		end := start + 100
+		if end > len(glyphs) {
+			end = len(glyphs)
+		}
+		fmt.Fprintf(&b, "%d beginbfchar\n", end-start)
+		for _, g := range glyphs[start:end] {
+			var units strings.Builder
+			for _, u := range utf16.Encode([]rune{used[uint16(g)]}) {
+				fmt.Fprintf(&units, "%04X", u)
+			}
+			fmt.Fprintf(&b, "<%04X> <%s>\n", g, units.String())
+		}
+		b.WriteString("endbfchar\n")
+	}
+	b.WriteString("endcmap\nCMapName currentdict /CMap defineresource pop\nend\nend\n")
+	return b.Bytes()
+}
+
+// pdfNumber formats a coordinate or size without superfluous digits
+func pdfNumber(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,191 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"strings"
+	"time"
+
+	"Dowlet_projects/ecommerce/models"
+)
+
+// Phone change codes
+const (
+	phoneChangePurpose     = "phone_change"
+	phoneChangeCodeTTL     = 5 * time.Minute
+	maxPhoneChangeAttempts = 5
+)
+
+// SetSMSSender replaces the SMS sender; the default only logs messages
+func (s *DBService) SetSMSSender(sender SMSSender) {
+	s.sms = sender
+}
+
+// RequestPhoneChange sends a verification code to the number a user wants to switch to. Only the
+// user's latest request can be confirmed.
+func (s *DBService) RequestPhoneChange(ctx context.Context, userID int, phone string) error {
+	ctx, span := tracer.Start(ctx, "DBService.RequestPhoneChange")
+	defer span.End()
+	var current string
+	err := s.db.QueryRowContext(ctx, "SELECT phone FROM users WHERE id = ?", userID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query user: %v", err)
+	}
+	if current == phone {
+		return ErrPhoneUnchanged
+	}
+	if err := s.checkPhoneAvailable(ctx, s.db, userID, phone); err != nil {
+		return err
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(10000))
+	if err != nil {
+		return fmt.Errorf("failed to generate code: %v", err)
+	}
+	code := fmt.Sprintf("%04d", n)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM verification_codes WHERE user_id = ? AND purpose = ?", userID, phoneChangePurpose); err != nil {
+		return fmt.Errorf("failed to clear previous codes: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO verification_codes (phone, purpose, user_id, code, expires_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		phone, phoneChangePurpose, userID, code, time.Now().Add(phoneChangeCodeTTL)); err != nil {
+		return fmt.Errorf("failed to store code: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	text := fmt.Sprintf("Код подтверждения нового номера: %s / Your new phone number verification code: %s", code, code)
+	if err := s.sms.SendSMS(ctx, phone, text); err != nil {
+		return fmt.Errorf("failed to send code: %v", err)
+	}
+	otpSent.Inc("phone_change")
+	return nil
+}
+
+// ConfirmPhoneChange switches a user to the number a code was sent to. Wrong codes count towards
+// maxPhoneChangeAttempts, after which the change has to be requested again. With notifyOld the
+// previous number is told about the change.
+func (s *DBService) ConfirmPhoneChange(ctx context.Context, userID int, phone, code string, notifyOld bool) (models.UserProfile, error) {
+	ctx, span := tracer.Start(ctx, "DBService.ConfirmPhoneChange")
+	defer span.End()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return models.UserProfile{}, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var codeID, attempts int
+	var storedCode, expiresAtStr string
+	err = tx.QueryRowContext(ctx, `
+		SELECT id, code, expires_at, attempts FROM verification_codes
+		WHERE phone = ? AND purpose = ? AND user_id = ?
+		FOR UPDATE`,
+		phone, phoneChangePurpose, userID,
+	).Scan(&codeID, &storedCode, &expiresAtStr, &attempts)
+	if err == sql.ErrNoRows {
+		return models.UserProfile{}, ErrNoPhoneChange
+	}
+	if err != nil {
+		return models.UserProfile{}, fmt.Errorf("failed to query verification code: %v", err)
+	}
+	expiresAt, err := time.Parse("2006-01-02 15:04:05", expiresAtStr)
+	if err != nil {
+		return models.UserProfile{}, fmt.Errorf("failed to parse expires_at: %v", err)
+	}
+
+	if time.Now().After(expiresAt) || attempts >= maxPhoneChangeAttempts {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM verification_codes WHERE id = ?", codeID); err != nil {
+			return models.UserProfile{}, fmt.Errorf("failed to clear verification code: %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return models.UserProfile{}, fmt.Errorf("failed to commit transaction: %v", err)
+		}
+		if attempts >= maxPhoneChangeAttempts {
+			return models.UserProfile{}, ErrTooManyAttempts
+		}
+		return models.UserProfile{}, ErrVerificationCodeExpired
+	}
+	if storedCode != code {
+		if _, err := tx.ExecContext(ctx, "UPDATE verification_codes SET attempts = attempts + 1 WHERE id = ?", codeID); err != nil {
+			return models.UserProfile{}, fmt.Errorf("failed to count attempt: %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return models.UserProfile{}, fmt.Errorf("failed to commit transaction: %v", err)
+		}
+		return models.UserProfile{}, ErrInvalidVerificationCode
+	}
+
+	var profile models.UserProfile
+	var oldPhone string
+	err = tx.QueryRowContext(ctx, "SELECT id, COALESCE(full_name, ''), phone FROM users WHERE id = ? FOR UPDATE", userID).
+		Scan(&profile.ID, &profile.FullName, &oldPhone)
+	if err == sql.ErrNoRows {
+		return models.UserProfile{}, ErrUserNotFound
+	}
+	if err != nil {
+		return models.UserProfile{}, fmt.Errorf("failed to query user: %v", err)
+	}
+	// The number may have been registered since the code was sent
+	if err := s.checkPhoneAvailable(ctx, tx, userID, phone); err != nil {
+		return models.UserProfile{}, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET phone = ?, verified = 1 WHERE id = ?", phone, userID); err != nil {
+		if strings.Contains(err.Error(), "Duplicate entry") {
+			return models.UserProfile{}, ErrPhoneRegistered
+		}
+		return models.UserProfile{}, fmt.Errorf("failed to update phone: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM verification_codes WHERE id = ?", codeID); err != nil {
+		return models.UserProfile{}, fmt.Errorf("failed to clear verification code: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return models.UserProfile{}, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	profile.Phone = phone
+
+	if notifyOld && oldPhone != "" {
+		text := fmt.Sprintf("Номер телефона вашего аккаунта изменён на %s. Если это были не вы, обратитесь в поддержку. / "+
+			"Your account phone number was changed to %s. If this wasn't you, contact support.", maskPhone(phone), maskPhone(phone))
+		if err := s.sms.SendSMS(ctx, oldPhone, text); err != nil {
+			slog.ErrorContext(ctx, "Failed to notify previous phone", "user_id", userID, "error", err)
+		}
+	}
+	return profile, nil
+}
+
+// checkPhoneAvailable fails when another user already has the number
+func (s *DBService) checkPhoneAvailable(ctx context.Context, q execer, userID int, phone string) error {
+	var taken bool
+	err := q.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE phone = ? AND id <> ?)", phone, userID).Scan(&taken)
+	if err != nil {
+		return fmt.Errorf("failed to check phone: %v", err)
+	}
+	if taken {
+		return ErrPhoneRegistered
+	}
+	return nil
+}
+
+// maskPhone hides all but the last four digits of a phone number
+func maskPhone(phone string) string {
+	if len(phone) <= 4 {
+		return phone
+	}
+	return strings.Repeat("*", len(phone)-4) + phone[len(phone)-4:]
+}
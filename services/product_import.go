@@ -0,0 +1,1084 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"Dowlet_projects/ecommerce/models"
+)
+
+// productImportColumns is the column layout shared by product imports and exports.
+// One row describes one variant (a color and size of a product); product columns repeat on every row
+// and are read from the first row of each product.
+var productImportColumns = []string{
+	"product_id", "name", "name_ru", "category_id", "price", "discount", "description", "description_ru",
+	"is_active", "image", "sku", "barcode", "color", "color_ru", "color_image", "size", "variant_price",
+	"compare_at_price", "stock", "options",
+}
+
+const (
+	// maxImportRows caps the number of data rows in a single import file
+	maxImportRows = 5000
+	// maxImportImageSize caps each image downloaded or extracted during an import
+	maxImportImageSize = 10 << 20
+	// productImportTimeout bounds how long a single import job may run
+	productImportTimeout = 30 * time.Minute
+	// importStorageDir holds uploaded import files until their job has run; it must not be publicly served
+	importStorageDir = "storage/imports"
+)
+
+// importLine is a validated data row of an import file
+type importLine struct {
+	row           int
+	productID     int
+	name          string
+	nameRu        string
+	description   string
+	descriptionRu string
+	categoryID    int
+	price         *float64
+	discount      *float64
+	isActive      *bool
+	image         string
+	sku           string
+	barcode       string
+	color         string
+	colorRu       string
+	colorImage    string
+	size          string
+	variantPrice  *float64
+	compareAt     *float64
+	stock         *int
+	options       []models.VariantAttributeInput
+	// existingVariantID is set when the row's SKU matches a variant of the market
+	existingVariantID int
+}
+
+// hasVariant reports whether the row describes a variant rather than only product fields
+func (l importLine) hasVariant() bool {
+	return l.sku != "" || l.color != "" || l.size != ""
+}
+
+// importProduct groups the rows describing one product
+type importProduct struct {
+	lines []importLine
+}
+
+// importPlan is the validated content of an import file
+type importPlan struct {
+	totalRows int
+	products  []*importProduct
+	preview   []models.ImportPreviewItem
+}
+
+// importImages resolves image references of an import file into upload URLs
+type importImages struct {
+	archive  map[string]*zip.File
+	resolved map[string]string
+	saved    []string
+	client   *http.Client
+}
+
+// StartProductImport records an import job and queues it for the background workers.
+// The uploaded files are kept in importStorageDir until the job has finished.
+func (s *DBService) StartProductImport(ctx context.Context, marketID, staffID int, fileName string, data, imagesZip []byte, dryRun bool) (int, error) {
+	ctx, span := tracer.Start(ctx, "DBService.StartProductImport")
+	defer span.End()
+	switch strings.ToLower(path.Ext(fileName)) {
+	case ".csv", ".xlsx":
+	default:
+		return 0, ErrUnsupportedFileFormat
+	}
+	if len(imagesZip) > 0 {
+		if _, err := zip.NewReader(bytes.NewReader(imagesZip), int64(len(imagesZip))); err != nil {
+			return 0, ErrInvalidImagesArchive
+		}
+	}
+
+	var staff interface{}
+	if staffID != 0 {
+		staff = staffID
+	}
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO product_import_jobs (market_id, staff_id, file_name, dry_run, status)
+		VALUES (?, ?, ?, ?, ?)`,
+		marketID, staff, fileName, dryRun, models.ImportStatusQueued)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create import job: %v", err)
+	}
+	importID, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve import job ID: %v", err)
+	}
+
+	dir := importJobDir(int(importID))
+	failed := func(err error) (int, error) {
+		os.RemoveAll(dir)
+		s.db.ExecContext(ctx, "DELETE FROM product_import_jobs WHERE id = ?", importID)
+		return 0, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return failed(fmt.Errorf("failed to store import file: %v", err))
+	}
+	if err := os.WriteFile(filepath.Join(dir, "data"), data, 0600); err != nil {
+		return failed(fmt.Errorf("failed to store import file: %v", err))
+	}
+	if len(imagesZip) > 0 {
+		if err := os.WriteFile(filepath.Join(dir, "images.zip"), imagesZip, 0600); err != nil {
+			return failed(fmt.Errorf("failed to store images archive: %v", err))
+		}
+	}
+
+	payload := productImportPayload{ImportID: int(importID), MarketID: marketID, FileName: fileName, DryRun: dryRun}
+	if _, err := s.EnqueueJob(ctx, JobTypeProductImport, payload, marketID); err != nil {
+		return failed(err)
+	}
+
+	return int(importID), nil
+}
+
+// GetProductImportJob retrieves an import job of a market
+func (s *DBService) GetProductImportJob(ctx context.Context, marketID, jobID int) (models.ProductImportJob, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetProductImportJob")
+	defer span.End()
+	var job models.ProductImportJob
+	var errorsJSON, previewJSON, finishedAt sql.NullString
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, market_id, file_name, dry_run, status, total_rows, products_created, products_updated,
+			variants_created, variants_updated, errors, preview, created_at, finished_at
+		FROM product_import_jobs
+		WHERE id = ? AND market_id = ?`, jobID, marketID).
+		Scan(&job.ID, &job.MarketID, &job.FileName, &job.DryRun, &job.Status, &job.TotalRows,
+			&job.ProductsCreated, &job.ProductsUpdated, &job.VariantsCreated, &job.VariantsUpdated,
+			&errorsJSON, &previewJSON, &job.CreatedAt, &finishedAt)
+	if err == sql.ErrNoRows {
+		return models.ProductImportJob{}, ErrImportJobNotFound
+	}
+	if err != nil {
+		return models.ProductImportJob{}, fmt.Errorf("failed to fetch import job: %v", err)
+	}
+
+	job.Errors = []models.ImportRowError{}
+	if errorsJSON.Valid && errorsJSON.String != "" {
+		if err := json.Unmarshal([]byte(errorsJSON.String), &job.Errors); err != nil {
+			return models.ProductImportJob{}, fmt.Errorf("failed to decode import errors: %v", err)
+		}
+	}
+	if previewJSON.Valid && previewJSON.String != "" {
+		if err := json.Unmarshal([]byte(previewJSON.String), &job.Preview); err != nil {
+			return models.ProductImportJob{}, fmt.Errorf("failed to decode import preview: %v", err)
+		}
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.String
+	}
+	return job, nil
+}
+
+// productImportPayload is the job payload of a product import
+type productImportPayload struct {
+	ImportID int    `json:"import_id"`
+	MarketID int    `json:"market_id"`
+	FileName string `json:"file_name"`
+	DryRun   bool   `json:"dry_run"`
+}
+
+// importJobDir is where the files of an import wait for the worker
+func importJobDir(importID int) string {
+	return filepath.Join(importStorageDir, strconv.Itoa(importID))
+}
+
+// handleProductImportJob is the job handler processing a queued product import.
+// Internal errors are returned so that the queue retries them; the outcome is recorded on the last attempt.
+func (s *DBService) handleProductImportJob(ctx context.Context, queued models.Job) error {
+	var payload productImportPayload
+	if err := json.Unmarshal(queued.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid product import payload: %v", err)
+	}
+	lastAttempt := queued.Attempts >= queued.MaxAttempts
+	dir := importJobDir(payload.ImportID)
+
+	job := models.ProductImportJob{Status: models.ImportStatusCompleted}
+	var rowErrors []models.ImportRowError
+	data, err := os.ReadFile(filepath.Join(dir, "data"))
+	if os.IsNotExist(err) {
+		// The files are removed once an outcome is recorded, e.g. when a finished job is retried by hand
+		rowErrors = []models.ImportRowError{{Message: "import file is no longer available"}}
+		err = nil
+	} else if err == nil {
+		var imagesZip []byte
+		imagesZip, err = os.ReadFile(filepath.Join(dir, "images.zip"))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		if err == nil {
+			if _, err := s.db.ExecContext(ctx, "UPDATE product_import_jobs SET status = ? WHERE id = ?", models.ImportStatusRunning, payload.ImportID); err != nil {
+				slog.ErrorContext(ctx, "Failed to mark import job as running", "import_id", payload.ImportID, "error", err)
+			}
+			rowErrors, err = s.importProducts(ctx, payload.MarketID, payload.FileName, data, imagesZip, payload.DryRun, &job)
+		}
+	}
+
+	if err != nil {
+		if !lastAttempt {
+			s.db.ExecContext(ctx, "UPDATE product_import_jobs SET status = ? WHERE id = ?", models.ImportStatusQueued, payload.ImportID)
+			return err
+		}
+		slog.ErrorContext(ctx, "Import job failed", "import_id", payload.ImportID, "error", err)
+		rowErrors = append(rowErrors, models.ImportRowError{Message: "import failed due to an internal error"})
+	}
+
+	s.recordProductImportOutcome(ctx, payload.ImportID, payload.DryRun, job, rowErrors)
+	if rmErr := os.RemoveAll(dir); rmErr != nil {
+		slog.WarnContext(ctx, "Failed to delete import files", "dir", dir, "error", rmErr)
+	}
+	return err
+}
+
+// recordProductImportOutcome stores the final status, counters, errors and preview of an import
+func (s *DBService) recordProductImportOutcome(ctx context.Context, importID int, dryRun bool, job models.ProductImportJob, rowErrors []models.ImportRowError) {
+	if len(rowErrors) > 0 {
+		job.Status = models.ImportStatusFailed
+		if !dryRun {
+			job.ProductsCreated, job.ProductsUpdated, job.VariantsCreated, job.VariantsUpdated = 0, 0, 0, 0
+		}
+	} else {
+		rowErrors = []models.ImportRowError{}
+	}
+
+	errorsJSON, err := json.Marshal(rowErrors)
+	if err != nil {
+		slog.Error("Failed to encode import job errors", "import_id", importID, "error", err)
+		errorsJSON = []byte("[]")
+	}
+	var previewJSON interface{}
+	if job.Preview != nil {
+		encoded, err := json.Marshal(job.Preview)
+		if err != nil {
+			slog.Error("Failed to encode import job preview", "import_id", importID, "error", err)
+		} else {
+			previewJSON = string(encoded)
+		}
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+		UPDATE product_import_jobs
+		SET status = ?, total_rows = ?, products_created = ?, products_updated = ?, variants_created = ?,
+			variants_updated = ?, errors = ?, preview = ?, finished_at = CURRENT_TIMESTAMP
+		WHERE id = ?`,
+		job.Status, job.TotalRows, job.ProductsCreated, job.ProductsUpdated, job.VariantsCreated,
+		job.VariantsUpdated, string(errorsJSON), previewJSON, importID)
+	if err != nil {
+		slog.Error("Failed to record import job outcome", "import_id", importID, "error", err)
+	}
+}
+
+// importProducts validates an import file and, unless dryRun is set, applies it in a single transaction.
+// Nothing is written when any row is invalid. Counters and the preview are filled into job.
+func (s *DBService) importProducts(ctx context.Context, marketID int, fileName string, data, imagesZip []byte, dryRun bool, job *models.ProductImportJob) ([]models.ImportRowError, error) {
+	rows, err := readSpreadsheet(fileName, data)
+	if err != nil {
+		return []models.ImportRowError{{Message: err.Error()}}, nil
+	}
+
+	images := &importImages{
+		resolved: make(map[string]string),
+		client:   &http.Client{Timeout: 15 * time.Second},
+	}
+	if len(imagesZip) > 0 {
+		archive, err := zip.NewReader(bytes.NewReader(imagesZip), int64(len(imagesZip)))
+		if err != nil {
+			return []models.ImportRowError{{Message: "invalid images archive"}}, nil
+		}
+		images.archive = make(map[string]*zip.File, len(archive.File))
+		for _, f := range archive.File {
+			if !f.FileInfo().IsDir() {
+				images.archive[strings.ToLower(path.Base(f.Name))] = f
+			}
+		}
+	}
+
+	plan, rowErrors, err := s.planProductImport(ctx, marketID, rows, images)
+	if err != nil {
+		return nil, err
+	}
+	job.TotalRows = plan.totalRows
+	job.Preview = plan.preview
+	for _, item := range plan.preview {
+		if item.Action == "create" {
+			job.ProductsCreated++
+		} else {
+			job.ProductsUpdated++
+		}
+		job.VariantsCreated += item.VariantsCreated
+		job.VariantsUpdated += item.VariantsUpdated
+	}
+	if len(rowErrors) > 0 || dryRun {
+		return rowErrors, nil
+	}
+
+	if rowErrors := images.resolveAll(ctx, plan); len(rowErrors) > 0 {
+		images.cleanup()
+		return rowErrors, nil
+	}
+
+	if err := s.applyProductImport(ctx, marketID, plan, images); err != nil {
+		images.cleanup()
+		return nil, err
+	}
+
+	s.invalidateMarketProductCaches(ctx, marketID)
+	return nil, nil
+}
+
+// planProductImport parses and validates the rows of an import file against the market's catalog
+func (s *DBService) planProductImport(ctx context.Context, marketID int, rows [][]string, images *importImages) (*importPlan, []models.ImportRowError, error) {
+	var rowErrors []models.ImportRowError
+	if len(rows) == 0 {
+		return &importPlan{}, []models.ImportRowError{{Row: 1, Message: "file is empty"}}, nil
+	}
+
+	columns := make(map[string]int)
+	for i, name := range rows[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	_, hasProductID := columns["product_id"]
+	_, hasName := columns["name"]
+	if !hasProductID && !hasName {
+		return &importPlan{}, []models.ImportRowError{{Row: 1, Message: "header must contain a product_id or name column"}}, nil
+	}
+
+	categories, err := s.marketCategoryIDs(ctx, marketID)
+	if err != nil {
+		return nil, nil, err
+	}
+	marketProducts := make(map[int]bool)
+	if err := collectIDs(ctx, s.db, marketProducts, "SELECT id FROM products WHERE market_id = ?", marketID); err != nil {
+		return nil, nil, err
+	}
+
+	type skuOwner struct{ variantID, productID int }
+	marketSKUs := make(map[string]skuOwner)
+	skuRows, err := s.db.QueryContext(ctx, `
+		SELECT v.sku, v.id, v.product_id
+		FROM product_variants v
+		JOIN products p ON v.product_id = p.id
+		WHERE p.market_id = ?`, marketID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query skus: %v", err)
+	}
+	for skuRows.Next() {
+		var sku string
+		var owner skuOwner
+		if err := skuRows.Scan(&sku, &owner.variantID, &owner.productID); err != nil {
+			skuRows.Close()
+			return nil, nil, fmt.Errorf("failed to scan sku: %v", err)
+		}
+		marketSKUs[strings.ToLower(sku)] = owner
+	}
+	skuRows.Close()
+	if err := skuRows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error iterating skus: %v", err)
+	}
+
+	plan := &importPlan{}
+	groups := make(map[string]*importProduct)
+	fileSKUs := make(map[string]int)
+
+	for i, cells := range rows[1:] {
+		rowNum := i + 2
+		get := func(column string) string {
+			idx, ok := columns[column]
+			if !ok || idx >= len(cells) {
+				return ""
+			}
+			return strings.TrimSpace(cells[idx])
+		}
+		blank := true
+		for _, c := range cells {
+			if strings.TrimSpace(c) != "" {
+				blank = false
+				break
+			}
+		}
+		if blank {
+			continue
+		}
+
+		plan.totalRows++
+		if plan.totalRows > maxImportRows {
+			rowErrors = append(rowErrors, models.ImportRowError{Row: rowNum, Message: fmt.Sprintf("file has more than %d rows", maxImportRows)})
+			break
+		}
+
+		fail := func(column, message string) {
+			rowErrors = append(rowErrors, models.ImportRowError{Row: rowNum, Column: column, Message: message})
+		}
+		line := importLine{
+			row:           rowNum,
+			name:          get("name"),
+			nameRu:        get("name_ru"),
+			description:   get("description"),
+			descriptionRu: get("description_ru"),
+			image:         get("image"),
+			sku:           get("sku"),
+			barcode:       get("barcode"),
+			color:         get("color"),
+			colorRu:       get("color_ru"),
+			colorImage:    get("color_image"),
+			size:          get("size"),
+		}
+		if v := get("product_id"); v != "" {
+			id, err := strconv.Atoi(v)
+			if err != nil || id < 1 {
+				fail("product_id", "invalid product ID")
+			} else if !marketProducts[id] {
+				fail("product_id", "product not found or unauthorized")
+			} else {
+				line.productID = id
+			}
+		}
+		if v := get("category_id"); v != "" {
+			id, err := strconv.Atoi(v)
+			if err != nil || !categories[id] {
+				fail("category_id", "category not found or not assigned to this market")
+			} else {
+				line.categoryID = id
+			}
+		}
+		line.price = parseImportFloat(get("price"), "price", fail)
+		line.discount = parseImportFloat(get("discount"), "discount", fail)
+		if line.discount != nil && *line.discount > 100 {
+			fail("discount", "discount must be between 0 and 100")
+		}
+		line.variantPrice = parseImportFloat(get("variant_price"), "variant_price", fail)
+		line.compareAt = parseImportFloat(get("compare_at_price"), "compare_at_price", fail)
+		if v := get("stock"); v != "" {
+			stock, err := strconv.Atoi(v)
+			if err != nil {
+				if f, ferr := strconv.ParseFloat(v, 64); ferr == nil && f == float64(int(f)) {
+					stock, err = int(f), nil
+				}
+			}
+			if err != nil || stock < 0 {
+				fail("stock", "stock must be a non-negative integer")
+			} else {
+				line.stock = &stock
+			}
+		}
+		if v := get("is_active"); v != "" {
+			active, err := parseImportBool(v)
+			if err != nil {
+				fail("is_active", "is_active must be true or false")
+			} else {
+				line.isActive = &active
+			}
+		}
+		if v := get("options"); v != "" {
+			options, err := parseImportOptions(v)
+			if err != nil {
+				fail("options", err.Error())
+			} else {
+				line.options = options
+			}
+		}
+		for _, ref := range []struct{ column, value string }{{"image", line.image}, {"color_image", line.colorImage}} {
+			if ref.value != "" {
+				if err := images.check(ref.value); err != nil {
+					fail(ref.column, err.Error())
+				}
+			}
+		}
+
+		if line.sku != "" {
+			key := strings.ToLower(line.sku)
+			if first, dup := fileSKUs[key]; dup {
+				fail("sku", fmt.Sprintf("sku already used on row %d", first))
+			} else {
+				fileSKUs[key] = rowNum
+			}
+			if owner, ok := marketSKUs[key]; ok {
+				if line.productID != 0 && owner.productID != line.productID {
+					fail("sku", "sku belongs to another product")
+				} else if line.productID == 0 && line.name != "" {
+					// A new product cannot take over an existing SKU
+					fail("sku", "sku already exists")
+				} else {
+					line.existingVariantID = owner.variantID
+					line.productID = owner.productID
+				}
+			}
+		}
+		if line.hasVariant() && line.existingVariantID == 0 {
+			if line.color == "" {
+				fail("color", "color is required for a new variant")
+			}
+			if line.size == "" {
+				fail("size", "size is required for a new variant")
+			}
+		}
+
+		key := "name:" + strings.ToLower(line.name)
+		if line.productID != 0 {
+			key = fmt.Sprintf("id:%d", line.productID)
+		} else if line.name == "" {
+			fail("name", "name is required for a new product")
+			continue
+		}
+		group, ok := groups[key]
+		if !ok {
+			group = &importProduct{}
+			groups[key] = group
+			plan.products = append(plan.products, group)
+		}
+		group.lines = append(group.lines, line)
+	}
+
+	for _, group := range plan.products {
+		first := group.lines[0]
+		item := models.ImportPreviewItem{Row: first.row, ProductID: first.productID, Name: first.name, Action: "update"}
+		if first.productID == 0 {
+			item.Action = "create"
+			if first.price == nil || *first.price <= 0 {
+				rowErrors = append(rowErrors, models.ImportRowError{Row: first.row, Column: "price", Message: "price is required for a new product"})
+			}
+			if first.categoryID == 0 {
+				rowErrors = append(rowErrors, models.ImportRowError{Row: first.row, Column: "category_id", Message: "category_id is required for a new product"})
+			}
+		}
+		for _, line := range group.lines {
+			if !line.hasVariant() {
+				continue
+			}
+			if line.existingVariantID != 0 {
+				item.VariantsUpdated++
+			} else {
+				item.VariantsCreated++
+			}
+		}
+		plan.preview = append(plan.preview, item)
+	}
+
+	return plan, rowErrors, nil
+}
+
+// applyProductImport writes a validated import plan in a single transaction
+func (s *DBService) applyProductImport(ctx context.Context, marketID int, plan *importPlan, images *importImages) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, group := range plan.products {
+		first := group.lines[0]
+		productID := first.productID
+		if productID == 0 {
+			productID, err = insertImportedProduct(ctx, tx, marketID, first, images.resolved[first.image])
+		} else {
+			err = updateImportedProduct(ctx, tx, first, images.resolved[first.image])
+		}
+		if err != nil {
+			return fmt.Errorf("row %d: %v", first.row, err)
+		}
+
+		thumbnails := make(map[string]int)
+		for _, line := range group.lines {
+			if !line.hasVariant() {
+				continue
+			}
+			if line.existingVariantID != 0 {
+				err = updateImportedVariant(ctx, tx, productID, line)
+			} else {
+				err = insertImportedVariant(ctx, tx, productID, line, thumbnails, images.resolved[line.colorImage])
+			}
+			if err != nil {
+				return fmt.Errorf("row %d: %v", line.row, err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+func insertImportedProduct(ctx context.Context, tx *sql.Tx, marketID int, line importLine, imageURL string) (int, error) {
+	result, err := tx.ExecContext(ctx, "INSERT INTO thumbnails (image_url) VALUES (?)", imageURL)
+	if err != nil {
+		return 0, fmt.Errorf("failed to save thumbnail URL: %v", err)
+	}
+	thumbnailID, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve thumbnail ID: %v", err)
+	}
+
+	var discount float64
+	if line.discount != nil {
+		discount = *line.discount
+	}
+	isActive := true
+	if line.isActive != nil {
+		isActive = *line.isActive
+	}
+	result, err = tx.ExecContext(ctx, `
+		INSERT INTO products (market_id, category_id, name, name_ru, price, discount, description, description_ru, is_active, thumbnail_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		marketID, line.categoryID, line.name, line.nameRu, *line.price, discount, line.description, line.descriptionRu, isActive, thumbnailID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create product: %v", err)
+	}
+	productID, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve product ID: %v", err)
+	}
+	return int(productID), nil
+}
+
+// updateImportedProduct updates the product columns that are filled in on the row
+func updateImportedProduct(ctx context.Context, tx *sql.Tx, line importLine, imageURL string) error {
+	var setClauses []string
+	var args []interface{}
+	for _, field := range []struct {
+		column string
+		value  string
+	}{{"name", line.name}, {"name_ru", line.nameRu}, {"description", line.description}, {"description_ru", line.descriptionRu}} {
+		if field.value != "" {
+			setClauses = append(setClauses, field.column+" = ?")
+			args = append(args, field.value)
+		}
+	}
+	if line.categoryID != 0 {
+		setClauses = append(setClauses, "category_id = ?")
+		args = append(args, line.categoryID)
+	}
+	if line.price != nil {
+		setClauses = append(setClauses, "price = ?")
+		args = append(args, *line.price)
+	}
+	if line.discount != nil {
+		setClauses = append(setClauses, "discount = ?")
+		args = append(args, *line.discount)
+	}
+	if line.isActive != nil {
+		setClauses = append(setClauses, "is_active = ?")
+		args = append(args, *line.isActive)
+	}
+	if len(setClauses) > 0 {
+		query := fmt.Sprintf("UPDATE products SET %s WHERE id = ?", strings.Join(setClauses, ", "))
+		args = append(args, line.productID)
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return fmt.Errorf("failed to update product: %v", err)
+		}
+	}
+
+	if imageURL != "" {
+		_, err := tx.ExecContext(ctx, `
+			UPDATE thumbnails t JOIN products p ON p.thumbnail_id = t.id
+			SET t.image_url = ?
+			WHERE p.id = ?`, imageURL, line.productID)
+		if err != nil {
+			return fmt.Errorf("failed to update product image: %v", err)
+		}
+	}
+	return nil
+}
+
+// insertImportedVariant creates a variant through the legacy color/size tables so both models stay in sync
+func insertImportedVariant(ctx context.Context, tx *sql.Tx, productID int, line importLine, thumbnails map[string]int, imageURL string) error {
+	colorKey := strings.ToLower(line.color)
+	thumbnailID, ok := thumbnails[colorKey]
+	if !ok {
+		err := tx.QueryRowContext(ctx, "SELECT id FROM thumbnails WHERE product_id = ? AND color = ? ORDER BY id LIMIT 1",
+			productID, line.color).Scan(&thumbnailID)
+		if err == sql.ErrNoRows {
+			result, err := tx.ExecContext(ctx, "INSERT INTO thumbnails (product_id, color, color_ru, image_url) VALUES (?, ?, ?, ?)",
+				productID, line.color, line.colorRu, imageURL)
+			if err != nil {
+				return fmt.Errorf("failed to insert thumbnail: %v", err)
+			}
+			id, err := result.LastInsertId()
+			if err != nil {
+				return fmt.Errorf("failed to retrieve thumbnail ID: %v", err)
+			}
+			thumbnailID = int(id)
+		} else if err != nil {
+			return fmt.Errorf("failed to fetch thumbnail: %v", err)
+		} else if imageURL != "" {
+			if _, err := tx.ExecContext(ctx, "UPDATE thumbnails SET image_url = ? WHERE id = ?", imageURL, thumbnailID); err != nil {
+				return fmt.Errorf("failed to update thumbnail image: %v", err)
+			}
+		}
+		thumbnails[colorKey] = thumbnailID
+	}
+
+	var price float64
+	if line.variantPrice != nil {
+		price = *line.variantPrice
+	} else if err := tx.QueryRowContext(ctx, "SELECT price FROM products WHERE id = ?", productID).Scan(&price); err != nil {
+		return fmt.Errorf("failed to fetch product price: %v", err)
+	}
+	var stock int
+	if line.stock != nil {
+		stock = *line.stock
+	}
+	result, err := tx.ExecContext(ctx, "INSERT INTO sizes (thumbnail_id, size, count, price) VALUES (?, ?, ?, ?)",
+		thumbnailID, line.size, stock, price)
+	if err != nil {
+		return fmt.Errorf("failed to insert size: %v", err)
+	}
+	sizeID, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve size ID: %v", err)
+	}
+	if err := syncSizeVariant(ctx, tx, int(sizeID)); err != nil {
+		return err
+	}
+
+	var variantID int
+	if err := tx.QueryRowContext(ctx, "SELECT id FROM product_variants WHERE legacy_size_id = ?", sizeID).Scan(&variantID); err != nil {
+		return fmt.Errorf("failed to fetch variant of size %d: %v", sizeID, err)
+	}
+	setClauses := []string{"barcode = ?", "compare_at_price = ?"}
+	args := []interface{}{nullIfEmpty(line.barcode), line.compareAt}
+	if line.sku != "" {
+		setClauses = append(setClauses, "sku = ?")
+		args = append(args, line.sku)
+	}
+	args = append(args, variantID)
+	query := fmt.Sprintf("UPDATE product_variants SET %s WHERE id = ?", strings.Join(setClauses, ", "))
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("failed to update variant: %v", err)
+	}
+
+	return setVariantAttributes(ctx, tx, productID, variantID, line.options)
+}
+
+// updateImportedVariant updates the variant columns that are filled in on the row
+func updateImportedVariant(ctx context.Context, tx *sql.Tx, productID int, line importLine) error {
+	var setClauses []string
+	var args []interface{}
+	if line.barcode != "" {
+		setClauses = append(setClauses, "barcode = ?")
+		args = append(args, line.barcode)
+	}
+	if line.variantPrice != nil {
+		setClauses = append(setClauses, "price = ?")
+		args = append(args, *line.variantPrice)
+	}
+	if line.compareAt != nil {
+		setClauses = append(setClauses, "compare_at_price = ?")
+		if *line.compareAt == 0 {
+			args = append(args, nil)
+		} else {
+			args = append(args, *line.compareAt)
+		}
+	}
+	if line.stock != nil {
+		setClauses = append(setClauses, "stock = ?")
+		args = append(args, *line.stock)
+	}
+	if len(setClauses) > 0 {
+		query := fmt.Sprintf("UPDATE product_variants SET %s WHERE id = ?", strings.Join(setClauses, ", "))
+		args = append(args, line.existingVariantID)
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return fmt.Errorf("failed to update variant: %v", err)
+		}
+		// Keep the legacy size row in step for clients still reading sizes
+		_, err := tx.ExecContext(ctx, `
+			UPDATE sizes s JOIN product_variants v ON v.legacy_size_id = s.id
+			SET s.count = v.stock, s.price = v.price
+			WHERE v.id = ?`, line.existingVariantID)
+		if err != nil {
+			return fmt.Errorf("failed to update legacy size: %v", err)
+		}
+	}
+
+	return setVariantAttributes(ctx, tx, productID, line.existingVariantID, line.options)
+}
+
+// ExportMarketProducts exports the market's catalog in the import format ("csv" or "xlsx")
+func (s *DBService) ExportMarketProducts(ctx context.Context, marketID int, format string) ([]byte, error) {
+	ctx, span := tracer.Start(ctx, "DBService.ExportMarketProducts")
+	defer span.End()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT p.id, p.name, COALESCE(p.name_ru, ''), p.category_id, p.price, COALESCE(p.discount, 0),
+			COALESCE(p.description, ''), COALESCE(p.description_ru, ''), p.is_active, COALESCE(t.image_url, '')
+		FROM products p
+		LEFT JOIN thumbnails t ON p.thumbnail_id = t.id
+		WHERE p.market_id = ?
+		ORDER BY p.id`, marketID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query products: %v", err)
+	}
+
+	type exportProduct struct {
+		id                                            int
+		name, nameRu, description, descriptionRu, img string
+		categoryID                                    int
+		price, discount                               float64
+		isActive                                      bool
+	}
+	var products []exportProduct
+	for rows.Next() {
+		var p exportProduct
+		if err := rows.Scan(&p.id, &p.name, &p.nameRu, &p.categoryID, &p.price, &p.discount,
+			&p.description, &p.descriptionRu, &p.isActive, &p.img); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan product: %v", err)
+		}
+		products = append(products, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating products: %v", err)
+	}
+
+	records := [][]string{productImportColumns}
+	for _, p := range products {
+		productCells := []string{
+			strconv.Itoa(p.id), p.name, p.nameRu, strconv.Itoa(p.categoryID), formatImportFloat(p.price),
+			formatImportFloat(p.discount), p.description, p.descriptionRu, strconv.FormatBool(p.isActive), p.img,
+		}
+
+		variants, err := s.GetProductVariants(ctx, p.id, false)
+		if err != nil {
+			return nil, err
+		}
+		if len(variants) == 0 {
+			records = append(records, append(productCells, make([]string, len(productImportColumns)-len(productCells))...))
+			continue
+		}
+		for _, v := range variants {
+			color, colorRu := attributeValue(v.Attributes, "color")
+			size, _ := attributeValue(v.Attributes, "size")
+			var colorImage, compareAt string
+			if len(v.Images) > 0 {
+				colorImage = v.Images[0].ImageURL
+			}
+			if v.CompareAtPrice != nil {
+				compareAt = formatImportFloat(*v.CompareAtPrice)
+			}
+			var options []string
+			for _, a := range v.Attributes {
+				if a.Name == "color" || a.Name == "size" {
+					continue
+				}
+				option := a.Name + "=" + a.Value
+				if a.ValueRu != "" && a.ValueRu != a.Value {
+					option += "|" + a.ValueRu
+				}
+				options = append(options, option)
+			}
+			record := append(append([]string{}, productCells...),
+				v.SKU, v.Barcode, color, colorRu, colorImage, size, formatImportFloat(v.Price), compareAt,
+				strconv.Itoa(v.Stock), strings.Join(options, "; "))
+			records = append(records, record)
+		}
+	}
+
+	switch format {
+	case "xlsx":
+		return writeXLSX(records)
+	default:
+		return writeCSV(records)
+	}
+}
+
+// check verifies that an image reference can be resolved without fetching it
+func (im *importImages) check(ref string) error {
+	switch {
+	case strings.HasPrefix(ref, "/uploads/"):
+		return nil
+	case strings.HasPrefix(ref, "http://") || strings.HasPrefix(ref, "https://"):
+		if u, err := url.Parse(ref); err != nil || u.Host == "" {
+			return fmt.Errorf("invalid image URL")
+		}
+		return nil
+	case im.archive == nil:
+		return fmt.Errorf("image %s requires an images archive", ref)
+	case im.archive[strings.ToLower(path.Base(ref))] == nil:
+		return fmt.Errorf("image %s not found in archive", ref)
+	}
+	return nil
+}
+
+// resolveAll downloads or extracts every image referenced by the plan into uploads/products
+func (im *importImages) resolveAll(ctx context.Context, plan *importPlan) []models.ImportRowError {
+	var rowErrors []models.ImportRowError
+	if err := os.MkdirAll("uploads/products", 0755); err != nil {
+		return []models.ImportRowError{{Message: "failed to create upload directory"}}
+	}
+	for _, group := range plan.products {
+		for _, line := range group.lines {
+			for _, ref := range []struct{ column, value string }{{"image", line.image}, {"color_image", line.colorImage}} {
+				if ref.value == "" {
+					continue
+				}
+				if _, done := im.resolved[ref.value]; done {
+					continue
+				}
+				imageURL, err := im.resolve(ctx, ref.value)
+				if err != nil {
+					rowErrors = append(rowErrors, models.ImportRowError{Row: line.row, Column: ref.column, Message: err.Error()})
+					continue
+				}
+				im.resolved[ref.value] = imageURL
+			}
+		}
+	}
+	return rowErrors
+}
+
+func (im *importImages) resolve(ctx context.Context, ref string) (string, error) {
+	if strings.HasPrefix(ref, "/uploads/") {
+		return ref, nil
+	}
+
+	var name string
+	var src io.Reader
+	if strings.HasPrefix(ref, "http://") || strings.HasPrefix(ref, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, ref, nil)
+		if err != nil {
+			return "", fmt.Errorf("invalid image URL")
+		}
+		resp, err := im.client.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("failed to download image")
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("failed to download image: status %d", resp.StatusCode)
+		}
+		contentType := resp.Header.Get("Content-Type")
+		if contentType != "image/jpeg" && contentType != "image/png" && contentType != "image/webp" {
+			return "", ErrUnsupportedImage
+		}
+		u, _ := url.Parse(ref)
+		name = path.Base(u.Path)
+		src = resp.Body
+	} else {
+		f := im.archive[strings.ToLower(path.Base(ref))]
+		rc, err := f.Open()
+		if err != nil {
+			return "", fmt.Errorf("failed to read image %s from archive", ref)
+		}
+		defer rc.Close()
+		name = path.Base(f.Name)
+		src = rc
+	}
+
+	if name == "" || name == "/" || name == "." {
+		name = "image"
+	}
+	filename := fmt.Sprintf("%d-%s", time.Now().UnixNano(), strings.ReplaceAll(name, " ", "_"))
+	filePath := filepath.Join("uploads", "products", filename)
+	out, err := os.Create(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to save image")
+	}
+	im.saved = append(im.saved, filePath)
+	n, err := io.Copy(out, io.LimitReader(src, maxImportImageSize+1))
+	out.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to save image")
+	}
+	if n > maxImportImageSize {
+		return "", fmt.Errorf("image exceeds %d MB", maxImportImageSize>>20)
+	}
+	return "/uploads/products/" + filename, nil
+}
+
+// cleanup removes images saved by an import that was not applied
+func (im *importImages) cleanup() {
+	for _, filePath := range im.saved {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			slog.Warn("Failed to delete file", "path", filePath, "error", err)
+		}
+	}
+}
+
+func collectIDs(ctx context.Context, q execer, ids map[int]bool, query string, args ...interface{}) error {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query ids: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return fmt.Errorf("failed to scan id: %v", err)
+		}
+		ids[id] = true
+	}
+	return rows.Err()
+}
+
+func parseImportFloat(value, column string, fail func(column, message string)) *float64 {
+	if value == "" {
+		return nil
+	}
+	f, err := strconv.ParseFloat(strings.ReplaceAll(value, ",", "."), 64)
+	if err != nil || f < 0 {
+		fail(column, column+" must be a non-negative number")
+		return nil
+	}
+	return &f
+}
+
+func parseImportBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "1", "true", "yes", "y":
+		return true, nil
+	case "0", "false", "no", "n":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean")
+}
+
+// parseImportOptions parses extra variant options written as "name=value|value_ru; name=value"
+func parseImportOptions(value string) ([]models.VariantAttributeInput, error) {
+	var options []models.VariantAttributeInput
+	for _, part := range strings.Split(value, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, val, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("options must be written as name=value")
+		}
+		val, valRu, _ := strings.Cut(val, "|")
+		option := models.VariantAttributeInput{Name: strings.TrimSpace(name), Value: strings.TrimSpace(val), ValueRu: strings.TrimSpace(valRu)}
+		if option.ValueRu == "" {
+			option.ValueRu = option.Value
+		}
+		if n := strings.ToLower(option.Name); n == "color" || n == "size" {
+			return nil, fmt.Errorf("use the color and size columns for %s", n)
+		}
+		options = append(options, option)
+	}
+	if err := validateVariantAttributes(options); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+func formatImportFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
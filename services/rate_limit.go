@@ -0,0 +1,78 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// rateLimitKeyFormat is the Redis hash of one token bucket, by group and client
+const rateLimitKeyFormat = "ratelimit:%s:%s"
+
+// takeTokenScript refills a token bucket for the time since it was last used and takes a token
+// from it. Buckets start full and expire once they would be full again. Redis' clock is used so
+// that all server instances agree on the refill.
+// Returns whether a token was taken, the whole tokens left, and the milliseconds until the next
+// token and until the bucket is full.
+var takeTokenScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(state[1])
+local updated = tonumber(state[2])
+if tokens == nil or updated == nil then
+	tokens = capacity
+	updated = now
+end
+tokens = math.min(capacity, tokens + math.max(0, now - updated) * capacity / period)
+
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) * period / capacity)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', now)
+redis.call('PEXPIRE', KEYS[1], period)
+return {allowed, math.floor(tokens), retry, math.ceil((capacity - tokens) * period / capacity)}
+`)
+
+// RateLimitResult is the outcome of a request against a token bucket
+type RateLimitResult struct {
+	Allowed bool
+	// Remaining is the number of requests that may follow right away
+	Remaining int
+	// RetryAfter is how long a rejected client has to wait for the next token
+	RetryAfter time.Duration
+	// ResetAfter is how long until the bucket is full again
+	ResetAfter time.Duration
+}
+
+// TakeRateLimitToken takes a token from the bucket of a client in a route group. The bucket holds
+// up to capacity tokens and refills at capacity tokens per period.
+func (s *DBService) TakeRateLimitToken(ctx context.Context, group, client string, capacity int, period time.Duration) (RateLimitResult, error) {
+	ctx, span := tracer.Start(ctx, "DBService.TakeRateLimitToken")
+	defer span.End()
+	key := fmt.Sprintf(rateLimitKeyFormat, group, client)
+	values, err := takeTokenScript.Run(ctx, s.redis, []string{key}, capacity, period.Milliseconds()).Int64Slice()
+	if err != nil {
+		return RateLimitResult{}, fmt.Errorf("failed to take rate limit token: %v", err)
+	}
+	if len(values) != 4 {
+		return RateLimitResult{}, fmt.Errorf("unexpected rate limit script result %v", values)
+	}
+	return RateLimitResult{
+		Allowed:    values[0] == 1,
+		Remaining:  int(values[1]),
+		RetryAfter: time.Duration(values[2]) * time.Millisecond,
+		ResetAfter: time.Duration(values[3]) * time.Millisecond,
+	}, nil
+}
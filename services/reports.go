@@ -0,0 +1,415 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"Dowlet_projects/ecommerce/models"
+)
+
+const (
+	// reportRestatementDays is how many trailing days the nightly rollup rebuilds, so that orders
+	// delivered or cancelled after their order day are reflected
+	reportRestatementDays = 14
+	// reportScheduleKeyFormat marks a nightly rollup as queued, so that only one instance queues it
+	reportScheduleKeyFormat = "reports:rollup_scheduled:%s"
+	// maxReportRollupDays caps the range of a single rollup job
+	maxReportRollupDays = 366
+)
+
+// reportOrdersSQL groups the order items of a day into one row per order, as marketOrdersSQL does for one market
+const reportOrdersSQL = `
+	SELECT o.market_id,
+		MIN(` + cancelledLine + `) AS cancelled,
+		MAX(o.status = 'delivered') AND NOT MAX(` + openLine + `) AS delivered,
+		SUM(` + lineRevenue + `) AS revenue,
+		SUM(` + lineItems + `) AS items
+	FROM order_items o
+	JOIN product_variants v ON o.variant_id = v.id
+	JOIN products p ON o.product_id = p.id
+	WHERE o.market_id IS NOT NULL AND o.created_at >= ? AND o.created_at < ?
+	GROUP BY o.market_id, o.order_id`
+
+// reportRollupPayload is the job payload of a report rollup; both dates are inclusive
+type reportRollupPayload struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// rollupReportDay rebuilds the report rows of one day from orders, cart_starts, users and markets
+func (s *DBService) rollupReportDay(ctx context.Context, day time.Time) error {
+	date := analyticsDate(day)
+	start, end := analyticsBounds(day, day)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM report_market_daily WHERE day = ?", date); err != nil {
+		return fmt.Errorf("failed to clear market report of %s: %v", date, err)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO report_market_daily (day, market_id, orders, delivered_orders, cancelled_orders, items_sold, gmv)
+		SELECT ?, market_id, COUNT(*), SUM(delivered), SUM(cancelled), SUM(items), SUM(revenue)
+		FROM (`+reportOrdersSQL+`) t
+		GROUP BY market_id`, date, start, end); err != nil {
+		return fmt.Errorf("failed to roll up market orders of %s: %v", date, err)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO report_market_daily (day, market_id, carts_started)
+		SELECT ?, market_id, COUNT(*)
+		FROM cart_starts
+		WHERE created_at >= ? AND created_at < ?
+		GROUP BY market_id
+		ON DUPLICATE KEY UPDATE carts_started = VALUES(carts_started)`, date, start, end); err != nil {
+		return fmt.Errorf("failed to roll up carts of %s: %v", date, err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM report_category_daily WHERE day = ?", date); err != nil {
+		return fmt.Errorf("failed to clear category report of %s: %v", date, err)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO report_category_daily (day, category_id, orders, items_sold, gmv)
+		SELECT ?, COALESCE(p.category_id, 0),
+			COUNT(DISTINCT o.order_id),
+			SUM(o.count),
+			SUM(`+lineAmount+`)
+		FROM order_items o
+		JOIN product_variants v ON o.variant_id = v.id
+		JOIN products p ON o.product_id = p.id
+		WHERE o.market_id IS NOT NULL AND o.created_at >= ? AND o.created_at < ? AND NOT `+cancelledLine+`
+		GROUP BY COALESCE(p.category_id, 0)`, date, start, end); err != nil {
+		return fmt.Errorf("failed to roll up categories of %s: %v", date, err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO report_platform_daily (day, new_users, new_markets, rolled_up_at)
+		SELECT ?,
+			(SELECT COUNT(*) FROM users WHERE created_at >= ? AND created_at < ?),
+			(SELECT COUNT(*) FROM markets WHERE created_at >= ? AND created_at < ?),
+			CURRENT_TIMESTAMP
+		ON DUPLICATE KEY UPDATE new_users = VALUES(new_users), new_markets = VALUES(new_markets),
+			rolled_up_at = VALUES(rolled_up_at)`, date, start, end, start, end); err != nil {
+		return fmt.Errorf("failed to roll up platform figures of %s: %v", date, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+// RollupReports rebuilds the report tables for every day of an inclusive date range
+func (s *DBService) RollupReports(ctx context.Context, from, to time.Time) error {
+	ctx, span := tracer.Start(ctx, "DBService.RollupReports")
+	defer span.End()
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		if err := s.rollupReportDay(ctx, day); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnqueueReportRollup queues a rebuild of the report tables for an inclusive date range
+func (s *DBService) EnqueueReportRollup(ctx context.Context, from, to time.Time) (string, error) {
+	ctx, span := tracer.Start(ctx, "DBService.EnqueueReportRollup")
+	defer span.End()
+	if from.After(to) {
+		return "", ErrInvalidPeriod
+	}
+	if to.Sub(from) >= maxReportRollupDays*24*time.Hour {
+		return "", ErrRollupRangeTooLong.WithDetails(map[string]interface{}{"max_days": maxReportRollupDays}, maxReportRollupDays)
+	}
+	return s.EnqueueJob(ctx, JobTypeReportRollup, reportRollupPayload{From: analyticsDate(from), To: analyticsDate(to)}, 0)
+}
+
+func (s *DBService) handleReportRollupJob(ctx context.Context, job models.Job) error {
+	var payload reportRollupPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid report rollup payload: %v", err)
+	}
+	from, err := time.Parse("2006-01-02", payload.From)
+	if err != nil {
+		return fmt.Errorf("invalid report rollup start %q", payload.From)
+	}
+	to, err := time.Parse("2006-01-02", payload.To)
+	if err != nil {
+		return fmt.Errorf("invalid report rollup end %q", payload.To)
+	}
+	return s.RollupReports(ctx, from, to)
+}
+
+// scheduleNightlyRollup queues the rollup of the days up to yesterday unless another run or instance
+// already queued it today
+func (s *DBService) scheduleNightlyRollup(ctx context.Context, now time.Time) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	yesterday := today.AddDate(0, 0, -1)
+	key := fmt.Sprintf(reportScheduleKeyFormat, analyticsDate(yesterday))
+	queued, err := s.redis.SetNX(ctx, key, 1, 48*time.Hour).Result()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to claim nightly report rollup", "error", err)
+		return
+	}
+	if !queued {
+		return
+	}
+
+	from := yesterday.AddDate(0, 0, 1-reportRestatementDays)
+	if _, err := s.EnqueueReportRollup(ctx, from, yesterday); err != nil {
+		slog.ErrorContext(ctx, "Failed to queue nightly report rollup", "error", err)
+		// Let the next start or night try again
+		s.redis.Del(ctx, key)
+	}
+}
+
+// reportDataThrough returns the last rolled-up day, or an empty string before the first rollup
+func (s *DBService) reportDataThrough(ctx context.Context) (string, error) {
+	var day string
+	if err := s.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(day), '') FROM report_platform_daily").Scan(&day); err != nil {
+		return "", fmt.Errorf("failed to query report state: %v", err)
+	}
+	return day, nil
+}
+
+// GetReportSummary returns the platform totals and the order funnel of a date range
+func (s *DBService) GetReportSummary(ctx context.Context, from, to time.Time) (models.ReportSummary, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetReportSummary")
+	defer span.End()
+	summary := models.ReportSummary{From: analyticsDate(from), To: analyticsDate(to)}
+	dataThrough, err := s.reportDataThrough(ctx)
+	if err != nil {
+		return summary, err
+	}
+	summary.DataThrough = dataThrough
+
+	var gmv float64
+	funnel := &summary.Funnel
+	err = s.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(carts_started), 0), COALESCE(SUM(orders), 0), COALESCE(SUM(delivered_orders), 0),
+			COALESCE(SUM(cancelled_orders), 0), COALESCE(SUM(items_sold), 0), COALESCE(SUM(gmv), 0),
+			COUNT(DISTINCT CASE WHEN orders > 0 THEN market_id END)
+		FROM report_market_daily
+		WHERE day BETWEEN ? AND ?`, summary.From, summary.To).Scan(
+		&funnel.CartsStarted, &funnel.Orders, &funnel.DeliveredOrders, &funnel.CancelledOrders,
+		&summary.ItemsSold, &gmv, &summary.ActiveMarkets)
+	if err != nil {
+		return summary, fmt.Errorf("failed to query report summary: %v", err)
+	}
+	summary.GMV = roundMoney(gmv)
+	funnel.CartToOrderRate = ratio(funnel.Orders, funnel.CartsStarted)
+	funnel.OrderToDeliveredRate = ratio(funnel.DeliveredOrders, funnel.Orders)
+
+	err = s.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(new_users), 0), COALESCE(SUM(new_markets), 0)
+		FROM report_platform_daily
+		WHERE day BETWEEN ? AND ?`, summary.From, summary.To).Scan(&summary.NewUsers, &summary.NewMarkets)
+	if err != nil {
+		return summary, fmt.Errorf("failed to query new users and markets: %v", err)
+	}
+	return summary, nil
+}
+
+// GetDailyPlatformStats returns new users, new and active markets, orders and GMV per day, including
+// days without activity
+func (s *DBService) GetDailyPlatformStats(ctx context.Context, from, to time.Time) ([]models.DailyPlatformStats, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetDailyPlatformStats")
+	defer span.End()
+	days := make(map[string]*models.DailyPlatformStats)
+	stats := []models.DailyPlatformStats{}
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		stats = append(stats, models.DailyPlatformStats{Day: analyticsDate(day)})
+	}
+	for i := range stats {
+		days[stats[i].Day] = &stats[i]
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT day, new_users, new_markets
+		FROM report_platform_daily
+		WHERE day BETWEEN ? AND ?`, analyticsDate(from), analyticsDate(to))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query daily platform figures: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var day string
+		var newUsers, newMarkets int
+		if err := rows.Scan(&day, &newUsers, &newMarkets); err != nil {
+			return nil, fmt.Errorf("failed to scan daily platform figures: %v", err)
+		}
+		if d, ok := days[day]; ok {
+			d.NewUsers = newUsers
+			d.NewMarkets = newMarkets
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating daily platform figures: %v", err)
+	}
+
+	rows, err = s.db.QueryContext(ctx, `
+		SELECT day, SUM(orders > 0), SUM(orders), SUM(gmv)
+		FROM report_market_daily
+		WHERE day BETWEEN ? AND ?
+		GROUP BY day`, analyticsDate(from), analyticsDate(to))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query daily orders: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var day string
+		var active, orders int
+		var gmv float64
+		if err := rows.Scan(&day, &active, &orders, &gmv); err != nil {
+			return nil, fmt.Errorf("failed to scan daily orders: %v", err)
+		}
+		if d, ok := days[day]; ok {
+			d.ActiveMarkets = active
+			d.Orders = orders
+			d.GMV = roundMoney(gmv)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating daily orders: %v", err)
+	}
+	return stats, nil
+}
+
+// GetMarketGMVReport returns the sales of every market over a date range, highest GMV first
+func (s *DBService) GetMarketGMVReport(ctx context.Context, from, to time.Time) ([]models.MarketGMV, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetMarketGMVReport")
+	defer span.End()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT m.id, m.name, m.name_ru, COALESCE(m.isVIP, 0),
+			COALESCE(t.orders, 0), COALESCE(t.delivered, 0), COALESCE(t.cancelled, 0),
+			COALESCE(t.items, 0), COALESCE(t.gmv, 0)
+		FROM markets m
+		LEFT JOIN (
+			SELECT market_id, SUM(orders) AS orders, SUM(delivered_orders) AS delivered,
+				SUM(cancelled_orders) AS cancelled, SUM(items_sold) AS items, SUM(gmv) AS gmv
+			FROM report_market_daily
+			WHERE day BETWEEN ? AND ?
+			GROUP BY market_id
+		) t ON t.market_id = m.id
+		ORDER BY COALESCE(t.gmv, 0) DESC, m.id`, analyticsDate(from), analyticsDate(to))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query market GMV: %v", err)
+	}
+	defer rows.Close()
+
+	markets := []models.MarketGMV{}
+	for rows.Next() {
+		var m models.MarketGMV
+		if err := rows.Scan(&m.MarketID, &m.Name, &m.NameRu, &m.IsVIP, &m.Orders, &m.DeliveredOrders,
+			&m.CancelledOrders, &m.ItemsSold, &m.GMV); err != nil {
+			return nil, fmt.Errorf("failed to scan market GMV: %v", err)
+		}
+		m.GMV = roundMoney(m.GMV)
+		markets = append(markets, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating market GMV: %v", err)
+	}
+	return markets, nil
+}
+
+// GetCategoryReport returns the sales per category over a date range, highest GMV first
+func (s *DBService) GetCategoryReport(ctx context.Context, from, to time.Time) ([]models.CategoryPerformance, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetCategoryReport")
+	defer span.End()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT r.category_id, COALESCE(c.name, ''), COALESCE(c.name_ru, ''),
+			SUM(r.orders), SUM(r.items_sold), SUM(r.gmv)
+		FROM report_category_daily r
+		LEFT JOIN categories c ON c.id = r.category_id
+		WHERE r.day BETWEEN ? AND ?
+		GROUP BY r.category_id, c.name, c.name_ru
+		ORDER BY SUM(r.gmv) DESC, r.category_id`, analyticsDate(from), analyticsDate(to))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query category performance: %v", err)
+	}
+	defer rows.Close()
+
+	categories := []models.CategoryPerformance{}
+	var total float64
+	for rows.Next() {
+		var c models.CategoryPerformance
+		if err := rows.Scan(&c.CategoryID, &c.Name, &c.NameRu, &c.Orders, &c.ItemsSold, &c.GMV); err != nil {
+			return nil, fmt.Errorf("failed to scan category performance: %v", err)
+		}
+		total += c.GMV
+		categories = append(categories, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating category performance: %v", err)
+	}
+
+	for i := range categories {
+		if total > 0 {
+			categories[i].GMVShare = math.Round(categories[i].GMV/total*10000) / 10000
+		}
+		categories[i].GMV = roundMoney(categories[i].GMV)
+	}
+	return categories, nil
+}
+
+// GetVIPComparison returns the combined figures of the non-VIP and the VIP markets over a date range
+func (s *DBService) GetVIPComparison(ctx context.Context, from, to time.Time) ([]models.VIPSegment, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetVIPComparison")
+	defer span.End()
+	segments := []models.VIPSegment{{IsVIP: false}, {IsVIP: true}}
+	cancelled := make([]int, len(segments))
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT COALESCE(m.isVIP, 0) <> 0, COUNT(*), COALESCE(SUM(t.orders > 0), 0),
+			COALESCE(SUM(t.orders), 0), COALESCE(SUM(t.cancelled), 0), COALESCE(SUM(t.gmv), 0)
+		FROM markets m
+		LEFT JOIN (
+			SELECT market_id, SUM(orders) AS orders, SUM(cancelled_orders) AS cancelled, SUM(gmv) AS gmv
+			FROM report_market_daily
+			WHERE day BETWEEN ? AND ?
+			GROUP BY market_id
+		) t ON t.market_id = m.id
+		GROUP BY COALESCE(m.isVIP, 0) <> 0`, analyticsDate(from), analyticsDate(to))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query VIP comparison: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var isVIP bool
+		var seg models.VIPSegment
+		var segCancelled int
+		if err := rows.Scan(&isVIP, &seg.Markets, &seg.ActiveMarkets, &seg.Orders, &segCancelled, &seg.GMV); err != nil {
+			return nil, fmt.Errorf("failed to scan VIP comparison: %v", err)
+		}
+		i := 0
+		if isVIP {
+			i = 1
+		}
+		seg.IsVIP = isVIP
+		segments[i] = seg
+		cancelled[i] = segCancelled
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating VIP comparison: %v", err)
+	}
+
+	for i := range segments {
+		seg := &segments[i]
+		if seg.ActiveMarkets > 0 {
+			seg.GMVPerActiveMarket = roundMoney(seg.GMV / float64(seg.ActiveMarkets))
+		}
+		if completed := seg.Orders - cancelled[i]; completed > 0 {
+			seg.AverageBasket = roundMoney(seg.GMV / float64(completed))
+		}
+		seg.CancellationRate = ratio(cancelled[i], seg.Orders)
+		seg.GMV = roundMoney(seg.GMV)
+	}
+	return segments, nil
+}
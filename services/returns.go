@@ -0,0 +1,451 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"Dowlet_projects/ecommerce/models"
+)
+
+// returnTransitions lists the statuses a return request may move to from each status
+var returnTransitions = map[string][]string{
+	models.ReturnStatusRequested: {models.ReturnStatusApproved, models.ReturnStatusRejected},
+	models.ReturnStatusApproved:  {models.ReturnStatusReceived},
+	models.ReturnStatusReceived:  {models.ReturnStatusRefunded},
+}
+
+// returnColumns selects a return request aliased rr joined with its order oh, user u and market m
+const returnColumns = `rr.id, rr.user_id, COALESCE(u.full_name, ''), rr.market_id, COALESCE(m.name, ''), rr.order_id,
+	COALESCE(oh.order_number, ''), rr.reason, rr.status, COALESCE(rr.market_note, ''), rr.refund_amount, COALESCE(rr.refund_reference, ''),
+	rr.created_at, rr.decided_at, rr.received_at, rr.refunded_at
+	FROM return_requests rr
+	LEFT JOIN orders oh ON oh.id = rr.order_id
+	LEFT JOIN users u ON u.id = rr.user_id
+	LEFT JOIN markets m ON m.id = rr.market_id`
+
+func scanReturnRequest(row rowScanner) (models.ReturnRequest, error) {
+	var rr models.ReturnRequest
+	var refundAmount sql.NullFloat64
+	var decidedAt, receivedAt, refundedAt sql.NullString
+	err := row.Scan(&rr.ID, &rr.UserID, &rr.UserName, &rr.MarketID, &rr.MarketName, &rr.OrderID, &rr.OrderNumber, &rr.Reason,
+		&rr.Status, &rr.MarketNote, &refundAmount, &rr.RefundReference, &rr.CreatedAt, &decidedAt, &receivedAt, &refundedAt)
+	if refundAmount.Valid {
+		rr.RefundAmount = &refundAmount.Float64
+	}
+	for _, t := range []struct {
+		src  sql.NullString
+		dest **string
+	}{{decidedAt, &rr.DecidedAt}, {receivedAt, &rr.ReceivedAt}, {refundedAt, &rr.RefundedAt}} {
+		if t.src.Valid {
+			value := t.src.String
+			*t.dest = &value
+		}
+	}
+	rr.Items = []models.ReturnItem{}
+	rr.Photos = []string{}
+	return rr, err
+}
+
+// returnScope returns the condition restricting return requests to those of a user or market
+func returnScope(partyType string, partyID int) (string, error) {
+	switch partyType {
+	case models.RecipientUser:
+		return "rr.user_id = ?", nil
+	case models.RecipientMarket:
+		return "rr.market_id = ?", nil
+	}
+	return "", fmt.Errorf("invalid return party")
+}
+
+// CreateReturnRequest opens a return for delivered items of one of the user's orders.
+// Items must have been delivered within windowDays; a count of 0 returns what is left of the item.
+func (s *DBService) CreateReturnRequest(ctx context.Context, userID int, req models.CreateReturnRequest, photoURLs []string, windowDays int) (int, error) {
+	ctx, span := tracer.Start(ctx, "DBService.CreateReturnRequest")
+	defer span.End()
+	if len(req.Items) == 0 {
+		return 0, ErrOrderItemsRequired
+	}
+	requested := make(map[int]int, len(req.Items))
+	args := make([]interface{}, 0, len(req.Items)+2)
+	args = append(args, windowDays)
+	for _, item := range req.Items {
+		if item.ItemID < 1 || item.Count < 0 {
+			return 0, ErrInvalidOrderItem
+		}
+		if _, ok := requested[item.ItemID]; ok {
+			return 0, ErrDuplicateOrderItem
+		}
+		requested[item.ItemID] = item.Count
+		args = append(args, item.ItemID)
+	}
+	args = append(args, userID)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT o.id, o.order_id, COALESCE(oh.market_id, 0), oh.order_number, o.count, o.status,
+			COALESCE(o.delivered_at, o.created_at) >= NOW() - INTERVAL ? DAY,
+			COALESCE((
+				SELECT SUM(i.count) FROM return_request_items i
+				JOIN return_requests r ON r.id = i.return_id
+				WHERE i.item_id = o.id AND r.status <> 'rejected'), 0)
+		FROM order_items o
+		JOIN orders oh ON oh.id = o.order_id
+		WHERE o.id IN (`+placeholders(len(requested))+`) AND oh.user_id = ? AND oh.is_active = 1
+		FOR UPDATE`, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch order items: %v", err)
+	}
+	var orderID, marketID int
+	var orderNumber string
+	found := 0
+	for rows.Next() {
+		var itemID, itemOrderID, itemMarketID, count, alreadyReturned int
+		var itemOrderNumber, status string
+		var inWindow bool
+		if err := rows.Scan(&itemID, &itemOrderID, &itemMarketID, &itemOrderNumber, &count, &status, &inWindow, &alreadyReturned); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan order item: %v", err)
+		}
+		found++
+		if found == 1 {
+			orderID, marketID, orderNumber = itemOrderID, itemMarketID, itemOrderNumber
+		} else if itemOrderID != orderID {
+			rows.Close()
+			return 0, ErrOrderItemsMixed
+		}
+		if status != "delivered" {
+			rows.Close()
+			return 0, ErrItemNotDelivered
+		}
+		if !inWindow {
+			rows.Close()
+			return 0, ErrReturnWindowClosed
+		}
+		left := count - alreadyReturned
+		if requested[itemID] == 0 {
+			requested[itemID] = left
+		}
+		if left <= 0 || requested[itemID] > left {
+			rows.Close()
+			return 0, ErrReturnCountExceeded
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating order items: %v", err)
+	}
+	if found != len(requested) {
+		return 0, ErrOrderItemNotFound
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO return_requests (user_id, market_id, order_id, reason) VALUES (?, ?, ?, ?)`,
+		userID, marketID, orderID, req.Reason)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create return request: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve return request ID: %v", err)
+	}
+	returnID := int(id)
+
+	var values []string
+	var itemArgs []interface{}
+	for itemID, count := range requested {
+		values = append(values, "(?, ?, ?)")
+		itemArgs = append(itemArgs, returnID, itemID, count)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO return_request_items (return_id, item_id, count) VALUES `+strings.Join(values, ", "), itemArgs...); err != nil {
+		return 0, fmt.Errorf("failed to save return items: %v", err)
+	}
+	for _, url := range photoURLs {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO return_request_photos (return_id, url) VALUES (?, ?)`, returnID, url); err != nil {
+			return 0, fmt.Errorf("failed to save return photo: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	s.notify(context.Background(), notification{
+		recipientType: models.RecipientMarket,
+		recipientID:   marketID,
+		kind:          models.NotificationReturnRequested,
+		title:         "New return request",
+		titleRu:       "Новый запрос на возврат",
+		body:          fmt.Sprintf("A return was requested for order #%s", orderNumber),
+		bodyRu:        fmt.Sprintf("Запрошен возврат по заказу №%s", orderNumber),
+		data: map[string]string{
+			"return_id":    fmt.Sprint(returnID),
+			"order_id":     fmt.Sprint(orderID),
+			"order_number": orderNumber,
+			"user_id":      fmt.Sprint(userID),
+		},
+	})
+	return returnID, nil
+}
+
+// loadReturnDetails attaches the items and photos to return requests
+func (s *DBService) loadReturnDetails(ctx context.Context, returns []models.ReturnRequest) error {
+	if len(returns) == 0 {
+		return nil
+	}
+	index := make(map[int]*models.ReturnRequest, len(returns))
+	args := make([]interface{}, len(returns))
+	for i := range returns {
+		index[returns[i].ID] = &returns[i]
+		args[i] = returns[i].ID
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT i.return_id, i.item_id, COALESCE(o.variant_id, 0), COALESCE(v.sku, ''), COALESCE(p.name, ''),
+			COALESCE(p.name_ru, ''), i.count, COALESCE(o.count, 0)
+		FROM return_request_items i
+		LEFT JOIN order_items o ON o.id = i.item_id
+		LEFT JOIN product_variants v ON v.id = o.variant_id
+		LEFT JOIN products p ON p.id = o.product_id
+		WHERE i.return_id IN (`+placeholders(len(args))+`)
+		ORDER BY i.item_id`, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query return items: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var returnID int
+		var item models.ReturnItem
+		if err := rows.Scan(&returnID, &item.ItemID, &item.VariantID, &item.SKU, &item.ProductName, &item.ProductNameRu,
+			&item.Count, &item.OrderedCount); err != nil {
+			return fmt.Errorf("failed to scan return item: %v", err)
+		}
+		if rr, ok := index[returnID]; ok {
+			rr.Items = append(rr.Items, item)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating return items: %v", err)
+	}
+
+	photoRows, err := s.db.QueryContext(ctx, `
+		SELECT return_id, url FROM return_request_photos
+		WHERE return_id IN (`+placeholders(len(args))+`)
+		ORDER BY id`, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query return photos: %v", err)
+	}
+	defer photoRows.Close()
+	for photoRows.Next() {
+		var returnID int
+		var url string
+		if err := photoRows.Scan(&returnID, &url); err != nil {
+			return fmt.Errorf("failed to scan return photo: %v", err)
+		}
+		if rr, ok := index[returnID]; ok {
+			rr.Photos = append(rr.Photos, url)
+		}
+	}
+	if err := photoRows.Err(); err != nil {
+		return fmt.Errorf("error iterating return photos: %v", err)
+	}
+	return nil
+}
+
+// GetReturnRequests lists the return requests of a user or market, newest first
+func (s *DBService) GetReturnRequests(ctx context.Context, partyType string, partyID int, status string, page, limit int) ([]models.ReturnRequest, int, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetReturnRequests")
+	defer span.End()
+	scope, err := returnScope(partyType, partyID)
+	if err != nil {
+		return nil, 0, err
+	}
+	where := scope
+	args := []interface{}{partyID}
+	if status != "" {
+		where += " AND rr.status = ?"
+		args = append(args, status)
+	}
+
+	var total int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM return_requests rr WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count return requests: %v", err)
+	}
+
+	rows, err := s.db.QueryContext(ctx, "SELECT "+returnColumns+" WHERE "+where+`
+		ORDER BY rr.created_at DESC, rr.id DESC
+		LIMIT ? OFFSET ?`, append(args, limit, (page-1)*limit)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query return requests: %v", err)
+	}
+	defer rows.Close()
+
+	returns := []models.ReturnRequest{}
+	for rows.Next() {
+		rr, err := scanReturnRequest(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to scan return request: %v", err)
+		}
+		returns = append(returns, rr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating return requests: %v", err)
+	}
+
+	if err := s.loadReturnDetails(ctx, returns); err != nil {
+		return nil, 0, err
+	}
+	return returns, total, nil
+}
+
+// GetReturnRequest retrieves a return request of a user or market
+func (s *DBService) GetReturnRequest(ctx context.Context, partyType string, partyID, returnID int) (models.ReturnRequest, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetReturnRequest")
+	defer span.End()
+	scope, err := returnScope(partyType, partyID)
+	if err != nil {
+		return models.ReturnRequest{}, err
+	}
+	rr, err := scanReturnRequest(s.db.QueryRowContext(ctx, "SELECT "+returnColumns+" WHERE rr.id = ? AND "+scope, returnID, partyID))
+	if err == sql.ErrNoRows {
+		return models.ReturnRequest{}, ErrReturnNotFound
+	}
+	if err != nil {
+		return models.ReturnRequest{}, fmt.Errorf("failed to fetch return request: %v", err)
+	}
+
+	returns := []models.ReturnRequest{rr}
+	if err := s.loadReturnDetails(ctx, returns); err != nil {
+		return models.ReturnRequest{}, err
+	}
+	return returns[0], nil
+}
+
+// UpdateReturnStatus moves a market's return request on. Receiving the goods restocks the returned
+// variants; refunding reverses the returned share of the items' ledger entries and records the amount.
+func (s *DBService) UpdateReturnStatus(ctx context.Context, marketID, returnID int, req models.UpdateReturnStatusRequest) error {
+	ctx, span := tracer.Start(ctx, "DBService.UpdateReturnStatus")
+	defer span.End()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var current, orderNumber string
+	var userID, orderID int
+	err = tx.QueryRowContext(ctx, `
+		SELECT rr.status, rr.user_id, rr.order_id, COALESCE(oh.order_number, '')
+		FROM return_requests rr
+		LEFT JOIN orders oh ON oh.id = rr.order_id
+		WHERE rr.id = ? AND rr.market_id = ?
+		FOR UPDATE`,
+		returnID, marketID).Scan(&current, &userID, &orderID, &orderNumber)
+	if err == sql.ErrNoRows {
+		return ErrReturnNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch return request: %v", err)
+	}
+
+	allowed := false
+	for _, next := range returnTransitions[current] {
+		if next == req.Status {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return ErrReturnTransition.WithDetails(map[string]interface{}{"from": current, "to": req.Status}, current, req.Status)
+	}
+
+	switch req.Status {
+	case models.ReturnStatusApproved, models.ReturnStatusRejected:
+		_, err = tx.ExecContext(ctx, `
+			UPDATE return_requests SET status = ?, market_note = ?, decided_at = CURRENT_TIMESTAMP WHERE id = ?`,
+			req.Status, nullIfEmpty(req.Note), returnID)
+	case models.ReturnStatusReceived:
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE product_variants v
+			JOIN order_items o ON o.variant_id = v.id
+			JOIN return_request_items i ON i.item_id = o.id
+			SET v.stock = v.stock + i.count
+			WHERE i.return_id = ?`, returnID); err != nil {
+			return fmt.Errorf("failed to restock returned variants: %v", err)
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE return_requests SET status = ?, received_at = CURRENT_TIMESTAMP WHERE id = ?`, req.Status, returnID)
+	case models.ReturnStatusRefunded:
+		amount, posted, err := refundReturnLedger(ctx, tx, returnID)
+		if err != nil {
+			return err
+		}
+		if !posted {
+			// Items delivered before the ledger existed are refunded at the price they were ordered at
+			err = tx.QueryRowContext(ctx, `
+				SELECT COALESCE(SUM(ROUND(o.unit_price * (1 - o.discount/100) * i.count, 2)), 0)
+				FROM return_request_items i
+				JOIN order_items o ON o.id = i.item_id
+				WHERE i.return_id = ?`, returnID).Scan(&amount)
+			if err != nil {
+				return fmt.Errorf("failed to compute refund amount: %v", err)
+			}
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE return_requests SET status = ?, refund_amount = ?, refund_reference = ?, refunded_at = CURRENT_TIMESTAMP
+			WHERE id = ?`, req.Status, amount, nullIfEmpty(req.Reference), returnID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update return request: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	if req.Status == models.ReturnStatusReceived {
+		s.invalidateMarketProductCaches(context.Background(), marketID)
+	}
+	s.notifyReturnUpdated(context.Background(), userID, returnID, orderID, orderNumber, req.Status)
+	return nil
+}
+
+// returnStatusTexts holds the notification body templates per return status
+var returnStatusTexts = map[string]struct{ body, bodyRu string }{
+	models.ReturnStatusApproved: {"Your return for order #%s was approved", "Ваш возврат по заказу №%s одобрен"},
+	models.ReturnStatusRejected: {"Your return for order #%s was rejected", "Ваш возврат по заказу №%s отклонён"},
+	models.ReturnStatusReceived: {"The shop received the items you returned from order #%s", "Магазин получил возвращённые товары по заказу №%s"},
+	models.ReturnStatusRefunded: {"Your return for order #%s was refunded", "Возврат средств по заказу №%s выполнен"},
+}
+
+// notifyReturnUpdated tells a user that a market moved their return request on
+func (s *DBService) notifyReturnUpdated(ctx context.Context, userID, returnID, orderID int, orderNumber, status string) {
+	texts, ok := returnStatusTexts[status]
+	if !ok {
+		slog.WarnContext(ctx, "No notification text for return status", "status", status)
+		return
+	}
+	s.notify(ctx, notification{
+		recipientType: models.RecipientUser,
+		recipientID:   userID,
+		kind:          models.NotificationReturnUpdated,
+		title:         "Return updated",
+		titleRu:       "Статус возврата изменён",
+		body:          fmt.Sprintf(texts.body, orderNumber),
+		bodyRu:        fmt.Sprintf(texts.bodyRu, orderNumber),
+		data: map[string]string{
+			"return_id":    fmt.Sprint(returnID),
+			"order_id":     fmt.Sprint(orderID),
+			"order_number": orderNumber,
+			"status":       status,
+		},
+	})
+}
@@ -0,0 +1,30 @@
+package services
+
+import (
+	"context"
+	"time"
+)
+
+// StartNightlyJobs queues the periodic background jobs right away if they have not been queued yet
+// today, and then every night at the given local hour, until ctx is cancelled
+func (s *DBService) StartNightlyJobs(ctx context.Context, hour int) {
+	go func() {
+		for {
+			now := time.Now()
+			s.scheduleNightlyRollup(ctx, now)
+			s.scheduleMonthlyPayoutStatements(ctx, now)
+
+			next := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, now.Location())
+			if !next.After(now) {
+				next = next.AddDate(0, 0, 1)
+			}
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+	}()
+}
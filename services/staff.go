@@ -0,0 +1,262 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"Dowlet_projects/ecommerce/models"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// validStaffRoles lists the roles a market staff account may hold
+var validStaffRoles = map[string]bool{
+	models.StaffRoleOwner:          true,
+	models.StaffRoleCatalogManager: true,
+	models.StaffRoleOrderHandler:   true,
+	models.StaffRoleViewer:         true,
+}
+
+// IsValidStaffRole reports whether role is a known market staff role
+func IsValidStaffRole(role string) bool {
+	return validStaffRoles[role]
+}
+
+// GenerateTempPassword generates a random password handed out on staff invites and resets
+func GenerateTempPassword() (string, error) {
+	const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnpqrstuvwxyz23456789"
+	b := make([]byte, 10)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			return "", fmt.Errorf("failed to generate password: %v", err)
+		}
+		b[i] = alphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// CreateMarketStaff creates a staff account for a market
+func (s *DBService) CreateMarketStaff(ctx context.Context, marketID int, fullName, phone, role, password string) (models.MarketStaff, error) {
+	ctx, span := tracer.Start(ctx, "DBService.CreateMarketStaff")
+	defer span.End()
+	if !IsValidStaffRole(role) {
+		return models.MarketStaff{}, ErrInvalidStaffRole
+	}
+
+	// Staff phones share the market login namespace with owner phones
+	var exists bool
+	err := s.db.QueryRowContext(ctx, `
+		SELECT EXISTS(SELECT 1 FROM markets WHERE phone = ?) OR EXISTS(SELECT 1 FROM market_staff WHERE phone = ?)`,
+		phone, phone).Scan(&exists)
+	if err != nil {
+		return models.MarketStaff{}, fmt.Errorf("failed to check phone: %v", err)
+	}
+	if exists {
+		return models.MarketStaff{}, ErrPhoneTaken
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return models.MarketStaff{}, fmt.Errorf("failed to hash password: %v", err)
+	}
+
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO market_staff (market_id, full_name, phone, password, role)
+		VALUES (?, ?, ?, ?, ?)`,
+		marketID, fullName, phone, passwordHash, role)
+	if err != nil {
+		if strings.Contains(err.Error(), "Duplicate entry") {
+			return models.MarketStaff{}, ErrPhoneTaken
+		}
+		return models.MarketStaff{}, fmt.Errorf("failed to create staff: %v", err)
+	}
+
+	staffID, err := result.LastInsertId()
+	if err != nil {
+		return models.MarketStaff{}, fmt.Errorf("failed to retrieve staff ID: %v", err)
+	}
+
+	return s.getMarketStaffByID(ctx, marketID, int(staffID))
+}
+
+// GetMarketStaff retrieves all staff accounts of a market
+func (s *DBService) GetMarketStaff(ctx context.Context, marketID int) ([]models.MarketStaff, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetMarketStaff")
+	defer span.End()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, market_id, full_name, phone, role, is_active, created_at
+		FROM market_staff
+		WHERE market_id = ?
+		ORDER BY id DESC`, marketID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query staff: %v", err)
+	}
+	defer rows.Close()
+
+	staff := []models.MarketStaff{}
+	for rows.Next() {
+		var m models.MarketStaff
+		if err := rows.Scan(&m.ID, &m.MarketID, &m.FullName, &m.Phone, &m.Role, &m.IsActive, &m.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan staff: %v", err)
+		}
+		staff = append(staff, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating staff: %v", err)
+	}
+
+	return staff, nil
+}
+
+// getMarketStaffByID retrieves a staff account belonging to a market
+func (s *DBService) getMarketStaffByID(ctx context.Context, marketID, staffID int) (models.MarketStaff, error) {
+	var m models.MarketStaff
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, market_id, full_name, phone, role, is_active, created_at
+		FROM market_staff
+		WHERE id = ? AND market_id = ?`, staffID, marketID).
+		Scan(&m.ID, &m.MarketID, &m.FullName, &m.Phone, &m.Role, &m.IsActive, &m.CreatedAt)
+	if err == sql.ErrNoRows {
+		return models.MarketStaff{}, ErrStaffNotFound
+	}
+	if err != nil {
+		return models.MarketStaff{}, fmt.Errorf("failed to fetch staff: %v", err)
+	}
+	return m, nil
+}
+
+// UpdateMarketStaff changes the role and/or active flag of a staff account
+func (s *DBService) UpdateMarketStaff(ctx context.Context, marketID, staffID int, req models.UpdateMarketStaffRequest) (models.MarketStaff, error) {
+	ctx, span := tracer.Start(ctx, "DBService.UpdateMarketStaff")
+	defer span.End()
+	var setClauses []string
+	var args []interface{}
+
+	if req.Role != nil {
+		if !IsValidStaffRole(*req.Role) {
+			return models.MarketStaff{}, ErrInvalidStaffRole
+		}
+		setClauses = append(setClauses, "role = ?")
+		args = append(args, *req.Role)
+	}
+	if req.IsActive != nil {
+		setClauses = append(setClauses, "is_active = ?")
+		args = append(args, *req.IsActive)
+	}
+	if len(setClauses) == 0 {
+		return models.MarketStaff{}, ErrNoFieldsToUpdate
+	}
+
+	// Make sure the staff member belongs to the market before touching it
+	if _, err := s.getMarketStaffByID(ctx, marketID, staffID); err != nil {
+		return models.MarketStaff{}, err
+	}
+
+	query := fmt.Sprintf("UPDATE market_staff SET %s WHERE id = ? AND market_id = ?", strings.Join(setClauses, ", "))
+	args = append(args, staffID, marketID)
+	if _, err := s.db.ExecContext(ctx, query, args...); err != nil {
+		return models.MarketStaff{}, fmt.Errorf("failed to update staff: %v", err)
+	}
+
+	return s.getMarketStaffByID(ctx, marketID, staffID)
+}
+
+// ResetMarketStaffPassword replaces the password of a staff account
+func (s *DBService) ResetMarketStaffPassword(ctx context.Context, marketID, staffID int, password string) error {
+	ctx, span := tracer.Start(ctx, "DBService.ResetMarketStaffPassword")
+	defer span.End()
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %v", err)
+	}
+
+	result, err := s.db.ExecContext(ctx, "UPDATE market_staff SET password = ? WHERE id = ? AND market_id = ?", passwordHash, staffID, marketID)
+	if err != nil {
+		return fmt.Errorf("failed to reset password: %v", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to check rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		return ErrStaffNotFound
+	}
+	return nil
+}
+
+// ChangeMarketStaffPassword lets a staff member replace their own password
+func (s *DBService) ChangeMarketStaffPassword(ctx context.Context, staffID int, oldPassword, newPassword string) error {
+	ctx, span := tracer.Start(ctx, "DBService.ChangeMarketStaffPassword")
+	defer span.End()
+	var passwordHash string
+	err := s.db.QueryRowContext(ctx, "SELECT password FROM market_staff WHERE id = ? AND is_active = 1", staffID).Scan(&passwordHash)
+	if err == sql.ErrNoRows {
+		return ErrStaffNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query staff: %v", err)
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(oldPassword)); err != nil {
+		return ErrInvalidCredentials
+	}
+
+	newHash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %v", err)
+	}
+	if _, err := s.db.ExecContext(ctx, "UPDATE market_staff SET password = ? WHERE id = ?", newHash, staffID); err != nil {
+		return fmt.Errorf("failed to update password: %v", err)
+	}
+	return nil
+}
+
+// AuthenticateMarketStaff authenticates an active market staff member
+func (s *DBService) AuthenticateMarketStaff(ctx context.Context, phone, password string) (models.MarketStaff, error) {
+	ctx, span := tracer.Start(ctx, "DBService.AuthenticateMarketStaff")
+	defer span.End()
+	var m models.MarketStaff
+	var passwordHash string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, market_id, full_name, phone, role, is_active, created_at, password
+		FROM market_staff WHERE phone = ?`, phone).
+		Scan(&m.ID, &m.MarketID, &m.FullName, &m.Phone, &m.Role, &m.IsActive, &m.CreatedAt, &passwordHash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return models.MarketStaff{}, ErrInvalidCredentials
+		}
+		return models.MarketStaff{}, fmt.Errorf("failed to query staff: %v", err)
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)); err != nil {
+		return models.MarketStaff{}, ErrInvalidCredentials
+	}
+	if !m.IsActive {
+		return models.MarketStaff{}, ErrAccountDisabled
+	}
+
+	return m, nil
+}
+
+// GetMarketStaffAccess returns the current market, role and active flag of a staff account
+func (s *DBService) GetMarketStaffAccess(ctx context.Context, staffID int) (int, string, bool, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetMarketStaffAccess")
+	defer span.End()
+	var marketID int
+	var role string
+	var isActive bool
+	err := s.db.QueryRowContext(ctx, "SELECT market_id, role, is_active FROM market_staff WHERE id = ?", staffID).
+		Scan(&marketID, &role, &isActive)
+	if err == sql.ErrNoRows {
+		return 0, "", false, ErrStaffNotFound
+	}
+	if err != nil {
+		return 0, "", false, fmt.Errorf("failed to query staff: %v", err)
+	}
+	return marketID, role, isActive, nil
+}
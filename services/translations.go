@@ -0,0 +1,525 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"Dowlet_projects/ecommerce/models"
+)
+
+// Locales with their own columns
+const (
+	// baseLocale is the language of the plain text columns such as products.name
+	baseLocale = "en"
+	// legacyLocale is the language of the *_ru columns, kept for clients reading name_ru and the like
+	legacyLocale = "ru"
+)
+
+// localePattern matches normalized language tags such as tk, ru or pt-br
+var localePattern = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})?$`)
+
+// translatableField is a text field of an entity. The base locale lives in column and Russian in
+// legacyColumn; other locales live in the translations table.
+type translatableField struct {
+	column       string
+	legacyColumn string
+	required     bool
+}
+
+// translatableEntity describes a table whose texts can be translated
+type translatableEntity struct {
+	fields map[string]translatableField
+	// marketQuery returns the market an entity belongs to, 0 for shared entities
+	marketQuery string
+	// catalog entities belong to a market's catalog and can be translated by its admins
+	catalog bool
+}
+
+// translatableEntities maps entity types, which are table names, to their translatable fields
+var translatableEntities = map[string]translatableEntity{
+	"products": {
+		fields: map[string]translatableField{
+			"name":        {column: "name", legacyColumn: "name_ru", required: true},
+			"description": {column: "description", legacyColumn: "description_ru"},
+		},
+		marketQuery: "SELECT market_id FROM products WHERE id = ?",
+		catalog:     true,
+	},
+	"thumbnails": {
+		fields: map[string]translatableField{
+			"color": {column: "color", legacyColumn: "color_ru"},
+		},
+		marketQuery: "SELECT p.market_id FROM thumbnails t JOIN products p ON p.id = t.product_id WHERE t.id = ?",
+		catalog:     true,
+	},
+	"product_options": {
+		fields: map[string]translatableField{
+			"name": {column: "name", legacyColumn: "name_ru", required: true},
+		},
+		marketQuery: "SELECT p.market_id FROM product_options o JOIN products p ON p.id = o.product_id WHERE o.id = ?",
+		catalog:     true,
+	},
+	"categories": {
+		fields: map[string]translatableField{
+			"name": {column: "name", legacyColumn: "name_ru", required: true},
+		},
+		marketQuery: "SELECT 0 FROM categories WHERE id = ?",
+	},
+	"markets": {
+		fields: map[string]translatableField{
+			"name":     {column: "name", legacyColumn: "name_ru", required: true},
+			"location": {column: "location", legacyColumn: "location_ru"},
+		},
+		marketQuery: "SELECT id FROM markets WHERE id = ?",
+	},
+}
+
+// NormalizeLocale lower-cases a language tag such as pt_BR and reports whether it is well-formed
+func NormalizeLocale(tag string) (string, bool) {
+	locale := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"))
+	return locale, localePattern.MatchString(locale)
+}
+
+// GetLocales lists the locales texts exist in: the base locale, Russian and every locale with
+// translations
+func (s *DBService) GetLocales(ctx context.Context) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetLocales")
+	defer span.End()
+	rows, err := s.db.QueryContext(ctx, "SELECT DISTINCT locale FROM translations ORDER BY locale")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query locales: %v", err)
+	}
+	defer rows.Close()
+
+	locales := []string{baseLocale, legacyLocale}
+	for rows.Next() {
+		var locale string
+		if err := rows.Scan(&locale); err != nil {
+			return nil, fmt.Errorf("failed to scan locale: %v", err)
+		}
+		if locale != baseLocale && locale != legacyLocale {
+			locales = append(locales, locale)
+		}
+	}
+	return locales, rows.Err()
+}
+
+// translationOwner checks that an entity exists and returns the market it belongs to. With a
+// marketID, only catalog entities of that market are found.
+func (s *DBService) translationOwner(ctx context.Context, q execer, entityType string, entityID, marketID int) (translatableEntity, int, error) {
+	entity, ok := translatableEntities[entityType]
+	if !ok || (marketID != 0 && !entity.catalog) {
+		return entity, 0, ErrUnknownEntityType
+	}
+	var owner int
+	err := q.QueryRowContext(ctx, entity.marketQuery, entityID).Scan(&owner)
+	if err == sql.ErrNoRows || (err == nil && marketID != 0 && owner != marketID) {
+		return entity, 0, ErrEntityNotFound
+	}
+	if err != nil {
+		return entity, 0, fmt.Errorf("failed to query %s: %v", entityType, err)
+	}
+	return entity, owner, nil
+}
+
+// sortedFields returns the field names of an entity in a stable order
+func (e translatableEntity) sortedFields() []string {
+	fields := make([]string, 0, len(e.fields))
+	for field := range e.fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// GetTranslations returns the texts of an entity by field and locale, including the base locale
+// and Russian columns. A marketID limits the lookup to that market's catalog.
+func (s *DBService) GetTranslations(ctx context.Context, entityType string, entityID, marketID int) (models.EntityTranslations, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetTranslations")
+	defer span.End()
+	entity, _, err := s.translationOwner(ctx, s.db, entityType, entityID, marketID)
+	if err != nil {
+		return models.EntityTranslations{}, err
+	}
+
+	fields := entity.sortedFields()
+	columns := make([]string, 0, 2*len(fields))
+	values := make([]string, 2*len(fields))
+	dest := make([]interface{}, 0, 2*len(fields))
+	for i, field := range fields {
+		f := entity.fields[field]
+		columns = append(columns, "COALESCE("+f.column+", '')", "COALESCE("+f.legacyColumn+", '')")
+		dest = append(dest, &values[2*i], &values[2*i+1])
+	}
+	query := "SELECT " + strings.Join(columns, ", ") + " FROM " + entityType + " WHERE id = ?"
+	if err := s.db.QueryRowContext(ctx, query, entityID).Scan(dest...); err != nil {
+		return models.EntityTranslations{}, fmt.Errorf("failed to query %s: %v", entityType, err)
+	}
+
+	result := models.EntityTranslations{
+		EntityType:   entityType,
+		EntityID:     entityID,
+		Translations: make(map[string]map[string]string),
+	}
+	for i, field := range fields {
+		result.Translations[field] = map[string]string{baseLocale: values[2*i]}
+		if values[2*i+1] != "" {
+			result.Translations[field][legacyLocale] = values[2*i+1]
+		}
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT field, locale, value FROM translations
+		WHERE entity_type = ? AND entity_id = ?`, entityType, entityID)
+	if err != nil {
+		return models.EntityTranslations{}, fmt.Errorf("failed to query translations: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var field, locale, value string
+		if err := rows.Scan(&field, &locale, &value); err != nil {
+			return models.EntityTranslations{}, fmt.Errorf("failed to scan translation: %v", err)
+		}
+		if texts, ok := result.Translations[field]; ok {
+			texts[locale] = value
+		}
+	}
+	return result, rows.Err()
+}
+
+// SetTranslations sets texts of an entity by field and locale. Base locale and Russian texts go to
+// the entity's own columns; an empty text removes a translation in any other locale. A marketID
+// limits the change to that market's catalog.
+func (s *DBService) SetTranslations(ctx context.Context, entityType string, entityID, marketID int, translations map[string]map[string]string) error {
+	ctx, span := tracer.Start(ctx, "DBService.SetTranslations")
+	defer span.End()
+	if len(translations) == 0 {
+		return ErrNoTranslations
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	entity, owner, err := s.translationOwner(ctx, tx, entityType, entityID, marketID)
+	if err != nil {
+		return err
+	}
+
+	var updates []string
+	var args []interface{}
+	for field, texts := range translations {
+		f, ok := entity.fields[field]
+		if !ok {
+			return ErrUnknownTranslationField
+		}
+		for tag, text := range texts {
+			locale, ok := NormalizeLocale(tag)
+			if !ok {
+				return ErrInvalidLocale
+			}
+			text = strings.TrimSpace(text)
+			switch locale {
+			case baseLocale:
+				if text == "" && f.required {
+					return ErrBaseTextRequired
+				}
+				updates = append(updates, f.column+" = ?")
+				args = append(args, text)
+			case legacyLocale:
+				updates = append(updates, f.legacyColumn+" = ?")
+				args = append(args, text)
+			default:
+				if text == "" {
+					_, err = tx.ExecContext(ctx, `
+						DELETE FROM translations
+						WHERE entity_type = ? AND entity_id = ? AND field = ? AND locale = ?`,
+						entityType, entityID, field, locale)
+				} else {
+					_, err = tx.ExecContext(ctx, `
+						INSERT INTO translations (entity_type, entity_id, field, locale, value)
+						VALUES (?, ?, ?, ?, ?)
+						ON DUPLICATE KEY UPDATE value = VALUES(value)`,
+						entityType, entityID, field, locale, text)
+				}
+				if err != nil {
+					return fmt.Errorf("failed to save translation: %v", err)
+				}
+			}
+		}
+	}
+
+	if len(updates) > 0 {
+		args = append(args, entityID)
+		if _, err := tx.ExecContext(ctx, "UPDATE "+entityType+" SET "+strings.Join(updates, ", ")+" WHERE id = ?", args...); err != nil {
+			if strings.Contains(err.Error(), "Duplicate entry") {
+				return ErrNameTaken
+			}
+			return fmt.Errorf("failed to update %s: %v", entityType, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	// Other locales are applied after the caches are read; only column changes are cached
+	if len(updates) > 0 {
+		if entityType == "categories" {
+			s.invalidateCategoryCaches(ctx)
+		} else {
+			sets := []string{"global_products_cache_keys", "markets_cache_keys"}
+			if owner != 0 {
+				sets = append(sets, fmt.Sprintf("market:%d:products_cache_keys", owner))
+			}
+			s.invalidateCacheSets(ctx, sets...)
+		}
+	}
+	return nil
+}
+
+// deleteTranslations removes the translations of an entity that is being deleted
+func deleteTranslations(ctx context.Context, q execer, entityType string, entityID interface{}) error {
+	if _, err := q.ExecContext(ctx, "DELETE FROM translations WHERE entity_type = ? AND entity_id = ?", entityType, entityID); err != nil {
+		return fmt.Errorf("failed to delete translations: %v", err)
+	}
+	return nil
+}
+
+// deleteProductTranslations removes the translations of the products matching where, and of their
+// thumbnails and options, before the products are deleted
+func deleteProductTranslations(ctx context.Context, q execer, where string, arg interface{}) error {
+	products := "SELECT id FROM products WHERE " + where
+	_, err := q.ExecContext(ctx, `
+		DELETE FROM translations
+		WHERE (entity_type = 'products' AND entity_id IN (`+products+`))
+		   OR (entity_type = 'thumbnails' AND entity_id IN (SELECT id FROM thumbnails WHERE product_id IN (`+products+`)))
+		   OR (entity_type = 'product_options' AND entity_id IN (SELECT id FROM product_options WHERE product_id IN (`+products+`)))`,
+		arg, arg, arg)
+	if err != nil {
+		return fmt.Errorf("failed to delete translations: %v", err)
+	}
+	return nil
+}
+
+// translationKey identifies a text of an entity in a locale
+type translationKey struct {
+	entityType string
+	entityID   int
+	field      string
+	locale     string
+}
+
+// localizer picks texts in the first of a request's locales that has one, falling back to the base
+// locale. Entities are registered with want, then loaded in one query per entity type.
+type localizer struct {
+	// locales are the requested locales in order of preference, up to the base locale
+	locales []string
+	wanted  map[string]map[int]bool
+	texts   map[translationKey]string
+}
+
+func newLocalizer(locales []string) *localizer {
+	l := &localizer{wanted: make(map[string]map[int]bool), texts: make(map[translationKey]string)}
+	seen := make(map[string]bool)
+	for _, locale := range locales {
+		if locale == baseLocale || strings.HasPrefix(locale, baseLocale+"-") {
+			break
+		}
+		if !seen[locale] {
+			seen[locale] = true
+			l.locales = append(l.locales, locale)
+		}
+	}
+	return l
+}
+
+// active reports whether any text can differ from the base locale
+func (l *localizer) active() bool {
+	return len(l.locales) > 0
+}
+
+func (l *localizer) want(entityType string, entityID int) {
+	if l.wanted[entityType] == nil {
+		l.wanted[entityType] = make(map[int]bool)
+	}
+	l.wanted[entityType][entityID] = true
+}
+
+// load fetches the translations of the wanted entities. Russian needs no query as it is read from
+// the entities' own columns.
+func (l *localizer) load(ctx context.Context, q execer) error {
+	var locales []interface{}
+	for _, locale := range l.locales {
+		if locale != legacyLocale {
+			locales = append(locales, locale)
+		}
+	}
+	if len(locales) == 0 {
+		return nil
+	}
+
+	for entityType, ids := range l.wanted {
+		args := []interface{}{entityType}
+		for id := range ids {
+			args = append(args, id)
+		}
+		args = append(args, locales...)
+		rows, err := q.QueryContext(ctx, `
+			SELECT entity_id, field, locale, value FROM translations
+			WHERE entity_type = ? AND entity_id IN (`+placeholders(len(ids))+`) AND locale IN (`+placeholders(len(locales))+`)`,
+			args...)
+		if err != nil {
+			return fmt.Errorf("failed to query translations: %v", err)
+		}
+		for rows.Next() {
+			key := translationKey{entityType: entityType}
+			var value string
+			if err := rows.Scan(&key.entityID, &key.field, &key.locale, &value); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan translation: %v", err)
+			}
+			l.texts[key] = value
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read translations: %v", err)
+		}
+	}
+	return nil
+}
+
+// text returns a field in the preferred locale; base and legacy are the entity's own column values
+func (l *localizer) text(entityType string, entityID int, field, base, legacy string) string {
+	for _, locale := range l.locales {
+		if locale == legacyLocale {
+			if legacy != "" {
+				return legacy
+			}
+			continue
+		}
+		if text := l.texts[translationKey{entityType, entityID, field, locale}]; text != "" {
+			return text
+		}
+	}
+	return base
+}
+
+// LocalizeProducts replaces the texts of products, including their market, category, breadcrumbs,
+// thumbnails and options, with the first of locales they are translated to. The *_ru fields are
+// left as they are.
+func (s *DBService) LocalizeProducts(ctx context.Context, locales []string, products []models.Product) error {
+	ctx, span := tracer.Start(ctx, "DBService.LocalizeProducts")
+	defer span.End()
+	l := newLocalizer(locales)
+	if !l.active() || len(products) == 0 {
+		return nil
+	}
+	for _, p := range products {
+		l.want("products", p.ID)
+		l.want("markets", p.MarketID)
+		l.want("categories", p.CategoryID)
+		for _, c := range p.Breadcrumbs {
+			l.want("categories", c.ID)
+		}
+		for _, t := range p.Thumbnails {
+			l.want("thumbnails", t.ID)
+		}
+		for _, o := range p.Options {
+			l.want("product_options", o.ID)
+		}
+		for _, v := range p.Variants {
+			for _, a := range v.Attributes {
+				l.want("product_options", a.OptionID)
+			}
+		}
+	}
+	if err := l.load(ctx, s.db); err != nil {
+		return err
+	}
+
+	for i := range products {
+		p := &products[i]
+		p.Name = l.text("products", p.ID, "name", p.Name, p.NameRu)
+		p.Description = l.text("products", p.ID, "description", p.Description, p.DescriptionRu)
+		p.MarketName = l.text("markets", p.MarketID, "name", p.MarketName, p.MarketNameRu)
+		p.CategoryName = l.text("categories", p.CategoryID, "name", p.CategoryName, p.CategoryNameRu)
+		for j := range p.Breadcrumbs {
+			c := &p.Breadcrumbs[j]
+			c.Name = l.text("categories", c.ID, "name", c.Name, c.NameRu)
+		}
+		for j := range p.Thumbnails {
+			t := &p.Thumbnails[j]
+			t.Color = l.text("thumbnails", t.ID, "color", t.Color, t.ColorRu)
+		}
+		for j := range p.Options {
+			o := &p.Options[j]
+			o.Name = l.text("product_options", o.ID, "name", o.Name, o.NameRu)
+		}
+		for j := range p.Variants {
+			for k := range p.Variants[j].Attributes {
+				a := &p.Variants[j].Attributes[k]
+				a.Name = l.text("product_options", a.OptionID, "name", a.Name, a.NameRu)
+			}
+		}
+	}
+	return nil
+}
+
+// LocalizeCategories replaces category names, down through the children of a tree, with the first
+// of locales they are translated to
+func (s *DBService) LocalizeCategories(ctx context.Context, locales []string, categories []models.Category) error {
+	ctx, span := tracer.Start(ctx, "DBService.LocalizeCategories")
+	defer span.End()
+	l := newLocalizer(locales)
+	if !l.active() || len(categories) == 0 {
+		return nil
+	}
+	var walk func(categories []models.Category, apply bool)
+	walk = func(categories []models.Category, apply bool) {
+		for i := range categories {
+			c := &categories[i]
+			if apply {
+				c.Name = l.text("categories", c.ID, "name", c.Name, c.NameRu)
+			} else {
+				l.want("categories", c.ID)
+			}
+			walk(c.Children, apply)
+		}
+	}
+	walk(categories, false)
+	if err := l.load(ctx, s.db); err != nil {
+		return err
+	}
+	walk(categories, true)
+	return nil
+}
+
+// LocalizeMarkets replaces market names and locations with the first of locales they are
+// translated to
+func (s *DBService) LocalizeMarkets(ctx context.Context, locales []string, markets []models.Market) error {
+	ctx, span := tracer.Start(ctx, "DBService.LocalizeMarkets")
+	defer span.End()
+	l := newLocalizer(locales)
+	if !l.active() || len(markets) == 0 {
+		return nil
+	}
+	for _, m := range markets {
+		l.want("markets", m.ID)
+	}
+	if err := l.load(ctx, s.db); err != nil {
+		return err
+	}
+	for i := range markets {
+		m := &markets[i]
+		m.Name = l.text("markets", m.ID, "name", m.Name, m.NameRu)
+		m.Location = l.text("markets", m.ID, "location", m.Location, m.LocationRu)
+	}
+	return nil
+}
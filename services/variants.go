@@ -0,0 +1,723 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"Dowlet_projects/ecommerce/models"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// execer is implemented by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// GetProductOptions retrieves the option axes of a product
+func (s *DBService) GetProductOptions(ctx context.Context, productID int) ([]models.ProductOption, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetProductOptions")
+	defer span.End()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, product_id, name, name_ru, position
+		FROM product_options
+		WHERE product_id = ?
+		ORDER BY position, id`, productID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query product options: %v", err)
+	}
+	defer rows.Close()
+
+	options := []models.ProductOption{}
+	for rows.Next() {
+		var o models.ProductOption
+		if err := rows.Scan(&o.ID, &o.ProductID, &o.Name, &o.NameRu, &o.Position); err != nil {
+			return nil, fmt.Errorf("failed to scan product option: %v", err)
+		}
+		options = append(options, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating product options: %v", err)
+	}
+	return options, nil
+}
+
+// GetProductVariants retrieves the variants of a product with their attributes and images
+func (s *DBService) GetProductVariants(ctx context.Context, productID int, activeOnly bool) ([]models.ProductVariant, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetProductVariants")
+	defer span.End()
+	query := `
+		SELECT v.id, v.product_id, v.sku, COALESCE(v.barcode, ''), v.price, v.compare_at_price,
+			v.price * (1 - COALESCE(p.discount, 0)/100), v.stock, v.is_active, v.position
+		FROM product_variants v
+		JOIN products p ON v.product_id = p.id
+		WHERE v.product_id = ?`
+	if activeOnly {
+		query += ` AND v.is_active = 1`
+	}
+	query += ` ORDER BY v.position, v.id`
+
+	rows, err := s.db.QueryContext(ctx, query, productID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query variants: %v", err)
+	}
+	defer rows.Close()
+
+	variants := []models.ProductVariant{}
+	var variantIDs []int
+	for rows.Next() {
+		var v models.ProductVariant
+		var compareAt sql.NullFloat64
+		if err := rows.Scan(&v.ID, &v.ProductID, &v.SKU, &v.Barcode, &v.Price, &compareAt,
+			&v.FinalPrice, &v.Stock, &v.IsActive, &v.Position); err != nil {
+			return nil, fmt.Errorf("failed to scan variant: %v", err)
+		}
+		if compareAt.Valid {
+			v.CompareAtPrice = &compareAt.Float64
+		}
+		v.FinalPrice = math.Round(v.FinalPrice*100) / 100
+		variants = append(variants, v)
+		variantIDs = append(variantIDs, v.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating variants: %v", err)
+	}
+
+	attributes, err := s.getVariantAttributes(ctx, variantIDs)
+	if err != nil {
+		return nil, err
+	}
+	images, err := s.getVariantImages(ctx, variantIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range variants {
+		variants[i].Attributes = attributes[variants[i].ID]
+		if variants[i].Attributes == nil {
+			variants[i].Attributes = []models.VariantAttribute{}
+		}
+		variants[i].Images = images[variants[i].ID]
+		if variants[i].Images == nil {
+			variants[i].Images = []models.VariantImage{}
+		}
+	}
+
+	return variants, nil
+}
+
+// getVariantAttributes retrieves the option values of the given variants keyed by variant ID
+func (s *DBService) getVariantAttributes(ctx context.Context, variantIDs []int) (map[int][]models.VariantAttribute, error) {
+	result := make(map[int][]models.VariantAttribute)
+	if len(variantIDs) == 0 {
+		return result, nil
+	}
+
+	args := make([]interface{}, len(variantIDs))
+	for i, id := range variantIDs {
+		args[i] = id
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT vv.variant_id, o.id, o.name, o.name_ru, vv.value, vv.value_ru
+		FROM product_variant_values vv
+		JOIN product_options o ON vv.option_id = o.id
+		WHERE vv.variant_id IN (`+placeholders(len(args))+`)
+		ORDER BY o.position, o.id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query variant attributes: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var variantID int
+		var a models.VariantAttribute
+		if err := rows.Scan(&variantID, &a.OptionID, &a.Name, &a.NameRu, &a.Value, &a.ValueRu); err != nil {
+			return nil, fmt.Errorf("failed to scan variant attribute: %v", err)
+		}
+		result[variantID] = append(result[variantID], a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating variant attributes: %v", err)
+	}
+	return result, nil
+}
+
+// getVariantImages retrieves the images of the given variants keyed by variant ID
+func (s *DBService) getVariantImages(ctx context.Context, variantIDs []int) (map[int][]models.VariantImage, error) {
+	result := make(map[int][]models.VariantImage)
+	if len(variantIDs) == 0 {
+		return result, nil
+	}
+
+	args := make([]interface{}, len(variantIDs))
+	for i, id := range variantIDs {
+		args[i] = id
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, variant_id, image_url, position
+		FROM product_variant_images
+		WHERE variant_id IN (`+placeholders(len(args))+`)
+		ORDER BY position, id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query variant images: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var img models.VariantImage
+		if err := rows.Scan(&img.ID, &img.VariantID, &img.ImageURL, &img.Position); err != nil {
+			return nil, fmt.Errorf("failed to scan variant image: %v", err)
+		}
+		result[img.VariantID] = append(result[img.VariantID], img)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating variant images: %v", err)
+	}
+	return result, nil
+}
+
+// attributeValue returns the value of the named option, used to fill legacy color/size fields
+func attributeValue(attributes []models.VariantAttribute, name string) (string, string) {
+	for _, a := range attributes {
+		if strings.EqualFold(a.Name, name) {
+			return a.Value, a.ValueRu
+		}
+	}
+	return "", ""
+}
+
+// CreateVariant creates a variant for a product of the market
+func (s *DBService) CreateVariant(ctx context.Context, marketID, productID int, req models.CreateVariantRequest) (models.ProductVariant, error) {
+	ctx, span := tracer.Start(ctx, "DBService.CreateVariant")
+	defer span.End()
+	if req.Stock < 0 {
+		return models.ProductVariant{}, ErrNegativeStock
+	}
+	if req.Price != nil && *req.Price < 0 {
+		return models.ProductVariant{}, ErrNegativePrice
+	}
+	if err := validateVariantAttributes(req.Attributes); err != nil {
+		return models.ProductVariant{}, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return models.ProductVariant{}, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var productPrice float64
+	err = tx.QueryRowContext(ctx, "SELECT price FROM products WHERE id = ? AND market_id = ?", productID, marketID).Scan(&productPrice)
+	if err == sql.ErrNoRows {
+		return models.ProductVariant{}, ErrProductNotOwned
+	}
+	if err != nil {
+		return models.ProductVariant{}, fmt.Errorf("failed to validate product: %v", err)
+	}
+
+	price := productPrice
+	if req.Price != nil {
+		price = *req.Price
+	}
+	isActive := true
+	if req.IsActive != nil {
+		isActive = *req.IsActive
+	}
+
+	sku := strings.TrimSpace(req.SKU)
+	if sku != "" {
+		if err := checkSKUAvailable(ctx, tx, marketID, sku, 0); err != nil {
+			return models.ProductVariant{}, err
+		}
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO product_variants (product_id, sku, barcode, price, compare_at_price, stock, is_active, position)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		productID, sku, nullIfEmpty(strings.TrimSpace(req.Barcode)), price, req.CompareAtPrice, req.Stock, isActive, req.Position)
+	if err != nil {
+		return models.ProductVariant{}, fmt.Errorf("failed to insert variant: %v", err)
+	}
+	variantID64, err := result.LastInsertId()
+	if err != nil {
+		return models.ProductVariant{}, fmt.Errorf("failed to retrieve variant ID: %v", err)
+	}
+	variantID := int(variantID64)
+
+	// Generate a SKU when none was given
+	if sku == "" {
+		if _, err := tx.ExecContext(ctx, "UPDATE product_variants SET sku = ? WHERE id = ?",
+			fmt.Sprintf("P%d-V%d", productID, variantID), variantID); err != nil {
+			return models.ProductVariant{}, fmt.Errorf("failed to set variant SKU: %v", err)
+		}
+	}
+
+	if err := setVariantAttributes(ctx, tx, productID, variantID, req.Attributes); err != nil {
+		return models.ProductVariant{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.ProductVariant{}, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	s.invalidateMarketProductCaches(ctx, marketID)
+
+	return s.getVariant(ctx, marketID, variantID)
+}
+
+// UpdateVariant updates a variant belonging to the market
+func (s *DBService) UpdateVariant(ctx context.Context, marketID, variantID int, req models.UpdateVariantRequest) (models.ProductVariant, error) {
+	ctx, span := tracer.Start(ctx, "DBService.UpdateVariant")
+	defer span.End()
+	if req.Stock != nil && *req.Stock < 0 {
+		return models.ProductVariant{}, ErrNegativeStock
+	}
+	if req.Price != nil && *req.Price < 0 {
+		return models.ProductVariant{}, ErrNegativePrice
+	}
+	if err := validateVariantAttributes(req.Attributes); err != nil {
+		return models.ProductVariant{}, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return models.ProductVariant{}, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	productID, _, err := variantOwner(ctx, tx, marketID, variantID)
+	if err != nil {
+		return models.ProductVariant{}, err
+	}
+
+	var setClauses []string
+	var args []interface{}
+	if req.SKU != nil {
+		sku := strings.TrimSpace(*req.SKU)
+		if sku == "" {
+			return models.ProductVariant{}, ErrSKURequired
+		}
+		if err := checkSKUAvailable(ctx, tx, marketID, sku, variantID); err != nil {
+			return models.ProductVariant{}, err
+		}
+		setClauses = append(setClauses, "sku = ?")
+		args = append(args, sku)
+	}
+	if req.Barcode != nil {
+		setClauses = append(setClauses, "barcode = ?")
+		args = append(args, nullIfEmpty(strings.TrimSpace(*req.Barcode)))
+	}
+	if req.Price != nil {
+		setClauses = append(setClauses, "price = ?")
+		args = append(args, *req.Price)
+	}
+	if req.CompareAtPrice != nil {
+		// A zero compare-at price clears it
+		setClauses = append(setClauses, "compare_at_price = ?")
+		if *req.CompareAtPrice > 0 {
+			args = append(args, *req.CompareAtPrice)
+		} else {
+			args = append(args, nil)
+		}
+	}
+	if req.Stock != nil {
+		setClauses = append(setClauses, "stock = ?")
+		args = append(args, *req.Stock)
+	}
+	if req.IsActive != nil {
+		setClauses = append(setClauses, "is_active = ?")
+		args = append(args, *req.IsActive)
+	}
+	if req.Position != nil {
+		setClauses = append(setClauses, "position = ?")
+		args = append(args, *req.Position)
+	}
+	if len(setClauses) == 0 && len(req.Attributes) == 0 {
+		return models.ProductVariant{}, ErrNoFieldsToUpdate
+	}
+
+	if len(setClauses) > 0 {
+		query := fmt.Sprintf("UPDATE product_variants SET %s WHERE id = ?", strings.Join(setClauses, ", "))
+		if _, err := tx.ExecContext(ctx, query, append(args, variantID)...); err != nil {
+			return models.ProductVariant{}, fmt.Errorf("failed to update variant: %v", err)
+		}
+	}
+	if err := setVariantAttributes(ctx, tx, productID, variantID, req.Attributes); err != nil {
+		return models.ProductVariant{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.ProductVariant{}, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	s.invalidateMarketProductCaches(ctx, marketID)
+
+	return s.getVariant(ctx, marketID, variantID)
+}
+
+// DeleteVariant deletes a variant belonging to the market, together with its legacy size row
+func (s *DBService) DeleteVariant(ctx context.Context, marketID, variantID int) error {
+	ctx, span := tracer.Start(ctx, "DBService.DeleteVariant")
+	defer span.End()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, legacySizeID, err := variantOwner(ctx, tx, marketID, variantID)
+	if err != nil {
+		return err
+	}
+
+	// Images shared with a legacy thumbnail stay on disk; the thumbnail still uses them
+	rows, err := tx.QueryContext(ctx, "SELECT image_url FROM product_variant_images WHERE variant_id = ? AND legacy_thumbnail_id IS NULL", variantID)
+	if err != nil {
+		return fmt.Errorf("failed to query variant images: %v", err)
+	}
+	var imageURLs []string
+	for rows.Next() {
+		var imageURL string
+		if err := rows.Scan(&imageURL); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan variant image: %v", err)
+		}
+		imageURLs = append(imageURLs, imageURL)
+	}
+	rows.Close()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM product_variants WHERE id = ?", variantID); err != nil {
+		return fmt.Errorf("failed to delete variant: %v", err)
+	}
+	if legacySizeID != 0 {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM sizes WHERE id = ?", legacySizeID); err != nil {
+			return fmt.Errorf("failed to delete legacy size: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	s.scheduleUploadRemoval(ctx, imageURLs)
+	s.invalidateMarketProductCaches(ctx, marketID)
+
+	return nil
+}
+
+// AddVariantImages attaches uploaded images to a variant belonging to the market
+func (s *DBService) AddVariantImages(ctx context.Context, marketID, variantID int, imageURLs []string) ([]models.VariantImage, error) {
+	ctx, span := tracer.Start(ctx, "DBService.AddVariantImages")
+	defer span.End()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, _, err := variantOwner(ctx, tx, marketID, variantID); err != nil {
+		return nil, err
+	}
+
+	var position int
+	if err := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(position), -1) + 1 FROM product_variant_images WHERE variant_id = ?", variantID).Scan(&position); err != nil {
+		return nil, fmt.Errorf("failed to determine image position: %v", err)
+	}
+
+	images := make([]models.VariantImage, 0, len(imageURLs))
+	for i, imageURL := range imageURLs {
+		result, err := tx.ExecContext(ctx, "INSERT INTO product_variant_images (variant_id, image_url, position) VALUES (?, ?, ?)",
+			variantID, imageURL, position+i)
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert variant image: %v", err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve image ID: %v", err)
+		}
+		images = append(images, models.VariantImage{ID: int(id), VariantID: variantID, ImageURL: imageURL, Position: position + i})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	s.invalidateMarketProductCaches(ctx, marketID)
+
+	return images, nil
+}
+
+// DeleteVariantImage removes an image from a variant
+func (s *DBService) DeleteVariantImage(ctx context.Context, marketID, imageID int) error {
+	ctx, span := tracer.Start(ctx, "DBService.DeleteVariantImage")
+	defer span.End()
+	var imageURL string
+	var legacyThumbnailID sql.NullInt64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT i.image_url, i.legacy_thumbnail_id
+		FROM product_variant_images i
+		JOIN product_variants v ON i.variant_id = v.id
+		JOIN products p ON v.product_id = p.id
+		WHERE i.id = ? AND p.market_id = ?`, imageID, marketID).Scan(&imageURL, &legacyThumbnailID)
+	if err == sql.ErrNoRows {
+		return ErrImageNotOwned
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch image: %v", err)
+	}
+
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM product_variant_images WHERE id = ?", imageID); err != nil {
+		return fmt.Errorf("failed to delete image: %v", err)
+	}
+
+	// Images mirrored from a legacy thumbnail are still used by it
+	if !legacyThumbnailID.Valid {
+		s.scheduleUploadRemoval(ctx, []string{imageURL})
+	}
+	s.invalidateMarketProductCaches(ctx, marketID)
+
+	return nil
+}
+
+// removeUploadedFiles deletes uploaded files by their public URL, logging failures
+func removeUploadedFiles(imageURLs []string) {
+	for _, imageURL := range imageURLs {
+		if !strings.HasPrefix(imageURL, "/uploads/") {
+			continue
+		}
+		filePath := filepath.Join(".", filepath.FromSlash(strings.TrimPrefix(imageURL, "/")))
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			slog.Warn("Failed to delete file", "path", filePath, "error", err)
+		}
+	}
+}
+
+// getVariant retrieves a single variant of the market with attributes and images
+func (s *DBService) getVariant(ctx context.Context, marketID, variantID int) (models.ProductVariant, error) {
+	var productID int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT v.product_id FROM product_variants v
+		JOIN products p ON v.product_id = p.id
+		WHERE v.id = ? AND p.market_id = ?`, variantID, marketID).Scan(&productID)
+	if err == sql.ErrNoRows {
+		return models.ProductVariant{}, ErrVariantNotOwned
+	}
+	if err != nil {
+		return models.ProductVariant{}, fmt.Errorf("failed to fetch variant: %v", err)
+	}
+
+	variants, err := s.GetProductVariants(ctx, productID, false)
+	if err != nil {
+		return models.ProductVariant{}, err
+	}
+	for _, v := range variants {
+		if v.ID == variantID {
+			return v, nil
+		}
+	}
+	return models.ProductVariant{}, ErrVariantNotOwned
+}
+
+// GetMarketProductVariants retrieves options and all variants, including inactive ones, of a market's product
+func (s *DBService) GetMarketProductVariants(ctx context.Context, marketID, productID int) ([]models.ProductOption, []models.ProductVariant, error) {
+	ctx, span := tracer.Start(ctx, "DBService.GetMarketProductVariants")
+	defer span.End()
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM products WHERE id = ? AND market_id = ?)", productID, marketID).Scan(&exists); err != nil {
+		return nil, nil, fmt.Errorf("failed to validate product: %v", err)
+	}
+	if !exists {
+		return nil, nil, ErrProductNotOwned
+	}
+
+	options, err := s.GetProductOptions(ctx, productID)
+	if err != nil {
+		return nil, nil, err
+	}
+	variants, err := s.GetProductVariants(ctx, productID, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return options, variants, nil
+}
+
+// variantOwner verifies a variant belongs to the market and returns its product and legacy size IDs
+func variantOwner(ctx context.Context, q execer, marketID, variantID int) (int, int, error) {
+	var productID int
+	var legacySizeID sql.NullInt64
+	err := q.QueryRowContext(ctx, `
+		SELECT v.product_id, v.legacy_size_id
+		FROM product_variants v
+		JOIN products p ON v.product_id = p.id
+		WHERE v.id = ? AND p.market_id = ?`, variantID, marketID).Scan(&productID, &legacySizeID)
+	if err == sql.ErrNoRows {
+		return 0, 0, ErrVariantNotOwned
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to validate variant: %v", err)
+	}
+	return productID, int(legacySizeID.Int64), nil
+}
+
+// checkSKUAvailable ensures no other variant in the market already uses the SKU
+func checkSKUAvailable(ctx context.Context, q execer, marketID int, sku string, exceptVariantID int) error {
+	var exists bool
+	err := q.QueryRowContext(ctx, `
+		SELECT EXISTS(
+			SELECT 1 FROM product_variants v
+			JOIN products p ON v.product_id = p.id
+			WHERE p.market_id = ? AND v.sku = ? AND v.id <> ?
+		)`, marketID, sku, exceptVariantID).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to check sku: %v", err)
+	}
+	if exists {
+		return ErrSKUTaken
+	}
+	return nil
+}
+
+// validateVariantAttributes checks attribute inputs for missing names and duplicate options
+func validateVariantAttributes(attributes []models.VariantAttributeInput) error {
+	seen := make(map[string]bool, len(attributes))
+	for _, a := range attributes {
+		name := strings.ToLower(strings.TrimSpace(a.Name))
+		if name == "" || strings.TrimSpace(a.Value) == "" {
+			return ErrAttributeRequired
+		}
+		if seen[name] {
+			return ErrDuplicateAttribute.WithDetails(map[string]interface{}{"attribute": name}, name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// setVariantAttributes upserts a variant's values, creating product options that do not exist yet
+func setVariantAttributes(ctx context.Context, q execer, productID, variantID int, attributes []models.VariantAttributeInput) error {
+	for _, a := range attributes {
+		name := strings.ToLower(strings.TrimSpace(a.Name))
+		_, err := q.ExecContext(ctx, `
+			INSERT INTO product_options (product_id, name, name_ru, position)
+			SELECT ?, ?, ?, COALESCE(MAX(position), -1) + 1 FROM product_options WHERE product_id = ?
+			ON DUPLICATE KEY UPDATE name_ru = IF(VALUES(name_ru) <> '', VALUES(name_ru), name_ru)`,
+			productID, name, strings.TrimSpace(a.NameRu), productID)
+		if err != nil {
+			return fmt.Errorf("failed to save option %s: %v", name, err)
+		}
+
+		_, err = q.ExecContext(ctx, `
+			INSERT INTO product_variant_values (variant_id, option_id, value, value_ru)
+			SELECT ?, id, ?, ? FROM product_options WHERE product_id = ? AND name = ?
+			ON DUPLICATE KEY UPDATE value = VALUES(value), value_ru = VALUES(value_ru)`,
+			variantID, strings.TrimSpace(a.Value), strings.TrimSpace(a.ValueRu), productID, name)
+		if err != nil {
+			return fmt.Errorf("failed to save value for option %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// syncSizeVariant mirrors a legacy size row, with its thumbnail's color and image, into its variant
+func syncSizeVariant(ctx context.Context, q execer, sizeID int) error {
+	var productID int
+	err := q.QueryRowContext(ctx, `
+		SELECT t.product_id FROM sizes s
+		JOIN thumbnails t ON s.thumbnail_id = t.id
+		WHERE s.id = ?`, sizeID).Scan(&productID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch size %d for variant sync: %v", sizeID, err)
+	}
+
+	if _, err := q.ExecContext(ctx, `
+		INSERT IGNORE INTO product_options (product_id, name, name_ru, position)
+		VALUES (?, 'color', 'Цвет', 0), (?, 'size', 'Размер', 1)`, productID, productID); err != nil {
+		return fmt.Errorf("failed to ensure legacy options: %v", err)
+	}
+
+	if _, err := q.ExecContext(ctx, `
+		INSERT INTO product_variants (product_id, sku, price, stock, legacy_size_id)
+		SELECT t.product_id, CONCAT('P', t.product_id, '-S', s.id), COALESCE(s.price, p.price), GREATEST(COALESCE(s.count, 0), 0), s.id
+		FROM sizes s
+		JOIN thumbnails t ON s.thumbnail_id = t.id
+		JOIN products p ON t.product_id = p.id
+		WHERE s.id = ?
+		ON DUPLICATE KEY UPDATE price = VALUES(price), stock = VALUES(stock)`, sizeID); err != nil {
+		return fmt.Errorf("failed to sync variant for size %d: %v", sizeID, err)
+	}
+
+	if _, err := q.ExecContext(ctx, `
+		INSERT INTO product_variant_values (variant_id, option_id, value, value_ru)
+		SELECT v.id, o.id, COALESCE(s.size, ''), COALESCE(s.size, '')
+		FROM product_variants v
+		JOIN sizes s ON v.legacy_size_id = s.id
+		JOIN product_options o ON o.product_id = v.product_id AND o.name = 'size'
+		WHERE s.id = ?
+		ON DUPLICATE KEY UPDATE value = VALUES(value), value_ru = VALUES(value_ru)`, sizeID); err != nil {
+		return fmt.Errorf("failed to sync size value for size %d: %v", sizeID, err)
+	}
+
+	var thumbnailID int
+	if err := q.QueryRowContext(ctx, "SELECT thumbnail_id FROM sizes WHERE id = ?", sizeID).Scan(&thumbnailID); err != nil {
+		return fmt.Errorf("failed to fetch thumbnail of size %d: %v", sizeID, err)
+	}
+	return syncThumbnailVariants(ctx, q, thumbnailID)
+}
+
+// syncThumbnailVariants mirrors a legacy thumbnail's color and image into the variants of its sizes
+func syncThumbnailVariants(ctx context.Context, q execer, thumbnailID int) error {
+	if _, err := q.ExecContext(ctx, `
+		INSERT INTO product_variant_values (variant_id, option_id, value, value_ru)
+		SELECT v.id, o.id, COALESCE(t.color, ''), COALESCE(t.color_ru, '')
+		FROM product_variants v
+		JOIN sizes s ON v.legacy_size_id = s.id
+		JOIN thumbnails t ON s.thumbnail_id = t.id
+		JOIN product_options o ON o.product_id = v.product_id AND o.name = 'color'
+		WHERE t.id = ?
+		ON DUPLICATE KEY UPDATE value = VALUES(value), value_ru = VALUES(value_ru)`, thumbnailID); err != nil {
+		return fmt.Errorf("failed to sync color for thumbnail %d: %v", thumbnailID, err)
+	}
+
+	if _, err := q.ExecContext(ctx, "DELETE FROM product_variant_images WHERE legacy_thumbnail_id = ?", thumbnailID); err != nil {
+		return fmt.Errorf("failed to clear images for thumbnail %d: %v", thumbnailID, err)
+	}
+	if _, err := q.ExecContext(ctx, `
+		INSERT INTO product_variant_images (variant_id, image_url, position, legacy_thumbnail_id)
+		SELECT v.id, t.image_url, 0, t.id
+		FROM product_variants v
+		JOIN sizes s ON v.legacy_size_id = s.id
+		JOIN thumbnails t ON s.thumbnail_id = t.id
+		WHERE t.id = ? AND t.image_url IS NOT NULL AND t.image_url <> ''`, thumbnailID); err != nil {
+		return fmt.Errorf("failed to sync images for thumbnail %d: %v", thumbnailID, err)
+	}
+	return nil
+}
+
+// invalidateMarketProductCaches drops cached product listings of a market and the global listings
+func (s *DBService) invalidateMarketProductCaches(ctx context.Context, marketID int) {
+	pipe := s.redis.Pipeline()
+	marketKeys, err := s.redis.SMembers(ctx, fmt.Sprintf("market:%d:products_cache_keys", marketID)).Result()
+	if err == nil && len(marketKeys) > 0 {
+		pipe.Del(ctx, marketKeys...)
+	} else if err != nil && err != redis.Nil {
+		slog.WarnContext(ctx, "Failed to fetch market cache keys", "error", err)
+	}
+
+	globalKeys, err := s.redis.SMembers(ctx, "global_products_cache_keys").Result()
+	if err == nil && len(globalKeys) > 0 {
+		pipe.Del(ctx, globalKeys...)
+	} else if err != nil && err != redis.Nil {
+		slog.WarnContext(ctx, "Failed to fetch global cache keys", "error", err)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		slog.WarnContext(ctx, "Failed to invalidate caches", "error", err)
+	}
+}